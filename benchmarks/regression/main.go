@@ -0,0 +1,283 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Mount a bucket with a given gcsfuse binary and set of flags, run a fixed
+// suite of workloads against it, and write a report that can be compared with
+// the report from another run. For example, to check a release candidate
+// against the previous release using the in-process fake bucket:
+//
+//     regression --gcsfuse old/gcsfuse --output old.json
+//     regression --gcsfuse new/gcsfuse --baseline old.json
+//
+// The second command exits with an error if any workload got worse by more
+// than --threshold. To compare two existing reports without running anything,
+// pass the newer one as an argument:
+//
+//     regression --baseline old.json new.json
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/jacobsa/fuse"
+)
+
+var fGcsfuse = flag.String("gcsfuse", "gcsfuse", "The gcsfuse binary to run.")
+var fBucket = flag.String(
+	"bucket",
+	canned.FakeBucketName,
+	"The bucket to mount. The default is an in-memory fake.")
+
+var fGcsfuseFlags = flag.String(
+	"gcsfuse_flags",
+	"",
+	"Space-separated flags to mount with, e.g. \"--stat-cache-ttl 0\".")
+
+var fDir = flag.String(
+	"dir",
+	"",
+	"Run against this already-mounted directory instead of mounting.")
+
+var fLabel = flag.String("label", "", "A name for this run in the report.")
+var fOutput = flag.String("output", "", "A file to write the report to.")
+var fBaseline = flag.String("baseline", "", "A report to compare against.")
+var fThreshold = flag.Float64(
+	"threshold",
+	0.1,
+	"The fraction by which a metric may get worse before it is a regression.")
+
+var fFileSize = flag.Int64("file_size", 1<<26, "Size of the large file.")
+var fIOSize = flag.Int64("io_size", 1<<20, "Size of each read and write.")
+var fRandomReads = flag.Int("random_reads", 256, "Number of random reads.")
+var fSmallFiles = flag.Int("small_files", 256, "Number of small files.")
+var fSmallFileSize = flag.Int64("small_file_size", 4096, "Size of small files.")
+var fIterations = flag.Int("iterations", 4, "Times to repeat each workload.")
+var fSeed = flag.Int64("seed", 1, "Seed for file contents and read offsets.")
+
+////////////////////////////////////////////////////////////////////////
+// Mounting
+////////////////////////////////////////////////////////////////////////
+
+// Return the version string printed by the gcsfuse binary.
+func gcsfuseVersion() (v string, err error) {
+	output, err := exec.Command(*fGcsfuse, "--version").CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("%s --version: %v", *fGcsfuse, err)
+		return
+	}
+
+	v = strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	return
+}
+
+// Mount the bucket on a new temporary directory. gcsfuse returns once the
+// file system is ready.
+func mount(flags []string) (dir string, err error) {
+	dir, err = ioutil.TempDir("", "gcsfuse_regression")
+	if err != nil {
+		err = fmt.Errorf("TempDir: %v", err)
+		return
+	}
+
+	args := append(append([]string{}, flags...), *fBucket, dir)
+	output, err := exec.Command(*fGcsfuse, args...).CombinedOutput()
+	if err != nil {
+		os.Remove(dir)
+		err = fmt.Errorf("gcsfuse: %v; output:\n%s", err, output)
+		return
+	}
+
+	return
+}
+
+// Unmount the file system and remove its mount point, retrying while the
+// kernel still considers it busy.
+func unmount(dir string) (err error) {
+	delay := 10 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err = fuse.Unmount(dir)
+		if err == nil {
+			break
+		}
+
+		if strings.Contains(err.Error(), "busy") && attempt < 10 {
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+
+		err = fmt.Errorf("Unmount: %v", err)
+		return
+	}
+
+	err = os.Remove(dir)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// main logic
+////////////////////////////////////////////////////////////////////////
+
+// Run the workloads and return a report of them.
+func measure() (r *Report, err error) {
+	r = &Report{
+		Label:  *fLabel,
+		Bucket: *fBucket,
+		Flags:  strings.Fields(*fGcsfuseFlags),
+		Time:   time.Now(),
+	}
+
+	// Mount if necessary.
+	dir := *fDir
+	if dir == "" {
+		r.Version, err = gcsfuseVersion()
+		if err != nil {
+			return
+		}
+
+		log.Printf("Mounting %s with %s %v.", *fBucket, r.Version, r.Flags)
+		dir, err = mount(r.Flags)
+		if err != nil {
+			err = fmt.Errorf("mount: %v", err)
+			return
+		}
+
+		defer func() {
+			unmountErr := unmount(dir)
+			if err == nil {
+				err = unmountErr
+			}
+		}()
+	}
+
+	if r.Label == "" {
+		r.Label = r.Version
+	}
+
+	// Work within a scratch directory, so that a real bucket is left as we
+	// found it.
+	scratch := path.Join(
+		dir,
+		fmt.Sprintf("gcsfuse_regression_%d", os.Getpid()))
+
+	err = os.Mkdir(scratch, 0700)
+	if err != nil {
+		err = fmt.Errorf("Mkdir: %v", err)
+		return
+	}
+
+	defer os.RemoveAll(scratch)
+
+	cfg := &config{
+		FileSize:      *fFileSize,
+		IOSize:        *fIOSize,
+		RandomReads:   *fRandomReads,
+		SmallFiles:    *fSmallFiles,
+		SmallFileSize: *fSmallFileSize,
+		Iterations:    *fIterations,
+		Seed:          *fSeed,
+	}
+
+	log.Printf("Running %d workloads in %s.", len(workloads), scratch)
+	r.Results, err = runWorkloads(scratch, cfg)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func run() (err error) {
+	if *fIOSize <= 0 || *fIterations <= 0 || *fSmallFiles <= 0 {
+		err = errors.New(
+			"--io_size, --iterations, and --small_files must be positive.")
+		return
+	}
+
+	// Load or produce the report.
+	var r *Report
+	switch flag.NArg() {
+	case 0:
+		r, err = measure()
+		if err != nil {
+			return
+		}
+
+	case 1:
+		r, err = readReport(flag.Arg(0))
+		if err != nil {
+			return
+		}
+
+	default:
+		err = errors.New("Expected at most one report to compare.")
+		return
+	}
+
+	printReport(os.Stdout, r)
+
+	if *fOutput != "" {
+		err = writeReport(*fOutput, r)
+		if err != nil {
+			err = fmt.Errorf("writeReport: %v", err)
+			return
+		}
+	}
+
+	// Compare against the baseline.
+	if *fBaseline == "" {
+		return
+	}
+
+	baseline, err := readReport(*fBaseline)
+	if err != nil {
+		return
+	}
+
+	regressions := compare(baseline, r, *fThreshold)
+	fmt.Printf("\nCompared with %s:\n", baseline.Label)
+	for _, reg := range regressions {
+		fmt.Printf("  %v\n", reg)
+	}
+
+	if len(regressions) != 0 {
+		err = fmt.Errorf("%d regressions", len(regressions))
+		return
+	}
+
+	fmt.Println("  No regressions.")
+	return
+}
+
+func main() {
+	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
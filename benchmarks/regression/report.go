@@ -0,0 +1,236 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/benchmarks/internal/format"
+	"github.com/googlecloudplatform/gcsfuse/benchmarks/internal/percentile"
+)
+
+// A report of one run of the benchmark suite, written as JSON so that runs
+// against different versions and flags can be compared later.
+type Report struct {
+	Label   string    `json:"label"`
+	Version string    `json:"version"`
+	Bucket  string    `json:"bucket"`
+	Flags   []string  `json:"flags"`
+	Time    time.Time `json:"time"`
+	Results []Result  `json:"results"`
+}
+
+// The outcome of a single workload.
+type Result struct {
+	Name string `json:"name"`
+
+	// The number of operations timed, and the number of bytes they moved. Bytes
+	// is zero for workloads measuring metadata operations.
+	Ops   int   `json:"ops"`
+	Bytes int64 `json:"bytes"`
+
+	// The total time taken, and percentiles of the time taken by each
+	// operation.
+	Elapsed time.Duration `json:"elapsed"`
+	P50     time.Duration `json:"p50"`
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+}
+
+// Summarize the supplied observations, one per operation.
+//
+// REQUIRES: len(observations) > 0
+func summarize(
+	name string,
+	bytes int64,
+	elapsed time.Duration,
+	observations percentile.DurationSlice) (r Result) {
+	sort.Sort(observations)
+	r = Result{
+		Name:    name,
+		Ops:     len(observations),
+		Bytes:   bytes,
+		Elapsed: elapsed,
+		P50:     percentile.Duration(observations, 50),
+		P90:     percentile.Duration(observations, 90),
+		P99:     percentile.Duration(observations, 99),
+	}
+
+	return
+}
+
+// Return bytes per second, or operations per second if the workload moved no
+// data.
+func (r *Result) Throughput() float64 {
+	seconds := float64(r.Elapsed) / float64(time.Second)
+	if seconds == 0 {
+		return 0
+	}
+
+	if r.Bytes == 0 {
+		return float64(r.Ops) / seconds
+	}
+
+	return float64(r.Bytes) / seconds
+}
+
+func (r *Result) formatThroughput(v float64) string {
+	if r.Bytes == 0 {
+		return format.Hertz(v)
+	}
+
+	return format.Bytes(v) + "/s"
+}
+
+func readReport(path string) (r *Report, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	r = new(Report)
+	err = json.NewDecoder(f).Decode(r)
+	if err != nil {
+		err = fmt.Errorf("Decoding %s: %v", path, err)
+		return
+	}
+
+	return
+}
+
+func writeReport(path string, r *Report) (err error) {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("MarshalIndent: %v", err)
+		return
+	}
+
+	err = ioutil.WriteFile(path, append(b, '\n'), 0644)
+	return
+}
+
+func printReport(w io.Writer, r *Report) {
+	fmt.Fprintf(w, "%s (%s)\n", r.Label, r.Version)
+	fmt.Fprintf(w, "  bucket: %s, flags: %v\n\n", r.Bucket, r.Flags)
+	for i := range r.Results {
+		res := &r.Results[i]
+		fmt.Fprintf(
+			w,
+			"  %-14s %6d ops %14s  p50 %10v  p90 %10v  p99 %10v\n",
+			res.Name,
+			res.Ops,
+			res.formatThroughput(res.Throughput()),
+			res.P50,
+			res.P90,
+			res.P99)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Comparison
+////////////////////////////////////////////////////////////////////////
+
+// A metric that got worse between two reports by more than the allowed
+// fraction.
+type Regression struct {
+	Workload string
+	Metric   string
+	Old      string
+	New      string
+
+	// The fractional change, positive meaning worse.
+	Change float64
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf(
+		"%s %s: %s -> %s (%+.1f%%)",
+		r.Workload,
+		r.Metric,
+		r.Old,
+		r.New,
+		100*r.Change)
+}
+
+// Compare the workloads common to the two reports, returning the metrics that
+// got worse by more than the given fraction. Throughput and the 50th and 90th
+// percentile latencies are compared; the 99th is too noisy to gate on.
+func compare(
+	baseline *Report,
+	current *Report,
+	threshold float64) (regressions []Regression) {
+	old := make(map[string]*Result)
+	for i := range baseline.Results {
+		old[baseline.Results[i].Name] = &baseline.Results[i]
+	}
+
+	for i := range current.Results {
+		cur := &current.Results[i]
+		prev, ok := old[cur.Name]
+		if !ok {
+			continue
+		}
+
+		// Throughput regresses when it falls.
+		if prevT := prev.Throughput(); prevT > 0 {
+			curT := cur.Throughput()
+			if change := (prevT - curT) / prevT; change > threshold {
+				regressions = append(regressions, Regression{
+					Workload: cur.Name,
+					Metric:   "throughput",
+					Old:      prev.formatThroughput(prevT),
+					New:      cur.formatThroughput(curT),
+					Change:   change,
+				})
+			}
+		}
+
+		// Latency regresses when it rises.
+		latencies := []struct {
+			metric    string
+			prev, cur time.Duration
+		}{
+			{"p50", prev.P50, cur.P50},
+			{"p90", prev.P90, cur.P90},
+		}
+
+		for _, l := range latencies {
+			if l.prev <= 0 {
+				continue
+			}
+
+			change := float64(l.cur-l.prev) / float64(l.prev)
+			if change > threshold {
+				regressions = append(regressions, Regression{
+					Workload: cur.Name,
+					Metric:   l.metric,
+					Old:      l.prev.String(),
+					New:      l.cur.String(),
+					Change:   change,
+				})
+			}
+		}
+	}
+
+	return
+}
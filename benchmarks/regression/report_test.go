@@ -0,0 +1,188 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestReport(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ReportTest struct {
+	baseline Report
+}
+
+func init() { RegisterTestSuite(&ReportTest{}) }
+
+func (t *ReportTest) SetUp(ti *TestInfo) {
+	t.baseline = Report{
+		Label: "old",
+		Results: []Result{
+			{
+				Name:    "read_seq",
+				Ops:     4,
+				Bytes:   400,
+				Elapsed: time.Second,
+				P50:     100 * time.Millisecond,
+				P90:     200 * time.Millisecond,
+			},
+			{
+				Name:    "stat",
+				Ops:     100,
+				Elapsed: time.Second,
+				P50:     time.Millisecond,
+				P90:     2 * time.Millisecond,
+			},
+		},
+	}
+}
+
+// Return a copy of the baseline with the named result modified.
+func (t *ReportTest) with(name string, f func(r *Result)) (r *Report) {
+	r = &Report{Label: "new"}
+	r.Results = append(r.Results, t.baseline.Results...)
+	for i := range r.Results {
+		if r.Results[i].Name == name {
+			f(&r.Results[i])
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReportTest) Throughput() {
+	ExpectEq(400, t.baseline.Results[0].Throughput())
+	ExpectEq(100, t.baseline.Results[1].Throughput())
+}
+
+func (t *ReportTest) NoChange() {
+	ExpectEq(0, len(compare(&t.baseline, &t.baseline, 0.1)))
+}
+
+func (t *ReportTest) WithinThreshold() {
+	r := t.with("read_seq", func(r *Result) {
+		r.Elapsed = 1050 * time.Millisecond
+		r.P50 = 105 * time.Millisecond
+	})
+
+	ExpectEq(0, len(compare(&t.baseline, r, 0.1)))
+}
+
+func (t *ReportTest) SlowerThroughput() {
+	r := t.with("read_seq", func(r *Result) {
+		r.Elapsed = 2 * time.Second
+	})
+
+	regressions := compare(&t.baseline, r, 0.1)
+	AssertEq(1, len(regressions))
+	ExpectEq("read_seq", regressions[0].Workload)
+	ExpectEq("throughput", regressions[0].Metric)
+	ExpectEq(0.5, regressions[0].Change)
+}
+
+func (t *ReportTest) HigherLatency() {
+	r := t.with("stat", func(r *Result) {
+		r.P90 = 3 * time.Millisecond
+	})
+
+	regressions := compare(&t.baseline, r, 0.1)
+	AssertEq(1, len(regressions))
+	ExpectEq("stat", regressions[0].Workload)
+	ExpectEq("p90", regressions[0].Metric)
+	ExpectThat(regressions[0].String(), HasSubstr("2ms -> 3ms (+50.0%)"))
+}
+
+func (t *ReportTest) ImprovementsIgnored() {
+	r := t.with("stat", func(r *Result) {
+		r.Elapsed = time.Second / 2
+		r.P50 = 0
+		r.P90 = time.Millisecond
+	})
+
+	ExpectEq(0, len(compare(&t.baseline, r, 0.1)))
+}
+
+func (t *ReportTest) NewWorkloadsIgnored() {
+	r := &Report{
+		Results: []Result{{Name: "list", Ops: 1, Elapsed: time.Hour}},
+	}
+
+	ExpectEq(0, len(compare(&t.baseline, r, 0.1)))
+}
+
+func (t *ReportTest) RoundTrip() {
+	dir, err := ioutil.TempDir("", "report_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "report.json")
+	AssertEq(nil, writeReport(p, &t.baseline))
+
+	r, err := readReport(p)
+	AssertEq(nil, err)
+	ExpectEq("old", r.Label)
+	AssertEq(2, len(r.Results))
+	ExpectThat(r.Results[0], DeepEquals(t.baseline.Results[0]))
+}
+
+func (t *ReportTest) WorkloadsOnLocalDisk() {
+	dir, err := ioutil.TempDir("", "report_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &config{
+		FileSize:      1 << 16,
+		IOSize:        1 << 12,
+		RandomReads:   8,
+		SmallFiles:    4,
+		SmallFileSize: 16,
+		Iterations:    2,
+		Seed:          1,
+	}
+
+	results, err := runWorkloads(dir, cfg)
+	AssertEq(nil, err)
+	AssertEq(len(workloads), len(results))
+
+	for i, r := range results {
+		ExpectEq(workloads[i].name, r.Name)
+	}
+
+	ExpectEq(2<<16, results[0].Bytes)
+	ExpectEq(2<<16, results[1].Bytes)
+	ExpectEq(8<<12, results[2].Bytes)
+	ExpectEq(8, results[4].Ops)
+
+	// Everything was cleaned up except the large file.
+	entries, err := ioutil.ReadDir(dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("large", entries[0].Name())
+}
@@ -0,0 +1,316 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/benchmarks/internal/percentile"
+)
+
+// The parameters of the workloads. These are fixed by flags rather than by
+// duration so that runs do the same amount of work and can be compared.
+type config struct {
+	FileSize      int64
+	IOSize        int64
+	RandomReads   int
+	SmallFiles    int
+	SmallFileSize int64
+	Iterations    int
+	Seed          int64
+}
+
+// A workload runs within a scratch directory on the file system under test.
+// It may rely on files left behind by the workloads that run before it.
+type workload struct {
+	name string
+	run  func(dir string, cfg *config) (r Result, err error)
+}
+
+// The workloads run by the suite, in order.
+var workloads = []workload{
+	{"write_seq", writeSequential},
+	{"read_seq", readSequential},
+	{"read_random", readRandom},
+	{"create_small", createSmall},
+	{"stat", statSmall},
+	{"list", listSmall},
+	{"delete", deleteSmall},
+}
+
+// Run each workload in turn.
+func runWorkloads(dir string, cfg *config) (results []Result, err error) {
+	for _, w := range workloads {
+		var r Result
+		r, err = w.run(dir, cfg)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", w.name, err)
+			return
+		}
+
+		r.Name = w.name
+		results = append(results, r)
+	}
+
+	return
+}
+
+// The name of the large file written and read by the sequential and random
+// workloads.
+func largeFile(dir string) string {
+	return path.Join(dir, "large")
+}
+
+func smallFile(dir string, i int) string {
+	return path.Join(dir, "small", fmt.Sprintf("%06d", i))
+}
+
+// Write the large file from scratch several times, timing from open to close
+// so that the upload performed by close is included.
+func writeSequential(dir string, cfg *config) (r Result, err error) {
+	contents := make([]byte, cfg.FileSize)
+	rand.New(rand.NewSource(cfg.Seed)).Read(contents)
+
+	var observations percentile.DurationSlice
+	start := time.Now()
+	for i := 0; i < cfg.Iterations; i++ {
+		fileStart := time.Now()
+
+		var f *os.File
+		f, err = os.Create(largeFile(dir))
+		if err != nil {
+			err = fmt.Errorf("Create: %v", err)
+			return
+		}
+
+		for off := int64(0); off < cfg.FileSize; off += cfg.IOSize {
+			end := off + cfg.IOSize
+			if end > cfg.FileSize {
+				end = cfg.FileSize
+			}
+
+			_, err = f.Write(contents[off:end])
+			if err != nil {
+				f.Close()
+				err = fmt.Errorf("Write: %v", err)
+				return
+			}
+		}
+
+		err = f.Close()
+		if err != nil {
+			err = fmt.Errorf("Close: %v", err)
+			return
+		}
+
+		observations = append(observations, time.Since(fileStart))
+	}
+
+	r = summarize(
+		"",
+		int64(cfg.Iterations)*cfg.FileSize,
+		time.Since(start),
+		observations)
+
+	return
+}
+
+// Read the large file from start to end several times.
+func readSequential(dir string, cfg *config) (r Result, err error) {
+	buf := make([]byte, cfg.IOSize)
+
+	var observations percentile.DurationSlice
+	var total int64
+	start := time.Now()
+	for i := 0; i < cfg.Iterations; i++ {
+		fileStart := time.Now()
+
+		var f *os.File
+		f, err = os.Open(largeFile(dir))
+		if err != nil {
+			err = fmt.Errorf("Open: %v", err)
+			return
+		}
+
+		var n int64
+		n, err = io.CopyBuffer(ioutil.Discard, onlyReader{f}, buf)
+		f.Close()
+		if err != nil {
+			err = fmt.Errorf("Read: %v", err)
+			return
+		}
+
+		total += n
+		observations = append(observations, time.Since(fileStart))
+	}
+
+	r = summarize("", total, time.Since(start), observations)
+	return
+}
+
+// Hide the file's WriteTo method so that io.CopyBuffer uses our buffer size.
+type onlyReader struct {
+	io.Reader
+}
+
+// Read from offsets in the large file chosen by a seeded generator, so that
+// every run reads the same ones.
+func readRandom(dir string, cfg *config) (r Result, err error) {
+	f, err := os.Open(largeFile(dir))
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, cfg.IOSize)
+	offsets := rand.New(rand.NewSource(cfg.Seed))
+	maxOffset := cfg.FileSize - cfg.IOSize + 1
+	if maxOffset < 1 {
+		maxOffset = 1
+	}
+
+	var observations percentile.DurationSlice
+	var total int64
+	start := time.Now()
+	for i := 0; i < cfg.RandomReads; i++ {
+		readStart := time.Now()
+
+		var n int
+		n, err = f.ReadAt(buf, offsets.Int63n(maxOffset))
+		if err != nil && err != io.EOF {
+			err = fmt.Errorf("ReadAt: %v", err)
+			return
+		}
+
+		err = nil
+		total += int64(n)
+		observations = append(observations, time.Since(readStart))
+	}
+
+	r = summarize("", total, time.Since(start), observations)
+	return
+}
+
+// Create a directory full of small files, each written and closed.
+func createSmall(dir string, cfg *config) (r Result, err error) {
+	err = os.Mkdir(path.Join(dir, "small"), 0700)
+	if err != nil {
+		err = fmt.Errorf("Mkdir: %v", err)
+		return
+	}
+
+	contents := make([]byte, cfg.SmallFileSize)
+	rand.New(rand.NewSource(cfg.Seed)).Read(contents)
+
+	var observations percentile.DurationSlice
+	start := time.Now()
+	for i := 0; i < cfg.SmallFiles; i++ {
+		fileStart := time.Now()
+		err = ioutil.WriteFile(smallFile(dir, i), contents, 0600)
+		if err != nil {
+			err = fmt.Errorf("WriteFile: %v", err)
+			return
+		}
+
+		observations = append(observations, time.Since(fileStart))
+	}
+
+	r = summarize("", 0, time.Since(start), observations)
+	return
+}
+
+// Stat each of the small files several times.
+func statSmall(dir string, cfg *config) (r Result, err error) {
+	var observations percentile.DurationSlice
+	start := time.Now()
+	for i := 0; i < cfg.Iterations; i++ {
+		for j := 0; j < cfg.SmallFiles; j++ {
+			statStart := time.Now()
+			_, err = os.Stat(smallFile(dir, j))
+			if err != nil {
+				err = fmt.Errorf("Stat: %v", err)
+				return
+			}
+
+			observations = append(observations, time.Since(statStart))
+		}
+	}
+
+	r = summarize("", 0, time.Since(start), observations)
+	return
+}
+
+// List the directory of small files several times.
+func listSmall(dir string, cfg *config) (r Result, err error) {
+	var observations percentile.DurationSlice
+	start := time.Now()
+	for i := 0; i < cfg.Iterations; i++ {
+		listStart := time.Now()
+
+		var entries []os.FileInfo
+		entries, err = ioutil.ReadDir(path.Join(dir, "small"))
+		if err != nil {
+			err = fmt.Errorf("ReadDir: %v", err)
+			return
+		}
+
+		if len(entries) != cfg.SmallFiles {
+			err = fmt.Errorf(
+				"Listed %d entries; expected %d",
+				len(entries),
+				cfg.SmallFiles)
+			return
+		}
+
+		observations = append(observations, time.Since(listStart))
+	}
+
+	r = summarize("", 0, time.Since(start), observations)
+	return
+}
+
+// Delete the small files and their directory.
+func deleteSmall(dir string, cfg *config) (r Result, err error) {
+	var observations percentile.DurationSlice
+	start := time.Now()
+	for i := 0; i < cfg.SmallFiles; i++ {
+		deleteStart := time.Now()
+		err = os.Remove(smallFile(dir, i))
+		if err != nil {
+			err = fmt.Errorf("Remove: %v", err)
+			return
+		}
+
+		observations = append(observations, time.Since(deleteStart))
+	}
+
+	r = summarize("", 0, time.Since(start), observations)
+
+	err = os.Remove(path.Join(dir, "small"))
+	if err != nil {
+		err = fmt.Errorf("Remove: %v", err)
+		return
+	}
+
+	return
+}
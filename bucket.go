@@ -15,15 +15,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/canned"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcscaching"
 	"github.com/jacobsa/ratelimit"
@@ -84,26 +90,600 @@ func setUpRateLimiting(
 	return
 }
 
-// Configure a bucket based on the supplied flags.
+// Wrap the supplied bucket in one that caches StatObject results as
+// configured by the stat cache flags, keeping objects that exist and those
+// that don't apart. Either kind of entry is disabled by a TTL of zero, and if
+// both are the cache returned is nil.
+func setUpStatCache(
+	in gcs.Bucket,
+	flags *flagStorage) (out gcs.Bucket, cache *gcsx.SharedStatCache) {
+	if flags.StatCacheTTL == 0 && flags.NegativeStatCacheTTL == 0 {
+		out = in
+		return
+	}
+
+	var positive, negative gcscaching.StatCache
+	switch {
+	case flags.StatCacheTTL == 0:
+	case flags.StatCacheMaxSizeMB > 0:
+		positive = gcsx.NewSizedStatCache(int64(flags.StatCacheMaxSizeMB) << 20)
+	default:
+		positive = gcscaching.NewStatCache(flags.StatCacheCapacity)
+	}
+
+	if flags.NegativeStatCacheTTL != 0 {
+		negative = gcscaching.NewStatCache(flags.NegativeStatCacheCapacity)
+	}
+
+	clock := timeutil.RealClock()
+	cache = gcsx.NewSharedStatCache(
+		gcsx.NewCountingStatCache(
+			gcsx.NewSplitStatCache(
+				positive,
+				negative,
+				flags.NegativeStatCacheTTL,
+				clock)))
+
+	out = gcscaching.NewFastStatBucket(flags.StatCacheTTL, cache, clock, in)
+
+	return
+}
+
+// The layers of the bucket set up by setUpBucket whose settings may be changed
+// while mounted, along with the buckets they wrap and their current settings.
+type bucketReloader struct {
+	unlimited            gcs.Bucket
+	limited              *gcsx.ReloadableBucket
+	opRateLimitHz        float64
+	egressBandwidthLimit float64
+
+	uncached                  gcs.Bucket
+	cached                    *gcsx.ReloadableBucket
+	statCacheTTL              time.Duration
+	statCacheCapacity         int
+	statCacheMaxSizeMB        int
+	negativeStatCacheTTL      time.Duration
+	negativeStatCacheCapacity int
+
+	statCacheMu sync.Mutex
+
+	// The cache used by the current stat cache layer, if any, from which
+	// entries may be erased concurrently with reloading.
+	//
+	// GUARDED_BY(statCacheMu)
+	statCache *gcsx.SharedStatCache
+}
+
+// Apply the rate limits and stat cache settings in the supplied flags. A layer
+// is replaced only if its settings have changed, since doing so discards the
+// allowance built up by the rate limits or the contents of the stat cache.
+//
+// Not safe for concurrent calls.
+func (r *bucketReloader) reload(flags *flagStorage) (err error) {
+	if flags.OpRateLimitHz != r.opRateLimitHz ||
+		flags.EgressBandwidthLimitBytesPerSecond != r.egressBandwidthLimit {
+		var limited gcs.Bucket
+		limited, err = setUpRateLimiting(
+			r.unlimited,
+			flags.OpRateLimitHz,
+			flags.EgressBandwidthLimitBytesPerSecond)
+
+		if err != nil {
+			err = fmt.Errorf("setUpRateLimiting: %v", err)
+			return
+		}
+
+		r.limited.Reload(limited)
+		r.opRateLimitHz = flags.OpRateLimitHz
+		r.egressBandwidthLimit = flags.EgressBandwidthLimitBytesPerSecond
+	}
+
+	if flags.StatCacheTTL != r.statCacheTTL ||
+		flags.StatCacheCapacity != r.statCacheCapacity ||
+		flags.StatCacheMaxSizeMB != r.statCacheMaxSizeMB ||
+		flags.NegativeStatCacheTTL != r.negativeStatCacheTTL ||
+		flags.NegativeStatCacheCapacity != r.negativeStatCacheCapacity {
+		cached, cache := setUpStatCache(r.uncached, flags)
+		r.cached.Reload(cached)
+		r.noteStatCache(flags, cache)
+	}
+
+	return
+}
+
+// Erase the stat cache's entry for the object with the given name, if any.
+//
+// LOCKS_EXCLUDED(r.statCacheMu)
+func (r *bucketReloader) eraseStat(name string) {
+	r.statCacheMu.Lock()
+	cache := r.statCache
+	r.statCacheMu.Unlock()
+
+	if cache != nil {
+		cache.Erase(name)
+	}
+}
+
+// Record the stat cache settings in the supplied flags, and the cache set up
+// with them, as current.
+//
+// LOCKS_EXCLUDED(r.statCacheMu)
+func (r *bucketReloader) noteStatCache(
+	flags *flagStorage,
+	cache *gcsx.SharedStatCache) {
+	r.statCacheMu.Lock()
+	r.statCache = cache
+	r.statCacheMu.Unlock()
+
+	r.statCacheTTL = flags.StatCacheTTL
+	r.statCacheCapacity = flags.StatCacheCapacity
+	r.statCacheMaxSizeMB = flags.StatCacheMaxSizeMB
+	r.negativeStatCacheTTL = flags.NegativeStatCacheTTL
+	r.negativeStatCacheCapacity = flags.NegativeStatCacheCapacity
+}
+
+// Parse the value of --prefix-dirs, a semicolon-separated list of name:prefix
+// pairs, into a map suitable for gcsx.NewMultiPrefixBucket.
+func parsePrefixDirs(s string) (dirs map[string]string, err error) {
+	dirs = make(map[string]string)
+	for _, pair := range strings.Split(s, ";") {
+		if pair == "" {
+			continue
+		}
+
+		i := strings.Index(pair, ":")
+		if i < 0 {
+			err = fmt.Errorf("Missing colon in %q", pair)
+			return
+		}
+
+		name := pair[:i]
+		prefix := strings.Trim(pair[i+1:], "/")
+		if prefix != "" {
+			prefix = path.Clean(prefix) + "/"
+		}
+
+		if _, ok := dirs[name]; ok {
+			err = fmt.Errorf("Duplicate directory name: %q", name)
+			return
+		}
+
+		dirs[name] = prefix
+	}
+
+	return
+}
+
+// How often to try applying writes queued while GCS was unavailable.
+const offlineReplayPeriod = 30 * time.Second
+
+// How long to wait before retrying a request that GCS throttled, at first.
+const throttledRetryBackoff = time.Second
+
+// How long to wait before retrying a failed request, at most, at first.
+const retryInitialBackoff = time.Second
+
+// How often to set the customTime of objects read recently, and how many to
+// set per second at most.
+const customTimeFlushPeriod = time.Minute
+const customTimeRateHz = 10
+
+// Open the named bucket.
 //
 // Special case: if the bucket name is canned.FakeBucketName, set up a fake
 // bucket as described in that package.
-func setUpBucket(
+func openBucket(
 	ctx context.Context,
 	flags *flagStorage,
 	conn gcs.Conn,
 	name string) (b gcs.Bucket, err error) {
-	// Set up the appropriate backing bucket.
 	if name == canned.FakeBucketName {
 		b = canned.MakeFakeBucket(ctx)
+		return
+	}
+
+	b, err = conn.OpenBucket(ctx, &gcs.OpenBucketOptions{Name: name, BillingProject: flags.BillingProject})
+	if err != nil {
+		err = fmt.Errorf("OpenBucket: %v", err)
+		return
+	}
+
+	return
+}
+
+// Set up a bucket in which each bucket in the project named by --project, or
+// that of the default credentials, appears as a top-level directory.
+func setUpAllBuckets(
+	ctx context.Context,
+	flags *flagStorage,
+	conn gcs.Conn,
+	client *http.Client) (b gcs.Bucket, err error) {
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"only-dir", flags.OnlyDir != ""},
+		{"prefix-dirs", flags.PrefixDirs != ""},
+		{"mapping-file", flags.MappingFile != ""},
+		{"mapping", len(flags.Mapping) != 0},
+		{"versions-dir", flags.VersionsDir != ""},
+		{"failover-bucket", flags.FailoverBucket != ""},
+		{"inventory-report", flags.InventoryReport != ""},
+		{"prefetch-metadata", flags.PrefetchMetadata.Enabled},
+		{"custom-time-interval", flags.CustomTimeInterval != 0},
+		{"reflect-iam-permissions", flags.ReflectIAMPermissions},
+		{"write-lease-ttl", flags.WriteLeaseTTL != 0},
+	} {
+		if f.set {
+			err = fmt.Errorf("--%s can't be used when mounting all buckets", f.name)
+			return
+		}
+	}
+
+	project := flags.Project
+	if project == "" {
+		var creds *google.DefaultCredentials
+		creds, err = google.FindDefaultCredentials(ctx)
+		if err == nil {
+			project = creds.ProjectID
+		}
+	}
+
+	if project == "" {
+		err = errors.New(
+			"Can't tell which project's buckets to mount; use --project")
+		return
+	}
+
+	list := func(ctx context.Context) (names []string, err error) {
+		names, err = gcsx.ListBuckets(ctx, client, project, userAgent)
+		if err != nil {
+			err = fmt.Errorf("ListBuckets: %v", err)
+			return
+		}
+
+		return
+	}
+
+	// A bucket that doesn't exist or that we may not use simply doesn't appear.
+	// Other failures, such as timeouts, are reported as they are, so that the
+	// bucket isn't mistaken for missing and is tried again next time.
+	open := func(ctx context.Context, name string) (b gcs.Bucket, err error) {
+		err = gcsx.ProbeBucket(
+			ctx,
+			client,
+			userAgent,
+			name,
+			flags.BillingProject)
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			logger.Infof("Not attaching bucket %q: %v", name, err)
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("ProbeBucket: %v", err)
+			return
+		}
+
+		b, err = openBucket(ctx, flags, conn, name)
+		if err != nil {
+			return
+		}
+
+		logger.Infof("Attached bucket %q.", name)
+		return
+	}
+
+	b = gcsx.NewDynamicBucket(
+		allBucketsName,
+		list,
+		open,
+		timeutil.RealClock())
+	return
+}
+
+// Wrap the supplied bucket so that it answers first listings from the
+// inventory report named by --inventory-report.
+func setUpInventory(
+	ctx context.Context,
+	flags *flagStorage,
+	conn gcs.Conn,
+	b gcs.Bucket) (out gcs.Bucket, err error) {
+	if flags.PrefixDirs != "" || hasMapping(flags) {
+		err = errors.New(
+			"--inventory-report is incompatible with --prefix-dirs and " +
+				"--mapping-file")
+		return
+	}
+
+	report := strings.TrimPrefix(flags.InventoryReport, "gs://")
+	slash := strings.Index(report, "/")
+	if slash <= 0 {
+		err = fmt.Errorf(
+			"--inventory-report must be of the form bucket/prefix, not %q",
+			flags.InventoryReport)
+		return
+	}
+
+	reportBucket, err := openBucket(ctx, flags, conn, report[:slash])
+	if err != nil {
+		err = fmt.Errorf("Opening inventory report bucket: %v", err)
+		return
+	}
+
+	index, err := gcsx.LoadInventoryReport(ctx, reportBucket, report[slash+1:])
+	if err != nil {
+		err = fmt.Errorf("LoadInventoryReport: %v", err)
+		return
+	}
+
+	logger.Infof(
+		"Loaded inventory report of %d objects written %v ago.",
+		index.Len(),
+		time.Since(index.Updated()).Truncate(time.Second))
+
+	var prefix string
+	if flags.OnlyDir != "" {
+		prefix = path.Clean(flags.OnlyDir) + "/"
+	}
+
+	out = gcsx.NewInventoryBucket(index, prefix, b)
+	return
+}
+
+// List the objects selected by --prefetch-metadata, returning a bucket that
+// answers the first listing of each directory among them from the result.
+func setUpPrefetch(
+	ctx context.Context,
+	flags *flagStorage,
+	b gcs.Bucket) (out gcs.Bucket, err error) {
+	start := time.Now()
+	index, err := gcsx.IndexObjects(ctx, b, flags.PrefetchMetadata.Prefix)
+	if err != nil {
+		err = fmt.Errorf("IndexObjects: %v", err)
+		return
+	}
+
+	logger.Infof(
+		"Prefetched metadata for %d objects in %v.",
+		index.Len(),
+		time.Since(start).Truncate(time.Millisecond))
+
+	out = gcsx.NewInventoryBucket(index, "", b)
+	return
+}
+
+// Wrap the supplied bucket so that every generation of its objects appears
+// beneath the directory named by --versions-dir.
+func setUpVersions(
+	flags *flagStorage,
+	client *http.Client,
+	name string,
+	b gcs.Bucket) (out gcs.Bucket, err error) {
+	if client == nil {
+		err = errors.New("--versions-dir requires a real bucket")
+		return
+	}
+
+	if flags.PrefixDirs != "" || hasMapping(flags) {
+		err = errors.New(
+			"--versions-dir is incompatible with --prefix-dirs and --mapping-file")
+		return
+	}
+
+	var prefix string
+	if flags.OnlyDir != "" {
+		prefix = path.Clean(flags.OnlyDir) + "/"
+	}
+
+	out, err = gcsx.NewVersionsBucket(
+		flags.VersionsDir,
+		gcsx.NewVersions(client, name, prefix, userAgent),
+		b)
+
+	return
+}
+
+// Return Folders for the named bucket if it has a hierarchical namespace, or
+// nil if it doesn't or it isn't possible to tell.
+func setUpFolders(
+	ctx context.Context,
+	flags *flagStorage,
+	client *http.Client,
+	name string) (folders gcsx.Folders) {
+	// Directories presented by --prefix-dirs and --mapping-file, or for each
+	// bucket when mounting all of them, don't correspond to folders.
+	if client == nil ||
+		name == allBucketsName ||
+		flags.PrefixDirs != "" ||
+		hasMapping(flags) {
+		return
+	}
+
+	hns, err := gcsx.IsHierarchical(ctx, client, name, userAgent)
+	if err != nil {
+		logger.Warningf("Treating bucket as flat: IsHierarchical: %v", err)
+		return
+	}
+
+	if !hns {
+		return
+	}
+
+	var prefix string
+	if flags.OnlyDir != "" {
+		prefix = path.Clean(flags.OnlyDir) + "/"
+	}
+
+	folders = gcsx.NewFolders(client, name, prefix, userAgent)
+	return
+}
+
+// Return ManagedFolders for the named bucket if it has any managed folders
+// within the part of it that is mounted, or nil if it doesn't or it isn't
+// possible to tell.
+func setUpManagedFolders(
+	ctx context.Context,
+	flags *flagStorage,
+	client *http.Client,
+	name string) (folders gcsx.ManagedFolders) {
+	// As for folders, the directories presented by these flags don't
+	// correspond to managed folders.
+	if client == nil ||
+		name == allBucketsName ||
+		flags.PrefixDirs != "" ||
+		hasMapping(flags) {
+		return
+	}
+
+	var prefix string
+	if flags.OnlyDir != "" {
+		prefix = path.Clean(flags.OnlyDir) + "/"
+	}
+
+	has, err := gcsx.HasManagedFolders(ctx, client, name, prefix, userAgent)
+	if err != nil {
+		logger.Warningf("Ignoring managed folders: HasManagedFolders: %v", err)
+		return
+	}
+
+	if !has {
+		return
+	}
+
+	folders = gcsx.NewManagedFolders(client, name, prefix, userAgent)
+	return
+}
+
+// Wrap the supplied bucket so that it retries requests according to the
+// supplied flags.
+func newRetryBucket(flags *flagStorage, wrapped gcs.Bucket) gcs.Bucket {
+	def := gcsx.RetryPolicy{
+		MaxAttempts:    flags.MaxRetryAttempts,
+		MaxSleep:       flags.MaxRetrySleep,
+		Multiplier:     flags.RetryMultiplier,
+		RetryableCodes: flags.RetryableCodes,
+	}
+
+	perOp := make(map[string]gcsx.RetryPolicy)
+	for _, o := range flags.RetryOverrides {
+		p, ok := perOp[o.Op]
+		if !ok {
+			p = def
+		}
+
+		perOp[o.Op] = o.Apply(p)
+	}
+
+	return gcsx.NewRetryBucket(retryInitialBackoff, def, perOp, wrapped)
+}
+
+// Configure a bucket based on the supplied flags. If the bucket has a
+// hierarchical namespace, also return Folders with which to manage it.
+func setUpBucket(
+	ctx context.Context,
+	flags *flagStorage,
+	conn gcs.Conn,
+	client *http.Client,
+	name string) (
+	b gcs.Bucket,
+	folders gcsx.Folders,
+	reloader *bucketReloader,
+	err error) {
+	// Set up the appropriate backing bucket.
+	if name == allBucketsName {
+		b, err = setUpAllBuckets(ctx, flags, conn, client)
+		if err != nil {
+			err = fmt.Errorf("setUpAllBuckets: %v", err)
+			return
+		}
 	} else {
-		b, err = conn.OpenBucket(ctx, &gcs.OpenBucketOptions{Name: name, BillingProject: flags.BillingProject})
+		b, err = openBucket(ctx, flags, conn, name)
 		if err != nil {
-			err = fmt.Errorf("OpenBucket: %v", err)
 			return
 		}
 	}
 
+	// Back off as a whole when GCS throttles us, if requested.
+	if flags.MaxConcurrentRequests > 0 {
+		b = gcsx.NewAdaptiveBucket(
+			flags.MaxConcurrentRequests,
+			throttledRetryBackoff,
+			b)
+	}
+
+	// Retry failed requests, if requested. This comes after the limit above so
+	// that requests waiting to be retried don't count towards it.
+	if flags.MaxRetryAttempts > 0 || len(flags.RetryOverrides) != 0 {
+		b = newRetryBucket(flags, b)
+	}
+
+	// Read from a mirror when the bucket is unavailable, if requested.
+	if flags.FailoverBucket != "" {
+		var mirror gcs.Bucket
+		mirror, err = openBucket(ctx, flags, conn, flags.FailoverBucket)
+		if err != nil {
+			err = fmt.Errorf("Opening failover bucket: %v", err)
+			return
+		}
+
+		b = gcsx.NewFailoverBucket(
+			b,
+			mirror,
+			flags.FailoverAfter,
+			flags.StatCacheCapacity)
+	}
+
+	// Keep working while GCS can't be reached, if requested.
+	if flags.OfflineQueueDir != "" {
+		var ob *gcsx.OfflineBucket
+		ob, err = gcsx.NewOfflineBucket(
+			flags.OfflineQueueDir,
+			flags.StatCacheCapacity,
+			timeutil.RealClock(),
+			b)
+
+		if err != nil {
+			err = fmt.Errorf("NewOfflineBucket: %v", err)
+			return
+		}
+
+		// Apply anything left over from last time right away, then check back
+		// periodically.
+		go func() {
+			ob.Replay(context.Background())
+			ob.ReplayPeriodically(context.Background(), offlineReplayPeriod)
+		}()
+
+		b = ob
+	}
+
+	// Set the customTime of objects as they're read, if requested.
+	if flags.CustomTimeInterval != 0 {
+		if client == nil {
+			err = errors.New("--custom-time-interval requires a real bucket")
+			return
+		}
+
+		var cb *gcsx.CustomTimeBucket
+		cb, err = gcsx.NewCustomTimeBucket(
+			flags.CustomTimeInterval,
+			customTimeRateHz,
+			flags.StatCacheCapacity,
+			timeutil.RealClock(),
+			gcsx.NewCustomTimeSetter(client, name, userAgent),
+			b)
+
+		if err != nil {
+			err = fmt.Errorf("NewCustomTimeBucket: %v", err)
+			return
+		}
+
+		go cb.FlushPeriodically(context.Background(), customTimeFlushPeriod)
+		b = cb
+	}
+
 	// Limit to a requested prefix of the bucket, if any.
 	if flags.OnlyDir != "" {
 		b, err = gcsx.NewPrefixBucket(path.Clean(flags.OnlyDir)+"/", b)
@@ -113,7 +693,62 @@ func setUpBucket(
 		}
 	}
 
-	// Enable rate limiting, if requested.
+	// Or to a set of prefixes, if requested.
+	if flags.PrefixDirs != "" {
+		if flags.OnlyDir != "" {
+			err = errors.New("--only-dir and --prefix-dirs are incompatible")
+			return
+		}
+
+		var dirs map[string]string
+		dirs, err = parsePrefixDirs(flags.PrefixDirs)
+		if err != nil {
+			err = fmt.Errorf("parsePrefixDirs: %v", err)
+			return
+		}
+
+		b, err = gcsx.NewMultiPrefixBucket(dirs, tmpObjectPrefix, b)
+		if err != nil {
+			err = fmt.Errorf("NewMultiPrefixBucket: %v", err)
+			return
+		}
+	}
+
+	// Or to a tree of directories from various buckets, if requested.
+	if hasMapping(flags) {
+		if flags.OnlyDir != "" || flags.PrefixDirs != "" {
+			err = errors.New(
+				"--mapping-file is incompatible with --only-dir and --prefix-dirs")
+			return
+		}
+
+		b, err = setUpTree(ctx, flags, conn, name, b)
+		if err != nil {
+			err = fmt.Errorf("setUpTree: %v", err)
+			return
+		}
+	}
+
+	// Hide objects according to --include and --exclude, leaving our own
+	// temporary and lease objects alone.
+	if len(flags.Include) > 0 || len(flags.Exclude) > 0 {
+		b, err = gcsx.NewFilterBucket(
+			flags.Include,
+			flags.Exclude,
+			[]string{tmpObjectPrefix, leaseObjectPrefix},
+			b)
+
+		if err != nil {
+			err = fmt.Errorf("NewFilterBucket: %v", err)
+			return
+		}
+	}
+
+	// Enable rate limiting, if requested. This and the stat cache below may be
+	// reconfigured while mounted. When several buckets are mounted, these wrap
+	// all of them, so their budgets are shared.
+	reloader = &bucketReloader{unlimited: b}
+
 	b, err = setUpRateLimiting(
 		b,
 		flags.OpRateLimitHz,
@@ -124,14 +759,102 @@ func setUpBucket(
 		return
 	}
 
-	// Enable cached StatObject results, if appropriate.
-	if flags.StatCacheTTL != 0 {
-		cacheCapacity := flags.StatCacheCapacity
-		b = gcscaching.NewFastStatBucket(
-			flags.StatCacheTTL,
-			gcscaching.NewStatCache(cacheCapacity),
+	reloader.limited = gcsx.NewReloadableBucket(b)
+	reloader.opRateLimitHz = flags.OpRateLimitHz
+	reloader.egressBandwidthLimit = flags.EgressBandwidthLimitBytesPerSecond
+	b = reloader.limited
+
+	// And limits that depend on the time of day.
+	if len(flags.BandwidthSchedule) != 0 {
+		b, err = gcsx.NewScheduledThrottledBucket(
+			flags.BandwidthSchedule,
 			timeutil.RealClock(),
 			b)
+
+		if err != nil {
+			err = fmt.Errorf("NewScheduledThrottledBucket: %v", err)
+			return
+		}
+	}
+
+	// Check objects read in full against their CRC32C, if requested. This comes
+	// before decompressing them, since the checksum is of the stored bytes.
+	if flags.VerifyCRC32C {
+		b = gcsx.NewVerifyingBucket(b)
+	}
+
+	// Present gzip-encoded objects decompressed, if requested. This comes before
+	// the caches below so that they hold decompressed sizes and contents.
+	if flags.GzipObjects == gcsx.GzipObjectsDecompress {
+		b = gcsx.NewDecompressingBucket(b)
+	}
+
+	// Keep object contents on local disk, if requested. This comes after the
+	// limits above so that reads from the cache aren't subject to them.
+	if flags.FileCacheDir != "" {
+		b, err = gcsx.NewFileCacheBucket(
+			flags.FileCacheDir,
+			int64(flags.FileCacheMaxMB)<<20,
+			b)
+
+		if err != nil {
+			err = fmt.Errorf("NewFileCacheBucket: %v", err)
+			return
+		}
+	}
+
+	// Enable cached StatObject results, if appropriate.
+	reloader.uncached = b
+	cached, cache := setUpStatCache(b, flags)
+	reloader.cached = gcsx.NewReloadableBucket(cached)
+	reloader.noteStatCache(flags, cache)
+	b = reloader.cached
+
+	// Present the folders of a bucket with a hierarchical namespace as
+	// directories. This comes after the stat cache so that renaming a folder
+	// can't leave stale records of it behind.
+	folders = setUpFolders(ctx, flags, client, name)
+	if folders != nil {
+		logger.Infof("Bucket has a hierarchical namespace; using folders.")
+		b = gcsx.NewHierarchicalBucket(folders, b)
+	}
+
+	// Likewise present managed folders as directories, even when they are
+	// empty.
+	if managed := setUpManagedFolders(ctx, flags, client, name); managed != nil {
+		logger.Infof("Bucket has managed folders; listing them as directories.")
+		b = gcsx.NewManagedFolderBucket(managed, b)
+	}
+
+	// Answer first listings from an inventory report, if requested. This comes
+	// after the stat cache so that the report's stale records aren't cached.
+	if flags.InventoryReport != "" {
+		b, err = setUpInventory(ctx, flags, conn, b)
+		if err != nil {
+			err = fmt.Errorf("setUpInventory: %v", err)
+			return
+		}
+	}
+
+	// Or from a listing made now, if requested. The listing passes through the
+	// stat cache, which records the objects listed.
+	if flags.PrefetchMetadata.Enabled {
+		b, err = setUpPrefetch(ctx, flags, b)
+		if err != nil {
+			err = fmt.Errorf("setUpPrefetch: %v", err)
+			return
+		}
+	}
+
+	// Present every generation of each object beneath a read-only directory, if
+	// requested. This comes last so that the directory's names, which don't
+	// refer to real objects, reach nothing else.
+	if flags.VersionsDir != "" {
+		b, err = setUpVersions(flags, client, name, b)
+		if err != nil {
+			err = fmt.Errorf("setUpVersions: %v", err)
+			return
+		}
 	}
 
 	// Check whether this bucket works, giving the user a warning early if there
@@ -0,0 +1,307 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+)
+
+// The catalog of flags written by `gcsfuse help --json`, for tools that need
+// to stay in sync with the binary. Fields may be added but not removed or
+// changed in meaning.
+type flagCatalog struct {
+	Version string     `json:"version"`
+	Flags   []flagInfo `json:"flags"`
+}
+
+type flagInfo struct {
+	// The flag's name, without leading dashes, and any other names for it.
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+
+	// One of "bool", "int", "float", "duration", "string", "string-list",
+	// "octal", or "enum".
+	Type string `json:"type"`
+
+	// The default value, formatted as it would be given on the command line.
+	Default string `json:"default"`
+
+	Usage string `json:"usage"`
+
+	// For enums, the legal values. For flags taking a list of rules, the legal
+	// actions.
+	Choices []string `json:"choices,omitempty"`
+
+	// The syntax of values for structured string flags.
+	Format string `json:"format,omitempty"`
+
+	// Flags that may not be used together with this one.
+	ConflictsWith []string `json:"conflicts_with,omitempty"`
+
+	// Whether the flag may be set in a file given with --config-file.
+	ConfigFile bool `json:"config_file"`
+
+	// Whether the flag may be given a YAML sequence in a config file.
+	ConfigList bool `json:"config_list,omitempty"`
+}
+
+// Information about the flags that cli.GenericFlag can't tell us.
+var genericFlagInfo = map[string]flagInfo{
+	"dir-mode":  {Type: "octal"},
+	"file-mode": {Type: "octal"},
+
+	"nonempty-mount-point": {
+		Type: "enum",
+		Choices: []string{
+			string(NonEmptyRefuse),
+			string(NonEmptyWarn),
+			string(NonEmptyAllow),
+		},
+	},
+
+	"profile": {
+		Type:    "enum",
+		Choices: profileNames(),
+	},
+
+	"normalize-names": {
+		Type:    "enum",
+		Choices: []string{"none", string(fs.NameFormNFC), string(fs.NameFormNFD)},
+	},
+
+	"unchanged-content": {
+		Type:    "enum",
+		Choices: []string{"upload", "skip", "touch"},
+	},
+
+	"file-rules": {
+		Type:   "string",
+		Format: "pattern:action[;pattern:action...]",
+		Choices: []string{
+			string(fs.ParallelDownload),
+			string(fs.NoCache),
+			string(fs.WriteThrough),
+			string(fs.Compress),
+		},
+	},
+
+	"client-protocol": {
+		Type: "enum",
+		Choices: []string{
+			string(ClientProtocolHTTP1),
+			string(ClientProtocolHTTP2),
+		},
+	},
+
+	"list-projection": {
+		Type:    "enum",
+		Choices: []string{gcsx.ListProjectionFull, gcsx.ListProjectionNoACL},
+	},
+
+	"gzip-objects": {
+		Type:    "enum",
+		Choices: []string{gcsx.GzipObjectsRaw, gcsx.GzipObjectsDecompress},
+	},
+
+	"content-types": {
+		Type:   "string",
+		Format: ".ext=type[,.ext=type...]",
+	},
+
+	"cache-control": {
+		Type:   "string",
+		Format: "pattern=directives",
+	},
+
+	"storage-class": {
+		Type:    "enum",
+		Choices: gcsx.StorageClasses(),
+	},
+
+	"storage-class-overrides": {
+		Type:    "string",
+		Format:  "prefix:class[;prefix:class...]",
+		Choices: gcsx.StorageClasses(),
+	},
+
+	"prefetch-metadata": {
+		Type:   "string",
+		Format: "[prefix]",
+	},
+
+	"bandwidth-schedule": {
+		Type:   "string",
+		Format: "HH:MM-HH:MM=read/write[;HH:MM-HH:MM=read/write...]",
+	},
+
+	"retryable-codes": {
+		Type:   "string",
+		Format: "code[,code...]",
+	},
+
+	"retry-overrides": {
+		Type:   "string",
+		Format: "op:key=value[,key=value...][;op:key=value...]",
+	},
+
+	"uid-map": {
+		Type:   "string",
+		Format: "inside:outside:count[,inside:outside:count...]",
+	},
+
+	"gid-map": {
+		Type:   "string",
+		Format: "inside:outside:count[,inside:outside:count...]",
+	},
+}
+
+// Syntax descriptions for string flags with structured values.
+var stringFlagFormats = map[string]string{
+	"prefix-dirs": "name:prefix[;name:prefix...]",
+}
+
+// Return the names of the available profiles, sorted.
+func profileNames() (names []string) {
+	for p := range profiles {
+		if p != ProfileNone {
+			names = append(names, string(p))
+		}
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// Describe the supplied flag.
+func describeFlag(f cli.Flag) (info flagInfo) {
+	names := strings.Split(f.GetName(), ",")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+
+	switch f := f.(type) {
+	case cli.BoolFlag:
+		info = flagInfo{Type: "bool", Default: "false", Usage: f.Usage}
+
+	case cli.BoolTFlag:
+		info = flagInfo{Type: "bool", Default: "true", Usage: f.Usage}
+
+	case cli.IntFlag:
+		info = flagInfo{Type: "int", Default: fmt.Sprint(f.Value), Usage: f.Usage}
+
+	case cli.Float64Flag:
+		info = flagInfo{Type: "float", Default: fmt.Sprint(f.Value), Usage: f.Usage}
+
+	case cli.DurationFlag:
+		info = flagInfo{Type: "duration", Default: f.Value.String(), Usage: f.Usage}
+
+	case cli.StringFlag:
+		info = flagInfo{
+			Type:    "string",
+			Default: f.Value,
+			Usage:   f.Usage,
+			Format:  stringFlagFormats[names[0]],
+		}
+
+	case cli.StringSliceFlag:
+		info = flagInfo{Type: "string-list", Usage: f.Usage}
+
+	case cli.GenericFlag:
+		info = genericFlagInfo[names[0]]
+		info.Usage = f.Usage
+		if f.Value != nil {
+			info.Default = f.Value.String()
+		}
+
+		if info.Type == "" {
+			info.Type = "string"
+		}
+
+	default:
+		info.Type = "string"
+	}
+
+	info.Name = names[0]
+	info.Aliases = names[1:]
+	info.ConfigFile = !configExcludedFlags[info.Name]
+	_, info.ConfigList = configListFlags[info.Name]
+
+	for _, pair := range conflictingFlags {
+		switch info.Name {
+		case pair[0]:
+			info.ConflictsWith = append(info.ConflictsWith, pair[1])
+
+		case pair[1]:
+			info.ConflictsWith = append(info.ConflictsWith, pair[0])
+		}
+	}
+
+	return
+}
+
+// Write a JSON catalog of the flags accepted by the supplied app.
+func writeFlagCatalog(w io.Writer, app *cli.App) (err error) {
+	catalog := flagCatalog{
+		Version: app.Version,
+		Flags:   []flagInfo{},
+	}
+
+	for _, f := range app.Flags {
+		catalog.Flags = append(catalog.Flags, describeFlag(f))
+	}
+
+	b, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("MarshalIndent: %v", err)
+		return
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return
+}
+
+// A replacement for the cli package's help command that can also write a
+// machine-readable catalog of flags.
+func newHelpCommand() cli.Command {
+	return cli.Command{
+		Name:    "help",
+		Aliases: []string{"h"},
+		Usage:   "Show help, or with --json a machine-readable catalog of flags",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "Write a JSON description of every flag to stdout.",
+			},
+		},
+		Action: func(c *cli.Context) (err error) {
+			if c.Bool("json") {
+				err = writeFlagCatalog(os.Stdout, c.App)
+				return
+			}
+
+			cli.ShowAppHelp(c)
+			return
+		},
+	}
+}
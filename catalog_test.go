@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestCatalog(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FlagCatalogTest struct {
+	catalog flagCatalog
+
+	// The catalog's entries, indexed by name.
+	flags map[string]flagInfo
+}
+
+var _ SetUpInterface = &FlagCatalogTest{}
+
+func init() { RegisterTestSuite(&FlagCatalogTest{}) }
+
+func (t *FlagCatalogTest) SetUp(ti *TestInfo) {
+	var buf bytes.Buffer
+	err := writeFlagCatalog(&buf, newApp())
+	AssertEq(nil, err)
+
+	err = json.Unmarshal(buf.Bytes(), &t.catalog)
+	AssertEq(nil, err)
+
+	t.flags = make(map[string]flagInfo)
+	for _, f := range t.catalog.Flags {
+		t.flags[f.Name] = f
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FlagCatalogTest) EveryFlagIsPresent() {
+	app := newApp()
+	AssertEq(len(app.Flags), len(t.catalog.Flags))
+
+	for _, f := range app.Flags {
+		info := describeFlag(f)
+		_, ok := t.flags[info.Name]
+		ExpectTrue(ok, "name: %s", info.Name)
+	}
+}
+
+func (t *FlagCatalogTest) Version() {
+	ExpectEq(getVersion(), t.catalog.Version)
+}
+
+func (t *FlagCatalogTest) ScalarTypes() {
+	testCases := []struct {
+		name            string
+		expectedType    string
+		expectedDefault string
+	}{
+		{"foreground", "bool", "false"},
+		{"default-permissions", "bool", "true"},
+		{"stat-cache-capacity", "int", "4096"},
+		{"limit-ops-per-sec", "float", "5"},
+		{"stat-cache-ttl", "duration", "1m0s"},
+		{"temp-dir", "string", ""},
+		{"o", "string-list", ""},
+		{"dir-mode", "octal", "755"},
+	}
+
+	for _, tc := range testCases {
+		f := t.flags[tc.name]
+		ExpectEq(tc.expectedType, f.Type, "name: %s", tc.name)
+		ExpectEq(tc.expectedDefault, f.Default, "name: %s", tc.name)
+		ExpectNe("", f.Usage, "name: %s", tc.name)
+	}
+}
+
+func (t *FlagCatalogTest) Enums() {
+	f := t.flags["nonempty-mount-point"]
+	ExpectEq("enum", f.Type)
+	ExpectEq("refuse", f.Default)
+	ExpectThat(f.Choices, ElementsAre("refuse", "warn", "allow"))
+
+	f = t.flags["profile"]
+	ExpectEq("enum", f.Type)
+	ExpectEq("", f.Default)
+	ExpectThat(
+		f.Choices,
+		ElementsAre("backup", "interactive", "media-serving", "ml-training"))
+
+	f = t.flags["gzip-objects"]
+	ExpectEq("enum", f.Type)
+	ExpectEq("raw", f.Default)
+	ExpectThat(f.Choices, ElementsAre("raw", "decompress"))
+
+	f = t.flags["storage-class"]
+	ExpectEq("enum", f.Type)
+	ExpectEq("", f.Default)
+	ExpectThat(f.Choices, Contains("COLDLINE"))
+}
+
+func (t *FlagCatalogTest) StructuredStrings() {
+	f := t.flags["file-rules"]
+	ExpectEq("string", f.Type)
+	ExpectThat(f.Format, HasSubstr("pattern:action"))
+	ExpectThat(f.Choices, Contains("write-through"))
+
+	f = t.flags["prefix-dirs"]
+	ExpectThat(f.Format, HasSubstr("name:prefix"))
+}
+
+func (t *FlagCatalogTest) Constraints() {
+	ExpectThat(
+		t.flags["only-dir"].ConflictsWith,
+		ElementsAre("prefix-dirs", "mapping-file", "mapping"))
+
+	ExpectThat(
+		t.flags["prefix-dirs"].ConflictsWith,
+		ElementsAre(
+			"only-dir",
+			"mapping-file",
+			"versions-dir",
+			"mapping",
+			"notification-subscription"))
+
+	ExpectThat(
+		t.flags["mapping-file"].ConflictsWith,
+		ElementsAre(
+			"only-dir",
+			"prefix-dirs",
+			"versions-dir",
+			"reflect-iam-permissions",
+			"mapping",
+			"notification-subscription"))
+
+	ExpectThat(
+		t.flags["mapping"].ConflictsWith,
+		ElementsAre(
+			"mapping-file",
+			"only-dir",
+			"prefix-dirs",
+			"versions-dir",
+			"reflect-iam-permissions",
+			"notification-subscription"))
+
+	ExpectThat(
+		t.flags["notification-subscription"].ConflictsWith,
+		ElementsAre("prefix-dirs", "mapping-file", "mapping"))
+
+	ExpectThat(
+		t.flags["versions-dir"].ConflictsWith,
+		ElementsAre("prefix-dirs", "mapping-file", "mapping"))
+
+	ExpectTrue(t.flags["implicit-dirs"].ConfigFile)
+	ExpectFalse(t.flags["config-file"].ConfigFile)
+	ExpectFalse(t.flags["help"].ConfigFile)
+
+	ExpectTrue(t.flags["file-rules"].ConfigList)
+	ExpectTrue(t.flags["o"].ConfigList)
+	ExpectTrue(t.flags["exclude"].ConfigList)
+	ExpectTrue(t.flags["mapping"].ConfigList)
+	ExpectFalse(t.flags["implicit-dirs"].ConfigList)
+}
+
+func (t *FlagCatalogTest) Aliases() {
+	ExpectThat(t.flags["help"].Aliases, ElementsAre("h"))
+	ExpectEq(0, len(t.flags["foreground"].Aliases))
+}
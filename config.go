@@ -0,0 +1,454 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// Flags that may not be set from a config file.
+var configExcludedFlags = map[string]bool{
+	"config-file": true,
+	"help":        true,
+	"h":           true,
+	"version":     true,
+	"v":           true,
+}
+
+// Pairs of flags that may not be used together.
+var conflictingFlags = [][2]string{
+	{"only-dir", "prefix-dirs"},
+	{"only-dir", "mapping-file"},
+	{"prefix-dirs", "mapping-file"},
+	{"prefix-dirs", "versions-dir"},
+	{"mapping-file", "versions-dir"},
+	{"mapping-file", "reflect-iam-permissions"},
+	{"mapping", "mapping-file"},
+	{"only-dir", "mapping"},
+	{"prefix-dirs", "mapping"},
+	{"mapping", "versions-dir"},
+	{"mapping", "reflect-iam-permissions"},
+	{"inventory-report", "prefetch-metadata"},
+	{"encryption-key", "encryption-key-file"},
+	{"key-file", "token-url"},
+	{"notification-subscription", "prefix-dirs"},
+	{"notification-subscription", "mapping-file"},
+	{"notification-subscription", "mapping"},
+}
+
+// Flags whose values are lists, which a config file may give as a YAML
+// sequence, mapped to the separator that joins the items into a single value.
+// Flags that may be repeated on the command line, with an empty separator, are
+// instead set once per item.
+var configListFlags = map[string]string{
+	"o":                           "",
+	"include":                     "",
+	"exclude":                     "",
+	"mapping":                     "",
+	"uid-map":                     ",",
+	"gid-map":                     ",",
+	"prefix-dirs":                 ";",
+	"file-rules":                  ";",
+	"content-types":               ",",
+	"cache-control":               "",
+	"storage-class-overrides":     ";",
+	"bandwidth-schedule":          ";",
+	"retryable-codes":             ",",
+	"retry-overrides":             ";",
+	"impersonate-service-account": ",",
+}
+
+// A setting read from a config file.
+type configSetting struct {
+	line  int
+	key   string
+	value string
+
+	// Set if the value was given as a sequence, in which case value is unused.
+	list  bool
+	items []string
+}
+
+// Parse the contents of a config file, which consists of lines of the form
+//
+//     flag-name: value
+//
+// where flag-name is the name of a gcsfuse flag without leading dashes, and
+// value may optionally be quoted. Blank lines and text following a '#' at the
+// start of a line or after whitespace, outside quotes, are ignored. This is a
+// subset of YAML.
+//
+// A value may also be a sequence, either on one line as
+//
+//     flag-name: [value, value]
+//
+// or with each item on its own line following the flag name:
+//
+//     flag-name:
+//       - value
+//       - value
+//
+// Syntax errors are returned as problems, each prefixed with its line number.
+func parseConfig(contents string) (settings []configSetting, problems []string) {
+	// The setting with an empty value most recently read, to which any items
+	// on the following lines belong.
+	var open *configSetting
+
+	for i, line := range strings.Split(contents, "\n") {
+		lineNum := i + 1
+
+		// Strip comments and whitespace.
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		// Is this an item in a sequence?
+		if line == "-" || strings.HasPrefix(line, "- ") {
+			if open == nil {
+				problems = append(
+					problems,
+					fmt.Sprintf("%d: sequence item without a flag name", lineNum))
+				continue
+			}
+
+			open.list = true
+			open.items = append(
+				open.items,
+				unquote(strings.TrimSpace(strings.TrimPrefix(line, "-"))))
+
+			continue
+		}
+
+		open = nil
+
+		// Split out the key and value.
+		j := strings.Index(line, ":")
+		if j < 0 {
+			problems = append(
+				problems,
+				fmt.Sprintf("%d: expected \"flag-name: value\", got %q", lineNum, line))
+			continue
+		}
+
+		s := configSetting{
+			line:  lineNum,
+			key:   strings.TrimSpace(line[:j]),
+			value: strings.TrimSpace(line[j+1:]),
+		}
+
+		if strings.HasPrefix(s.value, "[") {
+			if !strings.HasSuffix(s.value, "]") {
+				problems = append(
+					problems,
+					fmt.Sprintf("%d: unterminated sequence %q", lineNum, s.value))
+				continue
+			}
+
+			s.list = true
+			s.items = splitFlowSequence(s.value[1 : len(s.value)-1])
+		}
+
+		s.value = unquote(s.value)
+		settings = append(settings, s)
+
+		if s.value == "" {
+			open = &settings[len(settings)-1]
+		}
+	}
+
+	return
+}
+
+// Remove a comment from the supplied line: a '#' at the start of the line or
+// after whitespace, and anything following it. A '#' within a quoted value,
+// where a quote begins a value or sequence item, is not a comment.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		startOfToken := i == 0 || strings.IndexByte(" \t:[,", line[i-1]) >= 0
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+
+		case (c == '"' || c == '\'') && startOfToken:
+			quote = c
+
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// Split the contents of a sequence like [a, 'b, c'] into its items, unquoting
+// each.
+func splitFlowSequence(s string) (items []string) {
+	if strings.TrimSpace(s) == "" {
+		return
+	}
+
+	var quote byte
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		switch {
+		case i == len(s) || (s[i] == ',' && quote == 0):
+			items = append(items, unquote(strings.TrimSpace(s[start:i])))
+			start = i + 1
+
+		case quote != 0 && s[i] == quote:
+			quote = 0
+
+		case quote == 0 && (s[i] == '"' || s[i] == '\''):
+			quote = s[i]
+		}
+	}
+
+	return
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 &&
+		(s[0] == '"' || s[0] == '\'') &&
+		s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+
+	return s
+}
+
+// Describe the values accepted by the supplied flag, or return the empty
+// string if the flag parses its own values and produces its own errors.
+func describeFlagType(f cli.Flag) string {
+	switch f.(type) {
+	case cli.BoolFlag, cli.BoolTFlag:
+		return "true or false"
+
+	case cli.IntFlag:
+		return "an integer"
+
+	case cli.Float64Flag:
+		return "a number"
+
+	case cli.DurationFlag:
+		return "a duration such as 10s or 1h"
+	}
+
+	return ""
+}
+
+// Return the known flag name closest to the supplied unknown one, or the
+// empty string if none is close enough to be a plausible typo.
+func suggestFlag(name string, known map[string]cli.Flag) (suggestion string) {
+	// Underscores in place of dashes are a common mistake, since mount options
+	// are spelled that way.
+	if _, ok := known[strings.Replace(name, "_", "-", -1)]; ok {
+		return strings.Replace(name, "_", "-", -1)
+	}
+
+	// Otherwise choose the closest name within an edit distance of two,
+	// breaking ties alphabetically so that the result is deterministic.
+	best := 3
+	for k := range known {
+		if configExcludedFlags[k] {
+			continue
+		}
+
+		d := editDistance(name, k)
+		if d < best || (d == best && suggestion != "" && k < suggestion) {
+			best = d
+			suggestion = k
+		}
+	}
+
+	return
+}
+
+// Compute the Levenshtein distance between two strings.
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a int, rest ...int) int {
+	for _, b := range rest {
+		if b < a {
+			a = b
+		}
+	}
+
+	return a
+}
+
+// Apply the settings in the config file at the given path to the flags that
+// were not set explicitly on the command line. All problems found in the file
+// are reported together, each with its location.
+func applyConfigFile(c *cli.Context, path string) (err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+	}
+
+	settings, problems := parseConfig(string(contents))
+
+	// Find the flags we know about.
+	known := make(map[string]cli.Flag)
+	for _, f := range c.App.Flags {
+		for _, name := range strings.Split(f.GetName(), ",") {
+			known[strings.TrimSpace(name)] = f
+		}
+	}
+
+	// Note which flags were set on the command line before we start setting
+	// more.
+	explicit := make(map[string]bool)
+	for name := range known {
+		explicit[name] = c.IsSet(name)
+	}
+
+	// Apply each setting.
+	lines := make(map[string]int)
+	for _, s := range settings {
+		f, ok := known[s.key]
+		switch {
+		case !ok:
+			p := fmt.Sprintf("%d: unknown flag %q", s.line, s.key)
+			if suggestion := suggestFlag(s.key, known); suggestion != "" {
+				p += fmt.Sprintf("; did you mean %q?", suggestion)
+			}
+
+			problems = append(problems, p)
+			continue
+
+		case configExcludedFlags[s.key]:
+			problems = append(
+				problems,
+				fmt.Sprintf("%d: %q may not be set in a config file", s.line, s.key))
+			continue
+
+		case lines[s.key] != 0:
+			problems = append(
+				problems,
+				fmt.Sprintf(
+					"%d: %q is already set on line %d",
+					s.line,
+					s.key,
+					lines[s.key]))
+			continue
+		}
+
+		lines[s.key] = s.line
+
+		// Flags on the command line take precedence.
+		if explicit[s.key] {
+			continue
+		}
+
+		// Sequences are joined, or set item by item for repeatable flags.
+		values := []string{s.value}
+		if s.list {
+			sep, ok := configListFlags[s.key]
+			switch {
+			case !ok:
+				problems = append(
+					problems,
+					fmt.Sprintf("%d: %q doesn't take a list of values", s.line, s.key))
+				continue
+
+			case sep == "":
+				values = s.items
+
+			default:
+				values = []string{strings.Join(s.items, sep)}
+			}
+		}
+
+		for _, v := range values {
+			if setErr := c.Set(s.key, v); setErr != nil {
+				p := fmt.Sprintf("%d: %s: %v", s.line, s.key, setErr)
+				if want := describeFlagType(f); want != "" {
+					p = fmt.Sprintf("%d: %s: want %s, got %q", s.line, s.key, want, v)
+				}
+
+				problems = append(problems, p)
+			}
+		}
+	}
+
+	// Check for conflicts involving the settings in the file.
+	for _, pair := range conflictingFlags {
+		l0, l1 := lines[pair[0]], lines[pair[1]]
+		if l0 == 0 && l1 == 0 {
+			continue
+		}
+
+		if (l0 != 0 || explicit[pair[0]]) && (l1 != 0 || explicit[pair[1]]) {
+			// Report the later of the lines involved.
+			line := l0
+			if l1 > line {
+				line = l1
+			}
+
+			problems = append(
+				problems,
+				fmt.Sprintf(
+					"%d: %q and %q may not be used together",
+					line,
+					pair[0],
+					pair[1]))
+		}
+	}
+
+	if len(problems) != 0 {
+		for i, p := range problems {
+			problems[i] = path + ":" + p
+		}
+
+		err = errors.New(strings.Join(problems, "\n"))
+		return
+	}
+
+	return
+}
@@ -0,0 +1,278 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestConfig(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ConfigFileTest struct {
+	// A temporary directory holding the config file. Removed in TearDown.
+	dir string
+}
+
+var _ SetUpInterface = &ConfigFileTest{}
+var _ TearDownInterface = &ConfigFileTest{}
+
+func init() { RegisterTestSuite(&ConfigFileTest{}) }
+
+func (t *ConfigFileTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.dir, err = ioutil.TempDir("", "config_test")
+	AssertEq(nil, err)
+}
+
+func (t *ConfigFileTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Write a config file with the supplied contents, then parse the supplied
+// arguments along with a flag pointing at it.
+func (t *ConfigFileTest) parse(
+	contents string,
+	args ...string) (flags *flagStorage, err error) {
+	p := path.Join(t.dir, "gcsfuse.yaml")
+	err = ioutil.WriteFile(p, []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	app := newApp()
+	app.Action = func(appCtx *cli.Context) {
+		flags, err = populateFlags(appCtx)
+	}
+
+	fullArgs := append([]string{"some_app", "--config-file", p}, args...)
+	runErr := app.Run(fullArgs)
+	AssertEq(nil, runErr)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ConfigFileTest) ValidFile() {
+	const contents = `
+# Some comments.
+implicit-dirs: true
+stat-cache-ttl: 10s   # A trailing comment.
+only-dir: "foo/bar"
+file-rules: '*.log:no-cache'
+profile: backup
+`
+
+	f, err := t.parse(contents)
+	AssertEq(nil, err)
+
+	ExpectTrue(f.ImplicitDirs)
+	ExpectEq(10*time.Second, f.StatCacheTTL)
+	ExpectEq("foo/bar", f.OnlyDir)
+
+	AssertEq(1, len(f.FileRules))
+	ExpectEq("*.log", f.FileRules[0].Pattern)
+
+	// The profile should apply to flags the file doesn't mention.
+	ExpectEq(65536, f.StatCacheCapacity)
+}
+
+func (t *ConfigFileTest) CommandLineTakesPrecedence() {
+	const contents = `
+stat-cache-ttl: 10s
+type-cache-ttl: 20s
+`
+
+	f, err := t.parse(contents, "--stat-cache-ttl", "1h")
+	AssertEq(nil, err)
+
+	ExpectEq(time.Hour, f.StatCacheTTL)
+	ExpectEq(20*time.Second, f.TypeCacheTTL)
+}
+
+func (t *ConfigFileTest) MissingFile() {
+	app := newApp()
+
+	var err error
+	app.Action = func(appCtx *cli.Context) {
+		_, err = populateFlags(appCtx)
+	}
+
+	runErr := app.Run([]string{
+		"some_app",
+		"--config-file", path.Join(t.dir, "foo"),
+	})
+
+	AssertEq(nil, runErr)
+	ExpectThat(err, Error(HasSubstr("no such file")))
+}
+
+func (t *ConfigFileTest) UnknownKeys() {
+	const contents = `
+implicit-dirs: true
+stat-cache-tll: 10s
+stat_cache_ttl: 10s
+taco: burrito
+`
+
+	_, err := t.parse(contents)
+	AssertNe(nil, err)
+
+	ExpectThat(
+		err,
+		Error(HasSubstr(`gcsfuse.yaml:3: unknown flag "stat-cache-tll"; did you mean "stat-cache-ttl"?`)))
+
+	ExpectThat(
+		err,
+		Error(HasSubstr(`gcsfuse.yaml:4: unknown flag "stat_cache_ttl"; did you mean "stat-cache-ttl"?`)))
+
+	ExpectThat(err, Error(HasSubstr(`gcsfuse.yaml:5: unknown flag "taco"`)))
+	ExpectThat(err, Error(Not(HasSubstr(`"taco"; did you mean`))))
+}
+
+func (t *ConfigFileTest) TypeMismatches() {
+	const contents = `
+implicit-dirs: sure
+stat-cache-capacity: lots
+stat-cache-ttl: 10
+limit-ops-per-sec: fast
+profile: taco
+`
+
+	_, err := t.parse(contents)
+	AssertNe(nil, err)
+
+	ExpectThat(err, Error(HasSubstr(`:2: implicit-dirs: want true or false, got "sure"`)))
+	ExpectThat(err, Error(HasSubstr(`:3: stat-cache-capacity: want an integer, got "lots"`)))
+	ExpectThat(err, Error(HasSubstr(`:4: stat-cache-ttl: want a duration`)))
+	ExpectThat(err, Error(HasSubstr(`:5: limit-ops-per-sec: want a number`)))
+	ExpectThat(err, Error(HasSubstr(`:6: profile: Unknown profile "taco"`)))
+}
+
+func (t *ConfigFileTest) SyntaxErrorsAndDuplicates() {
+	const contents = `
+implicit-dirs
+only-dir: foo
+only-dir: bar
+config-file: baz
+`
+
+	_, err := t.parse(contents)
+	AssertNe(nil, err)
+
+	ExpectThat(err, Error(HasSubstr(`:2: expected "flag-name: value"`)))
+	ExpectThat(err, Error(HasSubstr(`:4: "only-dir" is already set on line 3`)))
+	ExpectThat(err, Error(HasSubstr(`:5: "config-file" may not be set`)))
+}
+
+func (t *ConfigFileTest) Conflicts() {
+	var err error
+
+	// Both in the file.
+	_, err = t.parse("only-dir: foo\nprefix-dirs: a:b\n")
+	ExpectThat(
+		err,
+		Error(HasSubstr(`:2: "only-dir" and "prefix-dirs" may not be used together`)))
+
+	// One on the command line.
+	_, err = t.parse("prefix-dirs: a:b\n", "--only-dir", "foo")
+	ExpectThat(
+		err,
+		Error(HasSubstr(`:1: "only-dir" and "prefix-dirs" may not be used together`)))
+}
+
+func (t *ConfigFileTest) Sequences() {
+	const contents = `
+o: [allow_other, "ro"]
+uid-map:
+  - 0:100000:1000
+  - '1000:1000:1'   # A trailing comment.
+file-rules:
+- "*.log:no-cache"
+- '*.db:write-through'
+bandwidth-schedule: []
+mapping:
+  - datasets/imagenet  gs://ml-data/imagenet  ro
+  - results            my-results
+`
+
+	f, err := t.parse(contents)
+	AssertEq(nil, err)
+
+	ExpectEq("", f.MountOptions["allow_other"])
+	ExpectEq("", f.MountOptions["ro"])
+	ExpectEq(2, len(f.MountOptions))
+
+	ExpectEq("0:100000:1000,1000:1000:1", f.UIDMap.String())
+
+	AssertEq(2, len(f.FileRules))
+	ExpectEq("*.log", f.FileRules[0].Pattern)
+	ExpectEq("*.db", f.FileRules[1].Pattern)
+
+	ExpectThat(
+		f.Mapping,
+		ElementsAre(
+			"datasets/imagenet  gs://ml-data/imagenet  ro",
+			"results            my-results"))
+}
+
+func (t *ConfigFileTest) HashInQuotedValues() {
+	const contents = `
+key-file: "/secrets/a #1.json"   # A trailing comment.
+only-dir: 'foo #1'
+include:
+  - "logs #1/**"   # Another.
+exclude: ["tmp #1", 'b # c']  # And another.
+`
+
+	f, err := t.parse(contents)
+	AssertEq(nil, err)
+
+	ExpectEq("/secrets/a #1.json", f.KeyFile)
+	ExpectEq("foo #1", f.OnlyDir)
+	ExpectThat(f.Include, ElementsAre("logs #1/**"))
+	ExpectThat(f.Exclude, ElementsAre("tmp #1", "b # c"))
+}
+
+func (t *ConfigFileTest) SequenceErrors() {
+	const contents = `
+- foo
+implicit-dirs: [true, false]
+only-dir:
+  - foo
+prefix-dirs: [a:b
+`
+
+	_, err := t.parse(contents)
+	AssertNe(nil, err)
+
+	ExpectThat(err, Error(HasSubstr(`:2: sequence item without a flag name`)))
+	ExpectThat(err, Error(HasSubstr(`:3: "implicit-dirs" doesn't take a list`)))
+	ExpectThat(err, Error(HasSubstr(`:4: "only-dir" doesn't take a list`)))
+	ExpectThat(err, Error(HasSubstr(`:6: unterminated sequence`)))
+}
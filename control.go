@@ -0,0 +1,242 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"golang.org/x/net/context"
+)
+
+// Each mount serves a control interface over HTTP on a Unix domain socket
+// whose path is derived from the mount point, so that commands like `gcsfuse
+// lsof` can find it. The socket lives in a directory readable only by the
+// user that mounted the file system.
+
+// The directory holding control sockets for the current user.
+func controlSocketDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gcsfuse-%d", os.Getuid()))
+}
+
+// The path of the control socket for the file system mounted at the given
+// absolute path.
+func controlSocketPath(mountPoint string) string {
+	sum := sha1.Sum([]byte(mountPoint))
+	return filepath.Join(controlSocketDir(), fmt.Sprintf("%x.sock", sum[:8]))
+}
+
+// Serve the control interface for the supplied server on a Unix domain socket
+// at the given path, replacing any left behind by an earlier mount. Closing
+// the returned listener stops serving and removes the socket.
+func startControlServer(
+	path string,
+	server fs.Server) (l net.Listener, err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	// A socket left behind by a process that died can't be listened on again.
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		err = fmt.Errorf("Remove: %v", err)
+		return
+	}
+
+	l, err = net.Listen("unix", path)
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/open_files", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.OpenFiles()); err != nil {
+			logger.Errorf("Encoding open files: %v", err)
+		}
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(collectStats(server)); err != nil {
+			logger.Errorf("Encoding stats: %v", err)
+		}
+	})
+
+	go http.Serve(l, mux)
+	return
+}
+
+// A snapshot of the activity of a mount, as served by the control interface.
+type mountStats struct {
+	Time time.Time `json:"time"`
+	FS   fs.Stats  `json:"fs"`
+
+	// Counts of stat cache lookups, or zero if the cache is disabled, and of
+	// entries evicted from a cache sized by --stat-cache-max-size-mb.
+	StatCacheHits      int64 `json:"stat_cache_hits"`
+	StatCacheMisses    int64 `json:"stat_cache_misses"`
+	StatCacheEvictions int64 `json:"stat_cache_evictions"`
+
+	// Uploads of file contents to GCS that have not yet finished.
+	Uploads []gcsx.UploadProgress `json:"uploads"`
+}
+
+func collectStats(server fs.Server) (s mountStats) {
+	s.Time = time.Now()
+	s.FS = server.Stats()
+	s.StatCacheHits, s.StatCacheMisses = gcsx.StatCacheCounts()
+	s.StatCacheEvictions = gcsx.StatCacheEvictions()
+	s.Uploads = gcsx.UploadsInProgress()
+	return
+}
+
+// Return a client that sends all requests to the control socket at the given
+// path, whatever their URL.
+func newControlClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(
+				ctx context.Context,
+				network string,
+				addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// Fetch the given path from the control socket at the given path, decoding
+// the JSON response into v.
+func controlGet(socket string, path string, v interface{}) (err error) {
+	resp, err := newControlClient(socket).Get("http://gcsfuse" + path)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Unexpected status: %s", resp.Status)
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		err = fmt.Errorf("Decode: %v", err)
+		return
+	}
+
+	return
+}
+
+// Ask the file system serving the control socket at the given path for its
+// open files.
+func listOpenFiles(path string) (files []fs.OpenFileInfo, err error) {
+	err = controlGet(path, "/open_files", &files)
+	return
+}
+
+// Ask the file system serving the control socket at the given path for a
+// snapshot of its activity.
+func getStats(path string) (s *mountStats, err error) {
+	s = new(mountStats)
+	err = controlGet(path, "/stats", s)
+	return
+}
+
+// Write a table describing the supplied open files, with ages relative to the
+// given time.
+func writeOpenFiles(
+	w io.Writer,
+	files []fs.OpenFileInfo,
+	now time.Time) (err error) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HANDLE\tMODE\tDIRTY\tAGE\tPATH")
+
+	for _, f := range files {
+		mode := "r"
+		if f.Written {
+			mode = "w"
+		}
+
+		dirty := "-"
+		if f.Dirty {
+			dirty = fmt.Sprintf("%d", f.DirtyBytes)
+		}
+
+		fmt.Fprintf(
+			tw,
+			"%d\t%s\t%s\t%v\t%s\n",
+			f.Handle,
+			mode,
+			dirty,
+			now.Sub(f.Opened).Truncate(time.Second),
+			f.Name)
+	}
+
+	err = tw.Flush()
+	return
+}
+
+// A command that lists the files open in a mounted file system.
+func newLsofCommand() cli.Command {
+	return cli.Command{
+		Name:      "lsof",
+		Usage:     "List the files open in the file system mounted at a path",
+		ArgsUsage: "mount_point",
+		Action: func(c *cli.Context) (err error) {
+			if len(c.Args()) != 1 {
+				err = errors.New("lsof takes exactly one argument, the mount point.")
+				return
+			}
+
+			mountPoint, err := filepath.Abs(c.Args()[0])
+			if err != nil {
+				err = fmt.Errorf("canonicalizing mount point: %v", err)
+				return
+			}
+
+			files, err := listOpenFiles(controlSocketPath(mountPoint))
+			if err != nil {
+				err = fmt.Errorf(
+					"Contacting gcsfuse for %s (is it mounted by this user?): %v",
+					mountPoint,
+					err)
+				return
+			}
+
+			err = writeOpenFiles(os.Stdout, files, time.Now())
+			return
+		},
+	}
+}
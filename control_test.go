@@ -0,0 +1,184 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestControl(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A fs.Server that reports a canned list of open files and stats.
+type fakeServer struct {
+	fs.Server
+	files []fs.OpenFileInfo
+	stats fs.Stats
+}
+
+func (s *fakeServer) OpenFiles() []fs.OpenFileInfo {
+	return s.files
+}
+
+func (s *fakeServer) Stats() fs.Stats {
+	return s.stats
+}
+
+type ControlTest struct {
+	// A temporary directory holding the socket. Removed in TearDown.
+	dir string
+
+	now    time.Time
+	server fakeServer
+}
+
+var _ SetUpInterface = &ControlTest{}
+var _ TearDownInterface = &ControlTest{}
+
+func init() { RegisterTestSuite(&ControlTest{}) }
+
+func (t *ControlTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.dir, err = ioutil.TempDir("", "control_test")
+	AssertEq(nil, err)
+
+	t.now = time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)
+	t.server.files = []fs.OpenFileInfo{
+		{
+			Handle: 3,
+			Name:   "foo/bar",
+			Opened: t.now.Add(-90 * time.Second),
+		},
+		{
+			Handle:     7,
+			Name:       "baz",
+			Written:    true,
+			Dirty:      true,
+			DirtyBytes: 17,
+			Opened:     t.now.Add(-time.Hour),
+		},
+	}
+
+	t.server.stats = fs.Stats{
+		Since: t.now.Add(-time.Minute),
+		Ops: map[string]fs.OpStats{
+			"ReadFile": {Count: 10, Errors: 1, Duration: time.Second},
+		},
+		BytesRead: 1 << 20,
+		InFlight: []fs.InFlightOp{
+			{Op: "FlushFile", Name: "baz", Start: t.now.Add(-time.Second)},
+		},
+		DirtyFiles: 1,
+	}
+}
+
+func (t *ControlTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ControlTest) SocketPathDependsOnMountPoint() {
+	ExpectEq(controlSocketPath("/mnt/a"), controlSocketPath("/mnt/a"))
+	ExpectNe(controlSocketPath("/mnt/a"), controlSocketPath("/mnt/b"))
+	ExpectEq(controlSocketDir(), path.Dir(controlSocketPath("/mnt/a")))
+}
+
+func (t *ControlTest) ListOpenFiles() {
+	p := path.Join(t.dir, "sockets", "control.sock")
+	l, err := startControlServer(p, &t.server)
+	AssertEq(nil, err)
+	defer l.Close()
+
+	files, err := listOpenFiles(p)
+	AssertEq(nil, err)
+	AssertEq(2, len(files))
+
+	ExpectEq(3, files[0].Handle)
+	ExpectEq("foo/bar", files[0].Name)
+	ExpectFalse(files[0].Written)
+	ExpectThat(files[0].Opened, timeutil.TimeEq(t.server.files[0].Opened))
+
+	ExpectEq(7, files[1].Handle)
+	ExpectTrue(files[1].Dirty)
+	ExpectEq(17, files[1].DirtyBytes)
+}
+
+func (t *ControlTest) ReplacesStaleSocket() {
+	p := path.Join(t.dir, "control.sock")
+	err := ioutil.WriteFile(p, nil, 0600)
+	AssertEq(nil, err)
+
+	l, err := startControlServer(p, &t.server)
+	AssertEq(nil, err)
+	defer l.Close()
+
+	_, err = listOpenFiles(p)
+	ExpectEq(nil, err)
+}
+
+func (t *ControlTest) NothingListening() {
+	_, err := listOpenFiles(path.Join(t.dir, "control.sock"))
+	ExpectThat(err, Error(HasSubstr("control.sock")))
+}
+
+func (t *ControlTest) WriteTable() {
+	var buf bytes.Buffer
+	err := writeOpenFiles(&buf, t.server.files, t.now)
+	AssertEq(nil, err)
+
+	ExpectEq(
+		"HANDLE  MODE  DIRTY  AGE     PATH\n"+
+			"3       r     -      1m30s   foo/bar\n"+
+			"7       w     17     1h0m0s  baz\n",
+		buf.String())
+}
+
+func (t *ControlTest) GetStats() {
+	p := path.Join(t.dir, "control.sock")
+	l, err := startControlServer(p, &t.server)
+	AssertEq(nil, err)
+	defer l.Close()
+
+	s, err := getStats(p)
+	AssertEq(nil, err)
+
+	ExpectThat(s.FS.Since, timeutil.TimeEq(t.server.stats.Since))
+	ExpectEq(10, s.FS.Ops["ReadFile"].Count)
+	ExpectEq(1, s.FS.Ops["ReadFile"].Errors)
+	ExpectEq(time.Second, s.FS.Ops["ReadFile"].Duration)
+	ExpectEq(1<<20, s.FS.BytesRead)
+	ExpectEq(1, s.FS.DirtyFiles)
+
+	AssertEq(1, len(s.FS.InFlight))
+	ExpectEq("FlushFile", s.FS.InFlight[0].Op)
+	ExpectEq("baz", s.FS.InFlight[0].Name)
+}
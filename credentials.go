@@ -0,0 +1,366 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// The IAM Service Account Credentials API, with which we impersonate service
+// accounts. A variable so that tests can point it elsewhere.
+var iamCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+
+// How long impersonated access tokens last. This is the longest the API
+// allows without an organization policy exception.
+const impersonatedTokenLifetime = time.Hour
+
+// How long before their expiry tokens from --token-url are replaced, at most.
+// Tokens with short lifetimes are replaced halfway through.
+const tokenURLRefreshMargin = time.Minute
+
+// Create token source from the JSON file at the supplide path.
+func newTokenSourceFromPath(
+	path string,
+	scope string) (ts oauth2.TokenSource, err error) {
+	// Read the file.
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("ReadFile(%q): %v", path, err)
+		return
+	}
+
+	// Package google doesn't understand external account credentials, used for
+	// workload identity federation, so we handle those ourselves.
+	if isExternalAccount(contents) {
+		ts, err = newExternalAccountTokenSource(contents, scope)
+		if err != nil {
+			err = fmt.Errorf("newExternalAccountTokenSource: %v", err)
+			return
+		}
+
+		return
+	}
+
+	// Create a config struct based on its contents.
+	jwtConfig, err := google.JWTConfigFromJSON(contents, scope)
+	if err != nil {
+		err = fmt.Errorf("JWTConfigFromJSON: %v", err)
+		return
+	}
+
+	// Create the token source.
+	ts = jwtConfig.TokenSource(context.Background())
+
+	return
+}
+
+// Create the token source with which to authenticate to the supplied GCS
+// endpoint, or to the default one if nil.
+func newTokenSource(
+	flags *flagStorage,
+	endpoint *url.URL) (ts oauth2.TokenSource, err error) {
+	// Pulling notifications needs a scope covering Pub/Sub as well.
+	scope := gcs.Scope_FullControl
+	if flags.NotificationSubscription != "" {
+		scope = gcsx.CloudPlatformScope
+	}
+
+	// Emulators don't check credentials, and we don't want to send real ones
+	// in the clear anyway.
+	if endpoint != nil && endpoint.Scheme == "http" {
+		ts = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "none"})
+		return
+	}
+
+	switch {
+	case flags.TokenURL != "" && flags.KeyFile != "":
+		err = errors.New("--token-url and --key-file are incompatible")
+		return
+
+	case flags.TokenURL != "":
+		ts = newTokenURLTokenSource(flags.TokenURL)
+
+	case flags.KeyFile != "":
+		ts, err = newTokenSourceFromPath(flags.KeyFile, scope)
+		if err != nil {
+			err = fmt.Errorf("newTokenSourceFromPath: %v", err)
+			return
+		}
+
+	// Nor does it understand them when found by way of the environment.
+	case externalAccountInEnvironment():
+		p := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		ts, err = newTokenSourceFromPath(p, scope)
+		if err != nil {
+			err = fmt.Errorf("newTokenSourceFromPath: %v", err)
+			return
+		}
+
+	default:
+		ts, err = google.DefaultTokenSource(context.Background(), scope)
+		if err != nil {
+			err = fmt.Errorf("DefaultTokenSource: %v", err)
+			return
+		}
+	}
+
+	// Use those credentials to impersonate a service account, if requested.
+	if flags.ImpersonateServiceAccount != "" {
+		var target string
+		var delegates []string
+		target, delegates, err = parseImpersonationChain(
+			flags.ImpersonateServiceAccount)
+
+		if err != nil {
+			err = fmt.Errorf("--impersonate-service-account: %v", err)
+			return
+		}
+
+		ts = newImpersonatedTokenSource(ts, target, delegates, scope)
+	}
+
+	return
+}
+
+// Parse a comma-separated list of service account emails, as taken by
+// --impersonate-service-account. The last is the account to impersonate. Any
+// others form a delegation chain, in order starting from the account that the
+// underlying credentials may impersonate, each of which may impersonate the
+// next.
+func parseImpersonationChain(
+	s string) (target string, delegates []string, err error) {
+	chain := strings.Split(s, ",")
+	for i, email := range chain {
+		chain[i] = strings.TrimSpace(email)
+		if chain[i] == "" {
+			err = fmt.Errorf("Empty service account in %q", s)
+			return
+		}
+	}
+
+	target = chain[len(chain)-1]
+	delegates = chain[:len(chain)-1]
+
+	return
+}
+
+// Create a token source that uses the credentials from the supplied one to
+// obtain access tokens for the target service account from the IAM Service
+// Account Credentials API, via the supplied delegates. Tokens are reused until
+// they expire.
+func newImpersonatedTokenSource(
+	base oauth2.TokenSource,
+	target string,
+	delegates []string,
+	scope string) (ts oauth2.TokenSource) {
+	ts = oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		client:    oauth2.NewClient(context.Background(), base),
+		target:    target,
+		delegates: delegates,
+		scope:     scope,
+	})
+
+	return
+}
+
+type impersonatedTokenSource struct {
+	client    *http.Client
+	target    string
+	delegates []string
+	scope     string
+
+	// The URL of the generateAccessToken method for the target, or empty to
+	// derive it from iamCredentialsEndpoint.
+	url string
+}
+
+func (ts *impersonatedTokenSource) Token() (t *oauth2.Token, err error) {
+	// Build the request.
+	req := struct {
+		Delegates []string `json:"delegates,omitempty"`
+		Scope     []string `json:"scope"`
+		Lifetime  string   `json:"lifetime"`
+	}{
+		Scope:    []string{ts.scope},
+		Lifetime: fmt.Sprintf("%ds", int64(impersonatedTokenLifetime/time.Second)),
+	}
+
+	for _, d := range ts.delegates {
+		req.Delegates = append(req.Delegates, "projects/-/serviceAccounts/"+d)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("json.Marshal: %v", err)
+		return
+	}
+
+	u := ts.url
+	if u == "" {
+		u = fmt.Sprintf(
+			"%s/v1/projects/-/serviceAccounts/%s:generateAccessToken",
+			iamCredentialsEndpoint,
+			url.QueryEscape(ts.target))
+	}
+
+	// Send it.
+	resp, err := ts.client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		err = fmt.Errorf("Impersonating %s: %v", ts.target, err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("ReadAll: %v", err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf(
+			"Impersonating %s: %s: %s",
+			ts.target,
+			resp.Status,
+			bytes.TrimSpace(contents))
+
+		return
+	}
+
+	// Parse the response.
+	var parsed struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+
+	err = json.Unmarshal(contents, &parsed)
+	if err != nil {
+		err = fmt.Errorf("Unmarshaling generateAccessToken response: %v", err)
+		return
+	}
+
+	t = &oauth2.Token{
+		AccessToken: parsed.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      parsed.ExpireTime,
+	}
+
+	return
+}
+
+// Create a token source that fetches access tokens from the supplied URL, e.g.
+// that of a local credential broker, replacing them before they expire. The
+// URL must respond to GET requests with a JSON object containing an
+// access_token field and either an expires_in field giving its lifetime in
+// seconds or an RFC 3339 expiry field. Tokens with neither are used until a
+// request fails.
+func newTokenURLTokenSource(u string) (ts oauth2.TokenSource) {
+	ts = oauth2.ReuseTokenSource(nil, &tokenURLTokenSource{
+		url:    u,
+		client: http.DefaultClient,
+	})
+
+	return
+}
+
+type tokenURLTokenSource struct {
+	url    string
+	client *http.Client
+}
+
+func (ts *tokenURLTokenSource) Token() (t *oauth2.Token, err error) {
+	resp, err := ts.client.Get(ts.url)
+	if err != nil {
+		err = fmt.Errorf("Fetching token: %v", err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("ReadAll: %v", err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf(
+			"Fetching token from %s: %s: %s",
+			ts.url,
+			resp.Status,
+			bytes.TrimSpace(contents))
+
+		return
+	}
+
+	// Parse the response.
+	var parsed struct {
+		AccessToken string    `json:"access_token"`
+		TokenType   string    `json:"token_type"`
+		ExpiresIn   int64     `json:"expires_in"`
+		Expiry      time.Time `json:"expiry"`
+	}
+
+	err = json.Unmarshal(contents, &parsed)
+	if err != nil {
+		err = fmt.Errorf("Unmarshaling token from %s: %v", ts.url, err)
+		return
+	}
+
+	if parsed.AccessToken == "" {
+		err = fmt.Errorf("No access_token in response from %s", ts.url)
+		return
+	}
+
+	t = &oauth2.Token{
+		AccessToken: parsed.AccessToken,
+		TokenType:   parsed.TokenType,
+	}
+
+	// Pretend that the token expires early, so that it's replaced while still
+	// valid.
+	expiry := parsed.Expiry
+	if parsed.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(parsed.ExpiresIn) * time.Second)
+	}
+
+	if !expiry.IsZero() {
+		margin := expiry.Sub(time.Now()) / 2
+		if margin > tokenURLRefreshMargin {
+			margin = tokenURLRefreshMargin
+		}
+
+		t.Expiry = expiry.Add(-margin)
+	}
+
+	return
+}
@@ -0,0 +1,776 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/authfake"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCredentials(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Environment variables that influence credential resolution.
+var credentialEnvVars = []string{
+	"GOOGLE_APPLICATION_CREDENTIALS",
+	"GCE_METADATA_HOST",
+	"HOME",
+	"AWS_REGION",
+	"AWS_DEFAULT_REGION",
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+}
+
+type CredentialsTest struct {
+	server *authfake.Server
+	flags  flagStorage
+
+	// A temporary directory, which also serves as $HOME so that gcloud's
+	// well-known credentials file is not found. Removed in TearDown.
+	dir string
+
+	// A service account key file pointing at the server.
+	keyFile string
+
+	// The original values of credentialEnvVars.
+	savedEnv map[string]string
+
+	// The original IAM Service Account Credentials API endpoint.
+	savedIAMCredentialsEndpoint string
+}
+
+var _ SetUpInterface = &CredentialsTest{}
+var _ TearDownInterface = &CredentialsTest{}
+
+func init() { RegisterTestSuite(&CredentialsTest{}) }
+
+func (t *CredentialsTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.server, err = authfake.NewServer()
+	AssertEq(nil, err)
+
+	t.dir, err = ioutil.TempDir("", "credentials_test")
+	AssertEq(nil, err)
+
+	t.keyFile = path.Join(t.dir, "key.json")
+	err = t.server.WriteServiceAccountKey(t.keyFile)
+	AssertEq(nil, err)
+
+	// Start with a clean environment.
+	t.savedEnv = make(map[string]string)
+	for _, k := range credentialEnvVars {
+		t.savedEnv[k] = os.Getenv(k)
+		os.Unsetenv(k)
+	}
+
+	os.Setenv("HOME", t.dir)
+
+	t.savedIAMCredentialsEndpoint = iamCredentialsEndpoint
+	iamCredentialsEndpoint = t.server.URL()
+}
+
+func (t *CredentialsTest) TearDown() {
+	for k, v := range t.savedEnv {
+		os.Setenv(k, v)
+	}
+
+	iamCredentialsEndpoint = t.savedIAMCredentialsEndpoint
+
+	t.server.Close()
+	os.RemoveAll(t.dir)
+}
+
+// The audience of the workload identity pool provider used in tests.
+const testAudience = "//iam.googleapis.com/projects/123/locations/global/" +
+	"workloadIdentityPools/some-pool/providers/some-provider"
+
+// Write an external account credentials file directing token exchanges to the
+// server, with the supplied credential source and any further fields, and
+// return its path.
+func (t *CredentialsTest) writeExternalAccount(
+	credentialSource map[string]interface{},
+	extra map[string]interface{}) (p string) {
+	config := map[string]interface{}{
+		"type":               "external_account",
+		"audience":           testAudience,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          t.server.TokenURL(),
+		"credential_source":  credentialSource,
+	}
+
+	for k, v := range extra {
+		config[k] = v
+	}
+
+	contents, err := json.Marshal(config)
+	AssertEq(nil, err)
+
+	p = path.Join(t.dir, "external_account.json")
+	err = ioutil.WriteFile(p, contents, 0600)
+	AssertEq(nil, err)
+
+	return
+}
+
+// Decode an AWS subject token into the request it describes.
+func decodeAWSSubjectToken(token string) (
+	u string,
+	method string,
+	headers map[string]string) {
+	unescaped, err := url.QueryUnescape(token)
+	AssertEq(nil, err)
+
+	var decoded struct {
+		URL     string
+		Method  string
+		Headers []struct {
+			Key   string
+			Value string
+		}
+	}
+
+	err = json.Unmarshal([]byte(unescaped), &decoded)
+	AssertEq(nil, err)
+
+	headers = make(map[string]string)
+	for _, h := range decoded.Headers {
+		headers[h.Key] = h.Value
+	}
+
+	u = decoded.URL
+	method = decoded.Method
+	return
+}
+
+func (t *CredentialsTest) newTokenSource() (ts oauth2.TokenSource) {
+	ts, err := newTokenSource(&t.flags, nil)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CredentialsTest) KeyFile() {
+	t.flags.KeyFile = t.keyFile
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+
+	ExpectEq("fake-token-0", token.AccessToken)
+	ExpectThat(t.server.ScopesRequested(), ElementsAre(gcs.Scope_FullControl))
+}
+
+func (t *CredentialsTest) KeyFile_DoesntExist() {
+	t.flags.KeyFile = path.Join(t.dir, "foobar")
+
+	_, err := newTokenSource(&t.flags, nil)
+	ExpectThat(err, Error(HasSubstr(t.flags.KeyFile)))
+	ExpectThat(err, Error(HasSubstr("no such file")))
+}
+
+func (t *CredentialsTest) KeyFile_TokenReusedUntilExpiry() {
+	t.flags.KeyFile = t.keyFile
+	ts := t.newTokenSource()
+
+	for i := 0; i < 3; i++ {
+		token, err := ts.Token()
+		AssertEq(nil, err)
+		ExpectEq("fake-token-0", token.AccessToken)
+	}
+
+	ExpectEq(1, len(t.server.TokensIssued()))
+}
+
+func (t *CredentialsTest) KeyFile_TokenRefreshedOnExpiry() {
+	// Issue tokens that package oauth2 will consider expired immediately.
+	t.server.SetTokenLifetime(5 * time.Second)
+
+	t.flags.KeyFile = t.keyFile
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-0", token.AccessToken)
+
+	token, err = ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-1", token.AccessToken)
+}
+
+func (t *CredentialsTest) KeyFile_CredentialsRevoked() {
+	t.flags.KeyFile = t.keyFile
+	ts := t.newTokenSource()
+
+	t.server.SetRefusing(true)
+
+	_, err := ts.Token()
+	ExpectThat(err, Error(HasSubstr("invalid_grant")))
+}
+
+func (t *CredentialsTest) EnvironmentVariable() {
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", t.keyFile)
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-0", token.AccessToken)
+}
+
+func (t *CredentialsTest) EnvironmentVariable_DoesntExist() {
+	p := path.Join(t.dir, "foobar")
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", p)
+
+	_, err := newTokenSource(&t.flags, nil)
+	ExpectThat(err, Error(HasSubstr(p)))
+	ExpectThat(err, Error(HasSubstr("no such file")))
+}
+
+func (t *CredentialsTest) KeyFileTakesPrecedenceOverEnvironment() {
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path.Join(t.dir, "foobar"))
+	t.flags.KeyFile = t.keyFile
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-0", token.AccessToken)
+}
+
+func (t *CredentialsTest) MetadataServer() {
+	os.Setenv("GCE_METADATA_HOST", t.server.MetadataHost())
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+
+	ExpectEq("fake-token-0", token.AccessToken)
+	ExpectThat(t.server.ScopesRequested(), ElementsAre(""))
+}
+
+func (t *CredentialsTest) MetadataServer_TokenRefreshedOnExpiry() {
+	t.server.SetTokenLifetime(5 * time.Second)
+
+	os.Setenv("GCE_METADATA_HOST", t.server.MetadataHost())
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-0", token.AccessToken)
+
+	token, err = ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-1", token.AccessToken)
+}
+
+func (t *CredentialsTest) PlainHTTPEndpoint() {
+	// Even with credentials available, none should be used.
+	t.flags.KeyFile = t.keyFile
+	endpoint, err := url.Parse("http://localhost:4443")
+	AssertEq(nil, err)
+
+	ts, err := newTokenSource(&t.flags, endpoint)
+	AssertEq(nil, err)
+
+	_, err = ts.Token()
+	AssertEq(nil, err)
+	ExpectEq(0, len(t.server.TokensIssued()))
+}
+
+func (t *CredentialsTest) Impersonation() {
+	const target = "target@fake-project.iam.gserviceaccount.com"
+	t.flags.KeyFile = t.keyFile
+	t.flags.ImpersonateServiceAccount = target
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-1", token.AccessToken)
+
+	// The key file's token was used to impersonate the target.
+	impersonations := t.server.Impersonations()
+	AssertEq(1, len(impersonations))
+	ExpectEq("fake-token-0", impersonations[0].CallerToken)
+	ExpectEq("projects/-/serviceAccounts/"+target, impersonations[0].Target)
+	ExpectEq(0, len(impersonations[0].Delegates))
+
+	ExpectThat(
+		t.server.ScopesRequested(),
+		ElementsAre(gcs.Scope_FullControl, gcs.Scope_FullControl))
+}
+
+func (t *CredentialsTest) Impersonation_DelegateChain() {
+	t.flags.KeyFile = t.keyFile
+	t.flags.ImpersonateServiceAccount =
+		"a@fake-project.iam.gserviceaccount.com, " +
+			"b@fake-project.iam.gserviceaccount.com, " +
+			"target@fake-project.iam.gserviceaccount.com"
+
+	ts := t.newTokenSource()
+
+	_, err := ts.Token()
+	AssertEq(nil, err)
+
+	impersonations := t.server.Impersonations()
+	AssertEq(1, len(impersonations))
+	ExpectEq(
+		"projects/-/serviceAccounts/target@fake-project.iam.gserviceaccount.com",
+		impersonations[0].Target)
+
+	ExpectThat(
+		impersonations[0].Delegates,
+		ElementsAre(
+			"projects/-/serviceAccounts/a@fake-project.iam.gserviceaccount.com",
+			"projects/-/serviceAccounts/b@fake-project.iam.gserviceaccount.com"))
+}
+
+func (t *CredentialsTest) Impersonation_InvalidChain() {
+	t.flags.KeyFile = t.keyFile
+	t.flags.ImpersonateServiceAccount = "a@fake-project.iam.gserviceaccount.com,"
+
+	_, err := newTokenSource(&t.flags, nil)
+	ExpectThat(err, Error(HasSubstr("--impersonate-service-account")))
+	ExpectThat(err, Error(HasSubstr("Empty service account")))
+}
+
+func (t *CredentialsTest) Impersonation_TokenReusedUntilExpiry() {
+	t.flags.KeyFile = t.keyFile
+	t.flags.ImpersonateServiceAccount = "target@fake-project.iam.gserviceaccount.com"
+	ts := t.newTokenSource()
+
+	for i := 0; i < 3; i++ {
+		token, err := ts.Token()
+		AssertEq(nil, err)
+		ExpectEq("fake-token-1", token.AccessToken)
+	}
+
+	ExpectEq(1, len(t.server.Impersonations()))
+}
+
+func (t *CredentialsTest) Impersonation_TokenRefreshedOnExpiry() {
+	t.server.SetTokenLifetime(5 * time.Second)
+
+	t.flags.KeyFile = t.keyFile
+	t.flags.ImpersonateServiceAccount = "target@fake-project.iam.gserviceaccount.com"
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-1", token.AccessToken)
+
+	// The caller's token has expired too, so both are refreshed.
+	token, err = ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-3", token.AccessToken)
+	ExpectEq(2, len(t.server.Impersonations()))
+}
+
+func (t *CredentialsTest) Impersonation_ErrorResponse() {
+	t.flags.KeyFile = t.keyFile
+	t.flags.ImpersonateServiceAccount = "target@fake-project.iam.gserviceaccount.com"
+	ts := t.newTokenSource()
+
+	// Send the request somewhere that will reject it.
+	iamCredentialsEndpoint = t.server.URL() + "/nonexistent"
+
+	_, err := ts.Token()
+	ExpectThat(err, Error(HasSubstr("target@fake-project.iam.gserviceaccount.com")))
+	ExpectThat(err, Error(HasSubstr("404")))
+}
+
+func (t *CredentialsTest) ExternalAccount_File() {
+	tokenFile := path.Join(t.dir, "oidc_token")
+	err := ioutil.WriteFile(tokenFile, []byte("some-oidc-token\n"), 0600)
+	AssertEq(nil, err)
+
+	t.flags.KeyFile = t.writeExternalAccount(
+		map[string]interface{}{"file": tokenFile},
+		nil)
+
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-0", token.AccessToken)
+
+	exchanges := t.server.Exchanges()
+	AssertEq(1, len(exchanges))
+	ExpectEq("some-oidc-token", exchanges[0].SubjectToken)
+	ExpectEq("urn:ietf:params:oauth:token-type:jwt", exchanges[0].SubjectTokenType)
+	ExpectEq(testAudience, exchanges[0].Audience)
+	ExpectEq(gcs.Scope_FullControl, exchanges[0].Scope)
+}
+
+func (t *CredentialsTest) ExternalAccount_URL() {
+	// Serve the subject token in JSON, as Azure's metadata server does.
+	idp := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Metadata") != "True" {
+				http.Error(w, "Missing header", http.StatusBadRequest)
+				return
+			}
+
+			fmt.Fprint(w, `{"access_token": "some-azure-token"}`)
+		}))
+
+	defer idp.Close()
+
+	t.flags.KeyFile = t.writeExternalAccount(
+		map[string]interface{}{
+			"url":     idp.URL + "/token",
+			"headers": map[string]string{"Metadata": "True"},
+			"format": map[string]string{
+				"type":                     "json",
+				"subject_token_field_name": "access_token",
+			},
+		},
+		nil)
+
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-0", token.AccessToken)
+
+	exchanges := t.server.Exchanges()
+	AssertEq(1, len(exchanges))
+	ExpectEq("some-azure-token", exchanges[0].SubjectToken)
+}
+
+func (t *CredentialsTest) ExternalAccount_EnvironmentVariable() {
+	tokenFile := path.Join(t.dir, "oidc_token")
+	err := ioutil.WriteFile(tokenFile, []byte("some-oidc-token"), 0600)
+	AssertEq(nil, err)
+
+	os.Setenv(
+		"GOOGLE_APPLICATION_CREDENTIALS",
+		t.writeExternalAccount(map[string]interface{}{"file": tokenFile}, nil))
+
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-0", token.AccessToken)
+	ExpectEq(1, len(t.server.Exchanges()))
+}
+
+func (t *CredentialsTest) ExternalAccount_Impersonation() {
+	const target = "target@fake-project.iam.gserviceaccount.com"
+
+	tokenFile := path.Join(t.dir, "oidc_token")
+	err := ioutil.WriteFile(tokenFile, []byte("some-oidc-token"), 0600)
+	AssertEq(nil, err)
+
+	t.flags.KeyFile = t.writeExternalAccount(
+		map[string]interface{}{"file": tokenFile},
+		map[string]interface{}{
+			"service_account_impersonation_url": t.server.URL() +
+				"/v1/projects/-/serviceAccounts/" + target + ":generateAccessToken",
+		})
+
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-1", token.AccessToken)
+
+	// The federated token was used only to impersonate the service account.
+	exchanges := t.server.Exchanges()
+	AssertEq(1, len(exchanges))
+	ExpectEq(cloudPlatformScope, exchanges[0].Scope)
+
+	impersonations := t.server.Impersonations()
+	AssertEq(1, len(impersonations))
+	ExpectEq("fake-token-0", impersonations[0].CallerToken)
+	ExpectEq("projects/-/serviceAccounts/"+target, impersonations[0].Target)
+	ExpectEq(gcs.Scope_FullControl, t.server.ScopesRequested()[1])
+}
+
+func (t *CredentialsTest) ExternalAccount_TokenRefreshedOnExpiry() {
+	t.server.SetTokenLifetime(5 * time.Second)
+
+	tokenFile := path.Join(t.dir, "oidc_token")
+	err := ioutil.WriteFile(tokenFile, []byte("first-oidc-token"), 0600)
+	AssertEq(nil, err)
+
+	t.flags.KeyFile = t.writeExternalAccount(
+		map[string]interface{}{"file": tokenFile},
+		nil)
+
+	ts := t.newTokenSource()
+
+	_, err = ts.Token()
+	AssertEq(nil, err)
+
+	// The file is read again, since the identity provider may have rotated it.
+	err = ioutil.WriteFile(tokenFile, []byte("second-oidc-token"), 0600)
+	AssertEq(nil, err)
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("fake-token-1", token.AccessToken)
+
+	exchanges := t.server.Exchanges()
+	AssertEq(2, len(exchanges))
+	ExpectEq("second-oidc-token", exchanges[1].SubjectToken)
+}
+
+func (t *CredentialsTest) ExternalAccount_AWSEnvironment() {
+	os.Setenv("AWS_REGION", "us-east-1")
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+
+	t.flags.KeyFile = t.writeExternalAccount(
+		map[string]interface{}{
+			"environment_id": "aws1",
+			"regional_cred_verification_url": "https://sts.{region}.amazonaws.com" +
+				"?Action=GetCallerIdentity&Version=2011-06-15",
+		},
+		nil)
+
+	ts := t.newTokenSource()
+
+	_, err := ts.Token()
+	AssertEq(nil, err)
+
+	exchanges := t.server.Exchanges()
+	AssertEq(1, len(exchanges))
+
+	u, method, headers := decodeAWSSubjectToken(exchanges[0].SubjectToken)
+	ExpectEq(
+		"https://sts.us-east-1.amazonaws.com"+
+			"?Action=GetCallerIdentity&Version=2011-06-15",
+		u)
+
+	ExpectEq("POST", method)
+	ExpectEq("sts.us-east-1.amazonaws.com", headers["host"])
+	ExpectEq(testAudience, headers["x-goog-cloud-target-resource"])
+	ExpectThat(
+		headers["Authorization"],
+		HasSubstr("Credential=AKIDEXAMPLE/"))
+	ExpectThat(
+		headers["Authorization"],
+		HasSubstr("/us-east-1/sts/aws4_request, "+
+			"SignedHeaders=host;x-amz-date;x-goog-cloud-target-resource, "))
+	ExpectNe("", headers["x-amz-date"])
+}
+
+func (t *CredentialsTest) ExternalAccount_AWSMetadata() {
+	// Play the part of the EC2 metadata server, insisting on IMDSv2.
+	metadata := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/latest/api/token" && r.Method == "PUT" {
+				fmt.Fprint(w, "some-session-token")
+				return
+			}
+
+			if r.Header.Get("X-aws-ec2-metadata-token") != "some-session-token" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/latest/meta-data/placement/availability-zone":
+				fmt.Fprint(w, "us-west-2b")
+
+			case "/latest/meta-data/iam/security-credentials":
+				fmt.Fprint(w, "some-role")
+
+			case "/latest/meta-data/iam/security-credentials/some-role":
+				fmt.Fprint(w, `{
+					"AccessKeyId": "AKIDROLE",
+					"SecretAccessKey": "some-secret",
+					"Token": "some-aws-session-token"
+				}`)
+
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+
+	defer metadata.Close()
+
+	md := metadata.URL + "/latest/meta-data"
+	t.flags.KeyFile = t.writeExternalAccount(
+		map[string]interface{}{
+			"environment_id":           "aws1",
+			"region_url":               md + "/placement/availability-zone",
+			"url":                      md + "/iam/security-credentials",
+			"imdsv2_session_token_url": metadata.URL + "/latest/api/token",
+			"regional_cred_verification_url": "https://sts.{region}.amazonaws.com" +
+				"?Action=GetCallerIdentity&Version=2011-06-15",
+		},
+		nil)
+
+	ts := t.newTokenSource()
+
+	_, err := ts.Token()
+	AssertEq(nil, err)
+
+	exchanges := t.server.Exchanges()
+	AssertEq(1, len(exchanges))
+
+	_, _, headers := decodeAWSSubjectToken(exchanges[0].SubjectToken)
+	ExpectEq("sts.us-west-2.amazonaws.com", headers["host"])
+	ExpectEq("some-aws-session-token", headers["x-amz-security-token"])
+	ExpectThat(
+		headers["Authorization"],
+		HasSubstr("Credential=AKIDROLE/"))
+	ExpectThat(
+		headers["Authorization"],
+		HasSubstr("/us-west-2/sts/aws4_request, "))
+}
+
+func (t *CredentialsTest) ExternalAccount_Invalid() {
+	t.flags.KeyFile = t.writeExternalAccount(
+		map[string]interface{}{"environment_id": "azure1"},
+		nil)
+
+	_, err := newTokenSource(&t.flags, nil)
+	ExpectThat(err, Error(HasSubstr("Unsupported environment_id")))
+
+	t.flags.KeyFile = t.writeExternalAccount(
+		map[string]interface{}{},
+		nil)
+
+	_, err = newTokenSource(&t.flags, nil)
+	ExpectThat(err, Error(HasSubstr("neither file nor url")))
+}
+
+// Serve tokens with the supplied lifetime in seconds as a credential broker
+// would, returning the server and a pointer to the number served.
+func newTokenBroker(lifetime int) (broker *httptest.Server, served *int) {
+	served = new(int)
+	broker = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(
+				w,
+				`{"access_token": "broker-token-%d", "token_type": "Bearer", `+
+					`"expires_in": %d}`,
+				*served,
+				lifetime)
+
+			*served++
+		}))
+
+	return
+}
+
+func (t *CredentialsTest) TokenURL() {
+	broker, served := newTokenBroker(3600)
+	defer broker.Close()
+
+	// Other credentials are ignored.
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", t.keyFile)
+	t.flags.TokenURL = broker.URL
+	ts := t.newTokenSource()
+
+	for i := 0; i < 3; i++ {
+		token, err := ts.Token()
+		AssertEq(nil, err)
+		ExpectEq("broker-token-0", token.AccessToken)
+	}
+
+	ExpectEq(1, *served)
+	ExpectEq(0, len(t.server.TokensIssued()))
+}
+
+func (t *CredentialsTest) TokenURL_RefreshedBeforeExpiry() {
+	// Package oauth2 considers tokens expiring within ten seconds expired, and
+	// we replace those lasting twenty seconds after ten.
+	broker, served := newTokenBroker(20)
+	defer broker.Close()
+
+	t.flags.TokenURL = broker.URL
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("broker-token-0", token.AccessToken)
+
+	token, err = ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("broker-token-1", token.AccessToken)
+	ExpectEq(2, *served)
+}
+
+func (t *CredentialsTest) TokenURL_Expiry() {
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	broker := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"access_token": "taco", "expiry": %q}`, expiry)
+		}))
+
+	defer broker.Close()
+
+	t.flags.TokenURL = broker.URL
+	ts := t.newTokenSource()
+
+	token, err := ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("taco", token.AccessToken)
+
+	// The token is replaced a minute early.
+	ExpectThat(
+		token.Expiry,
+		timeutil.TimeNear(time.Now().Add(59*time.Minute), 30*time.Second))
+}
+
+func (t *CredentialsTest) TokenURL_Error() {
+	broker := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Broker unavailable", http.StatusServiceUnavailable)
+		}))
+
+	defer broker.Close()
+
+	t.flags.TokenURL = broker.URL
+	ts := t.newTokenSource()
+
+	_, err := ts.Token()
+	ExpectThat(err, Error(HasSubstr("503")))
+	ExpectThat(err, Error(HasSubstr("Broker unavailable")))
+}
+
+func (t *CredentialsTest) TokenURL_KeyFile() {
+	t.flags.TokenURL = "http://localhost:8080/token"
+	t.flags.KeyFile = t.keyFile
+
+	_, err := newTokenSource(&t.flags, nil)
+	ExpectThat(err, Error(HasSubstr("incompatible")))
+}
@@ -0,0 +1,657 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// The scope requested from the Security Token Service when the federated token
+// is only used to impersonate a service account.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// The configuration in an external account credentials file, as created by
+// `gcloud iam workload-identity-pools create-cred-config`. It says how to
+// obtain a token from another identity provider, and how to exchange it with
+// the Security Token Service for a Google access token.
+type externalAccountConfig struct {
+	Type                           string           `json:"type"`
+	Audience                       string           `json:"audience"`
+	SubjectTokenType               string           `json:"subject_token_type"`
+	TokenURL                       string           `json:"token_url"`
+	ServiceAccountImpersonationURL string           `json:"service_account_impersonation_url"`
+	ClientID                       string           `json:"client_id"`
+	ClientSecret                   string           `json:"client_secret"`
+	CredentialSource               credentialSource `json:"credential_source"`
+}
+
+// Where to find the token from the other identity provider: a file or URL for
+// OIDC and SAML providers, or the AWS environment.
+type credentialSource struct {
+	File    string            `json:"file"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+
+	// How to extract the token from the file or URL's contents: as the whole
+	// of it ("text", the default) or from a field of a JSON object ("json").
+	Format struct {
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+
+	// For AWS, which identifies the machine with a signed request to its own
+	// Security Token Service rather than a token. The URL above gives the AWS
+	// metadata server's security credentials endpoint.
+	EnvironmentID               string `json:"environment_id"`
+	RegionURL                   string `json:"region_url"`
+	RegionalCredVerificationURL string `json:"regional_cred_verification_url"`
+	IMDSv2SessionTokenURL       string `json:"imdsv2_session_token_url"`
+}
+
+// Does the supplied credentials file describe an external account?
+func isExternalAccount(contents []byte) bool {
+	var f struct {
+		Type string `json:"type"`
+	}
+
+	return json.Unmarshal(contents, &f) == nil && f.Type == "external_account"
+}
+
+// Does GOOGLE_APPLICATION_CREDENTIALS name an external account credentials
+// file? Unreadable files are left for package google to complain about.
+func externalAccountInEnvironment() bool {
+	p := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if p == "" {
+		return false
+	}
+
+	contents, err := ioutil.ReadFile(p)
+	return err == nil && isExternalAccount(contents)
+}
+
+// Parse and validate the contents of an external account credentials file.
+func parseExternalAccountConfig(
+	contents []byte) (c *externalAccountConfig, err error) {
+	c = new(externalAccountConfig)
+	err = json.Unmarshal(contents, c)
+	if err != nil {
+		err = fmt.Errorf("json.Unmarshal: %v", err)
+		return
+	}
+
+	cs := &c.CredentialSource
+	switch {
+	case c.Type != "external_account":
+		err = fmt.Errorf("Unexpected credentials type %q", c.Type)
+
+	case c.Audience == "":
+		err = errors.New("Missing audience")
+
+	case c.TokenURL == "":
+		err = errors.New("Missing token_url")
+
+	case c.SubjectTokenType == "":
+		err = errors.New("Missing subject_token_type")
+
+	case cs.EnvironmentID != "":
+		if cs.EnvironmentID != "aws1" {
+			err = fmt.Errorf("Unsupported environment_id %q", cs.EnvironmentID)
+		} else if cs.RegionalCredVerificationURL == "" {
+			err = errors.New("Missing regional_cred_verification_url")
+		}
+
+	case cs.File == "" && cs.URL == "":
+		err = errors.New("credential_source has neither file nor url")
+
+	case cs.Format.Type != "" &&
+		cs.Format.Type != "text" &&
+		cs.Format.Type != "json":
+		err = fmt.Errorf("Unsupported credential_source format %q", cs.Format.Type)
+
+	case cs.Format.Type == "json" && cs.Format.SubjectTokenFieldName == "":
+		err = errors.New("Missing subject_token_field_name")
+	}
+
+	return
+}
+
+// Create a token source for the external account described by the supplied
+// credentials file contents.
+func newExternalAccountTokenSource(
+	contents []byte,
+	scope string) (ts oauth2.TokenSource, err error) {
+	c, err := parseExternalAccountConfig(contents)
+	if err != nil {
+		err = fmt.Errorf("parseExternalAccountConfig: %v", err)
+		return
+	}
+
+	eats := &externalAccountTokenSource{
+		config: c,
+		client: http.DefaultClient,
+		scope:  scope,
+		now:    time.Now,
+	}
+
+	// A federated token may be used directly, or only to impersonate a service
+	// account, in which case the latter needs the scope we want.
+	if c.ServiceAccountImpersonationURL == "" {
+		ts = oauth2.ReuseTokenSource(nil, eats)
+		return
+	}
+
+	eats.scope = cloudPlatformScope
+	ts = oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		client: oauth2.NewClient(
+			context.Background(),
+			oauth2.ReuseTokenSource(nil, eats)),
+		target: c.ServiceAccountImpersonationURL,
+		scope:  scope,
+		url:    c.ServiceAccountImpersonationURL,
+	})
+
+	return
+}
+
+type externalAccountTokenSource struct {
+	config *externalAccountConfig
+	client *http.Client
+	scope  string
+
+	// The current time, for signing AWS requests.
+	now func() time.Time
+}
+
+// Exchange a token from the other identity provider for a Google access token
+// using the Security Token Service, as described by RFC 8693.
+func (ts *externalAccountTokenSource) Token() (t *oauth2.Token, err error) {
+	subjectToken, err := ts.subjectToken()
+	if err != nil {
+		err = fmt.Errorf("Obtaining subject token: %v", err)
+		return
+	}
+
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {ts.config.Audience},
+		"scope":                {ts.scope},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {ts.config.SubjectTokenType},
+	}
+
+	req, err := http.NewRequest(
+		"POST",
+		ts.config.TokenURL,
+		strings.NewReader(form.Encode()))
+
+	if err != nil {
+		err = fmt.Errorf("http.NewRequest: %v", err)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if ts.config.ClientID != "" {
+		req.SetBasicAuth(ts.config.ClientID, ts.config.ClientSecret)
+	}
+
+	contents, err := ts.do(req)
+	if err != nil {
+		err = fmt.Errorf("Exchanging token: %v", err)
+		return
+	}
+
+	var parsed struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	err = json.Unmarshal(contents, &parsed)
+	if err != nil {
+		err = fmt.Errorf("Unmarshaling token exchange response: %v", err)
+		return
+	}
+
+	t = &oauth2.Token{
+		AccessToken: parsed.AccessToken,
+		TokenType:   parsed.TokenType,
+	}
+
+	if parsed.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(parsed.ExpiresIn) * time.Second)
+	}
+
+	return
+}
+
+// Send the supplied request, returning the body of a successful response.
+func (ts *externalAccountTokenSource) do(
+	req *http.Request) (contents []byte, err error) {
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	contents, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("ReadAll: %v", err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf(
+			"%s %s: %s: %s",
+			req.Method,
+			req.URL,
+			resp.Status,
+			bytes.TrimSpace(contents))
+
+		return
+	}
+
+	return
+}
+
+// Obtain the token to exchange, according to the credential source.
+func (ts *externalAccountTokenSource) subjectToken() (token string, err error) {
+	cs := &ts.config.CredentialSource
+	if cs.EnvironmentID != "" {
+		token, err = ts.awsSubjectToken()
+		return
+	}
+
+	// Read the file or URL.
+	var contents []byte
+	if cs.File != "" {
+		contents, err = ioutil.ReadFile(cs.File)
+		if err != nil {
+			err = fmt.Errorf("ReadFile: %v", err)
+			return
+		}
+	} else {
+		var req *http.Request
+		req, err = http.NewRequest("GET", cs.URL, nil)
+		if err != nil {
+			err = fmt.Errorf("http.NewRequest: %v", err)
+			return
+		}
+
+		for k, v := range cs.Headers {
+			req.Header.Set(k, v)
+		}
+
+		contents, err = ts.do(req)
+		if err != nil {
+			return
+		}
+	}
+
+	// Extract the token.
+	if cs.Format.Type != "json" {
+		token = strings.TrimSpace(string(contents))
+		if token == "" {
+			err = errors.New("Empty subject token")
+		}
+
+		return
+	}
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(contents, &fields)
+	if err != nil {
+		err = fmt.Errorf("json.Unmarshal: %v", err)
+		return
+	}
+
+	token, ok := fields[cs.Format.SubjectTokenFieldName].(string)
+	if !ok || token == "" {
+		err = fmt.Errorf("No %q field", cs.Format.SubjectTokenFieldName)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// AWS
+////////////////////////////////////////////////////////////////////////
+
+// AWS security credentials, found in the environment or from the metadata
+// server.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// An AWS API request to be signed with Signature Version 4. Header names are
+// lower case.
+type awsRequest struct {
+	method  string
+	url     *url.URL
+	headers map[string]string
+	body    []byte
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Escape a query string component as required for signing, which differs from
+// url.QueryEscape in escaping spaces as %20.
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// Sign the request for the given region and service at the given time with
+// AWS Signature Version 4, adding the x-amz-date, x-amz-security-token, and
+// authorization headers. See
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html.
+func (r *awsRequest) sign(
+	creds *awsCredentials,
+	region string,
+	service string,
+	now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	r.headers["x-amz-date"] = now.Format("20060102T150405Z")
+	if creds.Token != "" {
+		r.headers["x-amz-security-token"] = creds.Token
+	}
+
+	// Canonicalize the request.
+	path := r.url.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	query := r.url.Query()
+	var queryParts []string
+	for k, vs := range query {
+		for _, v := range vs {
+			queryParts = append(queryParts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+
+	sort.Strings(queryParts)
+
+	var names []string
+	for k := range r.headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, k := range names {
+		canonicalHeaders += k + ":" + strings.TrimSpace(r.headers[k]) + "\n"
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.method,
+		path,
+		strings.Join(queryParts, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex(r.body),
+	}, "\n")
+
+	// Sign it.
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		r.headers["x-amz-date"],
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	r.headers["authorization"] = fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID,
+		scope,
+		signedHeaders,
+		hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+// Fetch a value from the AWS metadata server, using the supplied IMDSv2
+// session token if non-empty.
+func (ts *externalAccountTokenSource) awsMetadata(
+	u string,
+	sessionToken string) (contents []byte, err error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		err = fmt.Errorf("http.NewRequest: %v", err)
+		return
+	}
+
+	if sessionToken != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", sessionToken)
+	}
+
+	contents, err = ts.do(req)
+	return
+}
+
+// Find the AWS region and security credentials, from the environment if
+// possible and otherwise from the metadata server.
+func (ts *externalAccountTokenSource) awsEnvironment() (
+	region string,
+	creds *awsCredentials,
+	err error) {
+	cs := &ts.config.CredentialSource
+
+	region = os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	creds = &awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Token:           os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	haveCreds := creds.AccessKeyID != "" && creds.SecretAccessKey != ""
+	if region != "" && haveCreds {
+		return
+	}
+
+	// We need the metadata server. Obtain an IMDSv2 session token for it if
+	// required.
+	var sessionToken string
+	if cs.IMDSv2SessionTokenURL != "" {
+		var req *http.Request
+		req, err = http.NewRequest("PUT", cs.IMDSv2SessionTokenURL, nil)
+		if err != nil {
+			err = fmt.Errorf("http.NewRequest: %v", err)
+			return
+		}
+
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+
+		var contents []byte
+		contents, err = ts.do(req)
+		if err != nil {
+			err = fmt.Errorf("Obtaining IMDSv2 session token: %v", err)
+			return
+		}
+
+		sessionToken = string(contents)
+	}
+
+	// The metadata server gives the availability zone, e.g. us-east-1b.
+	if region == "" {
+		if cs.RegionURL == "" {
+			err = errors.New("No AWS region in the environment and no region_url")
+			return
+		}
+
+		var contents []byte
+		contents, err = ts.awsMetadata(cs.RegionURL, sessionToken)
+		if err != nil {
+			err = fmt.Errorf("Finding AWS region: %v", err)
+			return
+		}
+
+		zone := strings.TrimSpace(string(contents))
+		if zone == "" {
+			err = errors.New("Empty AWS availability zone")
+			return
+		}
+
+		region = zone[:len(zone)-1]
+	}
+
+	// The metadata server gives the name of the instance's role, and then its
+	// credentials.
+	if !haveCreds {
+		if cs.URL == "" {
+			err = errors.New("No AWS credentials in the environment and no url")
+			return
+		}
+
+		var contents []byte
+		contents, err = ts.awsMetadata(cs.URL, sessionToken)
+		if err != nil {
+			err = fmt.Errorf("Finding AWS role: %v", err)
+			return
+		}
+
+		role := strings.TrimSpace(string(contents))
+		contents, err = ts.awsMetadata(cs.URL+"/"+role, sessionToken)
+		if err != nil {
+			err = fmt.Errorf("Finding AWS credentials: %v", err)
+			return
+		}
+
+		creds = new(awsCredentials)
+		err = json.Unmarshal(contents, creds)
+		if err != nil {
+			err = fmt.Errorf("Unmarshaling AWS credentials: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Create the subject token for AWS: a GetCallerIdentity request to the AWS
+// Security Token Service, signed with the machine's credentials but not sent,
+// serialized as the Security Token Service expects.
+func (ts *externalAccountTokenSource) awsSubjectToken() (
+	token string,
+	err error) {
+	region, creds, err := ts.awsEnvironment()
+	if err != nil {
+		return
+	}
+
+	u, err := url.Parse(strings.Replace(
+		ts.config.CredentialSource.RegionalCredVerificationURL,
+		"{region}",
+		region,
+		-1))
+
+	if err != nil {
+		err = fmt.Errorf("Parsing regional_cred_verification_url: %v", err)
+		return
+	}
+
+	r := &awsRequest{
+		method: "POST",
+		url:    u,
+		headers: map[string]string{
+			"host":                         u.Host,
+			"x-goog-cloud-target-resource": ts.config.Audience,
+		},
+	}
+
+	r.sign(creds, region, "sts", ts.now())
+
+	// Serialize it, with the headers in order.
+	type header struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+
+	serialized := struct {
+		URL     string   `json:"url"`
+		Method  string   `json:"method"`
+		Headers []header `json:"headers"`
+	}{
+		URL:    u.String(),
+		Method: r.method,
+	}
+
+	var names []string
+	for k := range r.headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	for _, k := range names {
+		key := k
+		if k == "authorization" {
+			key = "Authorization"
+		}
+
+		serialized.Headers = append(
+			serialized.Headers,
+			header{Key: key, Value: r.headers[k]})
+	}
+
+	contents, err := json.Marshal(serialized)
+	if err != nil {
+		err = fmt.Errorf("json.Marshal: %v", err)
+		return
+	}
+
+	token = url.QueryEscape(string(contents))
+
+	return
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestExternalAccount(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ExternalAccountTest struct {
+}
+
+func init() { RegisterTestSuite(&ExternalAccountTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ExternalAccountTest) SignAWSRequest() {
+	// The example from AWS's Signature Version 4 documentation.
+	u, err := url.Parse(
+		"https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08")
+	AssertEq(nil, err)
+
+	r := &awsRequest{
+		method: "GET",
+		url:    u,
+		headers: map[string]string{
+			"content-type": "application/x-www-form-urlencoded; charset=utf-8",
+			"host":         "iam.amazonaws.com",
+		},
+	}
+
+	creds := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+
+	r.sign(
+		creds,
+		"us-east-1",
+		"iam",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	ExpectEq("20150830T123600Z", r.headers["x-amz-date"])
+	ExpectEq(
+		"AWS4-HMAC-SHA256 "+
+			"Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+			"SignedHeaders=content-type;host;x-amz-date, "+
+			"Signature="+
+			"5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		r.headers["authorization"])
+
+	_, ok := r.headers["x-amz-security-token"]
+	ExpectFalse(ok)
+}
+
+func (t *ExternalAccountTest) SignAWSRequest_SessionToken() {
+	u, err := url.Parse("https://sts.us-east-1.amazonaws.com/")
+	AssertEq(nil, err)
+
+	r := &awsRequest{
+		method:  "POST",
+		url:     u,
+		headers: map[string]string{"host": u.Host},
+	}
+
+	creds := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		Token:           "some-session-token",
+	}
+
+	r.sign(creds, "us-east-1", "sts", time.Now())
+
+	ExpectEq("some-session-token", r.headers["x-amz-security-token"])
+	ExpectThat(
+		r.headers["authorization"],
+		HasSubstr("SignedHeaders=host;x-amz-date;x-amz-security-token, "))
+}
+
+func (t *ExternalAccountTest) ParseConfig() {
+	testCases := []struct {
+		contents      string
+		expectedError string
+	}{
+		0: {`{"type": "service_account"}`, "Unexpected credentials type"},
+		1: {`{"type": "external_account"}`, "Missing audience"},
+		2: {`{"type": "external_account", "audience": "a"}`, "Missing token_url"},
+		3: {
+			`{"type": "external_account", "audience": "a", "token_url": "u", ` +
+				`"subject_token_type": "t", "credential_source": ` +
+				`{"file": "f", "format": {"type": "json"}}}`,
+			"Missing subject_token_field_name",
+		},
+		4: {
+			`{"type": "external_account", "audience": "a", "token_url": "u", ` +
+				`"subject_token_type": "t", "credential_source": ` +
+				`{"environment_id": "aws1"}}`,
+			"Missing regional_cred_verification_url",
+		},
+	}
+
+	for i, tc := range testCases {
+		_, err := parseExternalAccountConfig([]byte(tc.contents))
+		ExpectThat(err, Error(HasSubstr(tc.expectedError)), "case %d", i)
+	}
+
+	c, err := parseExternalAccountConfig([]byte(
+		`{"type": "external_account", "audience": "a", "token_url": "u", ` +
+			`"subject_token_type": "t", "credential_source": {"file": "f"}}`))
+
+	AssertEq(nil, err)
+	ExpectEq("f", c.CredentialSource.File)
+}
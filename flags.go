@@ -16,11 +16,18 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
 	mountpkg "github.com/googlecloudplatform/gcsfuse/internal/mount"
 )
 
@@ -30,7 +37,7 @@ func init() {
    {{.Name}} - {{.Usage}}
 
 USAGE:
-   {{.Name}} {{if .Flags}}[global options]{{end}} bucket mountpoint
+   {{.Name}} {{if .Flags}}[global options]{{end}} [bucket] mountpoint
    {{if .Version}}
 VERSION:
    {{.Version}}
@@ -54,11 +61,60 @@ func newApp() (app *cli.App) {
 	fileModeValue := new(OctalInt)
 	*fileModeValue = 0644
 
+	nonEmptyValue := new(NonEmptyPolicy)
+	*nonEmptyValue = NonEmptyRefuse
+
+	fileRulesValue := new(FileRules)
+
+	bandwidthScheduleValue := new(BandwidthSchedule)
+
+	nameFormValue := new(NameForm)
+
+	uidMapValue := new(IDMap)
+	gidMapValue := new(IDMap)
+
+	unchangedContentValue := new(UnchangedContent)
+
+	contentTypesValue := make(ContentTypes)
+	cacheControlValue := new(CacheControlRules)
+
+	storageClassValue := new(StorageClass)
+	storageClassOverridesValue := new(StorageClassOverrides)
+
+	listProjectionValue := new(ListProjection)
+	*listProjectionValue = ListProjection(gcsx.ListProjectionFull)
+
+	gzipObjectsValue := new(GzipObjects)
+	*gzipObjectsValue = GzipObjects(gcsx.GzipObjectsRaw)
+
+	clientProtocolValue := new(ClientProtocol)
+	*clientProtocolValue = ClientProtocolHTTP2
+
+	retryableCodesValue := new(RetryableCodes)
+	*retryableCodesValue = RetryableCodes{408, 429, 500, 502, 503, 504}
+
+	retryOverridesValue := new(RetryOverrides)
+
+	profileValue := new(Profile)
+
+	prefetchMetadataValue := new(PrefetchMetadata)
+
+	logFormatValue := new(LogFormat)
+	*logFormatValue = LogFormat(logger.FormatText)
+
+	logSeverityValue := new(LogSeverity)
+	*logSeverityValue = LogSeverity(logger.Info)
+
 	app = &cli.App{
 		Name:    "gcsfuse",
 		Version: getVersion(),
 		Usage:   "Mount a GCS bucket locally",
 		Writer:  os.Stderr,
+		Commands: []cli.Command{
+			newHelpCommand(),
+			newLsofCommand(),
+			newTopCommand(),
+		},
 		Flags: []cli.Flag{
 
 			cli.BoolFlag{
@@ -66,6 +122,27 @@ func newApp() (app *cli.App) {
 				Usage: "Stay in the foreground after mounting.",
 			},
 
+			cli.BoolFlag{
+				Name: "force-unmount",
+				Usage: "Unmount on SIGINT even if some files have not yet been " +
+					"written to GCS, losing their contents.",
+			},
+
+			cli.StringFlag{
+				Name: "config-file",
+				Usage: "Read flag values from the given file, which contains lines " +
+					"of the form \"flag-name: value\". Flags given on the command " +
+					"line take precedence.",
+			},
+
+			cli.GenericFlag{
+				Name:  "profile",
+				Value: profileValue,
+				Usage: "Preset caching and tuning flags for a workload: " +
+					"ml-training, media-serving, backup, or interactive. Flags " +
+					"given explicitly take precedence. See docs/mounting.md.",
+			},
+
 			/////////////////////////
 			// File system
 			/////////////////////////
@@ -87,6 +164,14 @@ func newApp() (app *cli.App) {
 				Usage: "Permission bits for files, in octal.",
 			},
 
+			cli.GenericFlag{
+				Name:  "nonempty-mount-point",
+				Value: nonEmptyValue,
+				Usage: "What to do when the mount point is not empty, in which case " +
+					"its contents are hidden until unmounting: refuse, warn, or " +
+					"allow. Passing -o nonempty implies allow.",
+			},
+
 			cli.IntFlag{
 				Name:  "uid",
 				Value: -1,
@@ -99,17 +184,174 @@ func newApp() (app *cli.App) {
 				Usage: "GID owner of all inodes.",
 			},
 
+			cli.GenericFlag{
+				Name:  "uid-map",
+				Value: uidMapValue,
+				Usage: "Map UIDs inside a user namespace, such as a container's, " +
+					"to host UIDs, as comma-separated inside:outside:count ranges " +
+					"like those in /proc/PID/uid_map. --uid is then taken to be " +
+					"inside the namespace, defaulting to its root, and the mount " +
+					"admits other users subject to permissions.",
+			},
+
+			cli.GenericFlag{
+				Name:  "gid-map",
+				Value: gidMapValue,
+				Usage: "Like --uid-map, but for GIDs and --gid.",
+			},
+
+			cli.BoolFlag{
+				Name: "allow-other",
+				Usage: "Let users other than the one mounting use the file system, " +
+					"subject to --file-mode, --dir-mode, --uid, and --gid. The same " +
+					"as -o allow_other. See docs/mounting.md.",
+			},
+
+			cli.BoolTFlag{
+				Name: "default-permissions",
+				Usage: "Have the kernel check each access against the modes and " +
+					"owners of inodes. With --default-permissions=false, any user " +
+					"admitted to the mount may do anything. See docs/mounting.md.",
+			},
+
+			cli.BoolFlag{
+				Name: "preserve-posix-metadata",
+				Usage: "Record the permission bits, owner, and group given to files " +
+					"by chmod and chown in their objects' metadata, and report them " +
+					"in place of --file-mode, --uid, and --gid. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "reflect-iam-permissions",
+				Usage: "At mount time, ask GCS which object permissions the " +
+					"credentials have on the bucket, and clear the bits of " +
+					"--file-mode and --dir-mode that they don't allow, so that the " +
+					"kernel refuses such access up front. See docs/semantics.md",
+			},
+
 			cli.BoolFlag{
 				Name: "implicit-dirs",
 				Usage: "Implicitly define directories based on content. See " +
 					"docs/semantics.md",
 			},
 
+			cli.IntFlag{
+				Name: "rename-dir-limit",
+				Usage: "Allow renaming directories that contain up to this many " +
+					"objects, by copying and then deleting each one. Such renames " +
+					"are not atomic. Ignored for buckets with a hierarchical " +
+					"namespace, whose directories can always be renamed. " +
+					"(default: directories can't be renamed)",
+			},
+
 			cli.StringFlag{
 				Name:  "only-dir",
 				Usage: "Mount only the given directory, relative to the bucket root.",
 			},
 
+			cli.StringFlag{
+				Name: "prefix-dirs",
+				Usage: "Mount only the given prefixes of the bucket, each as a " +
+					"named directory under the mount point, as a semicolon-separated " +
+					"list of name:prefix pairs. Incompatible with --only-dir.",
+			},
+
+			cli.StringFlag{
+				Name: "mapping-file",
+				Usage: "Mount a tree of directories from one or more buckets, as " +
+					"described by the given file. The bucket given on the command " +
+					"line holds temporary objects. See docs/mounting.md.",
+			},
+
+			cli.StringSliceFlag{
+				Name: "mapping",
+				Usage: "Like --mapping-file, but giving one line of a mapping file " +
+					"directly, as in a config file. May be repeated.",
+			},
+
+			cli.StringFlag{
+				Name: "versions-dir",
+				Usage: "Expose every generation of each object, including " +
+					"noncurrent ones kept by object versioning, read-only beneath " +
+					"a directory with this name at the top of the mount, e.g. " +
+					"\".versions\". (default: none)",
+			},
+
+			cli.StringSliceFlag{
+				Name: "include",
+				Usage: "Show only the objects matching this glob pattern, which may " +
+					"use ** to match any number of directories. May be repeated. " +
+					"See docs/semantics.md",
+			},
+
+			cli.StringSliceFlag{
+				Name: "exclude",
+				Usage: "Hide the objects matching this glob pattern, and refuse to " +
+					"create them. May be repeated. See docs/semantics.md",
+			},
+
+			cli.GenericFlag{
+				Name:  "file-rules",
+				Value: fileRulesValue,
+				Usage: "Adjust the handling of files matching glob patterns, as a " +
+					"semicolon-separated list of pattern:action pairs, where action " +
+					"is parallel-download, no-cache, write-through, or compress. " +
+					"See docs/semantics.md.",
+			},
+
+			cli.GenericFlag{
+				Name:  "normalize-names",
+				Value: nameFormValue,
+				Usage: "Unicode normalization form for the names of new files and " +
+					"directories: none, nfc, or nfd. Lookups also find names stored " +
+					"in the other form, so that files written on OS X and Linux " +
+					"match. See docs/semantics.md.",
+			},
+
+			cli.GenericFlag{
+				Name:  "unchanged-content",
+				Value: unchangedContentValue,
+				Usage: "What to do when a modified file turns out to have the same " +
+					"contents as its object, judged by CRC32C: upload it anyway, " +
+					"skip the upload, or touch only the object's mtime. Saves " +
+					"bandwidth for tools that rewrite unchanged files. One of " +
+					"upload, skip, or touch.",
+			},
+
+			cli.GenericFlag{
+				Name:  "content-types",
+				Value: contentTypesValue,
+				Usage: "MIME types for objects created through the mount, by file " +
+					"extension, in addition to or replacing the system's. " +
+					"Comma-separated .ext=type entries.",
+			},
+
+			cli.GenericFlag{
+				Name:  "cache-control",
+				Value: cacheControlValue,
+				Usage: "Set the Cache-Control of objects created through the mount " +
+					"whose names match a pattern, given as pattern=directives. " +
+					"May be repeated; the last matching rule wins. See " +
+					"docs/semantics.md.",
+			},
+
+			cli.GenericFlag{
+				Name:  "storage-class",
+				Value: storageClassValue,
+				Usage: "The storage class of objects created through the mount: " +
+					"one of " + strings.Join(gcsx.StorageClasses(), ", ") + ". " +
+					"(default: the bucket's default storage class)",
+			},
+
+			cli.GenericFlag{
+				Name:  "storage-class-overrides",
+				Value: storageClassOverridesValue,
+				Usage: "Storage classes for objects created through the mount " +
+					"whose names begin with particular prefixes, replacing " +
+					"--storage-class. Semicolon-separated prefix:class entries; " +
+					"the longest matching prefix wins.",
+			},
+
 			/////////////////////////
 			// GCS
 			/////////////////////////
@@ -121,6 +363,21 @@ func newApp() (app *cli.App) {
 					"(default: none)",
 			},
 
+			cli.StringFlag{
+				Name: "project",
+				Usage: "Project whose buckets appear when mounting all buckets, " +
+					"with the bucket name _. (default: that of the credentials)",
+			},
+
+			cli.StringFlag{
+				Name:  "endpoint",
+				Value: "",
+				Usage: "URL of the GCS JSON API endpoint to use, e.g. a GCS emulator. " +
+					"Credentials are not used for plain http endpoints. " +
+					"If unset, $STORAGE_EMULATOR_HOST is used if set. " +
+					"(default: https://www.googleapis.com)",
+			},
+
 			cli.StringFlag{
 				Name:  "key-file",
 				Value: "",
@@ -128,6 +385,35 @@ func newApp() (app *cli.App) {
 					"(default: none, Google application default credentials used)",
 			},
 
+			cli.StringFlag{
+				Name: "impersonate-service-account",
+				Usage: "Use the credentials to impersonate this service account. " +
+					"A comma-separated list of service accounts is a delegation " +
+					"chain, ending with the account to impersonate. " +
+					"(default: none)",
+			},
+
+			cli.StringFlag{
+				Name: "token-url",
+				Usage: "Fetch access tokens from this URL, e.g. that of a local " +
+					"credential broker, rather than using credentials. " +
+					"Incompatible with --key-file. (default: none)",
+			},
+
+			cli.StringFlag{
+				Name: "encryption-key",
+				Usage: "A base64-encoded AES-256 key with which to encrypt objects " +
+					"written and decrypt objects read, as a customer-supplied " +
+					"encryption key. Prefer --encryption-key-file, since command " +
+					"lines are visible to other users.",
+			},
+
+			cli.StringFlag{
+				Name: "encryption-key-file",
+				Usage: "A file holding a key in the form taken by --encryption-key. " +
+					"Incompatible with --encryption-key.",
+			},
+
 			cli.Float64Flag{
 				Name:  "limit-bytes-per-sec",
 				Value: -1,
@@ -135,6 +421,16 @@ func newApp() (app *cli.App) {
 					"window. (use -1 for no limit)",
 			},
 
+			cli.GenericFlag{
+				Name:  "bandwidth-schedule",
+				Value: bandwidthScheduleValue,
+				Usage: "Limit reading and writing of object contents by time of day, " +
+					"as a semicolon-separated list of HH:MM-HH:MM=read/write " +
+					"windows in local time, with limits in bytes per second or " +
+					"none. The first matching window applies, and there is no " +
+					"limit outside of them. See docs/mounting.md.",
+			},
+
 			cli.Float64Flag{
 				Name:  "limit-ops-per-sec",
 				Value: 5.0,
@@ -142,22 +438,249 @@ func newApp() (app *cli.App) {
 					"(use -1 for no limit)",
 			},
 
+			cli.IntFlag{
+				Name:  "max-concurrent-requests",
+				Value: 100,
+				Usage: "Limit on concurrent GCS requests. When GCS responds that " +
+					"it is throttling us, the limit is halved and throttled " +
+					"requests other than uploads are retried, then the limit " +
+					"is raised again gradually. (use 0 for no limit)",
+			},
+
+			cli.GenericFlag{
+				Name:  "client-protocol",
+				Value: clientProtocolValue,
+				Usage: "The HTTP version to use for GCS: http1, which opens many " +
+					"TCP connections, or http2, which multiplexes requests over " +
+					"fewer.",
+			},
+
+			cli.IntFlag{
+				Name: "max-conns-per-host",
+				Usage: "Limit on connections to GCS, including those in use, " +
+					"being dialed, and idle. (default: no limit)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-idle-conns-per-host",
+				Value: http.DefaultMaxIdleConnsPerHost,
+				Usage: "How many idle connections to GCS to keep open for reuse. " +
+					"Raise this for highly parallel workloads, which otherwise " +
+					"open new connections often.",
+			},
+
+			cli.DurationFlag{
+				Name:  "idle-conn-timeout",
+				Value: 90 * time.Second,
+				Usage: "How long to keep an idle connection to GCS open for " +
+					"reuse. (use 0 for no limit)",
+			},
+
+			cli.DurationFlag{
+				Name:  "tcp-keep-alive",
+				Value: 30 * time.Second,
+				Usage: "The interval between TCP keep-alive probes on connections " +
+					"to GCS. (use -1 to disable)",
+			},
+
+			cli.IntFlag{
+				Name: "list-page-size",
+				Usage: fmt.Sprintf(
+					"How many objects and directories to ask for in each page "+
+						"of a listing, up to %d. (default: chosen by GCS)",
+					gcsx.MaxListPageSize),
+			},
+
+			cli.GenericFlag{
+				Name:  "list-projection",
+				Value: listProjectionValue,
+				Usage: "The object metadata to ask for in listings: full, or " +
+					"noAcl to leave out access control lists.",
+			},
+
+			cli.GenericFlag{
+				Name:  "gzip-objects",
+				Value: gzipObjectsValue,
+				Usage: "How to present objects stored with Content-Encoding: " +
+					"gzip: raw, as the bytes stored, or decompress, with their " +
+					"decompressed size and contents.",
+			},
+
+			cli.BoolFlag{
+				Name: "verify-crc32c",
+				Usage: "Check objects read in full against their CRC32C, failing " +
+					"the read with EIO on a mismatch. See docs/semantics.md.",
+			},
+
+			cli.DurationFlag{
+				Name: "read-stall-timeout",
+				Usage: "Cancel a read of object contents from which no data has " +
+					"arrived for this long, and ask for the rest on another " +
+					"connection, giving up after three retries. " +
+					"(default: wait indefinitely)",
+			},
+
+			cli.BoolFlag{
+				Name: "read-stall-other-ip",
+				Usage: "With --read-stall-timeout, also avoid connecting to the IP " +
+					"address of a server from which a read stalled for ten minutes, " +
+					"if GCS's host name resolves to others.",
+			},
+
+			cli.IntFlag{
+				Name: "max-retry-attempts",
+				Usage: "How many times to retry a GCS request that fails with a " +
+					"network error or one of --retryable-codes. (default: no " +
+					"retries)",
+			},
+
+			cli.DurationFlag{
+				Name:  "max-retry-sleep",
+				Value: 30 * time.Second,
+				Usage: "The longest to wait between attempts at a GCS request.",
+			},
+
+			cli.Float64Flag{
+				Name:  "retry-multiplier",
+				Value: 2,
+				Usage: "The factor by which the wait between attempts at a GCS " +
+					"request grows after each, starting from a second.",
+			},
+
+			cli.GenericFlag{
+				Name:  "retryable-codes",
+				Value: retryableCodesValue,
+				Usage: "Comma-separated HTTP status codes of GCS errors after " +
+					"which to retry.",
+			},
+
+			cli.GenericFlag{
+				Name:  "retry-overrides",
+				Value: retryOverridesValue,
+				Usage: "Retry settings for particular operations, replacing the " +
+					"above. Semicolon-separated op:key=value[,key=value] entries, " +
+					"where op is one of " + strings.Join(gcsx.RetryOps(), ", ") +
+					" and key is attempts, sleep, or multiplier.",
+			},
+
+			cli.DurationFlag{
+				Name: "custom-time-interval",
+				Usage: "Set the customTime of objects when they are read, at most " +
+					"once per this interval each, so that lifecycle rules can act " +
+					"on data that hasn't been used. Updates are sent in batches " +
+					"every minute. See docs/semantics.md. (default: disabled)",
+			},
+
+			cli.DurationFlag{
+				Name:  "clock-skew-threshold",
+				Value: 30 * time.Second,
+				Usage: "Warn when the local clock differs from the clock at GCS, as " +
+					"seen in responses, by more than this. (use 0 to disable)",
+			},
+
+			cli.StringFlag{
+				Name: "failover-bucket",
+				Usage: "A bucket holding a copy of the bucket's objects, to read " +
+					"from when reading from the bucket fails. See docs/mounting.md.",
+			},
+
+			cli.DurationFlag{
+				Name: "failover-after",
+				Usage: "Also read from --failover-bucket when opening an object in " +
+					"the bucket takes longer than this. (use 0 to fail over only " +
+					"on errors)",
+			},
+
+			cli.StringFlag{
+				Name: "offline-queue-dir",
+				Usage: "When GCS can't be reached, answer stats and listings from " +
+					"earlier results and queue writes in the given directory, " +
+					"applying them once GCS is back. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name: "inventory-report",
+				Usage: "A Storage Insights inventory report in CSV format, given " +
+					"as bucket/prefix, from which to answer the first listing of " +
+					"each directory instead of asking GCS. See docs/semantics.md.",
+			},
+
+			cli.GenericFlag{
+				Name:  "prefetch-metadata",
+				Value: prefetchMetadataValue,
+				Usage: "List the objects in the bucket, or those with the prefix " +
+					"given as --prefetch-metadata=prefix, when mounting, to warm " +
+					"the stat cache and answer the first listing of each " +
+					"directory. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name: "notification-subscription",
+				Usage: "A Pub/Sub subscription to the bucket's GCS notifications, " +
+					"given as projects/PROJECT/subscriptions/SUBSCRIPTION, from " +
+					"which to learn of changes made elsewhere and drop what is " +
+					"cached about the objects changed. See docs/semantics.md.",
+			},
+
+			cli.DurationFlag{
+				Name: "write-lease-ttl",
+				Usage: "Lease files from other gcsfuse mounts using this flag " +
+					"before writing them, failing with EBUSY if another mount " +
+					"holds the lease. Leases are renewed while the file is open " +
+					"and expire this long after a mount goes away. See " +
+					"docs/semantics.md. (default: disabled)",
+			},
+
 			/////////////////////////
 			// Tuning
 			/////////////////////////
 
+			cli.DurationFlag{
+				Name: "metadata-cache-ttl",
+				Usage: "If set, how long to cache both object metadata and the " +
+					"types of names, in place of --stat-cache-ttl and " +
+					"--type-cache-ttl where those aren't given.",
+			},
+
+			cli.IntFlag{
+				Name: "metadata-cache-capacity",
+				Usage: "If set, how many names to cache metadata for, in place of " +
+					"--stat-cache-capacity where that isn't given. Each " +
+					"directory's type cache holds as many names as the stat cache.",
+			},
+
 			cli.IntFlag{
 				Name:  "stat-cache-capacity",
 				Value: 4096,
 				Usage: "How many entries can the stat cache hold (impacts memory consumption)",
 			},
 
+			cli.IntFlag{
+				Name: "stat-cache-max-size-mb",
+				Usage: "If set, bound the stat cache by its estimated memory use in " +
+					"MiB, rather than by --stat-cache-capacity.",
+			},
+
 			cli.DurationFlag{
 				Name:  "stat-cache-ttl",
 				Value: time.Minute,
 				Usage: "How long to cache StatObject results and inode attributes.",
 			},
 
+			cli.IntFlag{
+				Name:  "negative-stat-cache-capacity",
+				Value: 4096,
+				Usage: "How many names of objects that don't exist the stat " +
+					"cache can hold, apart from the entries for those that do.",
+			},
+
+			cli.DurationFlag{
+				Name:  "negative-stat-cache-ttl",
+				Value: time.Minute,
+				Usage: "How long to remember that an object doesn't exist. " +
+					"Zero disables this.",
+			},
+
 			cli.DurationFlag{
 				Name:  "type-cache-ttl",
 				Value: time.Minute,
@@ -165,6 +688,14 @@ func newApp() (app *cli.App) {
 					"inodes.",
 			},
 
+			cli.DurationFlag{
+				Name: "kernel-list-cache-ttl",
+				Usage: "Let the kernel cache directory listings for up to this " +
+					"long, so that listing a directory again doesn't list objects " +
+					"in GCS. Changes made through this mount are seen right away; " +
+					"others may not be. (default: disabled)",
+			},
+
 			cli.StringFlag{
 				Name:  "temp-dir",
 				Value: "",
@@ -172,71 +703,416 @@ func newApp() (app *cli.App) {
 					"copies. (default: system default, likely /tmp)",
 			},
 
-			/////////////////////////
-			// Debugging
-			/////////////////////////
+			cli.IntFlag{
+				Name: "max-memory-mb",
+				Usage: "Bound the memory used by the stat cache, parallel " +
+					"downloads, reading ahead, and --memory-staging-mb to about " +
+					"this many MiB in total. See docs/semantics.md. " +
+					"(default: unlimited)",
+			},
+
+			cli.IntFlag{
+				Name: "max-cached-inodes",
+				Usage: "Discard the cached state of files and directories, such " +
+					"as clean local copies of contents, used least recently " +
+					"beyond this many. (default: unlimited)",
+			},
+
+			cli.IntFlag{
+				Name: "max-open-readers",
+				Usage: "Close the GCS readers of open files read from least " +
+					"recently beyond this many, reopening them if the files are " +
+					"read again. (default: unlimited)",
+			},
+
+			cli.IntFlag{
+				Name: "memory-staging-mb",
+				Usage: "Keep local copies of files being written in memory, up " +
+					"to this many MiB in total, rather than in --temp-dir. Files " +
+					"that don't fit are moved to --temp-dir. (default: disabled)",
+			},
+
+			cli.StringFlag{
+				Name: "write-journal-dir",
+				Usage: "Keep local copies of files being written in the given " +
+					"directory instead, so that data written but not yet flushed " +
+					"survives a crash. It is written out when next mounting. See " +
+					"docs/semantics.md.",
+			},
 
 			cli.BoolFlag{
-				Name:  "debug_fuse",
-				Usage: "Enable fuse-related debugging output.",
+				Name: "streaming-writes",
+				Usage: "Upload new files written sequentially from the start as " +
+					"they are written, rather than staging them in --temp-dir " +
+					"until they are closed. See docs/semantics.md.",
+			},
+
+			cli.DurationFlag{
+				Name: "write-back-delay",
+				Usage: "Don't write out files when they are closed, but in the " +
+					"background once they have waited this long, or sooner when " +
+					"synced, renamed, or unmounted. See docs/semantics.md. " +
+					"(default: disabled)",
+			},
+
+			cli.IntFlag{
+				Name:  "write-back-max-dirty-mb",
+				Value: 1024,
+				Usage: "With --write-back-delay, write out files right away when " +
+					"closed if those waiting would otherwise hold more than " +
+					"this many MiB of changes.",
 			},
 
 			cli.BoolFlag{
-				Name:  "debug_gcs",
-				Usage: "Print GCS request and timing information.",
+				Name: "async-close",
+				Usage: "Don't wait for files to be written out when they are " +
+					"closed, but write them out in the background right away. " +
+					"See docs/semantics.md.",
 			},
 
 			cli.BoolFlag{
-				Name:  "debug_http",
-				Usage: "Dump HTTP requests and responses to/from GCS.",
+				Name: "lazy-fsync",
+				Usage: "Don't write out files when they are fsynced, but only " +
+					"when they are closed.",
 			},
 
 			cli.BoolFlag{
-				Name:  "debug_invariants",
-				Usage: "Panic when internal invariants are violated.",
+				Name: "skip-unmodified-fsync",
+				Usage: "Make fsync do nothing on file handles that haven't been " +
+					"used to write, even if the file was written through another.",
 			},
-		},
-	}
 
-	return
-}
+			cli.IntFlag{
+				Name: "upload-chunk-size-mb",
+				Usage: "Upload objects in requests of this many MiB, holding " +
+					"one in memory at a time, rather than streaming each in a " +
+					"single request. (default: disabled)",
+			},
 
-type flagStorage struct {
-	Foreground bool
+			cli.StringFlag{
+				Name: "file-cache-dir",
+				Usage: "Keep the contents of objects read in the given directory, " +
+					"so that reading them again, even after remounting, doesn't " +
+					"fetch them from GCS. See docs/semantics.md. (default: disabled)",
+			},
 
-	// File system
-	MountOptions map[string]string
-	DirMode      os.FileMode
-	FileMode     os.FileMode
-	Uid          int64
-	Gid          int64
-	ImplicitDirs bool
-	OnlyDir      string
+			cli.IntFlag{
+				Name:  "file-cache-max-size-mb",
+				Value: 10240,
+				Usage: "The most the file cache may hold, in MiB.",
+			},
 
-	// GCS
-	BillingProject                     string
+			cli.StringFlag{
+				Name: "range-cache-dir",
+				Usage: "Once reads of a file look random, keep the ranges they " +
+					"fetch in the given directory so that reading them again " +
+					"doesn't fetch them from GCS. See docs/semantics.md. " +
+					"(default: disabled)",
+			},
+
+			cli.IntFlag{
+				Name:  "range-cache-max-size-mb",
+				Value: 10240,
+				Usage: "The most the range cache may hold, in MiB.",
+			},
+
+			cli.BoolFlag{
+				Name: "range-cache-all-reads",
+				Usage: "With --range-cache-dir, treat all reads as random rather " +
+					"than waiting until reads look random.",
+			},
+
+			cli.IntFlag{
+				Name:  "parallel-download-threshold-mb",
+				Value: 0,
+				Usage: "Download objects at least this many MiB long with several " +
+					"concurrent range requests rather than a single stream. Zero " +
+					"means only files matched by a parallel-download rule.",
+			},
+
+			cli.IntFlag{
+				Name:  "parallel-download-chunk-size-mb",
+				Value: 8,
+				Usage: "The size of each range requested by parallel downloads.",
+			},
+
+			cli.IntFlag{
+				Name:  "parallel-download-streams",
+				Value: 8,
+				Usage: "The most range requests in flight for each file being " +
+					"downloaded in parallel. Each holds a chunk in memory.",
+			},
+
+			cli.IntFlag{
+				Name: "read-ahead-mb",
+				Usage: "Once a file not downloaded in parallel is being read " +
+					"sequentially, fetch this many MiB following each read in " +
+					"the background. See docs/semantics.md. (default: disabled)",
+			},
+
+			cli.IntFlag{
+				Name:  "read-ahead-trigger",
+				Value: 2,
+				Usage: "With --read-ahead-mb, how many reads in a row through a " +
+					"file handle must each continue from the last before " +
+					"reading ahead.",
+			},
+
+			cli.IntFlag{
+				Name: "parallel-upload-threshold-mb",
+				Usage: "Upload files at least this many MiB long as several " +
+					"parts in parallel, composing them into the object. See " +
+					"docs/semantics.md. (default: disabled)",
+			},
+
+			cli.IntFlag{
+				Name:  "parallel-upload-parts",
+				Value: 8,
+				Usage: "The number of parts uploaded in parallel for each large " +
+					"file, at most 32.",
+			},
+
+			/////////////////////////
+			// Logging
+			/////////////////////////
+
+			cli.GenericFlag{
+				Name:  "log-format",
+				Value: logFormatValue,
+				Usage: "The format of log messages: text, or json for one object " +
+					"per line with time, severity, and message keys, as understood " +
+					"by Cloud Logging.",
+			},
+
+			cli.GenericFlag{
+				Name:  "log-severity",
+				Value: logSeverityValue,
+				Usage: "Drop log messages less severe than this: debug, info, " +
+					"warning, error, or off. At debug, each file system op is " +
+					"logged with its latency.",
+			},
+
+			/////////////////////////
+			// Debugging
+			/////////////////////////
+
+			cli.BoolFlag{
+				Name: "debug_fuse",
+				Usage: "Enable fuse-related debugging output. Implies " +
+					"--log-severity=debug.",
+			},
+
+			cli.BoolFlag{
+				Name: "debug_gcs",
+				Usage: "Print GCS request and timing information. Implies " +
+					"--log-severity=debug.",
+			},
+
+			cli.BoolFlag{
+				Name: "debug_http",
+				Usage: "Dump HTTP requests and responses to/from GCS. Implies " +
+					"--log-severity=debug.",
+			},
+
+			cli.BoolFlag{
+				Name:  "debug_invariants",
+				Usage: "Panic when internal invariants are violated.",
+			},
+
+			cli.StringFlag{
+				Name:  "debug_addr",
+				Value: "",
+				Usage: "Address (e.g. localhost:8000) on which to serve debugging " +
+					"information, such as the progress of uploads at /debug/vars. " +
+					"(default: none)",
+			},
+
+			cli.StringFlag{
+				Name: "debug_record_http",
+				Usage: "Append each HTTP exchange with GCS to the given file, " +
+					"without credentials, as a fixture for replaying in tests. " +
+					"See docs/mounting.md. (default: none)",
+			},
+
+			// The cli package adds this only when it supplies the help command
+			// itself, which we replace with newHelpCommand.
+			cli.HelpFlag,
+		},
+	}
+
+	// The systemd-unit command accepts the same flags as mounting.
+	app.Commands = append(app.Commands, newSystemdUnitCommand(app.Flags))
+
+	return
+}
+
+type flagStorage struct {
+	Foreground   bool
+	ForceUnmount bool
+	ConfigFile   string
+
+	// File system
+	MountOptions map[string]string
+	DirMode      os.FileMode
+	FileMode     os.FileMode
+	Uid          int64
+	Gid          int64
+	UIDMap       IDMap
+	GIDMap       IDMap
+	ImplicitDirs bool
+	OnlyDir      string
+	PrefixDirs   string
+	MappingFile  string
+	Mapping      []string
+	VersionsDir  string
+	Include      []string
+	Exclude      []string
+	NonEmpty     NonEmptyPolicy
+	FileRules    FileRules
+	NameForm     fs.NameForm
+
+	UnchangedContent      gcsx.UnchangedContentPolicy
+	ContentTypes          ContentTypes
+	CacheControl          CacheControlRules
+	StorageClass          string
+	StorageClassOverrides StorageClassOverrides
+	AllowOther            bool
+	DefaultPermissions    bool
+	PreservePosixMetadata bool
+	ReflectIAMPermissions bool
+	RenameDirLimit        int
+
+	// GCS
+	BillingProject                     string
+	Project                            string
+	Endpoint                           string
 	KeyFile                            string
+	ImpersonateServiceAccount          string
+	TokenURL                           string
+	EncryptionKey                      string
+	EncryptionKeyFile                  string
 	EgressBandwidthLimitBytesPerSecond float64
+	BandwidthSchedule                  BandwidthSchedule
 	OpRateLimitHz                      float64
+	MaxConcurrentRequests              int
+	ClientProtocol                     ClientProtocol
+	MaxConnsPerHost                    int
+	MaxIdleConnsPerHost                int
+	IdleConnTimeout                    time.Duration
+	TCPKeepAlive                       time.Duration
+	ListPageSize                       int
+	ListProjection                     string
+	GzipObjects                        string
+	VerifyCRC32C                       bool
+	ReadStallTimeout                   time.Duration
+	ReadStallOtherIP                   bool
+	MaxRetryAttempts                   int
+	MaxRetrySleep                      time.Duration
+	RetryMultiplier                    float64
+	RetryableCodes                     RetryableCodes
+	RetryOverrides                     RetryOverrides
+	CustomTimeInterval                 time.Duration
+	ClockSkewThreshold                 time.Duration
+	FailoverBucket                     string
+	FailoverAfter                      time.Duration
+	OfflineQueueDir                    string
+	InventoryReport                    string
+	PrefetchMetadata                   PrefetchMetadata
+	NotificationSubscription           string
+	WriteLeaseTTL                      time.Duration
 
 	// Tuning
-	StatCacheCapacity int
-	StatCacheTTL      time.Duration
-	TypeCacheTTL      time.Duration
-	TempDir           string
+	StatCacheCapacity  int
+	StatCacheMaxSizeMB int
+	StatCacheTTL       time.Duration
+
+	NegativeStatCacheCapacity int
+	NegativeStatCacheTTL      time.Duration
+
+	TypeCacheTTL       time.Duration
+	KernelListCacheTTL time.Duration
+	TempDir            string
+	MaxMemoryMB        int
+	MaxCachedInodes    int
+	MaxOpenReaders     int
+	MemoryStagingMB    int
+	WriteJournalDir    string
+	StreamingWrites    bool
+	UploadChunkSizeMB  int
+	FileCacheDir       string
+	FileCacheMaxMB     int
+
+	RangeCacheDir      string
+	RangeCacheMaxMB    int
+	RangeCacheAllReads bool
+
+	WriteBackDelay      time.Duration
+	WriteBackMaxDirtyMB int
+	AsyncClose          bool
+	LazyFsync           bool
+	SkipUnmodifiedFsync bool
+
+	ParallelDownloadThresholdMB int
+	ParallelDownloadChunkSizeMB int
+	ParallelDownloadStreams     int
+	ReadAheadMB                 int
+	ReadAheadTrigger            int
+
+	ParallelUploadThresholdMB int
+	ParallelUploadParts       int
+
+	// Logging
+	LogFormat   logger.Format
+	LogSeverity logger.Severity
 
 	// Debugging
 	DebugFuse       bool
 	DebugGCS        bool
 	DebugHTTP       bool
 	DebugInvariants bool
+	DebugAddr       string
+	DebugRecordHTTP string
 }
 
 // Add the flags accepted by run to the supplied flag set, returning the
 // variables into which the flags will parse.
-func populateFlags(c *cli.Context) (flags *flagStorage) {
+func populateFlags(c *cli.Context) (flags *flagStorage, err error) {
+	// Fill in the values from the config file, if any. These may include the
+	// profile, so this must come first.
+	if p := c.String("config-file"); p != "" {
+		err = applyConfigFile(c, p)
+		if err != nil {
+			err = fmt.Errorf("Loading config file:\n%v", err)
+			return
+		}
+	}
+
+	// Fill in the values chosen by the metadata cache flags, which take
+	// precedence over the profile.
+	err = applyMetadataCacheFlags(c)
+	if err != nil {
+		err = fmt.Errorf("applyMetadataCacheFlags: %v", err)
+		return
+	}
+
+	// Fill in the values chosen by the profile, if any.
+	err = applyProfile(c, *c.Generic("profile").(*Profile))
+	if err != nil {
+		err = fmt.Errorf("applyProfile: %v", err)
+		return
+	}
+
+	// Give the stat cache its share of the memory budget, if any.
+	err = applyMaxMemoryFlag(c)
+	if err != nil {
+		err = fmt.Errorf("applyMaxMemoryFlag: %v", err)
+		return
+	}
+
 	flags = &flagStorage{
-		Foreground: c.Bool("foreground"),
+		Foreground:   c.Bool("foreground"),
+		ForceUnmount: c.Bool("force-unmount"),
+		ConfigFile:   c.String("config-file"),
 
 		// File system
 		MountOptions: make(map[string]string),
@@ -244,26 +1120,125 @@ func populateFlags(c *cli.Context) (flags *flagStorage) {
 		FileMode:     os.FileMode(*c.Generic("file-mode").(*OctalInt)),
 		Uid:          int64(c.Int("uid")),
 		Gid:          int64(c.Int("gid")),
+		UIDMap:       *c.Generic("uid-map").(*IDMap),
+		GIDMap:       *c.Generic("gid-map").(*IDMap),
 		ImplicitDirs: c.Bool("implicit-dirs"),
 		OnlyDir:      c.String("only-dir"),
+		PrefixDirs:   c.String("prefix-dirs"),
+		MappingFile:  c.String("mapping-file"),
+		Mapping:      c.StringSlice("mapping"),
+		VersionsDir:  c.String("versions-dir"),
+		Include:      c.StringSlice("include"),
+		Exclude:      c.StringSlice("exclude"),
+		NonEmpty:     *c.Generic("nonempty-mount-point").(*NonEmptyPolicy),
+		FileRules:    *c.Generic("file-rules").(*FileRules),
+		NameForm:     fs.NameForm(*c.Generic("normalize-names").(*NameForm)),
+
+		UnchangedContent: gcsx.UnchangedContentPolicy(
+			*c.Generic("unchanged-content").(*UnchangedContent)),
+
+		ContentTypes: c.Generic("content-types").(ContentTypes),
+		CacheControl: *c.Generic("cache-control").(*CacheControlRules),
+		StorageClass: string(*c.Generic("storage-class").(*StorageClass)),
+		StorageClassOverrides: *c.Generic(
+			"storage-class-overrides").(*StorageClassOverrides),
+
+		AllowOther:            c.Bool("allow-other"),
+		DefaultPermissions:    c.BoolT("default-permissions"),
+		PreservePosixMetadata: c.Bool("preserve-posix-metadata"),
+		ReflectIAMPermissions: c.Bool("reflect-iam-permissions"),
+		RenameDirLimit:        c.Int("rename-dir-limit"),
 
 		// GCS,
 		BillingProject:                     c.String("billing-project"),
+		Project:                            c.String("project"),
+		Endpoint:                           c.String("endpoint"),
 		KeyFile:                            c.String("key-file"),
+		ImpersonateServiceAccount:          c.String("impersonate-service-account"),
+		TokenURL:                           c.String("token-url"),
+		EncryptionKey:                      c.String("encryption-key"),
+		EncryptionKeyFile:                  c.String("encryption-key-file"),
 		EgressBandwidthLimitBytesPerSecond: c.Float64("limit-bytes-per-sec"),
+		BandwidthSchedule:                  *c.Generic("bandwidth-schedule").(*BandwidthSchedule),
 		OpRateLimitHz:                      c.Float64("limit-ops-per-sec"),
+		MaxConcurrentRequests:              c.Int("max-concurrent-requests"),
+		ClientProtocol:                     *c.Generic("client-protocol").(*ClientProtocol),
+		MaxConnsPerHost:                    c.Int("max-conns-per-host"),
+		MaxIdleConnsPerHost:                c.Int("max-idle-conns-per-host"),
+		IdleConnTimeout:                    c.Duration("idle-conn-timeout"),
+		TCPKeepAlive:                       c.Duration("tcp-keep-alive"),
+		ListPageSize:                       c.Int("list-page-size"),
+		ListProjection:                     string(*c.Generic("list-projection").(*ListProjection)),
+		GzipObjects:                        string(*c.Generic("gzip-objects").(*GzipObjects)),
+		VerifyCRC32C:                       c.Bool("verify-crc32c"),
+		ReadStallTimeout:                   c.Duration("read-stall-timeout"),
+		ReadStallOtherIP:                   c.Bool("read-stall-other-ip"),
+		MaxRetryAttempts:                   c.Int("max-retry-attempts"),
+		MaxRetrySleep:                      c.Duration("max-retry-sleep"),
+		RetryMultiplier:                    c.Float64("retry-multiplier"),
+		RetryableCodes:                     *c.Generic("retryable-codes").(*RetryableCodes),
+		RetryOverrides:                     *c.Generic("retry-overrides").(*RetryOverrides),
+		CustomTimeInterval:                 c.Duration("custom-time-interval"),
+		ClockSkewThreshold:                 c.Duration("clock-skew-threshold"),
+		FailoverBucket:                     c.String("failover-bucket"),
+		FailoverAfter:                      c.Duration("failover-after"),
+		OfflineQueueDir:                    c.String("offline-queue-dir"),
+		InventoryReport:                    c.String("inventory-report"),
+		PrefetchMetadata:                   *c.Generic("prefetch-metadata").(*PrefetchMetadata),
+		NotificationSubscription:           c.String("notification-subscription"),
+		WriteLeaseTTL:                      c.Duration("write-lease-ttl"),
 
 		// Tuning,
-		StatCacheCapacity: c.Int("stat-cache-capacity"),
-		StatCacheTTL:      c.Duration("stat-cache-ttl"),
-		TypeCacheTTL:      c.Duration("type-cache-ttl"),
-		TempDir:           c.String("temp-dir"),
+		StatCacheCapacity:  c.Int("stat-cache-capacity"),
+		StatCacheMaxSizeMB: c.Int("stat-cache-max-size-mb"),
+		StatCacheTTL:       c.Duration("stat-cache-ttl"),
+
+		NegativeStatCacheCapacity: c.Int("negative-stat-cache-capacity"),
+		NegativeStatCacheTTL:      c.Duration("negative-stat-cache-ttl"),
+
+		TypeCacheTTL:       c.Duration("type-cache-ttl"),
+		KernelListCacheTTL: c.Duration("kernel-list-cache-ttl"),
+		TempDir:            c.String("temp-dir"),
+		MaxMemoryMB:        c.Int("max-memory-mb"),
+		MaxCachedInodes:    c.Int("max-cached-inodes"),
+		MaxOpenReaders:     c.Int("max-open-readers"),
+		MemoryStagingMB:    c.Int("memory-staging-mb"),
+		WriteJournalDir:    c.String("write-journal-dir"),
+		StreamingWrites:    c.Bool("streaming-writes"),
+		UploadChunkSizeMB:  c.Int("upload-chunk-size-mb"),
+		FileCacheDir:       c.String("file-cache-dir"),
+		FileCacheMaxMB:     c.Int("file-cache-max-size-mb"),
+
+		RangeCacheDir:      c.String("range-cache-dir"),
+		RangeCacheMaxMB:    c.Int("range-cache-max-size-mb"),
+		RangeCacheAllReads: c.Bool("range-cache-all-reads"),
+
+		WriteBackDelay:      c.Duration("write-back-delay"),
+		WriteBackMaxDirtyMB: c.Int("write-back-max-dirty-mb"),
+		AsyncClose:          c.Bool("async-close"),
+		LazyFsync:           c.Bool("lazy-fsync"),
+		SkipUnmodifiedFsync: c.Bool("skip-unmodified-fsync"),
+
+		ParallelDownloadThresholdMB: c.Int("parallel-download-threshold-mb"),
+		ParallelDownloadChunkSizeMB: c.Int("parallel-download-chunk-size-mb"),
+		ParallelDownloadStreams:     c.Int("parallel-download-streams"),
+		ReadAheadMB:                 c.Int("read-ahead-mb"),
+		ReadAheadTrigger:            c.Int("read-ahead-trigger"),
+
+		ParallelUploadThresholdMB: c.Int("parallel-upload-threshold-mb"),
+		ParallelUploadParts:       c.Int("parallel-upload-parts"),
+
+		// Logging
+		LogFormat:   logger.Format(*c.Generic("log-format").(*LogFormat)),
+		LogSeverity: logger.Severity(*c.Generic("log-severity").(*LogSeverity)),
 
 		// Debugging,
 		DebugFuse:       c.Bool("debug_fuse"),
 		DebugGCS:        c.Bool("debug_gcs"),
 		DebugHTTP:       c.Bool("debug_http"),
 		DebugInvariants: c.Bool("debug_invariants"),
+		DebugAddr:       c.String("debug_addr"),
+		DebugRecordHTTP: c.String("debug_record_http"),
 	}
 
 	// Handle the repeated "-o" flag.
@@ -271,6 +1246,113 @@ func populateFlags(c *cli.Context) (flags *flagStorage) {
 		mountpkg.ParseOptions(flags.MountOptions, o)
 	}
 
+	if flags.ParallelUploadThresholdMB < 0 {
+		err = fmt.Errorf("--parallel-upload-threshold-mb: must not be negative")
+		return
+	}
+
+	if flags.ParallelUploadParts < 2 || flags.ParallelUploadParts > 32 {
+		err = fmt.Errorf("--parallel-upload-parts: must be between 2 and 32")
+		return
+	}
+
+	if flags.WriteBackDelay > 0 && flags.WriteLeaseTTL > 0 {
+		err = fmt.Errorf("--write-back-delay can't be used with --write-lease-ttl")
+		return
+	}
+
+	if flags.AsyncClose && flags.WriteLeaseTTL > 0 {
+		err = fmt.Errorf("--async-close can't be used with --write-lease-ttl")
+		return
+	}
+
+	if flags.ReadAheadMB < 0 {
+		err = fmt.Errorf("--read-ahead-mb: must not be negative")
+		return
+	}
+
+	if flags.ReadAheadTrigger < 0 {
+		err = fmt.Errorf("--read-ahead-trigger: must not be negative")
+		return
+	}
+
+	if flags.RangeCacheDir != "" && flags.RangeCacheMaxMB <= 0 {
+		err = fmt.Errorf("--range-cache-max-size-mb: must be positive")
+		return
+	}
+
+	if flags.MaxMemoryMB < 0 {
+		err = fmt.Errorf("--max-memory-mb: must not be negative")
+		return
+	}
+
+	if flags.MaxMemoryMB > 0 && flags.StatCacheMaxSizeMB > flags.MaxMemoryMB {
+		err = fmt.Errorf("--stat-cache-max-size-mb can't exceed --max-memory-mb")
+		return
+	}
+
+	if flags.MaxCachedInodes < 0 {
+		err = fmt.Errorf("--max-cached-inodes: must not be negative")
+		return
+	}
+
+	if flags.MaxOpenReaders < 0 {
+		err = fmt.Errorf("--max-open-readers: must not be negative")
+		return
+	}
+
+	if flags.MemoryStagingMB < 0 {
+		err = fmt.Errorf("--memory-staging-mb: must not be negative")
+		return
+	}
+
+	if flags.MemoryStagingMB > 0 && flags.WriteJournalDir != "" {
+		err = fmt.Errorf(
+			"--memory-staging-mb can't be used with --write-journal-dir")
+		return
+	}
+
+	if flags.UploadChunkSizeMB < 0 {
+		err = fmt.Errorf("--upload-chunk-size-mb: must not be negative")
+		return
+	}
+
+	if flags.MaxRetryAttempts < 0 {
+		err = fmt.Errorf("--max-retry-attempts: must not be negative")
+		return
+	}
+
+	if flags.RetryMultiplier < 1 {
+		err = fmt.Errorf("--retry-multiplier: must be at least 1")
+		return
+	}
+
+	if flags.OnlyDir != "" {
+		flags.OnlyDir, err = cleanOnlyDir(flags.OnlyDir)
+		if err != nil {
+			err = fmt.Errorf("--only-dir: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Put the value of --only-dir, a directory relative to the root of the
+// bucket, into canonical form: cleaned, and without leading or trailing
+// slashes. Directories outside the bucket, and the root itself, are refused.
+func cleanOnlyDir(s string) (dir string, err error) {
+	dir = strings.Trim(path.Clean(s), "/")
+	if dir == "" || dir == "." {
+		err = fmt.Errorf("%q names the root of the bucket", s)
+		return
+	}
+
+	if dir == ".." || strings.HasPrefix(dir, "../") {
+		err = fmt.Errorf("%q is outside the bucket", s)
+		return
+	}
+
 	return
 }
 
@@ -294,3 +1376,776 @@ func (oi *OctalInt) Set(value string) (err error) {
 func (oi OctalInt) String() string {
 	return fmt.Sprintf("%o", oi)
 }
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain a policy for
+// mounting over a non-empty directory.
+type NonEmptyPolicy string
+
+const (
+	NonEmptyRefuse NonEmptyPolicy = "refuse"
+	NonEmptyWarn   NonEmptyPolicy = "warn"
+	NonEmptyAllow  NonEmptyPolicy = "allow"
+)
+
+var _ cli.Generic = (*NonEmptyPolicy)(nil)
+
+func (p *NonEmptyPolicy) Set(value string) (err error) {
+	switch NonEmptyPolicy(value) {
+	case NonEmptyRefuse, NonEmptyWarn, NonEmptyAllow:
+		*p = NonEmptyPolicy(value)
+
+	default:
+		err = fmt.Errorf("Unknown policy %q; want refuse, warn, or allow", value)
+	}
+
+	return
+}
+
+func (p NonEmptyPolicy) String() string {
+	return string(p)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to choose the version of
+// HTTP used to talk to GCS.
+type ClientProtocol string
+
+const (
+	ClientProtocolHTTP1 ClientProtocol = "http1"
+	ClientProtocolHTTP2 ClientProtocol = "http2"
+)
+
+var _ cli.Generic = (*ClientProtocol)(nil)
+
+func (p *ClientProtocol) Set(value string) (err error) {
+	switch ClientProtocol(value) {
+	case ClientProtocolHTTP1, ClientProtocolHTTP2:
+		*p = ClientProtocol(value)
+
+	default:
+		err = fmt.Errorf("Unknown protocol %q; want http1 or http2", value)
+	}
+
+	return
+}
+
+func (p ClientProtocol) String() string {
+	return string(p)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain a list of
+// rules for handling particular files, given as pattern:action pairs separated
+// by semicolons. Rules from repeated flags accumulate.
+type FileRules []fs.FileRule
+
+var _ cli.Generic = (*FileRules)(nil)
+
+func (fr *FileRules) Set(value string) (err error) {
+	for _, pair := range strings.Split(value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			err = fmt.Errorf("Missing colon in %q", pair)
+			return
+		}
+
+		r := fs.FileRule{
+			Pattern: strings.TrimSpace(pair[:i]),
+			Action:  fs.FileAction(strings.TrimSpace(pair[i+1:])),
+		}
+
+		if err = r.Validate(); err != nil {
+			return
+		}
+
+		*fr = append(*fr, r)
+	}
+
+	return
+}
+
+func (fr FileRules) String() string {
+	var pairs []string
+	for _, r := range fr {
+		pairs = append(pairs, fmt.Sprintf("%s:%s", r.Pattern, r.Action))
+	}
+
+	return strings.Join(pairs, ";")
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain a list of
+// time-of-day bandwidth limits, given as windows separated by semicolons.
+// Windows from repeated flags accumulate.
+type BandwidthSchedule []gcsx.BandwidthWindow
+
+var _ cli.Generic = (*BandwidthSchedule)(nil)
+
+func (bs *BandwidthSchedule) Set(value string) (err error) {
+	for _, s := range strings.Split(value, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		var w gcsx.BandwidthWindow
+		if w, err = gcsx.ParseBandwidthWindow(s); err != nil {
+			return
+		}
+
+		*bs = append(*bs, w)
+	}
+
+	return
+}
+
+func (bs BandwidthSchedule) String() string {
+	var windows []string
+	for _, w := range bs {
+		windows = append(windows, w.String())
+	}
+
+	return strings.Join(windows, ";")
+}
+
+// A range of IDs inside a user namespace and the IDs outside of it to which
+// they map, as in /proc/PID/uid_map.
+type IDMapping struct {
+	Inside  uint32
+	Outside uint32
+	Count   uint32
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain a table
+// mapping user or group IDs inside a user namespace to those outside of it,
+// given as inside:outside:count ranges separated by commas. Ranges from
+// repeated flags accumulate.
+type IDMap []IDMapping
+
+var _ cli.Generic = (*IDMap)(nil)
+
+func (m *IDMap) Set(value string) (err error) {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		parts := strings.Split(s, ":")
+		if len(parts) != 3 {
+			err = fmt.Errorf("Expected inside:outside:count, got %q", s)
+			return
+		}
+
+		var nums [3]uint64
+		for i, p := range parts {
+			nums[i], err = strconv.ParseUint(p, 10, 32)
+			if err != nil {
+				err = fmt.Errorf("Illegal ID range %q: %v", s, err)
+				return
+			}
+		}
+
+		// Both ends of the range must be representable.
+		if nums[2] == 0 || nums[0]+nums[2] > 1<<32 || nums[1]+nums[2] > 1<<32 {
+			err = fmt.Errorf("Illegal ID range %q", s)
+			return
+		}
+
+		*m = append(*m, IDMapping{
+			Inside:  uint32(nums[0]),
+			Outside: uint32(nums[1]),
+			Count:   uint32(nums[2]),
+		})
+	}
+
+	return
+}
+
+func (m IDMap) String() string {
+	var ranges []string
+	for _, r := range m {
+		ranges = append(
+			ranges,
+			fmt.Sprintf("%d:%d:%d", r.Inside, r.Outside, r.Count))
+	}
+
+	return strings.Join(ranges, ",")
+}
+
+// Translate the given ID inside the namespace to the one outside of it, using
+// the first range that contains it.
+func (m IDMap) Translate(inside uint32) (outside uint32, err error) {
+	for _, r := range m {
+		end := uint64(r.Inside) + uint64(r.Count)
+		if inside >= r.Inside && uint64(inside) < end {
+			outside = r.Outside + (inside - r.Inside)
+			return
+		}
+	}
+
+	err = fmt.Errorf("ID %d is not mapped", inside)
+	return
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain a Unicode
+// normalization form for file names: none, nfc, or nfd.
+type NameForm fs.NameForm
+
+var _ cli.Generic = (*NameForm)(nil)
+
+func (f *NameForm) Set(value string) (err error) {
+	switch value {
+	case "none":
+		*f = NameForm(fs.NameFormNone)
+
+	case string(fs.NameFormNFC), string(fs.NameFormNFD):
+		*f = NameForm(value)
+
+	default:
+		err = fmt.Errorf("Unknown form %q; want none, nfc, or nfd", value)
+	}
+
+	return
+}
+
+func (f NameForm) String() string {
+	if fs.NameForm(f) == fs.NameFormNone {
+		return "none"
+	}
+
+	return string(f)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain the format of
+// log messages: text or json.
+type LogFormat logger.Format
+
+var _ cli.Generic = (*LogFormat)(nil)
+
+func (f *LogFormat) Set(value string) (err error) {
+	switch logger.Format(value) {
+	case logger.FormatText, logger.FormatJSON:
+		*f = LogFormat(value)
+
+	default:
+		err = fmt.Errorf("Unknown format %q; want text or json", value)
+	}
+
+	return
+}
+
+func (f LogFormat) String() string {
+	return string(f)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain the least
+// severity of log messages to write.
+type LogSeverity logger.Severity
+
+var _ cli.Generic = (*LogSeverity)(nil)
+
+func (s *LogSeverity) Set(value string) (err error) {
+	sev, err := logger.ParseSeverity(value)
+	if err != nil {
+		return
+	}
+
+	*s = LogSeverity(sev)
+	return
+}
+
+func (s LogSeverity) String() string {
+	return strings.ToLower(logger.Severity(s).String())
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain a policy for
+// files rewritten with unchanged contents: upload, skip, or touch.
+type UnchangedContent gcsx.UnchangedContentPolicy
+
+var _ cli.Generic = (*UnchangedContent)(nil)
+
+func (u *UnchangedContent) Set(value string) (err error) {
+	switch value {
+	case "upload":
+		*u = UnchangedContent(gcsx.UnchangedContentUpload)
+
+	case string(gcsx.UnchangedContentSkip), string(gcsx.UnchangedContentTouch):
+		*u = UnchangedContent(value)
+
+	default:
+		err = fmt.Errorf(
+			"Unknown policy %q; want upload, skip, or touch",
+			value)
+	}
+
+	return
+}
+
+func (u UnchangedContent) String() string {
+	if gcsx.UnchangedContentPolicy(u) == gcsx.UnchangedContentUpload {
+		return "upload"
+	}
+
+	return string(u)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain MIME types for
+// new objects by file extension, given as .ext=type entries separated by
+// commas. Entries from repeated flags accumulate, and later ones for an
+// extension take precedence.
+type ContentTypes map[string]string
+
+var _ cli.Generic = (ContentTypes)(nil)
+
+func (ct ContentTypes) Set(value string) (err error) {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		var ext, t string
+		if ext, t, err = gcsx.ParseContentType(s); err != nil {
+			return
+		}
+
+		ct[ext] = t
+	}
+
+	return
+}
+
+func (ct ContentTypes) String() string {
+	var exts []string
+	for ext := range ct {
+		exts = append(exts, ext)
+	}
+
+	sort.Strings(exts)
+
+	var entries []string
+	for _, ext := range exts {
+		entries = append(entries, ext+"="+ct[ext])
+	}
+
+	return strings.Join(entries, ",")
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain rules setting
+// the Cache-Control of new objects, one per flag, since directives contain
+// commas.
+type CacheControlRules []gcsx.CacheControlRule
+
+var _ cli.Generic = (*CacheControlRules)(nil)
+
+func (cc *CacheControlRules) Set(value string) (err error) {
+	r, err := gcsx.ParseCacheControlRule(value)
+	if err != nil {
+		return
+	}
+
+	*cc = append(*cc, r)
+	return
+}
+
+func (cc CacheControlRules) String() string {
+	var rules []string
+	for _, r := range cc {
+		rules = append(rules, r.String())
+	}
+
+	return strings.Join(rules, ";")
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain the storage
+// class of new objects. The empty string leaves the bucket's default.
+type StorageClass string
+
+var _ cli.Generic = (*StorageClass)(nil)
+
+func (sc *StorageClass) Set(value string) (err error) {
+	class, err := gcsx.ParseStorageClass(value)
+	if err != nil {
+		return
+	}
+
+	*sc = StorageClass(class)
+	return
+}
+
+func (sc StorageClass) String() string {
+	return string(sc)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain the storage
+// classes of new objects with particular prefixes, given as rules separated by
+// semicolons. Rules from repeated flags accumulate.
+type StorageClassOverrides []gcsx.StorageClassRule
+
+var _ cli.Generic = (*StorageClassOverrides)(nil)
+
+func (o *StorageClassOverrides) Set(value string) (err error) {
+	for _, s := range strings.Split(value, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		var r gcsx.StorageClassRule
+		if r, err = gcsx.ParseStorageClassRule(s); err != nil {
+			return
+		}
+
+		*o = append(*o, r)
+	}
+
+	return
+}
+
+func (o StorageClassOverrides) String() string {
+	var rules []string
+	for _, r := range o {
+		rules = append(rules, r.String())
+	}
+
+	return strings.Join(rules, ";")
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain the projection
+// to ask for in listings.
+type ListProjection string
+
+var _ cli.Generic = (*ListProjection)(nil)
+
+func (p *ListProjection) Set(value string) (err error) {
+	switch value {
+	case gcsx.ListProjectionFull, gcsx.ListProjectionNoACL:
+		*p = ListProjection(value)
+
+	default:
+		err = fmt.Errorf(
+			"Unknown projection %q; want %s or %s",
+			value,
+			gcsx.ListProjectionFull,
+			gcsx.ListProjectionNoACL)
+	}
+
+	return
+}
+
+func (p ListProjection) String() string {
+	return string(p)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain how to present
+// gzip-encoded objects.
+type GzipObjects string
+
+var _ cli.Generic = (*GzipObjects)(nil)
+
+func (g *GzipObjects) Set(value string) (err error) {
+	switch value {
+	case gcsx.GzipObjectsRaw, gcsx.GzipObjectsDecompress:
+		*g = GzipObjects(value)
+
+	default:
+		err = fmt.Errorf(
+			"Unknown gzip handling %q; want %s or %s",
+			value,
+			gcsx.GzipObjectsRaw,
+			gcsx.GzipObjectsDecompress)
+	}
+
+	return
+}
+
+func (g GzipObjects) String() string {
+	return string(g)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain a list of
+// HTTP status codes, given separated by commas. Unlike most list flags, a
+// repeated flag replaces the list, so that the default can be overridden.
+type RetryableCodes []int
+
+var _ cli.Generic = (*RetryableCodes)(nil)
+
+func (rc *RetryableCodes) Set(value string) (err error) {
+	var codes RetryableCodes
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		var c int
+		c, err = strconv.Atoi(s)
+		if err != nil || c < 100 || c > 599 {
+			err = fmt.Errorf("Illegal HTTP status code %q", s)
+			return
+		}
+
+		codes = append(codes, c)
+	}
+
+	*rc = codes
+	return
+}
+
+func (rc RetryableCodes) String() string {
+	var codes []string
+	for _, c := range rc {
+		codes = append(codes, strconv.Itoa(c))
+	}
+
+	return strings.Join(codes, ",")
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain retry
+// settings for particular operations, given as overrides separated by
+// semicolons. Overrides from repeated flags accumulate, and later ones for an
+// operation take precedence.
+type RetryOverrides []gcsx.RetryOverride
+
+var _ cli.Generic = (*RetryOverrides)(nil)
+
+func (ro *RetryOverrides) Set(value string) (err error) {
+	for _, s := range strings.Split(value, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		var o gcsx.RetryOverride
+		if o, err = gcsx.ParseRetryOverride(s); err != nil {
+			return
+		}
+
+		*ro = append(*ro, o)
+	}
+
+	return
+}
+
+func (ro RetryOverrides) String() string {
+	var overrides []string
+	for _, o := range ro {
+		overrides = append(overrides, o.String())
+	}
+
+	return strings.Join(overrides, ";")
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to choose the objects
+// whose metadata is listed when mounting. Like a bool flag, it may be given
+// without a value, in which case every object is listed.
+type PrefetchMetadata struct {
+	Enabled bool
+	Prefix  string
+}
+
+var _ cli.Generic = (*PrefetchMetadata)(nil)
+
+func (p *PrefetchMetadata) Set(value string) (err error) {
+	switch value {
+	case "false":
+		*p = PrefetchMetadata{}
+
+	case "true":
+		*p = PrefetchMetadata{Enabled: true}
+
+	default:
+		*p = PrefetchMetadata{Enabled: true, Prefix: value}
+	}
+
+	return
+}
+
+func (p PrefetchMetadata) String() string {
+	switch {
+	case !p.Enabled:
+		return ""
+
+	case p.Prefix == "":
+		return "true"
+	}
+
+	return p.Prefix
+}
+
+// Allow the flag to be given without a value, which the flag package does
+// for values that say they are bools.
+func (p *PrefetchMetadata) IsBoolFlag() bool {
+	return true
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain the name of
+// a workload profile, which presets a group of other flags.
+type Profile string
+
+const (
+	ProfileNone         Profile = ""
+	ProfileMLTraining   Profile = "ml-training"
+	ProfileMediaServing Profile = "media-serving"
+	ProfileBackup       Profile = "backup"
+	ProfileInteractive  Profile = "interactive"
+)
+
+// A flag value set by a profile.
+type profileSetting struct {
+	flag  string
+	value string
+}
+
+// The flag values set by each profile, applied in order to the flags that
+// were not given explicitly.
+var profiles = map[Profile][]profileSetting{
+	ProfileNone: nil,
+
+	// Large, mostly immutable data sets read repeatedly and at high
+	// concurrency by data loaders, with checkpoints written out periodically.
+	ProfileMLTraining: {
+		{"implicit-dirs", "true"},
+		{"stat-cache-capacity", "262144"},
+		{"stat-cache-ttl", "1h"},
+		{"type-cache-ttl", "1h"},
+		{"limit-ops-per-sec", "-1"},
+		{"file-rules", "*.ckpt:parallel-download;*.pt:parallel-download;" +
+			"*.tfrecord:parallel-download"},
+	},
+
+	// Large media files that rarely change, streamed sequentially to many
+	// clients.
+	ProfileMediaServing: {
+		{"stat-cache-capacity", "65536"},
+		{"stat-cache-ttl", "10m"},
+		{"type-cache-ttl", "10m"},
+		{"limit-ops-per-sec", "-1"},
+		{"file-rules", "*.mp4:parallel-download;*.mov:parallel-download;" +
+			"*.mkv:parallel-download;*.webm:parallel-download;" +
+			"*.mp3:parallel-download"},
+	},
+
+	// Large trees written once and walked by backup tools that stat every
+	// file.
+	ProfileBackup: {
+		{"stat-cache-capacity", "65536"},
+		{"limit-ops-per-sec", "-1"},
+		{"unchanged-content", "touch"},
+	},
+
+	// People browsing a bucket that others may be modifying, who would rather
+	// see changes promptly than save round trips.
+	ProfileInteractive: {
+		{"implicit-dirs", "true"},
+		{"stat-cache-ttl", "10s"},
+		{"type-cache-ttl", "10s"},
+		{"file-rules", "*.log:no-cache"},
+	},
+}
+
+var _ cli.Generic = (*Profile)(nil)
+
+func (p *Profile) Set(value string) (err error) {
+	if _, ok := profiles[Profile(value)]; !ok || value == "" {
+		err = fmt.Errorf(
+			"Unknown profile %q; want ml-training, media-serving, backup, "+
+				"or interactive",
+			value)
+
+		return
+	}
+
+	*p = Profile(value)
+	return
+}
+
+func (p Profile) String() string {
+	return string(p)
+}
+
+// Set the flags preset by the given profile, except for those that were set
+// explicitly.
+func applyProfile(c *cli.Context, p Profile) (err error) {
+	var settings []profileSetting
+	for _, s := range profiles[p] {
+		if !c.IsSet(s.flag) {
+			settings = append(settings, s)
+		}
+	}
+
+	for _, s := range settings {
+		err = c.Set(s.flag, s.value)
+		if err != nil {
+			err = fmt.Errorf("Setting --%s: %v", s.flag, err)
+			return
+		}
+	}
+
+	return
+}
+
+// Set the stat and type cache flags standing in for --metadata-cache-ttl and
+// --metadata-cache-capacity, except for those that were set explicitly.
+func applyMetadataCacheFlags(c *cli.Context) (err error) {
+	var settings []profileSetting
+	if c.IsSet("metadata-cache-ttl") {
+		ttl := c.Duration("metadata-cache-ttl").String()
+		settings = append(
+			settings,
+			profileSetting{"stat-cache-ttl", ttl},
+			profileSetting{"type-cache-ttl", ttl})
+	}
+
+	if c.IsSet("metadata-cache-capacity") {
+		settings = append(
+			settings,
+			profileSetting{
+				"stat-cache-capacity",
+				strconv.Itoa(c.Int("metadata-cache-capacity")),
+			})
+	}
+
+	for _, s := range settings {
+		if c.IsSet(s.flag) {
+			continue
+		}
+
+		err = c.Set(s.flag, s.value)
+		if err != nil {
+			err = fmt.Errorf("Setting --%s: %v", s.flag, err)
+			return
+		}
+	}
+
+	return
+}
+
+// The share of --max-memory-mb given to the stat cache, unless
+// --stat-cache-max-size-mb says otherwise.
+const statCacheMemoryShare = 4
+
+// Bound the stat cache by memory, taking its share of --max-memory-mb, if
+// that is set and --stat-cache-max-size-mb isn't.
+func applyMaxMemoryFlag(c *cli.Context) (err error) {
+	maxMB := c.Int("max-memory-mb")
+	if maxMB <= 0 || c.IsSet("stat-cache-max-size-mb") {
+		return
+	}
+
+	share := maxMB / statCacheMemoryShare
+	if share == 0 {
+		share = 1
+	}
+
+	err = c.Set("stat-cache-max-size-mb", strconv.Itoa(share))
+	if err != nil {
+		err = fmt.Errorf("Setting --stat-cache-max-size-mb: %v", err)
+		return
+	}
+
+	return
+}
@@ -22,6 +22,9 @@ import (
 	"time"
 
 	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 )
@@ -41,7 +44,9 @@ func parseArgs(args []string) (flags *flagStorage) {
 	// Create a CLI app, and abuse it to snoop on the flags.
 	app := newApp()
 	app.Action = func(appCtx *cli.Context) {
-		flags = populateFlags(appCtx)
+		var err error
+		flags, err = populateFlags(appCtx)
+		AssertEq(nil, err)
 	}
 
 	// Simulate argv.
@@ -60,6 +65,8 @@ func parseArgs(args []string) (flags *flagStorage) {
 func (t *FlagsTest) Defaults() {
 	f := parseArgs([]string{})
 
+	ExpectFalse(f.ForceUnmount)
+
 	// File system
 	ExpectNe(nil, f.MountOptions)
 	ExpectEq(0, len(f.MountOptions), "Options: %v", f.MountOptions)
@@ -68,29 +75,124 @@ func (t *FlagsTest) Defaults() {
 	ExpectEq(os.FileMode(0644), f.FileMode)
 	ExpectEq(-1, f.Uid)
 	ExpectEq(-1, f.Gid)
+	ExpectEq(0, len(f.UIDMap))
+	ExpectEq(0, len(f.GIDMap))
 	ExpectFalse(f.ImplicitDirs)
+	ExpectEq("", f.VersionsDir)
+	ExpectEq(0, len(f.Include))
+	ExpectEq(0, len(f.Exclude))
+	ExpectEq(NonEmptyRefuse, f.NonEmpty)
+	ExpectEq(0, len(f.FileRules))
+	ExpectEq(fs.NameFormNone, f.NameForm)
+	ExpectEq(gcsx.UnchangedContentUpload, f.UnchangedContent)
+	ExpectFalse(f.AllowOther)
+	ExpectTrue(f.DefaultPermissions)
+	ExpectFalse(f.PreservePosixMetadata)
+	ExpectFalse(f.ReflectIAMPermissions)
+	ExpectEq(0, f.RenameDirLimit)
 
 	// GCS
+	ExpectEq("", f.Endpoint)
 	ExpectEq("", f.KeyFile)
+	ExpectEq("", f.ImpersonateServiceAccount)
+	ExpectEq("", f.TokenURL)
+	ExpectEq("", f.Project)
+	ExpectEq("", f.EncryptionKey)
+	ExpectEq("", f.EncryptionKeyFile)
 	ExpectEq(-1, f.EgressBandwidthLimitBytesPerSecond)
+	ExpectEq(0, len(f.BandwidthSchedule))
 	ExpectEq(5, f.OpRateLimitHz)
+	ExpectEq(100, f.MaxConcurrentRequests)
+	ExpectEq(ClientProtocolHTTP2, f.ClientProtocol)
+	ExpectEq(0, f.MaxConnsPerHost)
+	ExpectEq(2, f.MaxIdleConnsPerHost)
+	ExpectEq(90*time.Second, f.IdleConnTimeout)
+	ExpectEq(30*time.Second, f.TCPKeepAlive)
+	ExpectEq(0, f.ListPageSize)
+	ExpectEq("full", f.ListProjection)
+	ExpectEq(gcsx.GzipObjectsRaw, f.GzipObjects)
+	ExpectEq(0, len(f.ContentTypes))
+	ExpectEq(0, len(f.CacheControl))
+	ExpectEq("", f.StorageClass)
+	ExpectEq(0, len(f.StorageClassOverrides))
+	ExpectFalse(f.VerifyCRC32C)
+	ExpectEq(0, f.ReadStallTimeout)
+	ExpectFalse(f.ReadStallOtherIP)
+	ExpectEq(0, f.MaxRetryAttempts)
+	ExpectEq(30*time.Second, f.MaxRetrySleep)
+	ExpectEq(2, f.RetryMultiplier)
+	ExpectEq("408,429,500,502,503,504", f.RetryableCodes.String())
+	ExpectEq(0, len(f.RetryOverrides))
+	ExpectEq(0, f.CustomTimeInterval)
+	ExpectEq(30*time.Second, f.ClockSkewThreshold)
+	ExpectEq("", f.FailoverBucket)
+	ExpectEq(0, f.FailoverAfter)
+	ExpectEq("", f.OfflineQueueDir)
+	ExpectEq("", f.InventoryReport)
+	ExpectEq("", f.NotificationSubscription)
+	ExpectEq(0, f.WriteLeaseTTL)
 
 	// Tuning
 	ExpectEq(4096, f.StatCacheCapacity)
+	ExpectEq(0, f.StatCacheMaxSizeMB)
+	ExpectEq(0, f.MaxMemoryMB)
+	ExpectEq(0, f.MaxCachedInodes)
+	ExpectEq(0, f.MaxOpenReaders)
 	ExpectEq(time.Minute, f.StatCacheTTL)
+	ExpectEq(4096, f.NegativeStatCacheCapacity)
+	ExpectEq(time.Minute, f.NegativeStatCacheTTL)
 	ExpectEq(time.Minute, f.TypeCacheTTL)
+	ExpectEq(0, f.KernelListCacheTTL)
 	ExpectEq("", f.TempDir)
+	ExpectEq(0, f.MemoryStagingMB)
+	ExpectEq("", f.WriteJournalDir)
+	ExpectFalse(f.StreamingWrites)
+	ExpectEq(0, f.UploadChunkSizeMB)
+	ExpectEq(0, f.WriteBackDelay)
+	ExpectEq(1024, f.WriteBackMaxDirtyMB)
+	ExpectFalse(f.AsyncClose)
+	ExpectFalse(f.LazyFsync)
+	ExpectFalse(f.SkipUnmodifiedFsync)
+	ExpectEq(0, f.ParallelUploadThresholdMB)
+	ExpectEq(8, f.ParallelUploadParts)
+	ExpectEq("", f.FileCacheDir)
+	ExpectEq(10240, f.FileCacheMaxMB)
+	ExpectEq("", f.RangeCacheDir)
+	ExpectEq(10240, f.RangeCacheMaxMB)
+	ExpectFalse(f.RangeCacheAllReads)
+	ExpectEq(0, f.ParallelDownloadThresholdMB)
+	ExpectEq(8, f.ParallelDownloadChunkSizeMB)
+	ExpectEq(8, f.ParallelDownloadStreams)
+	ExpectEq(0, f.ReadAheadMB)
+	ExpectEq(2, f.ReadAheadTrigger)
+
+	// Logging
+	ExpectEq(logger.FormatText, f.LogFormat)
+	ExpectEq(logger.Info, f.LogSeverity)
 
 	// Debugging
 	ExpectFalse(f.DebugFuse)
 	ExpectFalse(f.DebugGCS)
 	ExpectFalse(f.DebugHTTP)
 	ExpectFalse(f.DebugInvariants)
+	ExpectEq("", f.DebugAddr)
+	ExpectEq("", f.DebugRecordHTTP)
 }
 
 func (t *FlagsTest) Bools() {
 	names := []string{
+		"force-unmount",
 		"implicit-dirs",
+		"allow-other",
+		"preserve-posix-metadata",
+		"reflect-iam-permissions",
+		"streaming-writes",
+		"async-close",
+		"lazy-fsync",
+		"skip-unmodified-fsync",
+		"range-cache-all-reads",
+		"read-stall-other-ip",
+		"verify-crc32c",
 		"debug_fuse",
 		"debug_gcs",
 		"debug_http",
@@ -107,7 +209,18 @@ func (t *FlagsTest) Bools() {
 	}
 
 	f = parseArgs(args)
+	ExpectTrue(f.ForceUnmount)
 	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.AllowOther)
+	ExpectTrue(f.PreservePosixMetadata)
+	ExpectTrue(f.ReflectIAMPermissions)
+	ExpectTrue(f.StreamingWrites)
+	ExpectTrue(f.AsyncClose)
+	ExpectTrue(f.LazyFsync)
+	ExpectTrue(f.SkipUnmodifiedFsync)
+	ExpectTrue(f.RangeCacheAllReads)
+	ExpectTrue(f.ReadStallOtherIP)
+	ExpectTrue(f.VerifyCRC32C)
 	ExpectTrue(f.DebugFuse)
 	ExpectTrue(f.DebugGCS)
 	ExpectTrue(f.DebugHTTP)
@@ -120,7 +233,18 @@ func (t *FlagsTest) Bools() {
 	}
 
 	f = parseArgs(args)
+	ExpectFalse(f.ForceUnmount)
 	ExpectFalse(f.ImplicitDirs)
+	ExpectFalse(f.AllowOther)
+	ExpectFalse(f.PreservePosixMetadata)
+	ExpectFalse(f.ReflectIAMPermissions)
+	ExpectFalse(f.StreamingWrites)
+	ExpectFalse(f.AsyncClose)
+	ExpectFalse(f.LazyFsync)
+	ExpectFalse(f.SkipUnmodifiedFsync)
+	ExpectFalse(f.RangeCacheAllReads)
+	ExpectFalse(f.ReadStallOtherIP)
+	ExpectFalse(f.VerifyCRC32C)
 	ExpectFalse(f.DebugFuse)
 	ExpectFalse(f.DebugGCS)
 	ExpectFalse(f.DebugHTTP)
@@ -133,28 +257,95 @@ func (t *FlagsTest) Bools() {
 	}
 
 	f = parseArgs(args)
+	ExpectTrue(f.ForceUnmount)
 	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.AllowOther)
+	ExpectTrue(f.PreservePosixMetadata)
+	ExpectTrue(f.ReflectIAMPermissions)
+	ExpectTrue(f.StreamingWrites)
+	ExpectTrue(f.AsyncClose)
+	ExpectTrue(f.LazyFsync)
+	ExpectTrue(f.SkipUnmodifiedFsync)
+	ExpectTrue(f.RangeCacheAllReads)
+	ExpectTrue(f.ReadStallOtherIP)
+	ExpectTrue(f.VerifyCRC32C)
 	ExpectTrue(f.DebugFuse)
 	ExpectTrue(f.DebugGCS)
 	ExpectTrue(f.DebugHTTP)
 	ExpectTrue(f.DebugInvariants)
 }
 
+func (t *FlagsTest) DefaultPermissions() {
+	ExpectTrue(parseArgs([]string{"--default-permissions"}).DefaultPermissions)
+	ExpectTrue(
+		parseArgs([]string{"--default-permissions=true"}).DefaultPermissions)
+	ExpectFalse(
+		parseArgs([]string{"--default-permissions=false"}).DefaultPermissions)
+}
+
 func (t *FlagsTest) DecimalNumbers() {
 	args := []string{
 		"--uid=17",
 		"--gid=19",
+		"--rename-dir-limit=1000",
 		"--limit-bytes-per-sec=123.4",
 		"--limit-ops-per-sec=56.78",
 		"--stat-cache-capacity=8192",
+		"--negative-stat-cache-capacity=100",
+		"--stat-cache-max-size-mb=256",
+		"--max-concurrent-requests=17",
+		"--max-conns-per-host=64",
+		"--max-idle-conns-per-host=32",
+		"--list-page-size=5000",
+		"--max-retry-attempts=7",
+		"--retry-multiplier=1.5",
+		"--upload-chunk-size-mb=16",
+		"--memory-staging-mb=512",
+		"--max-memory-mb=4096",
+		"--max-cached-inodes=100000",
+		"--max-open-readers=500",
+		"--write-back-max-dirty-mb=64",
+		"--parallel-upload-threshold-mb=256",
+		"--parallel-upload-parts=16",
+		"--file-cache-max-size-mb=512",
+		"--range-cache-max-size-mb=256",
+		"--parallel-download-threshold-mb=1024",
+		"--parallel-download-chunk-size-mb=32",
+		"--parallel-download-streams=16",
+		"--read-ahead-mb=32",
+		"--read-ahead-trigger=4",
 	}
 
 	f := parseArgs(args)
 	ExpectEq(17, f.Uid)
 	ExpectEq(19, f.Gid)
+	ExpectEq(1000, f.RenameDirLimit)
 	ExpectEq(123.4, f.EgressBandwidthLimitBytesPerSecond)
 	ExpectEq(56.78, f.OpRateLimitHz)
 	ExpectEq(8192, f.StatCacheCapacity)
+	ExpectEq(100, f.NegativeStatCacheCapacity)
+	ExpectEq(256, f.StatCacheMaxSizeMB)
+	ExpectEq(17, f.MaxConcurrentRequests)
+	ExpectEq(64, f.MaxConnsPerHost)
+	ExpectEq(32, f.MaxIdleConnsPerHost)
+	ExpectEq(5000, f.ListPageSize)
+	ExpectEq(7, f.MaxRetryAttempts)
+	ExpectEq(1.5, f.RetryMultiplier)
+	ExpectEq(16, f.UploadChunkSizeMB)
+	ExpectEq(512, f.MemoryStagingMB)
+	ExpectEq(4096, f.MaxMemoryMB)
+	ExpectEq(100000, f.MaxCachedInodes)
+	ExpectEq(500, f.MaxOpenReaders)
+	ExpectEq(64, f.WriteBackMaxDirtyMB)
+	ExpectEq(256, f.ParallelUploadThresholdMB)
+	ExpectEq(16, f.ParallelUploadParts)
+	ExpectEq(512, f.FileCacheMaxMB)
+	ExpectEq(256, f.RangeCacheMaxMB)
+	ExpectEq(1024, f.ParallelDownloadThresholdMB)
+	ExpectEq(32, f.ParallelDownloadChunkSizeMB)
+	ExpectEq(16, f.ParallelDownloadStreams)
+	ExpectEq(32, f.ReadAheadMB)
+	ExpectEq(4, f.ReadAheadTrigger)
 }
 
 func (t *FlagsTest) OctalNumbers() {
@@ -173,23 +364,476 @@ func (t *FlagsTest) Strings() {
 		"--key-file", "-asdf",
 		"--temp-dir=foobar",
 		"--only-dir=baz",
+		"--prefix-dirs=a:b/c;d:e",
+		"--versions-dir=.versions",
+		"--debug_addr=localhost:8000",
+		"--endpoint=http://localhost:4443",
+		"--nonempty-mount-point=warn",
+		"--failover-bucket=my-mirror",
+		"--offline-queue-dir=/var/spool/gcsfuse",
+		"--write-journal-dir=/var/lib/gcsfuse",
+		"--debug_record_http=/tmp/gcs.jsonl",
+		"--inventory-report=reports/inventory/2015-04-05",
+		"--notification-subscription=projects/p/subscriptions/s",
+		"--file-cache-dir=/mnt/ssd/gcsfuse",
+		"--range-cache-dir=/mnt/ssd/ranges",
+		"--encryption-key-file=/etc/gcsfuse/key",
+		"--impersonate-service-account=a@p.iam.gserviceaccount.com,b@p.iam.gserviceaccount.com",
+		"--token-url=http://localhost:8080/token",
+		"--project=my-project",
 	}
 
 	f := parseArgs(args)
 	ExpectEq("-asdf", f.KeyFile)
 	ExpectEq("foobar", f.TempDir)
 	ExpectEq("baz", f.OnlyDir)
+	ExpectEq("a:b/c;d:e", f.PrefixDirs)
+	ExpectEq(".versions", f.VersionsDir)
+	ExpectEq("localhost:8000", f.DebugAddr)
+	ExpectEq("http://localhost:4443", f.Endpoint)
+	ExpectEq(NonEmptyWarn, f.NonEmpty)
+	ExpectEq("my-mirror", f.FailoverBucket)
+	ExpectEq("/var/spool/gcsfuse", f.OfflineQueueDir)
+	ExpectEq("/var/lib/gcsfuse", f.WriteJournalDir)
+	ExpectEq("/tmp/gcs.jsonl", f.DebugRecordHTTP)
+	ExpectEq("reports/inventory/2015-04-05", f.InventoryReport)
+	ExpectEq("projects/p/subscriptions/s", f.NotificationSubscription)
+	ExpectEq("/mnt/ssd/gcsfuse", f.FileCacheDir)
+	ExpectEq("/mnt/ssd/ranges", f.RangeCacheDir)
+	ExpectEq("/etc/gcsfuse/key", f.EncryptionKeyFile)
+	ExpectEq(
+		"a@p.iam.gserviceaccount.com,b@p.iam.gserviceaccount.com",
+		f.ImpersonateServiceAccount)
+	ExpectEq("http://localhost:8080/token", f.TokenURL)
+	ExpectEq("my-project", f.Project)
+}
+
+func (t *FlagsTest) OnlyDir() {
+	f := parseArgs([]string{"--only-dir=/some//dir/"})
+	ExpectEq("some/dir", f.OnlyDir)
+
+	for s, expected := range map[string]string{
+		"a/../b":  "b",
+		"./a":     "a",
+		"/../a/b": "a/b",
+	} {
+		dir, err := cleanOnlyDir(s)
+		AssertEq(nil, err, "s: %q", s)
+		ExpectEq(expected, dir, "s: %q", s)
+	}
+
+	for _, s := range []string{"/", ".", "a/..", "..", "../a", "/../a/.."} {
+		_, err := cleanOnlyDir(s)
+		ExpectNe(nil, err, "s: %q", s)
+	}
+}
+
+func (t *FlagsTest) IncludeAndExclude() {
+	args := []string{
+		"--include", "data/**/*.parquet",
+		"--include=*.csv",
+		"--exclude", "*.tmp",
+	}
+
+	f := parseArgs(args)
+	ExpectThat(f.Include, ElementsAre("data/**/*.parquet", "*.csv"))
+	ExpectThat(f.Exclude, ElementsAre("*.tmp"))
 }
 
 func (t *FlagsTest) Durations() {
 	args := []string{
 		"--stat-cache-ttl", "1m17s",
 		"--type-cache-ttl", "19ns",
+		"--kernel-list-cache-ttl", "30s",
+		"--clock-skew-threshold", "5m",
+		"--failover-after", "250ms",
+		"--custom-time-interval", "24h",
+		"--write-lease-ttl", "90s",
+		"--negative-stat-cache-ttl", "5s",
+		"--read-stall-timeout", "20s",
+		"--max-retry-sleep", "2m",
+		"--idle-conn-timeout", "5m",
+		"--tcp-keep-alive", "15s",
 	}
 
 	f := parseArgs(args)
 	ExpectEq(77*time.Second, f.StatCacheTTL)
+	ExpectEq(5*time.Second, f.NegativeStatCacheTTL)
 	ExpectEq(19*time.Nanosecond, f.TypeCacheTTL)
+	ExpectEq(30*time.Second, f.KernelListCacheTTL)
+	ExpectEq(5*time.Minute, f.ClockSkewThreshold)
+	ExpectEq(250*time.Millisecond, f.FailoverAfter)
+	ExpectEq(24*time.Hour, f.CustomTimeInterval)
+	ExpectEq(90*time.Second, f.WriteLeaseTTL)
+	ExpectEq(20*time.Second, f.ReadStallTimeout)
+	ExpectEq(2*time.Minute, f.MaxRetrySleep)
+	ExpectEq(5*time.Minute, f.IdleConnTimeout)
+	ExpectEq(15*time.Second, f.TCPKeepAlive)
+}
+
+func (t *FlagsTest) WriteBack() {
+	// Write-back can't be combined with leases, so it gets a test of its own.
+	f := parseArgs([]string{"--write-back-delay", "10s"})
+	ExpectEq(10*time.Second, f.WriteBackDelay)
+}
+
+func (t *FlagsTest) PrefetchMetadata() {
+	f := parseArgs([]string{})
+	ExpectFalse(f.PrefetchMetadata.Enabled)
+
+	// Without a value, everything is listed.
+	f = parseArgs([]string{"--prefetch-metadata"})
+	ExpectTrue(f.PrefetchMetadata.Enabled)
+	ExpectEq("", f.PrefetchMetadata.Prefix)
+
+	// With one, only objects with that prefix are.
+	f = parseArgs([]string{"--prefetch-metadata=data/train/"})
+	ExpectTrue(f.PrefetchMetadata.Enabled)
+	ExpectEq("data/train/", f.PrefetchMetadata.Prefix)
+
+	f = parseArgs([]string{"--prefetch-metadata=false"})
+	ExpectFalse(f.PrefetchMetadata.Enabled)
+}
+
+func (t *FlagsTest) FileRules() {
+	args := []string{
+		"--file-rules", "*.ckpt:parallel-download; *.log:no-cache",
+		"--file-rules=db/*.db:write-through",
+	}
+
+	f := parseArgs(args)
+	AssertEq(3, len(f.FileRules))
+
+	ExpectEq("*.ckpt", f.FileRules[0].Pattern)
+	ExpectEq(fs.ParallelDownload, f.FileRules[0].Action)
+	ExpectEq("*.log", f.FileRules[1].Pattern)
+	ExpectEq(fs.NoCache, f.FileRules[1].Action)
+	ExpectEq("db/*.db", f.FileRules[2].Pattern)
+	ExpectEq(fs.WriteThrough, f.FileRules[2].Action)
+
+	ExpectEq(
+		"*.ckpt:parallel-download;*.log:no-cache;db/*.db:write-through",
+		f.FileRules.String())
+}
+
+func (t *FlagsTest) FileRules_Illegal() {
+	testCases := []string{
+		"*.ckpt",
+		"*.ckpt:taco",
+		"[:no-cache",
+	}
+
+	for _, tc := range testCases {
+		var fr FileRules
+		ExpectNe(nil, fr.Set(tc), "value: %q", tc)
+	}
+}
+
+func (t *FlagsTest) IDMaps() {
+	args := []string{
+		"--uid-map", "0:100000:1000, 1000:1000:1",
+		"--uid-map=1001:101001:64535",
+		"--gid-map=0:200000:65536",
+	}
+
+	f := parseArgs(args)
+	AssertEq(3, len(f.UIDMap))
+	AssertEq(1, len(f.GIDMap))
+
+	ExpectEq("0:100000:1000,1000:1000:1,1001:101001:64535", f.UIDMap.String())
+	ExpectEq("0:200000:65536", f.GIDMap.String())
+
+	// Translation
+	id, err := f.UIDMap.Translate(0)
+	AssertEq(nil, err)
+	ExpectEq(100000, id)
+
+	id, err = f.UIDMap.Translate(999)
+	AssertEq(nil, err)
+	ExpectEq(100999, id)
+
+	id, err = f.UIDMap.Translate(1000)
+	AssertEq(nil, err)
+	ExpectEq(1000, id)
+
+	id, err = f.GIDMap.Translate(65535)
+	AssertEq(nil, err)
+	ExpectEq(265535, id)
+
+	_, err = f.GIDMap.Translate(65536)
+	ExpectThat(err, Error(HasSubstr("not mapped")))
+}
+
+func (t *FlagsTest) IDMaps_Illegal() {
+	testCases := []string{
+		"0:100000",
+		"0:100000:1:2",
+		"a:100000:1",
+		"0:100000:0",
+		"0:4294967295:2",
+		"-1:100000:1",
+	}
+
+	for _, tc := range testCases {
+		var m IDMap
+		ExpectNe(nil, m.Set(tc), "value: %q", tc)
+	}
+}
+
+func (t *FlagsTest) BandwidthSchedule() {
+	args := []string{
+		"--bandwidth-schedule", "09:00-18:00=2e6/5e5; 22:00-06:00=none/none",
+		"--bandwidth-schedule=12:30-13:30=1000/none",
+	}
+
+	f := parseArgs(args)
+	AssertEq(3, len(f.BandwidthSchedule))
+
+	ExpectEq(9*time.Hour, f.BandwidthSchedule[0].Start)
+	ExpectEq(18*time.Hour, f.BandwidthSchedule[0].End)
+	ExpectEq(2e6, f.BandwidthSchedule[0].ReadLimit)
+	ExpectEq(5e5, f.BandwidthSchedule[0].WriteLimit)
+
+	ExpectEq(
+		"09:00-18:00=2e+06/500000;22:00-06:00=none/none;12:30-13:30=1000/none",
+		f.BandwidthSchedule.String())
+}
+
+func (t *FlagsTest) NormalizeNames() {
+	f := parseArgs([]string{"--normalize-names=nfd"})
+	ExpectEq(fs.NameFormNFD, f.NameForm)
+
+	f = parseArgs([]string{"--normalize-names", "none"})
+	ExpectEq(fs.NameFormNone, f.NameForm)
+
+	var nf NameForm
+	ExpectNe(nil, nf.Set("NFKC"))
+	ExpectNe(nil, nf.Set(""))
+}
+
+func (t *FlagsTest) Logging() {
+	f := parseArgs([]string{"--log-format=json", "--log-severity", "warning"})
+	ExpectEq(logger.FormatJSON, f.LogFormat)
+	ExpectEq(logger.Warning, f.LogSeverity)
+	ExpectEq("warning", LogSeverity(f.LogSeverity).String())
+
+	var lf LogFormat
+	ExpectNe(nil, lf.Set("xml"))
+
+	var ls LogSeverity
+	ExpectNe(nil, ls.Set("loud"))
+}
+
+func (t *FlagsTest) UnchangedContent() {
+	f := parseArgs([]string{"--unchanged-content=touch"})
+	ExpectEq(gcsx.UnchangedContentTouch, f.UnchangedContent)
+
+	f = parseArgs([]string{"--unchanged-content", "upload"})
+	ExpectEq(gcsx.UnchangedContentUpload, f.UnchangedContent)
+	ExpectEq("upload", UnchangedContent(f.UnchangedContent).String())
+
+	var u UnchangedContent
+	ExpectNe(nil, u.Set("taco"))
+	ExpectNe(nil, u.Set(""))
+}
+
+func (t *FlagsTest) ListProjection() {
+	f := parseArgs([]string{"--list-projection=noAcl"})
+	ExpectEq(gcsx.ListProjectionNoACL, f.ListProjection)
+
+	var p ListProjection
+	ExpectNe(nil, p.Set("taco"))
+	ExpectNe(nil, p.Set(""))
+}
+
+func (t *FlagsTest) GzipObjects() {
+	f := parseArgs([]string{"--gzip-objects=decompress"})
+	ExpectEq(gcsx.GzipObjectsDecompress, f.GzipObjects)
+
+	var g GzipObjects
+	ExpectNe(nil, g.Set("taco"))
+	ExpectNe(nil, g.Set(""))
+}
+
+func (t *FlagsTest) ContentTypesAndCacheControl() {
+	args := []string{
+		"--content-types=.md=text/markdown,.WASM=application/wasm",
+		"--content-types", ".md=text/x-markdown",
+		"--cache-control=*.html=no-cache",
+		"--cache-control", "static/*=public, max-age=31536000",
+	}
+
+	f := parseArgs(args)
+	ExpectEq(
+		".md=text/x-markdown,.wasm=application/wasm",
+		f.ContentTypes.String())
+
+	AssertEq(2, len(f.CacheControl))
+	ExpectEq("*.html", f.CacheControl[0].Pattern)
+	ExpectEq("no-cache", f.CacheControl[0].Value)
+	ExpectEq("static/*", f.CacheControl[1].Pattern)
+	ExpectEq("public, max-age=31536000", f.CacheControl[1].Value)
+
+	ct := make(ContentTypes)
+	ExpectNe(nil, ct.Set("md=text/markdown"))
+	ExpectNe(nil, ct.Set(".md"))
+
+	var cc CacheControlRules
+	ExpectNe(nil, cc.Set("*.html"))
+	ExpectNe(nil, cc.Set("*.html="))
+}
+
+func (t *FlagsTest) StorageClasses() {
+	args := []string{
+		"--storage-class=nearline",
+		"--storage-class-overrides=logs/:COLDLINE;archive/:archive",
+		"--storage-class-overrides", "archive/hot/:STANDARD",
+	}
+
+	f := parseArgs(args)
+	ExpectEq("NEARLINE", f.StorageClass)
+
+	AssertEq(3, len(f.StorageClassOverrides))
+	ExpectEq(
+		"logs/:COLDLINE;archive/:ARCHIVE;archive/hot/:STANDARD",
+		f.StorageClassOverrides.String())
+
+	var sc StorageClass
+	ExpectNe(nil, sc.Set("taco"))
+	ExpectNe(nil, sc.Set(""))
+
+	var o StorageClassOverrides
+	ExpectNe(nil, o.Set("logs/"))
+	ExpectNe(nil, o.Set("logs/:taco"))
+}
+
+func (t *FlagsTest) Retries() {
+	args := []string{
+		"--retryable-codes=503, 504",
+		"--retry-overrides=read:attempts=10,sleep=1m;create:attempts=0",
+		"--retry-overrides", "stat:multiplier=3",
+	}
+
+	f := parseArgs(args)
+	ExpectThat(f.RetryableCodes, ElementsAre(503, 504))
+
+	AssertEq(3, len(f.RetryOverrides))
+	ExpectEq(
+		"read:attempts=10,sleep=1m0s;create:attempts=0;stat:multiplier=3",
+		f.RetryOverrides.String())
+
+	var rc RetryableCodes
+	ExpectNe(nil, rc.Set("taco"))
+	ExpectNe(nil, rc.Set("42"))
+
+	var ro RetryOverrides
+	ExpectNe(nil, ro.Set("read"))
+	ExpectNe(nil, ro.Set("taco:attempts=1"))
+	ExpectNe(nil, ro.Set("read:attempts=-1"))
+	ExpectNe(nil, ro.Set("read:multiplier=0.5"))
+	ExpectNe(nil, ro.Set("read:speed=11"))
+}
+
+func (t *FlagsTest) ClientProtocol() {
+	f := parseArgs([]string{"--client-protocol=http1"})
+	ExpectEq(ClientProtocolHTTP1, f.ClientProtocol)
+
+	var p ClientProtocol
+	ExpectNe(nil, p.Set("http3"))
+	ExpectNe(nil, p.Set(""))
+}
+
+func (t *FlagsTest) Profile() {
+	f := parseArgs([]string{"--profile=ml-training"})
+
+	ExpectTrue(f.ImplicitDirs)
+	ExpectEq(262144, f.StatCacheCapacity)
+	ExpectEq(time.Hour, f.StatCacheTTL)
+	ExpectEq(time.Hour, f.TypeCacheTTL)
+	ExpectEq(-1, f.OpRateLimitHz)
+
+	AssertEq(3, len(f.FileRules))
+	ExpectEq(fs.ParallelDownload, f.FileRules[0].Action)
+
+	// Flags the profile doesn't mention keep their defaults.
+	ExpectEq(-1, f.EgressBandwidthLimitBytesPerSecond)
+}
+
+func (t *FlagsTest) Profile_ExplicitFlagsTakePrecedence() {
+	args := []string{
+		"--stat-cache-ttl=0",
+		"--profile", "ml-training",
+		"--file-rules=*.log:no-cache",
+	}
+
+	f := parseArgs(args)
+
+	ExpectEq(0, f.StatCacheTTL)
+	ExpectEq(time.Hour, f.TypeCacheTTL)
+
+	AssertEq(1, len(f.FileRules))
+	ExpectEq("*.log", f.FileRules[0].Pattern)
+}
+
+func (t *FlagsTest) Profile_AllApplyCleanly() {
+	names := []string{
+		"ml-training",
+		"media-serving",
+		"backup",
+		"interactive",
+	}
+
+	for _, n := range names {
+		parseArgs([]string{"--profile", n})
+	}
+}
+
+func (t *FlagsTest) Profile_Unknown() {
+	var p Profile
+	ExpectThat(p.Set("taco"), Error(HasSubstr("Unknown profile")))
+	ExpectThat(p.Set(""), Error(HasSubstr("Unknown profile")))
+}
+
+func (t *FlagsTest) MaxMemory() {
+	// The stat cache takes its share of the budget.
+	f := parseArgs([]string{"--max-memory-mb", "2048"})
+	ExpectEq(2048, f.MaxMemoryMB)
+	ExpectEq(512, f.StatCacheMaxSizeMB)
+
+	// Unless told otherwise.
+	f = parseArgs([]string{
+		"--max-memory-mb", "2048",
+		"--stat-cache-max-size-mb", "64",
+	})
+
+	ExpectEq(64, f.StatCacheMaxSizeMB)
+}
+
+func (t *FlagsTest) MetadataCache() {
+	args := []string{
+		"--metadata-cache-ttl", "5m",
+		"--metadata-cache-capacity", "100000",
+	}
+
+	f := parseArgs(args)
+	ExpectEq(5*time.Minute, f.StatCacheTTL)
+	ExpectEq(5*time.Minute, f.TypeCacheTTL)
+	ExpectEq(100000, f.StatCacheCapacity)
+}
+
+func (t *FlagsTest) MetadataCache_PrecedesProfile() {
+	args := []string{
+		"--type-cache-ttl", "0",
+		"--metadata-cache-ttl", "5m",
+		"--profile", "ml-training",
+	}
+
+	f := parseArgs(args)
+
+	// Explicit flags win, then the metadata cache flags, then the profile.
+	ExpectEq(0, f.TypeCacheTTL)
+	ExpectEq(5*time.Minute, f.StatCacheTTL)
+	ExpectEq(262144, f.StatCacheCapacity)
 }
 
 func (t *FlagsTest) Maps() {
@@ -213,3 +857,18 @@ func (t *FlagsTest) Maps() {
 	ExpectEq("", f.MountOptions["rw"])
 	ExpectEq("jacobsa", f.MountOptions["user"])
 }
+
+func (t *FlagsTest) Maps_QuotedValues() {
+	args := []string{
+		"-o", `ro,context="system_u:object_r:container_file_t:s0:c1,c2",nodev`,
+	}
+
+	f := parseArgs(args)
+
+	AssertEq(3, len(f.MountOptions), "Options: %v", f.MountOptions)
+	ExpectEq("", f.MountOptions["ro"])
+	ExpectEq("", f.MountOptions["nodev"])
+	ExpectEq(
+		"system_u:object_r:container_file_t:s0:c1,c2",
+		f.MountOptions["context"])
+}
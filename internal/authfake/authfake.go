@@ -0,0 +1,443 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authfake contains a test double for the Google OAuth 2.0 token
+// endpoint and the GCE metadata server, for exercising credential resolution
+// and token refresh without real service accounts.
+//
+// Point a service account key file at the server with WriteServiceAccountKey,
+// or point the metadata client at it by setting the GCE_METADATA_HOST
+// environment variable to MetadataHost(). It also serves the IAM Service
+// Account Credentials API's generateAccessToken method at URL(), allowing
+// tokens it has issued to impersonate any service account, and exchanges any
+// subject token for an access token at TokenURL(), as the Security Token
+// Service does for workload identity federation.
+package authfake
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/jws"
+)
+
+// The email address of the fake service account.
+const ServiceAccountEmail = "gcsfuse-test@fake-project.iam.gserviceaccount.com"
+
+// The project ID reported by the fake metadata server.
+const ProjectID = "fake-project"
+
+// The grant type used by service account key files.
+const jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// The grant type used for workload identity federation.
+const tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// Server is a fake token endpoint and metadata server. It is safe for
+// concurrent access.
+type Server struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu sync.Mutex
+
+	// How long newly issued tokens are valid for.
+	//
+	// GUARDED_BY(mu)
+	lifetime time.Duration
+
+	// If true, refuse to issue tokens.
+	//
+	// GUARDED_BY(mu)
+	refusing bool
+
+	// The tokens issued so far, in order, and the scopes requested for each.
+	// Tokens issued by the metadata server have no scope.
+	//
+	// GUARDED_BY(mu)
+	tokens []string
+	scopes []string
+
+	// The impersonations performed so far, in order.
+	//
+	// GUARDED_BY(mu)
+	impersonations []Impersonation
+
+	// The token exchanges performed so far, in order.
+	//
+	// GUARDED_BY(mu)
+	exchanges []Exchange
+}
+
+// Exchange records a token exchange request.
+type Exchange struct {
+	SubjectToken     string
+	SubjectTokenType string
+	Audience         string
+	Scope            string
+
+	// The token issued.
+	Token string
+}
+
+// Impersonation records a request to impersonate a service account.
+type Impersonation struct {
+	// The token with which the request was authorized.
+	CallerToken string
+
+	// The service account impersonated, and the delegates named in the request,
+	// as resource names of the form "projects/-/serviceAccounts/EMAIL".
+	Target    string
+	Delegates []string
+
+	// The token issued.
+	Token string
+}
+
+// NewServer starts a server issuing tokens that are valid for an hour. The
+// caller must call Close when finished with it.
+func NewServer() (s *Server, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		err = fmt.Errorf("GenerateKey: %v", err)
+		return
+	}
+
+	s = &Server{
+		key:      key,
+		lifetime: time.Hour,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc("/computeMetadata/v1/", s.handleMetadata)
+	mux.HandleFunc("/v1/projects/-/serviceAccounts/", s.handleGenerateAccessToken)
+	s.server = httptest.NewServer(mux)
+
+	return
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// URL returns the base URL of the server, e.g. for use as the IAM Service
+// Account Credentials API endpoint.
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// TokenURL returns the URL of the fake token endpoint.
+func (s *Server) TokenURL() string {
+	return s.server.URL + "/token"
+}
+
+// MetadataHost returns a value for the GCE_METADATA_HOST environment variable
+// that directs metadata requests to the server.
+func (s *Server) MetadataHost() string {
+	return s.server.Listener.Addr().String()
+}
+
+// SetTokenLifetime changes the lifetime of tokens issued from now on. Note
+// that package oauth2 treats tokens expiring within ten seconds as already
+// expired.
+func (s *Server) SetTokenLifetime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lifetime = d
+}
+
+// SetRefusing controls whether the server refuses to issue tokens, as if the
+// credentials had been revoked.
+func (s *Server) SetRefusing(refusing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refusing = refusing
+}
+
+// TokensIssued returns the access tokens issued so far, in order.
+func (s *Server) TokensIssued() (tokens []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens = append(tokens, s.tokens...)
+	return
+}
+
+// ScopesRequested returns the scope requested for each token returned by
+// TokensIssued, or the empty string for tokens issued by the metadata server.
+func (s *Server) ScopesRequested() (scopes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scopes = append(scopes, s.scopes...)
+	return
+}
+
+// Impersonations returns the impersonations performed so far, in order.
+func (s *Server) Impersonations() (impersonations []Impersonation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	impersonations = append(impersonations, s.impersonations...)
+	return
+}
+
+// Exchanges returns the token exchanges performed so far, in order.
+func (s *Server) Exchanges() (exchanges []Exchange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exchanges = append(exchanges, s.exchanges...)
+	return
+}
+
+// WriteServiceAccountKey writes a service account JSON key file to the
+// supplied path that directs token requests to the server.
+func (s *Server) WriteServiceAccountKey(path string) (err error) {
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(s.key),
+	})
+
+	contents, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     ProjectID,
+		"private_key_id": "fake-key-id",
+		"private_key":    string(keyPEM),
+		"client_email":   ServiceAccountEmail,
+		"client_id":      "12345",
+		"token_uri":      s.TokenURL(),
+	})
+
+	if err != nil {
+		err = fmt.Errorf("json.Marshal: %v", err)
+		return
+	}
+
+	err = ioutil.WriteFile(path, contents, 0600)
+	if err != nil {
+		err = fmt.Errorf("WriteFile: %v", err)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Handlers
+////////////////////////////////////////////////////////////////////////
+
+// Mint a new token with the given scope, unless we are refusing to.
+func (s *Server) issueToken(
+	scope string) (token string, lifetime time.Duration, refused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refusing {
+		refused = true
+		return
+	}
+
+	token = fmt.Sprintf("fake-token-%d", len(s.tokens))
+	lifetime = s.lifetime
+
+	s.tokens = append(s.tokens, token)
+	s.scopes = append(s.scopes, scope)
+
+	return
+}
+
+func writeToken(w http.ResponseWriter, token string, lifetime time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int64(lifetime / time.Second),
+	})
+}
+
+// Handle a JWT bearer grant, as made for service account keys, or a token
+// exchange grant.
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	grantType := r.FormValue("grant_type")
+	if grantType == tokenExchangeGrantType {
+		s.handleTokenExchange(w, r)
+		return
+	}
+
+	if grantType != jwtBearerGrantType {
+		http.Error(w, `{"error": "unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Check that the assertion was signed with our key and is meant for us.
+	assertion := r.FormValue("assertion")
+	if err := jws.Verify(assertion, &s.key.PublicKey); err != nil {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := jws.Decode(assertion)
+	if err != nil ||
+		claims.Iss != ServiceAccountEmail ||
+		claims.Aud != s.TokenURL() {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	token, lifetime, refused := s.issueToken(claims.Scope)
+	if refused {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	writeToken(w, token, lifetime)
+}
+
+// Handle a token exchange grant, as made for external accounts. Any subject
+// token is accepted.
+func (s *Server) handleTokenExchange(w http.ResponseWriter, r *http.Request) {
+	subjectToken := r.FormValue("subject_token")
+	if subjectToken == "" {
+		http.Error(w, `{"error": "invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+
+	token, lifetime, refused := s.issueToken(r.FormValue("scope"))
+	if refused {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.exchanges = append(s.exchanges, Exchange{
+		SubjectToken:     subjectToken,
+		SubjectTokenType: r.FormValue("subject_token_type"),
+		Audience:         r.FormValue("audience"),
+		Scope:            r.FormValue("scope"),
+		Token:            token,
+	})
+	s.mu.Unlock()
+
+	writeToken(w, token, lifetime)
+}
+
+// Handle the subset of the metadata server API used by package oauth2/google.
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	// Like the real server, insist on the header that proves the request isn't
+	// a redirected browser request.
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "Missing Metadata-Flavor header", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Metadata-Flavor", "Google")
+
+	switch r.URL.Path {
+	case "/computeMetadata/v1/project/project-id":
+		fmt.Fprint(w, ProjectID)
+
+	case "/computeMetadata/v1/instance/service-accounts/default/email":
+		fmt.Fprint(w, ServiceAccountEmail)
+
+	case "/computeMetadata/v1/instance/service-accounts/default/token":
+		token, lifetime, refused := s.issueToken("")
+		if refused {
+			http.Error(w, "Token unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		writeToken(w, token, lifetime)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Handle the IAM Service Account Credentials API's generateAccessToken method,
+// for any service account, if authorized by a token we issued.
+func (s *Server) handleGenerateAccessToken(
+	w http.ResponseWriter,
+	r *http.Request) {
+	const suffix = ":generateAccessToken"
+	if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, suffix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	target := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), suffix)
+
+	// Check the caller's token.
+	callerToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	known := false
+	for _, t := range s.TokensIssued() {
+		known = known || t == callerToken
+	}
+
+	if !known {
+		http.Error(w, `{"error": {"code": 401}}`, http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the request.
+	var req struct {
+		Delegates []string `json:"delegates"`
+		Scope     []string `json:"scope"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": {"code": 400}}`, http.StatusBadRequest)
+		return
+	}
+
+	token, lifetime, refused := s.issueToken(strings.Join(req.Scope, " "))
+	if refused {
+		http.Error(w, `{"error": {"code": 403}}`, http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	s.impersonations = append(s.impersonations, Impersonation{
+		CallerToken: callerToken,
+		Target:      target,
+		Delegates:   req.Delegates,
+		Token:       token,
+	})
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accessToken": token,
+		"expireTime":  time.Now().Add(lifetime).UTC().Format(time.RFC3339),
+	})
+}
@@ -18,6 +18,7 @@
 package canned
 
 import (
+	"fmt"
 	"log"
 	"strings"
 
@@ -60,7 +61,18 @@ const (
 func MakeFakeBucket(ctx context.Context) (b gcs.Bucket) {
 	b = gcsfake.NewFakeBucket(timeutil.RealClock(), FakeBucketName)
 
-	// Set up contents.
+	err := PopulateBucket(ctx, b)
+	if err != nil {
+		log.Panicf("PopulateBucket: %v", err)
+	}
+
+	return
+}
+
+// Create the canned contents described in the comments for FakeBucketName in
+// the supplied bucket, which may be a real one (e.g. on a GCS emulator).
+// Existing objects with other names are left alone.
+func PopulateBucket(ctx context.Context, b gcs.Bucket) (err error) {
 	contents := map[string]string{
 		TopLevelFile:    TopLevelFile_Contents,
 		TopLevelDir:     TopLevelDir_Contents,
@@ -69,7 +81,7 @@ func MakeFakeBucket(ctx context.Context) (b gcs.Bucket) {
 	}
 
 	for k, v := range contents {
-		_, err := b.CreateObject(
+		_, err = b.CreateObject(
 			ctx,
 			&gcs.CreateObjectRequest{
 				Name:     k,
@@ -77,7 +89,8 @@ func MakeFakeBucket(ctx context.Context) (b gcs.Bucket) {
 			})
 
 		if err != nil {
-			log.Panicf("CreateObject: %v", err)
+			err = fmt.Errorf("CreateObject(%q): %v", k, err)
+			return
 		}
 	}
 
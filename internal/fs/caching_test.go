@@ -278,11 +278,13 @@ func (t *CachingTest) TypeOfNameChanges_RemoteModifier() {
 
 	AssertEq(nil, err)
 
-	// Because the file system is caching types, it will fail to find the name.
-	_, err = os.Stat(path.Join(t.Dir, name))
-	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+	// Although the file system is caching types, the directory's absence tells
+	// it that the cache is stale, so it should find the file.
+	fi, err = os.Stat(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+	ExpectFalse(fi.IsDir())
 
-	// After the TTL elapses, we should see it turn into a file.
+	// The same holds after the TTL elapses.
 	t.cacheClock.AdvanceTime(ttl + time.Millisecond)
 
 	fi, err = os.Stat(path.Join(t.Dir, name))
@@ -368,7 +370,7 @@ func (t *CachingWithImplicitDirsTest) SymlinksWork() {
 	AssertEq(nil, err)
 
 	ExpectEq("bar", fi.Name())
-	ExpectEq(0, fi.Size())
+	ExpectEq(len("foo"), fi.Size())
 	ExpectEq(filePerms|os.ModeSymlink, fi.Mode())
 
 	// Stat the target via the link.
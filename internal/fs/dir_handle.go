@@ -41,19 +41,36 @@ type dirHandle struct {
 
 	Mu syncutil.InvariantMutex
 
-	// All entries in the directory. Populated the first time we need one.
+	// The entries read from the directory so far, in the order in which they
+	// were returned. The directory's listing is read a batch at a time, as
+	// entries beyond those already read are asked for.
 	//
 	// INVARIANT: For each i, entries[i+1].Offset == entries[i].Offset + 1
 	//
 	// GUARDED_BY(Mu)
 	entries []fuseutil.Dirent
 
-	// Has entries yet been populated?
+	// Entries for files and symlinks that have been read but not yet added to
+	// entries, because an entry for a directory of the same name may yet be
+	// read. See addEntries.
 	//
-	// INVARIANT: If !entriesValid, then len(entries) == 0
+	// INVARIANT: If done, then len(pending) == 0
 	//
 	// GUARDED_BY(Mu)
-	entriesValid bool
+	pending []fuseutil.Dirent
+
+	// The greatest object name, relative to the directory, that the listing
+	// has reached.
+	//
+	// GUARDED_BY(Mu)
+	listed string
+
+	// The continuation token with which to read the next batch of entries, and
+	// whether the last batch has been read.
+	//
+	// GUARDED_BY(Mu)
+	tok  string
+	done bool
 }
 
 // Create a directory handle that obtains listings from the supplied inode.
@@ -95,146 +112,116 @@ func (dh *dirHandle) checkInvariants() {
 		}
 	}
 
-	// INVARIANT: If !entriesValid, then len(entries) == 0
-	if !dh.entriesValid && len(dh.entries) != 0 {
-		panic("Unexpected non-empty entries slice")
+	// INVARIANT: If done, then len(pending) == 0
+	if dh.done && len(dh.pending) != 0 {
+		panic("Unexpected pending entries after the last batch")
 	}
 }
 
-// Resolve name conflicts between file objects and directory objects (e.g. the
-// objects "foo/bar" and "foo/bar/") by appending U+000A, which is illegal in
-// GCS object names, to conflicting file names.
+// Forget everything read so far, so that the listing starts over.
 //
-// Input must be sorted by name.
-func fixConflictingNames(entries []fuseutil.Dirent) (err error) {
-	// Sanity check.
-	if !sort.IsSorted(sortedDirents(entries)) {
-		err = fmt.Errorf("Expected sorted input")
-		return
-	}
-
-	// Examine each adjacent pair of names.
-	for i, _ := range entries {
-		e := &entries[i]
-
-		// Find the previous entry.
-		if i == 0 {
-			continue
-		}
-
-		prev := &entries[i-1]
-
-		// Does the pair have matching names?
-		if e.Name != prev.Name {
-			continue
-		}
-
-		// We expect exactly one to be a directory.
-		eIsDir := e.Type == fuseutil.DT_Directory
-		prevIsDir := prev.Type == fuseutil.DT_Directory
-
-		if eIsDir == prevIsDir {
-			err = fmt.Errorf(
-				"Weird dirent type pair for name %q: %v, %v",
-				e.Name,
-				e.Type,
-				prev.Type)
-
-			return
-		}
-
-		// Repair whichever is not the directory.
-		if eIsDir {
-			prev.Name += inode.ConflictingFileNameSuffix
-		} else {
-			e.Name += inode.ConflictingFileNameSuffix
-		}
-	}
-
-	return
+// LOCKS_REQUIRED(dh.Mu)
+func (dh *dirHandle) reset() {
+	dh.entries = nil
+	dh.pending = nil
+	dh.listed = ""
+	dh.tok = ""
+	dh.done = false
 }
 
-// Read all entries for the directory, fix up conflicting names, and fill in
-// offset fields.
+// Add a batch of entries, which the listing returned after those in earlier
+// batches, to those read so far.
 //
-// LOCKS_REQUIRED(in)
-func readAllEntries(
-	ctx context.Context,
-	in inode.DirInode) (entries []fuseutil.Dirent, err error) {
-	// Read one batch at a time.
-	var tok string
-	for {
-		// Read a batch.
-		var batch []fuseutil.Dirent
-
-		batch, tok, err = in.ReadEntries(ctx, tok)
-		if err != nil {
-			err = fmt.Errorf("ReadEntries: %v", err)
-			return
+// The listing is ordered by object name, and a directory's object name ends
+// with a slash, so the entries for a file and a directory of the same name
+// (e.g. the objects "foo/bar" and "foo/bar/") may arrive in different
+// batches. Entries for files are therefore held back until the listing has
+// passed the directory's place. Name conflicts are resolved by appending
+// U+000A, which is illegal in GCS object names, to the file's name.
+//
+// LOCKS_REQUIRED(dh.Mu)
+func (dh *dirHandle) addEntries(batch []fuseutil.Dirent) {
+	// Sort the batch into directories, which are ready to be returned, and
+	// files, noting how far the listing has got.
+	dirs := make(map[string]bool)
+	var ready []fuseutil.Dirent
+	var files []fuseutil.Dirent
+
+	for _, e := range batch {
+		objectName := e.Name
+		if e.Type == fuseutil.DT_Directory {
+			objectName += "/"
+			dirs[e.Name] = true
+			ready = append(ready, e)
+		} else {
+			files = append(files, e)
 		}
 
-		// Accumulate.
-		entries = append(entries, batch...)
-
-		// Are we done?
-		if tok == "" {
-			break
+		if objectName > dh.listed {
+			dh.listed = objectName
 		}
 	}
 
-	// Ensure that the entries are sorted, for use in fixConflictingNames
-	// below.
-	sort.Sort(sortedDirents(entries))
+	// A file held back from an earlier batch may conflict with a directory in
+	// this one, and no later one.
+	files = append(dh.pending, files...)
+	dh.pending = nil
 
-	// Fix name conflicts.
-	err = fixConflictingNames(entries)
-	if err != nil {
-		err = fmt.Errorf("fixConflictingNames: %v", err)
-		return
-	}
+	for _, e := range files {
+		switch {
+		case dirs[e.Name]:
+			e.Name += inode.ConflictingFileNameSuffix
+			ready = append(ready, e)
 
-	// Fix up offset fields.
-	for i := 0; i < len(entries); i++ {
-		entries[i].Offset = fuseops.DirOffset(i) + 1
-	}
+		case dh.done || e.Name+"/" <= dh.listed:
+			ready = append(ready, e)
 
-	// Return a bogus inode ID for each entry, but not the root inode ID.
-	//
-	// NOTE(jacobsa): As far as I can tell this is harmless. Minting and
-	// returning a real inode ID is difficult because fuse does not count
-	// readdir as an operation that increases the inode ID's lookup count and
-	// we therefore don't get a forget for it later, but we would like to not
-	// have to remember every inode ID that we've ever minted for readdir.
-	//
-	// If it turns out this is not harmless, we'll need to switch to something
-	// like inode IDs based on (object name, generation) hashes. But then what
-	// about the birthday problem? And more importantly, what about our
-	// semantic of not minting a new inode ID when the generation changes due
-	// to a local action?
-	for i, _ := range entries {
-		entries[i].Inode = fuseops.RootInodeID + 1
+		default:
+			dh.pending = append(dh.pending, e)
+		}
 	}
 
-	return
+	// Return the entries that are ready in order of name, filling in offsets.
+	sort.Sort(sortedDirents(ready))
+	for _, e := range ready {
+		e.Offset = fuseops.DirOffset(len(dh.entries)) + 1
+
+		// Return a bogus inode ID for each entry, but not the root inode ID.
+		//
+		// NOTE(jacobsa): As far as I can tell this is harmless. Minting and
+		// returning a real inode ID is difficult because fuse does not count
+		// readdir as an operation that increases the inode ID's lookup count and
+		// we therefore don't get a forget for it later, but we would like to not
+		// have to remember every inode ID that we've ever minted for readdir.
+		//
+		// If it turns out this is not harmless, we'll need to switch to
+		// something like inode IDs based on (object name, generation) hashes.
+		// But then what about the birthday problem? And more importantly, what
+		// about our semantic of not minting a new inode ID when the generation
+		// changes due to a local action?
+		e.Inode = fuseops.RootInodeID + 1
+
+		dh.entries = append(dh.entries, e)
+	}
 }
 
+// Read the next batch of entries from the directory.
+//
 // LOCKS_REQUIRED(dh.Mu)
 // LOCKS_EXCLUDED(dh.in)
-func (dh *dirHandle) ensureEntries(ctx context.Context) (err error) {
+func (dh *dirHandle) readBatch(ctx context.Context) (err error) {
 	dh.in.Lock()
-	defer dh.in.Unlock()
+	batch, tok, err := dh.in.ReadEntries(ctx, dh.tok)
+	dh.in.Unlock()
 
-	// Read entries.
-	var entries []fuseutil.Dirent
-	entries, err = readAllEntries(ctx, dh.in)
 	if err != nil {
-		err = fmt.Errorf("readAllEntries: %v", err)
+		err = fmt.Errorf("ReadEntries: %v", err)
 		return
 	}
 
-	// Update state.
-	dh.entries = entries
-	dh.entriesValid = true
+	dh.tok = tok
+	dh.done = tok == ""
+	dh.addEntries(batch)
 
 	return
 }
@@ -244,6 +231,9 @@ func (dh *dirHandle) ensureEntries(ctx context.Context) (err error) {
 ////////////////////////////////////////////////////////////////////////
 
 // ReadDir handles a request to read from the directory, without responding.
+// Entries are read from GCS a batch at a time, only as far as needed to
+// answer the request, so that the first entries of a large directory are
+// returned without waiting for the rest.
 //
 // Special case: we assume that a zero offset indicates that rewinddir has been
 // called (since fuse gives us no way to intercept and know for sure), and
@@ -257,13 +247,15 @@ func (dh *dirHandle) ReadDir(
 	// If the request is for offset zero, we assume that either this is the first
 	// call or rewinddir has been called. Reset state.
 	if op.Offset == 0 {
-		dh.entries = nil
-		dh.entriesValid = false
+		dh.reset()
 	}
 
-	// Do we need to read entries from GCS?
-	if !dh.entriesValid {
-		err = dh.ensureEntries(ctx)
+	// Read from GCS until we have an entry at the offset or there are no more.
+	// A batch may leave us with no new entries, if it holds only files held
+	// back until the next one.
+	index := int(op.Offset)
+	for index >= len(dh.entries) && !dh.done {
+		err = dh.readBatch(ctx)
 		if err != nil {
 			return
 		}
@@ -271,7 +263,6 @@ func (dh *dirHandle) ReadDir(
 
 	// Is the offset past the end of what we have buffered? If so, this must be
 	// an invalid seekdir according to posix.
-	index := int(op.Offset)
 	if index > len(dh.entries) {
 		err = fuse.EINVAL
 		return
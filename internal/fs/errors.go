@@ -0,0 +1,236 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// How often to repeat the same hint in the log.
+const hintLogInterval = time.Minute
+
+// A wrapper around a file system whose bucket was wrapped with
+// gcsx.NewDiagnosingBucket. For ops that fail with an error that would
+// otherwise be reported to the kernel as EIO, return a more specific errno if
+// a GCS request made by the op failed in a way we can diagnose, and log a hint
+// about how to fix it.
+//
+// Ops that don't talk to GCS are passed through untouched.
+type errorMappingFileSystem struct {
+	fuseutil.FileSystem
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// The last time each hint was logged.
+	//
+	// GUARDED_BY(mu)
+	hintsLogged map[string]time.Time
+}
+
+func newErrorMappingFileSystem(
+	wrapped fuseutil.FileSystem,
+	clock timeutil.Clock) (fs *errorMappingFileSystem) {
+	fs = &errorMappingFileSystem{
+		FileSystem:  wrapped,
+		clock:       clock,
+		hintsLogged: make(map[string]time.Time),
+	}
+
+	return
+}
+
+// Run f with a context that records diagnoses, translating its error if
+// appropriate.
+func (fs *errorMappingFileSystem) run(
+	ctx context.Context,
+	f func(ctx context.Context) error) (err error) {
+	ctx, last := gcsx.WithDiagnosisRecorder(ctx)
+	err = f(ctx)
+
+	// Leave alone errors that already carry an errno, such as ENOENT.
+	if _, ok := err.(syscall.Errno); ok || err == nil {
+		return
+	}
+
+	d := last()
+	if d == nil {
+		return
+	}
+
+	fs.logHint(d.Hint, err)
+	err = d.Errno
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *errorMappingFileSystem) logHint(hint string, err error) {
+	now := fs.clock.Now()
+
+	fs.mu.Lock()
+	last, ok := fs.hintsLogged[hint]
+	if ok && now.Sub(last) < hintLogInterval {
+		fs.mu.Unlock()
+		return
+	}
+
+	fs.hintsLogged[hint] = now
+	fs.mu.Unlock()
+
+	logger.Warningf("%s (%v)", hint, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// fuseutil.FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *errorMappingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.LookUpInode(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.GetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.SetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.MkDir(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.MkNode(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.CreateFile(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.CreateSymlink(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.Rename(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.RmDir(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.Unlink(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.ReadDir(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.ReadFile(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.WriteFile(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.SyncFile(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.FlushFile(ctx, op)
+	})
+}
+
+func (fs *errorMappingFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.run(ctx, func(ctx context.Context) error {
+		return fs.FileSystem.ReadSymlink(ctx, op)
+	})
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// An adjustment to how the file system handles particular files.
+type FileAction string
+
+const (
+	// Read from GCS using several concurrent range requests ahead of the
+	// current position rather than a single stream. Suits large files read
+	// sequentially.
+	ParallelDownload FileAction = "parallel-download"
+
+	// Don't allow the kernel to cache the file's contents from open to open, or
+	// its attributes at all, so that changes made elsewhere are seen promptly.
+	NoCache FileAction = "no-cache"
+
+	// Write the file's contents to GCS after every write, rather than only when
+	// it is flushed or synced. This is expensive for anything but small files.
+	WriteThrough FileAction = "write-through"
+
+	// Store the file's contents in GCS gzip-compressed, with Content-Encoding
+	// set, trading CPU for storage and egress. Suits text such as logs and CSV.
+	Compress FileAction = "compress"
+)
+
+// A rule applying an action to the files whose names match a pattern.
+type FileRule struct {
+	// A pattern in the syntax of path.Match. If it contains a slash it is
+	// matched against the file's full path relative to the root of the file
+	// system; otherwise against the file's base name.
+	Pattern string
+
+	Action FileAction
+}
+
+// Validate returns an error if the rule's pattern is malformed or its action
+// unknown.
+func (r FileRule) Validate() (err error) {
+	if _, err = path.Match(r.Pattern, ""); err != nil {
+		err = fmt.Errorf("Bad pattern %q: %v", r.Pattern, err)
+		return
+	}
+
+	switch r.Action {
+	case ParallelDownload, NoCache, WriteThrough, Compress:
+	default:
+		err = fmt.Errorf("Unknown action %q for pattern %q", r.Action, r.Pattern)
+		return
+	}
+
+	return
+}
+
+func (r FileRule) matches(name string) bool {
+	if !strings.Contains(r.Pattern, "/") {
+		name = path.Base(name)
+	}
+
+	ok, _ := path.Match(r.Pattern, name)
+	return ok
+}
+
+// The combined effect of the rules matching a particular file.
+type fileHandling struct {
+	parallelDownload bool
+	noCache          bool
+	writeThrough     bool
+	compress         bool
+}
+
+// Find the combined effect of the supplied rules on the file with the given
+// name, relative to the root of the file system.
+func handlingFor(rules []FileRule, name string) (h fileHandling) {
+	for _, r := range rules {
+		if !r.matches(name) {
+			continue
+		}
+
+		switch r.Action {
+		case ParallelDownload:
+			h.parallelDownload = true
+
+		case NoCache:
+			h.noCache = true
+
+		case WriteThrough:
+			h.writeThrough = true
+
+		case Compress:
+			h.compress = true
+		}
+	}
+
+	return
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FileRulesTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&FileRulesTest{}) }
+
+func (t *FileRulesTest) SetUp(ti *TestInfo) {
+	t.serverCfg.FileRules = []fs.FileRule{
+		{Pattern: "*.db", Action: fs.WriteThrough},
+		{Pattern: "big/*", Action: fs.ParallelDownload},
+		{Pattern: "*.log", Action: fs.NoCache},
+		{Pattern: "*.csv", Action: fs.Compress},
+	}
+
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileRulesTest) WriteThrough() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.Dir, "foo.db"))
+	AssertEq(nil, err)
+
+	// Each write should show up in the bucket without closing the file.
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+	ExpectEq("taco", t.readObject("foo.db"))
+
+	_, err = t.f1.Write([]byte("burrito"))
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", t.readObject("foo.db"))
+}
+
+func (t *FileRulesTest) NoWriteThroughForOtherFiles() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.Dir, "foo.txt"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// The write shouldn't be visible until the file is closed.
+	ExpectEq("", t.readObject("foo.txt"))
+
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readObject("foo.txt"))
+}
+
+func (t *FileRulesTest) ParallelDownload() {
+	var err error
+
+	// Create a large object in the bucket, and its parent directory.
+	contents := bytes.Repeat([]byte("0123456789"), 3<<20)
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "big/foo", contents)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "big/", []byte{})
+	AssertEq(nil, err)
+
+	// Reading it through the file system should yield the same contents.
+	actual, err := ioutil.ReadFile(path.Join(t.Dir, "big/foo"))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents, actual))
+}
+
+func (t *FileRulesTest) NoCache() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo.log", []byte("taco"))
+	AssertEq(nil, err)
+
+	// The file should be readable as usual.
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo.log"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	fi, err := os.Stat(path.Join(t.Dir, "foo.log"))
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), fi.Size())
+}
+
+func (t *FileRulesTest) Compress() {
+	var err error
+	contents := strings.Repeat("taco,burrito\n", 1000)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo.csv"), []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	// The object should be compressed.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo.csv"})
+	AssertEq(nil, err)
+	ExpectEq("gzip", o.ContentEncoding)
+	ExpectLt(o.Size, len(contents))
+
+	// But look normal through the file system.
+	fi, err := os.Stat(path.Join(t.Dir, "foo.csv"))
+	AssertEq(nil, err)
+	ExpectEq(len(contents), fi.Size())
+
+	actual, err := ioutil.ReadFile(path.Join(t.Dir, "foo.csv"))
+	AssertEq(nil, err)
+	ExpectEq(contents, string(actual))
+}
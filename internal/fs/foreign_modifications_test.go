@@ -889,7 +889,7 @@ func (t *ForeignModsTest) Symlink() {
 	AssertEq(nil, err)
 
 	ExpectEq("foo", fi.Name())
-	ExpectEq(0, fi.Size())
+	ExpectEq(len("bar/baz"), fi.Size())
 	ExpectEq(filePerms|os.ModeSymlink, fi.Mode())
 
 	// Read the link.
@@ -18,14 +18,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
@@ -47,6 +50,19 @@ type ServerConfig struct {
 	// use the system default.
 	TempDir string
 
+	// If non-nil, a journal in which to keep the local contents of files
+	// instead, so that modifications survive a crash. See gcsx.Journal.
+	Journal *gcsx.Journal
+
+	// If non-nil and there is no journal, the local contents of files are
+	// kept in memory while it has room, and in TempDir after that.
+	MemoryStaging *gcsx.MemoryStaging
+
+	// If set, new contents written sequentially from the start of a file are
+	// streamed to GCS as they are written, rather than kept locally until the
+	// file is flushed. See gcsx.StreamingUpload.
+	StreamingWrites bool
+
 	// By default, if a bucket contains the object "foo/bar" but no object named
 	// "foo/", it's as if the directory doesn't exist. This allows us to have
 	// non-flaky name resolution code.
@@ -75,10 +91,14 @@ type ServerConfig struct {
 	// information about whether that name exists as a file and/or directory.
 	// This may speed up calls to look up and stat inodes, especially when
 	// combined with a stat-caching GCS bucket, but comes at the cost of
-	// consistency: if the child is removed and recreated with a different type
-	// before the expiration, we may fail to find it.
+	// consistency: if a directory is created beside a file of the same name
+	// before the expiration, we may keep finding the file.
 	DirTypeCacheTTL time.Duration
 
+	// The number of names each directory's type cache may hold. Zero means
+	// DefaultDirTypeCacheCapacity.
+	DirTypeCacheCapacity int
+
 	// The UID and GID that owns all inodes in the file system.
 	Uid uint32
 	Gid uint32
@@ -88,6 +108,11 @@ type ServerConfig struct {
 	FilePerms os.FileMode
 	DirPerms  os.FileMode
 
+	// If set, chmod and chown of a file record its permission bits, owner, and
+	// group in its object's metadata, and files with such metadata report it
+	// in place of the values above.
+	PreservePosixMetadata bool
+
 	// Files backed by on object of length at least AppendThreshold that have
 	// only been appended to (i.e. none of the object's contents have been
 	// dirtied) will be written out by "appending" to the object in GCS with this
@@ -106,10 +131,171 @@ type ServerConfig struct {
 	// periodically garbage collected.
 	AppendThreshold int64
 	TmpObjectPrefix string
+
+	// If non-zero, files at least ParallelUploadThreshold bytes long that
+	// can't be appended as above are written out as up to ParallelUploadParts
+	// temporary objects uploaded concurrently, which are then composed over the
+	// original object and deleted. Temporary objects are named as above.
+	ParallelUploadThreshold int64
+	ParallelUploadParts     int
+
+	// If non-zero, closing a dirty file doesn't write out its contents.
+	// Instead it is written out in the background once it has waited this long
+	// (as measured by CacheClock), or sooner when it is synced, renamed, or
+	// forgotten by the kernel, or when the file system is unmounted. Closing a
+	// file writes it out right away if files waiting would otherwise hold more
+	// than WriteBackMaxDirtyBytes. Ignored if Leases is set, since a file's
+	// lease is given up once it is closed.
+	WriteBackDelay         time.Duration
+	WriteBackMaxDirtyBytes int64
+
+	// If set, closing a dirty file doesn't wait for its contents to be written
+	// out. It is written out in the background as soon as possible instead,
+	// subject to WriteBackMaxDirtyBytes as above. Ignored if Leases is set.
+	AsyncClose bool
+
+	// If set, syncing a file doesn't write out its contents, which are written
+	// out when it is closed instead.
+	LazySync bool
+
+	// If set, syncing a file through a handle that hasn't been used to write to
+	// it does nothing, even if the file has been written through another.
+	SkipUnmodifiedSync bool
+
+	// What to do when writing out a file whose contents turn out to be the
+	// same as its object's.
+	UnchangedContent gcsx.UnchangedContentPolicy
+
+	// Rules adjusting the handling of files whose names match patterns. When
+	// several rules match a file, all of their actions apply.
+	FileRules []FileRule
+
+	// MIME types for new objects, keyed by lower-cased file extension, taking
+	// precedence over the system's guesses, and rules choosing their
+	// Cache-Control. See gcsx.NewContentTypeBucket.
+	ContentTypes map[string]string
+	CacheControl []gcsx.CacheControlRule
+
+	// If non-zero, objects at least this many bytes long are downloaded with
+	// several concurrent range requests rather than a single stream, as are
+	// files matched by a parallel-download rule whatever their size. The chunk
+	// size and parallelism used default to those in package handle if zero.
+	ParallelDownloadThreshold   uint64
+	ParallelDownloadChunkSize   int64
+	ParallelDownloadParallelism int
+
+	// Whether files downloaded in parallel and read in full are checked
+	// against their objects' CRC32C. Other reads are checked by the bucket, if
+	// at all.
+	VerifyCRC32C bool
+
+	// If non-zero, files not downloaded in parallel are read ahead by this many
+	// bytes, fetched in the background, once ReadAheadTrigger reads in a row
+	// through a handle have each continued from the last.
+	ReadAheadWindow  int64
+	ReadAheadTrigger int
+
+	// If non-nil, ranges of files not downloaded in parallel that are fetched
+	// by random reads are kept here, and later reads of them served from it.
+	RangeCache *gcsx.RangeCache
+
+	// If non-nil, the budget from which parallel downloads and reading ahead
+	// reserve their buffers. MemoryStaging should share it.
+	MemoryBudget *gcsx.MemoryBudget
+
+	// If non-zero, inodes used least recently beyond this many have the state
+	// they cache, such as clean copies of file contents, discarded.
+	MaxCachedInodes int
+
+	// If non-zero, file handles read from least recently beyond this many have
+	// their readers from GCS closed, to be reopened if they are read again.
+	MaxOpenReaders int
+
+	// If non-zero, the kernel may cache the entries of directories and answer
+	// directory reads from the cache for up to this long. Entries are
+	// discarded sooner when a directory is modified through the file system.
+	KernelListCacheTTL time.Duration
+
+	// The Unicode normalization form for the names of files, directories, and
+	// symlinks created through the file system. Lookups try this form first,
+	// then the name as given, then the other form.
+	NameForm NameForm
+
+	// If non-nil, files are leased from it before they are created, written,
+	// or truncated, failing with EBUSY if another client holds the lease. The
+	// lease is released when the last handle to the file is closed, and all
+	// leases are released when the file system is destroyed. The caller is
+	// responsible for renewing them.
+	Leases *gcsx.LeaseManager
+
+	// If non-nil, the bucket has a hierarchical namespace whose folders back
+	// the directories of the file system, and directories are renamed
+	// atomically by renaming folders.
+	Folders gcsx.Folders
+
+	// If non-zero and the bucket has no folders, directories containing up to
+	// this many objects are renamed by copying each object and then deleting
+	// the originals. Renaming a larger directory fails with EXDEV. If zero,
+	// renaming a directory fails with ENOSYS.
+	RenameDirLimit int
+
+	// If non-empty, the contents of an .icns file that the Finder shows as the
+	// icon of the volume on macOS.
+	VolumeIcon []byte
+}
+
+// A fuse.Server that additionally allows the caller to inspect and act on the
+// state of the file system it serves.
+type Server interface {
+	fuse.Server
+
+	// Return the names of files that hold local modifications not yet written
+	// out to GCS, e.g. because they are open for writing or because an earlier
+	// flush or write-back failed. Unmounting while this is non-empty loses
+	// those writes.
+	DirtyFiles() (names []string)
+
+	// Attempt to write out each file returned by DirtyFiles, returning an error
+	// naming the files that could not be written.
+	SyncDirtyFiles(ctx context.Context) (err error)
+
+	// Return the internal state of the inodes for the given path relative to
+	// the root of the file system, for debugging. Only inodes currently known
+	// to the kernel are reported.
+	Inspect(ctx context.Context, path string) (infos []InodeInfo)
+
+	// Return the file handles currently open, e.g. so that the user can decide
+	// whether it's safe to unmount.
+	OpenFiles() (files []OpenFileInfo)
+
+	// Return counters describing the ops served since mounting, and the ops
+	// still in flight.
+	Stats() (s Stats)
+
+	// Change the cache TTLs first given by the config. Directories already
+	// known to the kernel keep caching types for the TTL they began with.
+	SetCacheTTLs(ttls CacheTTLs)
+
+	// Forget what the file system has cached about the object with the given
+	// name, relative to the root of the file system, which has been changed
+	// elsewhere. Caches in the bucket and the kernel are left alone.
+	Invalidate(name string)
+}
+
+// Cache TTLs that may be changed while the file system is mounted. See the
+// ServerConfig fields of the same names.
+type CacheTTLs struct {
+	InodeAttributeCacheTTL time.Duration
+	DirTypeCacheTTL        time.Duration
+	KernelListCacheTTL     time.Duration
 }
 
+// The number of names each directory's type cache holds if
+// ServerConfig.DirTypeCacheCapacity isn't set.
+const DefaultDirTypeCacheCapacity = 1 << 15
+
 // Create a fuse file system server according to the supplied configuration.
-func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
+func NewServer(cfg *ServerConfig) (s Server, err error) {
 	// Check permissions bits.
 	if cfg.FilePerms&^os.ModePerm != 0 {
 		err = fmt.Errorf("Illegal file perms: %v", cfg.FilePerms)
@@ -121,8 +307,44 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 		return
 	}
 
-	// Set up a bucket that infers content types when creating files.
-	bucket := gcsx.NewContentTypeBucket(cfg.Bucket)
+	// Set up a bucket that infers content types when creating files, and that
+	// records diagnoses for failures so that errorMappingFileSystem can report
+	// them.
+	bucket := gcsx.NewDiagnosingBucket(cfg.Bucket)
+
+	// Compress the files selected by the file rules, if any.
+	for _, r := range cfg.FileRules {
+		if r.Action == Compress {
+			bucket = gcsx.NewCompressingBucket(
+				func(name string) bool {
+					return handlingFor(cfg.FileRules, name).compress
+				},
+				cfg.TempDir,
+				bucket)
+
+			break
+		}
+	}
+
+	bucket = gcsx.NewContentTypeBucket(
+		cfg.ContentTypes,
+		cfg.CacheControl,
+		bucket)
+
+	for _, r := range cfg.FileRules {
+		if err = r.Validate(); err != nil {
+			err = fmt.Errorf("Illegal file rule: %v", err)
+			return
+		}
+	}
+
+	if err = cfg.NameForm.Validate(); err != nil {
+		return
+	}
+
+	if err = cfg.UnchangedContent.Validate(); err != nil {
+		return
+	}
 
 	// Create the object syncer.
 	if cfg.TmpObjectPrefix == "" {
@@ -132,19 +354,90 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 
 	syncer := gcsx.NewSyncer(
 		cfg.AppendThreshold,
+		cfg.ParallelUploadThreshold,
+		cfg.ParallelUploadParts,
+		cfg.UnchangedContent,
 		cfg.TmpObjectPrefix,
 		bucket)
 
+	if cfg.ParallelDownloadChunkSize < 0 || cfg.ParallelDownloadParallelism < 0 {
+		err = fmt.Errorf(
+			"Illegal parallel download settings: %d, %d",
+			cfg.ParallelDownloadChunkSize,
+			cfg.ParallelDownloadParallelism)
+		return
+	}
+
+	// Settle on how to download in parallel.
+	ruleDownloads := &handle.ParallelDownloads{
+		ChunkSize:   cfg.ParallelDownloadChunkSize,
+		Parallelism: cfg.ParallelDownloadParallelism,
+		Verify:      cfg.VerifyCRC32C,
+	}
+
+	if ruleDownloads.ChunkSize == 0 {
+		ruleDownloads.ChunkSize = handle.DefaultParallelDownloadChunkSize
+	}
+
+	if ruleDownloads.Parallelism == 0 {
+		ruleDownloads.Parallelism = handle.DefaultParallelDownloadParallelism
+	}
+
+	var readAhead *handle.ReadAhead
+	if cfg.ReadAheadWindow != 0 {
+		readAhead = &handle.ReadAhead{
+			Window:  cfg.ReadAheadWindow,
+			Trigger: cfg.ReadAheadTrigger,
+		}
+	}
+
+	var largeDownloads *handle.ParallelDownloads
+	if cfg.ParallelDownloadThreshold != 0 {
+		largeDownloads = &handle.ParallelDownloads{
+			MinObjectSize: cfg.ParallelDownloadThreshold,
+			ChunkSize:     ruleDownloads.ChunkSize,
+			Parallelism:   ruleDownloads.Parallelism,
+			Verify:        ruleDownloads.Verify,
+		}
+	}
+
+	typeCacheCapacity := cfg.DirTypeCacheCapacity
+	if typeCacheCapacity == 0 {
+		typeCacheCapacity = DefaultDirTypeCacheCapacity
+	}
+
 	// Set up the basic struct.
 	fs := &fileSystem{
-		mtimeClock:             timeutil.RealClock(),
-		cacheClock:             cfg.CacheClock,
-		bucket:                 bucket,
-		syncer:                 syncer,
-		tempDir:                cfg.TempDir,
-		implicitDirs:           cfg.ImplicitDirectories,
-		inodeAttributeCacheTTL: cfg.InodeAttributeCacheTTL,
-		dirTypeCacheTTL:        cfg.DirTypeCacheTTL,
+		mtimeClock:            timeutil.RealClock(),
+		cacheClock:            cfg.CacheClock,
+		bucket:                bucket,
+		syncer:                syncer,
+		tempDir:               cfg.TempDir,
+		journal:               cfg.Journal,
+		memoryStaging:         cfg.MemoryStaging,
+		streamingWrites:       cfg.StreamingWrites,
+		preservePosixMetadata: cfg.PreservePosixMetadata,
+		implicitDirs:          cfg.ImplicitDirectories,
+		typeCacheCapacity:     typeCacheCapacity,
+		ttls: CacheTTLs{
+			InodeAttributeCacheTTL: cfg.InodeAttributeCacheTTL,
+			DirTypeCacheTTL:        cfg.DirTypeCacheTTL,
+			KernelListCacheTTL:     cfg.KernelListCacheTTL,
+		},
+		fileRules:              cfg.FileRules,
+		ruleDownloads:          ruleDownloads,
+		largeDownloads:         largeDownloads,
+		readAhead:              readAhead,
+		rangeCache:             cfg.RangeCache,
+		memoryBudget:           cfg.MemoryBudget,
+		maxCachedInodes:        cfg.MaxCachedInodes,
+		maxOpenReaders:         cfg.MaxOpenReaders,
+		nameForm:               cfg.NameForm,
+		leases:                 cfg.Leases,
+		folders:                cfg.Folders,
+		renameDirLimit:         cfg.RenameDirLimit,
+		lazySync:               cfg.LazySync,
+		skipUnmodifiedSync:     cfg.SkipUnmodifiedSync,
 		uid:                    cfg.Uid,
 		gid:                    cfg.Gid,
 		fileMode:               cfg.FilePerms,
@@ -154,6 +447,8 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 		generationBackedInodes: make(map[string]inode.GenerationBackedInode),
 		implicitDirInodes:      make(map[string]inode.DirInode),
 		handles:                make(map[fuseops.HandleID]interface{}),
+		inodeLRU:               newTrimList(),
+		readerLRU:              newTrimList(),
 	}
 
 	// Set up the root inode.
@@ -171,7 +466,8 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 			Mtime: fs.mtimeClock.Now(),
 		},
 		fs.implicitDirs,
-		fs.dirTypeCacheTTL,
+		cfg.DirTypeCacheTTL,
+		fs.typeCacheCapacity,
 		fs.bucket,
 		fs.mtimeClock,
 		fs.cacheClock)
@@ -190,7 +486,149 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 	gcCtx, fs.stopGarbageCollecting = context.WithCancel(context.Background())
 	go garbageCollect(gcCtx, cfg.TmpObjectPrefix, fs.bucket)
 
-	server = fuseutil.NewFileSystemServer(fs)
+	// Trim inodes and handles beyond the limits, if any, in the background.
+	var trimCtx context.Context
+	trimCtx, fs.stopTrimming = context.WithCancel(context.Background())
+	go fs.trimPeriodically(trimCtx)
+
+	// Write back closed files in the background if enabled. Closing
+	// asynchronously is the same thing with no delay.
+	if (cfg.WriteBackDelay > 0 || cfg.AsyncClose) && cfg.Leases == nil {
+		fs.writeBackQueue = newWriteBackQueue(
+			cfg.WriteBackDelay,
+			cfg.WriteBackMaxDirtyBytes,
+			cfg.CacheClock)
+
+		var wbCtx context.Context
+		wbCtx, fs.stopWritingBack = context.WithCancel(context.Background())
+		go fs.writeBackPeriodically(wbCtx)
+	}
+
+	var wrapped fuseutil.FileSystem = newErrorMappingFileSystem(
+		fs,
+		timeutil.RealClock())
+
+	if len(cfg.VolumeIcon) != 0 {
+		wrapped = newVolumeIconFileSystem(
+			wrapped,
+			cfg.VolumeIcon,
+			fs.uid,
+			fs.gid,
+			fs.mtimeClock.Now())
+	}
+
+	recorder := newOpRecordingFileSystem(wrapped, timeutil.RealClock())
+
+	stats := newStatsFileSystem(recorder, timeutil.RealClock())
+
+	s = &server{
+		Server:   fuseutil.NewFileSystemServer(stats),
+		fs:       fs,
+		recorder: recorder,
+		stats:    stats,
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// server type
+////////////////////////////////////////////////////////////////////////
+
+type server struct {
+	fuse.Server
+	fs       *fileSystem
+	recorder *opRecordingFileSystem
+	stats    *statsFileSystem
+}
+
+// LOCKS_EXCLUDED(s.fs.mu)
+func (s *server) DirtyFiles() (names []string) {
+	for _, f := range s.fs.fileInodes() {
+		f.Lock()
+		if f.Dirty() {
+			names = append(names, f.Name())
+		}
+		f.Unlock()
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(s.fs.mu)
+func (s *server) SyncDirtyFiles(ctx context.Context) (err error) {
+	var failed []string
+	for _, f := range s.fs.fileInodes() {
+		f.Lock()
+		if f.Dirty() {
+			syncErr := s.fs.writeOut(ctx, f)
+			if syncErr != nil {
+				logger.Errorf("Writing out %q: %v", f.Name(), syncErr)
+				failed = append(failed, f.Name())
+			}
+		}
+		f.Unlock()
+	}
+
+	if len(failed) != 0 {
+		err = fmt.Errorf("Failed to write out %d file(s): %q", len(failed), failed)
+		return
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(s.fs.ttlMu)
+func (s *server) SetCacheTTLs(ttls CacheTTLs) {
+	s.fs.ttlMu.Lock()
+	defer s.fs.ttlMu.Unlock()
+
+	s.fs.ttls = ttls
+}
+
+// LOCKS_EXCLUDED(s.fs.mu)
+func (s *server) Invalidate(name string) {
+	s.fs.invalidate(name)
+}
+
+// LOCKS_EXCLUDED(s.fs.mu)
+func (s *server) OpenFiles() (files []OpenFileInfo) {
+	files = s.fs.openFiles()
+	return
+}
+
+// LOCKS_EXCLUDED(s.fs.mu)
+func (s *server) Stats() (stats Stats) {
+	stats = s.stats.Stats(func(id fuseops.InodeID) (name string, ok bool) {
+		s.fs.mu.Lock()
+		defer s.fs.mu.Unlock()
+
+		in, ok := s.fs.inodes[id]
+		if ok {
+			name = in.Name()
+		}
+
+		return
+	})
+
+	stats.DirtyFiles = len(s.DirtyFiles())
+
+	s.fs.mu.Lock()
+	stats.Inodes = len(s.fs.inodes)
+	stats.Handles = len(s.fs.handles)
+	s.fs.mu.Unlock()
+	return
+}
+
+// LOCKS_EXCLUDED(s.fs.mu)
+func (s *server) Inspect(
+	ctx context.Context,
+	path string) (infos []InodeInfo) {
+	infos = s.fs.inspect(ctx, path)
+	for i := range infos {
+		infos[i].RecentOps = s.recorder.RecentOps(infos[i].ID)
+	}
+
 	return
 }
 
@@ -236,10 +674,44 @@ type fileSystem struct {
 	// Constant data
 	/////////////////////////
 
-	tempDir                string
-	implicitDirs           bool
-	inodeAttributeCacheTTL time.Duration
-	dirTypeCacheTTL        time.Duration
+	tempDir               string
+	journal               *gcsx.Journal
+	memoryStaging         *gcsx.MemoryStaging
+	streamingWrites       bool
+	preservePosixMetadata bool
+	implicitDirs          bool
+	typeCacheCapacity     int
+	fileRules             []FileRule
+	nameForm              NameForm
+	leases                *gcsx.LeaseManager
+	folders               gcsx.Folders
+	renameDirLimit        int
+
+	// Whether syncing a file leaves its contents to be written out when it is
+	// closed, and whether syncing through a handle that hasn't written does
+	// nothing.
+	lazySync           bool
+	skipUnmodifiedSync bool
+
+	// How to download files matched by a parallel-download rule, and other
+	// files (nil if they're never downloaded in parallel).
+	ruleDownloads  *handle.ParallelDownloads
+	largeDownloads *handle.ParallelDownloads
+
+	// How to read ahead of sequential reads of files not downloaded in
+	// parallel, or nil if they aren't.
+	readAhead *handle.ReadAhead
+
+	// Where to cache ranges fetched by random reads, or nil if they aren't.
+	rangeCache *gcsx.RangeCache
+
+	// The budget for read buffers, or nil if there's no limit.
+	memoryBudget *gcsx.MemoryBudget
+
+	// The numbers of inodes and file handles kept in full beyond which those
+	// used least recently are trimmed. Zero means no limit.
+	maxCachedInodes int
+	maxOpenReaders  int
 
 	// The user and group owning everything in the file system.
 	uid uint32
@@ -252,10 +724,26 @@ type fileSystem struct {
 	// A function that shuts down the garbage collector.
 	stopGarbageCollecting func()
 
+	// A function that stops trimming inodes and handles.
+	stopTrimming func()
+
+	// Files closed while dirty whose contents are yet to be written out, and a
+	// function that stops writing them out in the background. Nil if write-back
+	// is disabled.
+	writeBackQueue  *writeBackQueue
+	stopWritingBack func()
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
+	// A lock protecting the cache TTLs, which may be changed by
+	// Server.SetCacheTTLs. No other lock is acquired while holding it.
+	ttlMu sync.Mutex
+
+	// GUARDED_BY(ttlMu)
+	ttls CacheTTLs
+
 	// A lock protecting the state of the file system struct itself (distinct
 	// from per-inode locks). Make sure to see the notes on lock ordering above.
 	mu syncutil.InvariantMutex
@@ -337,6 +825,13 @@ type fileSystem struct {
 	//
 	// GUARDED_BY(mu)
 	nextHandleID fuseops.HandleID
+
+	// The IDs of inodes and file handles in order of last use, from which those
+	// to trim are chosen.
+	//
+	// GUARDED_BY(mu)
+	inodeLRU  *trimList
+	readerLRU *trimList
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -489,9 +984,65 @@ func (fs *fileSystem) checkInvariants() {
 	}
 }
 
+// Return a snapshot of all file inodes currently known to the file system,
+// including those the kernel has forgotten that are kept until they can be
+// written back. The caller must lock each before inspecting it, and must be
+// prepared for inodes that have since been destroyed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) fileInodes() (files []*inode.FileInode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, in := range fs.inodes {
+		if f, ok := in.(*inode.FileInode); ok {
+			files = append(files, f)
+		}
+	}
+
+	if fs.writeBackQueue != nil {
+		files = append(files, fs.writeBackQueue.Orphans()...)
+	}
+
+	return
+}
+
+// Make the directory inode containing the object with the given name, if
+// known, forget what it has cached about it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) invalidate(name string) {
+	trimmed := strings.TrimSuffix(name, "/")
+	i := strings.LastIndex(trimmed, "/")
+	parent, child := trimmed[:i+1], trimmed[i+1:]
+
+	fs.mu.Lock()
+	d, ok := fs.implicitDirInodes[parent]
+	if !ok {
+		d, ok = fs.generationBackedInodes[parent].(inode.DirInode)
+	}
+	fs.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	d.Lock()
+	d.ForgetChild(child)
+	d.Unlock()
+}
+
 // Implementation detail of lookUpOrCreateInodeIfNotStale; do not use outside
 // of that function.
 //
+// LOCKS_EXCLUDED(fs.ttlMu)
+func (fs *fileSystem) cacheTTLs() CacheTTLs {
+	fs.ttlMu.Lock()
+	defer fs.ttlMu.Unlock()
+
+	return fs.ttls
+}
+
 // LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 	// Choose an ID.
@@ -516,7 +1067,8 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mtime: fs.mtimeClock.Now(),
 			},
 			fs.implicitDirs,
-			fs.dirTypeCacheTTL,
+			fs.cacheTTLs().DirTypeCacheTTL,
+			fs.typeCacheCapacity,
 			fs.bucket,
 			fs.mtimeClock,
 			fs.cacheClock)
@@ -537,7 +1089,8 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mtime: fs.mtimeClock.Now(),
 			},
 			fs.implicitDirs,
-			fs.dirTypeCacheTTL,
+			fs.cacheTTLs().DirTypeCacheTTL,
+			fs.typeCacheCapacity,
 			fs.bucket,
 			fs.mtimeClock,
 			fs.cacheClock)
@@ -564,11 +1117,16 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 			fs.bucket,
 			fs.syncer,
 			fs.tempDir,
+			fs.journal,
+			fs.memoryStaging,
+			fs.streamingWrites,
+			fs.preservePosixMetadata,
 			fs.mtimeClock)
 	}
 
 	// Place it in our map of IDs to inodes.
 	fs.inodes[in.ID()] = in
+	fs.inodeLRU.Touch(in.ID())
 
 	return
 }
@@ -599,6 +1157,7 @@ func (fs *fileSystem) lookUpOrCreateInodeIfNotStale(
 	defer func() {
 		if in != nil {
 			in.IncrementLookupCount()
+			fs.inodeLRU.Touch(in.ID())
 		}
 
 		fs.mu.Unlock()
@@ -744,6 +1303,47 @@ func (fs *fileSystem) lookUpOrCreateChildInode(
 	return
 }
 
+// Like lookUpOrCreateChildInode, but try each name under which a child given
+// the supplied name may be stored (see NameForm.candidates), returning the
+// one found.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(parent)
+// LOCK_FUNCTION(child)
+func (fs *fileSystem) lookUpOrCreateChildInodeInAnyForm(
+	ctx context.Context,
+	parent inode.DirInode,
+	name string) (childName string, child inode.Inode, err error) {
+	for _, childName = range fs.nameForm.candidates(name) {
+		child, err = fs.lookUpOrCreateChildInode(ctx, parent, childName)
+		if err != fuse.ENOENT {
+			return
+		}
+	}
+
+	return
+}
+
+// Find a lookup result for the child stored under the first of the candidate
+// names for the supplied name that exists. If none do, return a result that
+// doesn't exist along with the name as given.
+//
+// LOCKS_REQUIRED(parent)
+func (fs *fileSystem) lookUpChildInAnyForm(
+	ctx context.Context,
+	parent inode.DirInode,
+	name string) (childName string, r inode.LookUpResult, err error) {
+	for _, childName = range fs.nameForm.candidates(name) {
+		r, err = parent.LookUpChild(ctx, childName)
+		if err != nil || r.Exists() {
+			return
+		}
+	}
+
+	childName = name
+	return
+}
+
 // Synchronize the supplied file inode to GCS, updating the index as
 // appropriate.
 //
@@ -759,6 +1359,11 @@ func (fs *fileSystem) syncFile(
 		return
 	}
 
+	// It no longer needs writing back.
+	if fs.writeBackQueue != nil {
+		fs.writeBackQueue.Remove(f)
+	}
+
 	// We need not update fileIndex:
 	//
 	// We've held the inode lock the whole time, so there's no way that this
@@ -772,6 +1377,32 @@ func (fs *fileSystem) syncFile(
 	return
 }
 
+// Lease the object with the given name for writing, if leases are enabled,
+// failing with EBUSY if another client holds it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) acquireLease(
+	ctx context.Context,
+	name string) (err error) {
+	if fs.leases == nil {
+		return
+	}
+
+	err = fs.leases.Acquire(ctx, name)
+	if held, ok := err.(*gcsx.LeaseHeldError); ok {
+		logger.Warningf("Refusing to write: %v", held)
+		err = syscall.EBUSY
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Acquire: %v", err)
+		return
+	}
+
+	return
+}
+
 // Decrement the supplied inode's lookup count, destroying it if the inode says
 // that it has hit zero.
 //
@@ -792,6 +1423,7 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 	// below.
 	if shouldDestroy {
 		delete(fs.inodes, in.ID())
+		fs.inodeLRU.Remove(in.ID())
 
 		// Update indexes if necessary.
 		if fs.generationBackedInodes[name] == in {
@@ -806,17 +1438,83 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 	// We are done with the file system.
 	fs.mu.Unlock()
 
-	// Now we can destroy the inode if necessary.
+	// Now we can destroy the inode if necessary, first writing out any contents
+	// waiting to be written back. If that fails the inode is kept, holding the
+	// only copy of those contents.
 	if shouldDestroy {
-		destroyErr := in.Destroy()
-		if destroyErr != nil {
-			log.Printf("Error destroying inode %q: %v", name, destroyErr)
+		var kept bool
+		if f, ok := in.(*inode.FileInode); ok {
+			kept = fs.writeBackBeforeDestroying(f)
+		}
+
+		if !kept {
+			destroyErr := in.Destroy()
+			if destroyErr != nil {
+				logger.Errorf("Error destroying inode %q: %v", name, destroyErr)
+			}
 		}
 	}
 
 	in.Unlock()
 }
 
+// Write out the supplied file if it is waiting to be written back, as it is
+// about to be destroyed. If that fails the file stays in the queue as an
+// orphan, to be tried again and destroyed once written out, and kept is set
+// to tell the caller not to destroy it. Errors are logged, since there is
+// nobody to return them to.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_REQUIRED(f)
+func (fs *fileSystem) writeBackBeforeDestroying(
+	f *inode.FileInode) (kept bool) {
+	if fs.writeBackQueue == nil || !fs.writeBackQueue.Contains(f) {
+		return
+	}
+
+	err := fs.syncFile(context.Background(), f)
+	if err == nil {
+		return
+	}
+
+	logger.Errorf("Writing back %q: %v; keeping it to try again", f.Name(), err)
+	fs.writeBackQueue.Orphan(f)
+	kept = true
+
+	return
+}
+
+// Write out the file backed by the named object if it is waiting to be
+// written back, reporting whether it was.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) writeBackNamed(
+	ctx context.Context,
+	name string) (wrote bool, err error) {
+	if fs.writeBackQueue == nil {
+		return
+	}
+
+	fs.mu.Lock()
+	f, ok := fs.generationBackedInodes[name].(*inode.FileInode)
+	fs.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if !fs.writeBackQueue.Contains(f) {
+		return
+	}
+
+	err = fs.syncFile(ctx, f)
+	wrote = true
+	return
+}
+
 // A helper function for use after incrementing an inode's lookup count.
 // Ensures that the lookup count is decremented again if the caller is going to
 // return in error (in which case the kernel and gcsfuse would otherwise
@@ -853,6 +1551,23 @@ func (fs *fileSystem) unlockAndMaybeDisposeOfInode(
 	fs.unlockAndDecrementLookupCount(in, 1)
 }
 
+// Find how the supplied inode should be handled according to the file rules.
+// Its name is fixed, so no lock is required.
+func (fs *fileSystem) handlingFor(in inode.Inode) fileHandling {
+	return handlingFor(fs.fileRules, in.Name())
+}
+
+// Find how handles for the supplied file should download its contents in
+// parallel, if at all. No lock is required.
+func (fs *fileSystem) parallelDownloadsFor(
+	in inode.Inode) *handle.ParallelDownloads {
+	if fs.handlingFor(in).parallelDownload {
+		return fs.ruleDownloads
+	}
+
+	return fs.largeDownloads
+}
+
 // Fetch attributes for the supplied inode and fill in an appropriate
 // expiration time for them.
 //
@@ -869,9 +1584,14 @@ func (fs *fileSystem) getAttributes(
 		return
 	}
 
-	// Set up the expiration time.
-	if fs.inodeAttributeCacheTTL > 0 {
-		expiration = time.Now().Add(fs.inodeAttributeCacheTTL)
+	// Set up the expiration time, unless the kernel mustn't cache the
+	// attributes at all.
+	if _, ok := in.(*inode.FileInode); ok && fs.handlingFor(in).noCache {
+		return
+	}
+
+	if ttl := fs.cacheTTLs().InodeAttributeCacheTTL; ttl > 0 {
+		expiration = time.Now().Add(ttl)
 	}
 
 	return
@@ -887,6 +1607,7 @@ func (fs *fileSystem) inodeOrDie(id fuseops.InodeID) (in inode.Inode) {
 		panic(fmt.Sprintf("inode %d doesn't exist", id))
 	}
 
+	fs.inodeLRU.Touch(id)
 	return
 }
 
@@ -901,6 +1622,7 @@ func (fs *fileSystem) dirInodeOrDie(id fuseops.InodeID) (in inode.DirInode) {
 		panic(fmt.Sprintf("inode %d is %T, wanted inode.DirInode", id, tmp))
 	}
 
+	fs.inodeLRU.Touch(id)
 	return
 }
 
@@ -915,6 +1637,7 @@ func (fs *fileSystem) fileInodeOrDie(id fuseops.InodeID) (in *inode.FileInode) {
 		panic(fmt.Sprintf("inode %d is %T, wanted *inode.FileInode", id, tmp))
 	}
 
+	fs.inodeLRU.Touch(id)
 	return
 }
 
@@ -930,6 +1653,7 @@ func (fs *fileSystem) symlinkInodeOrDie(
 		panic(fmt.Sprintf("inode %d is %T, wanted *inode.SymlinkInode", id, tmp))
 	}
 
+	fs.inodeLRU.Touch(id)
 	return
 }
 
@@ -939,6 +1663,25 @@ func (fs *fileSystem) symlinkInodeOrDie(
 
 func (fs *fileSystem) Destroy() {
 	fs.stopGarbageCollecting()
+	fs.stopTrimming()
+
+	// Write out everything still waiting to be written back. Files that can't
+	// be are kept, and reported by Server.DirtyFiles for the caller to deal
+	// with after unmounting.
+	if fs.writeBackQueue != nil {
+		fs.stopWritingBack()
+		if failed := fs.writeBack(context.Background(), true); failed != 0 {
+			logger.Errorf(
+				"Failed to write back %d file(s) before unmounting",
+				failed)
+		}
+	}
+
+	if fs.leases != nil {
+		if err := fs.leases.ReleaseAll(context.Background()); err != nil {
+			logger.Warningf("Releasing leases: %v", err)
+		}
+	}
 }
 
 func (fs *fileSystem) StatFS(
@@ -973,7 +1716,7 @@ func (fs *fileSystem) LookUpInode(
 	fs.mu.Unlock()
 
 	// Find or create the child inode.
-	child, err := fs.lookUpOrCreateChildInode(ctx, parent, op.Name)
+	_, child, err := fs.lookUpOrCreateChildInodeInAnyForm(ctx, parent, op.Name)
 	if err != nil {
 		return
 	}
@@ -1022,9 +1765,18 @@ func (fs *fileSystem) SetInodeAttributes(
 	in := fs.inodeOrDie(op.Inode)
 	fs.mu.Unlock()
 
+	file, isFile := in.(*inode.FileInode)
+
+	// Truncating is writing, so requires the lease.
+	if isFile && op.Size != nil {
+		err = fs.acquireLease(ctx, file.Name())
+		if err != nil {
+			return
+		}
+	}
+
 	in.Lock()
 	defer in.Unlock()
-	file, isFile := in.(*inode.FileInode)
 
 	// Set file mtimes.
 	if isFile && op.Mtime != nil {
@@ -1044,7 +1796,18 @@ func (fs *fileSystem) SetInodeAttributes(
 		}
 	}
 
-	// We silently ignore updates to mode and atime.
+	// Record file modes and owners, if we're asked to.
+	if isFile &&
+		fs.preservePosixMetadata &&
+		(op.Mode != nil || op.Uid != nil || op.Gid != nil) {
+		err = file.SetPosixAttributes(ctx, op.Mode, op.Uid, op.Gid)
+		if err != nil {
+			err = fmt.Errorf("SetPosixAttributes: %v", err)
+			return
+		}
+	}
+
+	// We silently ignore updates to atime, and to mode and ownership otherwise.
 
 	// Fill in the response.
 	op.Attributes, op.AttributesExpiration, err = fs.getAttributes(ctx, in)
@@ -1087,7 +1850,7 @@ func (fs *fileSystem) MkDir(
 	// Create an empty backing object for the child, failing if it already
 	// exists.
 	parent.Lock()
-	o, err := parent.CreateChildDir(ctx, op.Name)
+	o, err := parent.CreateChildDir(ctx, fs.nameForm.normalize(op.Name))
 	parent.Unlock()
 
 	// Special case: *gcs.PreconditionError means the name already exists.
@@ -1132,7 +1895,11 @@ func (fs *fileSystem) MkNode(
 	ctx context.Context,
 	op *fuseops.MkNodeOp) (err error) {
 	// Create the child.
-	child, err := fs.createFile(ctx, op.Parent, op.Name, op.Mode)
+	child, err := fs.createFile(
+		ctx,
+		op.Parent,
+		fs.nameForm.normalize(op.Name),
+		op.Mode)
 	if err != nil {
 		return
 	}
@@ -1202,9 +1969,26 @@ func (fs *fileSystem) createFile(
 func (fs *fileSystem) CreateFile(
 	ctx context.Context,
 	op *fuseops.CreateFileOp) (err error) {
+	name := fs.nameForm.normalize(op.Name)
+
+	// Lease the file before creating it, so that nobody else can be writing it
+	// by the time it appears.
+	fs.mu.Lock()
+	leaseName := fs.dirInodeOrDie(op.Parent).Name() + name
+	fs.mu.Unlock()
+
+	err = fs.acquireLease(ctx, leaseName)
+	if err != nil {
+		return
+	}
+
 	// Create the child.
-	child, err := fs.createFile(ctx, op.Parent, op.Name, op.Mode)
+	child, err := fs.createFile(ctx, op.Parent, name, op.Mode)
 	if err != nil {
+		if fs.leases != nil {
+			fs.leases.Release(ctx, leaseName)
+		}
+
 		return
 	}
 
@@ -1218,7 +2002,12 @@ func (fs *fileSystem) CreateFile(
 
 	fs.handles[handleID] = handle.NewFileHandle(
 		child.(*inode.FileInode),
-		fs.bucket)
+		fs.bucket,
+		fs.parallelDownloadsFor(child),
+		fs.readAhead,
+		fs.rangeCache,
+		fs.memoryBudget,
+		fs.mtimeClock.Now())
 	op.Handle = handleID
 
 	fs.mu.Unlock()
@@ -1247,7 +2036,10 @@ func (fs *fileSystem) CreateSymlink(
 
 	// Create the object in GCS, failing if it already exists.
 	parent.Lock()
-	o, err := parent.CreateChildSymlink(ctx, op.Name, op.Target)
+	o, err := parent.CreateChildSymlink(
+		ctx,
+		fs.nameForm.normalize(op.Name),
+		op.Target)
 	parent.Unlock()
 
 	// Special case: *gcs.PreconditionError means the name already exists.
@@ -1297,7 +2089,11 @@ func (fs *fileSystem) RmDir(
 	fs.mu.Unlock()
 
 	// Find or create the child inode.
-	child, err := fs.lookUpOrCreateChildInode(ctx, parent, op.Name)
+	childName, child, err := fs.lookUpOrCreateChildInodeInAnyForm(
+		ctx,
+		parent,
+		op.Name)
+
 	if err != nil {
 		return
 	}
@@ -1357,7 +2153,7 @@ func (fs *fileSystem) RmDir(
 
 	// Delete the backing object.
 	parent.Lock()
-	err = parent.DeleteChildDir(ctx, op.Name)
+	err = parent.DeleteChildDir(ctx, childName)
 	parent.Unlock()
 
 	if err != nil {
@@ -1378,24 +2174,69 @@ func (fs *fileSystem) Rename(
 	newParent := fs.dirInodeOrDie(op.NewParent)
 	fs.mu.Unlock()
 
-	// Find the object in the old location.
-	oldParent.Lock()
-	lr, err := oldParent.LookUpChild(ctx, op.OldName)
-	oldParent.Unlock()
+	// Find the object in the old location. Renaming a file copies its object,
+	// so if the file's contents are waiting to be written back, write them out
+	// and look again.
+	var oldName string
+	var lr inode.LookUpResult
+	for attempt := 0; ; attempt++ {
+		oldParent.Lock()
+		oldName, lr, err = fs.lookUpChildInAnyForm(ctx, oldParent, op.OldName)
+		oldParent.Unlock()
 
-	if err != nil {
-		err = fmt.Errorf("LookUpChild: %v", err)
-		return
-	}
+		if err != nil {
+			err = fmt.Errorf("lookUpChildInAnyForm: %v", err)
+			return
+		}
 
-	if !lr.Exists() {
-		err = fuse.ENOENT
-		return
+		if !lr.Exists() {
+			err = fuse.ENOENT
+			return
+		}
+
+		if attempt > 0 {
+			break
+		}
+
+		var wrote bool
+		wrote, err = fs.writeBackNamed(ctx, lr.FullName)
+		if err != nil {
+			err = fmt.Errorf("writeBackNamed: %v", err)
+			return
+		}
+
+		if !wrote {
+			break
+		}
 	}
 
-	// We don't support renaming directories.
+	// Directories are renamed atomically if they are backed by folders, and
+	// otherwise object by object if renaming them is enabled.
 	if inode.IsDirName(lr.FullName) {
-		err = fuse.ENOSYS
+		dst := newParent.Name() + fs.nameForm.normalize(op.NewName) + "/"
+		switch {
+		case fs.folders != nil:
+			err = fs.renameFolder(ctx, lr.FullName, dst)
+
+		case fs.renameDirLimit > 0:
+			err = fs.renameDir(ctx, lr.FullName, dst)
+
+		default:
+			err = fuse.ENOSYS
+		}
+
+		if err != nil {
+			return
+		}
+
+		oldParent.Lock()
+		oldParent.InvalidateKernelListCache()
+		oldParent.Unlock()
+
+		newParent.Lock()
+		newParent.InvalidateKernelListCache()
+		newParent.Unlock()
+
 		return
 	}
 
@@ -1403,7 +2244,7 @@ func (fs *fileSystem) Rename(
 	newParent.Lock()
 	_, err = newParent.CloneToChildFile(
 		ctx,
-		op.NewName,
+		fs.nameForm.normalize(op.NewName),
 		lr.Object)
 	newParent.Unlock()
 
@@ -1417,7 +2258,7 @@ func (fs *fileSystem) Rename(
 	oldParent.Lock()
 	err = oldParent.DeleteChildFile(
 		ctx,
-		op.OldName,
+		oldName,
 		lr.Object.Generation,
 		&lr.Object.MetaGeneration)
 	oldParent.Unlock()
@@ -1430,6 +2271,145 @@ func (fs *fileSystem) Rename(
 	return
 }
 
+// Rename the folder src to dst, replacing dst if it is an empty folder.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) renameFolder(
+	ctx context.Context,
+	src string,
+	dst string) (err error) {
+	err = fs.folders.RenameFolder(ctx, src, dst)
+	if _, ok := err.(*gcs.PreconditionError); !ok {
+		if err != nil {
+			err = fmt.Errorf("RenameFolder: %v", err)
+		}
+
+		return
+	}
+
+	// The destination exists. Remove it if it's empty, as rename(2) requires,
+	// then try again.
+	err = fs.folders.DeleteFolder(ctx, dst)
+	switch err.(type) {
+	case nil:
+	case *gcs.PreconditionError:
+		err = fuse.ENOTEMPTY
+		return
+
+	default:
+		err = fmt.Errorf("DeleteFolder: %v", err)
+		return
+	}
+
+	err = fs.folders.RenameFolder(ctx, src, dst)
+	if err != nil {
+		err = fmt.Errorf("RenameFolder: %v", err)
+		return
+	}
+
+	return
+}
+
+// Rename the directory src to dst in a bucket without folders by copying each
+// object whose name begins with src, then deleting the originals. dst is
+// replaced if it is empty. Fail with EXDEV, which makes tools like mv fall
+// back to copying, if there are more than fs.renameDirLimit objects to copy.
+//
+// This is not atomic. If it fails part way through, some objects may exist
+// under both names.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) renameDir(
+	ctx context.Context,
+	src string,
+	dst string) (err error) {
+	// rename(2) replaces only empty directories.
+	listing, err := fs.bucket.ListObjects(
+		ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:     dst,
+			MaxResults: 2,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("ListObjects: %v", err)
+		return
+	}
+
+	for _, o := range listing.Objects {
+		if o.Name != dst {
+			err = fuse.ENOTEMPTY
+			return
+		}
+	}
+
+	// Find the objects to be renamed, giving up as soon as there are too many.
+	var objects []*gcs.Object
+	req := &gcs.ListObjectsRequest{Prefix: src}
+	for {
+		listing, err = fs.bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		objects = append(objects, listing.Objects...)
+		if len(objects) > fs.renameDirLimit {
+			err = syscall.EXDEV
+			return
+		}
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	// Copy everything before deleting anything, so that a failure can't lose
+	// data. Make sure to copy and delete exactly the generations we listed, in
+	// case an object is modified in the meantime.
+	for _, o := range objects {
+		_, err = fs.bucket.CopyObject(
+			ctx,
+			&gcs.CopyObjectRequest{
+				SrcName:                       o.Name,
+				DstName:                       dst + strings.TrimPrefix(o.Name, src),
+				SrcGeneration:                 o.Generation,
+				SrcMetaGenerationPrecondition: &o.MetaGeneration,
+			})
+
+		if err != nil {
+			err = fmt.Errorf("CopyObject: %v", err)
+			return
+		}
+	}
+
+	// Delete in reverse order, so that the backing objects of directories,
+	// which are listed before their contents, go last.
+	for i := len(objects) - 1; i >= 0; i-- {
+		o := objects[i]
+		err = fs.bucket.DeleteObject(
+			ctx,
+			&gcs.DeleteObjectRequest{
+				Name:                       o.Name,
+				Generation:                 o.Generation,
+				MetaGenerationPrecondition: &o.MetaGeneration,
+			})
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = nil
+		}
+
+		if err != nil {
+			err = fmt.Errorf("DeleteObject: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) Unlink(
 	ctx context.Context,
@@ -1442,10 +2422,20 @@ func (fs *fileSystem) Unlink(
 	parent.Lock()
 	defer parent.Unlock()
 
+	// Find the name under which the object is stored.
+	name := op.Name
+	if fs.nameForm != NameFormNone {
+		name, _, err = fs.lookUpChildInAnyForm(ctx, parent, op.Name)
+		if err != nil {
+			err = fmt.Errorf("lookUpChildInAnyForm: %v", err)
+			return
+		}
+	}
+
 	// Delete the backing object.
 	err = parent.DeleteChildFile(
 		ctx,
-		op.Name,
+		name,
 		0,   // Latest generation
 		nil) // No meta-generation precondition
 
@@ -1462,7 +2452,6 @@ func (fs *fileSystem) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) (err error) {
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
 
 	// Make sure the inode still exists and is a directory. If not, something has
 	// screwed up because the VFS layer shouldn't have let us forget the inode
@@ -1476,6 +2465,17 @@ func (fs *fileSystem) OpenDir(
 	fs.handles[handleID] = newDirHandle(in, fs.implicitDirs)
 	op.Handle = handleID
 
+	fs.mu.Unlock()
+
+	// Let the kernel cache the directory's entries, if enabled, keeping those
+	// it already has unless they have expired or the directory has changed.
+	if ttl := fs.cacheTTLs().KernelListCacheTTL; ttl > 0 {
+		in.Lock()
+		op.CacheDir = true
+		op.KeepCache = !in.ShouldInvalidateKernelListCache(ttl)
+		in.Unlock()
+	}
+
 	return
 }
 
@@ -1527,14 +2527,23 @@ func (fs *fileSystem) OpenFile(
 	handleID := fs.nextHandleID
 	fs.nextHandleID++
 
-	fs.handles[handleID] = handle.NewFileHandle(in, fs.bucket)
+	h := fs.handlingFor(in)
+	fs.handles[handleID] = handle.NewFileHandle(
+		in,
+		fs.bucket,
+		fs.parallelDownloadsFor(in),
+		fs.readAhead,
+		fs.rangeCache,
+		fs.memoryBudget,
+		fs.mtimeClock.Now())
+
 	op.Handle = handleID
 
 	// When we observe object generations that we didn't create, we assign them
 	// new inode IDs. So for a given inode, all modifications go through the
 	// kernel. Therefore it's safe to tell the kernel to keep the page cache from
-	// open to open for a given inode.
-	op.KeepPageCache = true
+	// open to open for a given inode, unless we've been asked not to.
+	op.KeepPageCache = !h.noCache
 
 	return
 }
@@ -1546,6 +2555,7 @@ func (fs *fileSystem) ReadFile(
 	// Find the handle and lock it.
 	fs.mu.Lock()
 	fh := fs.handles[op.Handle].(*handle.FileHandle)
+	fs.readerLRU.Touch(op.Handle)
 	fs.mu.Unlock()
 
 	fh.Lock()
@@ -1559,6 +2569,12 @@ func (fs *fileSystem) ReadFile(
 		err = nil
 	}
 
+	// If the generation the handle reads from has been overwritten or deleted
+	// by another client, its content is gone; say so rather than return EIO.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = syscall.ESTALE
+	}
+
 	return
 }
 
@@ -1584,16 +2600,39 @@ func (fs *fileSystem) ReadSymlink(
 func (fs *fileSystem) WriteFile(
 	ctx context.Context,
 	op *fuseops.WriteFileOp) (err error) {
-	// Find the inode.
+	// Find the inode and the handle.
 	fs.mu.Lock()
 	in := fs.fileInodeOrDie(op.Inode)
+	fh, _ := fs.handles[op.Handle].(*handle.FileHandle)
 	fs.mu.Unlock()
 
+	// Record that the handle is being used for writing, for OpenFiles. The
+	// kernel may send writes without a handle, e.g. when writing back dirty
+	// pages.
+	if fh != nil {
+		fh.Lock()
+		fh.MarkWritten()
+		fh.Unlock()
+	}
+
+	err = fs.acquireLease(ctx, in.Name())
+	if err != nil {
+		return
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
 	// Serve the request.
 	err = in.Write(ctx, op.Data, op.Offset)
+	if err != nil {
+		return
+	}
+
+	// Write the contents out now if we've been asked to.
+	if fs.handlingFor(in).writeThrough {
+		err = fs.syncFile(ctx, in)
+	}
 
 	return
 }
@@ -1602,11 +2641,29 @@ func (fs *fileSystem) WriteFile(
 func (fs *fileSystem) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
-	// Find the inode.
+	// Find the inode and the handle.
 	fs.mu.Lock()
 	in := fs.fileInodeOrDie(op.Inode)
+	fh, _ := fs.handles[op.Handle].(*handle.FileHandle)
 	fs.mu.Unlock()
 
+	// Leave the contents to be written out on close if we've been asked to.
+	if fs.lazySync {
+		return
+	}
+
+	// Likewise if the handle hasn't been used to write and we've been asked to
+	// ignore such handles.
+	if fs.skipUnmodifiedSync && fh != nil {
+		fh.Lock()
+		written := fh.Written()
+		fh.Unlock()
+
+		if !written {
+			return
+		}
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
@@ -1628,6 +2685,14 @@ func (fs *fileSystem) FlushFile(
 	in.Lock()
 	defer in.Unlock()
 
+	// In write-back mode, leave the contents to be written out later, unless
+	// too much is waiting already.
+	if fs.writeBackQueue != nil && in.Dirty() {
+		if !fs.writeBackQueue.Add(in) {
+			return
+		}
+	}
+
 	// Sync it.
 	err = fs.syncFile(ctx, in)
 
@@ -1639,13 +2704,41 @@ func (fs *fileSystem) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) (err error) {
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
 
 	// Destroy the handle.
-	fs.handles[op.Handle].(*handle.FileHandle).Destroy()
+	fh := fs.handles[op.Handle].(*handle.FileHandle)
+	fh.Destroy()
 
 	// Update the map.
 	delete(fs.handles, op.Handle)
+	fs.readerLRU.Remove(op.Handle)
+
+	// Give up the file's lease once its last handle is closed. The kernel
+	// flushes the file before releasing the handle, so its contents have been
+	// written out unless that failed.
+	var leaseName string
+	if fs.leases != nil && !fs.hasFileHandles(fh.Inode()) {
+		leaseName = fh.Inode().Name()
+	}
+
+	fs.mu.Unlock()
+
+	if leaseName != "" {
+		err = fs.leases.Release(ctx, leaseName)
+	}
 
 	return
 }
+
+// Does any open file handle refer to the supplied inode?
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) hasFileHandles(in *inode.FileInode) bool {
+	for _, h := range fs.handles {
+		if fh, ok := h.(*handle.FileHandle); ok && fh.Inode() == in {
+			return true
+		}
+	}
+
+	return false
+}
@@ -24,6 +24,7 @@ import (
 	"os"
 	"os/signal"
 	"os/user"
+	"path"
 	"strconv"
 	"strings"
 	"testing"
@@ -82,8 +83,9 @@ type fsTest struct {
 	bucket     gcs.Bucket
 
 	// Mount information
-	mfs *fuse.MountedFileSystem
-	Dir string
+	server fs.Server
+	mfs    *fuse.MountedFileSystem
+	Dir    string
 
 	// Files to close when tearing down. Nil entries are skipped.
 	f1 *os.File
@@ -126,7 +128,7 @@ func (t *fsTest) SetUp(ti *TestInfo) {
 	AssertEq(nil, err)
 
 	// Create a file system server.
-	server, err := fs.NewServer(&t.serverCfg)
+	t.server, err = fs.NewServer(&t.serverCfg)
 	AssertEq(nil, err)
 
 	// Mount the file system.
@@ -142,7 +144,7 @@ func (t *fsTest) SetUp(ti *TestInfo) {
 		mountCfg.DebugLogger = log.New(os.Stderr, "fuse: ", loggingFlags)
 	}
 
-	t.mfs, err = fuse.Mount(t.Dir, server, &mountCfg)
+	t.mfs, err = fuse.Mount(t.Dir, t.server, &mountCfg)
 	AssertEq(nil, err)
 }
 
@@ -207,6 +209,37 @@ func (t *fsTest) createEmptyObjects(names []string) error {
 	return err
 }
 
+func (t *fsTest) readObject(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+// Create the named file with the supplied contents, closing it.
+func (t *fsTest) writeAndClose(name string, contents string) {
+	f, err := os.Create(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte(contents))
+	AssertEq(nil, err)
+
+	AssertEq(nil, f.Close())
+}
+
+// Wait a while for the named object to have the supplied contents, returning
+// whatever it has in the end.
+func (t *fsTest) waitForObject(name string, contents string) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		actual := t.readObject(name)
+		if actual == contents || time.Now().After(deadline) {
+			return actual
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Common helpers
 ////////////////////////////////////////////////////////////////////////
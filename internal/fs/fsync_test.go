@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Lazy sync
+////////////////////////////////////////////////////////////////////////
+
+type LazySyncTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&LazySyncTest{}) }
+
+func (t *LazySyncTest) SetUp(ti *TestInfo) {
+	t.serverCfg.LazySync = true
+	t.fsTest.SetUp(ti)
+}
+
+func (t *LazySyncTest) SyncDoesntWriteOut() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	AssertEq(nil, t.f1.Sync())
+	ExpectEq("", t.readObject("foo"))
+
+	// Closing writes it out.
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readObject("foo"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Skipping sync of unmodified handles
+////////////////////////////////////////////////////////////////////////
+
+type SkipUnmodifiedSyncTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&SkipUnmodifiedSyncTest{}) }
+
+func (t *SkipUnmodifiedSyncTest) SetUp(ti *TestInfo) {
+	t.serverCfg.SkipUnmodifiedSync = true
+	t.fsTest.SetUp(ti)
+}
+
+func (t *SkipUnmodifiedSyncTest) SyncThroughOtherHandle() {
+	var err error
+
+	// Write through one handle.
+	t.f1, err = os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// Syncing through another does nothing.
+	t.f2, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	AssertEq(nil, t.f2.Sync())
+	ExpectEq("", t.readObject("foo"))
+
+	// Syncing through the first writes it out.
+	AssertEq(nil, t.f1.Sync())
+	ExpectEq("taco", t.readObject("foo"))
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A randomized test that hammers the file system with a mix of concurrent
+// operations on a small set of names, in order to flush out races and lock
+// ordering problems that only show up under production concurrency. It is
+// most useful when run under the race detector:
+//
+//     go test -race ./internal/fs -ogletest.run=FuzzTest --fuzz_duration=1m
+//
+// A failing run can be replayed (modulo scheduling) with --fuzz_seed.
+
+package fs_test
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/syncutil"
+)
+
+var fFuzzDuration = flag.Duration(
+	"fuzz_duration",
+	2*time.Second,
+	"How long FuzzTest should issue operations for.")
+
+var fFuzzSeed = flag.Int64(
+	"fuzz_seed",
+	0,
+	"Random seed for FuzzTest. If zero, one is chosen from the time.")
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// The errors that a well-behaved file system may legitimately return when
+// operations on the same names race with each other. Anything else (or a
+// panic, data race, invariant violation, or hang) is a bug.
+var expectedFuzzErrors = map[syscall.Errno]bool{
+	syscall.ENOENT:    true,
+	syscall.EEXIST:    true,
+	syscall.ENOTEMPTY: true,
+	syscall.ENOTDIR:   true,
+	syscall.EISDIR:    true,
+
+	// We don't support renaming directories, and the kernel refuses to move a
+	// directory beneath itself.
+	syscall.ENOSYS: true,
+	syscall.EINVAL: true,
+}
+
+// Return the errno underlying a *os.PathError, *os.LinkError, or
+// *os.SyscallError, if any.
+func errno(err error) (e syscall.Errno, ok bool) {
+	switch typed := err.(type) {
+	case *os.PathError:
+		err = typed.Err
+	case *os.LinkError:
+		err = typed.Err
+	case *os.SyscallError:
+		err = typed.Err
+	}
+
+	e, ok = err.(syscall.Errno)
+	return
+}
+
+// A single randomized operation against the file system. The supplied id is
+// unique across all calls, and may be used as file contents.
+type fuzzOp func(r *rand.Rand, id string) (err error)
+
+////////////////////////////////////////////////////////////////////////
+// Fuzzing
+////////////////////////////////////////////////////////////////////////
+
+type FuzzTest struct {
+	fsTest
+
+	// The names that operations choose from, relative to the mount point. Kept
+	// small so that operations frequently collide.
+	names []string
+}
+
+func init() { RegisterTestSuite(&FuzzTest{}) }
+
+func (t *FuzzTest) SetUp(ti *TestInfo) {
+	t.fsTest.SetUp(ti)
+
+	for _, d := range []string{"", "dir0", "dir1", "dir0/sub"} {
+		for _, f := range []string{"a", "b", "c"} {
+			t.names = append(t.names, path.Join(d, f))
+		}
+
+		if d != "" {
+			t.names = append(t.names, d)
+		}
+	}
+}
+
+func (t *FuzzTest) randomName(r *rand.Rand) string {
+	return path.Join(t.Dir, t.names[r.Intn(len(t.names))])
+}
+
+// The set of operations issued by the fuzzer. Each is chosen with equal
+// probability.
+func (t *FuzzTest) ops() (ops []fuzzOp) {
+	ops = []fuzzOp{
+		// Look up and stat.
+		func(r *rand.Rand, id string) (err error) {
+			_, err = os.Lstat(t.randomName(r))
+			return
+		},
+
+		// Create or overwrite a file.
+		func(r *rand.Rand, id string) (err error) {
+			err = ioutil.WriteFile(t.randomName(r), []byte(id), 0600)
+			return
+		},
+
+		// Append to a file.
+		func(r *rand.Rand, id string) (err error) {
+			f, err := os.OpenFile(t.randomName(r), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return
+			}
+
+			_, err = f.Write([]byte(id))
+			closeErr := f.Close()
+			if err == nil {
+				err = closeErr
+			}
+
+			return
+		},
+
+		// Truncate a file.
+		func(r *rand.Rand, id string) (err error) {
+			err = os.Truncate(t.randomName(r), r.Int63n(16))
+			return
+		},
+
+		// Read a file.
+		func(r *rand.Rand, id string) (err error) {
+			_, err = ioutil.ReadFile(t.randomName(r))
+			return
+		},
+
+		// Rename.
+		func(r *rand.Rand, id string) (err error) {
+			err = os.Rename(t.randomName(r), t.randomName(r))
+			return
+		},
+
+		// Unlink a file.
+		func(r *rand.Rand, id string) (err error) {
+			err = syscall.Unlink(t.randomName(r))
+			return
+		},
+
+		// Make a directory.
+		func(r *rand.Rand, id string) (err error) {
+			err = os.Mkdir(t.randomName(r), 0700)
+			return
+		},
+
+		// Remove a directory.
+		func(r *rand.Rand, id string) (err error) {
+			err = syscall.Rmdir(t.randomName(r))
+			return
+		},
+
+		// List a directory.
+		func(r *rand.Rand, id string) (err error) {
+			_, err = ioutil.ReadDir(t.randomName(r))
+			return
+		},
+
+		// Make a symlink.
+		func(r *rand.Rand, id string) (err error) {
+			err = os.Symlink(id, t.randomName(r))
+			return
+		},
+	}
+
+	return
+}
+
+// Issue random operations until the deadline, returning the first unexpected
+// error.
+func (t *FuzzTest) worker(
+	seed int64,
+	worker int,
+	deadline time.Time) (err error) {
+	r := rand.New(rand.NewSource(seed + int64(worker)))
+	ops := t.ops()
+
+	for i := 0; time.Now().Before(deadline); i++ {
+		id := fmt.Sprintf("w%d-%d", worker, i)
+		opErr := ops[r.Intn(len(ops))](r, id)
+		if opErr == nil {
+			continue
+		}
+
+		if e, ok := errno(opErr); ok && expectedFuzzErrors[e] {
+			continue
+		}
+
+		err = fmt.Errorf("Worker %d, op %s: %v", worker, id, opErr)
+		return
+	}
+
+	return
+}
+
+// Walk the file system, checking that everything listed can be looked up and
+// read.
+func (t *FuzzTest) checkTree(dir string) (err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	for _, fi := range entries {
+		p := path.Join(dir, fi.Name())
+
+		switch {
+		case fi.IsDir():
+			err = t.checkTree(p)
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			_, err = os.Readlink(p)
+
+		default:
+			_, err = ioutil.ReadFile(p)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (t *FuzzTest) ConcurrentOperations() {
+	// Ensure that we get parallelism for this test.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(runtime.NumCPU()))
+
+	seed := *fFuzzSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	// Run the workers.
+	const numWorkers = 16
+	deadline := time.Now().Add(*fFuzzDuration)
+
+	b := syncutil.NewBundle(t.ctx)
+	for i := 0; i < numWorkers; i++ {
+		i := i
+		b.Add(func(ctx context.Context) (err error) {
+			err = t.worker(seed, i, deadline)
+			return
+		})
+	}
+
+	// Wait for them, treating a failure to finish as a deadlock.
+	done := make(chan error, 1)
+	go func() { done <- b.Join() }()
+
+	const slack = 30 * time.Second
+	select {
+	case err := <-done:
+		AssertEq(nil, err, "Seed: %d", seed)
+
+	case <-time.After(*fFuzzDuration + slack):
+		pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+		AddFailure("Workers still running %v after deadline; seed: %d", slack, seed)
+		AbortTest()
+	}
+
+	// Once quiescent, the file system should be self-consistent.
+	err := t.checkTree(t.Dir)
+	ExpectEq(nil, err, "Seed: %d", seed)
+}
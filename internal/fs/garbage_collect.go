@@ -16,7 +16,6 @@ package fs
 
 import (
 	"fmt"
-	"log"
 	"sync/atomic"
 	"time"
 
@@ -25,6 +24,8 @@ import (
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/jacobsa/syncutil"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
 )
 
 func garbageCollectOnce(
@@ -111,20 +112,20 @@ func garbageCollect(
 		case <-ticker.C:
 		}
 
-		log.Println("Starting a garbage collection run.")
+		logger.Infof("Starting a garbage collection run.")
 
 		startTime := time.Now()
 		objectsDeleted, err := garbageCollectOnce(ctx, tmpObjectPrefix, bucket)
 
 		if err != nil {
-			log.Printf(
+			logger.Errorf(
 				"Garbage collection failed after deleting %d objects in %v, "+
 					"with error: %v",
 				objectsDeleted,
 				time.Since(startTime),
 				err)
 		} else {
-			log.Printf(
+			logger.Infof(
 				"Garbage collection succeeded after deleted %d objects in %v.",
 				objectsDeleted,
 				time.Since(startTime))
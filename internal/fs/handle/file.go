@@ -17,6 +17,7 @@ package handle
 import (
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
@@ -25,12 +26,68 @@ import (
 	"golang.org/x/net/context"
 )
 
+// The chunk size and number of chunks in flight used by handles that download
+// in parallel when no others are configured.
+const (
+	DefaultParallelDownloadChunkSize   = 8 << 20
+	DefaultParallelDownloadParallelism = 8
+)
+
+// Settings for reading objects with gcsx.NewParallelReader rather than a
+// single stream. The chunk size and parallelism together bound the memory
+// used by a handle.
+type ParallelDownloads struct {
+	// Objects at least this large are read in parallel. Smaller ones are read
+	// with a single stream.
+	MinObjectSize uint64
+
+	ChunkSize   int64
+	Parallelism int
+
+	// Whether to check the chunks of objects read in full against their
+	// CRC32C.
+	Verify bool
+}
+
+// Settings for reading with gcsx.NewReadAheadReader rather than a single
+// stream.
+type ReadAhead struct {
+	// How many bytes following each read to fetch once reads look sequential.
+	Window int64
+
+	// How many reads in a row must continue from the last before then.
+	Trigger int
+}
+
 type FileHandle struct {
 	inode  *inode.FileInode
 	bucket gcs.Bucket
 
+	// If non-nil, when to read from GCS with a parallel reader rather than a
+	// single stream.
+	parallelDownloads *ParallelDownloads
+
+	// If non-nil, how to read ahead when not reading in parallel.
+	readAhead *ReadAhead
+
+	// If non-nil, where to cache ranges fetched by random reads when not
+	// reading in parallel.
+	rangeCache *gcsx.RangeCache
+
+	// The budget from which parallel readers reserve their chunks, or nil if
+	// there's no limit.
+	budget *gcsx.MemoryBudget
+
+	// The time at which the handle was opened.
+	opened time.Time
+
 	mu syncutil.InvariantMutex
 
+	// Whether the handle has been used to write to the file.
+	//
+	// GUARDED_BY(mu)
+	written bool
+
 	// A random reader configured to some (potentially previous) generation of
 	// the object backing the inode, or nil.
 	//
@@ -40,12 +97,29 @@ type FileHandle struct {
 	reader gcsx.RandomReader
 }
 
+// NewFileHandle creates a handle for the supplied inode, opened at the given
+// time. If parallelDownloads is non-nil, reads of clean content from objects
+// large enough are served with gcsx.NewParallelReader. Otherwise if readAhead
+// is non-nil, they are served with gcsx.NewReadAheadReader. Random reads
+// not served in parallel are cached in rangeCache if it is non-nil. Memory
+// for downloading in parallel and reading ahead is reserved from budget, which
+// may be nil.
 func NewFileHandle(
 	inode *inode.FileInode,
-	bucket gcs.Bucket) (fh *FileHandle) {
+	bucket gcs.Bucket,
+	parallelDownloads *ParallelDownloads,
+	readAhead *ReadAhead,
+	rangeCache *gcsx.RangeCache,
+	budget *gcsx.MemoryBudget,
+	opened time.Time) (fh *FileHandle) {
 	fh = &FileHandle{
-		inode:  inode,
-		bucket: bucket,
+		inode:             inode,
+		bucket:            bucket,
+		parallelDownloads: parallelDownloads,
+		readAhead:         readAhead,
+		rangeCache:        rangeCache,
+		budget:            budget,
+		opened:            opened,
 	}
 
 	fh.mu = syncutil.NewInvariantMutex(fh.checkInvariants)
@@ -61,11 +135,46 @@ func (fh *FileHandle) Destroy() {
 	}
 }
 
+// DropReader destroys the handle's reader, if it has one, returning true if
+// it did. A new one is created when the handle is next read from.
+//
+// LOCKS_REQUIRED(fh)
+func (fh *FileHandle) DropReader() (dropped bool) {
+	if fh.reader == nil {
+		return
+	}
+
+	fh.reader.Destroy()
+	fh.reader = nil
+	dropped = true
+
+	return
+}
+
 // Inode returns the inode backing this handle.
 func (fh *FileHandle) Inode() *inode.FileInode {
 	return fh.inode
 }
 
+// Opened returns the time at which the handle was opened.
+func (fh *FileHandle) Opened() time.Time {
+	return fh.opened
+}
+
+// MarkWritten records that the handle has been used to write to the file.
+//
+// LOCKS_REQUIRED(fh)
+func (fh *FileHandle) MarkWritten() {
+	fh.written = true
+}
+
+// Written returns true if MarkWritten has been called.
+//
+// LOCKS_REQUIRED(fh)
+func (fh *FileHandle) Written() bool {
+	return fh.written
+}
+
 func (fh *FileHandle) Lock() {
 	fh.mu.Lock()
 }
@@ -77,6 +186,12 @@ func (fh *FileHandle) Unlock() {
 // Equivalent to locking fh.Inode() and calling fh.Inode().Read, but may be
 // more efficient.
 //
+// Clean content is read from GCS at the inode's source generation, which
+// changes only when the file is modified through this file system. (When we
+// observe a generation we didn't create, it gets a new inode.) So reads through
+// the handle never mix content from generations written by other clients; if
+// the generation is overwritten or deleted, a *gcs.NotFoundError is returned.
+//
 // LOCKS_REQUIRED(fh)
 // LOCKS_EXCLUDED(fh.inode)
 func (fh *FileHandle) Read(
@@ -102,6 +217,12 @@ func (fh *FileHandle) Read(
 		fh.inode.Unlock()
 
 		n, err = fh.reader.ReadAt(ctx, dst, offset)
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			// The generation we're pinned to is gone. Let the caller know rather
+			// than reading from another one.
+			return
+		}
+
 		switch {
 		case err == io.EOF:
 			return
@@ -162,10 +283,50 @@ func (fh *FileHandle) tryEnsureReader() (err error) {
 	}
 
 	// Attempt to create an appropriate reader.
-	rr, err := gcsx.NewRandomReader(fh.inode.Source(), fh.bucket)
-	if err != nil {
-		err = fmt.Errorf("NewRandomReader: %v", err)
-		return
+	var rr gcsx.RandomReader
+	p := fh.parallelDownloads
+	if p != nil && fh.inode.Source().Size >= p.MinObjectSize {
+		rr, err = gcsx.NewParallelReader(
+			fh.inode.Source(),
+			fh.bucket,
+			p.ChunkSize,
+			p.Parallelism,
+			fh.budget,
+			p.Verify)
+
+		if err != nil {
+			err = fmt.Errorf("NewParallelReader: %v", err)
+			return
+		}
+	} else if fh.readAhead != nil {
+		rr, err = gcsx.NewReadAheadReader(
+			fh.inode.Source(),
+			fh.bucket,
+			fh.readAhead.Window,
+			fh.readAhead.Trigger,
+			fh.rangeCache,
+			fh.budget)
+
+		if err != nil {
+			err = fmt.Errorf("NewReadAheadReader: %v", err)
+			return
+		}
+	} else if fh.rangeCache != nil {
+		rr, err = gcsx.NewCachingRandomReader(
+			fh.inode.Source(),
+			fh.bucket,
+			fh.rangeCache)
+
+		if err != nil {
+			err = fmt.Errorf("NewCachingRandomReader: %v", err)
+			return
+		}
+	} else {
+		rr, err = gcsx.NewRandomReader(fh.inode.Source(), fh.bucket)
+		if err != nil {
+			err = fmt.Errorf("NewRandomReader: %v", err)
+			return
+		}
 	}
 
 	fh.reader = rr
@@ -0,0 +1,390 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for what happens when another writer modifies a file's backing object
+// while we have it open or dirty, including in the middle of writing it out.
+//
+// The semantics locked down here: a file whose object has been replaced or
+// deleted behind our back is treated as if it had been unlinked. Its
+// modifications are never written over the other writer's generation (there
+// are no conflict files), and syncing it does not return an error.
+
+package inode_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/hookbucket"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestConflict(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ConflictTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+
+	// The fake bucket, which stands in for GCS as seen by other writers, and
+	// a hook bucket wrapping it, which is what the inode sees.
+	wrapped gcs.Bucket
+	bucket  *hookbucket.Bucket
+
+	backingObj *gcs.Object
+	in         *inode.FileInode
+}
+
+var _ SetUpInterface = &ConflictTest{}
+var _ TearDownInterface = &ConflictTest{}
+
+func init() { RegisterTestSuite(&ConflictTest{}) }
+
+func (t *ConflictTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = hookbucket.New(t.wrapped)
+
+	// Set up the backing object.
+	t.backingObj, err = gcsutil.CreateObject(
+		t.ctx,
+		t.wrapped,
+		fileInodeName,
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+
+	// Create the inode.
+	t.in = inode.NewFileInode(
+		fileInodeID,
+		t.backingObj,
+		fuseops.InodeAttributes{
+			Uid:  uid,
+			Gid:  gid,
+			Mode: fileMode,
+		},
+		t.bucket,
+		gcsx.NewSyncer(
+			1, // Append threshold
+			0, // Parallel upload threshold
+			0, // Parallel upload parts
+			gcsx.UnchangedContentUpload,
+			".gcsfuse_tmp/",
+			t.bucket),
+		"",
+		nil,
+		nil,
+		false, // Streaming writes
+		false, // POSIX metadata
+		&t.clock)
+
+	t.in.Lock()
+}
+
+func (t *ConflictTest) TearDown() {
+	t.in.Unlock()
+}
+
+// Replace the backing object with a new generation, as another writer would.
+func (t *ConflictTest) clobber() (o *gcs.Object) {
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.wrapped,
+		fileInodeName,
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+	return
+}
+
+// Delete the backing object, as another writer would.
+func (t *ConflictTest) delete() {
+	err := t.wrapped.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: fileInodeName})
+
+	AssertEq(nil, err)
+}
+
+func (t *ConflictTest) readObject() (contents string, err error) {
+	b, err := gcsutil.ReadObject(t.ctx, t.wrapped, fileInodeName)
+	contents = string(b)
+	return
+}
+
+func (t *ConflictTest) nlink() uint32 {
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	return attrs.Nlink
+}
+
+// List the names of temporary objects left in the bucket.
+func (t *ConflictTest) tmpObjects() (names []string) {
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.wrapped,
+		&gcs.ListObjectsRequest{Prefix: ".gcsfuse_tmp/"})
+
+	AssertEq(nil, err)
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ConflictTest) Clobbered_LooksUnlinked() {
+	AssertEq(1, t.nlink())
+
+	t.clobber()
+	ExpectEq(0, t.nlink())
+}
+
+func (t *ConflictTest) MetadataChanged_LooksUnlinked() {
+	lang := "fr"
+	_, err := t.wrapped.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:            fileInodeName,
+			ContentLanguage: &lang,
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(0, t.nlink())
+}
+
+func (t *ConflictTest) Deleted_LooksUnlinked() {
+	t.delete()
+	ExpectEq(0, t.nlink())
+}
+
+func (t *ConflictTest) Read_ClobberedBeforeContentFaultedIn() {
+	t.clobber()
+
+	// Our generation is gone, so there's nothing to read. In particular we must
+	// not serve the other writer's contents as if they were ours.
+	buf := make([]byte, 16)
+	n, err := t.in.Read(t.ctx, buf, 0)
+
+	ExpectThat(err, Error(HasSubstr("not found")))
+	ExpectFalse(strings.Contains(string(buf[:n]), "burrito"))
+}
+
+func (t *ConflictTest) Read_ClobberedAfterContentFaultedIn() {
+	var err error
+	buf := make([]byte, 4)
+
+	// Fault in the content.
+	_, err = t.in.Read(t.ctx, buf, 0)
+	AssertEq(nil, err)
+
+	// Clobber. We should continue to see our own contents.
+	t.clobber()
+
+	n, err := t.in.Read(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(buf[:n]))
+}
+
+func (t *ConflictTest) Sync_ClobberedBeforeWrite() {
+	var err error
+
+	// Clobber before we dirty the file. Faulting in the content for the write
+	// fails, since our generation is gone.
+	t.clobber()
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	ExpectThat(err, Error(HasSubstr("not found")))
+
+	// Syncing is a no-op, and the other writer's contents survive.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := t.readObject()
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+}
+
+func (t *ConflictTest) Sync_ClobberedWhileDirty() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	newObj := t.clobber()
+
+	// Syncing succeeds without overwriting the other writer's generation.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := t.readObject()
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+
+	// We keep our modifications, but remain unlinked.
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+	ExpectTrue(t.in.Dirty())
+	ExpectEq(0, t.nlink())
+
+	// Syncing again changes nothing.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	o, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: fileInodeName})
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+}
+
+func (t *ConflictTest) Sync_ClobberedDuringUpload() {
+	var err error
+
+	// Overwrite the first byte, forcing a full upload.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Have another writer get in just before our upload does.
+	var newObj *gcs.Object
+	t.bucket.OnceBefore(hookbucket.CreateObject, fileInodeName, func() {
+		newObj = t.clobber()
+	})
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	AssertNe(nil, newObj)
+
+	// The other writer wins.
+	contents, err := t.readObject()
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+	ExpectTrue(t.in.Dirty())
+	ExpectEq(0, t.nlink())
+}
+
+func (t *ConflictTest) Sync_DeletedDuringUpload() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	t.bucket.OnceBefore(hookbucket.CreateObject, fileInodeName, t.delete)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	// The object must not be resurrected.
+	_, err = t.readObject()
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(0, t.nlink())
+}
+
+func (t *ConflictTest) Sync_ClobberedDuringAppend() {
+	var err error
+
+	// Append, so that the append optimization is used.
+	err = t.in.Write(t.ctx, []byte("s"), 4)
+	AssertEq(nil, err)
+
+	// Have another writer get in after the appended data is uploaded but
+	// before it is composed onto our generation.
+	t.bucket.OnceBefore(hookbucket.ComposeObjects, fileInodeName, func() {
+		t.clobber()
+	})
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	// The other writer wins, and the temporary object is cleaned up.
+	contents, err := t.readObject()
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+
+	ExpectTrue(t.in.Dirty())
+	ExpectEq(0, t.nlink())
+	ExpectThat(t.tmpObjects(), ElementsAre())
+}
+
+func (t *ConflictTest) Sync_MetadataChangedDuringUpload() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Another writer changing only the metadata is also a conflict.
+	t.bucket.OnceBefore(hookbucket.CreateObject, fileInodeName, func() {
+		lang := "fr"
+		_, err := t.wrapped.UpdateObject(
+			t.ctx,
+			&gcs.UpdateObjectRequest{
+				Name:            fileInodeName,
+				ContentLanguage: &lang,
+			})
+
+		AssertEq(nil, err)
+	})
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := t.readObject()
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	ExpectTrue(t.in.Dirty())
+	ExpectEq(0, t.nlink())
+}
+
+func (t *ConflictTest) SetMtime_ClobberedWhileClean() {
+	var err error
+	newObj := t.clobber()
+
+	err = t.in.SetMtime(t.ctx, time.Now())
+	AssertEq(nil, err)
+
+	// The other writer's object is untouched.
+	o, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: fileInodeName})
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+	ExpectEq(newObj.MetaGeneration, o.MetaGeneration)
+	ExpectEq(0, len(o.Metadata))
+}
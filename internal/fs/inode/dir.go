@@ -147,6 +147,22 @@ type DirInode interface {
 	DeleteChildDir(
 		ctx context.Context,
 		name string) (err error)
+
+	// Return true if entries the kernel may have cached for the directory are
+	// older than ttl or out of date, in which case the caller must make the
+	// kernel discard them. The kernel's cache is then considered up to date as
+	// of now.
+	ShouldInvalidateKernelListCache(ttl time.Duration) bool
+
+	// Note that the entries of the directory have changed, so that any cached
+	// by the kernel are out of date. The methods above that create and delete
+	// children do this themselves.
+	InvalidateKernelListCache()
+
+	// Discard the type cached for the child with the given relative name, whose
+	// object has been changed elsewhere, and note that the entries of the
+	// directory have changed.
+	ForgetChild(name string)
 }
 
 type dirInode struct {
@@ -185,6 +201,12 @@ type dirInode struct {
 	//
 	// GUARDED_BY(mu)
 	cache typeCache
+
+	// The time as of which entries cached by the kernel for the directory
+	// are up to date, or zero if they may not be.
+	//
+	// GUARDED_BY(mu)
+	kernelListCacheTime time.Time
 }
 
 var _ DirInode = &dirInode{}
@@ -200,10 +222,12 @@ var _ DirInode = &dirInode{}
 //
 // If typeCacheTTL is non-zero, a cache from child name to information about
 // whether that name exists as a file/symlink and/or directory will be
-// maintained. This may speed up calls to LookUpChild, especially when combined
-// with a stat-caching GCS bucket, but comes at the cost of consistency: if the
-// child is removed and recreated with a different type before the expiration,
-// we may fail to find it.
+// maintained for up to typeCacheCapacity names. This may speed up calls to
+// LookUpChild, especially when combined with a stat-caching GCS bucket, but
+// comes at the cost of consistency: if a directory is created beside a file
+// of the same name before the expiration, we may keep finding the file. A
+// child removed and recreated with a different type is still found, at the
+// cost of an extra request.
 //
 // The initial lookup count is zero.
 //
@@ -214,6 +238,7 @@ func NewDirInode(
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
 	typeCacheTTL time.Duration,
+	typeCacheCapacity int,
 	bucket gcs.Bucket,
 	mtimeClock timeutil.Clock,
 	cacheClock timeutil.Clock) (d DirInode) {
@@ -222,7 +247,6 @@ func NewDirInode(
 	}
 
 	// Set up the struct.
-	const typeCacheCapacity = 1 << 16
 	typed := &dirInode{
 		bucket:       bucket,
 		mtimeClock:   mtimeClock,
@@ -231,7 +255,7 @@ func NewDirInode(
 		implicitDirs: implicitDirs,
 		name:         name,
 		attrs:        attrs,
-		cache:        newTypeCache(typeCacheCapacity/2, typeCacheTTL),
+		cache:        newTypeCache(typeCacheCapacity, typeCacheTTL),
 	}
 
 	typed.lc.Init(id)
@@ -581,6 +605,11 @@ func (d *dirInode) DecrementLookupCount(n uint64) (destroy bool) {
 	return
 }
 
+// LOCKS_REQUIRED(d)
+func (d *dirInode) Trim() {
+	d.cache.Clear()
+}
+
 // LOCKS_REQUIRED(d)
 func (d *dirInode) Destroy() (err error) {
 	// Nothing interesting to do.
@@ -649,6 +678,24 @@ func (d *dirInode) LookUpChild(
 		return
 	}
 
+	// If the cache told us the child had only one type but it no longer has
+	// that type, the cache is stale: the child may have been removed and
+	// recreated with the other type. Forget what we knew and look for the
+	// other type after all.
+	switch {
+	case cacheSaysDir && !cacheSaysFile && !dirResult.Exists():
+		d.cache.Erase(name)
+		fileResult, err = d.lookUpChildFile(ctx, name)
+
+	case cacheSaysFile && !cacheSaysDir && !fileResult.Exists():
+		d.cache.Erase(name)
+		dirResult, err = d.lookUpChildDir(ctx, name)
+	}
+
+	if err != nil {
+		return
+	}
+
 	// Prefer directories over files.
 	switch {
 	case dirResult.Exists():
@@ -752,6 +799,8 @@ func (d *dirInode) ReadEntries(
 func (d *dirInode) CreateChildFile(
 	ctx context.Context,
 	name string) (o *gcs.Object, err error) {
+	d.InvalidateKernelListCache()
+
 	metadata := map[string]string{
 		FileMtimeMetadataKey: d.mtimeClock.Now().UTC().Format(time.RFC3339Nano),
 	}
@@ -771,6 +820,8 @@ func (d *dirInode) CloneToChildFile(
 	ctx context.Context,
 	name string,
 	src *gcs.Object) (o *gcs.Object, err error) {
+	d.InvalidateKernelListCache()
+
 	// Erase any existing type information for this name.
 	d.cache.Erase(name)
 
@@ -799,6 +850,8 @@ func (d *dirInode) CreateChildSymlink(
 	ctx context.Context,
 	name string,
 	target string) (o *gcs.Object, err error) {
+	d.InvalidateKernelListCache()
+
 	metadata := map[string]string{
 		SymlinkMetadataKey: target,
 	}
@@ -817,6 +870,8 @@ func (d *dirInode) CreateChildSymlink(
 func (d *dirInode) CreateChildDir(
 	ctx context.Context,
 	name string) (o *gcs.Object, err error) {
+	d.InvalidateKernelListCache()
+
 	o, err = d.createNewObject(ctx, path.Join(d.Name(), name)+"/", nil)
 	if err != nil {
 		return
@@ -833,6 +888,7 @@ func (d *dirInode) DeleteChildFile(
 	name string,
 	generation int64,
 	metaGeneration *int64) (err error) {
+	d.InvalidateKernelListCache()
 	d.cache.Erase(name)
 
 	err = d.bucket.DeleteObject(
@@ -855,6 +911,7 @@ func (d *dirInode) DeleteChildFile(
 func (d *dirInode) DeleteChildDir(
 	ctx context.Context,
 	name string) (err error) {
+	d.InvalidateKernelListCache()
 	d.cache.Erase(name)
 
 	// Delete the backing object. Unfortunately we have no way to precondition
@@ -872,3 +929,25 @@ func (d *dirInode) DeleteChildDir(
 
 	return
 }
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) ShouldInvalidateKernelListCache(ttl time.Duration) bool {
+	now := d.cacheClock.Now()
+	if !d.kernelListCacheTime.IsZero() && now.Sub(d.kernelListCacheTime) < ttl {
+		return false
+	}
+
+	d.kernelListCacheTime = now
+	return true
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) InvalidateKernelListCache() {
+	d.kernelListCacheTime = time.Time{}
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) ForgetChild(name string) {
+	d.cache.Erase(name)
+	d.InvalidateKernelListCache()
+}
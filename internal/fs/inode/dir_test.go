@@ -44,6 +44,7 @@ const dirInodeID = 17
 const dirInodeName = "foo/bar/"
 const dirMode os.FileMode = 0712 | os.ModeDir
 const typeCacheTTL = time.Second
+const typeCacheCapacity = 1 << 15
 
 type DirTest struct {
 	ctx    context.Context
@@ -96,6 +97,7 @@ func (t *DirTest) resetInode(implicitDirs bool) {
 		},
 		implicitDirs,
 		typeCacheTTL,
+		typeCacheCapacity,
 		t.bucket,
 		&t.clock,
 		&t.clock)
@@ -506,6 +508,91 @@ func (t *DirTest) LookUpChild_TypeCaching() {
 	ExpectEq(dirObjName, o.Name)
 }
 
+func (t *DirTest) LookUpChild_TypeCacheIsStale() {
+	const name = "qux"
+	fileObjName := path.Join(dirInodeName, name)
+	dirObjName := path.Join(dirInodeName, name) + "/"
+
+	var o *gcs.Object
+	var err error
+
+	// Create a backing object for a file, and look it up so that the type
+	// cache notes it.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+
+	// Replace it with a directory behind the inode's back.
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: fileObjName})
+
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirObjName, []byte(""))
+	AssertEq(nil, err)
+
+	// The directory should be found despite the cache, and from then on the
+	// cache should know about it.
+	result, err = t.in.LookUpChild(t.ctx, name)
+	o = result.Object
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+	ExpectEq(dirObjName, o.Name)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	o = result.Object
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+	ExpectEq(dirObjName, o.Name)
+}
+
+func (t *DirTest) ForgetChild() {
+	const name = "qux"
+	const ttl = time.Minute
+	fileObjName := path.Join(dirInodeName, name)
+	dirObjName := path.Join(dirInodeName, name) + "/"
+
+	var err error
+
+	// Create a backing object for a file, and look it up so that the type
+	// cache notes it.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+
+	ExpectTrue(t.in.ShouldInvalidateKernelListCache(ttl))
+	ExpectFalse(t.in.ShouldInvalidateKernelListCache(ttl))
+
+	// Add a directory of the same name behind the inode's back. The cache
+	// says the child is a file, so the directory isn't found.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirObjName, []byte(""))
+	AssertEq(nil, err)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(fileObjName, result.Object.Name)
+
+	// Once told to forget the child, the inode finds the directory, and the
+	// kernel's listing is invalidated.
+	t.in.ForgetChild(name)
+	ExpectTrue(t.in.ShouldInvalidateKernelListCache(ttl))
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirObjName, result.Object.Name)
+}
+
 func (t *DirTest) ReadEntries_Empty() {
 	entries, err := t.readAllEntries()
 
@@ -1100,3 +1187,44 @@ func (t *DirTest) DeleteChildDir_Exists() {
 	_, err = gcsutil.ReadObject(t.ctx, t.bucket, objName)
 	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
 }
+
+func (t *DirTest) KernelListCache_Expires() {
+	const ttl = time.Minute
+
+	// Nothing has been cached at first.
+	ExpectTrue(t.in.ShouldInvalidateKernelListCache(ttl))
+
+	// The kernel's entries are fresh until the TTL passes.
+	t.clock.AdvanceTime(ttl - time.Millisecond)
+	ExpectFalse(t.in.ShouldInvalidateKernelListCache(ttl))
+
+	t.clock.AdvanceTime(time.Millisecond)
+	ExpectTrue(t.in.ShouldInvalidateKernelListCache(ttl))
+	ExpectFalse(t.in.ShouldInvalidateKernelListCache(ttl))
+}
+
+func (t *DirTest) KernelListCache_InvalidatedByChanges() {
+	const ttl = time.Minute
+	var err error
+
+	ExpectTrue(t.in.ShouldInvalidateKernelListCache(ttl))
+	ExpectFalse(t.in.ShouldInvalidateKernelListCache(ttl))
+
+	// Creating a child invalidates the cache.
+	_, err = t.in.CreateChildFile(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	ExpectTrue(t.in.ShouldInvalidateKernelListCache(ttl))
+	ExpectFalse(t.in.ShouldInvalidateKernelListCache(ttl))
+
+	// So does deleting one.
+	err = t.in.DeleteChildFile(t.ctx, "foo", 0, nil)
+	AssertEq(nil, err)
+
+	ExpectTrue(t.in.ShouldInvalidateKernelListCache(ttl))
+	ExpectFalse(t.in.ShouldInvalidateKernelListCache(ttl))
+
+	// As does an explicit request.
+	t.in.InvalidateKernelListCache()
+	ExpectTrue(t.in.ShouldInvalidateKernelListCache(ttl))
+}
@@ -17,7 +17,9 @@ package inode
 import (
 	"fmt"
 	"io"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
@@ -50,6 +52,23 @@ type FileInode struct {
 	attrs   fuseops.InodeAttributes
 	tempDir string
 
+	// If non-nil, the journal in which to keep local content instead of
+	// tempDir.
+	journal *gcsx.Journal
+
+	// If non-nil and there is no journal, where to keep local content instead
+	// of tempDir while it has room.
+	memory *gcsx.MemoryStaging
+
+	// Whether to stream sequential writes of new contents directly to GCS
+	// rather than staging them in local content.
+	streamingWrites bool
+
+	// Whether to report the permission bits, owner, and group recorded in the
+	// source object's metadata, rather than those in attrs, when there are
+	// any. See SetPosixAttributes.
+	posixMetadata bool
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -72,6 +91,24 @@ type FileInode struct {
 	// authoritative.
 	content gcsx.TempFile
 
+	// If non-nil, content written to the end of the file that has yet to be
+	// appended to the source object, held apart from it so that appending to a
+	// large object doesn't require downloading it.
+	//
+	// INVARIANT: If tail != nil, content == nil and upload == nil
+	//
+	// GUARDED_BY(mu)
+	tail gcsx.TempFile
+
+	// If non-nil, an upload receiving all of the current content of this inode
+	// as it is written, and the time of the last write to it.
+	//
+	// INVARIANT: If upload != nil, content == nil
+	//
+	// GUARDED_BY(mu)
+	upload      *gcsx.StreamingUpload
+	uploadMtime time.Time
+
 	// Has Destroy been called?
 	//
 	// GUARDED_BY(mu)
@@ -95,17 +132,25 @@ func NewFileInode(
 	bucket gcs.Bucket,
 	syncer gcsx.Syncer,
 	tempDir string,
+	journal *gcsx.Journal,
+	memory *gcsx.MemoryStaging,
+	streamingWrites bool,
+	posixMetadata bool,
 	mtimeClock timeutil.Clock) (f *FileInode) {
 	// Set up the basic struct.
 	f = &FileInode{
-		bucket:     bucket,
-		syncer:     syncer,
-		mtimeClock: mtimeClock,
-		id:         id,
-		name:       o.Name,
-		attrs:      attrs,
-		tempDir:    tempDir,
-		src:        *o,
+		bucket:          bucket,
+		syncer:          syncer,
+		mtimeClock:      mtimeClock,
+		id:              id,
+		name:            o.Name,
+		attrs:           attrs,
+		tempDir:         tempDir,
+		journal:         journal,
+		memory:          memory,
+		streamingWrites: streamingWrites,
+		posixMetadata:   posixMetadata,
+		src:             *o,
 	}
 
 	f.lc.Init(id)
@@ -120,6 +165,18 @@ func NewFileInode(
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// Create a temp file outside of the journal with the supplied initial
+// contents, in memory if configured and otherwise in tempDir.
+func (f *FileInode) newTempFile(content io.Reader) (tf gcsx.TempFile, err error) {
+	if f.memory != nil {
+		tf, err = f.memory.NewTempFile(content, f.mtimeClock)
+		return
+	}
+
+	tf, err = gcsx.NewTempFile(content, f.tempDir, f.mtimeClock)
+	return
+}
+
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) checkInvariants() {
 	if f.destroyed {
@@ -141,6 +198,20 @@ func (f *FileInode) checkInvariants() {
 	if f.content != nil {
 		f.content.CheckInvariants()
 	}
+
+	// INVARIANT: If upload != nil, content == nil
+	if f.upload != nil && f.content != nil {
+		panic("Streaming upload with local content")
+	}
+
+	// INVARIANT: If tail != nil, content == nil and upload == nil
+	if f.tail != nil {
+		if f.content != nil || f.upload != nil {
+			panic("Appended content with other local content")
+		}
+
+		f.tail.CheckInvariants()
+	}
 }
 
 // LOCKS_REQUIRED(f.mu)
@@ -169,6 +240,66 @@ func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
 	return
 }
 
+// Start streaming the contents of the inode to GCS, replacing the source
+// object if it hasn't been clobbered.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) startUpload() {
+	generation := f.src.Generation
+	metaGeneration := f.src.MetaGeneration
+
+	f.upload = gcsx.NewStreamingUpload(
+		f.bucket,
+		&gcs.CreateObjectRequest{
+			Name:                       f.src.Name,
+			GenerationPrecondition:     &generation,
+			MetaGenerationPrecondition: &metaGeneration,
+			Metadata:                   gcsx.PosixMetadata(&f.src),
+		})
+
+	f.uploadMtime = f.mtimeClock.Now()
+}
+
+// If an upload is in progress, finish it, making the object it creates the
+// source object. If the source object was clobbered in the meantime, the
+// contents are discarded, as they are when syncing.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) finishUpload(ctx context.Context) (err error) {
+	if f.upload == nil {
+		return
+	}
+
+	o, err := f.upload.Finish(ctx)
+	f.upload = nil
+
+	if err != nil {
+		return
+	}
+
+	f.src = *o
+	return
+}
+
+// Make o the source object in place of a new generation or metageneration of
+// the old one, keeping any journal record of the local content up to date so
+// that it's written out over o after a crash.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) setSource(o *gcs.Object) (err error) {
+	f.src = *o
+
+	if r, ok := f.content.(gcsx.SourceRecorder); ok {
+		err = r.SetSource(o)
+		if err != nil {
+			err = fmt.Errorf("SetSource: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
 // Ensure that f.content != nil
 //
 // LOCKS_REQUIRED(f.mu)
@@ -178,6 +309,14 @@ func (f *FileInode) ensureContent(ctx context.Context) (err error) {
 		return
 	}
 
+	// If we're streaming content to GCS, we can't go back and change it or
+	// read it. Write out what we have so far and start again from that.
+	err = f.finishUpload(ctx)
+	if err != nil {
+		err = fmt.Errorf("finishUpload: %v", err)
+		return
+	}
+
 	// Open a reader for the generation we care about.
 	rc, err := f.bucket.NewReader(
 		ctx,
@@ -194,18 +333,99 @@ func (f *FileInode) ensureContent(ctx context.Context) (err error) {
 	defer rc.Close()
 
 	// Create a temporary file with its contents.
-	tf, err := gcsx.NewTempFile(rc, f.tempDir, f.mtimeClock)
+	var tf gcsx.TempFile
+	if f.journal != nil {
+		tf, err = f.journal.NewTempFile(
+			rc,
+			f.bucket.Name(),
+			&f.src,
+			f.mtimeClock)
+	} else {
+		tf, err = f.newTempFile(rc)
+	}
+
 	if err != nil {
 		err = fmt.Errorf("NewTempFile: %v", err)
 		return
 	}
 
+	// Add any content appended since, which is then no longer needed apart.
+	if f.tail != nil {
+		err = f.mergeTail(tf)
+		if err != nil {
+			tf.Destroy()
+			err = fmt.Errorf("mergeTail: %v", err)
+			return
+		}
+	}
+
 	// Update state.
 	f.content = tf
 
 	return
 }
 
+// Write the content held in f.tail to the end of the supplied content for the
+// source object, and discard f.tail.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) mergeTail(tf gcsx.TempFile) (err error) {
+	sr, err := f.tail.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	_, err = io.Copy(
+		io.NewOffsetWriter(tf, int64(f.src.Size)),
+		io.NewSectionReader(f.tail, 0, sr.Size))
+
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	if sr.Mtime != nil {
+		tf.SetMtime(*sr.Mtime)
+	}
+
+	f.tail.Destroy()
+	f.tail = nil
+	return
+}
+
+// If the source object may be appended to in GCS without reading it, and no
+// other local content is held, return the offset at which a write appends to
+// the file. Otherwise return -1.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) appendOffset() (offset int64, err error) {
+	offset = -1
+
+	// Content kept in the journal must be complete, so that it can be replayed.
+	if f.content != nil || f.upload != nil || f.journal != nil {
+		return
+	}
+
+	if !f.syncer.CanAppend(&f.src) {
+		return
+	}
+
+	offset = int64(f.src.Size)
+	if f.tail != nil {
+		var sr gcsx.StatResult
+		sr, err = f.tail.Stat()
+		if err != nil {
+			err = fmt.Errorf("Stat: %v", err)
+			return
+		}
+
+		offset += sr.Size
+	}
+
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Public interface
 ////////////////////////////////////////////////////////////////////////
@@ -243,7 +463,60 @@ func (f *FileInode) Source() *gcs.Object {
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) SourceGenerationIsAuthoritative() bool {
-	return f.content == nil
+	return f.content == nil && f.upload == nil && f.tail == nil
+}
+
+// Return true if the inode holds local modifications that have not yet been
+// written out to GCS by a successful call to f.Sync.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Dirty() bool {
+	if f.upload != nil || f.tail != nil {
+		return true
+	}
+
+	if f.destroyed || f.content == nil {
+		return false
+	}
+
+	// If we can't tell, err on the side of caution.
+	sr, err := f.content.Stat()
+	if err != nil {
+		return true
+	}
+
+	return sr.Mtime != nil
+}
+
+// Return the number of bytes of local content that may differ from the source
+// object, i.e. those from the first modified offset onward. Zero if the inode
+// isn't dirty.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) DirtyBytes() int64 {
+	if f.upload != nil {
+		return f.upload.Size()
+	}
+
+	if f.tail != nil {
+		sr, err := f.tail.Stat()
+		if err != nil {
+			return 0
+		}
+
+		return sr.Size
+	}
+
+	if f.destroyed || f.content == nil {
+		return 0
+	}
+
+	sr, err := f.content.Stat()
+	if err != nil || sr.Mtime == nil || sr.Size < sr.DirtyThreshold {
+		return 0
+	}
+
+	return sr.Size - sr.DirtyThreshold
 }
 
 // Equivalent to the generation returned by f.Source().
@@ -266,6 +539,19 @@ func (f *FileInode) DecrementLookupCount(n uint64) (destroy bool) {
 	return
 }
 
+// If the inode holds a clean local copy of its source object, throw it away.
+// Reads will go back to GCS until the contents are next needed locally.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Trim() {
+	if f.content == nil || f.Dirty() {
+		return
+	}
+
+	f.content.Destroy()
+	f.content = nil
+}
+
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Destroy() (err error) {
 	f.destroyed = true
@@ -274,6 +560,15 @@ func (f *FileInode) Destroy() (err error) {
 		f.content.Destroy()
 	}
 
+	if f.tail != nil {
+		f.tail.Destroy()
+	}
+
+	if f.upload != nil {
+		f.upload.Abort()
+		f.upload = nil
+	}
+
 	return
 }
 
@@ -308,6 +603,11 @@ func (f *FileInode) Attributes(
 		}
 	}
 
+	// Likewise for the attributes recorded by SetPosixAttributes.
+	if f.posixMetadata {
+		f.applyPosixMetadata(&attrs)
+	}
+
 	// If we've got local content, its size and (maybe) mtime take precedence.
 	if f.content != nil {
 		var sr gcsx.StatResult
@@ -323,6 +623,27 @@ func (f *FileInode) Attributes(
 		}
 	}
 
+	// Likewise for content to be appended.
+	if f.tail != nil {
+		var sr gcsx.StatResult
+		sr, err = f.tail.Stat()
+		if err != nil {
+			err = fmt.Errorf("Stat: %v", err)
+			return
+		}
+
+		attrs.Size = f.src.Size + uint64(sr.Size)
+		if sr.Mtime != nil {
+			attrs.Mtime = *sr.Mtime
+		}
+	}
+
+	// Likewise for content being streamed.
+	if f.upload != nil {
+		attrs.Size = uint64(f.upload.Size())
+		attrs.Mtime = f.uploadMtime
+	}
+
 	// If the object has been clobbered, we reflect that as the inode being
 	// unlinked.
 	clobbered, err := f.clobbered(ctx)
@@ -376,6 +697,50 @@ func (f *FileInode) Write(
 	ctx context.Context,
 	data []byte,
 	offset int64) (err error) {
+	// If we're streaming writes and this one continues from where the content
+	// ends, hand it to GCS. A write to the start of an empty file starts
+	// streaming.
+	if f.streamingWrites && f.content == nil && f.tail == nil {
+		if f.upload == nil && offset == 0 && f.src.Size == 0 {
+			f.startUpload()
+		}
+
+		if f.upload != nil && offset == f.upload.Size() {
+			_, err = f.upload.Write(data)
+			if err != nil {
+				// The contents so far are lost, so there's no point in going on.
+				f.upload.Abort()
+				f.upload = nil
+				return
+			}
+
+			f.uploadMtime = f.mtimeClock.Now()
+			return
+		}
+	}
+
+	// If this write continues from the end of a large file, as writes to files
+	// opened with O_APPEND do, hold it apart to be composed with the source
+	// object rather than downloading that.
+	appendOffset, err := f.appendOffset()
+	if err != nil {
+		err = fmt.Errorf("appendOffset: %v", err)
+		return
+	}
+
+	if offset == appendOffset {
+		if f.tail == nil {
+			f.tail, err = f.newTempFile(strings.NewReader(""))
+			if err != nil {
+				err = fmt.Errorf("NewTempFile: %v", err)
+				return
+			}
+		}
+
+		_, err = f.tail.WriteAt(data, offset-int64(f.src.Size))
+		return
+	}
+
 	// Make sure f.content != nil.
 	err = f.ensureContent(ctx)
 	if err != nil {
@@ -396,6 +761,22 @@ func (f *FileInode) Write(
 func (f *FileInode) SetMtime(
 	ctx context.Context,
 	mtime time.Time) (err error) {
+	// Content being streamed can't be given metadata after the fact, so write
+	// it out first.
+	err = f.finishUpload(ctx)
+	switch err.(type) {
+	case nil:
+
+	case *gcs.PreconditionError:
+		// We were clobbered, which we treat as being unlinked.
+		err = nil
+		return
+
+	default:
+		err = fmt.Errorf("finishUpload: %v", err)
+		return
+	}
+
 	// If we have a local temp file, stat it.
 	var sr gcsx.StatResult
 	if f.content != nil {
@@ -406,6 +787,12 @@ func (f *FileInode) SetMtime(
 		}
 	}
 
+	// Likewise for content to be appended, which is always dirty.
+	if f.tail != nil {
+		f.tail.SetMtime(mtime)
+		return
+	}
+
 	// If the local content is dirty, simply update its mtime and return. This
 	// will cause the object in the bucket to be updated once we sync. If we lose
 	// power or something the mtime update will be lost, but so will the file
@@ -433,7 +820,7 @@ func (f *FileInode) SetMtime(
 	o, err := f.bucket.UpdateObject(ctx, req)
 	switch err.(type) {
 	case nil:
-		f.src = *o
+		err = f.setSource(o)
 		return
 
 	case *gcs.NotFoundError:
@@ -454,6 +841,142 @@ func (f *FileInode) SetMtime(
 	}
 }
 
+// Record the given permission bits, owner, and group for this file in the
+// backing object's metadata, leaving those that are nil unchanged. Only the
+// bits in os.ModePerm of mode are used. Attributes reports what is recorded
+// if the inode was created to do so. May involve a round trip to GCS.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetPosixAttributes(
+	ctx context.Context,
+	mode *os.FileMode,
+	uid *uint32,
+	gid *uint32) (err error) {
+	// As in SetMtime.
+	err = f.finishUpload(ctx)
+	switch err.(type) {
+	case nil:
+
+	case *gcs.PreconditionError:
+		err = nil
+		return
+
+	default:
+		err = fmt.Errorf("finishUpload: %v", err)
+		return
+	}
+
+	metadata := make(map[string]*string)
+	if mode != nil {
+		formatted := strconv.FormatUint(uint64(mode.Perm()), 8)
+		metadata[gcsx.ModeMetadataKey] = &formatted
+	}
+
+	if uid != nil {
+		formatted := strconv.FormatUint(uint64(*uid), 10)
+		metadata[gcsx.UIDMetadataKey] = &formatted
+	}
+
+	if gid != nil {
+		formatted := strconv.FormatUint(uint64(*gid), 10)
+		metadata[gcsx.GIDMetadataKey] = &formatted
+	}
+
+	// Any local content keeps what we record here when it's synced, since the
+	// syncer carries it over from the source object.
+	srcGen := f.SourceGeneration()
+	req := &gcs.UpdateObjectRequest{
+		Name:                       f.src.Name,
+		Generation:                 srcGen.Object,
+		MetaGenerationPrecondition: &srcGen.Metadata,
+		Metadata:                   metadata,
+	}
+
+	o, err := f.bucket.UpdateObject(ctx, req)
+	switch err.(type) {
+	case nil:
+		err = f.setSource(o)
+
+	// As in SetMtime, these mean the file has been unlinked.
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		err = nil
+
+	default:
+		err = fmt.Errorf("UpdateObject: %v", err)
+	}
+
+	return
+}
+
+// Override the permission bits, owner, and group in attrs with any recorded
+// in the source object's metadata. Malformed values are ignored.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) applyPosixMetadata(attrs *fuseops.InodeAttributes) {
+	if s, ok := f.src.Metadata[gcsx.ModeMetadataKey]; ok {
+		if perm, err := strconv.ParseUint(s, 8, 32); err == nil {
+			attrs.Mode = attrs.Mode&^os.ModePerm | os.FileMode(perm)&os.ModePerm
+		}
+	}
+
+	if s, ok := f.src.Metadata[gcsx.UIDMetadataKey]; ok {
+		if uid, err := strconv.ParseUint(s, 10, 32); err == nil {
+			attrs.Uid = uint32(uid)
+		}
+	}
+
+	if s, ok := f.src.Metadata[gcsx.GIDMetadataKey]; ok {
+		if gid, err := strconv.ParseUint(s, 10, 32); err == nil {
+			attrs.Gid = uint32(gid)
+		}
+	}
+}
+
+// UpdateMetadata applies changes to the backing object's content type, cache
+// control, and custom metadata, with the semantics of the corresponding fields
+// of gcs.UpdateObjectRequest. Local modifications are written out first, so
+// that the changes apply to them. If the object has been clobbered, which we
+// treat as the inode having been unlinked, a *gcs.NotFoundError is returned.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) UpdateMetadata(
+	ctx context.Context,
+	contentType *string,
+	cacheControl *string,
+	metadata map[string]*string) (err error) {
+	err = f.Sync(ctx)
+	if err != nil {
+		err = fmt.Errorf("Sync: %v", err)
+		return
+	}
+
+	srcGen := f.SourceGeneration()
+	req := &gcs.UpdateObjectRequest{
+		Name:                       f.src.Name,
+		Generation:                 srcGen.Object,
+		MetaGenerationPrecondition: &srcGen.Metadata,
+		ContentType:                contentType,
+		CacheControl:               cacheControl,
+		Metadata:                   metadata,
+	}
+
+	o, err := f.bucket.UpdateObject(ctx, req)
+	switch err.(type) {
+	case nil:
+		err = f.setSource(o)
+
+	case *gcs.NotFoundError:
+
+	case *gcs.PreconditionError:
+		err = &gcs.NotFoundError{Err: err}
+
+	default:
+		err = fmt.Errorf("UpdateObject: %v", err)
+	}
+
+	return
+}
+
 // Sync writes out contents to GCS. If this fails due to the generation having been
 // clobbered, treat it as a non-error (simulating the inode having been
 // unlinked).
@@ -464,6 +987,42 @@ func (f *FileInode) SetMtime(
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Sync(ctx context.Context) (err error) {
+	// If we're streaming, finish the upload. As below, a precondition error
+	// means we were clobbered.
+	if f.upload != nil {
+		err = f.finishUpload(ctx)
+		if _, ok := err.(*gcs.PreconditionError); ok {
+			err = nil
+		}
+
+		if err != nil {
+			err = fmt.Errorf("finishUpload: %v", err)
+			return
+		}
+
+		return
+	}
+
+	// If we're holding content to be appended, compose it with the source
+	// object. As below, a precondition error means we were clobbered.
+	if f.tail != nil {
+		var newObj *gcs.Object
+		newObj, err = f.syncer.AppendObject(ctx, &f.src, f.tail)
+		if _, ok := err.(*gcs.PreconditionError); ok {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("AppendObject: %v", err)
+			return
+		}
+
+		f.src = *newObj
+		f.tail = nil
+		return
+	}
+
 	// If we have not been dirtied, there is nothing to do.
 	if f.content == nil {
 		return
@@ -499,6 +1058,19 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 func (f *FileInode) Truncate(
 	ctx context.Context,
 	size int64) (err error) {
+	// If we're streaming writes, there's nothing to do for a truncation that
+	// doesn't change what has been streamed. Truncating clean content to
+	// nothing, as when a file is opened for overwriting, starts streaming.
+	if f.streamingWrites && f.content == nil && f.tail == nil {
+		if f.upload == nil && size == 0 {
+			f.startUpload()
+		}
+
+		if f.upload != nil && size == f.upload.Size() {
+			return
+		}
+	}
+
 	// Make sure f.content != nil.
 	err = f.ensureContent(ctx)
 	if err != nil {
@@ -55,6 +55,9 @@ type FileTest struct {
 	initialContents string
 	backingObj      *gcs.Object
 
+	// Passed to NewFileInode by createInode.
+	posixMetadata bool
+
 	in *inode.FileInode
 }
 
@@ -104,14 +107,33 @@ func (t *FileTest) createInode() {
 		t.bucket,
 		gcsx.NewSyncer(
 			1, // Append threshold
+			0, // Parallel upload threshold
+			0, // Parallel upload parts
+			gcsx.UnchangedContentUpload,
 			".gcsfuse_tmp/",
 			t.bucket),
 		"",
+		nil,
+		nil,
+		false, // Streaming writes
+		t.posixMetadata,
 		&t.clock)
 
 	t.in.Lock()
 }
 
+// A bucket that refuses to read objects' contents.
+type unreadableBucket struct {
+	gcs.Bucket
+}
+
+func (b *unreadableBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	err = fmt.Errorf("Unexpected read of %q", req.Name)
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Tests
 ////////////////////////////////////////////////////////////////////////
@@ -418,6 +440,88 @@ func (t *FileTest) AppendThenSync() {
 	ExpectThat(attrs.Mtime, timeutil.TimeEq(writeTime.UTC()))
 }
 
+func (t *FileTest) AppendDoesntReadSource() {
+	// Refuse to read the source object.
+	t.bucket = &unreadableBucket{t.bucket}
+	t.createInode()
+
+	// Append twice, then sync.
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	err = t.in.Write(t.ctx, []byte("enchilada"), int64(len("tacoburrito")))
+	AssertEq(nil, err)
+
+	ExpectTrue(t.in.Dirty())
+	ExpectEq(len("burritoenchilada"), t.in.DirtyBytes())
+	ExpectFalse(t.in.SourceGenerationIsAuthoritative())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburritoenchilada"), attrs.Size)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectFalse(t.in.Dirty())
+
+	// The object was composed.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: t.in.Name()})
+	AssertEq(nil, err)
+	ExpectEq(t.in.SourceGeneration().Object, o.Generation)
+	ExpectEq(2, o.ComponentCount)
+
+	contents, err := gcsutil.ReadObject(
+		t.ctx,
+		t.bucket.(*unreadableBucket).Bucket,
+		t.in.Name())
+
+	AssertEq(nil, err)
+	ExpectEq("tacoburritoenchilada", string(contents))
+}
+
+func (t *FileTest) AppendThenRead() {
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	buf := make([]byte, 1024)
+	n, err := t.in.Read(t.ctx, buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(buf[:n]))
+}
+
+func (t *FileTest) AppendThenOverwrite() {
+	var err error
+
+	// Append, then overwrite the start of the file.
+	t.clock.AdvanceTime(time.Second)
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Second)
+	writeTime := t.clock.Now()
+
+	err = t.in.Write(t.ctx, []byte("b"), 0)
+	AssertEq(nil, err)
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: t.in.Name()})
+	AssertEq(nil, err)
+	ExpectEq(
+		writeTime.UTC().Format(time.RFC3339Nano),
+		o.Metadata["gcsfuse_mtime"])
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("bacoburrito", string(contents))
+}
+
 func (t *FileTest) TruncateDownwardThenSync() {
 	var attrs fuseops.InodeAttributes
 	var err error
@@ -532,6 +636,38 @@ func (t *FileTest) Sync_Clobbered() {
 	ExpectEq(newObj.Size, o.Size)
 }
 
+func (t *FileTest) Dirty() {
+	var err error
+
+	// Initially clean.
+	ExpectFalse(t.in.Dirty())
+
+	// Reading doesn't change that.
+	buf := make([]byte, 4)
+	_, err = t.in.Read(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	ExpectFalse(t.in.Dirty())
+
+	// Writing does.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+	ExpectTrue(t.in.Dirty())
+
+	// Until we sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectFalse(t.in.Dirty())
+
+	// Destroyed inodes are never dirty.
+	err = t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+	AssertTrue(t.in.Dirty())
+
+	err = t.in.Destroy()
+	AssertEq(nil, err)
+	ExpectFalse(t.in.Dirty())
+}
+
 func (t *FileTest) SetMtime_ContentNotFaultedIn() {
 	var err error
 	var attrs fuseops.InodeAttributes
@@ -675,3 +811,86 @@ func (t *FileTest) SetMtime_SourceObjectMetaGenerationChanged() {
 	ExpectEq(newObj.Generation, o.Generation)
 	ExpectEq(newObj.MetaGeneration, o.MetaGeneration)
 }
+
+func (t *FileTest) SetPosixAttributes() {
+	var err error
+	var attrs fuseops.InodeAttributes
+
+	t.posixMetadata = true
+	t.createInode()
+
+	// Set the mode and owner.
+	mode := os.FileMode(0600) | os.ModeSetuid
+	owner := uint32(17)
+
+	err = t.in.SetPosixAttributes(t.ctx, &mode, &owner, nil)
+	AssertEq(nil, err)
+
+	// The inode should report them, and only the permission bits of the mode.
+	attrs, err = t.in.Attributes(t.ctx)
+
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0600), attrs.Mode)
+	ExpectEq(owner, attrs.Uid)
+	ExpectEq(gid, attrs.Gid)
+
+	// They should have been recorded in the backing object's metadata.
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+
+	AssertEq(nil, err)
+	ExpectEq("600", o.Metadata["gcsfuse_mode"])
+	ExpectEq("17", o.Metadata["gcsfuse_uid"])
+	_, ok := o.Metadata["gcsfuse_gid"]
+	ExpectFalse(ok)
+
+	// Writing out new contents should keep them.
+	err = t.in.Write(t.ctx, []byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	o, err = t.bucket.StatObject(t.ctx, statReq)
+
+	AssertEq(nil, err)
+	ExpectEq(t.in.SourceGeneration().Object, o.Generation)
+	ExpectEq("600", o.Metadata["gcsfuse_mode"])
+	ExpectEq("17", o.Metadata["gcsfuse_uid"])
+}
+
+func (t *FileTest) PosixMetadataIgnoredUnlessEnabled() {
+	t.backingObj.Metadata = map[string]string{
+		"gcsfuse_mode": "600",
+		"gcsfuse_uid":  "17",
+		"gcsfuse_gid":  "19",
+	}
+
+	t.createInode()
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq(fileMode, attrs.Mode)
+	ExpectEq(uid, attrs.Uid)
+	ExpectEq(gid, attrs.Gid)
+}
+
+func (t *FileTest) MalformedPosixMetadata() {
+	t.backingObj.Metadata = map[string]string{
+		"gcsfuse_mode": "taco",
+		"gcsfuse_uid":  "-1",
+		"gcsfuse_gid":  "19",
+	}
+
+	t.posixMetadata = true
+	t.createInode()
+
+	// Malformed values should be ignored.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq(fileMode, attrs.Mode)
+	ExpectEq(uid, attrs.Uid)
+	ExpectEq(19, attrs.Gid)
+}
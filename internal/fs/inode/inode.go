@@ -50,6 +50,11 @@ type Inode interface {
 	// after releasing locks that should not be held while blocking.
 	DecrementLookupCount(n uint64) (destroy bool)
 
+	// Discard anything the inode caches that can be fetched again from GCS,
+	// such as clean local copies of contents, keeping local modifications. For
+	// use when the inode hasn't been used in a while.
+	Trim()
+
 	// Clean up any local resources used by the inode, putting it into an
 	// indeterminate state where no method should be called except Unlock.
 	//
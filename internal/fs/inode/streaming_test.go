@@ -0,0 +1,269 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestStreaming(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that reads the contents of new objects before creating them. The
+// fake bucket holds its lock while reading contents, so without this the
+// inode couldn't stat its object while streaming to it.
+type bufferingBucket struct {
+	gcs.Bucket
+}
+
+func (b *bufferingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	contents, err := ioutil.ReadAll(req.Contents)
+	if err != nil {
+		return
+	}
+
+	reqCopy := *req
+	reqCopy.Contents = bytes.NewReader(contents)
+	o, err = b.Bucket.CreateObject(ctx, &reqCopy)
+	return
+}
+
+type StreamingTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+
+	backingObj *gcs.Object
+	in         *inode.FileInode
+}
+
+var _ SetUpInterface = &StreamingTest{}
+var _ TearDownInterface = &StreamingTest{}
+
+func init() { RegisterTestSuite(&StreamingTest{}) }
+
+func (t *StreamingTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.bucket = &bufferingBucket{
+		Bucket: gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+	}
+
+	// Set up an empty backing object, as for a newly created file.
+	t.createInode("")
+}
+
+func (t *StreamingTest) TearDown() {
+	t.in.Unlock()
+}
+
+func (t *StreamingTest) createInode(contents string) {
+	var err error
+	t.backingObj, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		fileInodeName,
+		[]byte(contents))
+
+	AssertEq(nil, err)
+
+	if t.in != nil {
+		t.in.Unlock()
+	}
+
+	t.in = inode.NewFileInode(
+		fileInodeID,
+		t.backingObj,
+		fuseops.InodeAttributes{
+			Uid:  uid,
+			Gid:  gid,
+			Mode: fileMode,
+		},
+		t.bucket,
+		gcsx.NewSyncer(
+			1, // Append threshold
+			0, // Parallel upload threshold
+			0, // Parallel upload parts
+			gcsx.UnchangedContentUpload,
+			".gcsfuse_tmp/",
+			t.bucket),
+		"",
+		nil,
+		nil,
+		true,  // Streaming writes
+		false, // POSIX metadata
+		&t.clock)
+
+	t.in.Lock()
+}
+
+func (t *StreamingTest) readObject() string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, fileInodeName)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+func (t *StreamingTest) write(s string, offset int64) {
+	err := t.in.Write(t.ctx, []byte(s), offset)
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StreamingTest) SequentialWrites() {
+	t.write("taco", 0)
+	t.write("burrito", 4)
+
+	// Nothing is visible in the bucket yet, but the inode knows what it holds.
+	ExpectEq("", t.readObject())
+	ExpectTrue(t.in.Dirty())
+	ExpectEq(len("tacoburrito"), t.in.DirtyBytes())
+	ExpectFalse(t.in.SourceGenerationIsAuthoritative())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), attrs.Size)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(t.clock.Now()))
+
+	// Syncing finishes the upload.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq("tacoburrito", t.readObject())
+	ExpectFalse(t.in.Dirty())
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+	ExpectNe(t.backingObj.Generation, t.in.SourceGeneration().Object)
+}
+
+func (t *StreamingTest) NonSequentialWrite() {
+	t.write("taco", 0)
+	t.write("p", 0)
+
+	// What was streamed so far has been written out, and the rest is local.
+	ExpectEq("taco", t.readObject())
+	ExpectTrue(t.in.Dirty())
+
+	err := t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq("paco", t.readObject())
+}
+
+func (t *StreamingTest) ReadWhileStreaming() {
+	t.write("taco", 0)
+
+	buf := make([]byte, 4)
+	n, err := t.in.Read(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(buf[:n]))
+
+	t.write("burrito", 4)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", t.readObject())
+}
+
+func (t *StreamingTest) ExistingContentsNotStreamed() {
+	t.createInode("taco")
+	t.write("s", 4)
+
+	// The write is staged locally rather than replacing the object.
+	ExpectEq("taco", t.readObject())
+
+	err := t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq("tacos", t.readObject())
+}
+
+func (t *StreamingTest) OverwriteAfterTruncating() {
+	t.createInode("taco")
+
+	err := t.in.Truncate(t.ctx, 0)
+	AssertEq(nil, err)
+
+	t.write("burrito", 0)
+	ExpectEq("taco", t.readObject())
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq("burrito", t.readObject())
+}
+
+func (t *StreamingTest) Clobbered() {
+	t.write("taco", 0)
+
+	// Another writer replaces the object.
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		fileInodeName,
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Syncing succeeds, as if the file had been unlinked, and leaves the other
+	// writer's contents alone.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq("burrito", t.readObject())
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+}
+
+func (t *StreamingTest) Destroy() {
+	t.write("taco", 0)
+
+	err := t.in.Destroy()
+	AssertEq(nil, err)
+
+	ExpectFalse(t.in.Dirty())
+	ExpectEq("", t.readObject())
+}
+
+func (t *StreamingTest) SetMtime() {
+	t.write("taco", 0)
+
+	mtime := time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)
+	err := t.in.SetMtime(t.ctx, mtime)
+	AssertEq(nil, err)
+
+	// The contents have been written out with the new mtime.
+	ExpectEq("taco", t.readObject())
+	ExpectFalse(t.in.Dirty())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(mtime))
+}
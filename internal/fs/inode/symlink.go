@@ -23,8 +23,10 @@ import (
 )
 
 // When this custom metadata key is present in an object record, it is to be
-// treated as a symlink. For use in testing only; other users should detect
-// this with IsSymlink.
+// treated as a symlink whose target is the key's value. The object's contents
+// are ignored (we write none). This is part of the documented format of a
+// bucket, shared by every mount of it, so it must not change; see
+// docs/semantics.md. Detect symlinks with IsSymlink.
 const SymlinkMetadataKey = "gcsfuse_symlink_target"
 
 // IsSymlink Does the supplied object represent a symlink inode?
@@ -63,7 +65,11 @@ func NewSymlinkInode(
 	id fuseops.InodeID,
 	o *gcs.Object,
 	attrs fuseops.InodeAttributes) (s *SymlinkInode) {
-	// Create the inode.
+	target := o.Metadata[SymlinkMetadataKey]
+
+	// Create the inode. As for symlinks on other file systems, the size is the
+	// length of the target, which some tools (notably on macOS) rely on when
+	// reading it.
 	s = &SymlinkInode{
 		id:   id,
 		name: o.Name,
@@ -73,12 +79,13 @@ func NewSymlinkInode(
 		},
 		attrs: fuseops.InodeAttributes{
 			Nlink: 1,
+			Size:  uint64(len(target)),
 			Uid:   attrs.Uid,
 			Gid:   attrs.Gid,
 			Mode:  attrs.Mode,
 			Mtime: o.Updated,
 		},
-		target: o.Metadata[SymlinkMetadataKey],
+		target: target,
 	}
 
 	// Set up lookup counting.
@@ -125,6 +132,11 @@ func (s *SymlinkInode) DecrementLookupCount(n uint64) (destroy bool) {
 	return
 }
 
+// LOCKS_REQUIRED(s.mu)
+func (s *SymlinkInode) Trim() {
+	// Nothing to do.
+}
+
 // LOCKS_REQUIRED(s.mu)
 func (s *SymlinkInode) Destroy() (err error) {
 	// Nothing to do.
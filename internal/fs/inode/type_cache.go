@@ -28,6 +28,10 @@ import (
 //  *  We have recorded that N is a directory.
 //  *  We have recorded that N is both a file and a directory.
 //
+// What is known about each name is kept in a single entry, so that the
+// capacity bounds the number of names and information about a name's types
+// is evicted together.
+//
 // Must be created with newTypeCache. May be contained in a larger struct.
 // External synchronization is required.
 type typeCache struct {
@@ -35,35 +39,65 @@ type typeCache struct {
 	// Constant data
 	/////////////////////////
 
-	ttl time.Duration
+	capacity int
+	ttl      time.Duration
 
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
-	// A cache mapping file names to the time at which the entry should expire.
+	// A cache mapping names to what we know about their types.
 	//
-	// INVARIANT: files.CheckInvariants() does not panic
-	// INVARIANT: Each value is of type time.Time
-	files lrucache.Cache
+	// INVARIANT: entries.CheckInvariants() does not panic
+	// INVARIANT: Each value is of type typeCacheEntry
+	entries lrucache.Cache
+}
 
-	// A cache mapping directory names to the time at which the entry should
-	// expire.
-	//
-	// INVARIANT: dirs.CheckInvariants() does not panic
-	// INVARIANT: Each value is of type time.Time
-	dirs lrucache.Cache
+// The times at which we stop believing that a name is a file and a directory,
+// each zero if we don't think it's one.
+type typeCacheEntry struct {
+	fileExpiration time.Time
+	dirExpiration  time.Time
 }
 
-// Create a cache whose information expires with the supplied TTL. If the TTL
-// is zero, nothing will ever be cached.
+// Create a cache holding information about up to the given number of names,
+// which expires with the supplied TTL. If the TTL is zero, nothing will ever
+// be cached.
 func newTypeCache(
-	perTypeCapacity int,
+	capacity int,
 	ttl time.Duration) (tc typeCache) {
 	tc = typeCache{
-		ttl:   ttl,
-		files: lrucache.New(perTypeCapacity),
-		dirs:  lrucache.New(perTypeCapacity),
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  lrucache.New(capacity),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the unexpired information about the supplied name, erasing the entry
+// if nothing is left.
+func (tc *typeCache) lookUp(now time.Time, name string) (e typeCacheEntry) {
+	val := tc.entries.LookUp(name)
+	if val == nil {
+		return
+	}
+
+	e = val.(typeCacheEntry)
+	if e.fileExpiration.Before(now) {
+		e.fileExpiration = time.Time{}
+	}
+
+	if e.dirExpiration.Before(now) {
+		e.dirExpiration = time.Time{}
+	}
+
+	if e.fileExpiration.IsZero() && e.dirExpiration.IsZero() {
+		tc.entries.Erase(name)
 	}
 
 	return
@@ -76,11 +110,8 @@ func newTypeCache(
 // Panic if any internal invariants have been violated. The careful user can
 // arrange to call this at crucial moments.
 func (tc *typeCache) CheckInvariants() {
-	// INVARIANT: files.CheckInvariants() does not panic
-	tc.files.CheckInvariants()
-
-	// INVARIANT: dirs.CheckInvariants() does not panic
-	tc.dirs.CheckInvariants()
+	// INVARIANT: entries.CheckInvariants() does not panic
+	tc.entries.CheckInvariants()
 }
 
 // Record that the supplied name is a file. It may still also be a directory.
@@ -90,7 +121,9 @@ func (tc *typeCache) NoteFile(now time.Time, name string) {
 		return
 	}
 
-	tc.files.Insert(name, now.Add(tc.ttl))
+	e := tc.lookUp(now, name)
+	e.fileExpiration = now.Add(tc.ttl)
+	tc.entries.Insert(name, e)
 }
 
 // Record that the supplied name is a directory. It may still also be a file.
@@ -100,55 +133,29 @@ func (tc *typeCache) NoteDir(now time.Time, name string) {
 		return
 	}
 
-	tc.dirs.Insert(name, now.Add(tc.ttl))
+	e := tc.lookUp(now, name)
+	e.dirExpiration = now.Add(tc.ttl)
+	tc.entries.Insert(name, e)
 }
 
 // Erase all information about the supplied name.
 func (tc *typeCache) Erase(name string) {
-	tc.files.Erase(name)
-	tc.dirs.Erase(name)
+	tc.entries.Erase(name)
+}
+
+// Erase all information about all names.
+func (tc *typeCache) Clear() {
+	tc.entries = lrucache.New(tc.capacity)
 }
 
 // Do we currently think the given name is a file?
 func (tc *typeCache) IsFile(now time.Time, name string) (res bool) {
-	// Is there an entry?
-	val := tc.files.LookUp(name)
-	if val == nil {
-		res = false
-		return
-	}
-
-	expiration := val.(time.Time)
-
-	// Has the entry expired?
-	if expiration.Before(now) {
-		tc.files.Erase(name)
-		res = false
-		return
-	}
-
-	res = true
+	res = !tc.lookUp(now, name).fileExpiration.IsZero()
 	return
 }
 
 // Do we currently think the given name is a directory?
 func (tc *typeCache) IsDir(now time.Time, name string) (res bool) {
-	// Is there an entry?
-	val := tc.dirs.LookUp(name)
-	if val == nil {
-		res = false
-		return
-	}
-
-	expiration := val.(time.Time)
-
-	// Has the entry expired?
-	if expiration.Before(now) {
-		tc.dirs.Erase(name)
-		res = false
-		return
-	}
-
-	res = true
+	res = !tc.lookUp(now, name).dirExpiration.IsZero()
 	return
 }
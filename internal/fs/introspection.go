@@ -0,0 +1,427 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+	"github.com/jacobsa/util/lrucache"
+)
+
+// How many recent ops to remember for each inode, and for how many inodes.
+const (
+	recentOpsPerInode = 16
+	recentOpsInodes   = 1024
+)
+
+// The internal state of an inode, as reported by Server.Inspect for
+// debugging.
+type InodeInfo struct {
+	ID   fuseops.InodeID `json:"id"`
+	Name string          `json:"name"`
+
+	// One of "file", "dir", or "symlink".
+	Type string `json:"type"`
+
+	// The generation of the object backing the inode, if any. Implicit
+	// directories have none.
+	Generation *inode.Generation `json:"generation,omitempty"`
+
+	// The attributes the inode would report to the kernel now, or the error
+	// obtaining them.
+	Attributes      *fuseops.InodeAttributes `json:"attributes,omitempty"`
+	AttributesError string                   `json:"attributes_error,omitempty"`
+
+	// For files, whether the inode holds modifications not yet written out to
+	// GCS.
+	Dirty bool `json:"dirty"`
+
+	// The number of open file or directory handles for the inode.
+	OpenHandles int `json:"open_handles"`
+
+	// The most recent ops for the inode, oldest first.
+	RecentOps []RecentOp `json:"recent_ops"`
+}
+
+// A fuse op recorded for an inode.
+type RecentOp struct {
+	Op       string        `json:"op"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// An open file handle, as reported by Server.OpenFiles.
+type OpenFileInfo struct {
+	Handle fuseops.HandleID `json:"handle"`
+
+	// The name of the object backing the file.
+	Name string `json:"name"`
+
+	// Whether the handle has been used to write to the file. The flags with
+	// which it was opened aren't known.
+	Written bool `json:"written"`
+
+	// Whether the file holds modifications not yet written out to GCS, and how
+	// many bytes of it may differ from the object in GCS. The file's state is
+	// shared by all of its handles.
+	Dirty      bool  `json:"dirty"`
+	DirtyBytes int64 `json:"dirty_bytes"`
+
+	Opened time.Time `json:"opened"`
+}
+
+// Convert a path relative to the root of the file system to the name of the
+// object backing it, ignoring whether it's a directory.
+func inspectedName(path string) string {
+	return strings.Trim(path, "/")
+}
+
+// Return the state of the inodes currently known to the kernel whose names
+// match the given path, which is relative to the root of the file system. A
+// path may match both a file and a directory, or several generations of the
+// same file when one was replaced while open.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) inspect(
+	ctx context.Context,
+	path string) (infos []InodeInfo) {
+	name := inspectedName(path)
+
+	// Find the matching inodes and count their handles.
+	fs.mu.Lock()
+
+	var matches []inode.Inode
+	for _, in := range fs.inodes {
+		n := in.Name()
+		if n == name || n == name+"/" {
+			matches = append(matches, in)
+		}
+	}
+
+	handles := make(map[fuseops.InodeID]int)
+	for _, h := range fs.handles {
+		switch h := h.(type) {
+		case *handle.FileHandle:
+			handles[h.Inode().ID()]++
+
+		case *dirHandle:
+			handles[h.in.ID()]++
+		}
+	}
+
+	fs.mu.Unlock()
+
+	// Fill in the details for each.
+	for _, in := range matches {
+		info := InodeInfo{
+			ID:          in.ID(),
+			Name:        in.Name(),
+			OpenHandles: handles[in.ID()],
+		}
+
+		switch in.(type) {
+		case *inode.FileInode:
+			info.Type = "file"
+		case *inode.SymlinkInode:
+			info.Type = "symlink"
+		default:
+			info.Type = "dir"
+		}
+
+		in.Lock()
+
+		if gb, ok := in.(inode.GenerationBackedInode); ok {
+			g := gb.SourceGeneration()
+			info.Generation = &g
+		}
+
+		if f, ok := in.(*inode.FileInode); ok {
+			info.Dirty = f.Dirty()
+		}
+
+		attrs, err := in.Attributes(ctx)
+		if err != nil {
+			info.AttributesError = err.Error()
+		} else {
+			info.Attributes = &attrs
+		}
+
+		in.Unlock()
+
+		infos = append(infos, info)
+	}
+
+	return
+}
+
+// Return the file handles currently open, in order of handle ID.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) openFiles() (files []OpenFileInfo) {
+	// Snapshot the handles.
+	fs.mu.Lock()
+
+	var ids []fuseops.HandleID
+	for id, h := range fs.handles {
+		if _, ok := h.(*handle.FileHandle); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	handles := make([]*handle.FileHandle, len(ids))
+	for i, id := range ids {
+		handles[i] = fs.handles[id].(*handle.FileHandle)
+	}
+
+	fs.mu.Unlock()
+
+	// Fill in the details for each.
+	for i, fh := range handles {
+		info := OpenFileInfo{
+			Handle: ids[i],
+			Name:   fh.Inode().Name(),
+			Opened: fh.Opened(),
+		}
+
+		fh.Lock()
+		info.Written = fh.Written()
+		fh.Unlock()
+
+		in := fh.Inode()
+		in.Lock()
+		info.Dirty = in.Dirty()
+		info.DirtyBytes = in.DirtyBytes()
+		in.Unlock()
+
+		files = append(files, info)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// opRecordingFileSystem
+////////////////////////////////////////////////////////////////////////
+
+// A wrapper around a file system that remembers the most recent ops for each
+// inode, for Server.Inspect to report. Ops that don't refer to an existing
+// inode aren't recorded.
+type opRecordingFileSystem struct {
+	fuseutil.FileSystem
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// The recent ops for recently used inodes, keyed by formatted inode ID.
+	// Values are of type []RecentOp.
+	//
+	// GUARDED_BY(mu)
+	recent lrucache.Cache
+}
+
+func newOpRecordingFileSystem(
+	wrapped fuseutil.FileSystem,
+	clock timeutil.Clock) (fs *opRecordingFileSystem) {
+	fs = &opRecordingFileSystem{
+		FileSystem: wrapped,
+		clock:      clock,
+		recent:     lrucache.New(recentOpsInodes),
+	}
+
+	return
+}
+
+// Return the recent ops for the given inode, oldest first.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *opRecordingFileSystem) RecentOps(
+	id fuseops.InodeID) (ops []RecentOp) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	recent, _ := fs.recent.LookUp(inodeKey(id)).([]RecentOp)
+	ops = append(ops, recent...)
+	return
+}
+
+func inodeKey(id fuseops.InodeID) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// Run f, recording it as an op with the given name for the inode returned by
+// getID after it has finished.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *opRecordingFileSystem) run(
+	name string,
+	getID func() fuseops.InodeID,
+	f func() error) (err error) {
+	start := fs.clock.Now()
+	err = f()
+
+	op := RecentOp{
+		Op:       name,
+		Start:    start,
+		Duration: fs.clock.Now().Sub(start),
+	}
+
+	if err != nil {
+		op.Error = err.Error()
+	}
+
+	id := getID()
+	if id == 0 {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key := inodeKey(id)
+	recent, _ := fs.recent.LookUp(key).([]RecentOp)
+	recent = append(recent, op)
+	if len(recent) > recentOpsPerInode {
+		recent = recent[len(recent)-recentOpsPerInode:]
+	}
+
+	fs.recent.Insert(key, recent)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// fuseutil.FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *opRecordingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.run(
+		"LookUpInode",
+		func() fuseops.InodeID { return op.Entry.Child },
+		func() error { return fs.FileSystem.LookUpInode(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.run(
+		"GetInodeAttributes",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.GetInodeAttributes(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.run(
+		"SetInodeAttributes",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.SetInodeAttributes(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return fs.run(
+		"ForgetInode",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.ForgetInode(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.run(
+		"OpenDir",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.OpenDir(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.run(
+		"ReadDir",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.ReadDir(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return fs.run(
+		"OpenFile",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.OpenFile(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.run(
+		"ReadFile",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.ReadFile(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.run(
+		"WriteFile",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.WriteFile(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.run(
+		"SyncFile",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.SyncFile(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.run(
+		"FlushFile",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.FlushFile(ctx, op) })
+}
+
+func (fs *opRecordingFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.run(
+		"ReadSymlink",
+		func() fuseops.InodeID { return op.Inode },
+		func() error { return fs.FileSystem.ReadSymlink(ctx, op) })
+}
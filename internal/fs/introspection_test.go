@@ -0,0 +1,154 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type InspectTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&InspectTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *InspectTest) UnknownPath() {
+	infos := t.server.Inspect(t.ctx, "foo")
+	ExpectEq(0, len(infos))
+}
+
+func (t *InspectTest) CleanFile() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	infos := t.server.Inspect(t.ctx, "/foo")
+	AssertEq(1, len(infos))
+
+	info := infos[0]
+	ExpectEq("foo", info.Name)
+	ExpectEq("file", info.Type)
+	AssertNe(nil, info.Generation)
+	ExpectEq(o.Generation, info.Generation.Object)
+	AssertNe(nil, info.Attributes)
+	ExpectEq(len("taco"), info.Attributes.Size)
+	ExpectFalse(info.Dirty)
+	ExpectEq(0, info.OpenHandles)
+
+	var ops []string
+	for _, op := range info.RecentOps {
+		ops = append(ops, op.Op)
+	}
+
+	ExpectThat(ops, Contains("LookUpInode"))
+}
+
+func (t *InspectTest) DirtyFile() {
+	var err error
+	t.f1, err = os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	infos := t.server.Inspect(t.ctx, "foo")
+	AssertEq(1, len(infos))
+
+	info := infos[0]
+	ExpectTrue(info.Dirty)
+	ExpectEq(1, info.OpenHandles)
+	AssertNe(nil, info.Attributes)
+	ExpectEq(len("taco"), info.Attributes.Size)
+
+	var ops []string
+	for _, op := range info.RecentOps {
+		ops = append(ops, op.Op)
+	}
+
+	ExpectThat(ops, Contains("WriteFile"))
+}
+
+func (t *InspectTest) Directory() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	infos := t.server.Inspect(t.ctx, "dir/")
+	AssertEq(1, len(infos))
+	ExpectEq("dir/", infos[0].Name)
+	ExpectEq("dir", infos[0].Type)
+	ExpectEq(0, infos[0].OpenHandles)
+}
+
+func (t *InspectTest) OpenFiles() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	ExpectEq(0, len(t.server.OpenFiles()))
+
+	t.f1, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	files := t.server.OpenFiles()
+	AssertEq(1, len(files))
+	ExpectEq("foo", files[0].Name)
+	ExpectFalse(files[0].Written)
+	ExpectFalse(files[0].Dirty)
+	ExpectEq(0, files[0].DirtyBytes)
+}
+
+func (t *InspectTest) Stats() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	s := t.server.Stats()
+	ExpectLe(1, s.Ops["LookUpInode"].Count)
+	ExpectLe(1, s.Ops["ReadFile"].Count)
+	ExpectEq(0, s.Ops["WriteFile"].Count)
+	ExpectEq(len("taco"), s.BytesRead)
+	ExpectEq(0, s.BytesWritten)
+	ExpectEq(0, len(s.InFlight))
+	ExpectEq(0, s.DirtyFiles)
+
+	// The root and foo.
+	ExpectEq(2, s.Inodes)
+}
+
+func (t *InspectTest) StatsCountErrors() {
+	_, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertTrue(os.IsNotExist(err))
+
+	s := t.server.Stats()
+	ExpectLe(1, s.Ops["LookUpInode"].Errors)
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const leasePrefix = ".gcsfuse_leases/"
+
+type LeasesTest struct {
+	fsTest
+
+	// Leases held by another client of the bucket.
+	other *gcsx.LeaseManager
+}
+
+func init() { RegisterTestSuite(&LeasesTest{}) }
+
+func (t *LeasesTest) SetUp(ti *TestInfo) {
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.serverCfg.Leases = gcsx.NewLeaseManager(
+		t.bucket,
+		leasePrefix,
+		time.Minute,
+		timeutil.RealClock())
+
+	t.other = gcsx.NewLeaseManager(
+		t.bucket,
+		leasePrefix,
+		time.Minute,
+		timeutil.RealClock())
+
+	t.fsTest.SetUp(ti)
+}
+
+func (t *LeasesTest) leaseExists(name string) bool {
+	_, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: leasePrefix + name})
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return false
+	}
+
+	AssertEq(nil, err)
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LeasesTest) CreateTakesLease() {
+	var err error
+	t.f1, err = os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	ExpectTrue(t.leaseExists("foo"))
+	ExpectThat(t.serverCfg.Leases.Held(), ElementsAre("foo"))
+}
+
+func (t *LeasesTest) CloseReleasesLease() {
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	AssertEq(nil, f.Close())
+
+	// The release happens after close returns.
+	deadline := time.Now().Add(time.Second)
+	for t.leaseExists("foo") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ExpectFalse(t.leaseExists("foo"))
+}
+
+func (t *LeasesTest) CreateLeasedByOther() {
+	AssertEq(nil, t.other.Acquire(t.ctx, "foo"))
+
+	_, err := os.Create(path.Join(t.Dir, "foo"))
+	ExpectThat(err, Error(HasSubstr("busy")))
+
+	// Nothing should have been created.
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *LeasesTest) WriteLeasedByOther() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	AssertEq(nil, t.other.Acquire(t.ctx, "foo"))
+
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_WRONLY, 0)
+	AssertEq(nil, err)
+
+	// With writeback caching, the kernel doesn't send the write until the file
+	// is synced.
+	_, err = t.f1.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	err = t.f1.Sync()
+	ExpectThat(err, Error(HasSubstr("busy")))
+}
+
+func (t *LeasesTest) TruncateLeasedByOther() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	AssertEq(nil, t.other.Acquire(t.ctx, "foo"))
+
+	err = os.Truncate(path.Join(t.Dir, "foo"), 2)
+	ExpectEq(syscall.EBUSY, err.(*os.PathError).Err)
+}
+
+func (t *LeasesTest) ReadLeasedByOther() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	AssertEq(nil, t.other.Acquire(t.ctx, "foo"))
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// A Unicode normalization form for the names of files and directories.
+//
+// The same name may be spelled with different code points: OS X tends to
+// decompose accented characters (NFD) where Linux programs usually leave them
+// precomposed (NFC). GCS compares object names byte by byte, so without
+// normalization a file written on one system may be invisible by name to the
+// other, and writing it again creates a second object that looks identical.
+type NameForm string
+
+const (
+	// Use names exactly as given.
+	NameFormNone NameForm = ""
+
+	NameFormNFC NameForm = "nfc"
+	NameFormNFD NameForm = "nfd"
+)
+
+// Validate returns an error if the form is unknown.
+func (f NameForm) Validate() (err error) {
+	switch f {
+	case NameFormNone, NameFormNFC, NameFormNFD:
+	default:
+		err = fmt.Errorf("Unknown name form %q", f)
+		return
+	}
+
+	return
+}
+
+// Return the name in this form.
+func (f NameForm) normalize(name string) string {
+	switch f {
+	case NameFormNFC:
+		return norm.NFC.String(name)
+
+	case NameFormNFD:
+		return norm.NFD.String(name)
+	}
+
+	return name
+}
+
+// Return the names under which a child named name may be stored, in the order
+// they should be tried: this form first, then the name as given, then the
+// other form. Names stored before normalization was turned on, or by other
+// clients, are thus still found. Duplicates are omitted, so for names that
+// are the same in every form (e.g. ASCII names) there is exactly one.
+func (f NameForm) candidates(name string) (names []string) {
+	if f == NameFormNone {
+		names = []string{name}
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, n := range []string{
+		f.normalize(name),
+		name,
+		norm.NFC.String(name),
+		norm.NFD.String(name),
+	} {
+		if !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+
+	return
+}
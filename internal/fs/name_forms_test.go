@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+// "café", precomposed and decomposed.
+const (
+	nfcName = "caf\u00e9"
+	nfdName = "cafe\u0301"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type NameFormTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&NameFormTest{}) }
+
+func (t *NameFormTest) SetUp(ti *TestInfo) {
+	t.serverCfg.NameForm = fs.NameFormNFC
+	t.fsTest.SetUp(ti)
+}
+
+func (t *NameFormTest) objectExists(name string) bool {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return false
+	}
+
+	AssertEq(nil, err)
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *NameFormTest) LookUpInEitherForm() {
+	AssertEq(nil, t.createWithContents(nfdName, "taco"))
+
+	fi, err := os.Stat(path.Join(t.Dir, nfcName))
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), fi.Size())
+
+	fi, err = os.Stat(path.Join(t.Dir, nfdName))
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), fi.Size())
+}
+
+func (t *NameFormTest) MkDirNormalizes() {
+	err := os.Mkdir(path.Join(t.Dir, nfdName), 0700)
+	AssertEq(nil, err)
+
+	ExpectTrue(t.objectExists(nfcName + "/"))
+	ExpectFalse(t.objectExists(nfdName + "/"))
+
+	fi, err := os.Stat(path.Join(t.Dir, nfdName))
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+}
+
+func (t *NameFormTest) MkDirOverOtherForm() {
+	AssertEq(nil, t.createEmptyObjects([]string{nfdName + "/"}))
+
+	// The existing directory should be found rather than duplicated.
+	err := os.Mkdir(path.Join(t.Dir, nfcName), 0700)
+	ExpectTrue(os.IsExist(err), "err: %v", err)
+	ExpectFalse(t.objectExists(nfcName + "/"))
+}
+
+func (t *NameFormTest) RemoveStoredInOtherForm() {
+	AssertEq(nil, t.createWithContents(nfdName, "taco"))
+
+	err := os.Remove(path.Join(t.Dir, nfcName))
+	AssertEq(nil, err)
+	ExpectFalse(t.objectExists(nfdName))
+}
+
+func (t *NameFormTest) RmDirStoredInOtherForm() {
+	AssertEq(nil, t.createEmptyObjects([]string{nfdName + "/"}))
+
+	err := os.Remove(path.Join(t.Dir, nfcName))
+	AssertEq(nil, err)
+	ExpectFalse(t.objectExists(nfdName + "/"))
+}
+
+func (t *NameFormTest) Rename() {
+	AssertEq(nil, t.createWithContents(nfdName, "taco"))
+
+	err := os.Rename(path.Join(t.Dir, nfcName), path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectFalse(t.objectExists(nfdName))
+	ExpectTrue(t.objectExists("foo"))
+
+	err = os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, nfdName))
+	AssertEq(nil, err)
+	ExpectFalse(t.objectExists("foo"))
+	ExpectTrue(t.objectExists(nfcName))
+}
+
+func (t *NameFormTest) AsciiNamesUnaffected() {
+	err := os.Mkdir(path.Join(t.Dir, "taco"), 0700)
+	AssertEq(nil, err)
+
+	ExpectTrue(t.objectExists("taco/"))
+
+	_, err = os.Stat(path.Join(t.Dir, "burrito"))
+	ExpectThat(err, Error(HasSubstr("no such file")))
+}
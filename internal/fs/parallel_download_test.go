@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ParallelDownloadTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&ParallelDownloadTest{}) }
+
+func (t *ParallelDownloadTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ParallelDownloadThreshold = 1 << 20
+	t.serverCfg.ParallelDownloadChunkSize = 256 << 10
+	t.serverCfg.ParallelDownloadParallelism = 3
+
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ParallelDownloadTest) LargeFile() {
+	contents := bytes.Repeat([]byte("0123456789"), 1<<20)
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	actual, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents, actual))
+}
+
+func (t *ParallelDownloadTest) SmallFile() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	actual, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(actual))
+}
+
+func (t *ParallelDownloadTest) RandomReads() {
+	contents := bytes.Repeat([]byte("0123456789"), 1<<20)
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	buf := make([]byte, 100)
+	for _, offset := range []int64{9 << 20, 17, 5<<20 - 50, 3 << 20} {
+		n, err := f.ReadAt(buf, offset)
+		AssertEq(nil, err)
+		ExpectTrue(bytes.Equal(contents[offset:offset+100], buf[:n]))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Read-ahead
+////////////////////////////////////////////////////////////////////////
+
+type ReadAheadTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&ReadAheadTest{}) }
+
+func (t *ReadAheadTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ReadAheadWindow = 1 << 20
+	t.serverCfg.ReadAheadTrigger = 2
+
+	t.fsTest.SetUp(ti)
+}
+
+func (t *ReadAheadTest) SequentialReads() {
+	contents := bytes.Repeat([]byte("0123456789"), 1<<20)
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	actual, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents, actual))
+}
+
+func (t *ReadAheadTest) SeekAfterSequentialReads() {
+	contents := bytes.Repeat([]byte("0123456789"), 1<<20)
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	buf := make([]byte, 100)
+	for _, offset := range []int64{0, 100, 200, 300, 7 << 20, 17} {
+		n, err := f.ReadAt(buf, offset)
+		AssertEq(nil, err)
+		ExpectTrue(bytes.Equal(contents[offset:offset+100], buf[:n]))
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PosixMetadataTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&PosixMetadataTest{}) }
+
+func (t *PosixMetadataTest) SetUp(ti *TestInfo) {
+	t.serverCfg.PreservePosixMetadata = true
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PosixMetadataTest) ExistingMetadata() {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name: "foo",
+			Metadata: map[string]string{
+				"gcsfuse_mode": "600",
+				"gcsfuse_uid":  "17",
+				"gcsfuse_gid":  "19",
+			},
+			Contents: ioutil.NopCloser(strings.NewReader("taco")),
+		})
+
+	AssertEq(nil, err)
+
+	fi, err := os.Lstat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	ExpectEq(os.FileMode(0600), fi.Mode())
+	ExpectEq(17, fi.Sys().(*syscall.Stat_t).Uid)
+	ExpectEq(19, fi.Sys().(*syscall.Stat_t).Gid)
+}
+
+func (t *PosixMetadataTest) ChmodAndChown() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	p := path.Join(t.Dir, "foo")
+
+	err = os.Chmod(p, 0640)
+	AssertEq(nil, err)
+
+	err = os.Lchown(p, 17, 19)
+	AssertEq(nil, err)
+
+	// The file system should report the changes.
+	fi, err := os.Lstat(p)
+	AssertEq(nil, err)
+
+	ExpectEq(os.FileMode(0640), fi.Mode())
+	ExpectEq(17, fi.Sys().(*syscall.Stat_t).Uid)
+	ExpectEq(19, fi.Sys().(*syscall.Stat_t).Gid)
+
+	// And they should have been recorded in the object's metadata.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	ExpectEq("640", o.Metadata["gcsfuse_mode"])
+	ExpectEq("17", o.Metadata["gcsfuse_uid"])
+	ExpectEq("19", o.Metadata["gcsfuse_gid"])
+}
+
+func (t *PosixMetadataTest) DirectoriesUnaffected() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "dir/", []byte{})
+	AssertEq(nil, err)
+
+	p := path.Join(t.Dir, "dir")
+
+	err = os.Chmod(p, 0700)
+	AssertEq(nil, err)
+
+	fi, err := os.Lstat(p)
+	AssertEq(nil, err)
+	ExpectEq(dirPerms|os.ModeDir, fi.Mode())
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RenameDirTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&RenameDirTest{}) }
+
+func (t *RenameDirTest) SetUp(ti *TestInfo) {
+	t.serverCfg.RenameDirLimit = 4
+	t.fsTest.SetUp(ti)
+}
+
+func (t *RenameDirTest) objectExists(name string) bool {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return false
+	}
+
+	AssertEq(nil, err)
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RenameDirTest) Directory() {
+	AssertEq(
+		nil,
+		t.createObjects(
+			map[string]string{
+				"foo/":           "",
+				"foo/bar":        "taco",
+				"foo/baz/":       "",
+				"foo/baz/qux":    "burrito",
+				"food/":          "",
+				"food/enchilada": "",
+			}))
+
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "taco"))
+	AssertEq(nil, err)
+
+	// The objects should have moved.
+	for _, name := range []string{"", "bar", "baz/", "baz/qux"} {
+		ExpectFalse(t.objectExists("foo/"+name), "%s", name)
+		ExpectTrue(t.objectExists("taco/"+name), "%s", name)
+	}
+
+	// Objects that merely share a prefix with the directory should not.
+	ExpectTrue(t.objectExists("food/"))
+	ExpectTrue(t.objectExists("food/enchilada"))
+
+	// The file system should agree.
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("food", entries[0].Name())
+	ExpectEq("taco", entries[1].Name())
+
+	fi, err := os.Stat(path.Join(t.Dir, "taco/baz/qux"))
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), fi.Size())
+
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *RenameDirTest) OverEmptyDirectory() {
+	AssertEq(
+		nil,
+		t.createObjects(
+			map[string]string{
+				"foo/":    "",
+				"foo/bar": "taco",
+				"baz/":    "",
+			}))
+
+	// os.Rename refuses to replace directories, so use the system call.
+	err := syscall.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "baz"))
+	AssertEq(nil, err)
+
+	ExpectFalse(t.objectExists("foo/"))
+	ExpectFalse(t.objectExists("foo/bar"))
+	ExpectTrue(t.objectExists("baz/"))
+	ExpectTrue(t.objectExists("baz/bar"))
+}
+
+func (t *RenameDirTest) OverNonEmptyDirectory() {
+	AssertEq(
+		nil,
+		t.createObjects(
+			map[string]string{
+				"foo/":    "",
+				"foo/bar": "taco",
+				"baz/":    "",
+				"baz/qux": "burrito",
+			}))
+
+	// os.Rename refuses to replace directories, so use the system call.
+	err := syscall.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "baz"))
+	ExpectEq(syscall.ENOTEMPTY, err)
+
+	ExpectTrue(t.objectExists("foo/bar"))
+	ExpectTrue(t.objectExists("baz/qux"))
+	ExpectFalse(t.objectExists("baz/bar"))
+}
+
+func (t *RenameDirTest) TooManyObjects() {
+	AssertEq(
+		nil,
+		t.createObjects(
+			map[string]string{
+				"foo/":  "",
+				"foo/a": "",
+				"foo/b": "",
+				"foo/c": "",
+				"foo/d": "",
+			}))
+
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	ExpectThat(err, Error(HasSubstr("cross-device")))
+
+	// Nothing should have been copied.
+	ExpectTrue(t.objectExists("foo/a"))
+	ExpectFalse(t.objectExists("bar/"))
+	ExpectFalse(t.objectExists("bar/a"))
+}
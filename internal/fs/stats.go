@@ -0,0 +1,528 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// Counts of the ops of one type served since the file system was mounted, as
+// reported by Server.Stats.
+type OpStats struct {
+	Count  uint64 `json:"count"`
+	Errors uint64 `json:"errors"`
+
+	// The total time spent serving them.
+	Duration time.Duration `json:"duration"`
+}
+
+// An op that the file system is still serving.
+type InFlightOp struct {
+	Op    string    `json:"op"`
+	Start time.Time `json:"start"`
+
+	// The name of the object the op refers to, if known. For ops that name a
+	// child of a directory, this is the name of the child.
+	Name string `json:"name,omitempty"`
+}
+
+// Counters describing the activity of the file system, as reported by
+// Server.Stats. Rates can be computed from the difference between two
+// snapshots.
+type Stats struct {
+	// When counting began.
+	Since time.Time `json:"since"`
+
+	// Completed ops, keyed by type, e.g. "ReadFile".
+	Ops map[string]OpStats `json:"ops"`
+
+	// Bytes of file contents returned by reads and accepted by writes.
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+
+	// Ops still being served, oldest first.
+	InFlight []InFlightOp `json:"in_flight"`
+
+	// The number of files holding modifications not yet written out to GCS.
+	DirtyFiles int `json:"dirty_files"`
+
+	// The numbers of inodes and of open file and directory handles.
+	Inodes  int `json:"inodes"`
+	Handles int `json:"handles"`
+}
+
+// A wrapper around a file system that counts the ops it serves and keeps
+// track of those still in flight, for Server.Stats to report.
+type statsFileSystem struct {
+	fuseutil.FileSystem
+	clock timeutil.Clock
+	since time.Time
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	ops          map[string]OpStats
+	bytesRead    int64
+	bytesWritten int64
+
+	// Ops in flight, keyed by an ID assigned when they started.
+	//
+	// GUARDED_BY(mu)
+	inFlight     map[uint64]inFlightOp
+	nextInFlight uint64
+}
+
+// An op in flight. The inode is resolved to a name only when reporting, since
+// doing so requires the file system lock.
+type inFlightOp struct {
+	op    string
+	start time.Time
+	inode fuseops.InodeID
+	child string
+}
+
+func newStatsFileSystem(
+	wrapped fuseutil.FileSystem,
+	clock timeutil.Clock) (fs *statsFileSystem) {
+	fs = &statsFileSystem{
+		FileSystem: wrapped,
+		clock:      clock,
+		since:      clock.Now(),
+		ops:        make(map[string]OpStats),
+		inFlight:   make(map[uint64]inFlightOp),
+	}
+
+	return
+}
+
+// Return a snapshot of the counters, with in-flight ops ordered oldest first
+// and named using the supplied function, which returns the name of the inode
+// with the given ID or false if it is unknown.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *statsFileSystem) Stats(
+	inodeName func(fuseops.InodeID) (string, bool)) (s Stats) {
+	fs.mu.Lock()
+
+	s = Stats{
+		Since:        fs.since,
+		Ops:          make(map[string]OpStats, len(fs.ops)),
+		BytesRead:    fs.bytesRead,
+		BytesWritten: fs.bytesWritten,
+	}
+
+	for k, v := range fs.ops {
+		s.Ops[k] = v
+	}
+
+	inFlight := make([]inFlightOp, 0, len(fs.inFlight))
+	for _, op := range fs.inFlight {
+		inFlight = append(inFlight, op)
+	}
+
+	fs.mu.Unlock()
+
+	sort.Slice(inFlight, func(i, j int) bool {
+		return inFlight[i].start.Before(inFlight[j].start)
+	})
+
+	for _, op := range inFlight {
+		info := InFlightOp{
+			Op:    op.op,
+			Start: op.start,
+		}
+
+		if op.inode != 0 {
+			if name, ok := inodeName(op.inode); ok {
+				info.Name = name
+				if op.child != "" {
+					info.Name = childName(name, op.child)
+				}
+			}
+		}
+
+		s.InFlight = append(s.InFlight, info)
+	}
+
+	return
+}
+
+// The object name of the named child of the directory with the given object
+// name, which is empty for the root.
+func childName(dir string, child string) string {
+	if dir == "" || dir[len(dir)-1] == '/' {
+		return dir + child
+	}
+
+	return dir + "/" + child
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *statsFileSystem) addBytes(read int64, written int64) {
+	fs.mu.Lock()
+	fs.bytesRead += read
+	fs.bytesWritten += written
+	fs.mu.Unlock()
+}
+
+// Run f as an op with the given name, referring to the given inode or to the
+// named child of it. An inode of zero means the op refers to none.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *statsFileSystem) run(
+	name string,
+	inode fuseops.InodeID,
+	child string,
+	f func() error) (err error) {
+	start := fs.clock.Now()
+
+	fs.mu.Lock()
+	id := fs.nextInFlight
+	fs.nextInFlight++
+	fs.inFlight[id] = inFlightOp{
+		op:    name,
+		start: start,
+		inode: inode,
+		child: child,
+	}
+	fs.mu.Unlock()
+
+	err = f()
+
+	duration := fs.clock.Now().Sub(start)
+	if logger.Enabled(logger.Debug) {
+		logOp(name, inode, child, duration, err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.inFlight, id)
+
+	s := fs.ops[name]
+	s.Count++
+	if err != nil {
+		s.Errors++
+	}
+
+	s.Duration += duration
+	fs.ops[name] = s
+
+	return
+}
+
+// Log an op that has been served, with its latency and any error.
+func logOp(
+	name string,
+	inode fuseops.InodeID,
+	child string,
+	duration time.Duration,
+	err error) {
+	fields := []interface{}{"op", name, "inode", inode}
+	if child != "" {
+		fields = append(fields, "name", child)
+	}
+
+	fields = append(fields, "latency", duration)
+	if err != nil {
+		fields = append(fields, "error", err)
+	}
+
+	logger.Log(logger.Debug, "Served op", fields...)
+}
+
+////////////////////////////////////////////////////////////////////////
+// fuseutil.FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *statsFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.run(
+		"StatFS",
+		0,
+		"",
+		func() error { return fs.FileSystem.StatFS(ctx, op) })
+}
+
+func (fs *statsFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.run(
+		"LookUpInode",
+		op.Parent,
+		op.Name,
+		func() error { return fs.FileSystem.LookUpInode(ctx, op) })
+}
+
+func (fs *statsFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.run(
+		"GetInodeAttributes",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.GetInodeAttributes(ctx, op) })
+}
+
+func (fs *statsFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.run(
+		"SetInodeAttributes",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.SetInodeAttributes(ctx, op) })
+}
+
+func (fs *statsFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return fs.run(
+		"ForgetInode",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.ForgetInode(ctx, op) })
+}
+
+func (fs *statsFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.run(
+		"MkDir",
+		op.Parent,
+		op.Name,
+		func() error { return fs.FileSystem.MkDir(ctx, op) })
+}
+
+func (fs *statsFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.run(
+		"MkNode",
+		op.Parent,
+		op.Name,
+		func() error { return fs.FileSystem.MkNode(ctx, op) })
+}
+
+func (fs *statsFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.run(
+		"CreateFile",
+		op.Parent,
+		op.Name,
+		func() error { return fs.FileSystem.CreateFile(ctx, op) })
+}
+
+func (fs *statsFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.run(
+		"CreateSymlink",
+		op.Parent,
+		op.Name,
+		func() error { return fs.FileSystem.CreateSymlink(ctx, op) })
+}
+
+func (fs *statsFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.run(
+		"Rename",
+		op.OldParent,
+		op.OldName,
+		func() error { return fs.FileSystem.Rename(ctx, op) })
+}
+
+func (fs *statsFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.run(
+		"RmDir",
+		op.Parent,
+		op.Name,
+		func() error { return fs.FileSystem.RmDir(ctx, op) })
+}
+
+func (fs *statsFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.run(
+		"Unlink",
+		op.Parent,
+		op.Name,
+		func() error { return fs.FileSystem.Unlink(ctx, op) })
+}
+
+func (fs *statsFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.run(
+		"OpenDir",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.OpenDir(ctx, op) })
+}
+
+func (fs *statsFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.run(
+		"ReadDir",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.ReadDir(ctx, op) })
+}
+
+func (fs *statsFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return fs.run(
+		"ReleaseDirHandle",
+		0,
+		"",
+		func() error { return fs.FileSystem.ReleaseDirHandle(ctx, op) })
+}
+
+func (fs *statsFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return fs.run(
+		"OpenFile",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.OpenFile(ctx, op) })
+}
+
+func (fs *statsFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.run(
+		"ReadFile",
+		op.Inode,
+		"",
+		func() (err error) {
+			err = fs.FileSystem.ReadFile(ctx, op)
+			fs.addBytes(int64(op.BytesRead), 0)
+			return
+		})
+}
+
+func (fs *statsFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.run(
+		"WriteFile",
+		op.Inode,
+		"",
+		func() (err error) {
+			err = fs.FileSystem.WriteFile(ctx, op)
+			if err == nil {
+				fs.addBytes(0, int64(len(op.Data)))
+			}
+
+			return
+		})
+}
+
+func (fs *statsFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.run(
+		"SyncFile",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.SyncFile(ctx, op) })
+}
+
+func (fs *statsFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.run(
+		"FlushFile",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.FlushFile(ctx, op) })
+}
+
+func (fs *statsFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return fs.run(
+		"ReleaseFileHandle",
+		0,
+		"",
+		func() error { return fs.FileSystem.ReleaseFileHandle(ctx, op) })
+}
+
+func (fs *statsFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.run(
+		"ReadSymlink",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.ReadSymlink(ctx, op) })
+}
+
+func (fs *statsFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.run(
+		"RemoveXattr",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.RemoveXattr(ctx, op) })
+}
+
+func (fs *statsFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.run(
+		"GetXattr",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.GetXattr(ctx, op) })
+}
+
+func (fs *statsFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.run(
+		"ListXattr",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.ListXattr(ctx, op) })
+}
+
+func (fs *statsFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.run(
+		"SetXattr",
+		op.Inode,
+		"",
+		func() error { return fs.FileSystem.SetXattr(ctx, op) })
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"container/list"
+	"expvar"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// Inodes can't be dropped while the kernel still refers to them, which for a
+// mount that touches many objects may be a long time. What can be dropped is
+// the state they cache: clean copies of file contents and directory type
+// caches. Similarly, open file handles hold on to readers streaming from GCS
+// until they are closed.
+//
+// So the file system keeps track of the inodes and handles used least
+// recently, and periodically trims those beyond the configured limits.
+
+// How often the file system trims inodes and handles beyond its limits.
+const trimPeriod = time.Second
+
+var (
+	inodesTrimmed  = expvar.NewInt("inodes_trimmed")
+	readersDropped = expvar.NewInt("readers_dropped")
+)
+
+// A trimList records the order in which keys were last used.
+//
+// External synchronization is required.
+type trimList struct {
+	// Keys, most recently used at the front.
+	//
+	// INVARIANT: For each k/v in index, v.Value == k
+	// INVARIANT: index has an entry for each element of order
+	order list.List
+	index map[interface{}]*list.Element
+}
+
+func newTrimList() (tl *trimList) {
+	tl = &trimList{
+		index: make(map[interface{}]*list.Element),
+	}
+
+	return
+}
+
+// Record that the supplied key has just been used.
+func (tl *trimList) Touch(k interface{}) {
+	if e, ok := tl.index[k]; ok {
+		tl.order.MoveToFront(e)
+		return
+	}
+
+	tl.index[k] = tl.order.PushFront(k)
+}
+
+// Forget about the supplied key, if it is present.
+func (tl *trimList) Remove(k interface{}) {
+	if e, ok := tl.index[k]; ok {
+		tl.order.Remove(e)
+		delete(tl.index, k)
+	}
+}
+
+// Return the number of keys recorded.
+func (tl *trimList) Len() int {
+	return tl.order.Len()
+}
+
+// Forget about the least recently used keys beyond the first limit, returning
+// them least recently used first.
+func (tl *trimList) Excess(limit int) (keys []interface{}) {
+	for tl.order.Len() > limit {
+		e := tl.order.Back()
+		tl.order.Remove(e)
+		delete(tl.index, e.Value)
+		keys = append(keys, e.Value)
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) trimPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(trimPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		fs.trimInodes()
+		fs.dropReaders()
+	}
+}
+
+// Trim the inodes used least recently beyond fs.maxCachedInodes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) trimInodes() {
+	if fs.maxCachedInodes == 0 {
+		return
+	}
+
+	fs.mu.Lock()
+	excess := fs.inodeLRU.Excess(fs.maxCachedInodes)
+	fs.mu.Unlock()
+
+	for _, k := range excess {
+		id := k.(fuseops.InodeID)
+
+		// Find the inode, making sure that it still exists once locked. Ops that
+		// use it will have touched it again, so it may be trimmed anyway: the
+		// state it loses is only a cache.
+		fs.mu.Lock()
+		in := fs.inodes[id]
+		fs.mu.Unlock()
+
+		if in == nil {
+			continue
+		}
+
+		in.Lock()
+
+		fs.mu.Lock()
+		live := fs.inodes[id] == in
+		fs.mu.Unlock()
+
+		if live {
+			in.Trim()
+			inodesTrimmed.Add(1)
+		}
+
+		in.Unlock()
+	}
+}
+
+// Drop the readers of the file handles read from least recently beyond
+// fs.maxOpenReaders. They are recreated if the handles are read from again.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) dropReaders() {
+	if fs.maxOpenReaders == 0 {
+		return
+	}
+
+	fs.mu.Lock()
+	excess := fs.readerLRU.Excess(fs.maxOpenReaders)
+	fs.mu.Unlock()
+
+	for _, k := range excess {
+		id := k.(fuseops.HandleID)
+
+		fs.mu.Lock()
+		fh, _ := fs.handles[id].(*handle.FileHandle)
+		fs.mu.Unlock()
+
+		if fh == nil {
+			continue
+		}
+
+		// ReleaseFileHandle destroys the handle holding only fs.mu, so hold it
+		// too while making sure the handle hasn't been released.
+		fh.Lock()
+		fs.mu.Lock()
+
+		if fs.handles[id] == fh && fh.DropReader() {
+			readersDropped.Add(1)
+		}
+
+		fs.mu.Unlock()
+		fh.Unlock()
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type TrimTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&TrimTest{}) }
+
+func (t *TrimTest) SetUp(ti *TestInfo) {
+	t.serverCfg.MaxCachedInodes = 1
+	t.serverCfg.MaxOpenReaders = 1
+	t.serverCfg.WriteBackDelay = writeBackDelay
+	t.fsTest.SetUp(ti)
+}
+
+// Wait a while for the named counter to exceed the supplied value, returning
+// whether it did.
+func waitForCounter(name string, prev int64) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if expvar.Get(name).(*expvar.Int).Value() > prev {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func counter(name string) int64 {
+	return expvar.Get(name).(*expvar.Int).Value()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TrimTest) CleanContentsDiscarded() {
+	prev := counter("inodes_trimmed")
+
+	// Write out a file, which keeps a clean copy of its contents, then use other
+	// inodes.
+	t.writeAndClose("foo", "taco")
+	t.cacheClock.AdvanceTime(writeBackDelay)
+	AssertEq("taco", t.waitForObject("foo", "taco"))
+
+	t.writeAndClose("bar", "burrito")
+	AssertTrue(waitForCounter("inodes_trimmed", prev))
+
+	// The contents are read back from GCS.
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *TrimTest) DirtyContentsKept() {
+	prev := counter("inodes_trimmed")
+
+	// Close a file whose contents wait to be written back, then use other
+	// inodes.
+	t.writeAndClose("foo", "taco")
+	AssertEq("", t.readObject("foo"))
+
+	_, err := os.Stat(path.Join(t.Dir, "bar"))
+	AssertTrue(os.IsNotExist(err), "err: %v", err)
+	AssertTrue(waitForCounter("inodes_trimmed", prev))
+
+	// Writing back still writes the contents.
+	t.cacheClock.AdvanceTime(writeBackDelay)
+	ExpectEq("taco", t.waitForObject("foo", "taco"))
+}
+
+func (t *TrimTest) ReadersDropped() {
+	var err error
+	prev := counter("readers_dropped")
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte("burrito"))
+	AssertEq(nil, err)
+
+	// Read from both files, keeping them open.
+	t.f1, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	t.f2, err = os.Open(path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	buf := make([]byte, 2)
+	_, err = t.f1.ReadAt(buf, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f2.ReadAt(buf, 0)
+	AssertEq(nil, err)
+
+	// The reader of the first is dropped, but it can still be read.
+	AssertTrue(waitForCounter("readers_dropped", prev))
+
+	_, err = t.f1.ReadAt(buf, 2)
+	AssertEq(nil, err)
+	ExpectEq("co", string(buf))
+}
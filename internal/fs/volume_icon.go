@@ -0,0 +1,253 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/binary"
+	"math"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The name of the file at the root of a volume in which the Finder looks for
+// its custom icon.
+const volumeIconName = ".VolumeIcon.icns"
+
+// The inode and handle IDs of the volume icon, chosen so as not to collide
+// with those allocated by fileSystem, which count up from small numbers.
+const (
+	volumeIconInodeID  = fuseops.InodeID(math.MaxUint64)
+	volumeIconHandleID = fuseops.HandleID(math.MaxUint64)
+)
+
+// The extended attribute holding the Finder's flags for a file or directory,
+// and the one among them (kHasCustomIcon) that makes it look for the icon
+// above.
+const (
+	finderInfoXattr   = "com.apple.FinderInfo"
+	hasCustomIconFlag = 0x0400
+)
+
+// A wrapper around a file system that gives its root a custom icon in the
+// Finder, as macFUSE's libfuse does for its volicon option: a read-only file
+// named volumeIconName with the supplied contents appears at the root, though
+// not in listings of it, and the root's Finder info says to use it. An object
+// of the same name in the bucket is hidden.
+type volumeIconFileSystem struct {
+	fuseutil.FileSystem
+
+	icon       []byte
+	attrs      fuseops.InodeAttributes
+	finderInfo []byte
+}
+
+func newVolumeIconFileSystem(
+	wrapped fuseutil.FileSystem,
+	icon []byte,
+	uid uint32,
+	gid uint32,
+	now time.Time) (fs *volumeIconFileSystem) {
+	fs = &volumeIconFileSystem{
+		FileSystem: wrapped,
+		icon:       icon,
+		attrs: fuseops.InodeAttributes{
+			Size:  uint64(len(icon)),
+			Nlink: 1,
+			Mode:  0444,
+			Atime: now,
+			Mtime: now,
+			Ctime: now,
+			Uid:   uid,
+			Gid:   gid,
+		},
+
+		// The Finder info is 32 bytes, with the flags at offset 8.
+		finderInfo: make([]byte, 32),
+	}
+
+	binary.BigEndian.PutUint16(fs.finderInfo[8:], hasCustomIconFlag)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// fuseutil.FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *volumeIconFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != volumeIconName {
+		return fs.FileSystem.LookUpInode(ctx, op)
+	}
+
+	op.Entry.Child = volumeIconInodeID
+	op.Entry.Attributes = fs.attrs
+	return nil
+}
+
+func (fs *volumeIconFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.GetInodeAttributes(ctx, op)
+	}
+
+	op.Attributes = fs.attrs
+	return nil
+}
+
+func (fs *volumeIconFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.SetInodeAttributes(ctx, op)
+	}
+
+	return syscall.EPERM
+}
+
+func (fs *volumeIconFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.ForgetInode(ctx, op)
+	}
+
+	return nil
+}
+
+func (fs *volumeIconFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.OpenFile(ctx, op)
+	}
+
+	op.Handle = volumeIconHandleID
+	op.KeepPageCache = true
+	return nil
+}
+
+func (fs *volumeIconFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.ReadFile(ctx, op)
+	}
+
+	if op.Offset < int64(len(fs.icon)) {
+		op.BytesRead = copy(op.Dst, fs.icon[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *volumeIconFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.WriteFile(ctx, op)
+	}
+
+	return syscall.EPERM
+}
+
+func (fs *volumeIconFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.SyncFile(ctx, op)
+	}
+
+	return nil
+}
+
+func (fs *volumeIconFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.FlushFile(ctx, op)
+	}
+
+	return nil
+}
+
+func (fs *volumeIconFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if op.Handle != volumeIconHandleID {
+		return fs.FileSystem.ReleaseFileHandle(ctx, op)
+	}
+
+	return nil
+}
+
+func (fs *volumeIconFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	switch {
+	case op.Inode == fuseops.RootInodeID && op.Name == finderInfoXattr:
+		op.BytesRead, err = copyXattr(op.Dst, fs.finderInfo)
+		return
+
+	case op.Inode == volumeIconInodeID:
+		err = fuse.ENOATTR
+		return
+	}
+
+	return fs.FileSystem.GetXattr(ctx, op)
+}
+
+func (fs *volumeIconFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	switch op.Inode {
+	case fuseops.RootInodeID:
+		op.BytesRead, err = copyXattr(op.Dst, []byte(finderInfoXattr+"\x00"))
+		return
+
+	case volumeIconInodeID:
+		err = syscall.ENOTSUP
+		return
+	}
+
+	return fs.FileSystem.ListXattr(ctx, op)
+}
+
+func (fs *volumeIconFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.SetXattr(ctx, op)
+	}
+
+	return syscall.EPERM
+}
+
+func (fs *volumeIconFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if op.Inode != volumeIconInodeID {
+		return fs.FileSystem.RemoveXattr(ctx, op)
+	}
+
+	return syscall.EPERM
+}
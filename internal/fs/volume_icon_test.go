@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type VolumeIconTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&VolumeIconTest{}) }
+
+func (t *VolumeIconTest) SetUp(ti *TestInfo) {
+	t.serverCfg.VolumeIcon = []byte("taco")
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *VolumeIconTest) ReadIcon() {
+	p := path.Join(t.Dir, ".VolumeIcon.icns")
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0444), fi.Mode())
+	ExpectEq(4, fi.Size())
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *VolumeIconTest) NotListed() {
+	entries, err := ioutil.ReadDir(t.Dir)
+	AssertEq(nil, err)
+	ExpectThat(entries, ElementsAre())
+}
+
+func (t *VolumeIconTest) CantWrite() {
+	err := ioutil.WriteFile(
+		path.Join(t.Dir, ".VolumeIcon.icns"),
+		[]byte("burrito"),
+		0644)
+
+	ExpectNe(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, ".VolumeIcon.icns"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *VolumeIconTest) HidesObject() {
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		".VolumeIcon.icns",
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, ".VolumeIcon.icns"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *VolumeIconTest) OtherFiles() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// How often the file system looks for files due to be written back.
+const writeBackPeriod = time.Second
+
+// A writeBackQueue tracks files that have been closed while dirty in
+// write-back mode, whose contents are yet to be written out to GCS.
+//
+// Its lock is a leaf: it may be acquired while holding an inode lock, and no
+// other lock is acquired while holding it.
+type writeBackQueue struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	delay         time.Duration
+	maxDirtyBytes int64
+	clock         timeutil.Clock
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The files waiting to be written out.
+	//
+	// INVARIANT: dirtyBytes is the sum of the bytes fields of the values
+	//
+	// GUARDED_BY(mu)
+	pending    map[*inode.FileInode]*pendingWriteBack
+	dirtyBytes int64
+}
+
+type pendingWriteBack struct {
+	// When the file was first closed while dirty.
+	since time.Time
+
+	// The file's dirty bytes as of the last time it was added.
+	bytes int64
+
+	// Set if the kernel has forgotten the file but writing it out failed, in
+	// which case it is kept here until it is written out and then destroyed.
+	orphaned bool
+}
+
+func newWriteBackQueue(
+	delay time.Duration,
+	maxDirtyBytes int64,
+	clock timeutil.Clock) (q *writeBackQueue) {
+	q = &writeBackQueue{
+		delay:         delay,
+		maxDirtyBytes: maxDirtyBytes,
+		clock:         clock,
+		pending:       make(map[*inode.FileInode]*pendingWriteBack),
+	}
+
+	return
+}
+
+// Add the supplied dirty file to the queue, or update its size if it is
+// already there. Return true if the files waiting now hold more than the
+// maximum number of dirty bytes.
+//
+// LOCKS_REQUIRED(f)
+func (q *writeBackQueue) Add(f *inode.FileInode) (overBudget bool) {
+	bytes := f.DirtyBytes()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.pending[f]
+	if !ok {
+		p = &pendingWriteBack{since: q.clock.Now()}
+		q.pending[f] = p
+	}
+
+	q.dirtyBytes += bytes - p.bytes
+	p.bytes = bytes
+
+	overBudget = q.dirtyBytes > q.maxDirtyBytes
+	return
+}
+
+// Remove the supplied file from the queue, if it is there.
+//
+// LOCKS_REQUIRED(f)
+func (q *writeBackQueue) Remove(f *inode.FileInode) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if p, ok := q.pending[f]; ok {
+		q.dirtyBytes -= p.bytes
+		delete(q.pending, f)
+	}
+}
+
+// Mark the supplied file, which must be in the queue, as forgotten by the
+// kernel. Whoever writes it out is responsible for destroying it.
+//
+// LOCKS_REQUIRED(f)
+func (q *writeBackQueue) Orphan(f *inode.FileInode) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending[f].orphaned = true
+}
+
+// Has the supplied file been marked with Orphan?
+//
+// LOCKS_REQUIRED(f)
+func (q *writeBackQueue) Orphaned(f *inode.FileInode) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.pending[f]
+	return ok && p.orphaned
+}
+
+// Return the files marked with Orphan, which the file system no longer
+// otherwise refers to.
+func (q *writeBackQueue) Orphans() (files []*inode.FileInode) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for f, p := range q.pending {
+		if p.orphaned {
+			files = append(files, f)
+		}
+	}
+
+	return
+}
+
+// Is the supplied file waiting to be written out? Because files are removed
+// before they are destroyed, a file for which this returns true while its lock
+// is held is still alive.
+//
+// LOCKS_REQUIRED(f)
+func (q *writeBackQueue) Contains(f *inode.FileInode) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, ok := q.pending[f]
+	return ok
+}
+
+// Return the files that have been waiting for at least the delay, or all of
+// them if all is set, oldest first.
+func (q *writeBackQueue) Due(all bool) (files []*inode.FileInode) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now()
+	for f, p := range q.pending {
+		if all || now.Sub(p.since) >= q.delay {
+			files = append(files, f)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return q.pending[files[i]].since.Before(q.pending[files[j]].since)
+	})
+
+	return
+}
+
+// Write out the files in the queue that are due, or all of them if all is
+// set. Errors are logged, and the files concerned are tried again next time.
+// Return the number of files that could not be written out.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) writeBack(ctx context.Context, all bool) (failed int) {
+	for _, f := range fs.writeBackQueue.Due(all) {
+		f.Lock()
+
+		// The file may have been written out and even destroyed since we looked.
+		if fs.writeBackQueue.Contains(f) {
+			if err := fs.writeOut(ctx, f); err != nil {
+				logger.Errorf("Writing back %q: %v", f.Name(), err)
+				failed++
+			}
+		}
+
+		f.Unlock()
+	}
+
+	return
+}
+
+// Write out the supplied file, destroying it afterward if it is an orphan
+// that was kept only until its contents were safe.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_REQUIRED(f)
+func (fs *fileSystem) writeOut(
+	ctx context.Context,
+	f *inode.FileInode) (err error) {
+	orphaned := fs.writeBackQueue != nil && fs.writeBackQueue.Orphaned(f)
+
+	err = fs.syncFile(ctx, f)
+	if err != nil {
+		return
+	}
+
+	if orphaned {
+		if destroyErr := f.Destroy(); destroyErr != nil {
+			logger.Errorf("Error destroying inode %q: %v", f.Name(), destroyErr)
+		}
+	}
+
+	return
+}
+
+// Periodically write out files that are due until the context is cancelled.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) writeBackPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(writeBackPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		fs.writeBack(ctx, false)
+	}
+}
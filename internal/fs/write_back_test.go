@@ -0,0 +1,281 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const writeBackDelay = time.Minute
+
+type WriteBackTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&WriteBackTest{}) }
+
+func (t *WriteBackTest) SetUp(ti *TestInfo) {
+	t.serverCfg.WriteBackDelay = writeBackDelay
+	t.serverCfg.WriteBackMaxDirtyBytes = 1 << 20
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *WriteBackTest) CloseDoesntWriteOut() {
+	t.writeAndClose("foo", "taco")
+
+	// The object exists, but is still empty.
+	ExpectEq("", t.readObject("foo"))
+
+	// Reading through the file system sees the new contents.
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *WriteBackTest) WrittenOutAfterDelay() {
+	t.writeAndClose("foo", "taco")
+	ExpectEq("", t.readObject("foo"))
+
+	t.cacheClock.AdvanceTime(writeBackDelay)
+	ExpectEq("taco", t.waitForObject("foo", "taco"))
+}
+
+func (t *WriteBackTest) SyncWritesOut() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	AssertEq(nil, t.f1.Sync())
+	ExpectEq("taco", t.readObject("foo"))
+}
+
+func (t *WriteBackTest) RenameWritesOutFirst() {
+	t.writeAndClose("foo", "taco")
+
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readObject("bar"))
+}
+
+func (t *WriteBackTest) OverBudgetWritesOutOnClose() {
+	big := string(randBytes(1 << 20))
+	t.writeAndClose("foo", "taco")
+	t.writeAndClose("bar", big)
+
+	// The second file took the total over the budget, so it was written out.
+	ExpectEq("", t.readObject("foo"))
+	ExpectTrue(t.readObject("bar") == big)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Failed write-back
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that refuses to create or compose objects while rejecting is set.
+type rejectingBucket struct {
+	gcs.Bucket
+
+	mu        sync.Mutex
+	rejecting bool
+}
+
+func (b *rejectingBucket) setRejecting(rejecting bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rejecting = rejecting
+}
+
+func (b *rejectingBucket) check() (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rejecting {
+		err = errors.New("taco")
+	}
+
+	return
+}
+
+func (b *rejectingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.check(); err != nil {
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *rejectingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if err = b.check(); err != nil {
+		return
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+type WriteBackFailureTest struct {
+	fsTest
+	rejecting *rejectingBucket
+
+	// Set once a test has unmounted the file system itself.
+	unmounted bool
+}
+
+func init() { RegisterTestSuite(&WriteBackFailureTest{}) }
+
+func (t *WriteBackFailureTest) SetUp(ti *TestInfo) {
+	t.rejecting = &rejectingBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.bucket = t.rejecting
+	t.serverCfg.WriteBackDelay = writeBackDelay
+	t.serverCfg.WriteBackMaxDirtyBytes = 1 << 20
+	t.fsTest.SetUp(ti)
+}
+
+func (t *WriteBackFailureTest) TearDown() {
+	if !t.unmounted {
+		t.fsTest.TearDown()
+		return
+	}
+
+	os.Remove(t.Dir)
+}
+
+func (t *WriteBackFailureTest) unmount() {
+	AssertEq(nil, fuse.Unmount(t.Dir))
+	AssertEq(nil, t.mfs.Join(t.ctx))
+	t.unmounted = true
+}
+
+func (t *WriteBackFailureTest) UnmountKeepsFilesNotWrittenBack() {
+	t.writeAndClose("foo", "taco")
+	t.rejecting.setRejecting(true)
+
+	// Unmounting can't write the file out, but doesn't drop it.
+	t.unmount()
+	ExpectEq("", t.readObject("foo"))
+	ExpectThat(t.server.DirtyFiles(), ElementsAre("foo"))
+
+	err := t.server.SyncDirtyFiles(t.ctx)
+	ExpectThat(err, Error(HasSubstr("foo")))
+
+	// Once the bucket accepts it, the file is written out.
+	t.rejecting.setRejecting(false)
+	AssertEq(nil, t.server.SyncDirtyFiles(t.ctx))
+
+	ExpectEq("taco", t.readObject("foo"))
+	ExpectThat(t.server.DirtyFiles(), ElementsAre())
+}
+
+func (t *WriteBackFailureTest) ForgottenFileKept() {
+	t.writeAndClose("foo", "taco")
+	t.rejecting.setRejecting(true)
+
+	// Make the kernel forget the file, which writes it out before destroying
+	// it. Only root can do this.
+	err := ioutil.WriteFile("/proc/sys/vm/drop_caches", []byte("2"), 0)
+	if err != nil {
+		log.Println("Skipping ForgottenFileKept when not running as root.")
+		return
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(t.server.Inspect(t.ctx, "foo")) != 0 {
+		AssertTrue(time.Now().Before(deadline), "Kernel didn't forget foo")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Writing it out failed, but its contents are kept.
+	ExpectEq("", t.readObject("foo"))
+	ExpectThat(t.server.DirtyFiles(), ElementsAre("foo"))
+
+	// And written out by a later attempt.
+	t.rejecting.setRejecting(false)
+	AssertEq(nil, t.server.SyncDirtyFiles(t.ctx))
+
+	ExpectEq("taco", t.readObject("foo"))
+	ExpectThat(t.server.DirtyFiles(), ElementsAre())
+}
+
+func (t *WriteBackFailureTest) FailedWriteBackRetried() {
+	t.writeAndClose("foo", "taco")
+	t.rejecting.setRejecting(true)
+
+	// The write-back fails, leaving the object as it was.
+	t.cacheClock.AdvanceTime(writeBackDelay)
+	// The file system looks for files due once a second.
+	time.Sleep(3 * time.Second)
+	ExpectEq("", t.readObject("foo"))
+
+	// It is tried again later.
+	t.rejecting.setRejecting(false)
+	ExpectEq("taco", t.waitForObject("foo", "taco"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Asynchronous close
+////////////////////////////////////////////////////////////////////////
+
+type AsyncCloseTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&AsyncCloseTest{}) }
+
+func (t *AsyncCloseTest) SetUp(ti *TestInfo) {
+	t.serverCfg.AsyncClose = true
+	t.serverCfg.WriteBackMaxDirtyBytes = 1 << 20
+	t.fsTest.SetUp(ti)
+}
+
+func (t *AsyncCloseTest) WrittenOutSoonAfterClose() {
+	t.writeAndClose("foo", "taco")
+	ExpectEq("taco", t.waitForObject("foo", "taco"))
+}
@@ -0,0 +1,285 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// The extended attributes of a file expose the properties of its backing
+// object under this prefix. Custom metadata appears under
+// xattrMetadataPrefix, e.g. as "user.gcs.metadata.foo" for key "foo".
+const (
+	xattrPrefix         = "user.gcs."
+	xattrMetadataPrefix = xattrPrefix + "metadata."
+)
+
+// Return the extended attributes exposing the properties of the supplied
+// object, keyed by name. Properties the object lacks are omitted.
+func objectXattrs(o *gcs.Object) (xattrs map[string]string) {
+	xattrs = map[string]string{
+		xattrPrefix + "generation":     strconv.FormatInt(o.Generation, 10),
+		xattrPrefix + "metageneration": strconv.FormatInt(o.MetaGeneration, 10),
+	}
+
+	// Checksums are given in base64, big-endian, as by the GCS API and gsutil.
+	var crc32c [4]byte
+	binary.BigEndian.PutUint32(crc32c[:], o.CRC32C)
+	xattrs[xattrPrefix+"crc32c"] = base64.StdEncoding.EncodeToString(crc32c[:])
+
+	if o.MD5 != nil {
+		xattrs[xattrPrefix+"md5"] = base64.StdEncoding.EncodeToString(o.MD5[:])
+	}
+
+	optional := map[string]string{
+		"content-type":  o.ContentType,
+		"cache-control": o.CacheControl,
+		"storage-class": o.StorageClass,
+	}
+
+	for k, v := range optional {
+		if v != "" {
+			xattrs[xattrPrefix+k] = v
+		}
+	}
+
+	for k, v := range o.Metadata {
+		xattrs[xattrMetadataPrefix+k] = v
+	}
+
+	return
+}
+
+// Return the extended attributes for the inode with the given ID, reflecting
+// its backing object as of the last time it was written to or read from GCS.
+// Only files have extended attributes; for other inodes ENOTSUP is returned.
+// (Since files always have some, this also spares us answering listxattr with
+// an empty list, which package fuse can't do when given a buffer.)
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) xattrs(
+	id fuseops.InodeID) (xattrs map[string]string, err error) {
+	fs.mu.Lock()
+	in := fs.inodeOrDie(id)
+	fs.mu.Unlock()
+
+	file, ok := in.(*inode.FileInode)
+	if !ok {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	file.Lock()
+	defer file.Unlock()
+
+	xattrs = objectXattrs(file.Source())
+	return
+}
+
+// Copy the supplied value to dst, returning ERANGE if it doesn't fit. This
+// includes the case where dst is empty, which is how the kernel asks for the
+// size of the value.
+func copyXattr(dst []byte, value []byte) (n int, err error) {
+	n = len(value)
+	if len(dst) < n {
+		err = syscall.ERANGE
+		return
+	}
+
+	copy(dst, value)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	xattrs, err := fs.xattrs(op.Inode)
+	if err != nil {
+		return
+	}
+
+	value, ok := xattrs[op.Name]
+	if !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	op.BytesRead, err = copyXattr(op.Dst, []byte(value))
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	xattrs, err := fs.xattrs(op.Inode)
+	if err != nil {
+		return
+	}
+
+	var names []string
+	for name := range xattrs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	// The names are NUL-terminated.
+	var list []byte
+	for _, name := range names {
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+
+	op.BytesRead, err = copyXattr(op.Dst, list)
+	return
+}
+
+// Flags for setxattr(2), which package fuse passes through unchanged.
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// Apply to the backing object of the inode with the given ID the change to
+// the named extended attribute described by value, with nil meaning removal.
+// Only custom metadata, the content type, and the cache control may be
+// modified; for other attributes under xattrPrefix EPERM is returned, and for
+// attributes outside of it ENOTSUP.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) updateXattr(
+	ctx context.Context,
+	id fuseops.InodeID,
+	name string,
+	value *string,
+	flags uint32) (err error) {
+	if !strings.HasPrefix(name, xattrPrefix) {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	// Work out the change to the object's properties.
+	var contentType *string
+	var cacheControl *string
+	var metadata map[string]*string
+
+	switch {
+	case strings.HasPrefix(name, xattrMetadataPrefix):
+		key := strings.TrimPrefix(name, xattrMetadataPrefix)
+		if key == "" {
+			err = syscall.EINVAL
+			return
+		}
+
+		metadata = map[string]*string{key: value}
+
+	case name == xattrPrefix+"content-type":
+		// GCS always has a content type for an object, so it can't be removed.
+		if value == nil {
+			err = syscall.EPERM
+			return
+		}
+
+		if *value == "" {
+			err = syscall.EINVAL
+			return
+		}
+
+		contentType = value
+
+	case name == xattrPrefix+"cache-control":
+		// The empty string clears the field.
+		if value == nil {
+			value = new(string)
+		}
+
+		cacheControl = value
+
+	default:
+		err = syscall.EPERM
+		return
+	}
+
+	// Find the file.
+	fs.mu.Lock()
+	in := fs.inodeOrDie(id)
+	fs.mu.Unlock()
+
+	file, ok := in.(*inode.FileInode)
+	if !ok {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	file.Lock()
+	defer file.Unlock()
+
+	// Honor the flags, and refuse to remove what isn't there.
+	_, exists := objectXattrs(file.Source())[name]
+	switch {
+	case exists && flags&xattrCreate != 0:
+		err = syscall.EEXIST
+		return
+
+	case !exists && (flags&xattrReplace != 0 || value == nil):
+		err = fuse.ENOATTR
+		return
+	}
+
+	err = file.UpdateMetadata(ctx, contentType, cacheControl, metadata)
+	switch err.(type) {
+	case nil:
+
+	case *gcs.NotFoundError:
+		err = fuse.ENOENT
+
+	default:
+		err = fmt.Errorf("UpdateMetadata: %v", err)
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	value := string(op.Value)
+	err = fs.updateXattr(ctx, op.Inode, op.Name, &value, op.Flags)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	err = fs.updateXattr(ctx, op.Inode, op.Name, nil, 0)
+	return
+}
@@ -0,0 +1,300 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type XattrTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&XattrTest{}) }
+
+// Return the value of the named extended attribute of the supplied path.
+func getxattr(p string, name string) (value string, err error) {
+	buf := make([]byte, 1024)
+	n, err := syscall.Getxattr(p, name, buf)
+	if err != nil {
+		return
+	}
+
+	value = string(buf[:n])
+	return
+}
+
+// Return the names of the extended attributes of the supplied path.
+func listxattr(p string) (names []string, err error) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Listxattr(p, buf)
+	if err != nil {
+		return
+	}
+
+	for _, name := range strings.Split(string(buf[:n]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *XattrTest) ObjectProperties() {
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:        "foo",
+			ContentType: "text/plain",
+			Metadata:    map[string]string{"color": "blue"},
+			Contents:    ioutil.NopCloser(strings.NewReader("taco")),
+		})
+
+	AssertEq(nil, err)
+
+	p := path.Join(t.Dir, "foo")
+	expected := map[string]string{
+		"user.gcs.generation":     strconv.FormatInt(o.Generation, 10),
+		"user.gcs.metageneration": strconv.FormatInt(o.MetaGeneration, 10),
+		"user.gcs.content-type":   "text/plain",
+		"user.gcs.metadata.color": "blue",
+	}
+
+	for name, v := range expected {
+		value, err := getxattr(p, name)
+		AssertEq(nil, err, "%s", name)
+		ExpectEq(v, value, "%s", name)
+	}
+
+	// The CRC32C of "taco", in base64 as gsutil shows it.
+	value, err := getxattr(p, "user.gcs.crc32c")
+	AssertEq(nil, err)
+	ExpectEq("rmxLDw==", value)
+}
+
+func (t *XattrTest) List() {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:        "foo",
+			ContentType: "text/plain",
+			Metadata:    map[string]string{"color": "blue"},
+			Contents:    ioutil.NopCloser(strings.NewReader("taco")),
+		})
+
+	AssertEq(nil, err)
+
+	names, err := listxattr(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	ExpectThat(names, Contains("user.gcs.generation"))
+	ExpectThat(names, Contains("user.gcs.metageneration"))
+	ExpectThat(names, Contains("user.gcs.content-type"))
+	ExpectThat(names, Contains("user.gcs.crc32c"))
+	ExpectThat(names, Contains("user.gcs.metadata.color"))
+	ExpectThat(names, Not(Contains("user.gcs.cache-control")))
+}
+
+func (t *XattrTest) SizeQuery() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	value, err := getxattr(path.Join(t.Dir, "foo"), "user.gcs.generation")
+	AssertEq(nil, err)
+
+	// A nil buffer asks for the size of the value.
+	n, err := syscall.Getxattr(
+		path.Join(t.Dir, "foo"),
+		"user.gcs.generation",
+		nil)
+
+	AssertEq(nil, err)
+	ExpectEq(len(value), n)
+
+	// Likewise for the list.
+	n, err = syscall.Listxattr(path.Join(t.Dir, "foo"), nil)
+	AssertEq(nil, err)
+	ExpectLt(0, n)
+}
+
+func (t *XattrTest) MissingAttribute() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = getxattr(path.Join(t.Dir, "foo"), "user.gcs.metadata.color")
+	ExpectEq(syscall.ENODATA, err)
+
+	_, err = getxattr(path.Join(t.Dir, "foo"), "user.taco")
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *XattrTest) Directories() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "dir/", []byte{})
+	AssertEq(nil, err)
+
+	_, err = listxattr(path.Join(t.Dir, "dir"))
+	ExpectEq(syscall.ENOTSUP, err)
+
+	_, err = getxattr(path.Join(t.Dir, "dir"), "user.gcs.generation")
+	ExpectEq(syscall.ENOTSUP, err)
+}
+
+func (t *XattrTest) SetMetadata() {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Metadata: map[string]string{"color": "blue"},
+			Contents: ioutil.NopCloser(strings.NewReader("taco")),
+		})
+
+	AssertEq(nil, err)
+
+	p := path.Join(t.Dir, "foo")
+
+	// Add a key and change an existing one.
+	err = syscall.Setxattr(p, "user.gcs.metadata.shape", []byte("round"), 0)
+	AssertEq(nil, err)
+
+	err = syscall.Setxattr(p, "user.gcs.metadata.color", []byte("red"), 0)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("round", o.Metadata["shape"])
+	ExpectEq("red", o.Metadata["color"])
+
+	// The change should be visible through the file system, too.
+	value, err := getxattr(p, "user.gcs.metadata.shape")
+	AssertEq(nil, err)
+	ExpectEq("round", value)
+
+	// Remove a key.
+	err = syscall.Removexattr(p, "user.gcs.metadata.color")
+	AssertEq(nil, err)
+
+	o, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	_, ok := o.Metadata["color"]
+	ExpectFalse(ok)
+	ExpectEq("round", o.Metadata["shape"])
+
+	err = syscall.Removexattr(p, "user.gcs.metadata.color")
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *XattrTest) SetContentTypeAndCacheControl() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	p := path.Join(t.Dir, "foo")
+
+	err = syscall.Setxattr(p, "user.gcs.content-type", []byte("text/html"), 0)
+	AssertEq(nil, err)
+
+	err = syscall.Setxattr(
+		p,
+		"user.gcs.cache-control",
+		[]byte("no-cache"),
+		0)
+
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("text/html", o.ContentType)
+	ExpectEq("no-cache", o.CacheControl)
+
+	// The cache control may be removed, but the content type may not.
+	err = syscall.Removexattr(p, "user.gcs.cache-control")
+	AssertEq(nil, err)
+
+	err = syscall.Removexattr(p, "user.gcs.content-type")
+	ExpectEq(syscall.EPERM, err)
+
+	o, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("text/html", o.ContentType)
+	ExpectEq("", o.CacheControl)
+}
+
+func (t *XattrTest) SetFlags() {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Metadata: map[string]string{"color": "blue"},
+			Contents: ioutil.NopCloser(strings.NewReader("taco")),
+		})
+
+	AssertEq(nil, err)
+
+	p := path.Join(t.Dir, "foo")
+
+	// XATTR_CREATE
+	err = syscall.Setxattr(p, "user.gcs.metadata.color", []byte("red"), 0x1)
+	ExpectEq(syscall.EEXIST, err)
+
+	// XATTR_REPLACE
+	err = syscall.Setxattr(p, "user.gcs.metadata.shape", []byte("round"), 0x2)
+	ExpectEq(syscall.ENODATA, err)
+
+	value, err := getxattr(p, "user.gcs.metadata.color")
+	AssertEq(nil, err)
+	ExpectEq("blue", value)
+}
+
+func (t *XattrTest) SetReadOnlyAttributes() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	p := path.Join(t.Dir, "foo")
+
+	err = syscall.Setxattr(p, "user.gcs.generation", []byte("17"), 0)
+	ExpectEq(syscall.EPERM, err)
+
+	err = syscall.Setxattr(p, "user.taco", []byte("burrito"), 0)
+	ExpectEq(syscall.ENOTSUP, err)
+}
@@ -0,0 +1,364 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"expvar"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// The number of requests to which GCS responded that it was throttling us,
+// and the current limit on concurrent requests.
+var (
+	throttledRequests = expvar.NewInt("throttled_requests")
+	concurrencyLimit  = expvar.NewFloat("concurrency_limit")
+)
+
+// How many times to send a request that GCS keeps throttling, and the longest
+// to wait between attempts.
+const (
+	adaptiveMaxAttempts = 6
+	adaptiveMaxBackoff  = 32 * time.Second
+)
+
+// Is the supplied error GCS telling us to slow down?
+func isThrottlingError(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+
+	return apiErr.Code == http.StatusTooManyRequests ||
+		apiErr.Code == http.StatusServiceUnavailable
+}
+
+// NewAdaptiveBucket returns a bucket that limits the number of concurrent
+// requests to the wrapped bucket, adapting the limit to throttling by GCS:
+// each time GCS responds with 429 or 503 the limit is halved, down to one,
+// and each request that succeeds raises it by about one per limit's worth of
+// requests, up to maxInFlight.
+//
+// Throttled requests are retried after an exponential backoff beginning at
+// initialBackoff, except for object creation, whose contents can't be
+// replayed. Since the limit is shared, a throttling episode slows down every
+// user of the bucket rather than only the requests that were throttled.
+//
+// The limit applies while waiting for responses, but not to reading the
+// contents of objects afterward.
+func NewAdaptiveBucket(
+	maxInFlight int,
+	initialBackoff time.Duration,
+	wrapped gcs.Bucket) gcs.Bucket {
+	return &adaptiveBucket{
+		Bucket:         wrapped,
+		limiter:        newAIMDLimiter(float64(maxInFlight)),
+		initialBackoff: initialBackoff,
+	}
+}
+
+type adaptiveBucket struct {
+	gcs.Bucket
+	limiter        *aimdLimiter
+	initialBackoff time.Duration
+}
+
+// Call f with the limiter's permission, retrying it if it is throttled and
+// retryable is set.
+func (b *adaptiveBucket) do(
+	ctx context.Context,
+	retryable bool,
+	f func() error) (err error) {
+	backoff := b.initialBackoff
+	for attempt := 1; ; attempt++ {
+		var epoch uint64
+		epoch, err = b.limiter.Acquire(ctx)
+		if err != nil {
+			return
+		}
+
+		err = f()
+		throttled := isThrottlingError(err)
+		b.limiter.Release(epoch, throttled)
+
+		if !throttled {
+			return
+		}
+
+		throttledRequests.Add(1)
+		if !retryable || attempt >= adaptiveMaxAttempts {
+			return
+		}
+
+		// Wait for a random time up to the backoff, so that requests throttled
+		// together don't come back together. If we're cancelled, report the
+		// throttling.
+		delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+		if backoff > adaptiveMaxBackoff {
+			backoff = adaptiveMaxBackoff
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *adaptiveBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	err = b.do(ctx, true, func() (err error) {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *adaptiveBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	err = b.do(ctx, false, func() (err error) {
+		o, err = b.Bucket.CreateObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *adaptiveBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	err = b.do(ctx, true, func() (err error) {
+		o, err = b.Bucket.CopyObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *adaptiveBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	err = b.do(ctx, true, func() (err error) {
+		o, err = b.Bucket.ComposeObjects(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *adaptiveBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = b.do(ctx, true, func() (err error) {
+		o, err = b.Bucket.StatObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *adaptiveBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	err = b.do(ctx, true, func() (err error) {
+		listing, err = b.Bucket.ListObjects(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *adaptiveBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	err = b.do(ctx, true, func() (err error) {
+		o, err = b.Bucket.UpdateObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *adaptiveBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.do(ctx, true, func() error {
+		return b.Bucket.DeleteObject(ctx, req)
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// aimdLimiter
+////////////////////////////////////////////////////////////////////////
+
+// A limit on the number of concurrent requests, increased additively on
+// success and decreased multiplicatively on throttling.
+type aimdLimiter struct {
+	max float64
+
+	mu sync.Mutex
+
+	// The current limit. At least one request is always allowed.
+	//
+	// INVARIANT: 1 <= limit <= max
+	//
+	// GUARDED_BY(mu)
+	limit float64
+
+	// The number of requests holding permission.
+	//
+	// GUARDED_BY(mu)
+	inFlight int
+
+	// Incremented each time the limit is decreased. Throttling of requests that
+	// began before the last decrease doesn't decrease it again, since they
+	// reflect the load before it took effect.
+	//
+	// GUARDED_BY(mu)
+	epoch uint64
+
+	// Channels for requests waiting for permission, in order of arrival. Each
+	// is closed when its request is granted permission.
+	//
+	// GUARDED_BY(mu)
+	waiters []chan struct{}
+}
+
+func newAIMDLimiter(max float64) (l *aimdLimiter) {
+	if max < 1 {
+		max = 1
+	}
+
+	l = &aimdLimiter{
+		max:   max,
+		limit: max,
+	}
+
+	concurrencyLimit.Set(l.limit)
+	return
+}
+
+// LOCKS_REQUIRED(l.mu)
+func (l *aimdLimiter) hasRoom() bool {
+	return l.inFlight < int(l.limit)
+}
+
+// Wait for permission to send a request, returning the epoch to pass to
+// Release.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *aimdLimiter) Acquire(ctx context.Context) (epoch uint64, err error) {
+	l.mu.Lock()
+
+	if len(l.waiters) == 0 && l.hasRoom() {
+		l.inFlight++
+		epoch = l.epoch
+		l.mu.Unlock()
+		return
+	}
+
+	c := make(chan struct{})
+	l.waiters = append(l.waiters, c)
+	l.mu.Unlock()
+
+	select {
+	case <-c:
+		l.mu.Lock()
+		epoch = l.epoch
+		l.mu.Unlock()
+		return
+
+	case <-ctx.Done():
+	}
+
+	// We may have been granted permission concurrently with being cancelled. If
+	// so, hand it back.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, w := range l.waiters {
+		if w == c {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			err = ctx.Err()
+			return
+		}
+	}
+
+	l.inFlight--
+	l.wake()
+
+	err = ctx.Err()
+	return
+}
+
+// Release permission granted by Acquire, noting whether the request was
+// throttled.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *aimdLimiter) Release(epoch uint64, throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+
+	switch {
+	case throttled && epoch == l.epoch:
+		l.limit /= 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+
+		l.epoch++
+
+	case !throttled:
+		l.limit += 1 / l.limit
+		if l.limit > l.max {
+			l.limit = l.max
+		}
+	}
+
+	concurrencyLimit.Set(l.limit)
+	l.wake()
+}
+
+// Grant permission to as many waiters as there is room for.
+//
+// LOCKS_REQUIRED(l.mu)
+func (l *aimdLimiter) wake() {
+	for len(l.waiters) != 0 && l.hasRoom() {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		l.inFlight++
+	}
+}
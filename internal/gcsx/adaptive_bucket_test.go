@@ -0,0 +1,256 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestAdaptiveBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+var errThrottled = &googleapi.Error{Code: http.StatusTooManyRequests}
+
+// A bucket that fails StatObject and CreateObject with the queued errors
+// before passing them through.
+type failingBucket struct {
+	gcs.Bucket
+
+	errs  []error
+	calls int
+}
+
+func (b *failingBucket) fail() (err error) {
+	b.calls++
+	if len(b.errs) != 0 {
+		err, b.errs = b.errs[0], b.errs[1:]
+	}
+
+	return
+}
+
+func (b *failingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if err = b.fail(); err != nil {
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *failingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.fail(); err != nil {
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+type AdaptiveBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped failingBucket
+	bucket  gcs.Bucket
+}
+
+func init() { RegisterTestSuite(&AdaptiveBucketTest{}) }
+
+func (t *AdaptiveBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = NewAdaptiveBucket(8, time.Millisecond, &t.wrapped)
+
+	_, err := t.wrapped.Bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:     "foo",
+		Contents: strings.NewReader("taco"),
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *AdaptiveBucketTest) limiter() *aimdLimiter {
+	return t.bucket.(*adaptiveBucket).limiter
+}
+
+func (t *AdaptiveBucketTest) stat() (err error) {
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AdaptiveBucketTest) RetriesThrottledRequests() {
+	t.wrapped.errs = []error{errThrottled, errThrottled}
+
+	ExpectEq(nil, t.stat())
+	ExpectEq(3, t.wrapped.calls)
+}
+
+func (t *AdaptiveBucketTest) GivesUpEventually() {
+	for i := 0; i < adaptiveMaxAttempts; i++ {
+		t.wrapped.errs = append(t.wrapped.errs, errThrottled)
+	}
+
+	ExpectEq(errThrottled, t.stat())
+	ExpectEq(adaptiveMaxAttempts, t.wrapped.calls)
+}
+
+func (t *AdaptiveBucketTest) DoesntRetryOtherErrors() {
+	t.wrapped.errs = []error{errors.New("taco")}
+
+	ExpectThat(t.stat(), Error(Equals("taco")))
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *AdaptiveBucketTest) DoesntRetryCreateObject() {
+	t.wrapped.errs = []error{errThrottled}
+
+	_, err := t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:     "bar",
+		Contents: strings.NewReader("burrito"),
+	})
+
+	ExpectEq(errThrottled, err)
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *AdaptiveBucketTest) ThrottlingHalvesLimit() {
+	t.wrapped.errs = []error{errThrottled}
+
+	AssertEq(nil, t.stat())
+	ExpectLt(t.limiter().limit, 5)
+	ExpectGe(t.limiter().limit, 4)
+}
+
+func (t *AdaptiveBucketTest) SuccessRaisesLimitGradually() {
+	l := t.limiter()
+	l.limit = 4
+
+	for i := 0; i < 4; i++ {
+		AssertEq(nil, t.stat())
+	}
+
+	ExpectGt(l.limit, 4.5)
+	ExpectLt(l.limit, 5.5)
+
+	// But never beyond the maximum.
+	for i := 0; i < 100; i++ {
+		AssertEq(nil, t.stat())
+	}
+
+	ExpectEq(8, l.limit)
+}
+
+func (t *AdaptiveBucketTest) OneDecreasePerEpoch() {
+	l := t.limiter()
+
+	// Two requests in flight together are both throttled.
+	e0, err := l.Acquire(t.ctx)
+	AssertEq(nil, err)
+	e1, err := l.Acquire(t.ctx)
+	AssertEq(nil, err)
+
+	l.Release(e0, true)
+	l.Release(e1, true)
+	ExpectEq(4, l.limit)
+
+	// A request sent afterward can decrease it again.
+	e2, err := l.Acquire(t.ctx)
+	AssertEq(nil, err)
+
+	l.Release(e2, true)
+	ExpectEq(2, l.limit)
+}
+
+func (t *AdaptiveBucketTest) LimitNeverBelowOne() {
+	l := t.limiter()
+	for i := 0; i < 10; i++ {
+		epoch, err := l.Acquire(t.ctx)
+		AssertEq(nil, err)
+		l.Release(epoch, true)
+	}
+
+	ExpectEq(1, l.limit)
+}
+
+func (t *AdaptiveBucketTest) WaitsForRoom() {
+	l := t.limiter()
+	l.limit = 1
+
+	epoch, err := l.Acquire(t.ctx)
+	AssertEq(nil, err)
+
+	// A second request must wait for the first.
+	acquired := make(chan struct{})
+	go func() {
+		epoch, _ := l.Acquire(context.Background())
+		close(acquired)
+		l.Release(epoch, false)
+	}()
+
+	select {
+	case <-acquired:
+		AddFailure("Acquired without room")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.Release(epoch, false)
+	<-acquired
+}
+
+func (t *AdaptiveBucketTest) CancelWhileWaiting() {
+	l := t.limiter()
+	l.limit = 1
+
+	epoch, err := l.Acquire(t.ctx)
+	AssertEq(nil, err)
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	_, err = l.Acquire(ctx)
+	ExpectEq(context.Canceled, err)
+
+	// The cancelled request shouldn't hold on to anything.
+	l.Release(epoch, false)
+
+	l.mu.Lock()
+	ExpectEq(0, l.inFlight)
+	ExpectEq(0, len(l.waiters))
+	l.mu.Unlock()
+}
@@ -53,7 +53,8 @@ type appendObjectCreator struct {
 	bucket gcs.Bucket
 }
 
-func (oc *appendObjectCreator) chooseName() (name string, err error) {
+// Choose a name for a temporary object beginning with the supplied prefix.
+func chooseTmpName(prefix string) (name string, err error) {
 	// Generate a good 64-bit random number.
 	var buf [8]byte
 	_, err = io.ReadFull(rand.Reader, buf[:])
@@ -72,7 +73,7 @@ func (oc *appendObjectCreator) chooseName() (name string, err error) {
 		uint64(buf[7])<<56
 
 	// Turn it into a name.
-	name = fmt.Sprintf("%s%016x", oc.prefix, x)
+	name = fmt.Sprintf("%s%016x", prefix, x)
 
 	return
 }
@@ -81,23 +82,28 @@ func (oc *appendObjectCreator) Create(
 	ctx context.Context,
 	srcObject *gcs.Object,
 	mtime time.Time,
+	checksums *Checksums,
 	r io.Reader) (o *gcs.Object, err error) {
 	// Choose a name for a temporary object.
-	tmpName, err := oc.chooseName()
+	tmpName, err := chooseTmpName(oc.prefix)
 	if err != nil {
-		err = fmt.Errorf("chooseName: %v", err)
+		err = fmt.Errorf("chooseTmpName: %v", err)
 		return
 	}
 
 	// Create a temporary object containing the additional contents.
 	var zero int64
-	tmp, err := oc.bucket.CreateObject(
-		ctx,
-		&gcs.CreateObjectRequest{
-			Name: tmpName,
-			GenerationPrecondition: &zero,
-			Contents:               r,
-		})
+	req := &gcs.CreateObjectRequest{
+		Name: tmpName,
+		GenerationPrecondition: &zero,
+		Contents:               r,
+	}
+
+	if checksums != nil {
+		checksums.apply(req)
+	}
+
+	tmp, err := oc.bucket.CreateObject(ctx, req)
 
 	// Don't mangle precondition errors.
 	switch typed := err.(type) {
@@ -145,9 +151,7 @@ func (oc *appendObjectCreator) Create(
 					Generation: tmp.Generation,
 				},
 			},
-			Metadata: map[string]string{
-				MtimeMetadataKey: mtime.Format(time.RFC3339Nano),
-			},
+			Metadata: syncedMetadata(srcObject, mtime),
 		})
 
 	switch typed := err.(type) {
@@ -91,6 +91,7 @@ func (t *AppendObjectCreatorTest) call() (o *gcs.Object, err error) {
 		t.ctx,
 		&t.srcObject,
 		t.mtime,
+		nil,
 		strings.NewReader(t.srcContents))
 
 	return
@@ -200,6 +201,45 @@ func (t *AppendObjectCreatorTest) CallsComposeObjects() {
 	ExpectEq(tmpObject.Generation, src.Generation)
 }
 
+func (t *AppendObjectCreatorTest) ComposeObjectsKeepsPosixMetadata() {
+	t.srcObject.Name = "foo"
+	t.srcObject.Metadata = map[string]string{
+		"gcsfuse_mode":  "600",
+		"gcsfuse_uid":   "17",
+		"gcsfuse_mtime": "2015-04-05T02:15:00Z",
+		"color":         "blue",
+	}
+
+	t.mtime = time.Now().UTC()
+
+	// CreateObject
+	tmpObject := &gcs.Object{
+		Name:       "bar",
+		Generation: 19,
+	}
+
+	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
+	// ComposeObjects
+	var req *gcs.ComposeObjectsRequest
+	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
+		WillOnce(DoAll(SaveArg(1, &req), Return(nil, errors.New(""))))
+
+	// DeleteObject
+	ExpectCall(t.bucket, "DeleteObject")(Any(), Any()).
+		WillOnce(Return(nil))
+
+	// Call
+	t.call()
+
+	AssertNe(nil, req)
+	ExpectEq(3, len(req.Metadata))
+	ExpectEq(t.mtime.Format(time.RFC3339Nano), req.Metadata["gcsfuse_mtime"])
+	ExpectEq("600", req.Metadata["gcsfuse_mode"])
+	ExpectEq("17", req.Metadata["gcsfuse_uid"])
+}
+
 func (t *AppendObjectCreatorTest) ComposeObjectsFails() {
 	// CreateObject
 	tmpObject := &gcs.Object{
@@ -0,0 +1,292 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/ratelimit"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// The period over which the limits of a BandwidthWindow are enforced to
+// within a few percent. This is kept short so that the allowance built up
+// while a window is inactive doesn't permit a large burst when it begins.
+const bandwidthLimitPeriod = 10 * time.Second
+
+// A BandwidthWindow limits the rate at which object contents are read and
+// written during a daily period of local time.
+type BandwidthWindow struct {
+	// The start and end of the period, as offsets from midnight. If End is not
+	// after Start, the period spans midnight.
+	Start time.Duration
+	End   time.Duration
+
+	// The limits in bytes per second, or negative for no limit.
+	ReadLimit  float64
+	WriteLimit float64
+}
+
+// ParseBandwidthWindow parses a window of the form
+//
+//     HH:MM-HH:MM=read/write
+//
+// where read and write are limits in bytes per second, or "none".
+func ParseBandwidthWindow(s string) (w BandwidthWindow, err error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		err = fmt.Errorf("Missing '=' in %q", s)
+		return
+	}
+
+	times := strings.Split(strings.TrimSpace(s[:i]), "-")
+	limits := strings.Split(strings.TrimSpace(s[i+1:]), "/")
+	if len(times) != 2 || len(limits) != 2 {
+		err = fmt.Errorf("Expected HH:MM-HH:MM=read/write, got %q", s)
+		return
+	}
+
+	if w.Start, err = parseTimeOfDay(times[0]); err != nil {
+		return
+	}
+
+	if w.End, err = parseTimeOfDay(times[1]); err != nil {
+		return
+	}
+
+	if w.ReadLimit, err = parseBandwidthLimit(limits[0]); err != nil {
+		return
+	}
+
+	if w.WriteLimit, err = parseBandwidthLimit(limits[1]); err != nil {
+		return
+	}
+
+	return
+}
+
+func parseTimeOfDay(s string) (d time.Duration, err error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		err = fmt.Errorf("Illegal time of day %q; want HH:MM", s)
+		return
+	}
+
+	d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	return
+}
+
+func parseBandwidthLimit(s string) (limit float64, err error) {
+	s = strings.TrimSpace(s)
+	if s == "none" {
+		limit = -1
+		return
+	}
+
+	limit, err = strconv.ParseFloat(s, 64)
+	if err != nil || !(limit > 0) {
+		err = fmt.Errorf("Illegal limit %q; want bytes per second or none", s)
+		return
+	}
+
+	return
+}
+
+func (w BandwidthWindow) String() string {
+	format := func(limit float64) string {
+		if limit < 0 {
+			return "none"
+		}
+
+		return strconv.FormatFloat(limit, 'g', -1, 64)
+	}
+
+	return fmt.Sprintf(
+		"%02d:%02d-%02d:%02d=%s/%s",
+		int(w.Start/time.Hour),
+		int(w.Start%time.Hour/time.Minute),
+		int(w.End/time.Hour),
+		int(w.End%time.Hour/time.Minute),
+		format(w.ReadLimit),
+		format(w.WriteLimit))
+}
+
+// Does the window include the supplied time?
+func (w BandwidthWindow) contains(t time.Time) bool {
+	t = t.Local()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	if w.Start < w.End {
+		return w.Start <= offset && offset < w.End
+	}
+
+	return offset >= w.Start || offset < w.End
+}
+
+// NewScheduledThrottledBucket creates a bucket that limits the rate at which
+// object contents are read from and written to the wrapped bucket according
+// to the first of the supplied windows that includes the current time, as
+// given by the clock. Outside of all of the windows there is no limit.
+func NewScheduledThrottledBucket(
+	windows []BandwidthWindow,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b gcs.Bucket, err error) {
+	read := &scheduledThrottle{clock: clock, windows: windows}
+	write := &scheduledThrottle{clock: clock, windows: windows}
+
+	for _, w := range windows {
+		var rt, wt ratelimit.Throttle
+		if rt, err = newBandwidthThrottle(w.ReadLimit); err != nil {
+			err = fmt.Errorf("%v: %v", w, err)
+			return
+		}
+
+		if wt, err = newBandwidthThrottle(w.WriteLimit); err != nil {
+			err = fmt.Errorf("%v: %v", w, err)
+			return
+		}
+
+		read.throttles = append(read.throttles, rt)
+		write.throttles = append(write.throttles, wt)
+	}
+
+	b = &scheduledThrottledBucket{
+		Bucket: wrapped,
+		read:   read,
+		write:  write,
+	}
+
+	return
+}
+
+// Create a throttle for the supplied limit, or return nil if there is none.
+func newBandwidthThrottle(limit float64) (t ratelimit.Throttle, err error) {
+	if limit < 0 {
+		return
+	}
+
+	capacity, err := ratelimit.ChooseTokenBucketCapacity(
+		limit,
+		bandwidthLimitPeriod)
+
+	if err != nil {
+		err = fmt.Errorf("ChooseTokenBucketCapacity: %v", err)
+		return
+	}
+
+	t = ratelimit.NewThrottle(limit, capacity)
+	return
+}
+
+// A throttle that defers to the throttle for the current window.
+type scheduledThrottle struct {
+	clock   timeutil.Clock
+	windows []BandwidthWindow
+
+	// The throttle for each window, or nil if it has no limit.
+	throttles []ratelimit.Throttle
+}
+
+var _ ratelimit.Throttle = &scheduledThrottle{}
+
+// Return the throttle for the current window, or nil if there is no limit.
+func (t *scheduledThrottle) current() ratelimit.Throttle {
+	now := t.clock.Now()
+	for i, w := range t.windows {
+		if w.contains(now) {
+			return t.throttles[i]
+		}
+	}
+
+	return nil
+}
+
+func (t *scheduledThrottle) Capacity() (c uint64) {
+	// Wait accepts any amount, so allow reads of a reasonable size.
+	c = 1 << 20
+	for _, wt := range t.throttles {
+		if wt != nil && wt.Capacity() > c {
+			c = wt.Capacity()
+		}
+	}
+
+	return
+}
+
+func (t *scheduledThrottle) Wait(
+	ctx context.Context,
+	tokens uint64) (err error) {
+	// The window may change between calls, and a window's throttle may have a
+	// smaller capacity than we advertise, so wait in pieces.
+	for tokens > 0 {
+		wt := t.current()
+		if wt == nil {
+			return
+		}
+
+		n := tokens
+		if n > wt.Capacity() {
+			n = wt.Capacity()
+		}
+
+		err = wt.Wait(ctx, n)
+		if err != nil {
+			return
+		}
+
+		tokens -= n
+	}
+
+	return
+}
+
+type scheduledThrottledBucket struct {
+	gcs.Bucket
+	read  ratelimit.Throttle
+	write ratelimit.Throttle
+}
+
+func (b *scheduledThrottledBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	rc = struct {
+		io.Reader
+		io.Closer
+	}{ratelimit.ThrottledReader(ctx, rc, b.read), rc}
+
+	return
+}
+
+func (b *scheduledThrottledBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	throttled := *req
+	throttled.Contents = ratelimit.ThrottledReader(ctx, req.Contents, b.write)
+
+	o, err = b.Bucket.CreateObject(ctx, &throttled)
+	return
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestBandwidthSchedule(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Large enough that reading or writing it at the limits below takes far
+// longer than a test should.
+const scheduledObjectSize = 1 << 20
+
+type BandwidthScheduleTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+func init() { RegisterTestSuite(&BandwidthScheduleTest{}) }
+
+func (t *BandwidthScheduleTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 6, 12, 0, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.wrapped,
+		"foo",
+		make([]byte, scheduledObjectSize))
+
+	AssertEq(nil, err)
+
+	// Limited during the day, and not at all at night.
+	var windows []gcsx.BandwidthWindow
+	for _, s := range []string{
+		"09:00-18:00=100/200",
+		"22:00-06:00=none/none",
+		"06:00-09:00=none/100",
+	} {
+		w, err := gcsx.ParseBandwidthWindow(s)
+		AssertEq(nil, err)
+		windows = append(windows, w)
+	}
+
+	t.bucket, err = gcsx.NewScheduledThrottledBucket(windows, &t.clock, t.wrapped)
+	AssertEq(nil, err)
+}
+
+func (t *BandwidthScheduleTest) setTimeOfDay(hour int, min int) {
+	t.clock.SetTime(time.Date(2015, 4, 6, hour, min, 0, 0, time.Local))
+}
+
+// Read the object with a short deadline.
+func (t *BandwidthScheduleTest) read() (err error) {
+	ctx, cancel := context.WithTimeout(t.ctx, 50*time.Millisecond)
+	defer cancel()
+
+	rc, err := t.bucket.NewReader(ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	_, err = ioutil.ReadAll(rc)
+	return
+}
+
+// Write the object with a short deadline.
+func (t *BandwidthScheduleTest) write() (err error) {
+	ctx, cancel := context.WithTimeout(t.ctx, 50*time.Millisecond)
+	defer cancel()
+
+	_, err = t.bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:     "foo",
+		Contents: bytes.NewReader(make([]byte, scheduledObjectSize)),
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BandwidthScheduleTest) ParseWindow() {
+	w, err := gcsx.ParseBandwidthWindow(" 22:30 - 06:15 = 1.5e6 / none ")
+	AssertEq(nil, err)
+
+	ExpectEq(22*time.Hour+30*time.Minute, w.Start)
+	ExpectEq(6*time.Hour+15*time.Minute, w.End)
+	ExpectEq(1.5e6, w.ReadLimit)
+	ExpectLt(w.WriteLimit, 0)
+	ExpectEq("22:30-06:15=1.5e+06/none", w.String())
+}
+
+func (t *BandwidthScheduleTest) ParseWindow_Illegal() {
+	testCases := []string{
+		"",
+		"09:00-18:00",
+		"09:00=100/100",
+		"09:00-18:00=100",
+		"9am-6pm=100/100",
+		"09:00-24:00=100/100",
+		"09:00-18:00=taco/100",
+		"09:00-18:00=0/100",
+		"09:00-18:00=100/-1",
+	}
+
+	for _, tc := range testCases {
+		_, err := gcsx.ParseBandwidthWindow(tc)
+		ExpectNe(nil, err, "value: %q", tc)
+	}
+}
+
+func (t *BandwidthScheduleTest) OutsideAllWindows() {
+	t.setTimeOfDay(20, 0)
+
+	ExpectEq(nil, t.read())
+	ExpectEq(nil, t.write())
+}
+
+func (t *BandwidthScheduleTest) WindowWithoutLimits() {
+	t.setTimeOfDay(23, 0)
+	ExpectEq(nil, t.read())
+
+	// After midnight.
+	t.setTimeOfDay(1, 0)
+	ExpectEq(nil, t.read())
+	ExpectEq(nil, t.write())
+}
+
+func (t *BandwidthScheduleTest) LimitedWindow() {
+	t.setTimeOfDay(12, 0)
+
+	ExpectThat(t.read(), Error(HasSubstr("deadline")))
+	ExpectThat(t.write(), Error(HasSubstr("deadline")))
+}
+
+func (t *BandwidthScheduleTest) OnlyWritesLimited() {
+	t.setTimeOfDay(7, 0)
+
+	ExpectEq(nil, t.read())
+	ExpectThat(t.write(), Error(HasSubstr("deadline")))
+}
+
+func (t *BandwidthScheduleTest) WindowBeginsDuringRead() {
+	t.setTimeOfDay(8, 59)
+
+	ctx, cancel := context.WithTimeout(t.ctx, 50*time.Millisecond)
+	defer cancel()
+
+	rc, err := t.bucket.NewReader(ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	// Unlimited to begin with.
+	buf := make([]byte, scheduledObjectSize/2)
+	_, err = io.ReadFull(rc, buf)
+	AssertEq(nil, err)
+
+	// The limit applies to the rest once the window begins.
+	t.setTimeOfDay(9, 0)
+
+	_, err = ioutil.ReadAll(rc)
+	ExpectThat(err, Error(HasSubstr("deadline")))
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffers used on the read path are taken from pools of power-of-two sizes,
+// so that high-throughput reads don't allocate a fresh chunk for each range
+// fetched and leave the garbage collector to clean up after them.
+//
+// The smallest and largest size classes pooled. Smaller buffers are cheap to
+// allocate, and larger ones are rare enough not to be worth holding on to.
+const (
+	minPooledBufferShift = 12
+	maxPooledBufferShift = 27
+)
+
+var bufferPools [maxPooledBufferShift + 1]sync.Pool
+
+// The size class of buffers able to hold n bytes, or -1 if they aren't pooled.
+func bufferClass(n int) (class int) {
+	if n <= 0 {
+		class = -1
+		return
+	}
+
+	class = bits.Len(uint(n - 1))
+	if class < minPooledBufferShift {
+		class = minPooledBufferShift
+	}
+
+	if class > maxPooledBufferShift {
+		class = -1
+	}
+
+	return
+}
+
+// Return a buffer of length n, whose contents are undefined. Hand it back with
+// putBuffer once finished with it.
+func getBuffer(n int) (b []byte) {
+	class := bufferClass(n)
+	if class < 0 {
+		b = make([]byte, n)
+		return
+	}
+
+	if p, ok := bufferPools[class].Get().(*[]byte); ok {
+		b = (*p)[:n]
+		return
+	}
+
+	b = make([]byte, n, 1<<uint(class))
+	return
+}
+
+// Return a buffer obtained from getBuffer to its pool. The caller must not use
+// it afterwards.
+func putBuffer(b []byte) {
+	// Buffers whose capacity isn't exactly a size class didn't come from a
+	// pool, so let the garbage collector have them.
+	class := bufferClass(cap(b))
+	if class < 0 || cap(b) != 1<<uint(class) {
+		return
+	}
+
+	b = b[:cap(b)]
+	bufferPools[class].Put(&b)
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"testing"
+
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestBufferPool(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type BufferPoolTest struct {
+}
+
+func init() { RegisterTestSuite(&BufferPoolTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BufferPoolTest) SizeClasses() {
+	ExpectEq(-1, bufferClass(0))
+	ExpectEq(minPooledBufferShift, bufferClass(1))
+	ExpectEq(minPooledBufferShift, bufferClass(1<<minPooledBufferShift))
+	ExpectEq(minPooledBufferShift+1, bufferClass(1<<minPooledBufferShift+1))
+	ExpectEq(20, bufferClass(MB))
+	ExpectEq(maxPooledBufferShift, bufferClass(1<<maxPooledBufferShift))
+	ExpectEq(-1, bufferClass(1<<maxPooledBufferShift+1))
+}
+
+func (t *BufferPoolTest) LengthAndCapacity() {
+	b := getBuffer(MB + 1)
+	ExpectEq(MB+1, len(b))
+	ExpectEq(2*MB, cap(b))
+	putBuffer(b)
+
+	// Buffers too large to pool are allocated exactly.
+	b = getBuffer(1<<maxPooledBufferShift + 1)
+	ExpectEq(1<<maxPooledBufferShift+1, len(b))
+	ExpectEq(1<<maxPooledBufferShift+1, cap(b))
+	putBuffer(b)
+}
+
+func (t *BufferPoolTest) ReusesBuffers() {
+	// sync.Pool makes no promises, so retry a few times before concluding that
+	// buffers aren't reused.
+	reused := false
+	for i := 0; i < 10 && !reused; i++ {
+		b := getBuffer(100)
+		b[0] = 17
+		putBuffer(b)
+
+		reused = &getBuffer(200)[0] == &b[0]
+	}
+
+	ExpectTrue(reused)
+}
+
+func (t *BufferPoolTest) IgnoresForeignBuffers() {
+	// Neither of these came from a pool, and neither should end up in one.
+	putBuffer(nil)
+	putBuffer(make([]byte, 100))
+
+	b := getBuffer(100)
+	ExpectEq(1<<minPooledBufferShift, cap(b))
+}
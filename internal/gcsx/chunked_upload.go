@@ -0,0 +1,197 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/jacobsa/gcloud/httputil"
+	"google.golang.org/api/googleapi"
+)
+
+// GCS requires all but the last chunk of a resumable upload to be a multiple
+// of this many bytes.
+const uploadChunkQuantum = 256 << 10
+
+// NewChunkedUploadRoundTripper returns a round tripper that sends the
+// contents of each resumable upload, which the GCS client sends in a single
+// request, in requests of chunkSize bytes rounded up to a multiple of 256 KiB
+// instead, holding one in memory at a time. Whatever GCS reports not having
+// persisted of a chunk is sent again with the next. Other requests are passed
+// through unmodified.
+//
+// Cf. https://cloud.google.com/storage/docs/performing-resumable-uploads
+func NewChunkedUploadRoundTripper(
+	chunkSize int,
+	wrapped httputil.CancellableRoundTripper) httputil.CancellableRoundTripper {
+	chunkSize += uploadChunkQuantum - 1
+	chunkSize -= chunkSize % uploadChunkQuantum
+
+	return &chunkedUploadRoundTripper{
+		rewritingRoundTripper: newRewritingRoundTripper(nil, wrapped),
+		chunkSize:             chunkSize,
+	}
+}
+
+type chunkedUploadRoundTripper struct {
+	*rewritingRoundTripper
+	chunkSize int
+}
+
+func (rt *chunkedUploadRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	// The contents of a resumable upload are put to the URL GCS returns when
+	// starting it, which identifies the upload with a query parameter. Requests
+	// already saying which part they send are left alone.
+	upload := req.Method == "PUT" &&
+		strings.HasPrefix(requestPath(req.URL), "/upload/") &&
+		req.URL.Query().Get("upload_id") != "" &&
+		req.Header.Get("Content-Range") == ""
+
+	if !upload || req.Body == nil {
+		resp, err = rt.wrapped.RoundTrip(req)
+		return
+	}
+
+	// We must close the body we were given, whatever happens.
+	defer req.Body.Close()
+
+	// Read a byte beyond each chunk, so that we know whether it is the last one
+	// without sending an empty request to finish the upload. Bytes not yet
+	// persisted are carried over to the front of the buffer for the next
+	// chunk.
+	buf := make([]byte, rt.chunkSize+1)
+	var n int
+	var offset int64
+	var eof bool
+
+	for {
+		if !eof {
+			var m int
+			m, err = io.ReadFull(req.Body, buf[n:])
+			n += m
+
+			switch err {
+			case nil:
+			case io.EOF, io.ErrUnexpectedEOF:
+				eof = true
+				err = nil
+
+			default:
+				err = fmt.Errorf("Reading contents: %v", err)
+				return
+			}
+		}
+
+		chunk := buf[:n]
+		if !eof {
+			chunk = buf[:rt.chunkSize]
+		}
+
+		resp, err = rt.sendChunk(req, chunk, offset, eof)
+		if err != nil {
+			return
+		}
+
+		// Anything other than "resume incomplete" is left to the caller, which
+		// treats it as success or an error as usual.
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			return
+		}
+
+		// Find out how much GCS kept, which may be less than we sent.
+		var persisted int64
+		persisted, err = persistedBytes(resp)
+		googleapi.CloseBody(resp)
+		resp = nil
+
+		if err != nil {
+			return
+		}
+
+		sent := persisted - offset
+		if sent <= 0 || sent > int64(len(chunk)) {
+			err = fmt.Errorf(
+				"GCS reports %d bytes persisted after sending %d at offset %d",
+				persisted,
+				len(chunk),
+				offset)
+			return
+		}
+
+		n = copy(buf, buf[sent:n])
+		offset = persisted
+	}
+}
+
+// Send one chunk of the upload begun by req, starting at the given offset,
+// and with the last one saying how long the object is.
+func (rt *chunkedUploadRoundTripper) sendChunk(
+	req *http.Request,
+	chunk []byte,
+	offset int64,
+	last bool) (resp *http.Response, err error) {
+	end := offset + int64(len(chunk))
+
+	var contentRange string
+	switch {
+	case !last:
+		contentRange = fmt.Sprintf("bytes %d-%d/*", offset, end-1)
+
+	case len(chunk) == 0:
+		contentRange = fmt.Sprintf("bytes */%d", end)
+
+	default:
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, end-1, end)
+	}
+
+	// Make a copy of the request with the chunk as its body.
+	modified := copyRequest(req)
+	modified.Header.Set("Content-Range", contentRange)
+	modified.ContentLength = int64(len(chunk))
+	modified.Body = http.NoBody
+	modified.GetBody = nil
+	if len(chunk) > 0 {
+		modified.Body = ioutil.NopCloser(bytes.NewReader(chunk))
+	}
+
+	resp, err = rt.send(req, modified)
+	return
+}
+
+// Return the number of bytes of a resumable upload that GCS reports having
+// persisted in the supplied "resume incomplete" response.
+func persistedBytes(resp *http.Response) (n int64, err error) {
+	// The header looks like "bytes=0-1234", and is missing if nothing has been
+	// persisted.
+	r := resp.Header.Get("Range")
+	if r == "" {
+		return
+	}
+
+	var first, last int64
+	if _, err = fmt.Sscanf(r, "bytes=%d-%d", &first, &last); err != nil {
+		err = fmt.Errorf("Parsing Range header %q: %v", r, err)
+		return
+	}
+
+	n = last + 1
+	return
+}
@@ -0,0 +1,318 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestChunkedUpload(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The size of the chunks sent.
+const uploadChunkSize = 256 << 10
+
+type ChunkedUploadTest struct {
+	server *httptest.Server
+	rt     http.RoundTripper
+
+	mu sync.Mutex
+
+	// The Content-Range headers received, in order.
+	ranges []string
+
+	// The contents persisted so far.
+	persisted []byte
+
+	// If positive, the number of bytes of the next chunk to persist, as GCS
+	// may persist less than it was sent.
+	persistLimit int
+
+	// If non-zero, the status with which to fail the next chunk.
+	failStatus int
+
+	// If non-empty, the Range header to send with the next "resume incomplete"
+	// response, in place of the right one.
+	bogusRange string
+}
+
+var _ SetUpInterface = &ChunkedUploadTest{}
+var _ TearDownInterface = &ChunkedUploadTest{}
+
+func init() { RegisterTestSuite(&ChunkedUploadTest{}) }
+
+func (t *ChunkedUploadTest) SetUp(ti *TestInfo) {
+	t.server = httptest.NewServer(http.HandlerFunc(t.serve))
+
+	// Chunks of one byte are rounded up to 256 KiB.
+	t.rt = gcsx.NewChunkedUploadRoundTripper(
+		1,
+		http.DefaultTransport.(*http.Transport))
+}
+
+func (t *ChunkedUploadTest) TearDown() {
+	t.server.Close()
+}
+
+// Serve requests for a resumable upload as GCS does, keeping what is sent in
+// t.persisted.
+func (t *ChunkedUploadTest) serve(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cr := r.Header.Get("Content-Range")
+	t.ranges = append(t.ranges, cr)
+
+	if t.failStatus != 0 {
+		http.Error(w, "failed", t.failStatus)
+		t.failStatus = 0
+		return
+	}
+
+	// Parse the range, which is one of "bytes */total", "bytes first-last/*",
+	// and "bytes first-last/total".
+	first := int64(len(t.persisted))
+	total := int64(-1)
+	var last int64
+
+	switch {
+	case cr == "":
+		http.Error(w, "Missing Content-Range", http.StatusBadRequest)
+		return
+
+	case strings.HasPrefix(cr, "bytes */"):
+		_, err = fmt.Sscanf(cr, "bytes */%d", &total)
+
+	case strings.HasSuffix(cr, "/*"):
+		_, err = fmt.Sscanf(cr, "bytes %d-%d/*", &first, &last)
+
+	default:
+		_, err = fmt.Sscanf(cr, "bytes %d-%d/%d", &first, &last, &total)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if first != int64(len(t.persisted)) {
+		http.Error(w, "Not contiguous", http.StatusBadRequest)
+		return
+	}
+
+	if t.persistLimit > 0 && len(body) > t.persistLimit {
+		body = body[:t.persistLimit]
+		total = -1
+		t.persistLimit = 0
+	}
+
+	t.persisted = append(t.persisted, body...)
+
+	if total >= 0 && int64(len(t.persisted)) == total {
+		fmt.Fprintf(w, `{"name":"foo","size":"%d"}`, total)
+		return
+	}
+
+	w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(t.persisted)-1))
+	if t.bogusRange != "" {
+		w.Header().Set("Range", t.bogusRange)
+		t.bogusRange = ""
+	}
+
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// Put the supplied contents to the upload URL through the round tripper.
+func (t *ChunkedUploadTest) upload(
+	contents []byte) (resp *http.Response, err error) {
+	req, err := http.NewRequest(
+		"PUT",
+		t.server.URL+"/upload/storage/v1/b/some_bucket/o?"+
+			"uploadType=resumable&upload_id=taco",
+		ioutil.NopCloser(bytes.NewReader(contents)))
+
+	AssertEq(nil, err)
+	req.ContentLength = -1
+
+	resp, err = t.rt.RoundTrip(req)
+	return
+}
+
+// Return contents of the given length, differing from chunk to chunk.
+func makeContents(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i / 1000)
+	}
+
+	return b
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ChunkedUploadTest) SeveralChunks() {
+	contents := makeContents(2*uploadChunkSize + 1000)
+
+	resp, err := t.upload(contents)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	ExpectEq(http.StatusOK, resp.StatusCode)
+	ExpectThat(
+		t.ranges,
+		ElementsAre(
+			"bytes 0-262143/*",
+			"bytes 262144-524287/*",
+			"bytes 524288-525287/525288"))
+
+	ExpectTrue(bytes.Equal(contents, t.persisted))
+}
+
+func (t *ChunkedUploadTest) MultipleOfChunkSize() {
+	contents := makeContents(2 * uploadChunkSize)
+
+	resp, err := t.upload(contents)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	// The last chunk says how long the object is, with no empty request
+	// afterward.
+	ExpectEq(http.StatusOK, resp.StatusCode)
+	ExpectThat(
+		t.ranges,
+		ElementsAre("bytes 0-262143/*", "bytes 262144-524287/524288"))
+
+	ExpectTrue(bytes.Equal(contents, t.persisted))
+}
+
+func (t *ChunkedUploadTest) Empty() {
+	resp, err := t.upload(nil)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	ExpectEq(http.StatusOK, resp.StatusCode)
+	ExpectThat(t.ranges, ElementsAre("bytes */0"))
+}
+
+func (t *ChunkedUploadTest) ResumesAfterPartialPersist() {
+	contents := makeContents(2*uploadChunkSize + 1000)
+	t.persistLimit = 100000
+
+	resp, err := t.upload(contents)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	// What GCS didn't keep of the first chunk is sent again with the second.
+	ExpectEq(http.StatusOK, resp.StatusCode)
+	ExpectThat(
+		t.ranges,
+		ElementsAre(
+			"bytes 0-262143/*",
+			"bytes 100000-362143/*",
+			"bytes 362144-525287/525288"))
+
+	ExpectTrue(bytes.Equal(contents, t.persisted))
+}
+
+func (t *ChunkedUploadTest) ResumesAfterPartialPersistOfLastChunk() {
+	contents := makeContents(1000)
+	t.persistLimit = 600
+
+	resp, err := t.upload(contents)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	ExpectEq(http.StatusOK, resp.StatusCode)
+	ExpectThat(
+		t.ranges,
+		ElementsAre("bytes 0-999/1000", "bytes 600-999/1000"))
+
+	ExpectTrue(bytes.Equal(contents, t.persisted))
+}
+
+func (t *ChunkedUploadTest) ErrorStatus() {
+	contents := makeContents(2 * uploadChunkSize)
+	t.failStatus = http.StatusServiceUnavailable
+
+	// The response is left to the caller.
+	resp, err := t.upload(contents)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	ExpectEq(http.StatusServiceUnavailable, resp.StatusCode)
+	ExpectThat(t.ranges, ElementsAre("bytes 0-262143/*"))
+}
+
+func (t *ChunkedUploadTest) BogusRange() {
+	contents := makeContents(2 * uploadChunkSize)
+	t.bogusRange = "bytes=0-999999"
+
+	_, err := t.upload(contents)
+	ExpectThat(err, Error(HasSubstr("1000000 bytes persisted")))
+}
+
+func (t *ChunkedUploadTest) OtherRequestsUnmodified() {
+	req, err := http.NewRequest(
+		"PUT",
+		t.server.URL+"/upload/storage/v1/b/some_bucket/o?"+
+			"uploadType=resumable&upload_id=taco",
+		bytes.NewReader([]byte("taco")))
+
+	AssertEq(nil, err)
+	req.Header.Set("Content-Range", "bytes 0-3/4")
+
+	resp, err := t.rt.RoundTrip(req)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	ExpectEq(http.StatusOK, resp.StatusCode)
+	ExpectThat(t.ranges, ElementsAre("bytes 0-3/4"))
+	ExpectEq("taco", string(t.persisted))
+
+	req, err = http.NewRequest(
+		"GET",
+		t.server.URL+"/storage/v1/b/some_bucket/o/foo",
+		nil)
+
+	AssertEq(nil, err)
+
+	resp, err = t.rt.RoundTrip(req)
+	AssertEq(nil, err)
+	resp.Body.Close()
+
+	ExpectEq("", t.ranges[1])
+}
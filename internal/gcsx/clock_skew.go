@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/gcloud/httputil"
+	"github.com/jacobsa/timeutil"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// How often to repeat the warning about a skewed clock while it remains
+// skewed.
+const clockSkewWarningInterval = 10 * time.Minute
+
+// The most recent estimate of the clock skew, in nanoseconds. Accessed
+// atomically.
+var latestClockSkew int64
+
+// ClockSkew returns the most recent estimate made by a round tripper returned
+// by NewClockSkewRoundTripper of how far the local clock is ahead of GCS's
+// clock, negative if it is behind, or zero if no estimate has been made. The
+// same value is published by package expvar, in seconds, under the name
+// "clock_skew_seconds".
+func ClockSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&latestClockSkew))
+}
+
+func init() {
+	expvar.Publish(
+		"clock_skew_seconds",
+		expvar.Func(func() interface{} { return ClockSkew().Seconds() }))
+}
+
+// NewClockSkewRoundTripper returns a round tripper that compares the Date
+// header of each response from the wrapped round tripper against the supplied
+// clock, updating ClockSkew and logging a warning when the two differ by more
+// than the threshold.
+//
+// A skewed clock makes signed URLs and freshly refreshed OAuth tokens appear
+// not yet valid or already expired, and makes the mtimes gcsfuse records
+// disagree with the times GCS records, so it is worth knowing about.
+func NewClockSkewRoundTripper(
+	threshold time.Duration,
+	clock timeutil.Clock,
+	wrapped httputil.CancellableRoundTripper) httputil.CancellableRoundTripper {
+	return &clockSkewRoundTripper{
+		threshold: threshold,
+		clock:     clock,
+		wrapped:   wrapped,
+	}
+}
+
+type clockSkewRoundTripper struct {
+	threshold time.Duration
+	clock     timeutil.Clock
+	wrapped   httputil.CancellableRoundTripper
+
+	mu sync.Mutex
+
+	// When we last warned about the skew exceeding the threshold, or the zero
+	// time if it has been within the threshold since then.
+	//
+	// GUARDED_BY(mu)
+	lastWarning time.Time
+}
+
+func (rt *clockSkewRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	sent := rt.clock.Now()
+	resp, err = rt.wrapped.RoundTrip(req)
+	received := rt.clock.Now()
+
+	if err != nil {
+		return
+	}
+
+	// Some servers, e.g. emulators, may not send a date.
+	date, parseErr := http.ParseTime(resp.Header.Get("Date"))
+	if parseErr != nil {
+		return
+	}
+
+	rt.record(measureClockSkew(sent, received, date))
+	return
+}
+
+func (rt *clockSkewRoundTripper) CancelRequest(req *http.Request) {
+	rt.wrapped.CancelRequest(req)
+}
+
+// Estimate how far the local clock is ahead of the server's, given the local
+// times at which a request was sent and its response received and the date
+// the server gave in the response. The date is truncated to a whole second
+// and may have been chosen at any point while the request was in flight, so
+// only a difference outside of that window is counted.
+func measureClockSkew(
+	sent time.Time,
+	received time.Time,
+	date time.Time) (skew time.Duration) {
+	latest := date.Add(time.Second)
+
+	switch {
+	case sent.After(latest):
+		skew = sent.Sub(latest)
+
+	case received.Before(date):
+		skew = received.Sub(date)
+	}
+
+	return
+}
+
+// Record the supplied estimate of the skew, warning if appropriate.
+//
+// LOCKS_EXCLUDED(rt.mu)
+func (rt *clockSkewRoundTripper) record(skew time.Duration) {
+	atomic.StoreInt64(&latestClockSkew, int64(skew))
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	magnitude := skew
+	direction := "ahead of"
+	if skew < 0 {
+		magnitude = -skew
+		direction = "behind"
+	}
+
+	// Is the skew acceptable? If so, say so if we've previously complained.
+	if magnitude <= rt.threshold {
+		if !rt.lastWarning.IsZero() {
+			logger.Infof(
+				"The local clock is again within %v of the clock at GCS.",
+				rt.threshold)
+
+			rt.lastWarning = time.Time{}
+		}
+
+		return
+	}
+
+	// Don't repeat ourselves too often.
+	now := rt.clock.Now()
+	if !rt.lastWarning.IsZero() &&
+		now.Sub(rt.lastWarning) < clockSkewWarningInterval {
+		return
+	}
+
+	rt.lastWarning = now
+	logger.Warningf(
+		"The local clock is %v %s the clock at GCS, which may cause "+
+			"authentication failures and confusing modification times. Check "+
+			"that the system's time is synchronized (e.g. by NTP).",
+		magnitude,
+		direction)
+}
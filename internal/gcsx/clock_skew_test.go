@@ -0,0 +1,214 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestClockSkew(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A round tripper that responds to every request with the configured Date
+// header, taking the configured time to do so according to the clock.
+type dateRoundTripper struct {
+	clock   *timeutil.SimulatedClock
+	date    string
+	latency time.Duration
+	err     error
+}
+
+func (rt *dateRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	rt.clock.AdvanceTime(rt.latency)
+	if rt.err != nil {
+		err = rt.err
+		return
+	}
+
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+
+	if rt.date != "" {
+		resp.Header.Set("Date", rt.date)
+	}
+
+	return
+}
+
+func (rt *dateRoundTripper) CancelRequest(req *http.Request) {
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ClockSkewTest struct {
+	clock   timeutil.SimulatedClock
+	wrapped dateRoundTripper
+	rt      httputil.CancellableRoundTripper
+
+	// Where the default logger writes during the test.
+	logs bytes.Buffer
+}
+
+var _ SetUpInterface = &ClockSkewTest{}
+var _ TearDownInterface = &ClockSkewTest{}
+
+func init() { RegisterTestSuite(&ClockSkewTest{}) }
+
+func (t *ClockSkewTest) SetUp(ti *TestInfo) {
+	// Use a time with a whole number of seconds, as in Date headers.
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	t.wrapped.clock = &t.clock
+	t.rt = gcsx.NewClockSkewRoundTripper(time.Minute, &t.clock, &t.wrapped)
+
+	logger.Init(&t.logs, logger.FormatText, logger.Info)
+}
+
+func (t *ClockSkewTest) TearDown() {
+	logger.Init(os.Stderr, logger.FormatText, logger.Info)
+}
+
+// Make a request, with the server claiming that the time is the local time
+// plus the given offset.
+func (t *ClockSkewTest) call(serverOffset time.Duration) {
+	t.wrapped.date = t.clock.Now().Add(serverOffset).UTC().Format(http.TimeFormat)
+
+	req, err := http.NewRequest("GET", "https://www.googleapis.com/foo", nil)
+	AssertEq(nil, err)
+
+	_, err = t.rt.RoundTrip(req)
+	AssertEq(nil, err)
+}
+
+func (t *ClockSkewTest) warnings() int {
+	return strings.Count(t.logs.String(), " WARNING ")
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ClockSkewTest) NoSkew() {
+	t.call(0)
+
+	ExpectEq(0, gcsx.ClockSkew())
+	ExpectEq("", t.logs.String())
+}
+
+func (t *ClockSkewTest) DateWithinRequestWindow() {
+	// The server may have chosen its date at any time while the request was in
+	// flight, and truncated it to the second.
+	t.wrapped.latency = 10 * time.Second
+	t.call(7 * time.Second)
+	ExpectEq(0, gcsx.ClockSkew())
+
+	t.wrapped.latency = 0
+	t.clock.AdvanceTime(999 * time.Millisecond)
+	t.call(-999 * time.Millisecond)
+	ExpectEq(0, gcsx.ClockSkew())
+}
+
+func (t *ClockSkewTest) LocalClockAhead() {
+	t.call(-2 * time.Minute)
+
+	ExpectEq(2*time.Minute-time.Second, gcsx.ClockSkew())
+	ExpectThat(t.logs.String(), HasSubstr("1m59s ahead of the clock at GCS"))
+}
+
+func (t *ClockSkewTest) LocalClockBehind() {
+	t.call(5 * time.Minute)
+
+	ExpectEq(-5*time.Minute, gcsx.ClockSkew())
+	ExpectThat(t.logs.String(), HasSubstr("5m0s behind the clock at GCS"))
+}
+
+func (t *ClockSkewTest) SkewWithinThreshold() {
+	t.call(-30 * time.Second)
+
+	ExpectEq(29*time.Second, gcsx.ClockSkew())
+	ExpectEq("", t.logs.String())
+}
+
+func (t *ClockSkewTest) WarningsAreRateLimited() {
+	t.call(5 * time.Minute)
+	ExpectEq(1, t.warnings())
+
+	t.clock.AdvanceTime(time.Minute)
+	t.call(5 * time.Minute)
+	ExpectEq(1, t.warnings())
+
+	t.clock.AdvanceTime(10 * time.Minute)
+	t.call(5 * time.Minute)
+	ExpectEq(2, t.warnings())
+}
+
+func (t *ClockSkewTest) RecoveryIsLogged() {
+	t.call(5 * time.Minute)
+	AssertEq(1, t.warnings())
+
+	t.call(0)
+	ExpectThat(t.logs.String(), HasSubstr("again within 1m0s"))
+
+	// A fresh skew should be reported immediately.
+	t.call(5 * time.Minute)
+	ExpectEq(2, t.warnings())
+}
+
+func (t *ClockSkewTest) MissingDate() {
+	t.call(-5 * time.Minute)
+	AssertNe(0, gcsx.ClockSkew())
+
+	// A response without a date should leave the estimate alone.
+	t.wrapped.date = ""
+	req, err := http.NewRequest("GET", "https://www.googleapis.com/foo", nil)
+	AssertEq(nil, err)
+
+	_, err = t.rt.RoundTrip(req)
+	AssertEq(nil, err)
+
+	ExpectEq(5*time.Minute-time.Second, gcsx.ClockSkew())
+}
+
+func (t *ClockSkewTest) ErrorsPassedThrough() {
+	t.wrapped.err = errors.New("taco")
+
+	req, err := http.NewRequest("GET", "https://www.googleapis.com/foo", nil)
+	AssertEq(nil, err)
+
+	_, err = t.rt.RoundTrip(req)
+	ExpectThat(err, Error(Equals("taco")))
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// An implementation detail of syncer, like objectCreator but for creators
+// that read the contents at arbitrary offsets.
+type parallelObjectCreator interface {
+	Create(
+		ctx context.Context,
+		srcObject *gcs.Object,
+		mtime time.Time,
+		r io.ReaderAt,
+		size int64) (o *gcs.Object, err error)
+}
+
+// Create a parallelObjectCreator that overwrites the source object with the
+// supplied contents by uploading them concurrently as up to the given number
+// of temporary objects using the supplied prefix, then composing those.
+//
+// Note that the Create method will attempt to remove the temporary objects,
+// but it may fail to do so. Users should arrange for garbage collection.
+//
+// Create guarantees to return *gcs.PreconditionError when the source object
+// has been clobbered.
+func newCompositeObjectCreator(
+	parts int,
+	prefix string,
+	bucket gcs.Bucket) (oc parallelObjectCreator) {
+	if parts > gcs.MaxSourcesPerComposeRequest {
+		parts = gcs.MaxSourcesPerComposeRequest
+	}
+
+	oc = &compositeObjectCreator{
+		parts:  parts,
+		prefix: prefix,
+		bucket: bucket,
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+type compositeObjectCreator struct {
+	parts  int
+	prefix string
+	bucket gcs.Bucket
+}
+
+// Upload the contents as temporary objects, one per element of the result,
+// which holds nil for those that weren't created. If any upload fails, the
+// others are cancelled.
+func (oc *compositeObjectCreator) uploadParts(
+	ctx context.Context,
+	r io.ReaderAt,
+	size int64) (tmps []*gcs.Object, err error) {
+	base, err := chooseTmpName(oc.prefix)
+	if err != nil {
+		err = fmt.Errorf("chooseTmpName: %v", err)
+		return
+	}
+
+	partSize := (size + int64(oc.parts) - 1) / int64(oc.parts)
+	if partSize == 0 {
+		partSize = 1
+	}
+
+	count := int((size + partSize - 1) / partSize)
+	tmps = make([]*gcs.Object, count)
+	errs := make([]error, count)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		off := int64(i) * partSize
+		n := partSize
+		if off+n > size {
+			n = size - off
+		}
+
+		wg.Add(1)
+		go func(i int, off int64, n int64) {
+			defer wg.Done()
+
+			// Checksum the part first, so that GCS can reject it if it's
+			// damaged on the way.
+			checksums, err := computeChecksums(io.NewSectionReader(r, off, n))
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+
+			var zero int64
+			req := &gcs.CreateObjectRequest{
+				Name:                   fmt.Sprintf("%s.%d", base, i),
+				GenerationPrecondition: &zero,
+				Contents:               io.NewSectionReader(r, off, n),
+			}
+
+			checksums.apply(req)
+			tmps[i], errs[i] = oc.bucket.CreateObject(ctx, req)
+
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i, off, n)
+	}
+
+	wg.Wait()
+
+	// Report the first error that wasn't caused by cancelling the others.
+	for _, e := range errs {
+		if e != nil && (err == nil || err == context.Canceled) {
+			err = e
+		}
+	}
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject: %v", err)
+		return
+	}
+
+	return
+}
+
+func (oc *compositeObjectCreator) Create(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	mtime time.Time,
+	r io.ReaderAt,
+	size int64) (o *gcs.Object, err error) {
+	tmps, err := oc.uploadParts(ctx, r, size)
+
+	// Attempt to delete the temporary objects when we're done, whether or not
+	// all of them were created.
+	defer func() {
+		for _, tmp := range tmps {
+			if tmp == nil {
+				continue
+			}
+
+			deleteErr := oc.bucket.DeleteObject(
+				ctx,
+				&gcs.DeleteObjectRequest{
+					Name: tmp.Name,
+				})
+
+			if err == nil && deleteErr != nil {
+				err = fmt.Errorf("DeleteObject: %v", deleteErr)
+			}
+		}
+	}()
+
+	if err != nil {
+		err = fmt.Errorf("uploadParts: %v", err)
+		return
+	}
+
+	// Compose the parts over the source object.
+	sources := make([]gcs.ComposeSource, len(tmps))
+	for i, tmp := range tmps {
+		sources[i] = gcs.ComposeSource{
+			Name:       tmp.Name,
+			Generation: tmp.Generation,
+		}
+	}
+
+	o, err = oc.bucket.ComposeObjects(
+		ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                       srcObject.Name,
+			DstGenerationPrecondition:     &srcObject.Generation,
+			DstMetaGenerationPrecondition: &srcObject.MetaGeneration,
+			Sources:                       sources,
+			Metadata:                      syncedMetadata(srcObject, mtime),
+		})
+
+	switch typed := err.(type) {
+	case nil:
+
+	case *gcs.PreconditionError:
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf("ComposeObjects: %v", typed.Err),
+		}
+		return
+
+	// The parts were only just created, so a not found error almost certainly
+	// means the source object was deleted.
+	case *gcs.NotFoundError:
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"Synthesized precondition error for ComposeObjects. Original: %v",
+				err),
+		}
+		return
+
+	default:
+		err = fmt.Errorf("ComposeObjects: %v", err)
+		return
+	}
+
+	return
+}
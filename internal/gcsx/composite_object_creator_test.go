@@ -0,0 +1,179 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestCompositeObjectCreator(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that fails to create objects whose names end with a given suffix.
+type partFailingBucket struct {
+	gcs.Bucket
+	suffix string
+}
+
+func (b *partFailingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if b.suffix != "" && strings.HasSuffix(req.Name, b.suffix) {
+		err = errors.New("taco")
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+type CompositeObjectCreatorTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	bucket  partFailingBucket
+	creator parallelObjectCreator
+
+	srcObject *gcs.Object
+	mtime     time.Time
+}
+
+var _ SetUpInterface = &CompositeObjectCreatorTest{}
+
+func init() { RegisterTestSuite(&CompositeObjectCreatorTest{}) }
+
+func (t *CompositeObjectCreatorTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.creator = newCompositeObjectCreator(4, prefix, &t.bucket)
+
+	t.srcObject, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"foo",
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+	t.mtime = t.clock.Now().Add(time.Hour)
+}
+
+func (t *CompositeObjectCreatorTest) call(contents string) (
+	o *gcs.Object,
+	err error) {
+	o, err = t.creator.Create(
+		t.ctx,
+		t.srcObject,
+		t.mtime,
+		strings.NewReader(contents),
+		int64(len(contents)))
+
+	return
+}
+
+// Return the names of all objects in the bucket.
+func (t *CompositeObjectCreatorTest) list() (names []string) {
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket.Bucket,
+		&gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CompositeObjectCreatorTest) ComposesParts() {
+	const contents = "burrito enchilada"
+
+	o, err := t.call(contents)
+	AssertEq(nil, err)
+
+	ExpectEq("foo", o.Name)
+	ExpectEq(len(contents), o.Size)
+	ExpectEq(4, o.ComponentCount)
+	ExpectEq(
+		t.mtime.UTC().Format(time.RFC3339Nano),
+		o.Metadata[MtimeMetadataKey])
+
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq(contents, string(b))
+
+	// The parts are gone.
+	ExpectThat(t.list(), ElementsAre("foo"))
+}
+
+func (t *CompositeObjectCreatorTest) FewerBytesThanParts() {
+	o, err := t.call("ab")
+	AssertEq(nil, err)
+	ExpectEq(2, o.ComponentCount)
+
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("ab", string(b))
+}
+
+func (t *CompositeObjectCreatorTest) PartFails() {
+	t.bucket.suffix = ".1"
+
+	_, err := t.call("burrito enchilada")
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	// The source object is untouched and the other parts are gone.
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(b))
+	ExpectThat(t.list(), ElementsAre("foo"))
+}
+
+func (t *CompositeObjectCreatorTest) SourceClobbered() {
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"foo",
+		[]byte("queso"))
+
+	AssertEq(nil, err)
+
+	_, err = t.call("burrito enchilada")
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("queso", string(b))
+	ExpectThat(t.list(), ElementsAre("foo"))
+}
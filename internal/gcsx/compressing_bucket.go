@@ -0,0 +1,291 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The custom metadata key with which compressed objects record the size of
+// their contents before compression.
+const uncompressedSizeMetadataKey = "gcsfuse_uncompressed_size"
+
+// NewCompressingBucket creates a bucket that gzip-compresses the contents of
+// objects whose names satisfy shouldCompress when creating them, setting
+// their Content-Encoding, and decompresses them when reading. Object records
+// for compressed objects report their uncompressed size.
+//
+// Compressed contents are staged in a temporary file in tempDir before
+// upload, or in the system default location if tempDir is empty.
+//
+// Reading from an offset within a compressed object requires decompressing
+// everything before it. Composing into a compressed object is done by
+// rewriting it in full.
+func NewCompressingBucket(
+	shouldCompress func(name string) bool,
+	tempDir string,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &compressingBucket{
+		Bucket:         wrapped,
+		shouldCompress: shouldCompress,
+		tempDir:        tempDir,
+	}
+
+	return
+}
+
+type compressingBucket struct {
+	gcs.Bucket
+	shouldCompress func(name string) bool
+	tempDir        string
+}
+
+// Should the object with the given name be compressed? Directory placeholders
+// never are.
+func (b *compressingBucket) compresses(name string) bool {
+	return !strings.HasSuffix(name, "/") && b.shouldCompress(name)
+}
+
+// If the object was compressed by us, return a copy reporting its
+// uncompressed size. Otherwise return it unmodified.
+func translateCompressed(o *gcs.Object) *gcs.Object {
+	if o == nil || o.ContentEncoding != "gzip" {
+		return o
+	}
+
+	size, err := strconv.ParseUint(
+		o.Metadata[uncompressedSizeMetadataKey],
+		10,
+		64)
+
+	if err != nil {
+		return o
+	}
+
+	translated := *o
+	translated.Size = size
+	return &translated
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *compressingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if !b.compresses(req.Name) {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	rc, err = newGunzipReader(ctx, b.Bucket, req)
+	return
+}
+
+// Like io.LimitReader, but accepting the full range of uint64.
+func limitReader(r io.Reader, n uint64) io.Reader {
+	if n > math.MaxInt64 {
+		return r
+	}
+
+	return io.LimitReader(r, int64(n))
+}
+
+func (b *compressingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if !b.compresses(req.Name) {
+		o, err = b.Bucket.CreateObject(ctx, req)
+		o = translateCompressed(o)
+		return
+	}
+
+	// Compress the contents into a temporary file, so that we know their size
+	// before we begin the upload.
+	f, err := ioutil.TempFile(b.tempDir, "gcsfuse_compress")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	crc32cHash := crc32.New(crc32cTable)
+	md5Hash := md5.New()
+	gz := gzip.NewWriter(f)
+
+	size, err := io.Copy(io.MultiWriter(gz, crc32cHash, md5Hash), req.Contents)
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	err = gz.Close()
+	if err != nil {
+		err = fmt.Errorf("Close: %v", err)
+		return
+	}
+
+	// Checksums requested by the caller are of the uncompressed contents, so
+	// check them ourselves.
+	if req.CRC32C != nil && *req.CRC32C != crc32cHash.Sum32() {
+		err = fmt.Errorf(
+			"CRC32C mismatch: got 0x%08x, expected 0x%08x",
+			crc32cHash.Sum32(),
+			*req.CRC32C)
+
+		return
+	}
+
+	if req.MD5 != nil && string(req.MD5[:]) != string(md5Hash.Sum(nil)) {
+		err = fmt.Errorf(
+			"MD5 mismatch: got %x, expected %x",
+			md5Hash.Sum(nil),
+			*req.MD5)
+
+		return
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	compressed := *req
+	compressed.Contents = f
+	compressed.CRC32C = nil
+	compressed.MD5 = nil
+	compressed.ContentEncoding = "gzip"
+
+	// Stop GCS from decompressing the contents when serving them, which it
+	// otherwise does for clients that don't accept gzip, ignoring any range.
+	if compressed.CacheControl == "" {
+		compressed.CacheControl = "no-transform"
+	} else if !strings.Contains(compressed.CacheControl, "no-transform") {
+		compressed.CacheControl += ", no-transform"
+	}
+
+	compressed.Metadata = make(map[string]string)
+	for k, v := range req.Metadata {
+		compressed.Metadata[k] = v
+	}
+
+	compressed.Metadata[uncompressedSizeMetadataKey] =
+		strconv.FormatInt(size, 10)
+
+	o, err = b.Bucket.CreateObject(ctx, &compressed)
+	o = translateCompressed(o)
+	return
+}
+
+func (b *compressingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CopyObject(ctx, req)
+	o = translateCompressed(o)
+	return
+}
+
+func (b *compressingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if !b.compresses(req.DstName) {
+		o, err = b.Bucket.ComposeObjects(ctx, req)
+		o = translateCompressed(o)
+		return
+	}
+
+	// GCS would concatenate the stored bytes, so instead read the sources and
+	// write out the result ourselves.
+	var readers []io.Reader
+	for _, src := range req.Sources {
+		var rc io.ReadCloser
+		rc, err = b.NewReader(ctx, &gcs.ReadObjectRequest{
+			Name:       src.Name,
+			Generation: src.Generation,
+		})
+
+		if err != nil {
+			err = fmt.Errorf("NewReader(%q): %v", src.Name, err)
+			return
+		}
+
+		defer rc.Close()
+		readers = append(readers, rc)
+	}
+
+	o, err = b.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:                       req.DstName,
+		ContentType:                req.ContentType,
+		Metadata:                   req.Metadata,
+		Contents:                   io.MultiReader(readers...),
+		GenerationPrecondition:     req.DstGenerationPrecondition,
+		MetaGenerationPrecondition: req.DstMetaGenerationPrecondition,
+	})
+
+	return
+}
+
+func (b *compressingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	o = translateCompressed(o)
+	return
+}
+
+func (b *compressingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// Don't modify the listing in place, since it may be shared with a cache.
+	translated := *listing
+	translated.Objects = make([]*gcs.Object, len(listing.Objects))
+	for i, o := range listing.Objects {
+		translated.Objects[i] = translateCompressed(o)
+	}
+
+	listing = &translated
+	return
+}
+
+func (b *compressingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	o = translateCompressed(o)
+	return
+}
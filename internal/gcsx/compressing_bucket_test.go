@@ -0,0 +1,225 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCompressingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Compressible contents.
+var csvContents = strings.Repeat("taco,burrito,enchilada\n", 100)
+
+type CompressingBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+func init() { RegisterTestSuite(&CompressingBucketTest{}) }
+
+func (t *CompressingBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.bucket = gcsx.NewCompressingBucket(
+		func(name string) bool { return path.Ext(name) == ".csv" },
+		"",
+		t.wrapped)
+}
+
+func (t *CompressingBucketTest) create(
+	name string,
+	contents string) *gcs.Object {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(contents))
+	AssertEq(nil, err)
+	return o
+}
+
+func (t *CompressingBucketTest) readRange(
+	name string,
+	start uint64,
+	limit uint64) string {
+	rc, err := t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{
+		Name:  name,
+		Range: &gcs.ByteRange{Start: start, Limit: limit},
+	})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	contents, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CompressingBucketTest) CreateCompressesMatchingObjects() {
+	o := t.create("foo.csv", csvContents)
+	ExpectEq(len(csvContents), o.Size)
+
+	// The stored object should be gzipped.
+	raw, err := gcsutil.ReadObject(t.ctx, t.wrapped, "foo.csv")
+	AssertEq(nil, err)
+	ExpectLt(len(raw), len(csvContents))
+
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadAll(gz)
+	AssertEq(nil, err)
+	ExpectEq(csvContents, string(contents))
+
+	stored, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo.csv"})
+
+	AssertEq(nil, err)
+	ExpectEq("gzip", stored.ContentEncoding)
+	ExpectThat(stored.CacheControl, HasSubstr("no-transform"))
+}
+
+func (t *CompressingBucketTest) CreateLeavesOtherObjectsAlone() {
+	o := t.create("foo.txt", csvContents)
+	ExpectEq(len(csvContents), o.Size)
+	ExpectEq("", o.ContentEncoding)
+
+	raw, err := gcsutil.ReadObject(t.ctx, t.wrapped, "foo.txt")
+	AssertEq(nil, err)
+	ExpectEq(csvContents, string(raw))
+}
+
+func (t *CompressingBucketTest) CreateChecksChecksums() {
+	crc32c := uint32(17)
+	_, err := t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:     "foo.csv",
+		Contents: strings.NewReader(csvContents),
+		CRC32C:   &crc32c,
+	})
+
+	ExpectThat(err, Error(HasSubstr("CRC32C")))
+}
+
+func (t *CompressingBucketTest) ReadWholeObject() {
+	t.create("foo.csv", csvContents)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo.csv")
+	AssertEq(nil, err)
+	ExpectEq(csvContents, string(contents))
+}
+
+func (t *CompressingBucketTest) ReadRange() {
+	t.create("foo.csv", csvContents)
+
+	ExpectEq(csvContents[5:17], t.readRange("foo.csv", 5, 17))
+	ExpectEq(csvContents[100:], t.readRange("foo.csv", 100, 1<<20))
+	ExpectEq("", t.readRange("foo.csv", 1<<20, 1<<21))
+}
+
+func (t *CompressingBucketTest) ReadUncompressedMatchingObject() {
+	// Written before compression was enabled.
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.wrapped,
+		"foo.csv",
+		[]byte(csvContents))
+
+	AssertEq(nil, err)
+
+	ExpectEq(csvContents[:17], t.readRange("foo.csv", 0, 17))
+	ExpectEq(csvContents[5:17], t.readRange("foo.csv", 5, 17))
+}
+
+func (t *CompressingBucketTest) StatAndListReportUncompressedSize() {
+	t.create("foo.csv", csvContents)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo.csv"})
+	AssertEq(nil, err)
+	ExpectEq(len(csvContents), o.Size)
+
+	listing, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	AssertEq(1, len(listing.Objects))
+	ExpectEq(len(csvContents), listing.Objects[0].Size)
+
+	// The wrapped bucket should be unaffected.
+	listing, err = t.wrapped.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	AssertEq(1, len(listing.Objects))
+	ExpectLt(listing.Objects[0].Size, len(csvContents))
+}
+
+func (t *CompressingBucketTest) ComposeIntoCompressedObject() {
+	src := t.create("foo.csv", csvContents)
+	tmp := t.create("tmp", "queso\n")
+
+	o, err := t.bucket.ComposeObjects(t.ctx, &gcs.ComposeObjectsRequest{
+		DstName:                   "foo.csv",
+		DstGenerationPrecondition: &src.Generation,
+		Sources: []gcs.ComposeSource{
+			{Name: "foo.csv", Generation: src.Generation},
+			{Name: "tmp", Generation: tmp.Generation},
+		},
+	})
+
+	AssertEq(nil, err)
+	ExpectEq(len(csvContents)+len("queso\n"), o.Size)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo.csv")
+	AssertEq(nil, err)
+	ExpectEq(csvContents+"queso\n", string(contents))
+}
+
+func (t *CompressingBucketTest) ComposeChecksPreconditions() {
+	t.create("foo.csv", csvContents)
+	tmp := t.create("tmp", "queso\n")
+
+	var gen int64 = 17
+	_, err := t.bucket.ComposeObjects(t.ctx, &gcs.ComposeObjectsRequest{
+		DstName:                   "foo.csv",
+		DstGenerationPrecondition: &gen,
+		Sources: []gcs.ComposeSource{
+			{Name: "tmp", Generation: tmp.Generation},
+		},
+	})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
@@ -15,21 +15,129 @@
 package gcsx
 
 import (
+	"fmt"
 	"mime"
 	"path"
+	"strings"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
 	"github.com/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
 )
 
+// A CacheControlRule sets the Cache-Control of new objects whose names match
+// a pattern.
+type CacheControlRule struct {
+	// A pattern in the syntax of path.Match. If it contains a slash it is
+	// matched against the object's full name; otherwise against its base name.
+	Pattern string
+
+	// The Cache-Control directives, e.g. "public, max-age=3600".
+	Value string
+}
+
+// ParseCacheControlRule parses a rule of the form "pattern=directives".
+func ParseCacheControlRule(s string) (r CacheControlRule, err error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		err = fmt.Errorf("Expected pattern=directives, got %q", s)
+		return
+	}
+
+	r.Pattern = strings.TrimSpace(s[:i])
+	r.Value = strings.TrimSpace(s[i+1:])
+
+	if _, err = path.Match(r.Pattern, ""); err != nil {
+		err = fmt.Errorf("Bad pattern %q: %v", r.Pattern, err)
+		return
+	}
+
+	if r.Value == "" {
+		err = fmt.Errorf("Missing directives in %q", s)
+		return
+	}
+
+	return
+}
+
+// String formats the rule as ParseCacheControlRule accepts it.
+func (r CacheControlRule) String() string {
+	return r.Pattern + "=" + r.Value
+}
+
+func (r CacheControlRule) matches(name string) bool {
+	if !strings.Contains(r.Pattern, "/") {
+		name = path.Base(name)
+	}
+
+	ok, _ := path.Match(r.Pattern, name)
+	return ok
+}
+
+// ParseContentType parses an extension's MIME type given in the form
+// ".ext=type", returning the extension lower-cased.
+func ParseContentType(s string) (ext string, contentType string, err error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		err = fmt.Errorf("Expected .ext=type, got %q", s)
+		return
+	}
+
+	ext = strings.ToLower(strings.TrimSpace(s[:i]))
+	contentType = strings.TrimSpace(s[i+1:])
+
+	if len(ext) < 2 || ext[0] != '.' || strings.Contains(ext, "/") {
+		err = fmt.Errorf("Bad extension %q; expected e.g. .txt", ext)
+		return
+	}
+
+	if _, _, err = mime.ParseMediaType(contentType); err != nil {
+		err = fmt.Errorf("Bad MIME type %q: %v", contentType, err)
+		return
+	}
+
+	return
+}
+
 // NewContentTypeBucket creates a wrapper bucket that guesses MIME types for
-// newly created or composed objects when an explicit type is not already set.
-func NewContentTypeBucket(b gcs.Bucket) gcs.Bucket {
-	return contentTypeBucket{b}
+// newly created or composed objects when an explicit type is not already set,
+// from the supplied map of lower-cased extensions to types and failing that
+// from the system's. The Cache-Control of such objects is set from the last of
+// the supplied rules that matches, if any.
+func NewContentTypeBucket(
+	types map[string]string,
+	cacheControl []CacheControlRule,
+	b gcs.Bucket) gcs.Bucket {
+	return contentTypeBucket{
+		Bucket:       b,
+		types:        types,
+		cacheControl: cacheControl,
+	}
 }
 
 type contentTypeBucket struct {
 	gcs.Bucket
+	types        map[string]string
+	cacheControl []CacheControlRule
+}
+
+func (b contentTypeBucket) contentType(name string) string {
+	ext := path.Ext(name)
+	if t, ok := b.types[strings.ToLower(ext)]; ok {
+		return t
+	}
+
+	return mime.TypeByExtension(ext)
+}
+
+func (b contentTypeBucket) cacheControlFor(name string) (value string) {
+	for _, r := range b.cacheControl {
+		if r.matches(name) {
+			value = r.Value
+		}
+	}
+
+	return
 }
 
 func (b contentTypeBucket) CreateObject(
@@ -37,7 +145,11 @@ func (b contentTypeBucket) CreateObject(
 	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
 	// Guess a content type if necessary.
 	if req.ContentType == "" {
-		req.ContentType = mime.TypeByExtension(path.Ext(req.Name))
+		req.ContentType = b.contentType(req.Name)
+	}
+
+	if req.CacheControl == "" {
+		req.CacheControl = b.cacheControlFor(req.Name)
 	}
 
 	// Pass on the request.
@@ -50,10 +162,34 @@ func (b contentTypeBucket) ComposeObjects(
 	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
 	// Guess a content type if necessary.
 	if req.ContentType == "" {
-		req.ContentType = mime.TypeByExtension(path.Ext(req.DstName))
+		req.ContentType = b.contentType(req.DstName)
 	}
 
 	// Pass on the request.
 	o, err = b.Bucket.ComposeObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// Composition can't set Cache-Control, so follow up with an update. The
+	// object has been written either way, so don't fail if that doesn't work.
+	cc := b.cacheControlFor(req.DstName)
+	if cc == "" || o.CacheControl == cc {
+		return
+	}
+
+	updated, updateErr := b.Bucket.UpdateObject(ctx, &gcs.UpdateObjectRequest{
+		Name:                       o.Name,
+		Generation:                 o.Generation,
+		MetaGenerationPrecondition: &o.MetaGeneration,
+		CacheControl:               &cc,
+	})
+
+	if updateErr != nil {
+		logger.Warningf("Setting Cache-Control of %q: %v", o.Name, updateErr)
+		return
+	}
+
+	o = updated
 	return
 }
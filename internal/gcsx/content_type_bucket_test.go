@@ -83,6 +83,8 @@ func TestContentTypeBucket_CreateObject(t *testing.T) {
 	for i, tc := range contentTypeBucketTestCases {
 		// Set up a bucket.
 		bucket := gcsx.NewContentTypeBucket(
+			nil,
+			nil,
 			gcsfake.NewFakeBucket(timeutil.RealClock(), ""))
 
 		// Create the object.
@@ -111,6 +113,8 @@ func TestContentTypeBucket_ComposeObjects(t *testing.T) {
 	for i, tc := range contentTypeBucketTestCases {
 		// Set up a bucket.
 		bucket := gcsx.NewContentTypeBucket(
+			nil,
+			nil,
 			gcsfake.NewFakeBucket(timeutil.RealClock(), ""))
 
 		// Create a source object.
@@ -142,3 +146,125 @@ func TestContentTypeBucket_ComposeObjects(t *testing.T) {
 		}
 	}
 }
+
+func TestContentTypeBucket_CustomTypes(t *testing.T) {
+	ctx := context.Background()
+	types := map[string]string{
+		".md":  "text/markdown; charset=utf-8",
+		".jpg": "image/x-custom",
+	}
+
+	bucket := gcsx.NewContentTypeBucket(
+		types,
+		nil,
+		gcsfake.NewFakeBucket(timeutil.RealClock(), ""))
+
+	for name, want := range map[string]string{
+		"foo/README.MD": "text/markdown; charset=utf-8",
+		"foo/bar.jpg":   "image/x-custom",
+		"foo/bar.png":   "image/png",
+	} {
+		o, err := bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+			Name:     name,
+			Contents: strings.NewReader(""),
+		})
+
+		if err != nil {
+			t.Fatalf("%q: CreateObject: %v", name, err)
+		}
+
+		if got := o.ContentType; got != want {
+			t.Errorf("%q: o.ContentType is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestContentTypeBucket_CacheControl(t *testing.T) {
+	ctx := context.Background()
+	rules := []gcsx.CacheControlRule{
+		{Pattern: "*", Value: "public, max-age=3600"},
+		{Pattern: "*.html", Value: "no-cache"},
+		{Pattern: "static/*", Value: "public, max-age=31536000"},
+	}
+
+	bucket := gcsx.NewContentTypeBucket(
+		nil,
+		rules,
+		gcsfake.NewFakeBucket(timeutil.RealClock(), ""))
+
+	cases := map[string]string{
+		"index.html":     "no-cache",
+		"foo/page.html":  "no-cache",
+		"foo/data.json":  "public, max-age=3600",
+		"static/app.js":  "public, max-age=31536000",
+		"static/a/b.css": "public, max-age=3600",
+	}
+
+	for name, want := range cases {
+		o, err := bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+			Name:     name,
+			Contents: strings.NewReader(""),
+		})
+
+		if err != nil {
+			t.Fatalf("%q: CreateObject: %v", name, err)
+		}
+
+		if got := o.CacheControl; got != want {
+			t.Errorf("%q: o.CacheControl is %q, want %q", name, got, want)
+		}
+	}
+
+	// Composition applies it too.
+	o, err := bucket.ComposeObjects(ctx, &gcs.ComposeObjectsRequest{
+		DstName: "bar.html",
+		Sources: []gcs.ComposeSource{{Name: "index.html"}},
+	})
+
+	if err != nil {
+		t.Fatalf("ComposeObjects: %v", err)
+	}
+
+	if got, want := o.CacheControl, "no-cache"; got != want {
+		t.Errorf("Composed o.CacheControl is %q, want %q", got, want)
+	}
+
+	// An explicit value is kept.
+	o, err = bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:         "baz.html",
+		CacheControl: "private",
+		Contents:     strings.NewReader(""),
+	})
+
+	if err != nil {
+		t.Fatalf("CreateObject: %v", err)
+	}
+
+	if got, want := o.CacheControl, "private"; got != want {
+		t.Errorf("Explicit o.CacheControl is %q, want %q", got, want)
+	}
+}
+
+func TestParseContentTypeAndCacheControl(t *testing.T) {
+	ext, ct, err := gcsx.ParseContentType(" .WASM = application/wasm")
+	if err != nil || ext != ".wasm" || ct != "application/wasm" {
+		t.Errorf("ParseContentType: %q, %q, %v", ext, ct, err)
+	}
+
+	for _, s := range []string{"wasm=application/wasm", ".wasm", ".wasm=;;"} {
+		if _, _, err := gcsx.ParseContentType(s); err == nil {
+			t.Errorf("ParseContentType(%q) succeeded", s)
+		}
+	}
+
+	r, err := gcsx.ParseCacheControlRule("*.js=public, max-age=60")
+	if err != nil || r.Pattern != "*.js" || r.Value != "public, max-age=60" {
+		t.Errorf("ParseCacheControlRule: %v, %v", r, err)
+	}
+
+	for _, s := range []string{"*.js", "*.js=", "[=no-cache"} {
+		if _, err := gcsx.ParseCacheControlRule(s); err == nil {
+			t.Errorf("ParseCacheControlRule(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+)
+
+// The number of lookups in stat caches returned by NewCountingStatCache that
+// found an entry, positive or negative, and that found none.
+var (
+	statCacheHits   = expvar.NewInt("stat_cache_hits")
+	statCacheMisses = expvar.NewInt("stat_cache_misses")
+)
+
+// StatCacheCounts returns the number of stat cache lookups in this process
+// that hit and missed. The same values are published by package expvar under
+// the names "stat_cache_hits" and "stat_cache_misses".
+func StatCacheCounts() (hits int64, misses int64) {
+	hits = statCacheHits.Value()
+	misses = statCacheMisses.Value()
+	return
+}
+
+// NewCountingStatCache returns a stat cache that behaves like the wrapped one,
+// counting its lookups for StatCacheCounts.
+func NewCountingStatCache(wrapped gcscaching.StatCache) gcscaching.StatCache {
+	return &countingStatCache{StatCache: wrapped}
+}
+
+type countingStatCache struct {
+	gcscaching.StatCache
+}
+
+func (sc *countingStatCache) LookUp(
+	name string,
+	now time.Time) (hit bool, o *gcs.Object) {
+	hit, o = sc.StatCache.LookUp(name, now)
+	if hit {
+		statCacheHits.Add(1)
+	} else {
+		statCacheMisses.Add(1)
+	}
+
+	return
+}
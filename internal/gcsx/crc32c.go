@@ -0,0 +1,252 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"expvar"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+var crc32cMismatches = expvar.NewInt("crc32c_mismatches")
+
+// The number of objects whose checksums are remembered by a verifying bucket.
+const checksumCacheCapacity = 1 << 16
+
+// Can the contents read for the supplied object be checked against its
+// CRC32C? Those of gzip-encoded objects may be presented decompressed, and
+// there's nothing to check for empty ones.
+func verifiable(o *gcs.Object) bool {
+	return o.Size != 0 && o.ContentEncoding != "gzip"
+}
+
+// Return an error if the supplied checksum of the contents read for the
+// object doesn't match the one GCS recorded, counting it.
+func checkCRC32C(o *gcs.Object, actual uint32) (err error) {
+	if actual == o.CRC32C {
+		return
+	}
+
+	crc32cMismatches.Add(1)
+	err = fmt.Errorf(
+		"CRC32C mismatch for %q generation %d: got 0x%08x, expected 0x%08x",
+		o.Name,
+		o.Generation,
+		actual,
+		o.CRC32C)
+
+	return
+}
+
+// NewVerifyingBucket creates a bucket that checks the contents of objects
+// read in full against the CRC32C that GCS recorded for them, returning an
+// error from the read that reaches the end if they don't match. The
+// checksums are those of the records that recently passed through the bucket,
+// or else ones fetched with StatObject.
+//
+// Reads of ranges within objects, of gzip-encoded objects, and those that
+// don't name a generation aren't checked.
+func NewVerifyingBucket(wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &verifyingBucket{
+		Bucket:  wrapped,
+		records: lrucache.New(checksumCacheCapacity),
+	}
+
+	return
+}
+
+type verifyingBucket struct {
+	gcs.Bucket
+
+	mu sync.Mutex
+
+	// Recently seen object records, keyed by gunzipSizeKey.
+	//
+	// GUARDED_BY(mu)
+	records lrucache.Cache
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *verifyingBucket) record(o *gcs.Object) {
+	if o == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records.Insert(gunzipSizeKey(o.Name, o.Generation), o)
+}
+
+// Find the record for the generation of the object read by req, or nil if
+// there is none.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *verifyingBucket) lookUp(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	v := b.records.LookUp(gunzipSizeKey(req.Name, req.Generation))
+	b.mu.Unlock()
+
+	if v != nil {
+		o = v.(*gcs.Object)
+		return
+	}
+
+	// We haven't seen it recently. If the latest generation isn't the one being
+	// read, there's nothing to check against.
+	o, err = b.StatObject(ctx, &gcs.StatObjectRequest{Name: req.Name})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		o = nil
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	if o.Generation != req.Generation {
+		o = nil
+	}
+
+	return
+}
+
+func (b *verifyingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	// Only reads of a particular generation starting at the beginning may
+	// cover the whole of something with a known checksum.
+	if req.Generation == 0 || (req.Range != nil && req.Range.Start != 0) {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	o, err := b.lookUp(ctx, req)
+	if err != nil {
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	if o == nil ||
+		!verifiable(o) ||
+		(req.Range != nil && req.Range.Limit < o.Size) {
+		return
+	}
+
+	rc = &verifyingReader{
+		wrapped: rc,
+		object:  o,
+		hash:    crc32.New(crc32cTable),
+	}
+
+	return
+}
+
+func (b *verifyingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+	b.record(o)
+	return
+}
+
+func (b *verifyingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	b.record(o)
+	return
+}
+
+func (b *verifyingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	b.record(o)
+	return
+}
+
+func (b *verifyingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	for _, o := range listing.Objects {
+		b.record(o)
+	}
+
+	return
+}
+
+func (b *verifyingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	b.record(o)
+	return
+}
+
+// A reader for the whole of an object that checks its CRC32C once it has
+// read object.Size bytes.
+type verifyingReader struct {
+	wrapped io.ReadCloser
+	object  *gcs.Object
+
+	hash    hash.Hash32
+	read    uint64
+	checked bool
+}
+
+func (r *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = r.wrapped.Read(p)
+	r.hash.Write(p[:n])
+	r.read += uint64(n)
+
+	if r.checked || r.read < r.object.Size {
+		return
+	}
+
+	// Withhold the final bytes on a mismatch. Callers such as io.ReadFull
+	// ignore errors returned along with the bytes they asked for.
+	r.checked = true
+	if mismatch := checkCRC32C(r.object, r.hash.Sum32()); mismatch != nil {
+		n = 0
+		err = mismatch
+	}
+
+	return
+}
+
+func (r *verifyingReader) Close() (err error) {
+	err = r.wrapped.Close()
+	return
+}
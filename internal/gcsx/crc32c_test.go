@@ -0,0 +1,261 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCRC32C(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose object records report the wrong CRC32C.
+type wrongChecksumBucket struct {
+	gcs.Bucket
+}
+
+func (b *wrongChecksumBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	copied := *o
+	copied.CRC32C++
+	o = &copied
+
+	return
+}
+
+func crc32cMismatches() int64 {
+	return expvar.Get("crc32c_mismatches").(*expvar.Int).Value()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Verifying bucket
+////////////////////////////////////////////////////////////////////////
+
+const crc32cContents = "abcdefghijklmnopqrstuvwxyz"
+
+type VerifyingBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	object  *gcs.Object
+}
+
+var _ SetUpInterface = &VerifyingBucketTest{}
+
+func init() { RegisterTestSuite(&VerifyingBucketTest{}) }
+
+func (t *VerifyingBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.object, err = gcsutil.CreateObject(
+		t.ctx,
+		t.wrapped,
+		"foo",
+		[]byte(crc32cContents))
+
+	AssertEq(nil, err)
+}
+
+func (t *VerifyingBucketTest) read(
+	bucket gcs.Bucket,
+	r *gcs.ByteRange) (contents string, err error) {
+	rc, err := bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{
+		Name:       "foo",
+		Generation: t.object.Generation,
+		Range:      r,
+	})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	contents = string(b)
+	return
+}
+
+func (t *VerifyingBucketTest) MatchingObjectRead() {
+	bucket := gcsx.NewVerifyingBucket(t.wrapped)
+
+	contents, err := t.read(bucket, nil)
+	AssertEq(nil, err)
+	ExpectEq(crc32cContents, contents)
+
+	contents, err = t.read(bucket, &gcs.ByteRange{Start: 0, Limit: 100})
+	AssertEq(nil, err)
+	ExpectEq(crc32cContents, contents)
+}
+
+func (t *VerifyingBucketTest) MismatchReported() {
+	bucket := gcsx.NewVerifyingBucket(&wrongChecksumBucket{t.wrapped})
+	prev := crc32cMismatches()
+
+	_, err := t.read(bucket, nil)
+	ExpectThat(err, Error(HasSubstr("CRC32C mismatch")))
+	ExpectEq(prev+1, crc32cMismatches())
+}
+
+func (t *VerifyingBucketTest) ChecksumFromRecordsSeen() {
+	bucket := gcsx.NewVerifyingBucket(&wrongChecksumBucket{t.wrapped})
+
+	// Listing records the right checksum, so no stat is needed.
+	_, err := bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	contents, err := t.read(bucket, nil)
+	AssertEq(nil, err)
+	ExpectEq(crc32cContents, contents)
+}
+
+func (t *VerifyingBucketTest) RangesNotChecked() {
+	bucket := gcsx.NewVerifyingBucket(&wrongChecksumBucket{t.wrapped})
+
+	contents, err := t.read(bucket, &gcs.ByteRange{Start: 1, Limit: 100})
+	AssertEq(nil, err)
+	ExpectEq(crc32cContents[1:], contents)
+
+	contents, err = t.read(bucket, &gcs.ByteRange{Start: 0, Limit: 3})
+	AssertEq(nil, err)
+	ExpectEq(crc32cContents[:3], contents)
+}
+
+func (t *VerifyingBucketTest) GzipEncodedNotChecked() {
+	_, err := t.wrapped.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:            "bar",
+		ContentEncoding: "gzip",
+		Contents:        bytes.NewReader(gzipBytes(crc32cContents)),
+	})
+
+	AssertEq(nil, err)
+
+	bucket := gcsx.NewVerifyingBucket(&wrongChecksumBucket{t.wrapped})
+	contents, err := gcsutil.ReadObject(t.ctx, bucket, "bar")
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(gzipBytes(crc32cContents), contents))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Parallel reader
+////////////////////////////////////////////////////////////////////////
+
+type VerifyingParallelReaderTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	object *gcs.Object
+}
+
+var _ SetUpInterface = &VerifyingParallelReaderTest{}
+
+func init() { RegisterTestSuite(&VerifyingParallelReaderTest{}) }
+
+func (t *VerifyingParallelReaderTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.object, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo",
+		[]byte(crc32cContents))
+
+	AssertEq(nil, err)
+}
+
+// Read the whole object in reads of the given size, stopping at the first
+// error.
+func (t *VerifyingParallelReaderTest) readAll(
+	o *gcs.Object,
+	size int) (contents string, err error) {
+	rr, err := gcsx.NewParallelReader(o, t.bucket, 4, 3, nil, true)
+	AssertEq(nil, err)
+	defer rr.Destroy()
+
+	buf := make([]byte, size)
+	for offset := 0; offset < int(o.Size); offset += size {
+		var n int
+		n, err = rr.ReadAt(t.ctx, buf, int64(offset))
+		contents += string(buf[:n])
+		rr.CheckInvariants()
+
+		if err == io.EOF {
+			err = nil
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (t *VerifyingParallelReaderTest) MatchingObjectRead() {
+	contents, err := t.readAll(t.object, 5)
+	AssertEq(nil, err)
+	ExpectEq(crc32cContents, contents)
+}
+
+func (t *VerifyingParallelReaderTest) MismatchReported() {
+	wrong := *t.object
+	wrong.CRC32C++
+	prev := crc32cMismatches()
+
+	_, err := t.readAll(&wrong, 5)
+	ExpectThat(err, Error(HasSubstr("CRC32C mismatch")))
+	ExpectEq(prev+1, crc32cMismatches())
+}
+
+func (t *VerifyingParallelReaderTest) MismatchNotCheckedWhenDisabled() {
+	wrong := *t.object
+	wrong.CRC32C++
+
+	rr, err := gcsx.NewParallelReader(&wrong, t.bucket, 4, 3, nil, false)
+	AssertEq(nil, err)
+	defer rr.Destroy()
+
+	buf := make([]byte, len(crc32cContents))
+	n, err := rr.ReadAt(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	ExpectEq(crc32cContents, string(buf[:n]))
+}
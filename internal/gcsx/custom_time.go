@@ -0,0 +1,263 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	"github.com/jacobsa/ratelimit"
+	"github.com/jacobsa/timeutil"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+var customTimeUpdates = expvar.NewInt("custom_time_updates")
+
+// A CustomTimeSetter sets the customTime field of the given generation of an
+// object, or of its latest generation if zero, failing with
+// *gcs.PreconditionError if that generation is no longer current.
+type CustomTimeSetter func(
+	ctx context.Context,
+	name string,
+	generation int64,
+	t time.Time) error
+
+// NewCustomTimeSetter returns a setter for objects in the named bucket that
+// sends requests using the supplied client, which must add credentials. The
+// GCS client we use has no support for the customTime field.
+func NewCustomTimeSetter(
+	client *http.Client,
+	bucketName string,
+	userAgent string) CustomTimeSetter {
+	return func(
+		ctx context.Context,
+		name string,
+		generation int64,
+		t time.Time) (err error) {
+		opaque := fmt.Sprintf(
+			"//www.googleapis.com/storage/v1/b/%s/o/%s",
+			httputil.EncodePathSegment(bucketName),
+			httputil.EncodePathSegment(name))
+
+		query := make(url.Values)
+		if generation != 0 {
+			query.Set("ifGenerationMatch", fmt.Sprintf("%d", generation))
+		}
+
+		u := &url.URL{
+			Scheme:   "https",
+			Host:     "www.googleapis.com",
+			Opaque:   opaque,
+			RawQuery: query.Encode(),
+		}
+
+		body, err := json.Marshal(map[string]string{
+			"customTime": t.UTC().Format(time.RFC3339Nano),
+		})
+
+		if err != nil {
+			err = fmt.Errorf("Marshal: %v", err)
+			return
+		}
+
+		httpReq, err := httputil.NewRequest(
+			ctx,
+			"PATCH",
+			u,
+			ioutil.NopCloser(bytes.NewReader(body)),
+			int64(len(body)),
+			userAgent)
+
+		if err != nil {
+			err = fmt.Errorf("httputil.NewRequest: %v", err)
+			return
+		}
+
+		httpReq.Header.Set("Content-Type", "application/json")
+
+		httpRes, err := client.Do(httpReq)
+		if err != nil {
+			return
+		}
+
+		defer googleapi.CloseBody(httpRes)
+
+		if err = googleapi.CheckResponse(httpRes); err != nil {
+			if typed, ok := err.(*googleapi.Error); ok {
+				switch typed.Code {
+				case http.StatusNotFound:
+					err = &gcs.NotFoundError{Err: typed}
+
+				case http.StatusPreconditionFailed:
+					err = &gcs.PreconditionError{Err: typed}
+				}
+			}
+
+			return
+		}
+
+		return
+	}
+}
+
+// A CustomTimeBucket records the objects read through it, and sets their
+// customTime to the time they were read when Flush is called, so that
+// lifecycle rules conditioned on it can act on data that hasn't been used
+// recently. Objects are updated at most once per interval.
+//
+// Setting customTime assigns the object a new meta-generation, so a file open
+// for writing through the file system when this happens loses its writes as if
+// the object had been modified elsewhere.
+type CustomTimeBucket struct {
+	gcs.Bucket
+
+	interval time.Duration
+	clock    timeutil.Clock
+	set      CustomTimeSetter
+	throttle ratelimit.Throttle
+
+	mu sync.Mutex
+
+	// The objects read since the last flush, with the generation read or zero
+	// if unknown.
+	//
+	// GUARDED_BY(mu)
+	pending map[string]int64
+
+	// The time at which we last set the customTime of recently updated objects,
+	// by name.
+	//
+	// GUARDED_BY(mu)
+	lastSet lrucache.Cache
+}
+
+// NewCustomTimeBucket creates a bucket that sets the customTime of objects
+// read through it using the supplied setter, at most once per interval for
+// each object and no more than rateHz times per second overall. Up to
+// capacity recently updated objects are remembered.
+func NewCustomTimeBucket(
+	interval time.Duration,
+	rateHz float64,
+	capacity int,
+	clock timeutil.Clock,
+	set CustomTimeSetter,
+	wrapped gcs.Bucket) (b *CustomTimeBucket, err error) {
+	throttleCapacity, err := ratelimit.ChooseTokenBucketCapacity(
+		rateHz,
+		time.Minute)
+
+	if err != nil {
+		err = fmt.Errorf("ChooseTokenBucketCapacity: %v", err)
+		return
+	}
+
+	b = &CustomTimeBucket{
+		Bucket:   wrapped,
+		interval: interval,
+		clock:    clock,
+		set:      set,
+		throttle: ratelimit.NewThrottle(rateHz, throttleCapacity),
+		pending:  make(map[string]int64),
+		lastSet:  lrucache.New(capacity),
+	}
+
+	return
+}
+
+func (b *CustomTimeBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if t, ok := b.lastSet.LookUp(req.Name).(time.Time); ok &&
+		b.clock.Now().Sub(t) < b.interval {
+		return
+	}
+
+	b.pending[req.Name] = req.Generation
+	return
+}
+
+// Flush sets the customTime of the objects read since the last call, waiting
+// as necessary for the rate limit. Failures are logged, and objects that have
+// been modified or deleted since they were read are skipped.
+func (b *CustomTimeBucket) Flush(ctx context.Context) {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]int64)
+	b.mu.Unlock()
+
+	for name, generation := range pending {
+		if err := b.throttle.Wait(ctx, 1); err != nil {
+			return
+		}
+
+		now := b.clock.Now()
+		err := b.set(ctx, name, generation, now)
+
+		switch err.(type) {
+		case nil:
+			customTimeUpdates.Add(1)
+
+			b.mu.Lock()
+			b.lastSet.Insert(name, now)
+			b.mu.Unlock()
+
+		case *gcs.PreconditionError, *gcs.NotFoundError:
+
+		default:
+			logger.Warningf("Setting customTime of %q: %v", name, err)
+		}
+	}
+}
+
+// FlushPeriodically calls Flush every period until the context is cancelled.
+func (b *CustomTimeBucket) FlushPeriodically(
+	ctx context.Context,
+	period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		b.Flush(ctx)
+	}
+}
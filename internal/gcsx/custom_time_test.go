@@ -0,0 +1,240 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCustomTime(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const customTimeInterval = 24 * time.Hour
+
+// A call to a CustomTimeSetter.
+type setCustomTimeCall struct {
+	name       string
+	generation int64
+	t          time.Time
+}
+
+type CustomTimeTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket *gcsx.CustomTimeBucket
+
+	// An object in the bucket.
+	o *gcs.Object
+
+	// Calls to the setter, and the error it returns.
+	calls []setCustomTimeCall
+	err   error
+}
+
+func init() { RegisterTestSuite(&CustomTimeTest{}) }
+
+func (t *CustomTimeTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	wrapped := gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.o, err = gcsutil.CreateObject(t.ctx, wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	set := func(
+		ctx context.Context,
+		name string,
+		generation int64,
+		ct time.Time) error {
+		t.calls = append(t.calls, setCustomTimeCall{name, generation, ct})
+		return t.err
+	}
+
+	t.bucket, err = gcsx.NewCustomTimeBucket(
+		customTimeInterval,
+		1000,
+		100,
+		&t.clock,
+		set,
+		wrapped)
+
+	AssertEq(nil, err)
+}
+
+func (t *CustomTimeTest) read(name string, generation int64) (err error) {
+	rc, err := t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{
+		Name:       name,
+		Generation: generation,
+	})
+
+	if err != nil {
+		return
+	}
+
+	rc.Close()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CustomTimeTest) NothingRead() {
+	t.bucket.Flush(t.ctx)
+	ExpectEq(0, len(t.calls))
+}
+
+func (t *CustomTimeTest) SetsOnFlush() {
+	AssertEq(nil, t.read("foo", t.o.Generation))
+	ExpectEq(0, len(t.calls))
+
+	t.bucket.Flush(t.ctx)
+	AssertEq(1, len(t.calls))
+	ExpectEq("foo", t.calls[0].name)
+	ExpectEq(t.o.Generation, t.calls[0].generation)
+	ExpectThat(t.calls[0].t, timeutil.TimeEq(t.clock.Now()))
+}
+
+func (t *CustomTimeTest) RepeatedReadsBatched() {
+	AssertEq(nil, t.read("foo", t.o.Generation))
+	AssertEq(nil, t.read("foo", 0))
+	AssertEq(nil, t.read("foo", t.o.Generation))
+
+	t.bucket.Flush(t.ctx)
+	ExpectEq(1, len(t.calls))
+}
+
+func (t *CustomTimeTest) FailedReadsIgnored() {
+	ExpectNe(nil, t.read("bar", 0))
+
+	t.bucket.Flush(t.ctx)
+	ExpectEq(0, len(t.calls))
+}
+
+func (t *CustomTimeTest) AtMostOncePerInterval() {
+	AssertEq(nil, t.read("foo", 0))
+	t.bucket.Flush(t.ctx)
+	AssertEq(1, len(t.calls))
+
+	// Reading again soon after shouldn't cause another update.
+	t.clock.AdvanceTime(customTimeInterval - time.Second)
+	AssertEq(nil, t.read("foo", 0))
+	t.bucket.Flush(t.ctx)
+	AssertEq(1, len(t.calls))
+
+	// But reading after the interval should.
+	t.clock.AdvanceTime(time.Second)
+	AssertEq(nil, t.read("foo", 0))
+	t.bucket.Flush(t.ctx)
+	ExpectEq(2, len(t.calls))
+}
+
+func (t *CustomTimeTest) FailuresRetriedOnNextRead() {
+	t.err = errors.New("taco")
+	AssertEq(nil, t.read("foo", 0))
+	t.bucket.Flush(t.ctx)
+	AssertEq(1, len(t.calls))
+
+	// The failure shouldn't count as an update.
+	t.err = nil
+	AssertEq(nil, t.read("foo", 0))
+	t.bucket.Flush(t.ctx)
+	ExpectEq(2, len(t.calls))
+}
+
+func (t *CustomTimeTest) SetterSendsPatch() {
+	var req *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			req = r
+			body, _ = ioutil.ReadAll(r.Body)
+			w.Write([]byte("{}"))
+		}))
+
+	defer server.Close()
+
+	endpoint, err := url.Parse(server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+
+	set := gcsx.NewCustomTimeSetter(
+		&http.Client{Transport: transport},
+		"some_bucket",
+		"gcsfuse/0.0")
+
+	ct := time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)
+	err = set(t.ctx, "foo/bar baz", 17, ct)
+	AssertEq(nil, err)
+
+	AssertNe(nil, req)
+	ExpectEq("PATCH", req.Method)
+	ExpectEq("/storage/v1/b/some_bucket/o/foo%2Fbar%20baz", req.URL.EscapedPath())
+	ExpectEq("17", req.URL.Query().Get("ifGenerationMatch"))
+	ExpectEq(`{"customTime":"2015-04-05T02:15:00Z"}`, string(body))
+}
+
+func (t *CustomTimeTest) SetterReportsPreconditionErrors() {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "{}", http.StatusPreconditionFailed)
+		}))
+
+	defer server.Close()
+
+	endpoint, err := url.Parse(server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+
+	set := gcsx.NewCustomTimeSetter(
+		&http.Client{Transport: transport},
+		"some_bucket",
+		"gcsfuse/0.0")
+
+	err = set(t.ctx, "foo", 17, t.clock.Now())
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// A Diagnosis explains a GCS failure that the user can probably do something
+// about.
+type Diagnosis struct {
+	// The errno that best describes the failure to applications.
+	Errno syscall.Errno
+
+	// A one-line hint naming the likely fix, suitable for logging.
+	Hint string
+}
+
+// Matches IAM permission names in GCS error messages, e.g.
+//
+//     foo@bar.iam.gserviceaccount.com does not have storage.objects.create
+//     access to the Google Cloud Storage object.
+//
+var permissionRegexp = regexp.MustCompile(`storage\.[a-zA-Z]+\.[a-zA-Z]+`)
+
+// Diagnose returns a diagnosis for the supplied error returned by the named
+// bucket, or nil if it isn't a failure we know how to explain.
+func Diagnose(bucketName string, err error) (d *Diagnosis) {
+	// Look through the wrappers that package gcs uses for special cases.
+	switch typed := err.(type) {
+	case *gcs.NotFoundError:
+		err = typed.Err
+	case *gcs.PreconditionError:
+		err = typed.Err
+
+	case *ReadOnlyError:
+		d = &Diagnosis{
+			Errno: syscall.EROFS,
+			Hint: fmt.Sprintf(
+				"%q is within a directory mounted read-only by the mapping file, "+
+					"or within that of --versions-dir.",
+				typed.Name),
+		}
+
+		return
+
+	case *FilteredError:
+		d = &Diagnosis{
+			Errno: syscall.EPERM,
+			Hint: fmt.Sprintf(
+				"%q is hidden by --include or --exclude, so can't be created.",
+				typed.Name),
+		}
+
+		return
+	}
+
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return
+	}
+
+	// Gather everything the server told us, for matching below.
+	message := apiErr.Message
+	for _, item := range apiErr.Errors {
+		message += " " + item.Reason + " " + item.Message
+	}
+
+	switch {
+	case apiErr.Code == http.StatusUnauthorized:
+		d = &Diagnosis{
+			Errno: syscall.EACCES,
+			Hint: "GCS rejected our credentials. Check that the key file is " +
+				"valid, or that the default credentials have not been revoked.",
+		}
+
+	case apiErr.Code == http.StatusForbidden &&
+		strings.Contains(message, "vpcServiceControls"):
+		d = &Diagnosis{
+			Errno: syscall.EACCES,
+			Hint: fmt.Sprintf(
+				"Access to bucket %q was denied by VPC Service Controls. Run from "+
+					"inside the service perimeter, or ask its administrator for an "+
+					"access level or ingress rule.",
+				bucketName),
+		}
+
+	case apiErr.Code == http.StatusForbidden:
+		permission := "the necessary permission"
+		if p := permissionRegexp.FindString(message); p != "" {
+			permission = "the " + p + " permission"
+		}
+
+		d = &Diagnosis{
+			Errno: syscall.EACCES,
+			Hint: fmt.Sprintf(
+				"Permission denied by GCS. Grant the account in use %s on bucket %q.",
+				permission,
+				bucketName),
+		}
+
+	case apiErr.Code == http.StatusNotFound &&
+		strings.Contains(message, "bucket does not exist"):
+		d = &Diagnosis{
+			Errno: syscall.ENODEV,
+			Hint: fmt.Sprintf(
+				"Bucket %q does not exist. It may have been deleted since mounting.",
+				bucketName),
+		}
+
+	case apiErr.Code == http.StatusTooManyRequests:
+		d = &Diagnosis{
+			Errno: syscall.EAGAIN,
+			Hint: "Rate limited by GCS. Note that each object can be updated " +
+				"only about once per second; otherwise consider lowering " +
+				"--limit-ops-per-sec.",
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Recording
+////////////////////////////////////////////////////////////////////////
+
+type diagnosisRecorderKey struct{}
+
+type diagnosisRecorder struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	last *Diagnosis
+}
+
+// WithDiagnosisRecorder returns a context that causes a bucket returned by
+// NewDiagnosingBucket to record diagnoses for requests made with it, along
+// with a function that returns the most recently recorded diagnosis, or nil
+// if none.
+//
+// This allows recovering the cause of a failure after the error returned by
+// the bucket has been wrapped (and its type lost) by intermediate layers.
+func WithDiagnosisRecorder(
+	parent context.Context) (ctx context.Context, last func() *Diagnosis) {
+	r := &diagnosisRecorder{}
+	ctx = context.WithValue(parent, diagnosisRecorderKey{}, r)
+
+	last = func() *Diagnosis {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		return r.last
+	}
+
+	return
+}
+
+// NewDiagnosingBucket creates a wrapper bucket that records a diagnosis for
+// each failed request whose context came from WithDiagnosisRecorder.
+func NewDiagnosingBucket(b gcs.Bucket) gcs.Bucket {
+	return diagnosingBucket{b}
+}
+
+type diagnosingBucket struct {
+	gcs.Bucket
+}
+
+func (b diagnosingBucket) record(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+
+	r, ok := ctx.Value(diagnosisRecorderKey{}).(*diagnosisRecorder)
+	if !ok {
+		return
+	}
+
+	d := Diagnose(b.Name(), err)
+	if d == nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.last = d
+	r.mu.Unlock()
+}
+
+func (b diagnosingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.Bucket.NewReader(ctx, req)
+	b.record(ctx, err)
+	return
+}
+
+func (b diagnosingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+	b.record(ctx, err)
+	return
+}
+
+func (b diagnosingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CopyObject(ctx, req)
+	b.record(ctx, err)
+	return
+}
+
+func (b diagnosingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	b.record(ctx, err)
+	return
+}
+
+func (b diagnosingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	b.record(ctx, err)
+	return
+}
+
+func (b diagnosingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	b.record(ctx, err)
+	return
+}
+
+func (b diagnosingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	b.record(ctx, err)
+	return
+}
+
+func (b diagnosingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.Bucket.DeleteObject(ctx, req)
+	b.record(ctx, err)
+	return
+}
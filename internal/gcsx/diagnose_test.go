@@ -0,0 +1,227 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestDiagnose(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose StatObject method returns a canned error.
+type failingStatBucket struct {
+	gcs.Bucket
+	err error
+}
+
+func (b *failingStatBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = b.err
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DiagnoseTest struct {
+	ctx     context.Context
+	wrapped failingStatBucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &DiagnoseTest{}
+
+func init() { RegisterTestSuite(&DiagnoseTest{}) }
+
+func (t *DiagnoseTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.bucket = gcsx.NewDiagnosingBucket(&t.wrapped)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DiagnoseTest) UnknownErrors() {
+	testCases := []error{
+		errors.New("taco"),
+		&googleapi.Error{Code: 500, Message: "Backend Error"},
+		&googleapi.Error{Code: 412, Message: "Precondition Failed"},
+		&gcs.NotFoundError{Err: &googleapi.Error{
+			Code:    404,
+			Message: "No such object: some_bucket/foo",
+		}},
+	}
+
+	for _, err := range testCases {
+		ExpectEq(nil, gcsx.Diagnose("some_bucket", err), "err: %v", err)
+	}
+}
+
+func (t *DiagnoseTest) KnownErrors() {
+	testCases := []struct {
+		err           error
+		expectedErrno syscall.Errno
+		expectedHint  string
+	}{
+		// Bad credentials
+		0: {
+			&googleapi.Error{Code: 401, Message: "Invalid Credentials"},
+			syscall.EACCES,
+			"credentials",
+		},
+
+		// Missing permission
+		1: {
+			&googleapi.Error{
+				Code: 403,
+				Message: "foo@bar.iam.gserviceaccount.com does not have " +
+					"storage.objects.create access to some_bucket/baz.",
+			},
+			syscall.EACCES,
+			"storage.objects.create permission on bucket \"some_bucket\"",
+		},
+
+		// Missing permission, wrapped
+		2: {
+			&gcs.PreconditionError{Err: &googleapi.Error{
+				Code:    403,
+				Message: "Caller does not have storage.objects.delete access.",
+			}},
+			syscall.EACCES,
+			"storage.objects.delete",
+		},
+
+		// Forbidden for an unknown reason
+		3: {
+			&googleapi.Error{Code: 403, Message: "Forbidden"},
+			syscall.EACCES,
+			"the necessary permission",
+		},
+
+		// VPC Service Controls
+		4: {
+			&googleapi.Error{
+				Code:    403,
+				Message: "Request is prohibited by organization's policy.",
+				Errors: []googleapi.ErrorItem{
+					{Reason: "vpcServiceControls"},
+				},
+			},
+			syscall.EACCES,
+			"VPC Service Controls",
+		},
+
+		// Bucket gone
+		5: {
+			&gcs.NotFoundError{Err: &googleapi.Error{
+				Code:    404,
+				Message: "The specified bucket does not exist.",
+			}},
+			syscall.ENODEV,
+			"Bucket \"some_bucket\" does not exist",
+		},
+
+		// Rate limited
+		6: {
+			&googleapi.Error{Code: 429, Message: "Rate limit exceeded"},
+			syscall.EAGAIN,
+			"--limit-ops-per-sec",
+		},
+
+		// Read-only directory of a tree
+		7: {
+			&gcsx.ReadOnlyError{Name: "datasets/foo"},
+			syscall.EROFS,
+			"\"datasets/foo\" is within a directory mounted read-only",
+		},
+
+		// Hidden by a filter
+		8: {
+			&gcsx.FilteredError{Name: "foo.tmp"},
+			syscall.EPERM,
+			"\"foo.tmp\" is hidden by --include or --exclude",
+		},
+	}
+
+	for i, tc := range testCases {
+		d := gcsx.Diagnose("some_bucket", tc.err)
+		AssertNe(nil, d, "Test case %d", i)
+
+		ExpectEq(tc.expectedErrno, d.Errno, "Test case %d", i)
+		ExpectThat(d.Hint, HasSubstr(tc.expectedHint), "Test case %d", i)
+	}
+}
+
+func (t *DiagnoseTest) NoRecorder() {
+	t.wrapped.err = &googleapi.Error{Code: 403}
+
+	// The error should be passed through untouched.
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(t.wrapped.err, err)
+}
+
+func (t *DiagnoseTest) RecordsDiagnosis() {
+	ctx, last := gcsx.WithDiagnosisRecorder(t.ctx)
+	ExpectEq(nil, last())
+
+	// A failure we can't diagnose.
+	t.wrapped.err = errors.New("taco")
+	t.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, last())
+
+	// One we can.
+	t.wrapped.err = &googleapi.Error{Code: 429}
+	_, err := t.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(t.wrapped.err, err)
+
+	AssertNe(nil, last())
+	ExpectEq(syscall.EAGAIN, last().Errno)
+
+	// A later success doesn't erase it.
+	_, err = t.bucket.ListObjects(ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectNe(nil, last())
+}
+
+func (t *DiagnoseTest) RecordersAreIndependent() {
+	ctx0, last0 := gcsx.WithDiagnosisRecorder(t.ctx)
+	_, last1 := gcsx.WithDiagnosisRecorder(t.ctx)
+
+	t.wrapped.err = &googleapi.Error{Code: 401}
+	t.bucket.StatObject(ctx0, &gcs.StatObjectRequest{Name: "foo"})
+
+	ExpectNe(nil, last0())
+	ExpectEq(nil, last1())
+}
@@ -0,0 +1,560 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// ListBuckets returns the names of the buckets in the given project that are
+// visible to the credentials the supplied client adds to its requests.
+func ListBuckets(
+	ctx context.Context,
+	client *http.Client,
+	project string,
+	userAgent string) (names []string, err error) {
+	query := url.Values{
+		"project": {project},
+		"fields":  {"items/name,nextPageToken"},
+	}
+
+	for {
+		var res struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+
+			NextPageToken string `json:"nextPageToken"`
+		}
+
+		err = sendRequest(ctx, client, userAgent, "GET", "b", query, nil, &res)
+		if err != nil {
+			return
+		}
+
+		for _, b := range res.Items {
+			names = append(names, b.Name)
+		}
+
+		if res.NextPageToken == "" {
+			break
+		}
+
+		query.Set("pageToken", res.NextPageToken)
+	}
+
+	return
+}
+
+// ProbeBucket checks that the named bucket exists and that the credentials the
+// supplied client adds to its requests may list its objects. If not, it
+// returns *gcs.NotFoundError. Any other failure, such as a timeout or a
+// server error, is returned unchanged since it says nothing about the bucket.
+//
+// gcs.Conn.OpenBucket makes the same check, but reports its result in a way
+// that can't be told apart from other errors.
+func ProbeBucket(
+	ctx context.Context,
+	client *http.Client,
+	userAgent string,
+	name string,
+	billingProject string) (err error) {
+	query := url.Values{
+		"maxResults": {"1"},
+		"fields":     {"kind"},
+	}
+
+	if billingProject != "" {
+		query.Set("userProject", billingProject)
+	}
+
+	err = sendBucketRequest(
+		ctx,
+		client,
+		name,
+		userAgent,
+		"GET",
+		"o",
+		query,
+		nil,
+		nil)
+
+	if typed, ok := err.(*googleapi.Error); ok &&
+		typed.Code == http.StatusForbidden {
+		err = &gcs.NotFoundError{Err: typed}
+	}
+
+	return
+}
+
+// NewDynamicBucket creates a bucket in which each of the buckets returned by
+// list appears as a top-level directory, so that the object "foo" in the
+// bucket "b" has the name "b/foo". Buckets are opened with open when first
+// used, whether or not list returns them, so that buckets in other projects
+// can be reached by name. list is called for each listing of the top level.
+//
+// open must return *gcs.NotFoundError for a bucket that doesn't exist or may
+// not be used. That result is remembered for a short while, so that tools
+// looking for the same missing name again and again don't each cost a request
+// to GCS. Other errors are returned unchanged and not remembered.
+//
+// The top-level directories always exist and can't be modified, and nothing
+// else can be created beside them; attempts to do so fail with
+// *ReadOnlyError. Copies and compositions between buckets work as for
+// NewTreeBucket. The bucket takes the supplied name.
+func NewDynamicBucket(
+	name string,
+	list func(context.Context) ([]string, error),
+	open func(context.Context, string) (gcs.Bucket, error),
+	clock timeutil.Clock) (b gcs.Bucket) {
+	b = &dynamicBucket{
+		name:    name,
+		list:    list,
+		open:    open,
+		clock:   clock,
+		buckets: make(map[string]gcs.Bucket),
+		missing: make(map[string]missingBucket),
+	}
+
+	return
+}
+
+// Names that GCS accepts for buckets. Anything else, such as the ".git" or
+// "__pycache__" that tools look for everywhere, can't name a bucket and so is
+// answered without asking GCS.
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,220}[a-z0-9]$`)
+
+// How long to keep answering that a bucket isn't found without asking again.
+const missingBucketTTL = 10 * time.Second
+
+// A bucket that open reported as not found.
+type missingBucket struct {
+	err        error
+	expiration time.Time
+}
+
+type dynamicBucket struct {
+	name  string
+	list  func(context.Context) ([]string, error)
+	open  func(context.Context, string) (gcs.Bucket, error)
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// The buckets opened so far, by name.
+	//
+	// GUARDED_BY(mu)
+	buckets map[string]gcs.Bucket
+
+	// The buckets recently found not to exist, by name.
+	//
+	// GUARDED_BY(mu)
+	missing map[string]missingBucket
+}
+
+// Split a local name into the name of the bucket holding it and the rest,
+// returning ok == false if it lies at the top level.
+func splitBucketName(n string) (bucketName string, rest string, ok bool) {
+	i := strings.Index(n, "/")
+	if i < 0 {
+		return
+	}
+
+	bucketName, rest, ok = n[:i], n[i+1:], true
+	return
+}
+
+// Return the named bucket, opening it if this is the first time it's been
+// asked for. Names that can't be those of buckets aren't found.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *dynamicBucket) bucket(
+	ctx context.Context,
+	name string) (bucket gcs.Bucket, err error) {
+	if !bucketNameRegexp.MatchString(name) {
+		err = objectNotFound(name + "/")
+		return
+	}
+
+	b.mu.Lock()
+	bucket = b.buckets[name]
+	m, isMissing := b.missing[name]
+	if isMissing && !b.clock.Now().Before(m.expiration) {
+		delete(b.missing, name)
+		isMissing = false
+	}
+	b.mu.Unlock()
+
+	if bucket != nil {
+		return
+	}
+
+	if isMissing {
+		err = m.err
+		return
+	}
+
+	// Open the bucket without holding the lock, since it involves a request to
+	// GCS. If another caller opens it at the same time, the later one wins.
+	bucket, err = b.open(ctx, name)
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		b.mu.Lock()
+		b.missing[name] = missingBucket{
+			err:        err,
+			expiration: b.clock.Now().Add(missingBucketTTL),
+		}
+		b.mu.Unlock()
+	}
+
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.buckets[name] = bucket
+	b.mu.Unlock()
+
+	return
+}
+
+// Find the object with the supplied local name, which must lie within a
+// bucket's directory.
+func (b *dynamicBucket) locate(
+	ctx context.Context,
+	n string) (l treeLocation, err error) {
+	bucketName, rest, ok := splitBucketName(n)
+	if !ok || rest == "" {
+		err = &ReadOnlyError{Name: n}
+		return
+	}
+
+	bucket, err := b.bucket(ctx, bucketName)
+	if err != nil {
+		return
+	}
+
+	l = treeLocation{
+		bucket: bucket,
+		name:   rest,
+		dir:    bucketName + "/",
+	}
+
+	return
+}
+
+// Like locate, but report all failures as the object not being found.
+func (b *dynamicBucket) locateExisting(
+	ctx context.Context,
+	n string) (l treeLocation, err error) {
+	l, err = b.locate(ctx, n)
+	if _, ok := err.(*ReadOnlyError); ok {
+		err = objectNotFound(n)
+	}
+
+	return
+}
+
+// List the directories for the buckets matching the supplied request.
+func (b *dynamicBucket) listBuckets(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	names, err := b.list(ctx)
+	if err != nil {
+		return
+	}
+
+	sort.Strings(names)
+	l = &gcs.Listing{}
+
+	for _, n := range names {
+		dir := n + "/"
+		if !bucketNameRegexp.MatchString(n) ||
+			!strings.HasPrefix(dir, req.Prefix) {
+			continue
+		}
+
+		if req.Delimiter == "/" {
+			l.CollapsedRuns = append(l.CollapsedRuns, dir)
+		} else {
+			l.Objects = append(l.Objects, syntheticDirObject(dir))
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket methods
+////////////////////////////////////////////////////////////////////////
+
+func (b *dynamicBucket) Name() string {
+	return b.name
+}
+
+func (b *dynamicBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	l, err := b.locateExisting(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.ReadObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	rc, err = l.bucket.NewReader(ctx, mReq)
+	return
+}
+
+func (b *dynamicBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	l, err := b.locate(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.CreateObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	o, err = l.bucket.CreateObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = l.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *dynamicBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	src, err := b.locateExisting(ctx, req.SrcName)
+	if err != nil {
+		return
+	}
+
+	dst, err := b.locate(ctx, req.DstName)
+	if err != nil {
+		return
+	}
+
+	if src.dir == dst.dir {
+		// Modify the request and call through.
+		mReq := new(gcs.CopyObjectRequest)
+		*mReq = *req
+		mReq.SrcName = src.name
+		mReq.DstName = dst.name
+
+		o, err = dst.bucket.CopyObject(ctx, mReq)
+	} else {
+		o, err = copyAcrossBuckets(
+			ctx,
+			src,
+			req.SrcGeneration,
+			req.SrcMetaGenerationPrecondition,
+			dst)
+	}
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = dst.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *dynamicBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	dst, err := b.locate(ctx, req.DstName)
+	if err != nil {
+		return
+	}
+
+	// Find the sources, noting whether they are all in the destination bucket.
+	var srcs []treeLocation
+	sameBucket := true
+	for _, s := range req.Sources {
+		var l treeLocation
+		l, err = b.locateExisting(ctx, s.Name)
+		if err != nil {
+			return
+		}
+
+		srcs = append(srcs, l)
+		sameBucket = sameBucket && l.dir == dst.dir
+	}
+
+	if sameBucket {
+		// Modify the request and call through.
+		mReq := new(gcs.ComposeObjectsRequest)
+		*mReq = *req
+		mReq.DstName = dst.name
+
+		mReq.Sources = nil
+		for i, s := range req.Sources {
+			s.Name = srcs[i].name
+			mReq.Sources = append(mReq.Sources, s)
+		}
+
+		o, err = dst.bucket.ComposeObjects(ctx, mReq)
+	} else {
+		o, err = composeAcrossBuckets(ctx, srcs, req, dst)
+	}
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = dst.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *dynamicBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	// Special case: the directory for a bucket exists if the bucket does.
+	if bucketName, rest, ok := splitBucketName(req.Name); ok && rest == "" {
+		_, err = b.bucket(ctx, bucketName)
+		if err != nil {
+			return
+		}
+
+		o = syntheticDirObject(req.Name)
+		return
+	}
+
+	l, err := b.locateExisting(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.StatObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	o, err = l.bucket.StatObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = l.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *dynamicBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	// Requests not within a single bucket are answered by listing buckets.
+	bucketName, rest, ok := splitBucketName(req.Prefix)
+	if !ok {
+		l, err = b.listBuckets(ctx, req)
+		return
+	}
+
+	// Nothing lies within a directory that can't be a bucket's.
+	if !bucketNameRegexp.MatchString(bucketName) {
+		l = &gcs.Listing{}
+		return
+	}
+
+	bucket, err := b.bucket(ctx, bucketName)
+	if err != nil {
+		return
+	}
+
+	loc := treeLocation{bucket: bucket, dir: bucketName + "/"}
+
+	// Modify the request and call through.
+	mReq := new(gcs.ListObjectsRequest)
+	*mReq = *req
+	mReq.Prefix = rest
+
+	l, err = bucket.ListObjects(ctx, mReq)
+
+	// Modify the returned listing.
+	if l != nil {
+		for _, o := range l.Objects {
+			o.Name = loc.localName(o.Name)
+		}
+
+		for i, n := range l.CollapsedRuns {
+			l.CollapsedRuns[i] = loc.localName(n)
+		}
+	}
+
+	return
+}
+
+func (b *dynamicBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	l, err := b.locate(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.UpdateObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	o, err = l.bucket.UpdateObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = l.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *dynamicBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	l, err := b.locate(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.DeleteObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	err = l.bucket.DeleteObject(ctx, mReq)
+	return
+}
@@ -0,0 +1,387 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"google.golang.org/api/googleapi"
+)
+
+func TestDynamicBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DynamicBucketTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+
+	// The buckets that exist, those that are listed, and the names passed to
+	// open so far.
+	buckets map[string]gcs.Bucket
+	listed  []string
+	opened  []string
+
+	// If set, the error returned by open for every bucket.
+	openErr error
+
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &DynamicBucketTest{}
+
+func init() { RegisterTestSuite(&DynamicBucketTest{}) }
+
+func (t *DynamicBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.buckets = make(map[string]gcs.Bucket)
+	for _, n := range []string{"foo", "bar", "unlisted"} {
+		t.buckets[n] = gcsfake.NewFakeBucket(timeutil.RealClock(), n)
+	}
+
+	t.listed = []string{"foo", "bar"}
+
+	list := func(ctx context.Context) ([]string, error) {
+		return t.listed, nil
+	}
+
+	open := func(ctx context.Context, name string) (b gcs.Bucket, err error) {
+		t.opened = append(t.opened, name)
+		if t.openErr != nil {
+			err = t.openErr
+			return
+		}
+
+		b, ok := t.buckets[name]
+		if !ok {
+			err = &gcs.NotFoundError{Err: fmt.Errorf("Unknown bucket %q", name)}
+		}
+
+		return
+	}
+
+	t.bucket = gcsx.NewDynamicBucket("_", list, open, &t.clock)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DynamicBucketTest) Name() {
+	ExpectEq("_", t.bucket.Name())
+}
+
+func (t *DynamicBucketTest) ListTopLevel() {
+	l, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Delimiter: "/"})
+
+	AssertEq(nil, err)
+	ExpectEq(0, len(l.Objects))
+	ExpectThat(l.CollapsedRuns, ElementsAre("bar/", "foo/"))
+
+	// Listing shouldn't open anything.
+	ExpectEq(0, len(t.opened))
+}
+
+func (t *DynamicBucketTest) BucketsOpenedOnce() {
+	_, err := gcsutil.CreateObject(t.ctx, t.buckets["foo"], "a", []byte("taco"))
+	AssertEq(nil, err)
+
+	for i := 0; i < 3; i++ {
+		contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo/a")
+		AssertEq(nil, err)
+		ExpectEq("taco", string(contents))
+	}
+
+	ExpectThat(t.opened, ElementsAre("foo"))
+}
+
+func (t *DynamicBucketTest) StatBucketDirectories() {
+	// Unlisted buckets can still be reached by name.
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "unlisted/"})
+
+	AssertEq(nil, err)
+	ExpectEq("unlisted/", o.Name)
+
+	// Unknown buckets don't exist.
+	_, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "missing/"})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DynamicBucketTest) MissingBucketsRemembered() {
+	stat := func() (err error) {
+		_, err = t.bucket.StatObject(
+			t.ctx,
+			&gcs.StatObjectRequest{Name: "missing/"})
+
+		return
+	}
+
+	// Asking again shortly afterward doesn't open the bucket again.
+	ExpectThat(stat(), HasSameTypeAs(&gcs.NotFoundError{}))
+
+	t.clock.AdvanceTime(time.Second)
+	ExpectThat(stat(), HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectThat(t.opened, ElementsAre("missing"))
+
+	// Once a while has passed, the bucket is looked for again and may have
+	// been created.
+	t.buckets["missing"] = gcsfake.NewFakeBucket(&t.clock, "missing")
+	t.clock.AdvanceTime(time.Minute)
+
+	ExpectEq(nil, stat())
+	ExpectThat(t.opened, ElementsAre("missing", "missing"))
+}
+
+func (t *DynamicBucketTest) OtherOpenErrorsNotRemembered() {
+	t.openErr = &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	// The error is passed on as it is, rather than as the bucket being missing.
+	_, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo/a")
+	ExpectThat(err, HasSameTypeAs(&googleapi.Error{}))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	ExpectThat(err, HasSameTypeAs(&googleapi.Error{}))
+
+	// Once the failure clears, the bucket is opened straight away.
+	t.openErr = nil
+	_, err = gcsutil.CreateObject(t.ctx, t.buckets["foo"], "a", []byte("taco"))
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo/a")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	ExpectThat(t.opened, ElementsAre("foo", "foo", "foo"))
+}
+
+func (t *DynamicBucketTest) NamesThatCantBeBuckets() {
+	for _, n := range []string{".git/", "Foo/", "a/", "x_/", "foo"} {
+		_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: n})
+		ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}), "name: %q", n)
+	}
+
+	l, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: ".gcsfuse_tmp/"})
+
+	AssertEq(nil, err)
+	ExpectEq(0, len(l.Objects))
+
+	ExpectEq(0, len(t.opened))
+}
+
+func (t *DynamicBucketTest) ReadAndWriteWithinBucket() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo/dir/a", []byte("taco"))
+	AssertEq(nil, err)
+	ExpectEq("foo/dir/a", o.Name)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.buckets["foo"], "dir/a")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	l, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: "foo/", Delimiter: "/"})
+
+	AssertEq(nil, err)
+	ExpectThat(l.CollapsedRuns, ElementsAre("foo/dir/"))
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo/dir/a"})
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.buckets["foo"], "dir/a")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DynamicBucketTest) TopLevelIsReadOnly() {
+	for _, n := range []string{"a", "baz/"} {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, n, []byte("taco"))
+		ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}), "name: %q", n)
+	}
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo/"})
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+}
+
+func (t *DynamicBucketTest) CopyAcrossBuckets() {
+	_, err := gcsutil.CreateObject(t.ctx, t.buckets["foo"], "a", []byte("taco"))
+	AssertEq(nil, err)
+
+	o, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: "foo/a", DstName: "bar/b"})
+
+	AssertEq(nil, err)
+	ExpectEq("bar/b", o.Name)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.buckets["bar"], "b")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+////////////////////////////////////////////////////////////////////////
+// ListBuckets
+////////////////////////////////////////////////////////////////////////
+
+type ListBucketsTest struct {
+}
+
+func init() { RegisterTestSuite(&ListBucketsTest{}) }
+
+func (t *ListBucketsTest) MultiplePages() {
+	var requests []*url.URL
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.URL)
+			if r.URL.Query().Get("pageToken") == "" {
+				w.Write([]byte(`{"items": [{"name": "a"}], "nextPageToken": "p"}`))
+			} else {
+				w.Write([]byte(`{"items": [{"name": "b"}]}`))
+			}
+		}))
+
+	defer server.Close()
+
+	endpoint, err := url.Parse(server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+
+	names, err := gcsx.ListBuckets(
+		context.Background(),
+		&http.Client{Transport: transport},
+		"some-project",
+		"gcsfuse/0.0")
+
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a", "b"))
+
+	AssertEq(2, len(requests))
+	ExpectEq("/storage/v1/b", requests[0].EscapedPath())
+	ExpectEq("some-project", requests[0].Query().Get("project"))
+	ExpectEq("p", requests[1].Query().Get("pageToken"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// ProbeBucket
+////////////////////////////////////////////////////////////////////////
+
+type ProbeBucketTest struct {
+	// The status with which the server responds, and the requests it has seen.
+	status   int
+	requests []*url.URL
+
+	server *httptest.Server
+	client *http.Client
+}
+
+var _ SetUpInterface = &ProbeBucketTest{}
+var _ TearDownInterface = &ProbeBucketTest{}
+
+func init() { RegisterTestSuite(&ProbeBucketTest{}) }
+
+func (t *ProbeBucketTest) SetUp(ti *TestInfo) {
+	t.status = http.StatusOK
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.requests = append(t.requests, r.URL)
+			w.WriteHeader(t.status)
+			w.Write([]byte(`{"kind": "storage#objects"}`))
+		}))
+
+	endpoint, err := url.Parse(t.server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+	t.client = &http.Client{Transport: transport}
+}
+
+func (t *ProbeBucketTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *ProbeBucketTest) probe(billingProject string) error {
+	return gcsx.ProbeBucket(
+		context.Background(),
+		t.client,
+		"gcsfuse/0.0",
+		"some-bucket",
+		billingProject)
+}
+
+func (t *ProbeBucketTest) BucketExists() {
+	ExpectEq(nil, t.probe("some-project"))
+
+	AssertEq(1, len(t.requests))
+	ExpectEq("/storage/v1/b/some-bucket/o", t.requests[0].EscapedPath())
+	ExpectEq("1", t.requests[0].Query().Get("maxResults"))
+	ExpectEq("some-project", t.requests[0].Query().Get("userProject"))
+}
+
+func (t *ProbeBucketTest) MissingOrForbidden() {
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden} {
+		t.status = status
+		err := t.probe("")
+		ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}), "status: %d", status)
+	}
+}
+
+func (t *ProbeBucketTest) OtherErrorsUnchanged() {
+	statuses := []int{
+		http.StatusUnauthorized,
+		http.StatusTooManyRequests,
+		http.StatusServiceUnavailable,
+	}
+
+	for _, status := range statuses {
+		t.status = status
+		err := t.probe("")
+		AssertThat(err, HasSameTypeAs(&googleapi.Error{}), "status: %d", status)
+		ExpectEq(status, err.(*googleapi.Error).Code)
+	}
+}
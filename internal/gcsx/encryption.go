@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// The length in bytes of an AES-256 key.
+const encryptionKeyLength = 32
+
+// ParseEncryptionKey parses a customer-supplied AES-256 encryption key given
+// in base64, as for the GCS JSON API. Surrounding whitespace is ignored, so
+// that the key may be read from a file ending in a newline.
+func ParseEncryptionKey(s string) (key []byte, err error) {
+	key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		err = fmt.Errorf("Decoding base64: %v", err)
+		return
+	}
+
+	if len(key) != encryptionKeyLength {
+		err = fmt.Errorf(
+			"Expected a %d-byte AES-256 key, got %d bytes",
+			encryptionKeyLength,
+			len(key))
+
+		return
+	}
+
+	return
+}
+
+// NewEncryptionRoundTripper returns a round tripper that attaches the supplied
+// customer-supplied encryption key to each request concerning a single object,
+// so that objects are encrypted with the key when written and may be read
+// when encrypted with it. Copies are also given the key for their source.
+// Listings and requests about the bucket are passed through unmodified.
+//
+// The key is sent in the clear in headers, so round trippers that log or
+// record requests should wrap this one rather than be wrapped by it.
+func NewEncryptionRoundTripper(
+	key []byte,
+	wrapped httputil.CancellableRoundTripper) httputil.CancellableRoundTripper {
+	sum := sha256.Sum256(key)
+
+	e := &encryptionRewriter{
+		key:       base64.StdEncoding.EncodeToString(key),
+		keySHA256: base64.StdEncoding.EncodeToString(sum[:]),
+	}
+
+	return newRewritingRoundTripper(e.rewrite, wrapped)
+}
+
+type encryptionRewriter struct {
+	// The key and its SHA-256 hash, base64-encoded.
+	key       string
+	keySHA256 string
+}
+
+// Return the escaped path of the supplied URL, which package gcs sets as an
+// opaque string beginning with the original host.
+func requestPath(u *url.URL) string {
+	if strings.HasPrefix(u.Opaque, "//") {
+		if i := strings.Index(u.Opaque[2:], "/"); i >= 0 {
+			return u.Opaque[2+i:]
+		}
+
+		return ""
+	}
+
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+
+	return u.EscapedPath()
+}
+
+func (e *encryptionRewriter) rewrite(
+	req *http.Request) (modified *http.Request, err error) {
+	// Object names are escaped in paths, so "/o/" appears only in requests
+	// concerning a single object. Uploads name the object elsewhere.
+	p := requestPath(req.URL)
+	if !strings.Contains(p, "/o/") && !strings.HasPrefix(p, "/upload/") {
+		modified = req
+		return
+	}
+
+	modified = copyRequest(req)
+	modified.Header.Set("X-Goog-Encryption-Algorithm", "AES256")
+	modified.Header.Set("X-Goog-Encryption-Key", e.key)
+	modified.Header.Set("X-Goog-Encryption-Key-Sha256", e.keySHA256)
+
+	if strings.Contains(p, "/copyTo/") || strings.Contains(p, "/rewriteTo/") {
+		h := modified.Header
+		h.Set("X-Goog-Copy-Source-Encryption-Algorithm", "AES256")
+		h.Set("X-Goog-Copy-Source-Encryption-Key", e.key)
+		h.Set("X-Goog-Copy-Source-Encryption-Key-Sha256", e.keySHA256)
+	}
+
+	return
+}
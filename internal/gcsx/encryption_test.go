@@ -0,0 +1,184 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestEncryption(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A round tripper that records the requests it's given, responding to each
+// with an empty 200.
+type capturingRoundTripper struct {
+	requests []*http.Request
+}
+
+func (rt *capturingRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	rt.requests = append(rt.requests, req)
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+
+	return
+}
+
+func (rt *capturingRoundTripper) CancelRequest(req *http.Request) {
+}
+
+// The base64 encoding of the bytes 0 through 31, and of their SHA-256 hash.
+const (
+	testEncryptionKey       = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	testEncryptionKeySHA256 = "Yw3NKWbEM2aRElRIu7JbT/QSpJxzLbLIq8G4WBvXEN0="
+)
+
+type EncryptionTest struct {
+	wrapped capturingRoundTripper
+	rt      httputil.CancellableRoundTripper
+}
+
+var _ SetUpInterface = &EncryptionTest{}
+
+func init() { RegisterTestSuite(&EncryptionTest{}) }
+
+func (t *EncryptionTest) SetUp(ti *TestInfo) {
+	key, err := gcsx.ParseEncryptionKey(testEncryptionKey)
+	AssertEq(nil, err)
+
+	t.rt = gcsx.NewEncryptionRoundTripper(key, &t.wrapped)
+}
+
+// Send a request with the given method and opaque URL, as package gcs does,
+// returning the request received by the wrapped round tripper.
+func (t *EncryptionTest) send(method string, opaque string) *http.Request {
+	req := &http.Request{
+		Method: method,
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   "www.googleapis.com",
+			Opaque: opaque,
+		},
+		Header: http.Header{"User-Agent": {"gcsfuse"}},
+	}
+
+	_, err := t.rt.RoundTrip(req)
+	AssertEq(nil, err)
+	AssertEq(1, len(t.wrapped.requests))
+
+	// The original request must not be modified.
+	ExpectEq("", req.Header.Get("X-Goog-Encryption-Key"))
+
+	received := t.wrapped.requests[0]
+	t.wrapped.requests = nil
+	return received
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *EncryptionTest) ParseEncryptionKey() {
+	key, err := gcsx.ParseEncryptionKey("  " + testEncryptionKey + "\n")
+	AssertEq(nil, err)
+	ExpectEq(32, len(key))
+	ExpectEq(31, key[31])
+
+	_, err = gcsx.ParseEncryptionKey("taco!")
+	ExpectThat(err, Error(HasSubstr("base64")))
+
+	_, err = gcsx.ParseEncryptionKey("AAECAwQFBgcICQoLDA0ODw==")
+	ExpectThat(err, Error(HasSubstr("got 16 bytes")))
+}
+
+func (t *EncryptionTest) ObjectRequests() {
+	for _, opaque := range []string{
+		"//www.googleapis.com/storage/v1/b/some_bucket/o/foo%2Fbar",
+		"//www.googleapis.com/download/storage/v1/b/some_bucket/o/foo",
+		"//www.googleapis.com/upload/storage/v1/b/some_bucket/o",
+		"//www.googleapis.com/storage/v1/b/some_bucket/o/foo/compose",
+	} {
+		req := t.send("GET", opaque)
+		ExpectEq("AES256", req.Header.Get("X-Goog-Encryption-Algorithm"), opaque)
+		ExpectEq(testEncryptionKey, req.Header.Get("X-Goog-Encryption-Key"))
+		ExpectEq(
+			testEncryptionKeySHA256,
+			req.Header.Get("X-Goog-Encryption-Key-Sha256"))
+
+		ExpectEq("gcsfuse", req.Header.Get("User-Agent"))
+		ExpectEq("", req.Header.Get("X-Goog-Copy-Source-Encryption-Key"))
+	}
+}
+
+func (t *EncryptionTest) Copies() {
+	req := t.send(
+		"POST",
+		"//www.googleapis.com/storage/v1/b/some_bucket/o/foo/copyTo/b/some_bucket/o/bar")
+
+	ExpectEq(testEncryptionKey, req.Header.Get("X-Goog-Encryption-Key"))
+	ExpectEq(
+		"AES256",
+		req.Header.Get("X-Goog-Copy-Source-Encryption-Algorithm"))
+	ExpectEq(
+		testEncryptionKey,
+		req.Header.Get("X-Goog-Copy-Source-Encryption-Key"))
+	ExpectEq(
+		testEncryptionKeySHA256,
+		req.Header.Get("X-Goog-Copy-Source-Encryption-Key-Sha256"))
+}
+
+func (t *EncryptionTest) OtherRequestsUnmodified() {
+	for _, opaque := range []string{
+		"//www.googleapis.com/storage/v1/b/some_bucket/o",
+		"//www.googleapis.com/storage/v1/b/some_bucket",
+		"//www.googleapis.com/storage/v1/b/some_bucket/folders/foo%2F",
+	} {
+		req := t.send("GET", opaque)
+		ExpectEq("", req.Header.Get("X-Goog-Encryption-Key"), opaque)
+	}
+}
+
+func (t *EncryptionTest) RedirectedRequests() {
+	// The endpoint round tripper changes the host but not the opaque URL.
+	req := &http.Request{
+		Method: "GET",
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   "localhost:4443",
+			Opaque: "//www.googleapis.com/upload/storage/v1/b/some_bucket/o",
+		},
+		Header: make(http.Header),
+	}
+
+	_, err := t.rt.RoundTrip(req)
+	AssertEq(nil, err)
+	AssertEq(1, len(t.wrapped.requests))
+	ExpectEq(
+		testEncryptionKey,
+		t.wrapped.requests[0].Header.Get("X-Goog-Encryption-Key"))
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// The host to which package gcs sends all requests.
+const defaultEndpointHost = "www.googleapis.com"
+
+// EmulatorHostEnvVar is the environment variable with which the Cloud client
+// libraries, and fake-gcs-server's documentation, name a GCS emulator.
+const EmulatorHostEnvVar = "STORAGE_EMULATOR_HOST"
+
+// ParseEmulatorHost parses the value of STORAGE_EMULATOR_HOST into an endpoint
+// suitable for NewEndpointRoundTripper. As in the client libraries, the value
+// may be a bare host and port, in which case plain http is assumed.
+func ParseEmulatorHost(host string) (endpoint *url.URL, err error) {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+
+	endpoint, err = url.Parse(host)
+	if err != nil {
+		err = fmt.Errorf("url.Parse: %v", err)
+		return
+	}
+
+	return
+}
+
+// NewEndpointRoundTripper returns a round tripper that redirects requests
+// bound for the public GCS JSON API (https://www.googleapis.com) to the
+// supplied endpoint, e.g. a GCS emulator such as fake-gcs-server. The endpoint
+// must consist only of an http or https scheme and a host, optionally with a
+// port. Other requests are passed through unmodified.
+func NewEndpointRoundTripper(
+	endpoint *url.URL,
+	wrapped httputil.CancellableRoundTripper) (
+	rt httputil.CancellableRoundTripper,
+	err error) {
+	// Validate the endpoint.
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		err = fmt.Errorf("Unsupported scheme in endpoint %q", endpoint)
+		return
+	}
+
+	if endpoint.Host == "" {
+		err = fmt.Errorf("No host in endpoint %q", endpoint)
+		return
+	}
+
+	if (endpoint.Path != "" && endpoint.Path != "/") ||
+		endpoint.RawQuery != "" ||
+		endpoint.Fragment != "" ||
+		endpoint.User != nil {
+		err = fmt.Errorf("Endpoint %q must contain only a scheme and host", endpoint)
+		return
+	}
+
+	e := &endpointRewriter{
+		scheme: endpoint.Scheme,
+		host:   endpoint.Host,
+	}
+
+	rt = newRewritingRoundTripper(e.rewrite, wrapped)
+	return
+}
+
+type endpointRewriter struct {
+	scheme string
+	host   string
+}
+
+func (e *endpointRewriter) rewrite(
+	req *http.Request) (redirected *http.Request, err error) {
+	if req.URL.Host != defaultEndpointHost {
+		redirected = req
+		return
+	}
+
+	// Point a copy of the request at our endpoint.
+	u := *req.URL
+	u.Scheme = e.scheme
+	u.Host = e.host
+
+	redirected = new(http.Request)
+	*redirected = *req
+	redirected.URL = &u
+	redirected.Host = e.host
+
+	return
+}
@@ -0,0 +1,365 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+// The number of reads served by the mirror of a bucket returned by
+// NewFailoverBucket.
+var failoverReads = expvar.NewInt("failover_reads")
+
+// NewFailoverBucket returns a bucket that reads from the mirror when opening
+// a reader on the primary bucket fails, or takes longer than the supplied
+// delay if it is non-zero. All other requests go to the primary.
+//
+// Objects in the mirror have different generation numbers than their
+// counterparts in the primary, so a mirror object is used only if its size and
+// checksums match those of the primary object last seen by this bucket with
+// the requested generation. Up to capacity such objects are remembered.
+// Failures that the mirror can't help with, such as the object not existing,
+// are returned as is.
+func NewFailoverBucket(
+	primary gcs.Bucket,
+	mirror gcs.Bucket,
+	delay time.Duration,
+	capacity int) gcs.Bucket {
+	return &failoverBucket{
+		Bucket: primary,
+		mirror: mirror,
+		delay:  delay,
+		seen:   lrucache.New(capacity),
+	}
+}
+
+type failoverBucket struct {
+	gcs.Bucket
+	mirror gcs.Bucket
+	delay  time.Duration
+
+	mu sync.Mutex
+
+	// A cache from object name to the most recent *gcs.Object record returned
+	// by the primary for that name.
+	//
+	// GUARDED_BY(mu)
+	seen lrucache.Cache
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failoverBucket) remember(objects ...*gcs.Object) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, o := range objects {
+		b.seen.Insert(o.Name, o)
+	}
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failoverBucket) forget(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seen.Erase(name)
+}
+
+// Return the record for the object that the supplied request will read, or
+// nil if it hasn't been seen.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *failoverBucket) expected(req *gcs.ReadObjectRequest) (o *gcs.Object) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, _ = b.seen.LookUp(req.Name).(*gcs.Object)
+	if o != nil && req.Generation != 0 && o.Generation != req.Generation {
+		o = nil
+	}
+
+	return
+}
+
+// Does the mirror's record describe the same contents as the primary's?
+func sameContents(primary *gcs.Object, mirror *gcs.Object) bool {
+	if primary.Size != mirror.Size || primary.CRC32C != mirror.CRC32C {
+		return false
+	}
+
+	if primary.MD5 != nil && mirror.MD5 != nil && *primary.MD5 != *mirror.MD5 {
+		return false
+	}
+
+	return true
+}
+
+// Open a reader on the mirror's copy of the supplied primary object.
+func (b *failoverBucket) readMirror(
+	ctx context.Context,
+	expected *gcs.Object,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	o, err := b.mirror.StatObject(ctx, &gcs.StatObjectRequest{Name: req.Name})
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	if !sameContents(expected, o) {
+		err = fmt.Errorf(
+			"%q in %q doesn't match generation %d in %q",
+			req.Name,
+			b.mirror.Name(),
+			expected.Generation,
+			b.Bucket.Name())
+		return
+	}
+
+	rc, err = b.mirror.NewReader(ctx, &gcs.ReadObjectRequest{
+		Name:       req.Name,
+		Generation: o.Generation,
+		Range:      req.Range,
+	})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	return
+}
+
+// Is the supplied error from the primary one that the mirror might not
+// suffer from?
+func worthFailingOver(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	_, notFound := err.(*gcs.NotFoundError)
+	return !notFound
+}
+
+// The outcome of an attempt to open a reader.
+type readAttempt struct {
+	rc     io.ReadCloser
+	err    error
+	mirror bool
+}
+
+// A reader that cancels the context used to open it when closed.
+type cancellingReader struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (r *cancellingReader) Close() (err error) {
+	err = r.ReadCloser.Close()
+	r.cancel()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *failoverBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	expected := b.expected(req)
+
+	// If we couldn't use the mirror anyway, don't bother with the machinery
+	// below.
+	if expected == nil {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	// Start reading from the primary.
+	attempts := make(chan readAttempt, 2)
+	primaryCtx, cancelPrimary := context.WithCancel(ctx)
+	go func() {
+		rc, err := b.Bucket.NewReader(primaryCtx, req)
+		attempts <- readAttempt{rc: rc, err: err}
+	}()
+
+	// Start reading from the mirror if the primary fails or is too slow.
+	var mirrorCtx context.Context
+	var cancelMirror func()
+
+	startMirror := func() {
+		mirrorCtx, cancelMirror = context.WithCancel(ctx)
+		go func() {
+			rc, err := b.readMirror(mirrorCtx, expected, req)
+			attempts <- readAttempt{rc: rc, err: err, mirror: true}
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if b.delay != 0 {
+		timeout = time.After(b.delay)
+	}
+
+	// Wait for the first success, or for all of the attempts to fail.
+	var primaryErr error
+	outstanding := 1
+	for outstanding > 0 {
+		select {
+		case <-timeout:
+			timeout = nil
+			if cancelMirror == nil {
+				startMirror()
+				outstanding++
+			}
+
+		case a := <-attempts:
+			outstanding--
+
+			// Has this attempt failed?
+			if a.err != nil {
+				if a.mirror {
+					continue
+				}
+
+				primaryErr = a.err
+				if cancelMirror == nil && worthFailingOver(ctx, a.err) {
+					startMirror()
+					outstanding++
+				}
+
+				continue
+			}
+
+			// It succeeded. Use it, and give up on the other.
+			cancel := cancelPrimary
+			if a.mirror {
+				cancel = cancelMirror
+				cancelPrimary()
+				failoverReads.Add(1)
+			} else if cancelMirror != nil {
+				cancelMirror()
+			}
+
+			rc = &cancellingReader{ReadCloser: a.rc, cancel: cancel}
+
+			// Clean up after the other attempt if it's still running.
+			if outstanding > 0 {
+				go func() {
+					if a := <-attempts; a.rc != nil {
+						a.rc.Close()
+					}
+				}()
+			}
+
+			return
+		}
+	}
+
+	// Everything failed. Report the primary's error, which is what the caller
+	// would have seen without a mirror.
+	cancelPrimary()
+	if cancelMirror != nil {
+		cancelMirror()
+	}
+
+	err = primaryErr
+	return
+}
+
+func (b *failoverBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *failoverBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CopyObject(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *failoverBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *failoverBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *failoverBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	if err == nil {
+		b.remember(listing.Objects...)
+	}
+
+	return
+}
+
+func (b *failoverBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *failoverBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.Bucket.DeleteObject(ctx, req)
+	b.forget(req.Name)
+	return
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFailoverBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose NewReader method can be made to fail or to stall.
+type unreliableBucket struct {
+	gcs.Bucket
+
+	// If non-nil, returned by NewReader.
+	err error
+
+	// If non-zero, how long NewReader waits before doing anything.
+	delay time.Duration
+}
+
+func (b *unreliableBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FailoverBucketTest struct {
+	ctx     context.Context
+	primary unreliableBucket
+	mirror  gcs.Bucket
+}
+
+var _ SetUpInterface = &FailoverBucketTest{}
+
+func init() { RegisterTestSuite(&FailoverBucketTest{}) }
+
+func (t *FailoverBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.primary.Bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "primary")
+	t.mirror = gcsfake.NewFakeBucket(timeutil.RealClock(), "mirror")
+}
+
+// Create the named object in the primary and mirror with the supplied
+// contents, returning the primary's record.
+func (t *FailoverBucketTest) create(
+	name string,
+	primaryContents string,
+	mirrorContents string) (o *gcs.Object) {
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.primary.Bucket,
+		name,
+		[]byte(primaryContents))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.mirror, name, []byte(mirrorContents))
+	AssertEq(nil, err)
+
+	return
+}
+
+// Read the given generation of the named object through the supplied bucket.
+func (t *FailoverBucketTest) read(
+	b gcs.Bucket,
+	req *gcs.ReadObjectRequest) (contents string, err error) {
+	rc, err := b.NewReader(t.ctx, req)
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	buf, err := ioutil.ReadAll(rc)
+	contents = string(buf)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FailoverBucketTest) PrimaryHealthy() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	o := t.create("foo", "taco", "burr")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	contents, err := t.read(b, &gcs.ReadObjectRequest{
+		Name:       "foo",
+		Generation: o.Generation,
+	})
+
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *FailoverBucketTest) PrimaryFails() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	o := t.create("foo", "taco", "taco")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	t.primary.err = &googleapi.Error{Code: 503}
+	contents, err := t.read(b, &gcs.ReadObjectRequest{
+		Name:       "foo",
+		Generation: o.Generation,
+	})
+
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *FailoverBucketTest) PrimaryFails_Range() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	o := t.create("foo", "taco", "taco")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	t.primary.err = &googleapi.Error{Code: 503}
+	contents, err := t.read(b, &gcs.ReadObjectRequest{
+		Name:       "foo",
+		Generation: o.Generation,
+		Range:      &gcs.ByteRange{Start: 1, Limit: 3},
+	})
+
+	AssertEq(nil, err)
+	ExpectEq("ac", contents)
+}
+
+func (t *FailoverBucketTest) PrimaryFails_LearnedFromListing() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	t.create("foo", "taco", "taco")
+
+	_, err := b.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	t.primary.err = &googleapi.Error{Code: 503}
+	contents, err := t.read(b, &gcs.ReadObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *FailoverBucketTest) PrimaryFails_NotFound() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	t.create("foo", "taco", "taco")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	t.primary.err = &gcs.NotFoundError{}
+	_, err = t.read(b, &gcs.ReadObjectRequest{Name: "foo"})
+
+	ExpectEq(t.primary.err, err)
+}
+
+func (t *FailoverBucketTest) PrimaryFails_NeverSeen() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	t.create("foo", "taco", "taco")
+
+	t.primary.err = &googleapi.Error{Code: 503}
+	_, err := t.read(b, &gcs.ReadObjectRequest{Name: "foo"})
+
+	ExpectEq(t.primary.err, err)
+}
+
+func (t *FailoverBucketTest) PrimaryFails_MirrorDiffers() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	t.create("foo", "taco", "burrito")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	t.primary.err = &googleapi.Error{Code: 503}
+	_, err = t.read(b, &gcs.ReadObjectRequest{Name: "foo"})
+
+	ExpectEq(t.primary.err, err)
+}
+
+func (t *FailoverBucketTest) PrimaryFails_OtherGeneration() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	o := t.create("foo", "taco", "taco")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	t.primary.err = &googleapi.Error{Code: 503}
+	_, err = t.read(b, &gcs.ReadObjectRequest{
+		Name:       "foo",
+		Generation: o.Generation + 1,
+	})
+
+	ExpectEq(t.primary.err, err)
+}
+
+func (t *FailoverBucketTest) PrimaryFails_Deleted() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	t.create("foo", "taco", "taco")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	err = b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	t.primary.err = &googleapi.Error{Code: 503}
+	_, err = t.read(b, &gcs.ReadObjectRequest{Name: "foo"})
+
+	ExpectEq(t.primary.err, err)
+}
+
+func (t *FailoverBucketTest) PrimarySlow() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, time.Millisecond, 10)
+	t.create("foo", "taco", "taco")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	// The primary would take far longer than the test's deadline.
+	t.primary.delay = time.Hour
+
+	before := time.Now()
+	contents, err := t.read(b, &gcs.ReadObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+	ExpectLt(time.Since(before), time.Minute)
+}
+
+func (t *FailoverBucketTest) PrimarySlow_NoDelayConfigured() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	t.create("foo", "taco", "burrito")
+
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	// Since the mirror differs, only the primary can supply these contents.
+	t.primary.delay = 10 * time.Millisecond
+	contents, err := t.read(b, &gcs.ReadObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *FailoverBucketTest) OtherRequestsGoToPrimary() {
+	b := gcsx.NewFailoverBucket(&t.primary, t.mirror, 0, 10)
+	ExpectEq("primary", b.Name())
+
+	_, err := gcsutil.CreateObject(t.ctx, b, "bar", []byte(""))
+	AssertEq(nil, err)
+
+	_, err = t.primary.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectEq(nil, err)
+
+	_, err = t.mirror.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -0,0 +1,477 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// The size of the pieces in which object contents are fetched and cached. A
+// read of any part of a chunk fetches all of it, so this trades the cost of
+// reading more than asked for against the cost of many small requests.
+const fileCacheChunkSize = 4 << 20
+
+// The prefix of files in the cache directory still being written.
+const fileCacheTempPrefix = "tmp_"
+
+// The number of chunks read from the cache of a bucket returned by
+// NewFileCacheBucket, and the number fetched from GCS.
+var (
+	fileCacheHits   = expvar.NewInt("file_cache_hits")
+	fileCacheMisses = expvar.NewInt("file_cache_misses")
+)
+
+// NewFileCacheBucket returns a bucket that keeps the contents of the objects
+// read through it in files within dir, so that reading them again doesn't
+// require fetching them from the wrapped bucket. Contents are fetched and
+// cached in fixed-size chunks, so that reading part of a large object caches
+// only that part. When the files total more than maxBytes, the least recently
+// used are removed.
+//
+// Chunks are identified by object name and generation, so a new generation of
+// an object never reads the contents of an old one. The cache survives
+// restarts: chunks left in dir by an earlier bucket are used, most recently
+// used last. Reads that don't name a generation bypass the cache.
+func NewFileCacheBucket(
+	dir string,
+	maxBytes int64,
+	wrapped gcs.Bucket) (b gcs.Bucket, err error) {
+	if maxBytes <= 0 {
+		err = fmt.Errorf("Illegal cache size: %d", maxBytes)
+		return
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	fcb := &fileCacheBucket{
+		Bucket:   wrapped,
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		fetching: make(map[string]chan struct{}),
+	}
+
+	err = fcb.load()
+	if err != nil {
+		err = fmt.Errorf("load: %v", err)
+		return
+	}
+
+	b = fcb
+	return
+}
+
+type fileCacheBucket struct {
+	gcs.Bucket
+	dir      string
+	maxBytes int64
+
+	mu sync.Mutex
+
+	// The chunks in the cache, keyed by file name. Values are of type
+	// *fileCacheEntry. The list is ordered from most to least recently used.
+	//
+	// INVARIANT: For each k, v in entries, v.Value.(*fileCacheEntry).file == k
+	// INVARIANT: size is the sum of the sizes of the entries
+	//
+	// GUARDED_BY(mu)
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+
+	// Chunks being fetched, keyed by file name. The channel is closed when the
+	// fetch finishes, successfully or not.
+	//
+	// GUARDED_BY(mu)
+	fetching map[string]chan struct{}
+}
+
+type fileCacheEntry struct {
+	file string
+	size int64
+}
+
+// The name of the file holding the given chunk of the given object.
+func chunkFile(name string, generation int64, chunk int64) string {
+	sum := sha256.Sum256([]byte(name))
+	return fmt.Sprintf("%x_%d_%d", sum[:16], generation, chunk)
+}
+
+// Index the chunks left in the cache directory, removing any that were being
+// written when an earlier process stopped.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *fileCacheBucket) load() (err error) {
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	// Oldest first, so that the most recently used end up at the front.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if strings.HasPrefix(fi.Name(), fileCacheTempPrefix) {
+			os.Remove(filepath.Join(b.dir, fi.Name()))
+			continue
+		}
+
+		b.insert(fi.Name(), fi.Size())
+	}
+
+	b.evict()
+	return
+}
+
+// Record a chunk as the most recently used.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *fileCacheBucket) insert(file string, size int64) {
+	if e, ok := b.entries[file]; ok {
+		b.size -= e.Value.(*fileCacheEntry).size
+		b.lru.Remove(e)
+	}
+
+	b.entries[file] = b.lru.PushFront(&fileCacheEntry{file: file, size: size})
+	b.size += size
+}
+
+// Forget a chunk, removing its file.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *fileCacheBucket) remove(e *list.Element) {
+	entry := e.Value.(*fileCacheEntry)
+	b.lru.Remove(e)
+	delete(b.entries, entry.file)
+	b.size -= entry.size
+
+	// Readers that already have the file open can keep reading it.
+	err := os.Remove(filepath.Join(b.dir, entry.file))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warningf("Removing cached chunk: %v", err)
+	}
+}
+
+// Remove the least recently used chunks until the cache fits.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *fileCacheBucket) evict() {
+	for b.size > b.maxBytes {
+		b.remove(b.lru.Back())
+	}
+}
+
+// Open the file holding the given chunk of the object, fetching it from the
+// wrapped bucket if it isn't cached, and return it with its length. A length
+// less than fileCacheChunkSize means the chunk is the last in the object.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *fileCacheBucket) openChunk(
+	ctx context.Context,
+	name string,
+	generation int64,
+	chunk int64) (f *os.File, size int64, err error) {
+	file := chunkFile(name, generation, chunk)
+	p := filepath.Join(b.dir, file)
+
+	for {
+		b.mu.Lock()
+
+		// Is it already cached?
+		if e, ok := b.entries[file]; ok {
+			b.lru.MoveToFront(e)
+			size = e.Value.(*fileCacheEntry).size
+			b.mu.Unlock()
+
+			f, err = os.Open(p)
+			if err == nil {
+				// Remember the use across restarts.
+				now := time.Now()
+				os.Chtimes(p, now, now)
+
+				fileCacheHits.Add(1)
+				return
+			}
+
+			// Someone removed the file behind our back. Forget it and fetch it
+			// again.
+			logger.Warningf("Opening cached chunk: %v", err)
+
+			b.mu.Lock()
+			if e, ok := b.entries[file]; ok {
+				b.remove(e)
+			}
+			b.mu.Unlock()
+			continue
+		}
+
+		// Is someone else fetching it? If so, wait for them and try again.
+		if done, ok := b.fetching[file]; ok {
+			b.mu.Unlock()
+
+			select {
+			case <-done:
+				continue
+
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+
+		done := make(chan struct{})
+		b.fetching[file] = done
+		b.mu.Unlock()
+
+		fileCacheMisses.Add(1)
+		f, size, err = b.fetchChunk(ctx, name, generation, chunk, file)
+
+		b.mu.Lock()
+		delete(b.fetching, file)
+		close(done)
+		b.mu.Unlock()
+
+		return
+	}
+}
+
+// Fetch the given chunk of the object into the cache, returning the opened
+// file holding it.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *fileCacheBucket) fetchChunk(
+	ctx context.Context,
+	name string,
+	generation int64,
+	chunk int64,
+	file string) (f *os.File, size int64, err error) {
+	start := uint64(chunk) * fileCacheChunkSize
+	rc, err := b.Bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       name,
+			Generation: generation,
+			Range: &gcs.ByteRange{
+				Start: start,
+				Limit: start + fileCacheChunkSize,
+			},
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	// Write to a temporary file, so that a partially written chunk is never
+	// mistaken for a whole one.
+	f, err = ioutil.TempFile(b.dir, fileCacheTempPrefix)
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	size, err = io.Copy(f, rc)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		f = nil
+		return
+	}
+
+	// A chunk bigger than the whole cache can be read, but not kept.
+	if size > b.maxBytes {
+		os.Remove(f.Name())
+		return
+	}
+
+	err = os.Rename(f.Name(), filepath.Join(b.dir, file))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		f = nil
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	b.mu.Lock()
+	b.insert(file, size)
+	b.evict()
+	b.mu.Unlock()
+
+	return
+}
+
+func (b *fileCacheBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if req.Generation == 0 {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	r := &fileCacheReader{
+		ctx:        ctx,
+		bucket:     b,
+		name:       req.Name,
+		generation: req.Generation,
+		limit:      math.MaxInt64,
+	}
+
+	if req.Range != nil {
+		r.pos = int64(req.Range.Start)
+		if req.Range.Limit < math.MaxInt64 {
+			r.limit = int64(req.Range.Limit)
+		}
+	}
+
+	// Fail now if the object can't be read at all, as the wrapped bucket
+	// would.
+	err = r.next()
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	err = nil
+	rc = r
+	return
+}
+
+// A reader for a range of an object that reads from cached chunks, fetching
+// them as it goes.
+type fileCacheReader struct {
+	ctx        context.Context
+	bucket     *fileCacheBucket
+	name       string
+	generation int64
+
+	// The offset of the next byte to read, and the end of the range.
+	pos   int64
+	limit int64
+
+	// The chunk being read, if any, limited to the range.
+	f   *os.File
+	cur io.Reader
+}
+
+// Open the chunk containing pos, returning io.EOF if the range has been read.
+func (r *fileCacheReader) next() (err error) {
+	if r.pos >= r.limit {
+		err = io.EOF
+		return
+	}
+
+	chunk := r.pos / fileCacheChunkSize
+	f, size, err := r.bucket.openChunk(r.ctx, r.name, r.generation, chunk)
+	if err != nil {
+		return
+	}
+
+	// A short chunk is the last in the object.
+	chunkStart := chunk * fileCacheChunkSize
+	if size < fileCacheChunkSize && chunkStart+size < r.limit {
+		r.limit = chunkStart + size
+	}
+
+	if r.pos >= r.limit {
+		f.Close()
+		err = io.EOF
+		return
+	}
+
+	_, err = f.Seek(r.pos-chunkStart, io.SeekStart)
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	end := chunkStart + size
+	if end > r.limit {
+		end = r.limit
+	}
+
+	r.f = f
+	r.cur = io.LimitReader(f, end-r.pos)
+	return
+}
+
+func (r *fileCacheReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.cur == nil {
+			err = r.next()
+			if err != nil {
+				return
+			}
+		}
+
+		n, err = r.cur.Read(p)
+		r.pos += int64(n)
+
+		// Move on to the next chunk when this one runs out.
+		if err == io.EOF {
+			r.f.Close()
+			r.f = nil
+			r.cur = nil
+			err = nil
+		}
+
+		if n != 0 || err != nil || len(p) == 0 {
+			return
+		}
+	}
+}
+
+func (r *fileCacheReader) Close() (err error) {
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+		r.cur = nil
+	}
+
+	return
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestFileCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The size of the chunks the cache fetches.
+const fileCacheChunk = 4 << 20
+
+type FileCacheTest struct {
+	ctx context.Context
+
+	// The cache directory. Removed in TearDown.
+	dir string
+
+	wrapped *rangeRecordingBucket
+	bucket  gcs.Bucket
+
+	// An object spanning two whole chunks and part of a third.
+	contents []byte
+	object   *gcs.Object
+}
+
+var _ SetUpInterface = &FileCacheTest{}
+var _ TearDownInterface = &FileCacheTest{}
+
+func init() { RegisterTestSuite(&FileCacheTest{}) }
+
+func (t *FileCacheTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.dir, err = ioutil.TempDir("", "file_cache_test")
+	AssertEq(nil, err)
+
+	t.wrapped = &rangeRecordingBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.contents = make([]byte, 2*fileCacheChunk+100)
+	for i := range t.contents {
+		t.contents[i] = byte(i * 7)
+	}
+
+	t.object, err = gcsutil.CreateObject(t.ctx, t.wrapped, "foo", t.contents)
+	AssertEq(nil, err)
+
+	t.bucket, err = gcsx.NewFileCacheBucket(t.dir, 1<<30, t.wrapped)
+	AssertEq(nil, err)
+}
+
+func (t *FileCacheTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Read the given range of the given generation of foo through the cache.
+func (t *FileCacheTest) read(
+	b gcs.Bucket,
+	generation int64,
+	start uint64,
+	limit uint64) []byte {
+	rc, err := b.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       "foo",
+			Generation: generation,
+			Range:      &gcs.ByteRange{Start: start, Limit: limit},
+		})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	contents, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	return contents
+}
+
+// The total size of the files in the cache directory.
+func (t *FileCacheTest) cachedBytes() (n int64) {
+	infos, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+
+	for _, fi := range infos {
+		n += fi.Size()
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileCacheTest) ReadWholeObject() {
+	contents := t.read(t.bucket, t.object.Generation, 0, 1<<40)
+	ExpectTrue(bytes.Equal(t.contents, contents))
+
+	ExpectThat(
+		t.wrapped.starts(3),
+		ElementsAre(0, fileCacheChunk, 2*fileCacheChunk))
+
+	ExpectEq(len(t.contents), t.cachedBytes())
+}
+
+func (t *FileCacheTest) SecondReadFromCache() {
+	t.read(t.bucket, t.object.Generation, 0, 1<<40)
+	AssertEq(3, len(t.wrapped.starts(3)))
+
+	contents := t.read(t.bucket, t.object.Generation, 0, 1<<40)
+	ExpectTrue(bytes.Equal(t.contents, contents))
+	ExpectEq(3, len(t.wrapped.starts(3)))
+}
+
+func (t *FileCacheTest) PartialRead() {
+	start := uint64(fileCacheChunk + 17)
+	contents := t.read(t.bucket, t.object.Generation, start, start+10)
+	ExpectTrue(bytes.Equal(t.contents[start:start+10], contents))
+
+	// Only the chunk containing the range was fetched.
+	ExpectThat(t.wrapped.starts(1), ElementsAre(fileCacheChunk))
+	ExpectEq(fileCacheChunk, t.cachedBytes())
+}
+
+func (t *FileCacheTest) RangeSpanningChunks() {
+	start := uint64(fileCacheChunk - 5)
+	limit := uint64(2*fileCacheChunk + 50)
+	contents := t.read(t.bucket, t.object.Generation, start, limit)
+	ExpectTrue(bytes.Equal(t.contents[start:limit], contents))
+
+	ExpectThat(
+		t.wrapped.starts(3),
+		ElementsAre(0, fileCacheChunk, 2*fileCacheChunk))
+}
+
+func (t *FileCacheTest) RangePastEndOfObject() {
+	start := uint64(2*fileCacheChunk + 90)
+	contents := t.read(t.bucket, t.object.Generation, start, start+1000)
+	ExpectTrue(bytes.Equal(t.contents[start:], contents))
+}
+
+func (t *FileCacheTest) NewGeneration() {
+	t.read(t.bucket, t.object.Generation, 0, 10)
+
+	o, err := gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	contents := t.read(t.bucket, o.Generation, 0, 10)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *FileCacheTest) NoGeneration() {
+	t.read(t.bucket, 0, 0, 10)
+	t.read(t.bucket, 0, 0, 10)
+
+	// Both reads went to the wrapped bucket, and nothing was cached.
+	ExpectEq(2, len(t.wrapped.starts(2)))
+	ExpectEq(0, t.cachedBytes())
+}
+
+func (t *FileCacheTest) ObjectDoesntExist() {
+	_, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       "bar",
+			Generation: 17,
+			Range:      &gcs.ByteRange{Start: 0, Limit: 10},
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(0, t.cachedBytes())
+}
+
+func (t *FileCacheTest) EvictsLeastRecentlyUsed() {
+	b, err := gcsx.NewFileCacheBucket(t.dir, fileCacheChunk+200, t.wrapped)
+	AssertEq(nil, err)
+
+	// The first chunk and the last, partial one fit together.
+	t.read(b, t.object.Generation, 0, 10)
+	t.read(b, t.object.Generation, 2*fileCacheChunk, 2*fileCacheChunk+10)
+	ExpectEq(fileCacheChunk+100, t.cachedBytes())
+
+	// The second pushes out the first, which was used least recently.
+	t.read(b, t.object.Generation, fileCacheChunk, fileCacheChunk+10)
+	ExpectEq(fileCacheChunk+100, t.cachedBytes())
+
+	// So reading the first again fetches it again.
+	t.read(b, t.object.Generation, 0, 10)
+	ExpectThat(
+		t.wrapped.starts(4),
+		ElementsAre(0, 0, fileCacheChunk, 2*fileCacheChunk))
+}
+
+func (t *FileCacheTest) SurvivesRestart() {
+	t.read(t.bucket, t.object.Generation, 0, 1<<40)
+	AssertEq(3, len(t.wrapped.starts(3)))
+
+	b, err := gcsx.NewFileCacheBucket(t.dir, 1<<30, t.wrapped)
+	AssertEq(nil, err)
+
+	contents := t.read(b, t.object.Generation, 0, 1<<40)
+	ExpectTrue(bytes.Equal(t.contents, contents))
+	ExpectEq(3, len(t.wrapped.starts(3)))
+}
+
+func (t *FileCacheTest) RemovesPartialChunksOnRestart() {
+	p := path.Join(t.dir, "tmp_12345")
+	err := ioutil.WriteFile(p, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	_, err = gcsx.NewFileCacheBucket(t.dir, 1<<30, t.wrapped)
+	AssertEq(nil, err)
+
+	_, err = os.Stat(p)
+	ExpectTrue(os.IsNotExist(err))
+}
+
+func (t *FileCacheTest) ShrinksOnRestart() {
+	t.read(t.bucket, t.object.Generation, 0, 1<<40)
+	AssertEq(len(t.contents), t.cachedBytes())
+
+	_, err := gcsx.NewFileCacheBucket(t.dir, fileCacheChunk, t.wrapped)
+	AssertEq(nil, err)
+	ExpectLe(t.cachedBytes(), fileCacheChunk)
+}
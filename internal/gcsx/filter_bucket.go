@@ -0,0 +1,337 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// FilteredError is returned by buckets created by NewFilterBucket for
+// requests that would create an object hidden by their patterns.
+type FilteredError struct {
+	Name string
+}
+
+func (e *FilteredError) Error() string {
+	return fmt.Sprintf("%q is excluded from the bucket", e.Name)
+}
+
+// NewFilterBucket creates a view on the wrapped bucket in which only the
+// objects whose names are matched by the include patterns, or all of them if
+// there are none, and aren't matched by any exclude pattern exist. Creating
+// objects that would be hidden fails with *FilteredError.
+//
+// Patterns use the syntax of path.Match, extended so that a "**" segment
+// matches any number of directories. A pattern containing a slash is matched
+// against the object's full name, from the start; otherwise against its base
+// name. A pattern matching a directory, named without its trailing slash,
+// matches everything within it, so "--exclude tmp" hides each directory named
+// "tmp". When there are include patterns, directories are visible if they
+// could contain a match.
+//
+// Objects whose names begin with any of the passthrough prefixes are exposed
+// as-is, so that temporary objects used by gcsfuse itself can be created in
+// the wrapped bucket.
+func NewFilterBucket(
+	include []string,
+	exclude []string,
+	passthrough []string,
+	wrapped gcs.Bucket) (b gcs.Bucket, err error) {
+	fb := &filterBucket{
+		Bucket:      wrapped,
+		passthrough: passthrough,
+	}
+
+	for _, p := range include {
+		var g glob
+		g, err = parseGlob(p)
+		if err != nil {
+			return
+		}
+
+		fb.include = append(fb.include, g)
+	}
+
+	for _, p := range exclude {
+		var g glob
+		g, err = parseGlob(p)
+		if err != nil {
+			return
+		}
+
+		fb.exclude = append(fb.exclude, g)
+	}
+
+	b = fb
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Patterns
+////////////////////////////////////////////////////////////////////////
+
+// A pattern split into segments. Patterns without slashes have a single
+// segment, which is matched against base names.
+type glob struct {
+	segments []string
+	anchored bool
+}
+
+func parseGlob(p string) (g glob, err error) {
+	trimmed := strings.Trim(p, "/")
+	if trimmed == "" {
+		err = fmt.Errorf("Empty pattern %q", p)
+		return
+	}
+
+	g.segments = strings.Split(trimmed, "/")
+	g.anchored = strings.Contains(p, "/")
+
+	for _, s := range g.segments {
+		if _, err = path.Match(s, ""); err != nil {
+			err = fmt.Errorf("Bad pattern %q: %v", p, err)
+			return
+		}
+	}
+
+	return
+}
+
+// Does the pattern match the file or directory with the given path segments,
+// or one of the directories containing it?
+func (g glob) matches(segments []string) bool {
+	if !g.anchored {
+		for _, s := range segments {
+			if ok, _ := path.Match(g.segments[0], s); ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return matchSegments(g.segments, segments, false)
+}
+
+// Could the pattern match something within the directory with the given path
+// segments?
+func (g glob) couldMatchWithin(segments []string) bool {
+	if !g.anchored {
+		return true
+	}
+
+	return matchSegments(g.segments, segments, true)
+}
+
+// Match pattern segments against name segments. If prefix is set, succeed if
+// the pattern could match a name beginning with the name segments. Otherwise
+// succeed if the pattern matches the name segments or any leading run of them.
+func matchSegments(pattern []string, name []string, prefix bool) bool {
+	if len(pattern) == 0 {
+		return !prefix || len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:], prefix) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(name) == 0 {
+		return prefix
+	}
+
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], name[1:], prefix)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket
+////////////////////////////////////////////////////////////////////////
+
+type filterBucket struct {
+	gcs.Bucket
+
+	include     []glob
+	exclude     []glob
+	passthrough []string
+}
+
+// Is the object with the given name visible?
+func (b *filterBucket) visible(name string) bool {
+	for _, p := range b.passthrough {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+
+	isDir := strings.HasSuffix(name, "/")
+	segments := strings.Split(strings.TrimSuffix(name, "/"), "/")
+
+	for _, g := range b.exclude {
+		if g.matches(segments) {
+			return false
+		}
+	}
+
+	if len(b.include) == 0 {
+		return true
+	}
+
+	for _, g := range b.include {
+		if g.matches(segments) || (isDir && g.couldMatchWithin(segments)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *filterBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if !b.visible(req.Name) {
+		err = objectNotFound(req.Name)
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *filterBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if !b.visible(req.Name) {
+		err = &FilteredError{Name: req.Name}
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *filterBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if !b.visible(req.SrcName) {
+		err = objectNotFound(req.SrcName)
+		return
+	}
+
+	if !b.visible(req.DstName) {
+		err = &FilteredError{Name: req.DstName}
+		return
+	}
+
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
+
+func (b *filterBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	for _, s := range req.Sources {
+		if !b.visible(s.Name) {
+			err = objectNotFound(s.Name)
+			return
+		}
+	}
+
+	if !b.visible(req.DstName) {
+		err = &FilteredError{Name: req.DstName}
+		return
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *filterBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if !b.visible(req.Name) {
+		err = objectNotFound(req.Name)
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *filterBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	filtered := &gcs.Listing{
+		ContinuationToken: l.ContinuationToken,
+	}
+
+	for _, o := range l.Objects {
+		if b.visible(o.Name) {
+			filtered.Objects = append(filtered.Objects, o)
+		}
+	}
+
+	for _, r := range l.CollapsedRuns {
+		if b.visible(r) {
+			filtered.CollapsedRuns = append(filtered.CollapsedRuns, r)
+		}
+	}
+
+	l = filtered
+	return
+}
+
+func (b *filterBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if !b.visible(req.Name) {
+		err = objectNotFound(req.Name)
+		return
+	}
+
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	return
+}
+
+func (b *filterBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if !b.visible(req.Name) {
+		err = objectNotFound(req.Name)
+		return
+	}
+
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
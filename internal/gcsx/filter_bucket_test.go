@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFilterBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FilterBucketTest struct {
+	ctx     context.Context
+	wrapped gcs.Bucket
+}
+
+var _ SetUpInterface = &FilterBucketTest{}
+
+func init() { RegisterTestSuite(&FilterBucketTest{}) }
+
+func (t *FilterBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+}
+
+func (t *FilterBucketTest) newBucket(include, exclude []string) gcs.Bucket {
+	b, err := gcsx.NewFilterBucket(include, exclude, []string{"tmp/"}, t.wrapped)
+	AssertEq(nil, err)
+	return b
+}
+
+func (t *FilterBucketTest) createWrapped(names ...string) {
+	for _, n := range names {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped, n, []byte("taco"))
+		AssertEq(nil, err)
+	}
+}
+
+// Return the names visible in the bucket, and the directories visible in the
+// listing of the given prefix.
+func (t *FilterBucketTest) list(
+	b gcs.Bucket,
+	prefix string) (names []string, runs []string) {
+	l, err := b.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: prefix, Delimiter: "/"})
+
+	AssertEq(nil, err)
+	AssertEq("", l.ContinuationToken)
+
+	for _, o := range l.Objects {
+		names = append(names, o.Name)
+	}
+
+	runs = l.CollapsedRuns
+	return
+}
+
+func (t *FilterBucketTest) exists(b gcs.Bucket, name string) bool {
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return false
+	}
+
+	AssertEq(nil, err)
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FilterBucketTest) BadPatterns() {
+	for _, p := range []string{"", "/", "[", "a/[/b"} {
+		_, err := gcsx.NewFilterBucket([]string{p}, nil, nil, t.wrapped)
+		ExpectNe(nil, err, "pattern: %q", p)
+
+		_, err = gcsx.NewFilterBucket(nil, []string{p}, nil, t.wrapped)
+		ExpectNe(nil, err, "pattern: %q", p)
+	}
+}
+
+func (t *FilterBucketTest) Exclude_BaseName() {
+	t.createWrapped("foo", "foo.tmp", "dir/bar.tmp", "dir/baz")
+	b := t.newBucket(nil, []string{"*.tmp"})
+
+	names, runs := t.list(b, "")
+	ExpectThat(names, ElementsAre("foo"))
+	ExpectThat(runs, ElementsAre("dir/"))
+
+	names, _ = t.list(b, "dir/")
+	ExpectThat(names, ElementsAre("dir/baz"))
+
+	ExpectTrue(t.exists(b, "foo"))
+	ExpectFalse(t.exists(b, "foo.tmp"))
+	ExpectFalse(t.exists(b, "dir/bar.tmp"))
+}
+
+func (t *FilterBucketTest) Exclude_Directory() {
+	t.createWrapped("foo", "logs/a", "logs/old/b", "x/logs/c")
+	b := t.newBucket(nil, []string{"logs/old", "x/**"})
+
+	_, runs := t.list(b, "")
+	ExpectThat(runs, ElementsAre("logs/"))
+
+	names, runs := t.list(b, "logs/")
+	ExpectThat(names, ElementsAre("logs/a"))
+	ExpectThat(runs, ElementsAre())
+
+	ExpectFalse(t.exists(b, "logs/old/b"))
+	ExpectFalse(t.exists(b, "x/logs/c"))
+}
+
+func (t *FilterBucketTest) Include() {
+	t.createWrapped(
+		"data/a.parquet",
+		"data/2015/04/b.parquet",
+		"data/2015/04/b.csv",
+		"other/c.parquet",
+		"top.parquet")
+
+	b := t.newBucket([]string{"data/**/*.parquet"}, nil)
+
+	names, runs := t.list(b, "")
+	ExpectThat(names, ElementsAre())
+	ExpectThat(runs, ElementsAre("data/"))
+
+	names, runs = t.list(b, "data/")
+	ExpectThat(names, ElementsAre("data/a.parquet"))
+	ExpectThat(runs, ElementsAre("data/2015/"))
+
+	names, _ = t.list(b, "data/2015/04/")
+	ExpectThat(names, ElementsAre("data/2015/04/b.parquet"))
+
+	ExpectFalse(t.exists(b, "other/c.parquet"))
+	ExpectFalse(t.exists(b, "top.parquet"))
+}
+
+func (t *FilterBucketTest) IncludeAndExclude() {
+	t.createWrapped("a.csv", "b.csv", "c.txt")
+	b := t.newBucket([]string{"*.csv"}, []string{"b.*"})
+
+	names, _ := t.list(b, "")
+	ExpectThat(names, ElementsAre("a.csv"))
+}
+
+func (t *FilterBucketTest) CreateHidden() {
+	b := t.newBucket([]string{"data/**"}, []string{"*.tmp"})
+
+	_, err := gcsutil.CreateObject(t.ctx, b, "data/foo", []byte("taco"))
+	ExpectEq(nil, err)
+
+	for _, n := range []string{"data/foo.tmp", "junk", "junk/"} {
+		_, err = gcsutil.CreateObject(t.ctx, b, n, []byte("taco"))
+		ExpectThat(err, HasSameTypeAs(&gcsx.FilteredError{}), "name: %q", n)
+	}
+
+	// Nor may hidden objects be copied into place.
+	_, err = b.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: "data/foo", DstName: "data/bar.tmp"})
+
+	ExpectThat(err, HasSameTypeAs(&gcsx.FilteredError{}))
+
+	// Directories that could hold matches may be created.
+	_, err = gcsutil.CreateObject(t.ctx, b, "data/dir/", nil)
+	ExpectEq(nil, err)
+}
+
+func (t *FilterBucketTest) HiddenObjectsUntouched() {
+	t.createWrapped("foo.tmp")
+	b := t.newBucket(nil, []string{"*.tmp"})
+
+	err := b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo.tmp"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = gcsutil.ReadObject(t.ctx, b, "foo.tmp")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	ExpectTrue(t.exists(t.wrapped, "foo.tmp"))
+}
+
+func (t *FilterBucketTest) Passthrough() {
+	b := t.newBucket([]string{"*.csv"}, []string{"*.tmp"})
+
+	_, err := gcsutil.CreateObject(t.ctx, b, "tmp/foo.tmp", []byte("taco"))
+	AssertEq(nil, err)
+
+	ExpectTrue(t.exists(b, "tmp/foo.tmp"))
+}
@@ -0,0 +1,447 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// How often to check whether a folder rename has finished, at first and at
+// most.
+const (
+	folderRenameInitialPoll = 100 * time.Millisecond
+	folderRenameMaxPoll     = 5 * time.Second
+)
+
+// Folder describes a folder in a bucket with a hierarchical namespace.
+type Folder struct {
+	// The name of the folder, ending in a slash.
+	Name string
+
+	MetaGeneration int64
+	Created        time.Time
+	Updated        time.Time
+}
+
+// Folders manages the folders of a bucket with a hierarchical namespace,
+// which are resources of their own rather than objects. The GCS client we
+// use has no support for them.
+//
+// Methods fail with *gcs.NotFoundError if a folder they act on doesn't exist,
+// and with *gcs.PreconditionError if one they would create already does or
+// one they would delete isn't empty.
+type Folders interface {
+	GetFolder(ctx context.Context, name string) (f *Folder, err error)
+
+	// Create the named folder, and any missing parents.
+	CreateFolder(ctx context.Context, name string) (f *Folder, err error)
+
+	DeleteFolder(ctx context.Context, name string) (err error)
+
+	// Atomically move a folder and everything in it to a new name, returning
+	// once the move has finished.
+	RenameFolder(ctx context.Context, src string, dst string) (err error)
+
+	// List the names of the folders directly within the given one, or at the
+	// top of the bucket if it is empty.
+	ListFolders(ctx context.Context, parent string) (names []string, err error)
+}
+
+// IsHierarchical reports whether the named bucket has a hierarchical
+// namespace, sending the request using the supplied client, which must add
+// credentials.
+func IsHierarchical(
+	ctx context.Context,
+	client *http.Client,
+	bucketName string,
+	userAgent string) (hns bool, err error) {
+	f := &httpFolders{
+		client:     client,
+		bucketName: bucketName,
+		userAgent:  userAgent,
+	}
+
+	var layout struct {
+		HierarchicalNamespace struct {
+			Enabled bool `json:"enabled"`
+		} `json:"hierarchicalNamespace"`
+	}
+
+	err = f.do(ctx, "GET", "storageLayout", nil, nil, &layout)
+	if err != nil {
+		return
+	}
+
+	hns = layout.HierarchicalNamespace.Enabled
+	return
+}
+
+// NewFolders returns Folders for the named bucket that sends requests using
+// the supplied client, which must add credentials. Folder names are relative
+// to prefix, which must be empty or end in a slash.
+func NewFolders(
+	client *http.Client,
+	bucketName string,
+	prefix string,
+	userAgent string) Folders {
+	return &httpFolders{
+		client:     client,
+		bucketName: bucketName,
+		prefix:     prefix,
+		userAgent:  userAgent,
+	}
+}
+
+type httpFolders struct {
+	client     *http.Client
+	bucketName string
+	prefix     string
+	userAgent  string
+}
+
+// The JSON representation of a folder.
+type folderResource struct {
+	Name           string `json:"name"`
+	MetaGeneration string `json:"metageneration"`
+	CreateTime     string `json:"createTime"`
+	UpdateTime     string `json:"updateTime"`
+}
+
+// The JSON representation of a long-running operation.
+type operationResource struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Send a request for the given path relative to the bucket's resource,
+// encoding body (if non-nil) as its JSON content and decoding the response
+// into result (if non-nil).
+func (f *httpFolders) do(
+	ctx context.Context,
+	method string,
+	relPath string,
+	query url.Values,
+	body interface{},
+	result interface{}) (err error) {
+	err = sendBucketRequest(
+		ctx,
+		f.client,
+		f.bucketName,
+		f.userAgent,
+		method,
+		relPath,
+		query,
+		body,
+		result)
+
+	return
+}
+
+// Send a request for the given path relative to the named bucket's resource
+// in the JSON API, as for requests the GCS client we use can't make. The body
+// (if non-nil) is encoded as JSON, and the response decoded into result (if
+// non-nil). Not found and precondition failures are reported as the
+// corresponding gcs errors.
+func sendBucketRequest(
+	ctx context.Context,
+	client *http.Client,
+	bucketName string,
+	userAgent string,
+	method string,
+	relPath string,
+	query url.Values,
+	body interface{},
+	result interface{}) (err error) {
+	err = sendRequest(
+		ctx,
+		client,
+		userAgent,
+		method,
+		fmt.Sprintf("b/%s/%s", httputil.EncodePathSegment(bucketName), relPath),
+		query,
+		body,
+		result)
+
+	return
+}
+
+// Like sendBucketRequest, but for a path relative to the root of the JSON
+// API, which must already be escaped.
+func sendRequest(
+	ctx context.Context,
+	client *http.Client,
+	userAgent string,
+	method string,
+	relPath string,
+	query url.Values,
+	body interface{},
+	result interface{}) (err error) {
+	opaque := "//www.googleapis.com/storage/v1/" + relPath
+
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     "www.googleapis.com",
+		Opaque:   opaque,
+		RawQuery: query.Encode(),
+	}
+
+	var encoded []byte
+	if body != nil {
+		encoded, err = json.Marshal(body)
+		if err != nil {
+			err = fmt.Errorf("Marshal: %v", err)
+			return
+		}
+	}
+
+	httpReq, err := httputil.NewRequest(
+		ctx,
+		method,
+		u,
+		ioutil.NopCloser(bytes.NewReader(encoded)),
+		int64(len(encoded)),
+		userAgent)
+
+	if err != nil {
+		err = fmt.Errorf("httputil.NewRequest: %v", err)
+		return
+	}
+
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		return
+	}
+
+	defer googleapi.CloseBody(httpRes)
+
+	if err = googleapi.CheckResponse(httpRes); err != nil {
+		if typed, ok := err.(*googleapi.Error); ok {
+			switch typed.Code {
+			case http.StatusNotFound:
+				err = &gcs.NotFoundError{Err: typed}
+
+			case http.StatusConflict, http.StatusPreconditionFailed:
+				err = &gcs.PreconditionError{Err: typed}
+			}
+		}
+
+		return
+	}
+
+	if result == nil {
+		return
+	}
+
+	err = json.NewDecoder(httpRes.Body).Decode(result)
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Decoding response: %v", err)
+		return
+	}
+
+	return
+}
+
+// The path of the named folder relative to the bucket's resource.
+func (f *httpFolders) folderPath(name string) string {
+	return "folders/" + httputil.EncodePathSegment(f.prefix+name)
+}
+
+// Convert a folder resource to a Folder with a name relative to the prefix.
+func (f *httpFolders) toFolder(r *folderResource) (folder *Folder, err error) {
+	folder = &Folder{
+		Name: strings.TrimPrefix(r.Name, f.prefix),
+	}
+
+	folder.MetaGeneration, err = strconv.ParseInt(r.MetaGeneration, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("Parsing metageneration %q: %v", r.MetaGeneration, err)
+		return
+	}
+
+	folder.Created, err = time.Parse(time.RFC3339Nano, r.CreateTime)
+	if err != nil {
+		err = fmt.Errorf("Parsing createTime %q: %v", r.CreateTime, err)
+		return
+	}
+
+	folder.Updated, err = time.Parse(time.RFC3339Nano, r.UpdateTime)
+	if err != nil {
+		err = fmt.Errorf("Parsing updateTime %q: %v", r.UpdateTime, err)
+		return
+	}
+
+	return
+}
+
+func (f *httpFolders) GetFolder(
+	ctx context.Context,
+	name string) (folder *Folder, err error) {
+	var r folderResource
+	err = f.do(ctx, "GET", f.folderPath(name), nil, nil, &r)
+	if err != nil {
+		return
+	}
+
+	folder, err = f.toFolder(&r)
+	return
+}
+
+func (f *httpFolders) CreateFolder(
+	ctx context.Context,
+	name string) (folder *Folder, err error) {
+	query := make(url.Values)
+	query.Set("recursive", "true")
+
+	var r folderResource
+	err = f.do(
+		ctx,
+		"POST",
+		"folders",
+		query,
+		map[string]string{"name": f.prefix + name},
+		&r)
+
+	if err != nil {
+		return
+	}
+
+	folder, err = f.toFolder(&r)
+	return
+}
+
+func (f *httpFolders) DeleteFolder(
+	ctx context.Context,
+	name string) (err error) {
+	err = f.do(ctx, "DELETE", f.folderPath(name), nil, nil, nil)
+	return
+}
+
+func (f *httpFolders) RenameFolder(
+	ctx context.Context,
+	src string,
+	dst string) (err error) {
+	var op operationResource
+	err = f.do(
+		ctx,
+		"POST",
+		f.folderPath(src)+"/renameTo/"+f.folderPath(dst),
+		nil,
+		nil,
+		&op)
+
+	if err != nil {
+		return
+	}
+
+	// The rename happens in the background. Wait for it to finish.
+	delay := folderRenameInitialPoll
+	for !op.Done {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+
+		if delay *= 2; delay > folderRenameMaxPoll {
+			delay = folderRenameMaxPoll
+		}
+
+		err = f.do(
+			ctx,
+			"GET",
+			"operations/"+httputil.EncodePathSegment(path.Base(op.Name)),
+			nil,
+			nil,
+			&op)
+
+		if err != nil {
+			err = fmt.Errorf("Checking on rename: %v", err)
+			return
+		}
+	}
+
+	if op.Error != nil {
+		err = fmt.Errorf(
+			"Renaming %q to %q: %s (%d)",
+			src,
+			dst,
+			op.Error.Message,
+			op.Error.Code)
+		return
+	}
+
+	return
+}
+
+func (f *httpFolders) ListFolders(
+	ctx context.Context,
+	parent string) (names []string, err error) {
+	query := make(url.Values)
+	query.Set("prefix", f.prefix+parent)
+	query.Set("delimiter", "/")
+
+	for {
+		var page struct {
+			Items         []folderResource `json:"items"`
+			NextPageToken string           `json:"nextPageToken"`
+		}
+
+		err = f.do(ctx, "GET", "folders", query, nil, &page)
+		if err != nil {
+			return
+		}
+
+		for _, r := range page.Items {
+			name := strings.TrimPrefix(r.Name, f.prefix)
+			if name != parent {
+				names = append(names, name)
+			}
+		}
+
+		if page.NextPageToken == "" {
+			return
+		}
+
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
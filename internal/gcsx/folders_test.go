@@ -0,0 +1,353 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFolders(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A request received by the test server.
+type folderRequest struct {
+	method string
+	path   string
+	query  url.Values
+	body   string
+}
+
+type FoldersTest struct {
+	ctx    context.Context
+	server *httptest.Server
+	client *http.Client
+
+	// The responses to send, in order, as status codes and bodies. A missing
+	// response is a 500.
+	statuses  []int
+	responses []string
+
+	// The requests received so far.
+	requests []folderRequest
+
+	folders gcsx.Folders
+}
+
+var _ SetUpInterface = &FoldersTest{}
+var _ TearDownInterface = &FoldersTest{}
+
+func init() { RegisterTestSuite(&FoldersTest{}) }
+
+func (t *FoldersTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.server = httptest.NewServer(http.HandlerFunc(t.serve))
+
+	endpoint, err := url.Parse(t.server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+
+	t.client = &http.Client{Transport: transport}
+	t.folders = gcsx.NewFolders(t.client, "some_bucket", "pre/", "gcsfuse/0.0")
+}
+
+func (t *FoldersTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *FoldersTest) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	t.requests = append(t.requests, folderRequest{
+		method: r.Method,
+		path:   r.URL.EscapedPath(),
+		query:  r.URL.Query(),
+		body:   string(body),
+	})
+
+	i := len(t.requests) - 1
+	if i >= len(t.responses) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(t.statuses[i])
+	w.Write([]byte(t.responses[i]))
+}
+
+// Arrange for the next request to be answered with the given status and body.
+func (t *FoldersTest) respond(status int, body string) {
+	t.statuses = append(t.statuses, status)
+	t.responses = append(t.responses, body)
+}
+
+const folderJSON = `{
+	"name": "pre/foo/bar/",
+	"metageneration": "3",
+	"createTime": "2015-04-05T02:15:00.5Z",
+	"updateTime": "2015-04-06T02:15:00Z"
+}`
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FoldersTest) IsHierarchical() {
+	t.respond(http.StatusOK, `{"hierarchicalNamespace": {"enabled": true}}`)
+	t.respond(http.StatusOK, `{"location": "US"}`)
+
+	hns, err := gcsx.IsHierarchical(t.ctx, t.client, "some_bucket", "gcsfuse/0.0")
+	AssertEq(nil, err)
+	ExpectTrue(hns)
+
+	hns, err = gcsx.IsHierarchical(t.ctx, t.client, "some_bucket", "gcsfuse/0.0")
+	AssertEq(nil, err)
+	ExpectFalse(hns)
+
+	AssertEq(2, len(t.requests))
+	ExpectEq("GET", t.requests[0].method)
+	ExpectEq("/storage/v1/b/some_bucket/storageLayout", t.requests[0].path)
+}
+
+func (t *FoldersTest) GetFolder() {
+	t.respond(http.StatusOK, folderJSON)
+
+	f, err := t.folders.GetFolder(t.ctx, "foo/bar/")
+	AssertEq(nil, err)
+
+	AssertEq(1, len(t.requests))
+	ExpectEq("GET", t.requests[0].method)
+	ExpectEq(
+		"/storage/v1/b/some_bucket/folders/pre%2Ffoo%2Fbar%2F",
+		t.requests[0].path)
+
+	ExpectEq("foo/bar/", f.Name)
+	ExpectEq(3, f.MetaGeneration)
+	ExpectThat(
+		f.Created,
+		DeepEquals(time.Date(2015, 4, 5, 2, 15, 0, 5e8, time.UTC)))
+	ExpectThat(
+		f.Updated,
+		DeepEquals(time.Date(2015, 4, 6, 2, 15, 0, 0, time.UTC)))
+}
+
+func (t *FoldersTest) GetFolder_NotFound() {
+	t.respond(http.StatusNotFound, `{"error": {"code": 404}}`)
+
+	_, err := t.folders.GetFolder(t.ctx, "foo/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FoldersTest) CreateFolder() {
+	t.respond(http.StatusOK, folderJSON)
+
+	f, err := t.folders.CreateFolder(t.ctx, "foo/bar/")
+	AssertEq(nil, err)
+	ExpectEq("foo/bar/", f.Name)
+
+	AssertEq(1, len(t.requests))
+	ExpectEq("POST", t.requests[0].method)
+	ExpectEq("/storage/v1/b/some_bucket/folders", t.requests[0].path)
+	ExpectEq("true", t.requests[0].query.Get("recursive"))
+	ExpectEq(`{"name":"pre/foo/bar/"}`, t.requests[0].body)
+}
+
+func (t *FoldersTest) CreateFolder_AlreadyExists() {
+	t.respond(http.StatusConflict, `{"error": {"code": 409}}`)
+
+	_, err := t.folders.CreateFolder(t.ctx, "foo/")
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *FoldersTest) DeleteFolder() {
+	t.respond(http.StatusNoContent, "")
+
+	err := t.folders.DeleteFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+
+	AssertEq(1, len(t.requests))
+	ExpectEq("DELETE", t.requests[0].method)
+	ExpectEq("/storage/v1/b/some_bucket/folders/pre%2Ffoo%2F", t.requests[0].path)
+}
+
+func (t *FoldersTest) DeleteFolder_NotEmpty() {
+	t.respond(http.StatusPreconditionFailed, `{"error": {"code": 412}}`)
+
+	err := t.folders.DeleteFolder(t.ctx, "foo/")
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *FoldersTest) RenameFolder_WaitsForOperation() {
+	t.respond(
+		http.StatusOK,
+		`{"name": "projects/_/buckets/some_bucket/operations/17"}`)
+	t.respond(
+		http.StatusOK,
+		`{"name": "projects/_/buckets/some_bucket/operations/17"}`)
+	t.respond(
+		http.StatusOK,
+		`{"name": "projects/_/buckets/some_bucket/operations/17", "done": true}`)
+
+	err := t.folders.RenameFolder(t.ctx, "foo/", "bar/baz/")
+	AssertEq(nil, err)
+
+	AssertEq(3, len(t.requests))
+	ExpectEq("POST", t.requests[0].method)
+	ExpectEq(
+		"/storage/v1/b/some_bucket/folders/pre%2Ffoo%2F/renameTo/folders/pre%2Fbar%2Fbaz%2F",
+		t.requests[0].path)
+
+	for _, r := range t.requests[1:] {
+		ExpectEq("GET", r.method)
+		ExpectEq("/storage/v1/b/some_bucket/operations/17", r.path)
+	}
+}
+
+func (t *FoldersTest) RenameFolder_OperationFails() {
+	t.respond(
+		http.StatusOK,
+		`{"name": "operations/17", "done": true, "error": {"code": 9, "message": "taco"}}`)
+
+	err := t.folders.RenameFolder(t.ctx, "foo/", "bar/")
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
+
+func (t *FoldersTest) ListFolders() {
+	t.respond(
+		http.StatusOK,
+		`{"items": [{"name": "pre/foo/"}, {"name": "pre/foo/bar/"}], "nextPageToken": "tok"}`)
+	t.respond(
+		http.StatusOK,
+		`{"items": [{"name": "pre/foo/baz/"}]}`)
+
+	names, err := t.folders.ListFolders(t.ctx, "foo/")
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("foo/bar/", "foo/baz/"))
+
+	AssertEq(2, len(t.requests))
+	for _, r := range t.requests {
+		ExpectEq("GET", r.method)
+		ExpectEq("/storage/v1/b/some_bucket/folders", r.path)
+		ExpectEq("pre/foo/", r.query.Get("prefix"))
+		ExpectEq("/", r.query.Get("delimiter"))
+	}
+
+	ExpectEq("", t.requests[0].query.Get("pageToken"))
+	ExpectEq("tok", t.requests[1].query.Get("pageToken"))
+}
+
+func (t *FoldersTest) HasManagedFolders() {
+	t.respond(http.StatusOK, `{"items": [{"name": "pre/foo/"}]}`)
+	t.respond(http.StatusOK, `{}`)
+
+	has, err := gcsx.HasManagedFolders(
+		t.ctx,
+		t.client,
+		"some_bucket",
+		"pre/",
+		"gcsfuse/0.0")
+
+	AssertEq(nil, err)
+	ExpectTrue(has)
+
+	has, err = gcsx.HasManagedFolders(
+		t.ctx,
+		t.client,
+		"some_bucket",
+		"",
+		"gcsfuse/0.0")
+
+	AssertEq(nil, err)
+	ExpectFalse(has)
+
+	AssertEq(2, len(t.requests))
+	ExpectEq("/storage/v1/b/some_bucket/managedFolders", t.requests[0].path)
+	ExpectEq("pre/", t.requests[0].query.Get("prefix"))
+	ExpectEq("1", t.requests[0].query.Get("pageSize"))
+}
+
+func (t *FoldersTest) FindManagedFolder() {
+	t.respond(http.StatusOK, `{"items": [`+folderJSON+`]}`)
+	t.respond(http.StatusOK, `{}`)
+
+	managed := gcsx.NewManagedFolders(
+		t.client,
+		"some_bucket",
+		"pre/",
+		"gcsfuse/0.0")
+
+	f, err := managed.FindManagedFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+	ExpectEq("foo/bar/", f.Name)
+	ExpectEq(3, f.MetaGeneration)
+
+	_, err = managed.FindManagedFolder(t.ctx, "baz/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	AssertEq(2, len(t.requests))
+	ExpectEq("GET", t.requests[0].method)
+	ExpectEq("/storage/v1/b/some_bucket/managedFolders", t.requests[0].path)
+	ExpectEq("pre/foo/", t.requests[0].query.Get("prefix"))
+	ExpectEq("1", t.requests[0].query.Get("pageSize"))
+}
+
+func (t *FoldersTest) ListManagedFolders() {
+	t.respond(
+		http.StatusOK,
+		`{"items": [{"name": "pre/foo/"}, {"name": "pre/foo/bar/"}], "nextPageToken": "tok"}`)
+	t.respond(
+		http.StatusOK,
+		`{"items": [{"name": "pre/foo/bar/baz/"}, {"name": "pre/foo/qux/taco/"}]}`)
+
+	managed := gcsx.NewManagedFolders(
+		t.client,
+		"some_bucket",
+		"pre/",
+		"gcsfuse/0.0")
+
+	names, err := managed.ListManagedFolders(t.ctx, "foo/")
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("foo/bar/", "foo/qux/"))
+
+	AssertEq(2, len(t.requests))
+	for _, r := range t.requests {
+		ExpectEq("GET", r.method)
+		ExpectEq("/storage/v1/b/some_bucket/managedFolders", r.path)
+		ExpectEq("pre/foo/", r.query.Get("prefix"))
+		ExpectEq("", r.query.Get("delimiter"))
+	}
+
+	ExpectEq("", t.requests[0].query.Get("pageToken"))
+	ExpectEq("tok", t.requests[1].query.Get("pageToken"))
+}
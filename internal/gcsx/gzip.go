@@ -0,0 +1,545 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+// Ways of presenting objects stored with Content-Encoding: gzip: as the bytes
+// stored, with the size stored, or decompressed, with the size of their
+// contents once decompressed.
+const (
+	GzipObjectsRaw        = "raw"
+	GzipObjectsDecompress = "decompress"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Stored bytes
+////////////////////////////////////////////////////////////////////////
+
+// NewStoredBytesRoundTripper returns a round tripper that asks for the bytes
+// stored in GCS when downloading object contents, so that they match the size
+// recorded for the object and ranges within them can be read.
+//
+// Without this, GCS decompresses objects stored with Content-Encoding: gzip
+// for clients that don't say they accept gzip, ignoring any range asked for,
+// while the HTTP client asks for gzip and decompresses it itself when no range
+// is asked for. Either way the contents don't match the size.
+//
+// GCS may compress other objects when gzip is accepted. Those responses are
+// decompressed here, leaving their stored bytes. Other requests are passed
+// through unmodified.
+func NewStoredBytesRoundTripper(
+	wrapped httputil.CancellableRoundTripper) httputil.CancellableRoundTripper {
+	return &storedBytesRoundTripper{
+		rewritingRoundTripper: newRewritingRoundTripper(nil, wrapped),
+	}
+}
+
+type storedBytesRoundTripper struct {
+	*rewritingRoundTripper
+}
+
+func (rt *storedBytesRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	// Downloads of object contents ask for alt=media.
+	if req.Method != "GET" ||
+		req.URL.Query().Get("alt") != "media" ||
+		req.Header.Get("Accept-Encoding") != "" {
+		resp, err = rt.wrapped.RoundTrip(req)
+		return
+	}
+
+	modified := copyRequest(req)
+	modified.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err = rt.send(req, modified)
+	if err != nil {
+		return
+	}
+
+	// Undo any compression that isn't how the object is stored.
+	if resp.Header.Get("Content-Encoding") == "gzip" &&
+		resp.Header.Get("X-Goog-Stored-Content-Encoding") != "" &&
+		resp.Header.Get("X-Goog-Stored-Content-Encoding") != "gzip" {
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			resp = nil
+			err = fmt.Errorf("gzip.NewReader: %v", err)
+			return
+		}
+
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{gz, resp.Body}
+
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Decompressing
+////////////////////////////////////////////////////////////////////////
+
+// Return a reader for the supplied range of the decompressed contents of the
+// gzipped object named by req, which must be read from the start. If the
+// stored bytes turn out not to be gzipped, the range of them is read instead.
+func newGunzipReader(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	var start uint64
+	var limit uint64 = math.MaxUint64
+	if req.Range != nil {
+		start, limit = req.Range.Start, req.Range.Limit
+	}
+
+	// Read the stored bytes from the start. Asking for a range prevents both GCS
+	// and the HTTP client from decompressing them for us.
+	raw, err := bucket.NewReader(ctx, &gcs.ReadObjectRequest{
+		Name:       req.Name,
+		Generation: req.Generation,
+		Range:      &gcs.ByteRange{Start: 0, Limit: math.MaxUint64},
+	})
+
+	if err != nil {
+		return
+	}
+
+	// Look for the gzip header, in case the object isn't gzipped after all.
+	br := bufio.NewReader(raw)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		// If the caller wanted to start at the beginning anyway, we can carry on.
+		// Otherwise it's cheaper to start over.
+		if start != 0 {
+			raw.Close()
+			rc, err = bucket.NewReader(ctx, req)
+			return
+		}
+
+		rc = struct {
+			io.Reader
+			io.Closer
+		}{limitReader(br, limit), raw}
+
+		return
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		raw.Close()
+		err = fmt.Errorf("gzip.NewReader: %v", err)
+		return
+	}
+
+	// Skip to the start of the range.
+	_, err = io.CopyN(ioutil.Discard, gz, int64(start))
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		raw.Close()
+		err = fmt.Errorf("Skipping to offset %d: %v", start, err)
+		return
+	}
+
+	n := uint64(0)
+	if limit > start {
+		n = limit - start
+	}
+
+	rc = struct {
+		io.Reader
+		io.Closer
+	}{limitReader(gz, n), raw}
+
+	return
+}
+
+// The number of objects whose decompressed sizes are remembered by a
+// decompressing bucket.
+const gunzipSizeCacheCapacity = 1 << 16
+
+// The number of gzip trailers read at once when listing.
+const gunzipListParallelism = 8
+
+// The smallest possible gzip stream: a ten-byte header, an empty deflate
+// block, and an eight-byte trailer.
+const minGzipSize = 20
+
+// NewDecompressingBucket creates a bucket that presents objects stored with
+// Content-Encoding: gzip decompressed. Their records report the size of their
+// decompressed contents, which is read from the last four bytes of the stored
+// bytes unless gcsfuse recorded it when compressing the object. The sizes of
+// objects whose decompressed contents are 4 GiB or more, or that consist of
+// several gzip streams, are unknown, and so are wrong.
+//
+// Reading from an offset within such an object requires decompressing
+// everything before it. Composing into one is done by rewriting the result in
+// full, uncompressed. Objects created through the bucket aren't compressed.
+func NewDecompressingBucket(wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &decompressingBucket{
+		Bucket: wrapped,
+		sizes:  lrucache.New(gunzipSizeCacheCapacity),
+	}
+
+	return
+}
+
+type decompressingBucket struct {
+	gcs.Bucket
+
+	mu sync.Mutex
+
+	// The decompressed sizes of recently seen generations of objects, keyed by
+	// gunzipSizeKey, or -1 for those presented as stored.
+	//
+	// GUARDED_BY(mu)
+	sizes lrucache.Cache
+}
+
+func gunzipSizeKey(name string, generation int64) string {
+	return name + "\x00" + strconv.FormatInt(generation, 10)
+}
+
+// Return the decompressed size of the supplied generation of the named object,
+// or -1 if it is presented as stored, and whether it is known.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *decompressingBucket) lookUpSize(
+	name string,
+	generation int64) (size int64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v := b.sizes.LookUp(gunzipSizeKey(name, generation))
+	if v == nil {
+		return
+	}
+
+	size, ok = v.(int64), true
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *decompressingBucket) recordSize(o *gcs.Object, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sizes.Insert(gunzipSizeKey(o.Name, o.Generation), size)
+}
+
+// Return the decompressed size of the supplied gzipped object, or -1 if it
+// should be presented as stored.
+func (b *decompressingBucket) decompressedSize(
+	ctx context.Context,
+	o *gcs.Object) (size int64, err error) {
+	if s, ok := o.Metadata[uncompressedSizeMetadataKey]; ok {
+		size, err = strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			return
+		}
+	}
+
+	if o.Size < minGzipSize {
+		size = -1
+		err = nil
+		return
+	}
+
+	// The trailer ends with the size of the contents, modulo 2^32.
+	rc, err := b.Bucket.NewReader(ctx, &gcs.ReadObjectRequest{
+		Name:       o.Name,
+		Generation: o.Generation,
+		Range:      &gcs.ByteRange{Start: o.Size - 4, Limit: o.Size},
+	})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	var trailer [4]byte
+	_, err = io.ReadFull(rc, trailer[:])
+	if err != nil {
+		err = fmt.Errorf("Reading gzip trailer: %v", err)
+		return
+	}
+
+	size = int64(binary.LittleEndian.Uint32(trailer[:]))
+	return
+}
+
+// Return the supplied object record, or a copy reporting the decompressed size
+// if it is gzipped, remembering which.
+func (b *decompressingBucket) translate(
+	ctx context.Context,
+	o *gcs.Object) (translated *gcs.Object, err error) {
+	translated = o
+	if o == nil {
+		return
+	}
+
+	if size, ok := b.lookUpSize(o.Name, o.Generation); ok {
+		if size >= 0 {
+			copied := *o
+			copied.Size = uint64(size)
+			translated = &copied
+		}
+
+		return
+	}
+
+	size := int64(-1)
+	if o.ContentEncoding == "gzip" {
+		size, err = b.decompressedSize(ctx, o)
+		if err != nil {
+			err = fmt.Errorf("Finding decompressed size of %q: %v", o.Name, err)
+			return
+		}
+	}
+
+	b.recordSize(o, size)
+	if size >= 0 {
+		copied := *o
+		copied.Size = uint64(size)
+		translated = &copied
+	}
+
+	return
+}
+
+// Is the given generation of the named object presented decompressed? Zero
+// means the latest generation.
+func (b *decompressingBucket) decompresses(
+	ctx context.Context,
+	name string,
+	generation int64) (decompress bool, err error) {
+	size, ok := b.lookUpSize(name, generation)
+	if !ok {
+		// We haven't seen it recently, so find out.
+		var o *gcs.Object
+		o, err = b.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+		if err != nil {
+			err = fmt.Errorf("StatObject: %v", err)
+			return
+		}
+
+		if generation != 0 && o.Generation != generation {
+			return
+		}
+
+		size, _ = b.lookUpSize(name, o.Generation)
+	}
+
+	decompress = size >= 0
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *decompressingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	decompress, err := b.decompresses(ctx, req.Name, req.Generation)
+	if err != nil {
+		return
+	}
+
+	if !decompress {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	rc, err = newGunzipReader(ctx, b.Bucket, req)
+	return
+}
+
+func (b *decompressingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	o, err = b.translate(ctx, o)
+	return
+}
+
+func (b *decompressingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CopyObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	o, err = b.translate(ctx, o)
+	return
+}
+
+func (b *decompressingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	// GCS would concatenate the stored bytes, so if any of the sources is
+	// presented decompressed, read them and write out the result ourselves.
+	rewrite := false
+	for _, src := range req.Sources {
+		var decompress bool
+		decompress, err = b.decompresses(ctx, src.Name, src.Generation)
+		if err != nil {
+			return
+		}
+
+		rewrite = rewrite || decompress
+	}
+
+	if !rewrite {
+		o, err = b.Bucket.ComposeObjects(ctx, req)
+		if err != nil {
+			return
+		}
+
+		o, err = b.translate(ctx, o)
+		return
+	}
+
+	var readers []io.Reader
+	for _, src := range req.Sources {
+		var rc io.ReadCloser
+		rc, err = b.NewReader(ctx, &gcs.ReadObjectRequest{
+			Name:       src.Name,
+			Generation: src.Generation,
+		})
+
+		if err != nil {
+			err = fmt.Errorf("NewReader(%q): %v", src.Name, err)
+			return
+		}
+
+		defer rc.Close()
+		readers = append(readers, rc)
+	}
+
+	o, err = b.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:                       req.DstName,
+		ContentType:                req.ContentType,
+		Metadata:                   req.Metadata,
+		Contents:                   io.MultiReader(readers...),
+		GenerationPrecondition:     req.DstGenerationPrecondition,
+		MetaGenerationPrecondition: req.DstMetaGenerationPrecondition,
+	})
+
+	return
+}
+
+func (b *decompressingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	o, err = b.translate(ctx, o)
+	return
+}
+
+func (b *decompressingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// Don't modify the listing in place, since it may be shared with a cache.
+	// Finding the sizes of gzipped objects takes a request each, so make
+	// several at once.
+	translated := *listing
+	translated.Objects = make([]*gcs.Object, len(listing.Objects))
+	errs := make([]error, len(listing.Objects))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, gunzipListParallelism)
+	for i, o := range listing.Objects {
+		if o.ContentEncoding != "gzip" {
+			translated.Objects[i], errs[i] = b.translate(ctx, o)
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, o *gcs.Object) {
+			defer func() { <-sem; wg.Done() }()
+			translated.Objects[i], errs[i] = b.translate(ctx, o)
+		}(i, o)
+	}
+
+	wg.Wait()
+
+	for _, e := range errs {
+		if e != nil {
+			err = e
+			listing = nil
+			return
+		}
+	}
+
+	listing = &translated
+	return
+}
+
+func (b *decompressingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	o, err = b.translate(ctx, o)
+	return
+}
@@ -0,0 +1,293 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestGzip(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func gzipBytes(contents string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(contents))
+	gz.Close()
+	return buf.Bytes()
+}
+
+// A round tripper that responds to every request with the given headers and
+// body.
+type fixedRoundTripper struct {
+	header http.Header
+	body   []byte
+}
+
+func (rt *fixedRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     rt.header,
+		Body:       ioutil.NopCloser(bytes.NewReader(rt.body)),
+		Request:    req,
+	}
+
+	return
+}
+
+func (rt *fixedRoundTripper) CancelRequest(req *http.Request) {
+}
+
+////////////////////////////////////////////////////////////////////////
+// Stored bytes
+////////////////////////////////////////////////////////////////////////
+
+type StoredBytesTest struct {
+	wrapped capturingRoundTripper
+}
+
+func init() { RegisterTestSuite(&StoredBytesTest{}) }
+
+func (t *StoredBytesTest) send(
+	method string,
+	rawQuery string,
+	header http.Header) (received *http.Request) {
+	req := &http.Request{
+		Method: method,
+		URL: &url.URL{
+			Scheme:   "https",
+			Host:     "www.googleapis.com",
+			Opaque:   "//www.googleapis.com/download/storage/v1/b/some_bucket/o/foo",
+			RawQuery: rawQuery,
+		},
+		Header: header,
+	}
+
+	_, err := gcsx.NewStoredBytesRoundTripper(&t.wrapped).RoundTrip(req)
+	AssertEq(nil, err)
+	AssertEq(1, len(t.wrapped.requests))
+
+	received = t.wrapped.requests[0]
+	t.wrapped.requests = nil
+	return
+}
+
+func (t *StoredBytesTest) DownloadsAcceptGzip() {
+	header := make(http.Header)
+	received := t.send("GET", "alt=media", header)
+
+	ExpectEq("gzip", received.Header.Get("Accept-Encoding"))
+
+	// The original request must not be modified.
+	ExpectEq("", header.Get("Accept-Encoding"))
+}
+
+func (t *StoredBytesTest) OtherRequestsUnmodified() {
+	received := t.send("GET", "projection=full", make(http.Header))
+	ExpectEq("", received.Header.Get("Accept-Encoding"))
+}
+
+func (t *StoredBytesTest) ExistingAcceptEncodingKept() {
+	header := make(http.Header)
+	header.Set("Accept-Encoding", "identity")
+
+	received := t.send("GET", "alt=media", header)
+	ExpectEq("identity", received.Header.Get("Accept-Encoding"))
+}
+
+func (t *StoredBytesTest) CompressionOfPlainObjectsUndone() {
+	header := make(http.Header)
+	header.Set("Content-Encoding", "gzip")
+	header.Set("X-Goog-Stored-Content-Encoding", "identity")
+
+	rt := gcsx.NewStoredBytesRoundTripper(&fixedRoundTripper{
+		header: header,
+		body:   gzipBytes("taco"),
+	})
+
+	resp, err := rt.RoundTrip(&http.Request{
+		Method: "GET",
+		URL:    &url.URL{RawQuery: "alt=media"},
+		Header: make(http.Header),
+	})
+
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(body))
+	ExpectEq("", resp.Header.Get("Content-Encoding"))
+}
+
+func (t *StoredBytesTest) GzippedObjectsLeftCompressed() {
+	header := make(http.Header)
+	header.Set("Content-Encoding", "gzip")
+	header.Set("X-Goog-Stored-Content-Encoding", "gzip")
+
+	stored := gzipBytes("taco")
+	rt := gcsx.NewStoredBytesRoundTripper(&fixedRoundTripper{
+		header: header,
+		body:   stored,
+	})
+
+	resp, err := rt.RoundTrip(&http.Request{
+		Method: "GET",
+		URL:    &url.URL{RawQuery: "alt=media"},
+		Header: make(http.Header),
+	})
+
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(stored, body))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Decompressing
+////////////////////////////////////////////////////////////////////////
+
+type DecompressingBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+
+	// A gzip-encoded object holding csvContents, and a plain one.
+	foo *gcs.Object
+	bar *gcs.Object
+}
+
+var _ SetUpInterface = &DecompressingBucketTest{}
+
+func init() { RegisterTestSuite(&DecompressingBucketTest{}) }
+
+func (t *DecompressingBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = gcsx.NewDecompressingBucket(t.wrapped)
+
+	t.foo, err = t.wrapped.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:            "foo",
+		ContentEncoding: "gzip",
+		Contents:        bytes.NewReader(gzipBytes(csvContents)),
+	})
+
+	AssertEq(nil, err)
+
+	t.bar, err = gcsutil.CreateObject(t.ctx, t.wrapped, "bar", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *DecompressingBucketTest) readRange(
+	name string,
+	start uint64,
+	limit uint64) string {
+	rc, err := t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{
+		Name:  name,
+		Range: &gcs.ByteRange{Start: start, Limit: limit},
+	})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	contents, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+func (t *DecompressingBucketTest) StatReportsDecompressedSize() {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(len(csvContents), o.Size)
+	ExpectEq("gzip", o.ContentEncoding)
+
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), o.Size)
+}
+
+func (t *DecompressingBucketTest) ListReportsDecompressedSize() {
+	listing, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	AssertEq(2, len(listing.Objects))
+
+	ExpectEq("bar", listing.Objects[0].Name)
+	ExpectEq(len("taco"), listing.Objects[0].Size)
+	ExpectEq("foo", listing.Objects[1].Name)
+	ExpectEq(len(csvContents), listing.Objects[1].Size)
+
+	// The wrapped bucket's records are left alone.
+	listing, err = t.wrapped.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectEq(t.foo.Size, listing.Objects[1].Size)
+	ExpectLt(t.foo.Size, len(csvContents))
+}
+
+func (t *DecompressingBucketTest) ReadsDecompressed() {
+	ExpectEq(csvContents, t.readRange("foo", 0, uint64(len(csvContents))))
+	ExpectEq(csvContents[30:45], t.readRange("foo", 30, 45))
+	ExpectEq("aco", t.readRange("bar", 1, 4))
+}
+
+func (t *DecompressingBucketTest) ComposeRewritesDecompressed() {
+	o, err := t.bucket.ComposeObjects(t.ctx, &gcs.ComposeObjectsRequest{
+		DstName: "baz",
+		Sources: []gcs.ComposeSource{{Name: "foo"}, {Name: "bar"}},
+	})
+
+	AssertEq(nil, err)
+	ExpectEq("", o.ContentEncoding)
+	ExpectEq(len(csvContents)+len("taco"), o.Size)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped, "baz")
+	AssertEq(nil, err)
+	ExpectEq(csvContents+"taco", string(contents))
+}
+
+func (t *DecompressingBucketTest) ComposePlainObjectsInGCS() {
+	o, err := t.bucket.ComposeObjects(t.ctx, &gcs.ComposeObjectsRequest{
+		DstName: "baz",
+		Sources: []gcs.ComposeSource{{Name: "bar"}, {Name: "bar"}},
+	})
+
+	AssertEq(nil, err)
+	ExpectThat(o.ComponentCount, Equals(2))
+}
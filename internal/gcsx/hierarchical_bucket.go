@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewHierarchicalBucket wraps a bucket with a hierarchical namespace so that
+// names ending in a slash refer to its folders, which aren't objects. Stat,
+// create, and delete requests for such names act on the folder instead, and
+// listings with a "/" delimiter include child folders as collapsed runs even
+// when they contain no objects.
+//
+// Folders are presented as objects with no contents, whose generation is
+// their creation time in nanoseconds since the epoch.
+func NewHierarchicalBucket(
+	folders Folders,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &hierarchicalBucket{
+		Bucket:  wrapped,
+		folders: folders,
+	}
+
+	return
+}
+
+type hierarchicalBucket struct {
+	gcs.Bucket
+	folders Folders
+}
+
+func isFolderName(name string) bool {
+	return strings.HasSuffix(name, "/")
+}
+
+// Present a folder as an object.
+func folderObject(f *Folder) (o *gcs.Object) {
+	o = &gcs.Object{
+		Name:           f.Name,
+		Generation:     f.Created.UnixNano(),
+		MetaGeneration: f.MetaGeneration,
+		Updated:        f.Updated,
+	}
+
+	return
+}
+
+func (b *hierarchicalBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if !isFolderName(req.Name) {
+		o, err = b.Bucket.CreateObject(ctx, req)
+		return
+	}
+
+	// Folders can't be replaced, so the only precondition that makes sense is
+	// that there is nothing there yet.
+	if req.GenerationPrecondition != nil && *req.GenerationPrecondition != 0 {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf("Folder %q can't be replaced", req.Name),
+		}
+
+		return
+	}
+
+	f, err := b.folders.CreateFolder(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	o = folderObject(f)
+	return
+}
+
+func (b *hierarchicalBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if !isFolderName(req.Name) {
+		o, err = b.Bucket.StatObject(ctx, req)
+		return
+	}
+
+	f, err := b.folders.GetFolder(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	o = folderObject(f)
+	return
+}
+
+func (b *hierarchicalBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if !isFolderName(req.Name) {
+		err = b.Bucket.DeleteObject(ctx, req)
+		return
+	}
+
+	err = b.folders.DeleteFolder(ctx, req.Name)
+	return
+}
+
+func (b *hierarchicalBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	if req.Delimiter != "/" || !(req.Prefix == "" || isFolderName(req.Prefix)) {
+		return
+	}
+
+	names, err := b.folders.ListFolders(ctx, req.Prefix)
+	if err != nil {
+		err = fmt.Errorf("ListFolders: %v", err)
+		return
+	}
+
+	// Add every folder to the first page, and make sure none shows up again on
+	// later ones.
+	folders := make(map[string]struct{})
+	for _, n := range names {
+		folders[n] = struct{}{}
+	}
+
+	var runs []string
+	for _, r := range l.CollapsedRuns {
+		if _, ok := folders[r]; !ok {
+			runs = append(runs, r)
+		}
+	}
+
+	if req.ContinuationToken == "" {
+		runs = append(runs, names...)
+		sort.Strings(runs)
+	}
+
+	l.CollapsedRuns = runs
+	return
+}
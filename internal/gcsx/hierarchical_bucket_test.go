@@ -0,0 +1,272 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestHierarchicalBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// An in-memory set of folders.
+type fakeFolders struct {
+	clock   timeutil.Clock
+	folders map[string]*gcsx.Folder
+}
+
+func (f *fakeFolders) GetFolder(
+	ctx context.Context,
+	name string) (folder *gcsx.Folder, err error) {
+	folder, ok := f.folders[name]
+	if !ok {
+		err = &gcs.NotFoundError{Err: errors.New(name)}
+		return
+	}
+
+	return
+}
+
+func (f *fakeFolders) CreateFolder(
+	ctx context.Context,
+	name string) (folder *gcsx.Folder, err error) {
+	if _, ok := f.folders[name]; ok {
+		err = &gcs.PreconditionError{Err: errors.New(name)}
+		return
+	}
+
+	folder = &gcsx.Folder{
+		Name:           name,
+		MetaGeneration: 1,
+		Created:        f.clock.Now(),
+		Updated:        f.clock.Now(),
+	}
+
+	f.folders[name] = folder
+	return
+}
+
+func (f *fakeFolders) DeleteFolder(
+	ctx context.Context,
+	name string) (err error) {
+	if _, ok := f.folders[name]; !ok {
+		err = &gcs.NotFoundError{Err: errors.New(name)}
+		return
+	}
+
+	delete(f.folders, name)
+	return
+}
+
+func (f *fakeFolders) RenameFolder(
+	ctx context.Context,
+	src string,
+	dst string) (err error) {
+	err = errors.New("Not implemented")
+	return
+}
+
+func (f *fakeFolders) ListFolders(
+	ctx context.Context,
+	parent string) (names []string, err error) {
+	for name := range f.folders {
+		if !strings.HasPrefix(name, parent) || name == parent {
+			continue
+		}
+
+		// Skip folders nested more deeply.
+		if strings.Contains(strings.TrimSuffix(name[len(parent):], "/"), "/") {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
+
+type HierarchicalBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	folders *fakeFolders
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &HierarchicalBucketTest{}
+
+func init() { RegisterTestSuite(&HierarchicalBucketTest{}) }
+
+func (t *HierarchicalBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.folders = &fakeFolders{
+		clock:   &t.clock,
+		folders: make(map[string]*gcsx.Folder),
+	}
+
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = gcsx.NewHierarchicalBucket(t.folders, t.wrapped)
+}
+
+func (t *HierarchicalBucketTest) createFolder(name string) {
+	_, err := t.folders.CreateFolder(t.ctx, name)
+	AssertEq(nil, err)
+}
+
+func (t *HierarchicalBucketTest) createObjects(names ...string) {
+	for _, name := range names {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, []byte("taco"))
+		AssertEq(nil, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *HierarchicalBucketTest) StatFolder() {
+	t.createFolder("foo/")
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	AssertEq(nil, err)
+	ExpectEq("foo/", o.Name)
+	ExpectEq(0, o.Size)
+	ExpectEq(t.clock.Now().UnixNano(), o.Generation)
+	ExpectEq(1, o.MetaGeneration)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar/"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *HierarchicalBucketTest) StatObject() {
+	t.createObjects("foo")
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), o.Size)
+}
+
+func (t *HierarchicalBucketTest) CreateFolder() {
+	var zero int64
+	o, err := t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:                   "foo/",
+		Contents:               strings.NewReader(""),
+		GenerationPrecondition: &zero,
+	})
+
+	AssertEq(nil, err)
+	ExpectEq("foo/", o.Name)
+
+	// The folder exists, and no object was created.
+	_, ok := t.folders.folders["foo/"]
+	ExpectTrue(ok)
+
+	_, err = t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// It can't be created again.
+	_, err = t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:                   "foo/",
+		Contents:               strings.NewReader(""),
+		GenerationPrecondition: &zero,
+	})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *HierarchicalBucketTest) DeleteFolder() {
+	t.createFolder("foo/")
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo/"})
+	AssertEq(nil, err)
+
+	_, ok := t.folders.folders["foo/"]
+	ExpectFalse(ok)
+}
+
+func (t *HierarchicalBucketTest) ListIncludesEmptyFolders() {
+	t.createFolder("foo/")
+	t.createFolder("foo/bar/")
+	t.createFolder("foo/qux/")
+	t.createObjects("foo/baz", "foo/bar/x", "foo/qux/y/z")
+
+	l, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{
+		Prefix:    "foo/",
+		Delimiter: "/",
+	})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(l.Objects))
+	ExpectEq("foo/baz", l.Objects[0].Name)
+	ExpectThat(l.CollapsedRuns, ElementsAre("foo/bar/", "foo/qux/"))
+}
+
+func (t *HierarchicalBucketTest) ListWithoutDelimiter() {
+	t.createFolder("foo/")
+	t.createObjects("bar")
+
+	l, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	AssertEq(1, len(l.Objects))
+	ExpectEq("bar", l.Objects[0].Name)
+	ExpectEq(0, len(l.CollapsedRuns))
+}
+
+func (t *HierarchicalBucketTest) ListFoldersOnlyOnFirstPage() {
+	t.createFolder("a/")
+	t.createFolder("c/")
+	t.createObjects("a/x", "b/x", "c/x", "d")
+
+	// Read every page, one result at a time.
+	var runs []string
+	var tok string
+	for {
+		l, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{
+			Delimiter:         "/",
+			ContinuationToken: tok,
+			MaxResults:        1,
+		})
+
+		AssertEq(nil, err)
+		runs = append(runs, l.CollapsedRuns...)
+
+		tok = l.ContinuationToken
+		if tok == "" {
+			break
+		}
+	}
+
+	sort.Strings(runs)
+	ExpectThat(runs, ElementsAre("a/", "b/", "c/"))
+}
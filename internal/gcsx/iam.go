@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+// IAM permissions governing access to objects, as named by GCS.
+const (
+	PermissionObjectsGet    = "storage.objects.get"
+	PermissionObjectsList   = "storage.objects.list"
+	PermissionObjectsCreate = "storage.objects.create"
+	PermissionObjectsDelete = "storage.objects.delete"
+)
+
+// TestBucketPermissions asks GCS which of the given IAM permissions on the
+// named bucket are held by the credentials that the supplied client adds to
+// its requests, returning those that are.
+func TestBucketPermissions(
+	ctx context.Context,
+	client *http.Client,
+	bucketName string,
+	userAgent string,
+	permissions []string) (granted []string, err error) {
+	query := url.Values{"permissions": permissions}
+
+	var res struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err = sendBucketRequest(
+		ctx,
+		client,
+		bucketName,
+		userAgent,
+		"GET",
+		"iam/testPermissions",
+		query,
+		nil,
+		&res)
+
+	if err != nil {
+		return
+	}
+
+	granted = res.Permissions
+	return
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestIAM(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type IAMTest struct {
+	ctx    context.Context
+	server *httptest.Server
+	client *http.Client
+
+	// The response to send, and the URLs of the requests received so far.
+	status   int
+	response string
+	requests []*url.URL
+}
+
+var _ SetUpInterface = &IAMTest{}
+var _ TearDownInterface = &IAMTest{}
+
+func init() { RegisterTestSuite(&IAMTest{}) }
+
+func (t *IAMTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.status = http.StatusOK
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.requests = append(t.requests, r.URL)
+			w.WriteHeader(t.status)
+			w.Write([]byte(t.response))
+		}))
+
+	endpoint, err := url.Parse(t.server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+	t.client = &http.Client{Transport: transport}
+}
+
+func (t *IAMTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *IAMTest) test() (granted []string, err error) {
+	granted, err = gcsx.TestBucketPermissions(
+		t.ctx,
+		t.client,
+		"some_bucket",
+		"gcsfuse/0.0",
+		[]string{
+			gcsx.PermissionObjectsGet,
+			gcsx.PermissionObjectsCreate,
+		})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *IAMTest) SomeGranted() {
+	t.response = `{"permissions": ["storage.objects.get"]}`
+
+	granted, err := t.test()
+	AssertEq(nil, err)
+	ExpectThat(granted, ElementsAre(gcsx.PermissionObjectsGet))
+
+	AssertEq(1, len(t.requests))
+	ExpectEq(
+		"/storage/v1/b/some_bucket/iam/testPermissions",
+		t.requests[0].EscapedPath())
+
+	ExpectThat(
+		t.requests[0].Query()["permissions"],
+		ElementsAre("storage.objects.get", "storage.objects.create"))
+}
+
+func (t *IAMTest) NoneGranted() {
+	t.response = `{"kind": "storage#testIamPermissionsResponse"}`
+
+	granted, err := t.test()
+	AssertEq(nil, err)
+	ExpectEq(0, len(granted))
+}
+
+func (t *IAMTest) Forbidden() {
+	t.status = http.StatusForbidden
+	t.response = `{"error": {"code": 403, "message": "Forbidden"}}`
+
+	_, err := t.test()
+	ExpectNe(nil, err)
+}
@@ -89,6 +89,9 @@ func (t *IntegrationTest) SetUp(ti *TestInfo) {
 
 	t.syncer = gcsx.NewSyncer(
 		appendThreshold,
+		0,
+		0,
+		gcsx.UnchangedContentUpload,
 		tmpObjectPrefix,
 		t.bucket)
 }
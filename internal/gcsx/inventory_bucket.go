@@ -0,0 +1,532 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The number of results in a listing served from an inventory report when the
+// request doesn't say.
+const inventoryDefaultMaxResults = 1000
+
+// Continuation tokens for listings served from an inventory report begin with
+// this, so that we can tell them apart from those of GCS.
+const inventoryTokenPrefix = "inventory:"
+
+// An object listed in an inventory report, kept smaller than a gcs.Object
+// since a report may list a very large number of them.
+type inventoryEntry struct {
+	name           string
+	size           uint64
+	generation     int64
+	metaGeneration int64
+	updated        time.Time
+	contentType    string
+	storageClass   string
+}
+
+func (e *inventoryEntry) object() *gcs.Object {
+	return &gcs.Object{
+		Name:           e.name,
+		Size:           e.size,
+		Generation:     e.generation,
+		MetaGeneration: e.metaGeneration,
+		Updated:        e.updated,
+		ContentType:    e.contentType,
+		StorageClass:   e.storageClass,
+	}
+}
+
+// An InventoryIndex holds the objects listed in a Storage Insights inventory
+// report, sorted by name.
+type InventoryIndex struct {
+	entries []inventoryEntry
+
+	// The time at which the newest shard of the report was written.
+	updated time.Time
+
+	// The prefix of the names of all objects the index describes. Listings of
+	// other prefixes can't be answered from it.
+	prefix string
+}
+
+// Len returns the number of objects in the index.
+func (x *InventoryIndex) Len() int {
+	return len(x.entries)
+}
+
+// Updated returns the time at which the report was written, after which
+// changes to the bucket aren't reflected in it.
+func (x *InventoryIndex) Updated() time.Time {
+	return x.updated
+}
+
+// LoadInventoryReport reads the CSV shards of an inventory report, i.e. the
+// objects with the given prefix and a .csv extension in the supplied bucket.
+// Reports in Parquet format are not supported.
+func LoadInventoryReport(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	prefix string) (x *InventoryIndex, err error) {
+	x = &InventoryIndex{}
+
+	var shards []*gcs.Object
+	req := &gcs.ListObjectsRequest{Prefix: prefix}
+	for {
+		var listing *gcs.Listing
+		listing, err = bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		for _, o := range listing.Objects {
+			switch path.Ext(o.Name) {
+			case ".csv":
+				shards = append(shards, o)
+
+			case ".parquet":
+				err = fmt.Errorf(
+					"%s: Parquet inventory reports aren't supported; use CSV",
+					o.Name)
+				return
+			}
+		}
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	if len(shards) == 0 {
+		err = fmt.Errorf("No CSV files under %q", prefix)
+		return
+	}
+
+	for _, o := range shards {
+		err = x.readShard(ctx, bucket, o)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", o.Name, err)
+			return
+		}
+
+		if o.Updated.After(x.updated) {
+			x.updated = o.Updated
+		}
+	}
+
+	// Sort, keeping the last of any duplicates.
+	sort.SliceStable(x.entries, func(i, j int) bool {
+		return x.entries[i].name < x.entries[j].name
+	})
+
+	unique := x.entries[:0]
+	for i, e := range x.entries {
+		if i+1 < len(x.entries) && x.entries[i+1].name == e.name {
+			continue
+		}
+
+		unique = append(unique, e)
+	}
+
+	x.entries = unique
+	return
+}
+
+// IndexObjects lists the objects with the given prefix in the supplied bucket,
+// returning an index of them like one loaded from an inventory report written
+// when the listing began. Only listings within the prefix are answered from
+// the index.
+func IndexObjects(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	prefix string) (x *InventoryIndex, err error) {
+	x = &InventoryIndex{
+		updated: time.Now(),
+		prefix:  prefix,
+	}
+
+	req := &gcs.ListObjectsRequest{Prefix: prefix}
+	for {
+		var listing *gcs.Listing
+		listing, err = bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		for _, o := range listing.Objects {
+			x.entries = append(x.entries, inventoryEntry{
+				name:           o.Name,
+				size:           o.Size,
+				generation:     o.Generation,
+				metaGeneration: o.MetaGeneration,
+				updated:        o.Updated,
+				contentType:    o.ContentType,
+				storageClass:   o.StorageClass,
+			})
+		}
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	// GCS lists objects in order, but other buckets needn't.
+	sort.Slice(x.entries, func(i, j int) bool {
+		return x.entries[i].name < x.entries[j].name
+	})
+
+	return
+}
+
+func (x *InventoryIndex) readShard(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object) (err error) {
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	err = parseInventoryCSV(rc, func(e inventoryEntry) {
+		x.entries = append(x.entries, e)
+	})
+
+	return
+}
+
+// Parse an inventory report in CSV format with a header row, calling f for
+// each object. Only the name column is required; unknown columns are ignored.
+func parseInventoryCSV(r io.Reader, f func(inventoryEntry)) (err error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		err = errors.New("Missing header row")
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+
+	if _, ok := columns["name"]; !ok {
+		err = errors.New("No name column")
+		return
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+
+		return ""
+	}
+
+	for {
+		var record []string
+		record, err = cr.Read()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		e := inventoryEntry{
+			name:         field(record, "name"),
+			contentType:  field(record, "contentType"),
+			storageClass: field(record, "storageClass"),
+		}
+
+		if s := field(record, "size"); s != "" {
+			e.size, err = strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("Parsing size of %q: %v", e.name, err)
+				return
+			}
+		}
+
+		if s := field(record, "generation"); s != "" {
+			e.generation, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("Parsing generation of %q: %v", e.name, err)
+				return
+			}
+		}
+
+		if s := field(record, "metageneration"); s != "" {
+			e.metaGeneration, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("Parsing metageneration of %q: %v", e.name, err)
+				return
+			}
+		}
+
+		if s := field(record, "updated"); s != "" {
+			e.updated, err = time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				err = fmt.Errorf("Parsing updated time of %q: %v", e.name, err)
+				return
+			}
+		}
+
+		f(e)
+	}
+}
+
+// Return the index of the first entry at or after i whose name doesn't begin
+// with the given prefix, assuming that any that do come first.
+func (x *InventoryIndex) skipPrefix(i int, prefix string) int {
+	return i + sort.Search(len(x.entries)-i, func(j int) bool {
+		return !strings.HasPrefix(x.entries[i+j].name, prefix)
+	})
+}
+
+// List the objects and collapsed runs with the given prefix, delimited by
+// slashes, strictly after the given name. If the listing is cut short, its
+// continuation token is the name of the last object or run listed.
+func (x *InventoryIndex) list(
+	prefix string,
+	after string,
+	maxResults int) (listing *gcs.Listing) {
+	listing = &gcs.Listing{}
+
+	start := prefix
+	if after > start {
+		start = after
+	}
+
+	i := sort.Search(len(x.entries), func(j int) bool {
+		return x.entries[j].name >= start
+	})
+
+	// Skip the entry we left off at and, if it was a collapsed run, the objects
+	// within it.
+	if after != "" {
+		if strings.HasSuffix(after, "/") && after != prefix {
+			i = x.skipPrefix(i, after)
+		} else if i < len(x.entries) && x.entries[i].name == after {
+			i++
+		}
+	}
+
+	var last string
+	for i < len(x.entries) && strings.HasPrefix(x.entries[i].name, prefix) {
+		if len(listing.Objects)+len(listing.CollapsedRuns) == maxResults {
+			listing.ContinuationToken = last
+			return
+		}
+
+		e := &x.entries[i]
+		rest := e.name[len(prefix):]
+		if slash := strings.Index(rest, "/"); slash >= 0 {
+			run := prefix + rest[:slash+1]
+			listing.CollapsedRuns = append(listing.CollapsedRuns, run)
+			last = run
+			i = x.skipPrefix(i, run)
+			continue
+		}
+
+		listing.Objects = append(listing.Objects, e.object())
+		last = e.name
+		i++
+	}
+
+	return
+}
+
+// NewInventoryBucket returns a bucket that answers the first listing of each
+// directory from the supplied inventory report rather than asking GCS, which
+// makes a first traversal of a bucket with very many objects much faster. The
+// report sees the bucket as it was when it was written, so later listings of
+// the same directory, and listings of directories in which objects have been
+// created or deleted through this bucket, are answered by the wrapped bucket.
+// Other requests are always passed through.
+//
+// Only listings delimited by slashes, as made by the file system, are
+// answered from the report. If the wrapped bucket is limited to a prefix of
+// the bucket the report describes, that prefix must be supplied.
+func NewInventoryBucket(
+	index *InventoryIndex,
+	prefix string,
+	wrapped gcs.Bucket) gcs.Bucket {
+	return &inventoryBucket{
+		Bucket: wrapped,
+		index:  index,
+		prefix: prefix,
+		live:   make(map[string]bool),
+	}
+}
+
+type inventoryBucket struct {
+	gcs.Bucket
+	index  *InventoryIndex
+	prefix string
+
+	mu sync.Mutex
+
+	// Prefixes that the report mustn't be used to list, because they have
+	// already been listed from it or have changed since.
+	//
+	// GUARDED_BY(mu)
+	live map[string]bool
+}
+
+// Note that objects with the given name have changed, so that the report is
+// no longer a fair picture of the directories containing it.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *inventoryBucket) invalidate(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		slash := strings.LastIndex(name, "/")
+		name = name[:slash+1]
+		b.live[name] = true
+
+		if slash < 0 {
+			return
+		}
+
+		name = name[:slash]
+	}
+}
+
+func (b *inventoryBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	// Continue listings we began from the report.
+	if strings.HasPrefix(req.ContinuationToken, inventoryTokenPrefix) {
+		after := strings.TrimPrefix(req.ContinuationToken, inventoryTokenPrefix)
+		listing = b.listFromIndex(req, b.prefix+after)
+		return
+	}
+
+	// Pass through listings we can't answer, or have answered already.
+	useIndex := req.Delimiter == "/" &&
+		req.ContinuationToken == "" &&
+		strings.HasPrefix(b.prefix+req.Prefix, b.index.prefix)
+	if useIndex {
+		b.mu.Lock()
+		useIndex = !b.live[req.Prefix]
+		b.live[req.Prefix] = true
+		b.mu.Unlock()
+	}
+
+	if !useIndex {
+		listing, err = b.Bucket.ListObjects(ctx, req)
+		return
+	}
+
+	listing = b.listFromIndex(req, "")
+	return
+}
+
+func (b *inventoryBucket) listFromIndex(
+	req *gcs.ListObjectsRequest,
+	after string) (listing *gcs.Listing) {
+	maxResults := req.MaxResults
+	if maxResults <= 0 {
+		maxResults = inventoryDefaultMaxResults
+	}
+
+	listing = b.index.list(b.prefix+req.Prefix, after, maxResults)
+
+	// Translate names from the report's point of view to ours.
+	for i, o := range listing.Objects {
+		o.Name = strings.TrimPrefix(o.Name, b.prefix)
+		listing.Objects[i] = o
+	}
+
+	for i, run := range listing.CollapsedRuns {
+		listing.CollapsedRuns[i] = strings.TrimPrefix(run, b.prefix)
+	}
+
+	if listing.ContinuationToken != "" {
+		listing.ContinuationToken = inventoryTokenPrefix +
+			strings.TrimPrefix(listing.ContinuationToken, b.prefix)
+	}
+
+	return
+}
+
+func (b *inventoryBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.invalidate(req.Name)
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	b.invalidate(req.DstName)
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	b.invalidate(req.DstName)
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *inventoryBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.invalidate(req.Name)
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,276 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestInventoryBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const inventoryHeader = "bucket,name,size,generation,metageneration,updated\n"
+
+type InventoryBucketTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+
+	// The bucket holding reports, and the bucket they describe.
+	reports gcs.Bucket
+	live    gcs.Bucket
+}
+
+func init() { RegisterTestSuite(&InventoryBucketTest{}) }
+
+func (t *InventoryBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.reports = gcsfake.NewFakeBucket(&t.clock, "reports")
+	t.live = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// The report lists a few objects in two shards.
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.reports,
+		"inventory/0.csv",
+		[]byte(inventoryHeader+
+			"some_bucket,a,4,17,1,2015-04-01T00:00:00Z\n"+
+			"some_bucket,d/x,5,18,2,2015-04-01T00:00:00Z\n"+
+			"some_bucket,d/y/z,6,19,1,2015-04-01T00:00:00Z\n"))
+
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.reports,
+		"inventory/1.csv",
+		[]byte(inventoryHeader+
+			"some_bucket,b,7,20,1,2015-04-01T00:00:00Z\n"+
+			"some_bucket,e/,0,21,1,2015-04-01T00:00:00Z\n"))
+
+	AssertEq(nil, err)
+
+	// The bucket has since changed.
+	_, err = gcsutil.CreateObject(t.ctx, t.live, "c", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *InventoryBucketTest) load() *gcsx.InventoryIndex {
+	index, err := gcsx.LoadInventoryReport(t.ctx, t.reports, "inventory/")
+	AssertEq(nil, err)
+	return index
+}
+
+func (t *InventoryBucketTest) list(
+	b gcs.Bucket,
+	req *gcs.ListObjectsRequest) (names []string, runs []string) {
+	listing, err := b.ListObjects(t.ctx, req)
+	AssertEq(nil, err)
+
+	for _, o := range listing.Objects {
+		names = append(names, o.Name)
+	}
+
+	runs = listing.CollapsedRuns
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *InventoryBucketTest) LoadsAllShards() {
+	index := t.load()
+	ExpectEq(5, index.Len())
+	ExpectLe(t.clock.Now().Sub(index.Updated()), time.Second)
+}
+
+func (t *InventoryBucketTest) NoReport() {
+	_, err := gcsx.LoadInventoryReport(t.ctx, t.reports, "nothing/")
+	ExpectThat(err, Error(HasSubstr("No CSV files")))
+}
+
+func (t *InventoryBucketTest) ParquetReport() {
+	_, err := gcsutil.CreateObject(t.ctx, t.reports, "pq/0.parquet", nil)
+	AssertEq(nil, err)
+
+	_, err = gcsx.LoadInventoryReport(t.ctx, t.reports, "pq/")
+	ExpectThat(err, Error(HasSubstr("Parquet")))
+}
+
+func (t *InventoryBucketTest) NoNameColumn() {
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.reports,
+		"bad/0.csv",
+		[]byte("bucket,size\nsome_bucket,4\n"))
+
+	AssertEq(nil, err)
+
+	_, err = gcsx.LoadInventoryReport(t.ctx, t.reports, "bad/")
+	ExpectThat(err, Error(HasSubstr("name column")))
+}
+
+func (t *InventoryBucketTest) FirstListingFromReport() {
+	b := gcsx.NewInventoryBucket(t.load(), "", t.live)
+	req := &gcs.ListObjectsRequest{Delimiter: "/"}
+
+	names, runs := t.list(b, req)
+	ExpectThat(names, ElementsAre("a", "b"))
+	ExpectThat(runs, ElementsAre("d/", "e/"))
+
+	// The second listing reflects the bucket as it is now.
+	names, runs = t.list(b, req)
+	ExpectThat(names, ElementsAre("c"))
+	ExpectEq(0, len(runs))
+}
+
+func (t *InventoryBucketTest) ObjectAttributes() {
+	b := gcsx.NewInventoryBucket(t.load(), "", t.live)
+	listing, err := b.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: "d/", Delimiter: "/"})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(listing.Objects))
+
+	o := listing.Objects[0]
+	ExpectEq("d/x", o.Name)
+	ExpectEq(5, o.Size)
+	ExpectEq(18, o.Generation)
+	ExpectEq(2, o.MetaGeneration)
+	ExpectThat(listing.CollapsedRuns, ElementsAre("d/y/"))
+}
+
+func (t *InventoryBucketTest) Paging() {
+	b := gcsx.NewInventoryBucket(t.load(), "", t.live)
+	req := &gcs.ListObjectsRequest{Delimiter: "/", MaxResults: 3}
+
+	listing, err := b.ListObjects(t.ctx, req)
+	AssertEq(nil, err)
+	ExpectEq(2, len(listing.Objects))
+	ExpectThat(listing.CollapsedRuns, ElementsAre("d/"))
+	AssertNe("", listing.ContinuationToken)
+
+	req.ContinuationToken = listing.ContinuationToken
+	listing, err = b.ListObjects(t.ctx, req)
+	AssertEq(nil, err)
+	ExpectEq(0, len(listing.Objects))
+	ExpectThat(listing.CollapsedRuns, ElementsAre("e/"))
+	ExpectEq("", listing.ContinuationToken)
+}
+
+func (t *InventoryBucketTest) WritesMakeDirectoriesLive() {
+	b := gcsx.NewInventoryBucket(t.load(), "", t.live)
+
+	_, err := gcsutil.CreateObject(t.ctx, b, "d/y/new", []byte("burrito"))
+	AssertEq(nil, err)
+
+	// The directory containing the new object and its ancestors are listed
+	// from the bucket.
+	names, _ := t.list(b, &gcs.ListObjectsRequest{Prefix: "d/y/", Delimiter: "/"})
+	ExpectThat(names, ElementsAre("d/y/new"))
+
+	_, runs := t.list(b, &gcs.ListObjectsRequest{Delimiter: "/"})
+	ExpectThat(runs, ElementsAre("d/"))
+
+	// Others aren't.
+	names, _ = t.list(b, &gcs.ListObjectsRequest{Prefix: "e/", Delimiter: "/"})
+	ExpectThat(names, ElementsAre("e/"))
+}
+
+func (t *InventoryBucketTest) RecursiveListingsPassedThrough() {
+	b := gcsx.NewInventoryBucket(t.load(), "", t.live)
+
+	names, _ := t.list(b, &gcs.ListObjectsRequest{})
+	ExpectThat(names, ElementsAre("c"))
+}
+
+func (t *InventoryBucketTest) Prefix() {
+	b := gcsx.NewInventoryBucket(t.load(), "d/", t.live)
+
+	names, runs := t.list(b, &gcs.ListObjectsRequest{Delimiter: "/"})
+	ExpectThat(names, ElementsAre("x"))
+	ExpectThat(runs, ElementsAre("y/"))
+}
+
+func (t *InventoryBucketTest) IndexObjects() {
+	for _, n := range []string{"d/x", "d/y/z", "e/w"} {
+		_, err := gcsutil.CreateObject(t.ctx, t.live, n, []byte("taco"))
+		AssertEq(nil, err)
+	}
+
+	index, err := gcsx.IndexObjects(t.ctx, t.live, "")
+	AssertEq(nil, err)
+	ExpectEq(4, index.Len())
+
+	b := gcsx.NewInventoryBucket(index, "", t.live)
+
+	names, runs := t.list(b, &gcs.ListObjectsRequest{Delimiter: "/"})
+	ExpectThat(names, ElementsAre("c"))
+	ExpectThat(runs, ElementsAre("d/", "e/"))
+
+	o, err := t.live.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "d/x"})
+	AssertEq(nil, err)
+
+	listing, err := b.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: "d/", Delimiter: "/"})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(listing.Objects))
+	ExpectEq(o.Generation, listing.Objects[0].Generation)
+	ExpectEq(o.Size, listing.Objects[0].Size)
+}
+
+func (t *InventoryBucketTest) IndexObjects_Prefix() {
+	for _, n := range []string{"d/x", "d/y/z", "e/w"} {
+		_, err := gcsutil.CreateObject(t.ctx, t.live, n, []byte("taco"))
+		AssertEq(nil, err)
+	}
+
+	index, err := gcsx.IndexObjects(t.ctx, t.live, "d/")
+	AssertEq(nil, err)
+	ExpectEq(2, index.Len())
+
+	b := gcsx.NewInventoryBucket(index, "", t.live)
+
+	// Listings within the prefix are answered from the index, so objects
+	// created since aren't seen the first time.
+	_, err = gcsutil.CreateObject(t.ctx, t.live, "d/new", []byte("taco"))
+	AssertEq(nil, err)
+
+	names, runs := t.list(b, &gcs.ListObjectsRequest{Prefix: "d/", Delimiter: "/"})
+	ExpectThat(names, ElementsAre("d/x"))
+	ExpectThat(runs, ElementsAre("d/y/"))
+
+	// Others go to the bucket.
+	names, runs = t.list(b, &gcs.ListObjectsRequest{Delimiter: "/"})
+	ExpectThat(names, ElementsAre("c"))
+	ExpectThat(runs, ElementsAre("d/", "e/"))
+}
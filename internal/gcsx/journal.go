@@ -0,0 +1,381 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// A Journal keeps the contents of files being modified in a directory, rather
+// than in anonymous temporary files, so that writes acknowledged to the
+// kernel but not yet written to GCS survive a crash of the process. Use
+// Recover when starting up to write out anything left behind.
+//
+// Contents are not synced to disk with each write, so they may not survive a
+// crash of the whole machine.
+type Journal struct {
+	dir         string
+	conflictDir string
+}
+
+// The record kept alongside each file in the journal, identifying the object
+// it is a modified copy of.
+type journalRecord struct {
+	Bucket         string
+	Name           string
+	Generation     int64
+	MetaGeneration int64
+
+	// The object's POSIX attributes as recorded by PosixMetadata, carried over
+	// when writing out the file as they are when syncing.
+	PosixMetadata map[string]string `json:",omitempty"`
+
+	// Set once the contents have been modified, so that unmodified copies
+	// needn't be written out.
+	Dirty bool
+}
+
+const journalRecordSuffix = ".json"
+
+// NewJournal creates a journal in the supplied directory, creating it if
+// necessary.
+func NewJournal(dir string) (j *Journal, err error) {
+	j = &Journal{
+		dir:         dir,
+		conflictDir: path.Join(dir, "conflicts"),
+	}
+
+	err = os.MkdirAll(j.conflictDir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	return
+}
+
+// NewTempFile creates a temp file as with the package-level function, but
+// living in the journal and recorded as a copy of the supplied object in the
+// supplied bucket.
+func (j *Journal) NewTempFile(
+	content io.Reader,
+	bucket string,
+	src *gcs.Object,
+	clock timeutil.Clock) (tf TempFile, err error) {
+	f, err := ioutil.TempFile(j.dir, "file")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	jtf := &journaledTempFile{
+		path:       f.Name(),
+		recordPath: f.Name() + journalRecordSuffix,
+		record: journalRecord{
+			Bucket:         bucket,
+			Name:           src.Name,
+			Generation:     src.Generation,
+			MetaGeneration: src.MetaGeneration,
+			PosixMetadata:  PosixMetadata(src),
+		},
+	}
+
+	// Clean up if we don't make it to the end.
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			os.Remove(jtf.recordPath)
+		}
+	}()
+
+	err = jtf.writeRecord()
+	if err != nil {
+		err = fmt.Errorf("writeRecord: %v", err)
+		return
+	}
+
+	jtf.tempFile, err = newTempFile(f, content, clock)
+	if err != nil {
+		return
+	}
+
+	tf = jtf
+	return
+}
+
+// A SourceRecorder is a temp file that records the object it is a copy of, as
+// those created by a Journal do. SetSource must be called when the object is
+// replaced by a new generation or metageneration without the contents being
+// written out, as when its metadata is updated, so that recovery writes the
+// contents over the right object.
+type SourceRecorder interface {
+	SetSource(src *gcs.Object) (err error)
+}
+
+// A temp file in a journal.
+type journaledTempFile struct {
+	*tempFile
+	path       string
+	recordPath string
+	record     journalRecord
+}
+
+func (tf *journaledTempFile) writeRecord() (err error) {
+	contents, err := json.Marshal(&tf.record)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	err = writeFileSync(tf.recordPath+".tmp", contents)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tf.recordPath+".tmp", tf.recordPath)
+	if err != nil {
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
+
+func (tf *journaledTempFile) SetSource(src *gcs.Object) (err error) {
+	old := tf.record
+	tf.record.Name = src.Name
+	tf.record.Generation = src.Generation
+	tf.record.MetaGeneration = src.MetaGeneration
+	tf.record.PosixMetadata = PosixMetadata(src)
+
+	err = tf.writeRecord()
+	if err != nil {
+		tf.record = old
+		err = fmt.Errorf("writeRecord: %v", err)
+		return
+	}
+
+	return
+}
+
+// Note in the record that the contents have been modified, if that's news.
+func (tf *journaledTempFile) markDirty() (err error) {
+	if tf.record.Dirty {
+		return
+	}
+
+	tf.record.Dirty = true
+	err = tf.writeRecord()
+	if err != nil {
+		tf.record.Dirty = false
+		err = fmt.Errorf("writeRecord: %v", err)
+		return
+	}
+
+	return
+}
+
+func (tf *journaledTempFile) WriteAt(p []byte, offset int64) (n int, err error) {
+	err = tf.markDirty()
+	if err != nil {
+		return
+	}
+
+	n, err = tf.tempFile.WriteAt(p, offset)
+	return
+}
+
+func (tf *journaledTempFile) Truncate(n int64) (err error) {
+	err = tf.markDirty()
+	if err != nil {
+		return
+	}
+
+	err = tf.tempFile.Truncate(n)
+	return
+}
+
+func (tf *journaledTempFile) SetMtime(mtime time.Time) {
+	tf.tempFile.SetMtime(mtime)
+
+	// Recovery takes the mtime from the file. There's no way to report a
+	// failure here, so if either of these fails only the mtime is lost in a
+	// crash.
+	tf.markDirty()
+	os.Chtimes(tf.path, mtime, mtime)
+}
+
+func (tf *journaledTempFile) Destroy() {
+	tf.tempFile.Destroy()
+
+	os.Remove(tf.recordPath)
+	os.Remove(tf.path)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Recovery
+////////////////////////////////////////////////////////////////////////
+
+// Recover writes out to the supplied bucket the modified files left in the
+// journal by an earlier process, deleting the unmodified ones. Each file is
+// written only if its object hasn't changed since the copy was made. Files
+// that can't be written for that reason are moved to a "conflicts"
+// subdirectory and logged. Files belonging to other buckets are left alone,
+// as are ones that can't be written for other reasons, to be tried again next
+// time.
+//
+// Must be called before any temp files are created in the journal.
+func (j *Journal) Recover(
+	ctx context.Context,
+	bucket gcs.Bucket) (recovered int, err error) {
+	entries, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), journalRecordSuffix) {
+			continue
+		}
+
+		var ok bool
+		ok, err = j.recoverOne(ctx, bucket, path.Join(j.dir, e.Name()))
+		if err != nil {
+			err = fmt.Errorf("%s: %v", e.Name(), err)
+			return
+		}
+
+		if ok {
+			recovered++
+		}
+	}
+
+	// Clean up files whose records were never completely written, which hold
+	// nothing that was acknowledged.
+	for _, e := range entries {
+		p := path.Join(j.dir, e.Name())
+		if e.IsDir() || strings.HasSuffix(p, journalRecordSuffix) {
+			continue
+		}
+
+		if _, err := os.Stat(p + journalRecordSuffix); os.IsNotExist(err) {
+			os.Remove(p)
+		}
+	}
+
+	return
+}
+
+// Recover the file with the supplied record path, returning true if it was
+// written out.
+func (j *Journal) recoverOne(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	recordPath string) (ok bool, err error) {
+	contentsPath := strings.TrimSuffix(recordPath, journalRecordSuffix)
+
+	contents, err := ioutil.ReadFile(recordPath)
+	if err != nil {
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+	}
+
+	var r journalRecord
+	err = json.Unmarshal(contents, &r)
+	if err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	if r.Bucket != bucket.Name() {
+		return
+	}
+
+	// Unmodified copies are of no interest.
+	if !r.Dirty {
+		os.Remove(recordPath)
+		os.Remove(contentsPath)
+		return
+	}
+
+	f, err := os.Open(contentsPath)
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	_, err = bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:                       r.Name,
+		GenerationPrecondition:     &r.Generation,
+		MetaGenerationPrecondition: &r.MetaGeneration,
+		Contents:                   f,
+		Metadata: syncedMetadata(
+			&gcs.Object{Metadata: r.PosixMetadata},
+			fi.ModTime().UTC()),
+	})
+
+	switch err.(type) {
+	case nil:
+		logger.Infof("Wrote out %q from the write journal.", r.Name)
+		os.Remove(recordPath)
+		os.Remove(contentsPath)
+		ok = true
+
+	case *gcs.PreconditionError, *gcs.NotFoundError:
+		logger.Warningf(
+			"Not writing out %q from the write journal, since it has changed in "+
+				"GCS since %s was made.",
+			r.Name,
+			path.Base(contentsPath))
+
+		for _, p := range []string{recordPath, contentsPath} {
+			os.Rename(p, path.Join(j.conflictDir, path.Base(p)))
+		}
+
+		err = nil
+
+	default:
+		logger.Errorf(
+			"Couldn't write out %q from the write journal: %v",
+			r.Name,
+			err)
+		err = nil
+	}
+
+	return
+}
@@ -0,0 +1,297 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestJournal(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type JournalTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	dir     string
+	bucket  gcs.Bucket
+	journal *gcsx.Journal
+
+	// An object in the bucket.
+	src *gcs.Object
+}
+
+var _ SetUpInterface = &JournalTest{}
+var _ TearDownInterface = &JournalTest{}
+
+func init() { RegisterTestSuite(&JournalTest{}) }
+
+func (t *JournalTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.dir, err = ioutil.TempDir("", "journal_test")
+	AssertEq(nil, err)
+
+	t.journal, err = gcsx.NewJournal(t.dir)
+	AssertEq(nil, err)
+
+	t.src, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *JournalTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Create a temp file in the journal with the contents of the source object.
+func (t *JournalTest) newTempFile() (tf gcsx.TempFile) {
+	tf, err := t.journal.NewTempFile(
+		strings.NewReader("taco"),
+		t.bucket.Name(),
+		t.src,
+		&t.clock)
+
+	AssertEq(nil, err)
+	return
+}
+
+// Return the names of the files in the journal directory, excluding the
+// conflicts directory.
+func (t *JournalTest) files() (names []string) {
+	entries, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+
+	return
+}
+
+func (t *JournalTest) readObject() string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *JournalTest) TempFileBehavesNormally() {
+	tf := t.newTempFile()
+	defer tf.Destroy()
+
+	_, err := tf.WriteAt([]byte("burrito"), 2)
+	AssertEq(nil, err)
+
+	sr, err := tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(9, sr.Size)
+	ExpectEq(2, sr.DirtyThreshold)
+
+	buf := make([]byte, 9)
+	_, err = tf.ReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("taburrito", string(buf))
+}
+
+func (t *JournalTest) DestroyRemovesFiles() {
+	tf := t.newTempFile()
+	ExpectEq(2, len(t.files()))
+
+	_, err := tf.WriteAt([]byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	tf.Destroy()
+	ExpectEq(0, len(t.files()))
+}
+
+func (t *JournalTest) RecoverUnmodified() {
+	t.newTempFile()
+
+	// As if the process crashed.
+	recovered, err := t.journal.Recover(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	ExpectEq(0, recovered)
+	ExpectEq(0, len(t.files()))
+	ExpectEq("taco", t.readObject())
+}
+
+func (t *JournalTest) RecoverModified() {
+	tf := t.newTempFile()
+
+	_, err := tf.WriteAt([]byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	mtime := time.Date(2012, 8, 15, 22, 56, 0, 0, time.UTC)
+	tf.SetMtime(mtime)
+
+	// As if the process crashed.
+	recovered, err := t.journal.Recover(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	ExpectEq(1, recovered)
+	ExpectEq(0, len(t.files()))
+	ExpectEq("burrito", t.readObject())
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(mtime.Format(time.RFC3339Nano), o.Metadata[gcsx.MtimeMetadataKey])
+}
+
+func (t *JournalTest) RecoverPosixMetadata() {
+	var err error
+	t.src, err = t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:     "foo",
+		Contents: strings.NewReader("taco"),
+		Metadata: map[string]string{
+			gcsx.ModeMetadataKey: "640",
+			gcsx.UIDMetadataKey:  "1000",
+			"other":              "value",
+		},
+	})
+	AssertEq(nil, err)
+
+	tf := t.newTempFile()
+
+	_, err = tf.WriteAt([]byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	// As if the process crashed.
+	_, err = t.journal.Recover(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq("640", o.Metadata[gcsx.ModeMetadataKey])
+	ExpectEq("1000", o.Metadata[gcsx.UIDMetadataKey])
+	ExpectEq("", o.Metadata["other"])
+}
+
+func (t *JournalTest) RecoverAfterSetSource() {
+	tf := t.newTempFile()
+
+	_, err := tf.WriteAt([]byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	// The file's mode is changed, giving a new metageneration.
+	mode := "600"
+	o, err := t.bucket.UpdateObject(t.ctx, &gcs.UpdateObjectRequest{
+		Name:     "foo",
+		Metadata: map[string]*string{gcsx.ModeMetadataKey: &mode},
+	})
+	AssertEq(nil, err)
+
+	err = tf.(gcsx.SourceRecorder).SetSource(o)
+	AssertEq(nil, err)
+
+	// As if the process crashed.
+	recovered, err := t.journal.Recover(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	ExpectEq(1, recovered)
+	ExpectEq("burrito", t.readObject())
+
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq("600", o.Metadata[gcsx.ModeMetadataKey])
+}
+
+func (t *JournalTest) RecoverTruncated() {
+	tf := t.newTempFile()
+
+	err := tf.Truncate(2)
+	AssertEq(nil, err)
+
+	_, err = t.journal.Recover(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	ExpectEq("ta", t.readObject())
+}
+
+func (t *JournalTest) RecoverConflict() {
+	tf := t.newTempFile()
+
+	_, err := tf.WriteAt([]byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	// Someone else modifies the object.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	recovered, err := t.journal.Recover(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	ExpectEq(0, recovered)
+	ExpectEq(0, len(t.files()))
+	ExpectEq("enchilada", t.readObject())
+
+	// Our copy is set aside.
+	entries, err := ioutil.ReadDir(path.Join(t.dir, "conflicts"))
+	AssertEq(nil, err)
+	ExpectEq(2, len(entries))
+}
+
+func (t *JournalTest) RecoverOtherBucket() {
+	tf := t.newTempFile()
+
+	_, err := tf.WriteAt([]byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	other := gcsfake.NewFakeBucket(&t.clock, "other_bucket")
+	recovered, err := t.journal.Recover(t.ctx, other)
+	AssertEq(nil, err)
+
+	ExpectEq(0, recovered)
+	ExpectEq(2, len(t.files()))
+}
+
+func (t *JournalTest) RecoverRemovesIncompleteFiles() {
+	err := ioutil.WriteFile(path.Join(t.dir, "file123"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.dir, "file123.json.tmp"), nil, 0600)
+	AssertEq(nil, err)
+
+	_, err = t.journal.Recover(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	ExpectThat(t.files(), ElementsAre())
+}
@@ -0,0 +1,358 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// The user metadata keys of a lease object recording who holds it and when it
+// expires unless renewed.
+const (
+	leaseHolderKey  = "gcsfuse_lease_holder"
+	leaseExpiresKey = "gcsfuse_lease_expires"
+)
+
+// How many times to try to create a lease object that keeps being created or
+// deleted by others between our attempts.
+const leaseMaxAttempts = 3
+
+// LeaseHeldError is returned by LeaseManager.Acquire when another client holds
+// an unexpired lease on the name.
+type LeaseHeldError struct {
+	Name    string
+	Holder  string
+	Expires time.Time
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf(
+		"%q is leased to %s until %v",
+		e.Name,
+		e.Holder,
+		e.Expires.Format(time.RFC3339))
+}
+
+// A LeaseManager coordinates writers of the same objects across clients by
+// means of lease objects in the bucket. A client wanting to write an object
+// first creates the lease object for its name, which succeeds only if no
+// other client holds it. Leases expire unless renewed, so that those of a
+// client that goes away are eventually taken over.
+//
+// Leases are advisory: they exclude only other clients using a LeaseManager
+// with the same prefix, not writers that ignore them.
+type LeaseManager struct {
+	bucket gcs.Bucket
+	prefix string
+	ttl    time.Duration
+	clock  timeutil.Clock
+
+	// Identifies this manager in the leases it holds, for the benefit of
+	// humans and of Acquire.
+	holder string
+
+	mu sync.Mutex
+
+	// The lease objects we hold, by the name they lease.
+	//
+	// GUARDED_BY(mu)
+	held map[string]*gcs.Object
+}
+
+// NewLeaseManager returns a manager for leases on objects in the supplied
+// bucket, stored as objects named by prepending the given prefix. Leases
+// expire ttl after they are acquired or last renewed.
+func NewLeaseManager(
+	bucket gcs.Bucket,
+	prefix string,
+	ttl time.Duration,
+	clock timeutil.Clock) (m *LeaseManager) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	// Distinguish managers in processes that share a host name and PID, e.g.
+	// in containers.
+	nonce := rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+
+	m = &LeaseManager{
+		bucket: bucket,
+		prefix: prefix,
+		ttl:    ttl,
+		clock:  clock,
+		holder: fmt.Sprintf("%s:%d:%08x", host, os.Getpid(), nonce),
+		held:   make(map[string]*gcs.Object),
+	}
+
+	return
+}
+
+// Holder returns the string identifying this manager in its leases.
+func (m *LeaseManager) Holder() string {
+	return m.holder
+}
+
+// Held returns the names currently leased by this manager.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LeaseManager) Held() (names []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name := range m.held {
+		names = append(names, name)
+	}
+
+	return
+}
+
+// Acquire a lease on the given object name, doing nothing if we already hold
+// one. Fails with *LeaseHeldError if another client holds an unexpired lease.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LeaseManager) Acquire(ctx context.Context, name string) (err error) {
+	m.mu.Lock()
+	_, ok := m.held[name]
+	m.mu.Unlock()
+
+	if ok {
+		return
+	}
+
+	// Create the lease object if nobody has, or replace it if its lease has
+	// expired. Either may race with another client doing the same, in which
+	// case we look again.
+	var precondition int64
+	for attempt := 0; attempt < leaseMaxAttempts; attempt++ {
+		var o *gcs.Object
+		o, err = m.create(ctx, name, precondition)
+		if err == nil {
+			m.mu.Lock()
+			m.held[name] = o
+			m.mu.Unlock()
+			return
+		}
+
+		if _, ok := err.(*gcs.PreconditionError); !ok {
+			err = fmt.Errorf("CreateObject: %v", err)
+			return
+		}
+
+		o, err = m.bucket.StatObject(
+			ctx,
+			&gcs.StatObjectRequest{Name: m.prefix + name})
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			precondition = 0
+			continue
+		}
+
+		if err != nil {
+			err = fmt.Errorf("StatObject: %v", err)
+			return
+		}
+
+		holder := o.Metadata[leaseHolderKey]
+		expires, _ := time.Parse(time.RFC3339Nano, o.Metadata[leaseExpiresKey])
+
+		// We may have raced with another acquisition of our own.
+		if holder == m.holder {
+			m.mu.Lock()
+			m.held[name] = o
+			m.mu.Unlock()
+			return
+		}
+
+		if m.clock.Now().Before(expires) {
+			err = &LeaseHeldError{
+				Name:    name,
+				Holder:  holder,
+				Expires: expires,
+			}
+
+			return
+		}
+
+		logger.Infof(
+			"Taking over lease on %q from %s, which expired at %v.",
+			name,
+			holder,
+			expires.Format(time.RFC3339))
+
+		precondition = o.Generation
+	}
+
+	err = fmt.Errorf("Lease on %q keeps changing; giving up", name)
+	return
+}
+
+// Create the lease object for the given name, replacing the given generation
+// of it or, if zero, only if it doesn't exist.
+func (m *LeaseManager) create(
+	ctx context.Context,
+	name string,
+	generation int64) (o *gcs.Object, err error) {
+	o, err = m.bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   m.prefix + name,
+			Contents:               strings.NewReader(""),
+			GenerationPrecondition: &generation,
+			Metadata: map[string]string{
+				leaseHolderKey:  m.holder,
+				leaseExpiresKey: m.expiry(),
+			},
+		})
+
+	return
+}
+
+// The expiry to record for a lease acquired or renewed now.
+func (m *LeaseManager) expiry() string {
+	return m.clock.Now().Add(m.ttl).UTC().Format(time.RFC3339Nano)
+}
+
+// Renew extends each lease we hold by the TTL. Leases that turn out to have
+// been taken over by another client, after expiring without being renewed in
+// time, are forgotten, so that a later Acquire will fail.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LeaseManager) Renew(ctx context.Context) {
+	m.mu.Lock()
+	held := make(map[string]*gcs.Object, len(m.held))
+	for name, o := range m.held {
+		held[name] = o
+	}
+	m.mu.Unlock()
+
+	for name, o := range held {
+		expires := m.expiry()
+		renewed, err := m.bucket.UpdateObject(
+			ctx,
+			&gcs.UpdateObjectRequest{
+				Name:                       o.Name,
+				Generation:                 o.Generation,
+				MetaGenerationPrecondition: &o.MetaGeneration,
+				Metadata: map[string]*string{
+					leaseExpiresKey: &expires,
+				},
+			})
+
+		_, notFound := err.(*gcs.NotFoundError)
+		_, precondition := err.(*gcs.PreconditionError)
+
+		switch {
+		case notFound || precondition:
+			logger.Warningf("Lost lease on %q: %v", name, err)
+			renewed = nil
+
+		case err != nil:
+			logger.Warningf("Renewing lease on %q: %v", name, err)
+			continue
+		}
+
+		// Don't resurrect a lease released while we were renewing it.
+		m.mu.Lock()
+		if m.held[name] == o {
+			if renewed == nil {
+				delete(m.held, name)
+			} else {
+				m.held[name] = renewed
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// RenewPeriodically calls Renew every period until the context is cancelled.
+// The period should be well under the TTL.
+func (m *LeaseManager) RenewPeriodically(
+	ctx context.Context,
+	period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		m.Renew(ctx)
+	}
+}
+
+// Release the lease on the given name, if we hold one, by deleting its lease
+// object unless another client has since taken it over.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LeaseManager) Release(ctx context.Context, name string) (err error) {
+	m.mu.Lock()
+	o, ok := m.held[name]
+	delete(m.held, name)
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	err = m.bucket.DeleteObject(
+		ctx,
+		&gcs.DeleteObjectRequest{
+			Name:                       o.Name,
+			Generation:                 o.Generation,
+			MetaGenerationPrecondition: &o.MetaGeneration,
+		})
+
+	switch err.(type) {
+	case nil:
+
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		err = nil
+
+	default:
+		err = fmt.Errorf("DeleteObject: %v", err)
+	}
+
+	return
+}
+
+// ReleaseAll releases every lease we hold, e.g. at unmount, returning the
+// first error encountered.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *LeaseManager) ReleaseAll(ctx context.Context) (err error) {
+	for _, name := range m.Held() {
+		if releaseErr := m.Release(ctx, name); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}
+
+	return
+}
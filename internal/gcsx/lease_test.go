@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestLease(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	leasePrefix = ".gcsfuse_leases/"
+	leaseTTL    = time.Minute
+)
+
+type LeaseTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+
+	// Two clients sharing the bucket.
+	ours   *gcsx.LeaseManager
+	theirs *gcsx.LeaseManager
+}
+
+func init() { RegisterTestSuite(&LeaseTest{}) }
+
+func (t *LeaseTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.ours = gcsx.NewLeaseManager(t.bucket, leasePrefix, leaseTTL, &t.clock)
+	t.theirs = gcsx.NewLeaseManager(t.bucket, leasePrefix, leaseTTL, &t.clock)
+}
+
+func (t *LeaseTest) leaseObject(name string) (o *gcs.Object, err error) {
+	o, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: leasePrefix + name})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LeaseTest) AcquireCreatesLeaseObject() {
+	AssertEq(nil, t.ours.Acquire(t.ctx, "foo"))
+
+	o, err := t.leaseObject("foo")
+	AssertEq(nil, err)
+	ExpectEq(t.ours.Holder(), o.Metadata["gcsfuse_lease_holder"])
+	ExpectThat(t.ours.Held(), ElementsAre("foo"))
+}
+
+func (t *LeaseTest) AcquireTwice() {
+	AssertEq(nil, t.ours.Acquire(t.ctx, "foo"))
+	AssertEq(nil, t.ours.Acquire(t.ctx, "foo"))
+
+	ExpectThat(t.ours.Held(), ElementsAre("foo"))
+}
+
+func (t *LeaseTest) HeldByOther() {
+	AssertEq(nil, t.theirs.Acquire(t.ctx, "foo"))
+
+	err := t.ours.Acquire(t.ctx, "foo")
+	held, ok := err.(*gcsx.LeaseHeldError)
+	AssertTrue(ok, "%v", err)
+
+	ExpectEq("foo", held.Name)
+	ExpectEq(t.theirs.Holder(), held.Holder)
+	ExpectEq(0, len(t.ours.Held()))
+}
+
+func (t *LeaseTest) DifferentNames() {
+	AssertEq(nil, t.theirs.Acquire(t.ctx, "foo"))
+	ExpectEq(nil, t.ours.Acquire(t.ctx, "bar"))
+}
+
+func (t *LeaseTest) TakesOverExpiredLease() {
+	AssertEq(nil, t.theirs.Acquire(t.ctx, "foo"))
+
+	t.clock.AdvanceTime(leaseTTL + time.Second)
+	AssertEq(nil, t.ours.Acquire(t.ctx, "foo"))
+
+	o, err := t.leaseObject("foo")
+	AssertEq(nil, err)
+	ExpectEq(t.ours.Holder(), o.Metadata["gcsfuse_lease_holder"])
+
+	// The previous holder finds out when it next renews.
+	t.theirs.Renew(t.ctx)
+	ExpectEq(0, len(t.theirs.Held()))
+
+	err = t.theirs.Acquire(t.ctx, "foo")
+	ExpectThat(err, Error(HasSubstr(t.ours.Holder())))
+}
+
+func (t *LeaseTest) RenewExtendsLease() {
+	AssertEq(nil, t.theirs.Acquire(t.ctx, "foo"))
+
+	t.clock.AdvanceTime(leaseTTL / 2)
+	t.theirs.Renew(t.ctx)
+
+	t.clock.AdvanceTime(leaseTTL/2 + time.Second)
+	_, ok := t.ours.Acquire(t.ctx, "foo").(*gcsx.LeaseHeldError)
+	ExpectTrue(ok)
+	ExpectThat(t.theirs.Held(), ElementsAre("foo"))
+}
+
+func (t *LeaseTest) Release() {
+	AssertEq(nil, t.theirs.Acquire(t.ctx, "foo"))
+	AssertEq(nil, t.theirs.Release(t.ctx, "foo"))
+
+	_, err := t.leaseObject("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(0, len(t.theirs.Held()))
+
+	ExpectEq(nil, t.ours.Acquire(t.ctx, "foo"))
+}
+
+func (t *LeaseTest) ReleaseAfterTakeover() {
+	AssertEq(nil, t.theirs.Acquire(t.ctx, "foo"))
+
+	t.clock.AdvanceTime(leaseTTL + time.Second)
+	AssertEq(nil, t.ours.Acquire(t.ctx, "foo"))
+
+	// Releasing the stale lease mustn't delete the new one.
+	AssertEq(nil, t.theirs.Release(t.ctx, "foo"))
+
+	o, err := t.leaseObject("foo")
+	AssertEq(nil, err)
+	ExpectEq(t.ours.Holder(), o.Metadata["gcsfuse_lease_holder"])
+}
+
+func (t *LeaseTest) ReleaseAll() {
+	AssertEq(nil, t.ours.Acquire(t.ctx, "foo"))
+	AssertEq(nil, t.ours.Acquire(t.ctx, "bar"))
+	AssertEq(nil, t.ours.ReleaseAll(t.ctx))
+
+	ExpectEq(0, len(t.ours.Held()))
+	ExpectEq(nil, t.theirs.Acquire(t.ctx, "foo"))
+	ExpectEq(nil, t.theirs.Acquire(t.ctx, "bar"))
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// The most results that may be asked for in a page of a listing.
+const MaxListPageSize = 5000
+
+// Projections that may be asked for in listings: the full metadata of each
+// object, or all of it but the ACL, which is smaller.
+const (
+	ListProjectionFull  = "full"
+	ListProjectionNoACL = "noAcl"
+)
+
+// NewListingRoundTripper returns a round tripper that modifies requests to
+// list the objects in a bucket, asking for pages of the given size unless the
+// request already says, and for the given projection. A page size of zero or
+// an empty projection leaves the default chosen by package gcs. Other requests
+// are passed through unmodified.
+func NewListingRoundTripper(
+	pageSize int,
+	projection string,
+	wrapped httputil.CancellableRoundTripper) (
+	rt httputil.CancellableRoundTripper,
+	err error) {
+	if pageSize < 0 || pageSize > MaxListPageSize {
+		err = fmt.Errorf(
+			"Page size %d is out of range; want 1 to %d",
+			pageSize,
+			MaxListPageSize)
+		return
+	}
+
+	switch projection {
+	case "", ListProjectionFull, ListProjectionNoACL:
+	default:
+		err = fmt.Errorf(
+			"Unknown projection %q; want %s or %s",
+			projection,
+			ListProjectionFull,
+			ListProjectionNoACL)
+		return
+	}
+
+	l := &listingRewriter{
+		pageSize:   pageSize,
+		projection: projection,
+	}
+
+	rt = newRewritingRoundTripper(l.rewrite, wrapped)
+	return
+}
+
+type listingRewriter struct {
+	pageSize   int
+	projection string
+}
+
+func (l *listingRewriter) rewrite(
+	req *http.Request) (modified *http.Request, err error) {
+	// Bucket names can't contain slashes, so only listings end in "/o".
+	if req.Method != "GET" || !strings.HasSuffix(requestPath(req.URL), "/o") {
+		modified = req
+		return
+	}
+
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		err = fmt.Errorf("ParseQuery: %v", err)
+		return
+	}
+
+	if l.pageSize != 0 && query.Get("maxResults") == "" {
+		query.Set("maxResults", fmt.Sprint(l.pageSize))
+	}
+
+	if l.projection != "" {
+		query.Set("projection", l.projection)
+	}
+
+	// Make a copy of the request with the new query.
+	u := *req.URL
+	u.RawQuery = query.Encode()
+
+	modified = new(http.Request)
+	*modified = *req
+	modified.URL = &u
+
+	return
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestListing(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ListingTest struct {
+	wrapped capturingRoundTripper
+}
+
+func init() { RegisterTestSuite(&ListingTest{}) }
+
+// Send a request with the given method and opaque URL and query through a
+// round tripper with the given settings, returning the query received by the
+// wrapped round tripper.
+func (t *ListingTest) send(
+	pageSize int,
+	projection string,
+	method string,
+	opaque string,
+	rawQuery string) url.Values {
+	rt, err := gcsx.NewListingRoundTripper(pageSize, projection, &t.wrapped)
+	AssertEq(nil, err)
+
+	req := &http.Request{
+		Method: method,
+		URL: &url.URL{
+			Scheme:   "https",
+			Host:     "www.googleapis.com",
+			Opaque:   opaque,
+			RawQuery: rawQuery,
+		},
+		Header: make(http.Header),
+	}
+
+	_, err = rt.RoundTrip(req)
+	AssertEq(nil, err)
+	AssertEq(1, len(t.wrapped.requests))
+
+	// The original request must not be modified.
+	ExpectEq(rawQuery, req.URL.RawQuery)
+
+	received := t.wrapped.requests[0]
+	t.wrapped.requests = nil
+
+	query, err := url.ParseQuery(received.URL.RawQuery)
+	AssertEq(nil, err)
+	return query
+}
+
+const listingOpaque = "//www.googleapis.com/storage/v1/b/some_bucket/o"
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ListingTest) PageSizeAndProjection() {
+	query := t.send(
+		5000,
+		gcsx.ListProjectionNoACL,
+		"GET",
+		listingOpaque,
+		"delimiter=%2F&projection=full")
+
+	ExpectEq("5000", query.Get("maxResults"))
+	ExpectEq("noAcl", query.Get("projection"))
+	ExpectEq("/", query.Get("delimiter"))
+}
+
+func (t *ListingTest) ExplicitPageSizeKept() {
+	query := t.send(5000, "", "GET", listingOpaque, "maxResults=1&projection=full")
+
+	ExpectEq("1", query.Get("maxResults"))
+	ExpectEq("full", query.Get("projection"))
+}
+
+func (t *ListingTest) DefaultsLeftAlone() {
+	query := t.send(0, "", "GET", listingOpaque, "projection=full")
+
+	ExpectEq("", query.Get("maxResults"))
+	ExpectEq("full", query.Get("projection"))
+}
+
+func (t *ListingTest) OtherRequestsUnmodified() {
+	for _, tc := range []struct {
+		method string
+		opaque string
+	}{
+		{"GET", "//www.googleapis.com/storage/v1/b/some_bucket/o/foo"},
+		{"GET", "//www.googleapis.com/storage/v1/b/some_bucket"},
+		{"POST", "//www.googleapis.com/upload/storage/v1/b/some_bucket/o"},
+	} {
+		query := t.send(
+			5000,
+			gcsx.ListProjectionNoACL,
+			tc.method,
+			tc.opaque,
+			"projection=full")
+
+		ExpectEq("", query.Get("maxResults"), "%s %s", tc.method, tc.opaque)
+		ExpectEq("full", query.Get("projection"), "%s %s", tc.method, tc.opaque)
+	}
+}
+
+func (t *ListingTest) IllegalSettings() {
+	_, err := gcsx.NewListingRoundTripper(5001, "", &t.wrapped)
+	ExpectThat(err, Error(HasSubstr("out of range")))
+
+	_, err = gcsx.NewListingRoundTripper(-1, "", &t.wrapped)
+	ExpectThat(err, Error(HasSubstr("out of range")))
+
+	_, err = gcsx.NewListingRoundTripper(0, "taco", &t.wrapped)
+	ExpectThat(err, Error(HasSubstr("Unknown projection")))
+}
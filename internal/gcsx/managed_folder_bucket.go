@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// NewManagedFolderBucket wraps a bucket so that its managed folders, and the
+// directories leading to them, show up as directories even when there is no
+// object for them and nothing in them: stats of a name ending in a slash find
+// a managed folder with that name or within it if there is no object, and
+// listings with a "/" delimiter include such directories as collapsed runs.
+//
+// Directories are presented as objects with no contents, with the generation
+// and times of the managed folder found for them.
+//
+// When the account in use may read only some managed folders, GCS refuses to
+// stat objects outside of them. A stat of a name that GCS refuses, but that is
+// also the name of a managed folder without the slash, fails with
+// *gcs.NotFoundError instead, so that the folder can be looked up. Other
+// refusals are passed through, so that directories that may not be read fail
+// with a permission error rather than appearing empty.
+func NewManagedFolderBucket(
+	folders ManagedFolders,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &managedFolderBucket{
+		Bucket:  wrapped,
+		folders: folders,
+	}
+
+	return
+}
+
+type managedFolderBucket struct {
+	gcs.Bucket
+	folders ManagedFolders
+}
+
+func isForbidden(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusForbidden
+}
+
+func (b *managedFolderBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+
+	switch {
+	case isFolderName(req.Name):
+		if _, ok := err.(*gcs.NotFoundError); !ok {
+			return
+		}
+
+		f, mErr := b.folders.FindManagedFolder(ctx, req.Name)
+		if mErr != nil {
+			if _, ok := mErr.(*gcs.NotFoundError); !ok {
+				err = fmt.Errorf("FindManagedFolder: %v", mErr)
+			}
+
+			return
+		}
+
+		o = folderObject(f)
+		o.Name = req.Name
+		err = nil
+
+	case isForbidden(err):
+		_, mErr := b.folders.FindManagedFolder(ctx, req.Name+"/")
+		if mErr == nil {
+			err = &gcs.NotFoundError{Err: err}
+		}
+	}
+
+	return
+}
+
+func (b *managedFolderBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	if req.Delimiter != "/" || !(req.Prefix == "" || isFolderName(req.Prefix)) {
+		return
+	}
+
+	names, err := b.folders.ListManagedFolders(ctx, req.Prefix)
+	if err != nil {
+		err = fmt.Errorf("ListManagedFolders: %v", err)
+		return
+	}
+
+	// Add the directories to the first page, and make sure none shows up again
+	// on later ones.
+	folders := make(map[string]struct{})
+	for _, n := range names {
+		folders[n] = struct{}{}
+	}
+
+	var runs []string
+	for _, r := range l.CollapsedRuns {
+		if _, ok := folders[r]; !ok {
+			runs = append(runs, r)
+		}
+	}
+
+	if req.ContinuationToken == "" {
+		runs = append(runs, names...)
+		sort.Strings(runs)
+	}
+
+	l.CollapsedRuns = runs
+	return
+}
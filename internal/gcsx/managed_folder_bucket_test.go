@@ -0,0 +1,269 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"google.golang.org/api/googleapi"
+)
+
+func TestManagedFolderBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// An in-memory set of managed folders.
+type fakeManagedFolders struct {
+	folders map[string]*gcsx.Folder
+}
+
+func (f *fakeManagedFolders) FindManagedFolder(
+	ctx context.Context,
+	name string) (folder *gcsx.Folder, err error) {
+	var names []string
+	for n := range f.folders {
+		if strings.HasPrefix(n, name) {
+			names = append(names, n)
+		}
+	}
+
+	if len(names) == 0 {
+		err = &gcs.NotFoundError{Err: errors.New(name)}
+		return
+	}
+
+	sort.Strings(names)
+	folder = f.folders[names[0]]
+	return
+}
+
+func (f *fakeManagedFolders) ListManagedFolders(
+	ctx context.Context,
+	parent string) (names []string, err error) {
+	children := make(map[string]struct{})
+	for name := range f.folders {
+		rest := strings.TrimPrefix(name, parent)
+		if !strings.HasPrefix(name, parent) || rest == "" {
+			continue
+		}
+
+		children[parent+rest[:strings.Index(rest, "/")+1]] = struct{}{}
+	}
+
+	for name := range children {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// A bucket that refuses to stat objects whose names don't begin with one of
+// the allowed prefixes, as GCS does for an account that may read only some
+// managed folders.
+type forbiddingBucket struct {
+	gcs.Bucket
+	allowed []string
+}
+
+func (b *forbiddingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	for _, p := range b.allowed {
+		if strings.HasPrefix(req.Name, p) {
+			o, err = b.Bucket.StatObject(ctx, req)
+			return
+		}
+	}
+
+	err = &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "does not have storage.objects.get access",
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ManagedFolderBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	folders fakeManagedFolders
+	wrapped forbiddingBucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &ManagedFolderBucketTest{}
+
+func init() { RegisterTestSuite(&ManagedFolderBucketTest{}) }
+
+func (t *ManagedFolderBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.folders.folders = make(map[string]*gcsx.Folder)
+
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.wrapped.allowed = []string{""}
+	t.bucket = gcsx.NewManagedFolderBucket(&t.folders, &t.wrapped)
+}
+
+func (t *ManagedFolderBucketTest) createFolder(name string) {
+	t.folders.folders[name] = &gcsx.Folder{
+		Name:           name,
+		MetaGeneration: 1,
+		Created:        t.clock.Now(),
+		Updated:        t.clock.Now(),
+	}
+}
+
+func (t *ManagedFolderBucketTest) createObjects(names ...string) {
+	for _, name := range names {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, name, []byte("taco"))
+		AssertEq(nil, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ManagedFolderBucketTest) StatFolder() {
+	t.createFolder("foo/")
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	AssertEq(nil, err)
+	ExpectEq("foo/", o.Name)
+	ExpectEq(0, o.Size)
+	ExpectEq(t.clock.Now().UnixNano(), o.Generation)
+}
+
+func (t *ManagedFolderBucketTest) StatDirectoryLeadingToFolder() {
+	t.createFolder("foo/bar/baz/")
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	AssertEq(nil, err)
+	ExpectEq("foo/", o.Name)
+	ExpectEq(0, o.Size)
+}
+
+func (t *ManagedFolderBucketTest) StatFolderWithObject() {
+	t.createFolder("foo/")
+	t.createObjects("foo/")
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), o.Size)
+}
+
+func (t *ManagedFolderBucketTest) StatMissing() {
+	t.createFolder("foo/")
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar/"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *ManagedFolderBucketTest) StatForbidden() {
+	t.wrapped.allowed = []string{"foo/"}
+	t.createFolder("foo/")
+	t.createObjects("foo/bar", "baz")
+
+	// The name of a folder the account may read is simply missing as a file.
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/bar"})
+	ExpectEq(nil, err)
+
+	// Other names can't be read.
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "baz"})
+	ExpectThat(err, HasSameTypeAs(&googleapi.Error{}))
+}
+
+func (t *ManagedFolderBucketTest) ListIncludesEmptyFolders() {
+	t.createFolder("foo/bar/")
+	t.createFolder("foo/qux/taco/")
+	t.createObjects("foo/baz", "foo/bar/x")
+
+	l, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{
+		Prefix:    "foo/",
+		Delimiter: "/",
+	})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(l.Objects))
+	ExpectEq("foo/baz", l.Objects[0].Name)
+	ExpectThat(l.CollapsedRuns, ElementsAre("foo/bar/", "foo/qux/"))
+}
+
+func (t *ManagedFolderBucketTest) ListWithoutDelimiter() {
+	t.createFolder("foo/")
+	t.createObjects("bar")
+
+	l, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	AssertEq(1, len(l.Objects))
+	ExpectEq("bar", l.Objects[0].Name)
+	ExpectEq(0, len(l.CollapsedRuns))
+}
+
+func (t *ManagedFolderBucketTest) ListFoldersOnlyOnFirstPage() {
+	t.createFolder("a/")
+	t.createFolder("c/")
+	t.createObjects("a/x", "b/x", "c/x", "d")
+
+	// Read every page, one result at a time.
+	var runs []string
+	var tok string
+	for {
+		l, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{
+			Delimiter:         "/",
+			ContinuationToken: tok,
+			MaxResults:        1,
+		})
+
+		AssertEq(nil, err)
+		runs = append(runs, l.CollapsedRuns...)
+
+		tok = l.ContinuationToken
+		if tok == "" {
+			break
+		}
+	}
+
+	sort.Strings(runs)
+	ExpectThat(runs, ElementsAre("a/", "b/", "c/"))
+}
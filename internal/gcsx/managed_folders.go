@@ -0,0 +1,171 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// ManagedFolders reads the managed folders of a bucket, which hold IAM
+// policies for the objects whose names begin with theirs. Unlike the folders
+// of a bucket with a hierarchical namespace they may be created in any bucket,
+// and needn't contain any objects.
+type ManagedFolders interface {
+	// Return the managed folder with the given name, which must end in a
+	// slash, or if there is none the first one within it. Fail with
+	// *gcs.NotFoundError if there is neither.
+	FindManagedFolder(ctx context.Context, name string) (f *Folder, err error)
+
+	// List the names of the directories directly within the given one, or at
+	// the top of the bucket if it is empty, that are or contain managed
+	// folders.
+	ListManagedFolders(
+		ctx context.Context,
+		parent string) (names []string, err error)
+}
+
+// HasManagedFolders reports whether the named bucket has any managed folders
+// whose names begin with prefix, sending the request using the supplied
+// client, which must add credentials.
+func HasManagedFolders(
+	ctx context.Context,
+	client *http.Client,
+	bucketName string,
+	prefix string,
+	userAgent string) (has bool, err error) {
+	f := &httpFolders{
+		client:     client,
+		bucketName: bucketName,
+		userAgent:  userAgent,
+	}
+
+	query := make(url.Values)
+	query.Set("prefix", prefix)
+	query.Set("pageSize", "1")
+
+	var page struct {
+		Items []folderResource `json:"items"`
+	}
+
+	err = f.do(ctx, "GET", "managedFolders", query, nil, &page)
+	if err != nil {
+		return
+	}
+
+	has = len(page.Items) != 0
+	return
+}
+
+// NewManagedFolders returns ManagedFolders for the named bucket that sends
+// requests using the supplied client, which must add credentials. Folder
+// names are relative to prefix, which must be empty or end in a slash.
+func NewManagedFolders(
+	client *http.Client,
+	bucketName string,
+	prefix string,
+	userAgent string) ManagedFolders {
+	return &httpManagedFolders{
+		httpFolders{
+			client:     client,
+			bucketName: bucketName,
+			prefix:     prefix,
+			userAgent:  userAgent,
+		},
+	}
+}
+
+// Managed folders are resources much like folders, and are represented the
+// same way in the JSON API.
+type httpManagedFolders struct {
+	httpFolders
+}
+
+func (f *httpManagedFolders) FindManagedFolder(
+	ctx context.Context,
+	name string) (folder *Folder, err error) {
+	// Folders are listed in order, so the named one comes first if it exists.
+	query := make(url.Values)
+	query.Set("prefix", f.prefix+name)
+	query.Set("pageSize", "1")
+
+	var page struct {
+		Items []folderResource `json:"items"`
+	}
+
+	err = f.do(ctx, "GET", "managedFolders", query, nil, &page)
+	if err != nil {
+		return
+	}
+
+	if len(page.Items) == 0 {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("No managed folder within %q", name),
+		}
+
+		return
+	}
+
+	folder, err = f.toFolder(&page.Items[0])
+	return
+}
+
+func (f *httpManagedFolders) ListManagedFolders(
+	ctx context.Context,
+	parent string) (names []string, err error) {
+	// Managed folders can't be listed with a delimiter, so list all of those
+	// beneath the parent and keep the first component of each name.
+	query := make(url.Values)
+	query.Set("prefix", f.prefix+parent)
+
+	children := make(map[string]struct{})
+	for {
+		var page struct {
+			Items         []folderResource `json:"items"`
+			NextPageToken string           `json:"nextPageToken"`
+		}
+
+		err = f.do(ctx, "GET", "managedFolders", query, nil, &page)
+		if err != nil {
+			return
+		}
+
+		for _, r := range page.Items {
+			rest := strings.TrimPrefix(r.Name, f.prefix+parent)
+			if i := strings.Index(rest, "/"); i > 0 {
+				children[parent+rest[:i+1]] = struct{}{}
+			}
+		}
+
+		if page.NextPageToken == "" {
+			break
+		}
+
+		query.Set("pageToken", page.NextPageToken)
+	}
+
+	for name := range children {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"expvar"
+	"sync"
+)
+
+// The number of bytes reserved from memory budgets in this process.
+var memoryBudgetUsed = expvar.NewInt("memory_budget_used_bytes")
+
+// MemoryBudget accounts for memory shared by several users, such as read
+// buffers and writes staged in memory, so that together they stay within a
+// limit. Users that can do without the memory, by reading ahead less or by
+// moving data to disk, ask for it with TryReserve and back off when refused.
+// Those that can't use Reserve, which may take the total over the limit.
+//
+// A nil *MemoryBudget is unlimited: every reservation succeeds and nothing is
+// counted.
+//
+// Safe for concurrent access.
+type MemoryBudget struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	maxBytes int64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The number of bytes currently reserved.
+	//
+	// INVARIANT: usedBytes >= 0
+	//
+	// GUARDED_BY(mu)
+	usedBytes int64
+}
+
+// NewMemoryBudget creates a budget of maxBytes.
+func NewMemoryBudget(maxBytes int64) (mb *MemoryBudget) {
+	mb = &MemoryBudget{
+		maxBytes: maxBytes,
+	}
+
+	return
+}
+
+// TryReserve sets aside n bytes if that keeps the total within the limit,
+// returning false otherwise.
+func (mb *MemoryBudget) TryReserve(n int64) (ok bool) {
+	if mb == nil {
+		ok = true
+		return
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.usedBytes+n > mb.maxBytes {
+		return
+	}
+
+	mb.usedBytes += n
+	memoryBudgetUsed.Add(n)
+	ok = true
+
+	return
+}
+
+// Reserve sets aside n bytes, even if that takes the total over the limit.
+func (mb *MemoryBudget) Reserve(n int64) {
+	if mb == nil {
+		return
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.usedBytes += n
+	memoryBudgetUsed.Add(n)
+}
+
+// Release gives back n bytes set aside by TryReserve or Reserve.
+func (mb *MemoryBudget) Release(n int64) {
+	if mb == nil {
+		return
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.usedBytes -= n
+	memoryBudgetUsed.Add(-n)
+}
+
+// UsedBytes returns the number of bytes currently set aside.
+func (mb *MemoryBudget) UsedBytes() (n int64) {
+	if mb == nil {
+		return
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	n = mb.usedBytes
+	return
+}
@@ -0,0 +1,353 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/jacobsa/fuse/fsutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// MemoryStaging creates temp files whose contents are held in memory rather
+// than on disk, up to a limit on the total size of all of them. A temp file
+// that would take the total over the limit, or for which the memory budget
+// has no room, is moved to disk, where it stays.
+//
+// Safe for concurrent access.
+type MemoryStaging struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	maxBytes int64
+	dir      string
+	budget   *MemoryBudget
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The total size of the contents of temp files held in memory.
+	//
+	// INVARIANT: 0 <= usedBytes <= maxBytes
+	//
+	// GUARDED_BY(mu)
+	usedBytes int64
+}
+
+// NewMemoryStaging creates a MemoryStaging holding up to maxBytes in memory.
+// Temp files that don't fit are moved to dir, or to the system default
+// temporary location if empty. The memory is also reserved from budget, which
+// may be nil.
+func NewMemoryStaging(
+	maxBytes int64,
+	dir string,
+	budget *MemoryBudget) (ms *MemoryStaging) {
+	ms = &MemoryStaging{
+		maxBytes: maxBytes,
+		dir:      dir,
+		budget:   budget,
+	}
+
+	return
+}
+
+// NewTempFile creates a temp file as with the package-level function, but
+// held in memory while there is room.
+func (ms *MemoryStaging) NewTempFile(
+	content io.Reader,
+	clock timeutil.Clock) (tf TempFile, err error) {
+	mf := &memoryFile{staging: ms}
+
+	tf, err = newTempFile(mf, content, clock)
+	if err != nil {
+		mf.Close()
+		return
+	}
+
+	return
+}
+
+// Return the number of bytes currently held in memory.
+func (ms *MemoryStaging) UsedBytes() int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.usedBytes
+}
+
+// Set aside n more bytes of memory, returning false if there's no room.
+func (ms *MemoryStaging) reserve(n int64) (ok bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.usedBytes+n > ms.maxBytes {
+		return
+	}
+
+	if !ms.budget.TryReserve(n) {
+		return
+	}
+
+	ms.usedBytes += n
+	ok = true
+	return
+}
+
+// Give back n bytes previously set aside with reserve.
+func (ms *MemoryStaging) release(n int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.usedBytes -= n
+	ms.budget.Release(n)
+}
+
+////////////////////////////////////////////////////////////////////////
+// memoryFile
+////////////////////////////////////////////////////////////////////////
+
+// A tempFileStorage that holds its contents in memory until the staging it
+// belongs to runs out of room, and in an anonymous file from then on.
+type memoryFile struct {
+	staging *MemoryStaging
+
+	// The contents and seek position while in memory. The length of buf is
+	// reserved from staging.
+	buf []byte
+	pos int64
+
+	// The file holding the contents once moved to disk, or nil if they are
+	// still in memory.
+	spilled *os.File
+}
+
+var _ tempFileStorage = &memoryFile{}
+
+func (mf *memoryFile) Read(p []byte) (n int, err error) {
+	if mf.spilled != nil {
+		return mf.spilled.Read(p)
+	}
+
+	n, err = mf.ReadAt(p, mf.pos)
+	mf.pos += int64(n)
+
+	// Like os.File, don't report EOF along with data.
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+func (mf *memoryFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if mf.spilled != nil {
+		return mf.spilled.ReadAt(p, off)
+	}
+
+	if off < 0 {
+		err = errors.New("negative offset")
+		return
+	}
+
+	if off >= int64(len(mf.buf)) {
+		err = io.EOF
+		return
+	}
+
+	n = copy(p, mf.buf[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+func (mf *memoryFile) Seek(offset int64, whence int) (pos int64, err error) {
+	if mf.spilled != nil {
+		return mf.spilled.Seek(offset, whence)
+	}
+
+	switch whence {
+	case 0:
+		pos = offset
+
+	case 1:
+		pos = mf.pos + offset
+
+	case 2:
+		pos = int64(len(mf.buf)) + offset
+
+	default:
+		err = fmt.Errorf("invalid whence: %d", whence)
+		return
+	}
+
+	if pos < 0 {
+		err = errors.New("negative position")
+		return
+	}
+
+	mf.pos = pos
+	return
+}
+
+func (mf *memoryFile) Write(p []byte) (n int, err error) {
+	if mf.spilled != nil {
+		return mf.spilled.Write(p)
+	}
+
+	n, err = mf.WriteAt(p, mf.pos)
+	mf.pos += int64(n)
+
+	return
+}
+
+func (mf *memoryFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if mf.spilled != nil {
+		return mf.spilled.WriteAt(p, off)
+	}
+
+	if off < 0 {
+		err = errors.New("negative offset")
+		return
+	}
+
+	// Make room, moving to disk if there isn't enough.
+	end := off + int64(len(p))
+	if end > int64(len(mf.buf)) {
+		err = mf.resize(end)
+		if err != nil {
+			return
+		}
+
+		if mf.spilled != nil {
+			return mf.spilled.WriteAt(p, off)
+		}
+	}
+
+	n = copy(mf.buf[off:], p)
+	return
+}
+
+func (mf *memoryFile) Truncate(size int64) (err error) {
+	if mf.spilled != nil {
+		return mf.spilled.Truncate(size)
+	}
+
+	if size < 0 {
+		err = errors.New("negative size")
+		return
+	}
+
+	err = mf.resize(size)
+	if err != nil {
+		return
+	}
+
+	if mf.spilled != nil {
+		return mf.spilled.Truncate(size)
+	}
+
+	return
+}
+
+func (mf *memoryFile) Close() (err error) {
+	if mf.spilled != nil {
+		return mf.spilled.Close()
+	}
+
+	mf.staging.release(int64(len(mf.buf)))
+	mf.buf = nil
+
+	return
+}
+
+// Change the size of the contents in memory, zero-filling any new bytes. If
+// the staging has no room, move the contents to disk instead and leave it to
+// the caller to act on mf.spilled.
+func (mf *memoryFile) resize(size int64) (err error) {
+	old := int64(len(mf.buf))
+	if size <= old {
+		mf.buf = mf.buf[:size]
+		mf.staging.release(old - size)
+		return
+	}
+
+	if !mf.staging.reserve(size - old) {
+		err = mf.spill()
+		if err != nil {
+			err = fmt.Errorf("spill: %v", err)
+			return
+		}
+
+		return
+	}
+
+	// Grow in place if we can, zeroing bytes left over from before a shrink.
+	if size <= int64(cap(mf.buf)) {
+		mf.buf = mf.buf[:size]
+		for i := old; i < size; i++ {
+			mf.buf[i] = 0
+		}
+
+		return
+	}
+
+	// Otherwise at least double the capacity, so that a file written
+	// sequentially isn't copied for each write.
+	newCap := 2 * int64(cap(mf.buf))
+	if newCap < size {
+		newCap = size
+	}
+
+	buf := make([]byte, size, newCap)
+	copy(buf, mf.buf)
+	mf.buf = buf
+
+	return
+}
+
+// Move the contents to an anonymous file, giving back their memory.
+func (mf *memoryFile) spill() (err error) {
+	f, err := fsutil.AnonymousFile(mf.staging.dir)
+	if err != nil {
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	_, err = f.Write(mf.buf)
+	if err == nil {
+		_, err = f.Seek(mf.pos, 0)
+	}
+
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	mf.staging.release(int64(len(mf.buf)))
+	mf.buf = nil
+	mf.spilled = f
+
+	return
+}
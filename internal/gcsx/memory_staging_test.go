@@ -0,0 +1,178 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestMemoryStaging(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const memoryStagingMaxBytes = 32
+
+// The shared memory budget, larger than the staging's own limit.
+const memoryStagingBudget = 48
+
+type MemoryStagingTest struct {
+	clock   timeutil.SimulatedClock
+	budget  *gcsx.MemoryBudget
+	staging *gcsx.MemoryStaging
+
+	tf checkingTempFile
+}
+
+func init() { RegisterTestSuite(&MemoryStagingTest{}) }
+
+var _ SetUpInterface = &MemoryStagingTest{}
+
+func (t *MemoryStagingTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.budget = gcsx.NewMemoryBudget(memoryStagingBudget)
+	t.staging = gcsx.NewMemoryStaging(
+		memoryStagingMaxBytes,
+		"",
+		t.budget)
+
+	t.tf.wrapped, err = t.staging.NewTempFile(
+		strings.NewReader(initialContent),
+		&t.clock)
+
+	AssertEq(nil, err)
+}
+
+func (t *MemoryStagingTest) contents() string {
+	b, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	return string(b)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MemoryStagingTest) InitialContentInMemory() {
+	ExpectEq(initialContentSize, t.staging.UsedBytes())
+	ExpectEq(initialContent, t.contents())
+
+	sr, err := t.tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize, sr.Size)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+	ExpectEq(nil, sr.Mtime)
+}
+
+func (t *MemoryStagingTest) WritePastEnd() {
+	n, err := t.tf.WriteAt([]byte("queso"), int64(initialContentSize+2))
+	AssertEq(nil, err)
+	ExpectEq(5, n)
+
+	ExpectEq(initialContentSize+7, t.staging.UsedBytes())
+	ExpectEq(initialContent+"\x00\x00queso", t.contents())
+
+	sr, err := t.tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize+7, sr.Size)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+}
+
+func (t *MemoryStagingTest) TruncateThenGrow() {
+	AssertEq(nil, t.tf.Truncate(4))
+	ExpectEq(4, t.staging.UsedBytes())
+	ExpectEq("taco", t.contents())
+
+	// Growing again doesn't bring back the old contents.
+	AssertEq(nil, t.tf.Truncate(6))
+	ExpectEq(6, t.staging.UsedBytes())
+	ExpectEq("taco\x00\x00", t.contents())
+}
+
+func (t *MemoryStagingTest) SpillsToDiskWhenFull() {
+	big := strings.Repeat("x", memoryStagingMaxBytes)
+	_, err := t.tf.WriteAt([]byte(big), 4)
+	AssertEq(nil, err)
+
+	// The contents have moved to disk, giving back their memory.
+	ExpectEq(0, t.staging.UsedBytes())
+	ExpectEq("taco"+big, t.contents())
+
+	// And they stay there.
+	AssertEq(nil, t.tf.Truncate(2))
+	ExpectEq(0, t.staging.UsedBytes())
+	ExpectEq("ta", t.contents())
+}
+
+func (t *MemoryStagingTest) RoomIsShared() {
+	// A second file that fits takes up the rest of the room.
+	other, err := t.staging.NewTempFile(
+		strings.NewReader(strings.Repeat("x", 20)),
+		&t.clock)
+
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize+20, t.staging.UsedBytes())
+
+	// So growing the first moves it to disk.
+	_, err = t.tf.WriteAt([]byte("queso"), int64(initialContentSize))
+	AssertEq(nil, err)
+	ExpectEq(20, t.staging.UsedBytes())
+	ExpectEq(initialContent+"queso", t.contents())
+
+	// Destroying the second gives back its room.
+	other.Destroy()
+	ExpectEq(0, t.staging.UsedBytes())
+}
+
+func (t *MemoryStagingTest) InitialContentTooLarge() {
+	tf, err := t.staging.NewTempFile(
+		strings.NewReader(strings.Repeat("x", memoryStagingMaxBytes)),
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	ExpectEq(initialContentSize, t.staging.UsedBytes())
+
+	sr, err := tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(memoryStagingMaxBytes, sr.Size)
+	ExpectEq(memoryStagingMaxBytes, sr.DirtyThreshold)
+}
+
+func (t *MemoryStagingTest) SharesBudget() {
+	ExpectEq(initialContentSize, t.budget.UsedBytes())
+
+	// Another user of the budget takes up most of the rest.
+	t.budget.Reserve(int64(memoryStagingBudget - initialContentSize - 2))
+
+	// So growing the file by more than is left moves it to disk, giving back
+	// its share.
+	_, err := t.tf.WriteAt([]byte("queso"), int64(initialContentSize))
+	AssertEq(nil, err)
+
+	ExpectEq(0, t.staging.UsedBytes())
+	ExpectEq(memoryStagingBudget-initialContentSize-2, t.budget.UsedBytes())
+	ExpectEq(initialContent+"queso", t.contents())
+}
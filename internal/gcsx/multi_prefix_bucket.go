@@ -0,0 +1,67 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// NewMultiPrefixBucket creates a view on the wrapped bucket in which each key
+// of dirs appears as a top-level directory whose contents are the objects
+// whose names begin with the corresponding prefix, with the prefix stripped.
+// For example, with
+//
+//     dirs = {"datasets": "a/b/", "results": "c/"}
+//
+// the object "a/b/foo" appears as "datasets/foo" and "c/bar" as "results/bar".
+// Nothing else exists at the top level, and it cannot be modified.
+//
+// Objects whose names begin with passthrough (which may be empty to disable
+// this) are exposed as-is, so that temporary objects used by gcsfuse itself
+// can be created in the wrapped bucket.
+//
+// Each key must be a non-empty, valid UTF-8 string without slashes. Each
+// prefix must be valid UTF-8, and be empty or end in a slash.
+func NewMultiPrefixBucket(
+	dirs map[string]string,
+	passthrough string,
+	wrapped gcs.Bucket) (b gcs.Bucket, err error) {
+	if len(dirs) == 0 {
+		err = errors.New("No directories given")
+		return
+	}
+
+	var entries []TreeEntry
+	for dir, prefix := range dirs {
+		if dir == "" || strings.Contains(dir, "/") || !utf8.ValidString(dir) {
+			err = fmt.Errorf("Illegal directory name: %q", dir)
+			return
+		}
+
+		entries = append(entries, TreeEntry{
+			Path:   dir,
+			Bucket: wrapped,
+			Prefix: prefix,
+		})
+	}
+
+	b, err = NewTreeBucket(entries, passthrough, wrapped)
+	return
+}
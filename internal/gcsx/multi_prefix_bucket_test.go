@@ -0,0 +1,373 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestMultiPrefixBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MultiPrefixBucketTest struct {
+	ctx     context.Context
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &MultiPrefixBucketTest{}
+
+func init() { RegisterTestSuite(&MultiPrefixBucketTest{}) }
+
+func (t *MultiPrefixBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.bucket, err = gcsx.NewMultiPrefixBucket(
+		map[string]string{
+			"datasets": "a/b/",
+			"results":  "c/",
+		},
+		"tmp/",
+		t.wrapped)
+
+	AssertEq(nil, err)
+}
+
+func (t *MultiPrefixBucketTest) readWrapped(name string) (contents string) {
+	b, err := gcsutil.ReadObject(t.ctx, t.wrapped, name)
+	AssertEq(nil, err)
+
+	contents = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MultiPrefixBucketTest) IllegalConfigs() {
+	testCases := []map[string]string{
+		{},
+		{"": "a/"},
+		{"a/b": "a/"},
+		{"tmp": "a/"},
+		{"a": "b"},
+		{"a": "\xff/"},
+	}
+
+	for _, dirs := range testCases {
+		_, err := gcsx.NewMultiPrefixBucket(dirs, "tmp/", t.wrapped)
+		ExpectNe(nil, err, "dirs: %v", dirs)
+	}
+}
+
+func (t *MultiPrefixBucketTest) Name() {
+	ExpectEq(t.wrapped.Name(), t.bucket.Name())
+}
+
+func (t *MultiPrefixBucketTest) NewReader() {
+	var err error
+
+	// Create an object through the back door.
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "a/b/foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// Read it through the multi-prefix bucket.
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name: "datasets/foo",
+		})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	actual, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(actual))
+}
+
+func (t *MultiPrefixBucketTest) NewReader_OutsidePrefixes() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *MultiPrefixBucketTest) CreateObject() {
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "results/foo",
+			Contents: strings.NewReader("taco"),
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("results/foo", o.Name)
+	ExpectEq("taco", t.readWrapped("c/foo"))
+}
+
+func (t *MultiPrefixBucketTest) CreateObject_OutsidePrefixes() {
+	names := []string{
+		"foo",
+		"datasets/",
+		"other/foo",
+	}
+
+	for _, name := range names {
+		_, err := t.bucket.CreateObject(
+			t.ctx,
+			&gcs.CreateObjectRequest{
+				Name:     name,
+				Contents: strings.NewReader("taco"),
+			})
+
+		ExpectNe(nil, err, "name: %q", name)
+	}
+
+	// Nothing should have been created.
+	listing, err := t.wrapped.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectEq(0, len(listing.Objects))
+}
+
+func (t *MultiPrefixBucketTest) CreateObject_Passthrough() {
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "tmp/foo",
+			Contents: strings.NewReader("taco"),
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("tmp/foo", o.Name)
+	ExpectEq("taco", t.readWrapped("tmp/foo"))
+}
+
+func (t *MultiPrefixBucketTest) CopyObject() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "a/b/foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// Copy between prefixes.
+	o, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName: "datasets/foo",
+			DstName: "results/bar",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("results/bar", o.Name)
+	ExpectEq("taco", t.readWrapped("c/bar"))
+}
+
+func (t *MultiPrefixBucketTest) ComposeObjects() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "a/b/foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "tmp/bar", []byte("burrito"))
+	AssertEq(nil, err)
+
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "results/baz",
+			Sources: []gcs.ComposeSource{
+				{Name: "datasets/foo"},
+				{Name: "tmp/bar"},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("results/baz", o.Name)
+	ExpectEq("tacoburrito", t.readWrapped("c/baz"))
+}
+
+func (t *MultiPrefixBucketTest) StatObject() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "a/b/foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{
+			Name: "datasets/foo",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("datasets/foo", o.Name)
+	ExpectEq(len("taco"), o.Size)
+}
+
+func (t *MultiPrefixBucketTest) StatObject_TopLevelDirs() {
+	// The mounted directories exist even though there are no placeholder
+	// objects for them.
+	for _, name := range []string{"datasets/", "results/"} {
+		o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+		AssertEq(nil, err, "name: %q", name)
+		ExpectEq(name, o.Name)
+	}
+
+	// Nothing else does.
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "other/"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *MultiPrefixBucketTest) ListObjects_Root() {
+	var err error
+
+	// Create some objects, some of which are outside the prefixes.
+	err = gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.wrapped,
+		[]string{
+			"foo",
+			"a/b/bar",
+			"c/baz",
+			"d/qux",
+		})
+
+	AssertEq(nil, err)
+
+	// With a delimiter, the mounted directories show up as collapsed runs.
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Delimiter: "/",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("", listing.ContinuationToken)
+	ExpectEq(0, len(listing.Objects))
+	ExpectThat(listing.CollapsedRuns, ElementsAre("datasets/", "results/"))
+
+	// Without one, they show up as placeholder objects.
+	listing, err = t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix: "res",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(0, len(listing.CollapsedRuns))
+	AssertEq(1, len(listing.Objects))
+	ExpectEq("results/", listing.Objects[0].Name)
+}
+
+func (t *MultiPrefixBucketTest) ListObjects_WithinPrefix() {
+	var err error
+
+	err = gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.wrapped,
+		[]string{
+			"a/",
+			"a/b/",
+			"a/b/foo",
+			"a/b/bar/",
+			"a/b/bar/baz",
+			"a/c",
+		})
+
+	AssertEq(nil, err)
+
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:    "datasets/",
+			Delimiter: "/",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("", listing.ContinuationToken)
+	ExpectThat(listing.CollapsedRuns, ElementsAre("datasets/bar/"))
+
+	AssertEq(2, len(listing.Objects))
+	ExpectEq("datasets/", listing.Objects[0].Name)
+	ExpectEq("datasets/foo", listing.Objects[1].Name)
+}
+
+func (t *MultiPrefixBucketTest) UpdateObject() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "c/foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	newContentLanguage := "en"
+	o, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:            "results/foo",
+			ContentLanguage: &newContentLanguage,
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("results/foo", o.Name)
+	ExpectEq(newContentLanguage, o.ContentLanguage)
+}
+
+func (t *MultiPrefixBucketTest) DeleteObject() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "c/foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{
+			Name: "results/foo",
+		})
+
+	AssertEq(nil, err)
+
+	_, err = t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "c/foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *MultiPrefixBucketTest) DeleteObject_TopLevelDir() {
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{
+			Name: "results/",
+		})
+
+	ExpectNe(nil, err)
+}
@@ -0,0 +1,303 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// The OAuth scope that covers pulling from Pub/Sub subscriptions as well as
+// GCS.
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// The Pub/Sub API used by NewNotificationListener when no other is given.
+const DefaultPubsubEndpoint = "https://pubsub.googleapis.com/"
+
+// The most notifications pulled at once.
+const notificationBatchSize = 1000
+
+// The longest to wait before pulling again after a failure.
+const maxNotificationBackoff = time.Minute
+
+// An ObjectChange is a change to an object reported by a GCS Pub/Sub
+// notification (cf. https://cloud.google.com/storage/docs/pubsub-notifications).
+type ObjectChange struct {
+	// One of OBJECT_FINALIZE, OBJECT_DELETE, OBJECT_METADATA_UPDATE, or
+	// OBJECT_ARCHIVE.
+	EventType string
+
+	Bucket     string
+	Name       string
+	Generation int64
+}
+
+// A NotificationListener pulls GCS notifications from a Pub/Sub subscription.
+type NotificationListener struct {
+	client       *http.Client
+	endpoint     string
+	subscription string
+}
+
+// NewNotificationListener creates a listener for the subscription with the
+// given name, of the form projects/PROJECT/subscriptions/SUBSCRIPTION, using
+// the Pub/Sub API at the supplied endpoint, or DefaultPubsubEndpoint if empty.
+// The client must have credentials allowing it to pull from the subscription.
+func NewNotificationListener(
+	client *http.Client,
+	endpoint string,
+	subscription string) (l *NotificationListener, err error) {
+	parts := strings.Split(subscription, "/")
+	if len(parts) != 4 ||
+		parts[0] != "projects" ||
+		parts[1] == "" ||
+		parts[2] != "subscriptions" ||
+		parts[3] == "" {
+		err = fmt.Errorf(
+			"Expected projects/PROJECT/subscriptions/SUBSCRIPTION, got %q",
+			subscription)
+		return
+	}
+
+	if endpoint == "" {
+		endpoint = DefaultPubsubEndpoint
+	}
+
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+
+	l = &NotificationListener{
+		client:       client,
+		endpoint:     endpoint,
+		subscription: subscription,
+	}
+
+	return
+}
+
+// Post the supplied request to the given method of the subscription, decoding
+// the response into resp if non-nil.
+func (l *NotificationListener) call(
+	ctx context.Context,
+	method string,
+	req interface{},
+	resp interface{}) (err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("json.Marshal: %v", err)
+		return
+	}
+
+	httpReq, err := http.NewRequest(
+		"POST",
+		l.endpoint+"v1/"+l.subscription+":"+method,
+		bytes.NewReader(body))
+
+	if err != nil {
+		err = fmt.Errorf("http.NewRequest: %v", err)
+		return
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Cancel = ctx.Done()
+
+	httpRes, err := l.client.Do(httpReq)
+	if err != nil {
+		return
+	}
+
+	defer googleapi.CloseBody(httpRes)
+
+	if err = googleapi.CheckResponse(httpRes); err != nil {
+		return
+	}
+
+	if resp != nil {
+		if err = json.NewDecoder(httpRes.Body).Decode(resp); err != nil {
+			err = fmt.Errorf("Decoding response: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// PullOnce waits for a batch of notifications, calls handle for each change to
+// an object they report, and then acknowledges them. Pub/Sub may return an
+// empty batch after a while even if there are none.
+func (l *NotificationListener) PullOnce(
+	ctx context.Context,
+	handle func(ObjectChange)) (err error) {
+	var pulled struct {
+		ReceivedMessages []struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				Attributes map[string]string `json:"attributes"`
+			} `json:"message"`
+		} `json:"receivedMessages"`
+	}
+
+	err = l.call(
+		ctx,
+		"pull",
+		map[string]interface{}{"maxMessages": notificationBatchSize},
+		&pulled)
+
+	if err != nil {
+		err = fmt.Errorf("Pulling: %v", err)
+		return
+	}
+
+	if len(pulled.ReceivedMessages) == 0 {
+		return
+	}
+
+	var ackIDs []string
+	for _, m := range pulled.ReceivedMessages {
+		ackIDs = append(ackIDs, m.AckID)
+
+		attrs := m.Message.Attributes
+		if attrs["objectId"] == "" {
+			continue
+		}
+
+		c := ObjectChange{
+			EventType: attrs["eventType"],
+			Bucket:    attrs["bucketId"],
+			Name:      attrs["objectId"],
+		}
+
+		c.Generation, _ = strconv.ParseInt(attrs["objectGeneration"], 10, 64)
+		handle(c)
+	}
+
+	err = l.call(
+		ctx,
+		"acknowledge",
+		map[string]interface{}{"ackIds": ackIDs},
+		nil)
+
+	if err != nil {
+		err = fmt.Errorf("Acknowledging: %v", err)
+		return
+	}
+
+	return
+}
+
+// Listen calls PullOnce repeatedly until the context is cancelled, logging
+// failures and backing off after them.
+func (l *NotificationListener) Listen(
+	ctx context.Context,
+	handle func(ObjectChange)) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := l.PullOnce(ctx, handle)
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Warningf("Notifications from %s: %v", l.subscription, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxNotificationBackoff {
+			backoff = maxNotificationBackoff
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Shared stat cache
+////////////////////////////////////////////////////////////////////////
+
+// NewSharedStatCache returns a stat cache that behaves like the wrapped one
+// but may be used concurrently, so that entries may be erased by something
+// other than the bucket caching through it, e.g. when notified that an object
+// has changed.
+func NewSharedStatCache(wrapped gcscaching.StatCache) *SharedStatCache {
+	return &SharedStatCache{wrapped: wrapped}
+}
+
+// See NewSharedStatCache.
+type SharedStatCache struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	wrapped gcscaching.StatCache
+}
+
+var _ gcscaching.StatCache = &SharedStatCache{}
+
+// LOCKS_EXCLUDED(sc.mu)
+func (sc *SharedStatCache) Insert(o *gcs.Object, expiration time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.wrapped.Insert(o, expiration)
+}
+
+// LOCKS_EXCLUDED(sc.mu)
+func (sc *SharedStatCache) AddNegativeEntry(name string, expiration time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.wrapped.AddNegativeEntry(name, expiration)
+}
+
+// LOCKS_EXCLUDED(sc.mu)
+func (sc *SharedStatCache) Erase(name string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.wrapped.Erase(name)
+}
+
+// LOCKS_EXCLUDED(sc.mu)
+func (sc *SharedStatCache) LookUp(
+	name string,
+	now time.Time) (hit bool, o *gcs.Object) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	hit, o = sc.wrapped.LookUp(name, now)
+	return
+}
+
+// LOCKS_EXCLUDED(sc.mu)
+func (sc *SharedStatCache) CheckInvariants() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.wrapped.CheckInvariants()
+}
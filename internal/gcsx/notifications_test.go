@@ -0,0 +1,184 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestNotifications(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const notificationSubscription = "projects/some-project/subscriptions/sub"
+
+type NotificationListenerTest struct {
+	ctx      context.Context
+	server   *httptest.Server
+	listener *gcsx.NotificationListener
+
+	// The response to send to pulls, and the paths and bodies of the requests
+	// received so far.
+	status   int
+	pulled   string
+	paths    []string
+	requests []string
+
+	changes []gcsx.ObjectChange
+}
+
+var _ SetUpInterface = &NotificationListenerTest{}
+var _ TearDownInterface = &NotificationListenerTest{}
+
+func init() { RegisterTestSuite(&NotificationListenerTest{}) }
+
+func (t *NotificationListenerTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.status = http.StatusOK
+	t.pulled = "{}"
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			t.paths = append(t.paths, r.URL.Path)
+			t.requests = append(t.requests, string(body))
+
+			w.WriteHeader(t.status)
+			if strings.HasSuffix(r.URL.Path, ":pull") {
+				w.Write([]byte(t.pulled))
+			} else {
+				w.Write([]byte("{}"))
+			}
+		}))
+
+	t.listener, err = gcsx.NewNotificationListener(
+		http.DefaultClient,
+		t.server.URL,
+		notificationSubscription)
+
+	AssertEq(nil, err)
+}
+
+func (t *NotificationListenerTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *NotificationListenerTest) pullOnce() error {
+	return t.listener.PullOnce(t.ctx, func(c gcsx.ObjectChange) {
+		t.changes = append(t.changes, c)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *NotificationListenerTest) InvalidSubscriptions() {
+	names := []string{
+		"",
+		"sub",
+		"projects/some-project",
+		"projects//subscriptions/sub",
+		"projects/some-project/subscriptions/",
+		"projects/some-project/topics/sub",
+		"projects/some-project/subscriptions/sub/extra",
+	}
+
+	for _, name := range names {
+		_, err := gcsx.NewNotificationListener(http.DefaultClient, "", name)
+		ExpectThat(err, Error(HasSubstr("projects/PROJECT")), "name: %q", name)
+	}
+}
+
+func (t *NotificationListenerTest) NothingPulled() {
+	AssertEq(nil, t.pullOnce())
+
+	ExpectThat(t.changes, ElementsAre())
+	AssertEq(1, len(t.paths))
+	ExpectEq("/v1/"+notificationSubscription+":pull", t.paths[0])
+	ExpectEq(`{"maxMessages":1000}`, t.requests[0])
+}
+
+func (t *NotificationListenerTest) ChangesPulledAndAcknowledged() {
+	t.pulled = `{"receivedMessages": [
+		{"ackId": "a", "message": {"attributes": {
+			"eventType": "OBJECT_FINALIZE",
+			"bucketId": "some-bucket",
+			"objectId": "foo/bar",
+			"objectGeneration": "17"}}},
+		{"ackId": "b", "message": {"attributes": {
+			"eventType": "OBJECT_DELETE",
+			"bucketId": "some-bucket",
+			"objectId": "baz"}}},
+		{"ackId": "c", "message": {"attributes": {}}}
+	]}`
+
+	AssertEq(nil, t.pullOnce())
+
+	AssertEq(2, len(t.changes))
+	ExpectEq("OBJECT_FINALIZE", t.changes[0].EventType)
+	ExpectEq("some-bucket", t.changes[0].Bucket)
+	ExpectEq("foo/bar", t.changes[0].Name)
+	ExpectEq(17, t.changes[0].Generation)
+
+	ExpectEq("OBJECT_DELETE", t.changes[1].EventType)
+	ExpectEq("baz", t.changes[1].Name)
+	ExpectEq(0, t.changes[1].Generation)
+
+	// Every message should be acknowledged, even those not describing an
+	// object.
+	AssertEq(2, len(t.paths))
+	ExpectEq("/v1/"+notificationSubscription+":acknowledge", t.paths[1])
+	ExpectEq(`{"ackIds":["a","b","c"]}`, t.requests[1])
+}
+
+func (t *NotificationListenerTest) PullFails() {
+	t.status = http.StatusForbidden
+
+	err := t.pullOnce()
+	ExpectThat(err, Error(HasSubstr("Pulling")))
+	ExpectThat(err, Error(HasSubstr("403")))
+	ExpectThat(t.changes, ElementsAre())
+}
+
+func (t *NotificationListenerTest) SharedStatCache() {
+	now := time.Now()
+	sc := gcsx.NewSharedStatCache(gcscaching.NewStatCache(10))
+	o := &gcs.Object{Name: "foo", Generation: 1}
+
+	sc.Insert(o, now.Add(time.Minute))
+	hit, found := sc.LookUp("foo", now)
+	ExpectTrue(hit)
+	ExpectEq(o, found)
+
+	sc.Erase("foo")
+	hit, _ = sc.LookUp("foo", now)
+	ExpectFalse(hit)
+}
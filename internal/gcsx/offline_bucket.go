@@ -0,0 +1,1322 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// Placeholder generation numbers handed out for queued writes are at least
+// this large. Real generation numbers are timestamps in microseconds, which
+// won't reach it for a very long time.
+const placeholderGenerationBase = 1 << 62
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The number of writes waiting in the queue of a bucket returned by
+// NewOfflineBucket.
+var queuedWrites = expvar.NewInt("queued_writes")
+
+// IsUnavailable returns true if the supplied error from a GCS request suggests
+// that GCS can't currently be reached or is shedding load, as opposed to the
+// request having been rejected.
+func IsUnavailable(err error) bool {
+	switch typed := err.(type) {
+	case *googleapi.Error:
+		switch typed.Code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		}
+
+		return typed.Code >= 500 && typed.Code < 600
+
+	case *url.Error, net.Error:
+		return true
+	}
+
+	return err == io.ErrUnexpectedEOF
+}
+
+// An OfflineBucket wraps a bucket, continuing to serve requests while GCS is
+// unavailable. See NewOfflineBucket.
+type OfflineBucket struct {
+	wrapped gcs.Bucket
+	clock   timeutil.Clock
+
+	// The directory holding the queue, the one to which writes that can't be
+	// applied are moved, and the file recording the progress of replay.
+	queueDir    string
+	conflictDir string
+	replayPath  string
+
+	// Held while replaying, so that only one replay runs at a time.
+	replayMu sync.Mutex
+
+	mu sync.Mutex
+
+	// Writes not yet applied to the wrapped bucket, in order.
+	//
+	// INVARIANT: Sorted by Seq
+	//
+	// GUARDED_BY(mu)
+	queue []*queuedWrite
+
+	// The effect of the queued writes, as a map from object name to the
+	// object's record, or nil if it has been deleted. Recomputed whenever the
+	// queue changes.
+	//
+	// GUARDED_BY(mu)
+	overlay map[string]*overlayEntry
+
+	// The sequence number and placeholder generation to assign next.
+	//
+	// GUARDED_BY(mu)
+	nextSeq        int64
+	nextGeneration int64
+
+	// A map from the placeholder generations of writes that have been applied
+	// to the generations GCS assigned them. Those that queued writes refer to
+	// are also persisted in the replay state, so that the writes can be
+	// applied by a later process; the rest are kept only for callers still
+	// holding records with placeholder generations.
+	//
+	// GUARDED_BY(mu)
+	realGenerations map[int64]int64
+
+	// The most recent records seen for object names, and listings seen for
+	// requests, used when GCS can't be reached.
+	//
+	// GUARDED_BY(mu)
+	known    lrucache.Cache
+	listings lrucache.Cache
+}
+
+// A write queued to be applied later, as persisted in the queue directory.
+// Exactly one of the requests is set. The contents of a created object are
+// stored alongside.
+type queuedWrite struct {
+	Seq int64
+
+	Create  *gcs.CreateObjectRequest   `json:",omitempty"`
+	Copy    *gcs.CopyObjectRequest     `json:",omitempty"`
+	Compose *gcs.ComposeObjectsRequest `json:",omitempty"`
+	Update  *gcs.UpdateObjectRequest   `json:",omitempty"`
+	Delete  *gcs.DeleteObjectRequest   `json:",omitempty"`
+
+	// The record returned for the resulting object, with a placeholder
+	// generation. Nil for deletions.
+	Result *gcs.Object `json:",omitempty"`
+}
+
+// The placeholder generations of other writes that the write refers to.
+func (w *queuedWrite) placeholders() (gs []int64) {
+	var all []int64
+	switch {
+	case w.Create != nil:
+		if w.Create.GenerationPrecondition != nil {
+			all = append(all, *w.Create.GenerationPrecondition)
+		}
+
+	case w.Copy != nil:
+		all = append(all, w.Copy.SrcGeneration)
+
+	case w.Compose != nil:
+		if w.Compose.DstGenerationPrecondition != nil {
+			all = append(all, *w.Compose.DstGenerationPrecondition)
+		}
+
+		for _, src := range w.Compose.Sources {
+			all = append(all, src.Generation)
+		}
+
+	case w.Update != nil:
+		all = append(all, w.Update.Generation)
+
+	default:
+		all = append(all, w.Delete.Generation)
+	}
+
+	for _, g := range all {
+		if g >= placeholderGenerationBase {
+			gs = append(gs, g)
+		}
+	}
+
+	return
+}
+
+// The progress of replay, as persisted in the directory. Written after each
+// write is applied and before it is removed from the queue, so that a crash
+// in between doesn't cause the write to be applied twice, and so that the
+// writes after it can still be applied with the generations GCS assigned to
+// the ones before.
+type replayState struct {
+	// The sequence number of the last write applied or moved to the conflicts
+	// directory. Writes up to this one left in the queue are discarded.
+	AppliedSeq int64
+
+	// The real generations of the placeholders that queued writes refer to.
+	RealGenerations map[int64]int64
+}
+
+// The name of the object the write modifies.
+func (w *queuedWrite) name() string {
+	switch {
+	case w.Create != nil:
+		return w.Create.Name
+	case w.Copy != nil:
+		return w.Copy.DstName
+	case w.Compose != nil:
+		return w.Compose.DstName
+	case w.Update != nil:
+		return w.Update.Name
+	default:
+		return w.Delete.Name
+	}
+}
+
+type overlayEntry struct {
+	// Nil if the object has been deleted.
+	o *gcs.Object
+
+	// The file holding the object's contents, or "" if they aren't known
+	// locally.
+	contents string
+}
+
+// NewOfflineBucket creates a bucket that keeps serving requests when GCS
+// can't be reached, according to IsUnavailable.
+//
+// Stats and listings are answered from the most recent results seen, of which
+// up to capacity are remembered. Writes are queued durably in the supplied
+// directory, and reflected in stats, listings, and (for newly created
+// objects) reads made through this bucket, using placeholder generation
+// numbers. Once writes are queued, later ones are queued too so that they
+// are applied in order.
+//
+// Call Replay to apply the queue, e.g. using ReplayPeriodically. Each write
+// is applied with the preconditions it was made with. A write whose
+// preconditions GCS rejects, e.g. because the object was modified elsewhere
+// in the meantime, is moved to a "conflicts" subdirectory of the directory
+// along with its contents, and logged. Writes failing for other reasons stay
+// queued. A queue left by an earlier process is picked up.
+func NewOfflineBucket(
+	dir string,
+	capacity int,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b *OfflineBucket, err error) {
+	b = &OfflineBucket{
+		wrapped:         wrapped,
+		clock:           clock,
+		queueDir:        path.Join(dir, "queue"),
+		conflictDir:     path.Join(dir, "conflicts"),
+		replayPath:      path.Join(dir, "replay.json"),
+		nextGeneration:  placeholderGenerationBase,
+		realGenerations: make(map[int64]int64),
+		known:           lrucache.New(capacity),
+		listings:        lrucache.New(capacity),
+	}
+
+	for _, d := range []string{b.queueDir, b.conflictDir} {
+		err = os.MkdirAll(d, 0700)
+		if err != nil {
+			err = fmt.Errorf("MkdirAll: %v", err)
+			return
+		}
+	}
+
+	err = b.load()
+	if err != nil {
+		err = fmt.Errorf("load: %v", err)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Queue
+////////////////////////////////////////////////////////////////////////
+
+func (b *OfflineBucket) metadataPath(seq int64) string {
+	return path.Join(b.queueDir, fmt.Sprintf("%020d.json", seq))
+}
+
+func (b *OfflineBucket) contentsPath(seq int64) string {
+	return path.Join(b.queueDir, fmt.Sprintf("%020d.data", seq))
+}
+
+// Read the queue left by an earlier process, discarding contents whose
+// writes were never queued and writes that had already been applied.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *OfflineBucket) load() (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := replayState{AppliedSeq: -1}
+	encoded, err := ioutil.ReadFile(b.replayPath)
+	switch {
+	case os.IsNotExist(err):
+		err = nil
+
+	case err != nil:
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+
+	default:
+		err = json.Unmarshal(encoded, &state)
+		if err != nil {
+			err = fmt.Errorf("Unmarshal %s: %v", path.Base(b.replayPath), err)
+			return
+		}
+	}
+
+	b.nextSeq = state.AppliedSeq + 1
+	for placeholder, real := range state.RealGenerations {
+		b.realGenerations[placeholder] = real
+		if placeholder >= b.nextGeneration {
+			b.nextGeneration = placeholder + 1
+		}
+	}
+
+	entries, err := ioutil.ReadDir(b.queueDir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	queued := make(map[string]bool)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		var contents []byte
+		contents, err = ioutil.ReadFile(path.Join(b.queueDir, e.Name()))
+		if err != nil {
+			err = fmt.Errorf("ReadFile: %v", err)
+			return
+		}
+
+		w := new(queuedWrite)
+		err = json.Unmarshal(contents, w)
+		if err != nil {
+			err = fmt.Errorf("Unmarshal %s: %v", e.Name(), err)
+			return
+		}
+
+		if w.Seq <= state.AppliedSeq {
+			continue
+		}
+
+		queued[e.Name()] = true
+		queued[path.Base(b.contentsPath(w.Seq))] = true
+		b.queue = append(b.queue, w)
+
+		if w.Seq >= b.nextSeq {
+			b.nextSeq = w.Seq + 1
+		}
+
+		if w.Result != nil && w.Result.Generation >= b.nextGeneration {
+			b.nextGeneration = w.Result.Generation + 1
+		}
+	}
+
+	for _, e := range entries {
+		if !queued[e.Name()] {
+			os.Remove(path.Join(b.queueDir, e.Name()))
+		}
+	}
+
+	sort.Sort(bySeq(b.queue))
+	b.queueChanged()
+
+	if len(b.queue) != 0 {
+		logger.Infof("Found %d queued writes in %s.", len(b.queue), b.queueDir)
+	}
+
+	return
+}
+
+type bySeq []*queuedWrite
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
+func (s bySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Recompute the overlay after a change to the queue.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *OfflineBucket) queueChanged() {
+	queuedWrites.Set(int64(len(b.queue)))
+
+	b.overlay = make(map[string]*overlayEntry)
+	for _, w := range b.queue {
+		e := &overlayEntry{o: w.Result}
+		switch {
+		case w.Create != nil:
+			e.contents = b.contentsPath(w.Seq)
+
+		case w.Update != nil:
+			if prev, ok := b.overlay[w.Update.Name]; ok && prev.o != nil {
+				e.contents = prev.contents
+			}
+		}
+
+		b.overlay[w.name()] = e
+	}
+}
+
+// Persist the supplied write and add it to the queue. Its Seq field must
+// already be set, and its contents (if any) written.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *OfflineBucket) enqueue(w *queuedWrite) (err error) {
+	contents, err := json.Marshal(w)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename, so that the metadata appears
+	// complete or not at all.
+	p := b.metadataPath(w.Seq)
+	err = writeFileSync(p+".tmp", contents)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(p+".tmp", p)
+	if err != nil {
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	if len(b.queue) == 0 {
+		logger.Warningf(
+			"GCS is unavailable; queueing writes to bucket %q in %s.",
+			b.wrapped.Name(),
+			b.queueDir)
+	}
+
+	b.queue = append(b.queue, w)
+	b.queueChanged()
+	return
+}
+
+func writeFileSync(p string, contents []byte) (err error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		err = fmt.Errorf("OpenFile: %v", err)
+		return
+	}
+
+	defer f.Close()
+
+	_, err = f.Write(contents)
+	if err != nil {
+		err = fmt.Errorf("Write: %v", err)
+		return
+	}
+
+	err = f.Sync()
+	if err != nil {
+		err = fmt.Errorf("Sync: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return a record for the result of a queued write, based on the supplied
+// one, with a fresh placeholder generation.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *OfflineBucket) placeholder(base *gcs.Object) (o *gcs.Object) {
+	copied := *base
+	o = &copied
+
+	o.Generation = b.nextGeneration
+	o.MetaGeneration = 1
+	o.Updated = b.clock.Now()
+	o.MediaLink = ""
+	b.nextGeneration++
+
+	return
+}
+
+// Return the current record for the named object: from the queue if it has
+// queued writes, otherwise the most recent one seen. Return nil if the object
+// is unknown or deleted.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *OfflineBucket) current(name string) (o *gcs.Object) {
+	if e, ok := b.overlay[name]; ok {
+		o = e.o
+		return
+	}
+
+	o, _ = b.known.LookUp(name).(*gcs.Object)
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *OfflineBucket) remember(objects ...*gcs.Object) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, o := range objects {
+		b.known.Insert(o.Name, o)
+	}
+}
+
+// Translate a generation number handed out by this bucket to the one GCS
+// knows it by, if any.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *OfflineBucket) translate(g int64) int64 {
+	if real, ok := b.realGenerations[g]; ok {
+		return real
+	}
+
+	return g
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *OfflineBucket) translatePtr(g *int64) *int64 {
+	if g == nil {
+		return nil
+	}
+
+	t := b.translate(*g)
+	return &t
+}
+
+////////////////////////////////////////////////////////////////////////
+// Replay
+////////////////////////////////////////////////////////////////////////
+
+// Replay applies queued writes to the wrapped bucket in order. A write whose
+// preconditions fail or whose source is gone is moved to the conflicts
+// directory. Any other error, e.g. because GCS is unavailable, stops replay
+// early and is returned, leaving the write to be tried again.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *OfflineBucket) Replay(ctx context.Context) (err error) {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+
+	var applied int
+	defer func() {
+		if applied != 0 {
+			logger.Infof(
+				"Applied %d queued writes to bucket %q.",
+				applied,
+				b.wrapped.Name())
+		}
+	}()
+
+	for {
+		// Find the next write. No one else removes from the queue, so it will
+		// still be at the front below.
+		b.mu.Lock()
+		if len(b.queue) == 0 {
+			b.mu.Unlock()
+			return
+		}
+
+		w := b.queue[0]
+		b.mu.Unlock()
+
+		var o *gcs.Object
+		o, err = b.apply(ctx, w)
+
+		var conflict bool
+		switch err.(type) {
+		case nil:
+
+		case *gcs.PreconditionError, *gcs.NotFoundError:
+			conflict = true
+			b.reportConflict(w, err)
+			err = nil
+
+		default:
+			if !IsUnavailable(err) {
+				logger.Errorf(
+					"Replaying write %d to bucket %q: %v; will try again",
+					w.Seq,
+					b.wrapped.Name(),
+					err)
+			}
+
+			return
+		}
+
+		b.mu.Lock()
+		if o != nil {
+			b.realGenerations[w.Result.Generation] = o.Generation
+			b.known.Insert(o.Name, o)
+		}
+
+		if !conflict && w.Delete != nil {
+			b.known.Erase(w.Delete.Name)
+		}
+
+		b.queue = b.queue[1:]
+		b.queueChanged()
+		state := b.replayState(w.Seq)
+		b.mu.Unlock()
+
+		applied++
+
+		// If the state can't be saved, leave the write's files behind. A later
+		// process will apply it again unless a later write's state is saved.
+		err = b.saveReplayState(state)
+		if err != nil {
+			err = fmt.Errorf("saveReplayState: %v", err)
+			logger.Errorf("Replaying writes to bucket %q: %v", b.wrapped.Name(), err)
+			return
+		}
+
+		os.Remove(b.metadataPath(w.Seq))
+		os.Remove(b.contentsPath(w.Seq))
+	}
+}
+
+// Return the replay state once the write with the given sequence number has
+// been applied, with the real generations that the rest of the queue needs.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *OfflineBucket) replayState(appliedSeq int64) (s replayState) {
+	s.AppliedSeq = appliedSeq
+	s.RealGenerations = make(map[int64]int64)
+	for _, w := range b.queue {
+		for _, g := range w.placeholders() {
+			if real, ok := b.realGenerations[g]; ok {
+				s.RealGenerations[g] = real
+			}
+		}
+	}
+
+	return
+}
+
+// Durably replace the replay state in the directory.
+func (b *OfflineBucket) saveReplayState(s replayState) (err error) {
+	contents, err := json.Marshal(&s)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	err = writeFileSync(b.replayPath+".tmp", contents)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(b.replayPath+".tmp", b.replayPath)
+	if err != nil {
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
+
+// Apply the supplied write to the wrapped bucket, translating placeholder
+// generations.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *OfflineBucket) apply(
+	ctx context.Context,
+	w *queuedWrite) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	switch {
+	case w.Create != nil:
+		req := *w.Create
+		req.GenerationPrecondition = b.translatePtr(req.GenerationPrecondition)
+		b.mu.Unlock()
+
+		var f *os.File
+		f, err = os.Open(b.contentsPath(w.Seq))
+		if err != nil {
+			err = fmt.Errorf("Open: %v", err)
+			return
+		}
+
+		defer f.Close()
+		req.Contents = f
+		o, err = b.wrapped.CreateObject(ctx, &req)
+
+	case w.Copy != nil:
+		req := *w.Copy
+		req.SrcGeneration = b.translate(req.SrcGeneration)
+		b.mu.Unlock()
+
+		o, err = b.wrapped.CopyObject(ctx, &req)
+
+	case w.Compose != nil:
+		req := *w.Compose
+		req.DstGenerationPrecondition =
+			b.translatePtr(req.DstGenerationPrecondition)
+
+		req.Sources = make([]gcs.ComposeSource, len(w.Compose.Sources))
+		for i, s := range w.Compose.Sources {
+			req.Sources[i] = gcs.ComposeSource{
+				Name:       s.Name,
+				Generation: b.translate(s.Generation),
+			}
+		}
+
+		b.mu.Unlock()
+		o, err = b.wrapped.ComposeObjects(ctx, &req)
+
+	case w.Update != nil:
+		req := *w.Update
+		req.Generation = b.translate(req.Generation)
+		b.mu.Unlock()
+
+		o, err = b.wrapped.UpdateObject(ctx, &req)
+
+	default:
+		req := *w.Delete
+		req.Generation = b.translate(req.Generation)
+		b.mu.Unlock()
+
+		err = b.wrapped.DeleteObject(ctx, &req)
+	}
+
+	return
+}
+
+// Log that the supplied write couldn't be applied, moving it to the
+// conflicts directory.
+func (b *OfflineBucket) reportConflict(w *queuedWrite, err error) {
+	saved := b.metadataPath(w.Seq)
+	if w.Create != nil {
+		saved = b.contentsPath(w.Seq)
+	}
+
+	for _, p := range []string{b.metadataPath(w.Seq), b.contentsPath(w.Seq)} {
+		dst := path.Join(b.conflictDir, path.Base(p))
+		if p == saved {
+			saved = dst
+		}
+
+		os.Rename(p, dst)
+	}
+
+	logger.Errorf(
+		"Couldn't apply a queued write to %q in bucket %q: %v. It has been "+
+			"saved in %s.",
+		w.name(),
+		b.wrapped.Name(),
+		err,
+		saved)
+}
+
+// ReplayPeriodically calls Replay with the given period until the context is
+// cancelled.
+func (b *OfflineBucket) ReplayPeriodically(
+	ctx context.Context,
+	period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		b.Replay(ctx)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *OfflineBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+// Are there queued writes? If so, new writes must be queued behind them.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *OfflineBucket) queueing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.queue) != 0
+}
+
+func (b *OfflineBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.mu.Lock()
+	e, queued := b.overlay[req.Name]
+	translated := *req
+	translated.Generation = b.translate(req.Generation)
+	b.mu.Unlock()
+
+	if !queued {
+		rc, err = b.wrapped.NewReader(ctx, &translated)
+		return
+	}
+
+	// Is this an object we know the queued contents of?
+	switch {
+	case e.o == nil:
+		err = objectNotFound(req.Name)
+		return
+
+	case req.Generation != 0 && req.Generation != e.o.Generation:
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf(
+				"Object %q generation %d not found",
+				req.Name,
+				req.Generation),
+		}
+
+		return
+
+	case e.contents == "":
+		err = fmt.Errorf(
+			"The contents of %q are waiting to be written to GCS",
+			req.Name)
+		return
+	}
+
+	f, err := os.Open(e.contents)
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	var start int64
+	limit := int64(e.o.Size)
+	if req.Range != nil {
+		start = int64(req.Range.Start)
+		if int64(req.Range.Limit) < limit {
+			limit = int64(req.Range.Limit)
+		}
+	}
+
+	if start > limit {
+		start = limit
+	}
+
+	rc = struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, start, limit-start), f}
+
+	return
+}
+
+func (b *OfflineBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	seq := b.nextSeq
+	b.nextSeq++
+	b.mu.Unlock()
+
+	// Save the contents as they are read, so that we can queue them if GCS is
+	// unavailable.
+	p := b.contentsPath(seq)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		err = fmt.Errorf("OpenFile: %v", err)
+		return
+	}
+
+	defer f.Close()
+
+	md5Hash := md5.New()
+	crc32cHash := crc32.New(crc32cTable)
+	saved := io.MultiWriter(f, md5Hash, crc32cHash)
+
+	if !b.queueing() {
+		wrappedReq := *req
+		wrappedReq.Contents = io.TeeReader(req.Contents, saved)
+
+		b.mu.Lock()
+		wrappedReq.GenerationPrecondition =
+			b.translatePtr(req.GenerationPrecondition)
+		b.mu.Unlock()
+
+		o, err = b.wrapped.CreateObject(ctx, &wrappedReq)
+		if !IsUnavailable(err) {
+			os.Remove(p)
+			if err == nil {
+				b.remember(o)
+			}
+
+			return
+		}
+	}
+
+	// Save the rest of the contents, durably.
+	_, err = io.Copy(saved, req.Contents)
+	if err != nil {
+		os.Remove(p)
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	err = f.Sync()
+	if err != nil {
+		os.Remove(p)
+		err = fmt.Errorf("Sync: %v", err)
+		return
+	}
+
+	size, err := f.Seek(0, 1)
+	if err != nil {
+		os.Remove(p)
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	// Queue the write, renumbering it so that it follows any queued while we
+	// were trying GCS.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seq = b.nextSeq
+	b.nextSeq++
+
+	err = os.Rename(p, b.contentsPath(seq))
+	if err != nil {
+		os.Remove(p)
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	p = b.contentsPath(seq)
+
+	var sum [md5.Size]byte
+	copy(sum[:], md5Hash.Sum(nil))
+
+	o = b.placeholder(&gcs.Object{
+		Name:            req.Name,
+		ContentType:     req.ContentType,
+		ContentLanguage: req.ContentLanguage,
+		ContentEncoding: req.ContentEncoding,
+		CacheControl:    req.CacheControl,
+		Metadata:        req.Metadata,
+		Size:            uint64(size),
+		MD5:             &sum,
+		CRC32C:          crc32cHash.Sum32(),
+		ComponentCount:  1,
+	})
+
+	queuedReq := *req
+	queuedReq.Contents = nil
+
+	err = b.enqueue(&queuedWrite{Seq: seq, Create: &queuedReq, Result: o})
+	if err != nil {
+		os.Remove(p)
+		o = nil
+		err = fmt.Errorf("enqueue: %v", err)
+		return
+	}
+
+	return
+}
+
+func (b *OfflineBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if !b.queueing() {
+		b.mu.Lock()
+		translated := *req
+		translated.SrcGeneration = b.translate(req.SrcGeneration)
+		b.mu.Unlock()
+
+		o, err = b.wrapped.CopyObject(ctx, &translated)
+		if !IsUnavailable(err) {
+			if err == nil {
+				b.remember(o)
+			}
+
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	src := b.current(req.SrcName)
+	if src == nil {
+		if err == nil {
+			err = objectNotFound(req.SrcName)
+		}
+
+		return
+	}
+
+	o = b.placeholder(src)
+	o.Name = req.DstName
+
+	queuedReq := *req
+	err = b.enqueue(&queuedWrite{Seq: b.nextSeq, Copy: &queuedReq, Result: o})
+	b.nextSeq++
+
+	if err != nil {
+		o = nil
+		err = fmt.Errorf("enqueue: %v", err)
+		return
+	}
+
+	return
+}
+
+func (b *OfflineBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if !b.queueing() {
+		b.mu.Lock()
+		translated := *req
+		translated.DstGenerationPrecondition =
+			b.translatePtr(req.DstGenerationPrecondition)
+
+		translated.Sources = make([]gcs.ComposeSource, len(req.Sources))
+		for i, s := range req.Sources {
+			translated.Sources[i] = gcs.ComposeSource{
+				Name:       s.Name,
+				Generation: b.translate(s.Generation),
+			}
+		}
+		b.mu.Unlock()
+
+		o, err = b.wrapped.ComposeObjects(ctx, &translated)
+		if !IsUnavailable(err) {
+			if err == nil {
+				b.remember(o)
+			}
+
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Work out the size of the result from the sources.
+	result := &gcs.Object{
+		Name:        req.DstName,
+		ContentType: req.ContentType,
+		Metadata:    req.Metadata,
+	}
+
+	for _, s := range req.Sources {
+		src := b.current(s.Name)
+		if src == nil {
+			if err == nil {
+				err = objectNotFound(s.Name)
+			}
+
+			return
+		}
+
+		result.Size += src.Size
+		result.ComponentCount += src.ComponentCount
+	}
+
+	o = b.placeholder(result)
+
+	queuedReq := *req
+	err = b.enqueue(&queuedWrite{Seq: b.nextSeq, Compose: &queuedReq, Result: o})
+	b.nextSeq++
+
+	if err != nil {
+		o = nil
+		err = fmt.Errorf("enqueue: %v", err)
+		return
+	}
+
+	return
+}
+
+func (b *OfflineBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	e, queued := b.overlay[req.Name]
+	b.mu.Unlock()
+
+	if queued {
+		o = e.o
+		if o == nil {
+			err = objectNotFound(req.Name)
+		}
+
+		return
+	}
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	switch {
+	case err == nil:
+		b.remember(o)
+
+	case IsUnavailable(err):
+		b.mu.Lock()
+		if known, ok := b.known.LookUp(req.Name).(*gcs.Object); ok {
+			o = known
+			err = nil
+		}
+		b.mu.Unlock()
+
+	default:
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			b.mu.Lock()
+			b.known.Erase(req.Name)
+			b.mu.Unlock()
+		}
+	}
+
+	return
+}
+
+func (b *OfflineBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	key := fmt.Sprintf(
+		"%q %q %q %d",
+		req.Prefix,
+		req.Delimiter,
+		req.ContinuationToken,
+		req.MaxResults)
+
+	listing, err = b.wrapped.ListObjects(ctx, req)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case err == nil:
+		b.listings.Insert(key, listing)
+		for _, o := range listing.Objects {
+			b.known.Insert(o.Name, o)
+		}
+
+	case IsUnavailable(err):
+		cached, ok := b.listings.LookUp(key).(*gcs.Listing)
+		if !ok {
+			return
+		}
+
+		listing = cached
+		err = nil
+
+	default:
+		return
+	}
+
+	if len(b.overlay) != 0 {
+		listing = b.applyOverlay(req, listing)
+	}
+
+	return
+}
+
+// Return a copy of the supplied listing modified to reflect queued writes.
+// Objects created by queued writes are added to the first page.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *OfflineBucket) applyOverlay(
+	req *gcs.ListObjectsRequest,
+	in *gcs.Listing) (out *gcs.Listing) {
+	out = &gcs.Listing{ContinuationToken: in.ContinuationToken}
+
+	for _, o := range in.Objects {
+		if _, ok := b.overlay[o.Name]; !ok {
+			out.Objects = append(out.Objects, o)
+		}
+	}
+
+	runs := make(map[string]bool)
+	for _, r := range in.CollapsedRuns {
+		runs[r] = true
+		out.CollapsedRuns = append(out.CollapsedRuns, r)
+	}
+
+	if req.ContinuationToken != "" {
+		return
+	}
+
+	for name, e := range b.overlay {
+		if e.o == nil || !strings.HasPrefix(name, req.Prefix) {
+			continue
+		}
+
+		rest := name[len(req.Prefix):]
+		if i := strings.Index(rest, req.Delimiter); req.Delimiter != "" && i >= 0 {
+			r := req.Prefix + rest[:i+len(req.Delimiter)]
+			if !runs[r] {
+				runs[r] = true
+				out.CollapsedRuns = append(out.CollapsedRuns, r)
+			}
+
+			continue
+		}
+
+		out.Objects = append(out.Objects, e.o)
+	}
+
+	return
+}
+
+func (b *OfflineBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if !b.queueing() {
+		b.mu.Lock()
+		translated := *req
+		translated.Generation = b.translate(req.Generation)
+		b.mu.Unlock()
+
+		o, err = b.wrapped.UpdateObject(ctx, &translated)
+		if !IsUnavailable(err) {
+			if err == nil {
+				b.remember(o)
+			}
+
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	base := b.current(req.Name)
+	if base == nil {
+		if err == nil {
+			err = objectNotFound(req.Name)
+		}
+
+		return
+	}
+
+	// Apply the update to a copy of the current record.
+	updated := *base
+	o = &updated
+	o.MetaGeneration++
+	o.Updated = b.clock.Now()
+
+	for _, f := range []struct {
+		dst *string
+		src *string
+	}{
+		{&o.ContentType, req.ContentType},
+		{&o.ContentEncoding, req.ContentEncoding},
+		{&o.ContentLanguage, req.ContentLanguage},
+		{&o.CacheControl, req.CacheControl},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+
+	o.Metadata = make(map[string]string)
+	for k, v := range base.Metadata {
+		o.Metadata[k] = v
+	}
+
+	for k, v := range req.Metadata {
+		if v == nil {
+			delete(o.Metadata, k)
+		} else {
+			o.Metadata[k] = *v
+		}
+	}
+
+	queuedReq := *req
+	err = b.enqueue(&queuedWrite{Seq: b.nextSeq, Update: &queuedReq, Result: o})
+	b.nextSeq++
+
+	if err != nil {
+		o = nil
+		err = fmt.Errorf("enqueue: %v", err)
+		return
+	}
+
+	return
+}
+
+func (b *OfflineBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if !b.queueing() {
+		b.mu.Lock()
+		translated := *req
+		translated.Generation = b.translate(req.Generation)
+		b.mu.Unlock()
+
+		err = b.wrapped.DeleteObject(ctx, &translated)
+		if !IsUnavailable(err) {
+			if err == nil {
+				b.mu.Lock()
+				b.known.Erase(req.Name)
+				b.mu.Unlock()
+			}
+
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queuedReq := *req
+	err = b.enqueue(&queuedWrite{Seq: b.nextSeq, Delete: &queuedReq})
+	b.nextSeq++
+
+	if err != nil {
+		err = fmt.Errorf("enqueue: %v", err)
+		return
+	}
+
+	return
+}
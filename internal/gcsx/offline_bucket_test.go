@@ -0,0 +1,685 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestOfflineBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+var errUnreachable = &url.Error{
+	Op:  "Post",
+	URL: "https://www.googleapis.com/upload/storage/v1/b/some_bucket/o",
+	Err: errors.New("dial tcp: network is unreachable"),
+}
+
+// A bucket that can be disconnected, failing every request as the HTTP
+// client would.
+type disconnectableBucket struct {
+	gcs.Bucket
+	down bool
+
+	// If set, the error with which requests fail while down, in place of
+	// errUnreachable.
+	downErr error
+
+	// If positive, the number of objects that may be created before the
+	// bucket disconnects, e.g. to stop partway through replaying.
+	createsUntilDown int
+}
+
+func (b *disconnectableBucket) failure() error {
+	if b.downErr != nil {
+		return b.downErr
+	}
+
+	return errUnreachable
+}
+
+func (b *disconnectableBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if b.down {
+		err = b.failure()
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *disconnectableBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if b.down {
+		// Consume some of the contents first, as a failed upload would.
+		io.CopyN(ioutil.Discard, req.Contents, 2)
+		err = b.failure()
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	if err == nil && b.createsUntilDown > 0 {
+		b.createsUntilDown--
+		b.down = b.createsUntilDown == 0
+	}
+
+	return
+}
+
+func (b *disconnectableBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if b.down {
+		err = b.failure()
+		return
+	}
+
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
+
+func (b *disconnectableBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if b.down {
+		err = b.failure()
+		return
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *disconnectableBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if b.down {
+		err = b.failure()
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *disconnectableBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	if b.down {
+		err = b.failure()
+		return
+	}
+
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	return
+}
+
+func (b *disconnectableBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if b.down {
+		err = b.failure()
+		return
+	}
+
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	return
+}
+
+func (b *disconnectableBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if b.down {
+		err = b.failure()
+		return
+	}
+
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type OfflineBucketTest struct {
+	ctx     context.Context
+	dir     string
+	wrapped disconnectableBucket
+	bucket  *gcsx.OfflineBucket
+}
+
+var _ SetUpInterface = &OfflineBucketTest{}
+var _ TearDownInterface = &OfflineBucketTest{}
+
+func init() { RegisterTestSuite(&OfflineBucketTest{}) }
+
+func (t *OfflineBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.dir, err = ioutil.TempDir("", "offline_bucket_test")
+	AssertEq(nil, err)
+
+	t.reopen()
+}
+
+func (t *OfflineBucketTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Create a new offline bucket using the same directory, as if gcsfuse had
+// been restarted.
+func (t *OfflineBucketTest) reopen() {
+	var err error
+	t.bucket, err = gcsx.NewOfflineBucket(
+		t.dir,
+		100,
+		timeutil.RealClock(),
+		&t.wrapped)
+
+	AssertEq(nil, err)
+}
+
+func (t *OfflineBucketTest) readWrapped(name string) (contents string) {
+	b, err := gcsutil.ReadObject(t.ctx, t.wrapped.Bucket, name)
+	AssertEq(nil, err)
+
+	contents = string(b)
+	return
+}
+
+func (t *OfflineBucketTest) listDir() (entries []string) {
+	objects, runs, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Delimiter: "/"})
+
+	AssertEq(nil, err)
+
+	for _, o := range objects {
+		entries = append(entries, o.Name)
+	}
+
+	entries = append(entries, runs...)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OfflineBucketTest) IsUnavailable() {
+	ExpectTrue(gcsx.IsUnavailable(errUnreachable))
+	ExpectTrue(gcsx.IsUnavailable(&googleapi.Error{Code: 503}))
+	ExpectTrue(gcsx.IsUnavailable(io.ErrUnexpectedEOF))
+	ExpectTrue(gcsx.IsUnavailable(&googleapi.Error{Code: 408}))
+	ExpectTrue(gcsx.IsUnavailable(&googleapi.Error{Code: 429}))
+
+	ExpectFalse(gcsx.IsUnavailable(nil))
+	ExpectFalse(gcsx.IsUnavailable(&googleapi.Error{Code: 403}))
+	ExpectFalse(gcsx.IsUnavailable(&gcs.NotFoundError{}))
+	ExpectFalse(gcsx.IsUnavailable(&gcs.PreconditionError{}))
+}
+
+func (t *OfflineBucketTest) Online() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readWrapped("foo"))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	statted, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, statted.Generation)
+
+	// Nothing is left behind.
+	entries, err := ioutil.ReadDir(path.Join(t.dir, "queue"))
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *OfflineBucketTest) StatAndListFromCache() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar/baz", []byte(""))
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectThat(t.listDir(), ElementsAre("foo", "bar/"))
+
+	t.wrapped.down = true
+
+	statted, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, statted.Generation)
+
+	ExpectThat(t.listDir(), ElementsAre("foo", "bar/"))
+
+	// Unknown things still fail.
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "qux"})
+	ExpectEq(errUnreachable, err)
+
+	_, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{Prefix: "b"})
+	ExpectEq(errUnreachable, err)
+}
+
+func (t *OfflineBucketTest) CreateWhileOffline() {
+	t.wrapped.down = true
+
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+	ExpectEq(4, o.Size)
+
+	// The object is visible through the bucket.
+	statted, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, statted.Generation)
+
+	rc, err := t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{
+		Name:       "foo",
+		Generation: o.Generation,
+		Range:      &gcs.ByteRange{Start: 1, Limit: 3},
+	})
+
+	AssertEq(nil, err)
+	contents, err := ioutil.ReadAll(rc)
+	rc.Close()
+	AssertEq(nil, err)
+	ExpectEq("ac", string(contents))
+
+	// Reconnect and replay.
+	t.wrapped.down = false
+	_, err = t.wrapped.Bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq("taco", t.readWrapped("foo"))
+
+	// The placeholder generation still works.
+	rc, err = t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{
+		Name:       "foo",
+		Generation: o.Generation,
+	})
+
+	AssertEq(nil, err)
+	contents, err = ioutil.ReadAll(rc)
+	rc.Close()
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// As does overwriting with it as a precondition.
+	_, err = t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:                   "foo",
+		Contents:               strings.NewReader("burrito"),
+		GenerationPrecondition: &o.Generation,
+	})
+
+	AssertEq(nil, err)
+	ExpectEq("burrito", t.readWrapped("foo"))
+}
+
+func (t *OfflineBucketTest) WritesAreQueuedInOrder() {
+	t.wrapped.down = true
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// Even once GCS is back, later writes wait behind earlier ones.
+	t.wrapped.down = false
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(0, len(t.listDir()))
+
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	_, err = t.wrapped.Bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OfflineBucketTest) AppendWhileOffline() {
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.wrapped.down = true
+
+	// Do what the syncer does to append to an object.
+	tmp, err := gcsutil.CreateObject(t.ctx, t.bucket, "tmp", []byte("burrito"))
+	AssertEq(nil, err)
+
+	o, err := t.bucket.ComposeObjects(t.ctx, &gcs.ComposeObjectsRequest{
+		DstName:                   "foo",
+		DstGenerationPrecondition: &src.Generation,
+		Sources: []gcs.ComposeSource{
+			{Name: "foo", Generation: src.Generation},
+			{Name: "tmp", Generation: tmp.Generation},
+		},
+	})
+
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), o.Size)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "tmp"})
+	AssertEq(nil, err)
+
+	// The new contents can't be read until they reach GCS.
+	_, err = t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	ExpectThat(err, Error(HasSubstr("waiting")))
+
+	t.wrapped.down = false
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq("tacoburrito", t.readWrapped("foo"))
+	_, err = t.wrapped.Bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "tmp"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OfflineBucketTest) UpdateWhileOffline() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.wrapped.down = true
+
+	v := "bar"
+	o, err := t.bucket.UpdateObject(t.ctx, &gcs.UpdateObjectRequest{
+		Name:     "foo",
+		Metadata: map[string]*string{"baz": &v},
+	})
+
+	AssertEq(nil, err)
+	ExpectEq(2, o.MetaGeneration)
+	ExpectEq("bar", o.Metadata["baz"])
+
+	t.wrapped.down = false
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	o, err = t.wrapped.Bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("bar", o.Metadata["baz"])
+}
+
+func (t *OfflineBucketTest) ReplayStopsWhileOffline() {
+	t.wrapped.down = true
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	err = t.bucket.Replay(t.ctx)
+	ExpectEq(errUnreachable, err)
+
+	// Still queued.
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+}
+
+func (t *OfflineBucketTest) ReplayStopsWhileThrottled() {
+	t.wrapped.down = true
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// GCS is reachable again, but rate limiting us.
+	throttled := &googleapi.Error{Code: 429}
+	t.wrapped.downErr = throttled
+
+	err = t.bucket.Replay(t.ctx)
+	ExpectEq(throttled, err)
+
+	// The write is still queued rather than treated as a conflict.
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+
+	entries, err := ioutil.ReadDir(path.Join(t.dir, "conflicts"))
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+
+	// It is applied once GCS relents.
+	t.wrapped.down = false
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readWrapped("foo"))
+}
+
+func (t *OfflineBucketTest) ReplayRetriesOtherErrors() {
+	t.wrapped.down = true
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// An error that says nothing about the write itself, e.g. expired
+	// credentials, leaves it queued.
+	forbidden := &googleapi.Error{Code: 403}
+	t.wrapped.downErr = forbidden
+
+	err = t.bucket.Replay(t.ctx)
+	ExpectEq(forbidden, err)
+
+	entries, err := ioutil.ReadDir(path.Join(t.dir, "conflicts"))
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+
+	t.wrapped.down = false
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readWrapped("foo"))
+}
+
+func (t *OfflineBucketTest) ConflictingWrite() {
+	t.wrapped.down = true
+
+	var zero int64
+	_, err := t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:                   "foo",
+		Contents:               strings.NewReader("taco"),
+		GenerationPrecondition: &zero,
+	})
+
+	AssertEq(nil, err)
+
+	// Meanwhile, someone else creates the object.
+	t.wrapped.down = false
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "foo", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	// Their write wins, and ours is saved.
+	ExpectEq("enchilada", t.readWrapped("foo"))
+
+	entries, err := ioutil.ReadDir(path.Join(t.dir, "conflicts"))
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+
+	contents, err := ioutil.ReadFile(
+		path.Join(t.dir, "conflicts", entries[0].Name()))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *OfflineBucketTest) QueueSurvivesRestart() {
+	t.wrapped.down = true
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte("burrito"))
+	AssertEq(nil, err)
+
+	t.reopen()
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+
+	t.wrapped.down = false
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readWrapped("foo"))
+	ExpectEq("burrito", t.readWrapped("bar"))
+}
+
+func (t *OfflineBucketTest) ReplayResumesAfterRestart() {
+	t.wrapped.down = true
+
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// Overwrite it, as the file system does, with the placeholder generation
+	// as a precondition.
+	_, err = t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:                   "foo",
+		Contents:               strings.NewReader("burrito"),
+		GenerationPrecondition: &o.Generation,
+	})
+
+	AssertEq(nil, err)
+
+	// Replay stops after the first write, and then gcsfuse is restarted.
+	t.wrapped.down = false
+	t.wrapped.createsUntilDown = 1
+
+	err = t.bucket.Replay(t.ctx)
+	ExpectEq(errUnreachable, err)
+	ExpectEq("taco", t.readWrapped("foo"))
+
+	t.reopen()
+
+	// The second write is applied over the generation GCS assigned to the
+	// first.
+	t.wrapped.down = false
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", t.readWrapped("foo"))
+
+	entries, err := ioutil.ReadDir(path.Join(t.dir, "conflicts"))
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *OfflineBucketTest) AppliedWriteNotRepeatedAfterCrash() {
+	t.wrapped.down = true
+
+	var zero int64
+	_, err := t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:                   "foo",
+		Contents:               strings.NewReader("taco"),
+		GenerationPrecondition: &zero,
+	})
+
+	AssertEq(nil, err)
+
+	// Save the queue, to put back below as if gcsfuse had crashed after
+	// applying the write but before removing it from the queue.
+	queueDir := path.Join(t.dir, "queue")
+	entries, err := ioutil.ReadDir(queueDir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+
+	saved := make(map[string][]byte)
+	for _, e := range entries {
+		saved[e.Name()], err = ioutil.ReadFile(path.Join(queueDir, e.Name()))
+		AssertEq(nil, err)
+	}
+
+	t.wrapped.down = false
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	for name, contents := range saved {
+		err = ioutil.WriteFile(path.Join(queueDir, name), contents, 0600)
+		AssertEq(nil, err)
+	}
+
+	t.reopen()
+
+	// The write isn't applied again, which would fail its precondition.
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readWrapped("foo"))
+
+	entries, err = ioutil.ReadDir(path.Join(t.dir, "conflicts"))
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+
+	entries, err = ioutil.ReadDir(queueDir)
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+
+	// New writes aren't mistaken for ones already applied.
+	t.wrapped.down = true
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte("burrito"))
+	AssertEq(nil, err)
+
+	t.reopen()
+
+	t.wrapped.down = false
+	err = t.bucket.Replay(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", t.readWrapped("bar"))
+}
@@ -0,0 +1,366 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewParallelReader creates a random reader that downloads the object in
+// chunks of chunkSize bytes, keeping up to parallelism chunks starting with
+// the one most recently read from in flight or in memory at once. This suits
+// large objects read mostly sequentially, where a single stream from GCS is
+// the bottleneck, at the cost of up to chunkSize * parallelism bytes of memory
+// and some wasted transfer when reading randomly.
+//
+// Chunks are reserved from budget, which may be nil. When it has no room,
+// chunks after the one being read aren't fetched until there is.
+//
+// If verify is set, chunks are checksummed in order as they arrive, and once
+// all of them have been the read that finished them fails if the result
+// doesn't match the object's CRC32C. Reading far enough out of order to throw
+// away a chunk before it has been checksummed skips the check until chunk 0
+// is fetched again.
+func NewParallelReader(
+	o *gcs.Object,
+	bucket gcs.Bucket,
+	chunkSize int64,
+	parallelism int,
+	budget *MemoryBudget,
+	verify bool) (rr RandomReader, err error) {
+	if chunkSize <= 0 {
+		err = fmt.Errorf("Illegal chunk size: %d", chunkSize)
+		return
+	}
+
+	if parallelism <= 0 {
+		err = fmt.Errorf("Illegal parallelism: %d", parallelism)
+		return
+	}
+
+	rr = &parallelReader{
+		object:      o,
+		bucket:      bucket,
+		chunkSize:   chunkSize,
+		parallelism: parallelism,
+		budget:      budget,
+		verify:      verify && verifiable(o),
+		chunks:      make(map[int64]*chunk),
+	}
+
+	return
+}
+
+// A chunk of an object being downloaded in the background.
+type chunk struct {
+	// Closed when the download has finished, after which data and err may be
+	// read.
+	done chan struct{}
+
+	// A buffer from getBuffer, returned to its pool by release.
+	data []byte
+	err  error
+
+	// Cancel the download.
+	cancel func()
+
+	// The budget from which the chunk's size was reserved.
+	budget   *MemoryBudget
+	reserved int64
+}
+
+// Cancel the download, and return the chunk's buffer to its pool once the
+// download has finished with it. The chunk must not be used afterwards.
+func (c *chunk) release() {
+	c.cancel()
+
+	select {
+	case <-c.done:
+		c.free()
+
+	default:
+		go func() {
+			<-c.done
+			c.free()
+		}()
+	}
+}
+
+// REQUIRES: The download has finished.
+func (c *chunk) free() {
+	putBuffer(c.data)
+	c.budget.Release(c.reserved)
+}
+
+type parallelReader struct {
+	object      *gcs.Object
+	bucket      gcs.Bucket
+	chunkSize   int64
+	parallelism int
+	budget      *MemoryBudget
+	verify      bool
+
+	// Whether chunks are being checksummed, which starts over whenever chunk 0
+	// is fetched. If so, the index of the next chunk to be checksummed and the
+	// checksum of those before it.
+	//
+	// INVARIANT: hashed >= 0
+	hashing bool
+	hashed  int64
+	crc     uint32
+
+	// Chunks that have been started, indexed by their offset in the object
+	// divided by chunkSize.
+	//
+	// INVARIANT: len(chunks) <= parallelism
+	// INVARIANT: For each k, 0 <= k*chunkSize < object.Size
+	chunks map[int64]*chunk
+}
+
+func (rr *parallelReader) CheckInvariants() {
+	// INVARIANT: len(chunks) <= parallelism
+	if len(rr.chunks) > rr.parallelism {
+		panic(fmt.Sprintf("Too many chunks: %d", len(rr.chunks)))
+	}
+
+	// INVARIANT: For each k, 0 <= k*chunkSize < object.Size
+	for k := range rr.chunks {
+		if !(0 <= k && k*rr.chunkSize < int64(rr.object.Size)) {
+			panic(fmt.Sprintf("Unexpected chunk index: %d", k))
+		}
+	}
+
+	// INVARIANT: hashed >= 0
+	if rr.hashed < 0 {
+		panic(fmt.Sprintf("Unexpected hashed index: %d", rr.hashed))
+	}
+}
+
+func (rr *parallelReader) ReadAt(
+	ctx context.Context,
+	p []byte,
+	offset int64) (n int, err error) {
+	for len(p) > 0 {
+		// Have we blown past the end of the object?
+		if offset >= int64(rr.object.Size) {
+			err = io.EOF
+			return
+		}
+
+		// Make sure the chunk containing the offset and those following it are
+		// on their way, then wait for the one we need.
+		i := offset / rr.chunkSize
+		rr.prefetch(i)
+
+		c := rr.chunks[i]
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+
+		// Don't hold on to failed chunks, so that the next read can try again.
+		// Not found errors, which mean that the generation we read has been
+		// overwritten or deleted, are passed through unmangled.
+		if c.err != nil {
+			c.release()
+			delete(rr.chunks, i)
+			err = c.err
+			if _, ok := err.(*gcs.NotFoundError); !ok {
+				err = fmt.Errorf("Reading chunk %d: %v", i, err)
+			}
+
+			return
+		}
+
+		// Checksum what we can before handing out the data, so that a mismatch
+		// can be reported in place of the data that finishes the object.
+		if rr.hashing {
+			err = rr.checksumChunks()
+			if err != nil {
+				return
+			}
+		}
+
+		// Copy out what we can.
+		tmp := copy(p, c.data[offset-i*rr.chunkSize:])
+		n += tmp
+		p = p[tmp:]
+		offset += int64(tmp)
+	}
+
+	return
+}
+
+func (rr *parallelReader) Object() (o *gcs.Object) {
+	o = rr.object
+	return
+}
+
+func (rr *parallelReader) Destroy() {
+	for k, c := range rr.chunks {
+		c.release()
+		delete(rr.chunks, k)
+	}
+}
+
+// Extend the checksum over the chunks following those already checksummed
+// that have arrived, and check it once all of them have been. On a mismatch,
+// all chunks are thrown away so that they are downloaded again.
+func (rr *parallelReader) checksumChunks() (err error) {
+	for rr.hashing {
+		if rr.hashed*rr.chunkSize >= int64(rr.object.Size) {
+			rr.hashing = false
+			err = checkCRC32C(rr.object, rr.crc)
+			if err != nil {
+				rr.Destroy()
+			}
+
+			return
+		}
+
+		c, ok := rr.chunks[rr.hashed]
+		if !ok {
+			return
+		}
+
+		select {
+		case <-c.done:
+		default:
+			return
+		}
+
+		if c.err != nil {
+			return
+		}
+
+		rr.crc = crc32.Update(rr.crc, crc32cTable, c.data)
+		rr.hashed++
+	}
+
+	return
+}
+
+// Throw away chunks outside of the window starting at chunk index i, and
+// start downloading the ones within it that aren't already present. Chunk i
+// is always started, but the ones after it only while the budget has room.
+func (rr *parallelReader) prefetch(i int64) {
+	limit := i + int64(rr.parallelism)
+	for k, c := range rr.chunks {
+		if k < i || k >= limit {
+			c.release()
+			delete(rr.chunks, k)
+		}
+	}
+
+	for k := i; k < limit && k*rr.chunkSize < int64(rr.object.Size); k++ {
+		if _, ok := rr.chunks[k]; ok {
+			continue
+		}
+
+		size := rr.chunkLimit(k) - k*rr.chunkSize
+		if k == i {
+			rr.budget.Reserve(size)
+		} else if !rr.budget.TryReserve(size) {
+			break
+		}
+
+		rr.chunks[k] = rr.startChunk(k)
+		if k == 0 {
+			rr.hashing = rr.verify
+			rr.hashed = 0
+			rr.crc = 0
+		}
+	}
+}
+
+// The offset in the object at which the chunk with the given index ends.
+func (rr *parallelReader) chunkLimit(k int64) (limit int64) {
+	limit = (k + 1) * rr.chunkSize
+	if limit > int64(rr.object.Size) {
+		limit = int64(rr.object.Size)
+	}
+
+	return
+}
+
+// Start downloading the chunk with the given index in the background.
+//
+// REQUIRES: The chunk's size has been reserved from rr.budget.
+func (rr *parallelReader) startChunk(k int64) (c *chunk) {
+	start := k * rr.chunkSize
+	limit := rr.chunkLimit(k)
+
+	// Use a context unrelated to any particular read, since the chunk may be
+	// consumed by a later one.
+	ctx, cancel := context.WithCancel(context.Background())
+	c = &chunk{
+		done:     make(chan struct{}),
+		cancel:   cancel,
+		budget:   rr.budget,
+		reserved: limit - start,
+	}
+
+	go func() {
+		defer close(c.done)
+		c.data, c.err = rr.readRange(ctx, uint64(start), uint64(limit))
+	}()
+
+	return
+}
+
+func (rr *parallelReader) readRange(
+	ctx context.Context,
+	start uint64,
+	limit uint64) (data []byte, err error) {
+	rc, err := rr.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       rr.object.Name,
+			Generation: rr.object.Generation,
+			Range: &gcs.ByteRange{
+				Start: start,
+				Limit: limit,
+			},
+		})
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	data = getBuffer(int(limit - start))
+	_, err = io.ReadFull(rc, data)
+	if err != nil {
+		putBuffer(data)
+		data = nil
+		err = fmt.Errorf("ReadFull: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,286 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestParallelReader(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that records the ranges requested from NewReader, and optionally
+// fails them.
+type rangeRecordingBucket struct {
+	gcs.Bucket
+
+	mu     sync.Mutex
+	ranges []gcs.ByteRange // GUARDED_BY(mu)
+	err    error           // GUARDED_BY(mu)
+}
+
+func (b *rangeRecordingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.mu.Lock()
+	b.ranges = append(b.ranges, *req.Range)
+	err = b.err
+	b.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *rangeRecordingBucket) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+// Return the sorted start offsets of the requested ranges, once there are n
+// of them. Chunks are requested in the background, so there may be a delay.
+func (b *rangeRecordingBucket) starts(n int) (starts []interface{}) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mu.Lock()
+		count := len(b.ranges)
+		b.mu.Unlock()
+
+		if count >= n || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var tmp []int
+	for _, r := range b.ranges {
+		tmp = append(tmp, int(r.Start))
+	}
+
+	sort.Ints(tmp)
+	for _, s := range tmp {
+		starts = append(starts, uint64(s))
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const parallelReaderContents = "abcdefghij"
+
+type ParallelReaderTest struct {
+	ctx    context.Context
+	bucket rangeRecordingBucket
+	object *gcs.Object
+	rr     gcsx.RandomReader
+}
+
+var _ SetUpInterface = &ParallelReaderTest{}
+var _ TearDownInterface = &ParallelReaderTest{}
+
+func init() { RegisterTestSuite(&ParallelReaderTest{}) }
+
+func (t *ParallelReaderTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.bucket.Bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.object, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"foo",
+		[]byte(parallelReaderContents))
+
+	AssertEq(nil, err)
+
+	// Chunks of three bytes, two at a time.
+	t.rr, err = gcsx.NewParallelReader(t.object, &t.bucket, 3, 2, nil, false)
+	AssertEq(nil, err)
+}
+
+func (t *ParallelReaderTest) TearDown() {
+	t.rr.CheckInvariants()
+	t.rr.Destroy()
+}
+
+func (t *ParallelReaderTest) readAt(offset int64, size int) (s string, err error) {
+	buf := make([]byte, size)
+	n, err := t.rr.ReadAt(t.ctx, buf, offset)
+	t.rr.CheckInvariants()
+
+	s = string(buf[:n])
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ParallelReaderTest) IllegalArgs() {
+	var err error
+
+	_, err = gcsx.NewParallelReader(t.object, &t.bucket, 0, 1, nil, false)
+	ExpectThat(err, Error(HasSubstr("chunk size")))
+
+	_, err = gcsx.NewParallelReader(t.object, &t.bucket, 1, 0, nil, false)
+	ExpectThat(err, Error(HasSubstr("parallelism")))
+}
+
+func (t *ParallelReaderTest) Object() {
+	ExpectEq(t.object, t.rr.Object())
+}
+
+func (t *ParallelReaderTest) SequentialReads() {
+	var s string
+	var err error
+
+	// Each read should be served in full, even when it spans chunks.
+	for offset := int64(0); offset < int64(len(parallelReaderContents)); offset += 2 {
+		s, err = t.readAt(offset, 2)
+		AssertEq(nil, err)
+		ExpectEq(parallelReaderContents[offset:offset+2], s)
+	}
+
+	// Each chunk should have been fetched exactly once.
+	ExpectThat(t.bucket.starts(4), ElementsAre(0, 3, 6, 9))
+}
+
+func (t *ParallelReaderTest) ReadsAhead() {
+	s, err := t.readAt(0, 1)
+	AssertEq(nil, err)
+	ExpectEq("a", s)
+
+	// The following chunk should have been requested too.
+	ExpectThat(t.bucket.starts(2), ElementsAre(0, 3))
+}
+
+func (t *ParallelReaderTest) BudgetLimitsReadAhead() {
+	// A budget with room for only one chunk.
+	budget := gcsx.NewMemoryBudget(4)
+	rr, err := gcsx.NewParallelReader(t.object, &t.bucket, 3, 2, budget, false)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 1)
+	_, err = rr.ReadAt(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("a", string(buf))
+
+	// The following chunk wasn't requested.
+	ExpectThat(t.bucket.starts(2), ElementsAre(0))
+	ExpectEq(3, budget.UsedBytes())
+
+	// But reading it doesn't wait for room.
+	_, err = rr.ReadAt(t.ctx, buf, 3)
+	AssertEq(nil, err)
+	ExpectEq("d", string(buf))
+
+	// Destroying the reader gives back its chunks.
+	rr.Destroy()
+	ExpectEq(0, budget.UsedBytes())
+}
+
+func (t *ParallelReaderTest) ReadPastEOF() {
+	s, err := t.readAt(8, 10)
+	ExpectEq(io.EOF, err)
+	ExpectEq("ij", s)
+
+	s, err = t.readAt(10, 1)
+	ExpectEq(io.EOF, err)
+	ExpectEq("", s)
+}
+
+func (t *ParallelReaderTest) Seek() {
+	var s string
+	var err error
+
+	s, err = t.readAt(7, 2)
+	AssertEq(nil, err)
+	ExpectEq("hi", s)
+
+	s, err = t.readAt(1, 2)
+	AssertEq(nil, err)
+	ExpectEq("bc", s)
+}
+
+func (t *ParallelReaderTest) ErrorIsRetried() {
+	var s string
+	var err error
+
+	t.bucket.setErr(errors.New("taco"))
+	_, err = t.readAt(0, 1)
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	t.bucket.setErr(nil)
+	s, err = t.readAt(0, 1)
+	AssertEq(nil, err)
+	ExpectEq("a", s)
+}
+
+func (t *ParallelReaderTest) CancelledContext() {
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	// Block the chunk download so that the cancellation wins.
+	t.bucket.mu.Lock()
+	defer t.bucket.mu.Unlock()
+
+	_, err := t.rr.ReadAt(ctx, make([]byte, 1), 0)
+	ExpectEq(context.Canceled, err)
+}
+
+func (t *ParallelReaderTest) GenerationOverwritten() {
+	// Read the first chunk, then overwrite the object.
+	s, err := t.readAt(0, 3)
+	AssertEq(nil, err)
+	ExpectEq("abc", s)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// Chunks already downloaded are still served, but we should never see the
+	// new contents.
+	_, err = t.readAt(6, 3)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -228,6 +228,18 @@ func (t *RandomReaderTest) NewReaderReturnsError() {
 	ExpectThat(err, Error(HasSubstr("taco")))
 }
 
+func (t *RandomReaderTest) GenerationNotFound() {
+	// The generation has been overwritten or deleted.
+	expected := &gcs.NotFoundError{Err: errors.New("taco")}
+	ExpectCall(t.bucket, "NewReader")(Any(), Any()).
+		WillOnce(Return(nil, expected))
+
+	buf := make([]byte, 1)
+	_, err := t.rr.ReadAt(buf, 0)
+
+	ExpectEq(expected, err)
+}
+
 func (t *RandomReaderTest) ReaderFails() {
 	// Bucket
 	r := iotest.OneByteReader(iotest.TimeoutReader(strings.NewReader("xxx")))
@@ -0,0 +1,311 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// The number of random reads served from a RangeCache, and the number that
+// had to fetch from GCS.
+var (
+	rangeCacheHits   = expvar.NewInt("range_cache_hits")
+	rangeCacheMisses = expvar.NewInt("range_cache_misses")
+)
+
+// RangeCache keeps the ranges of objects fetched by random readers (see
+// NewCachingRandomReader) in sparse files within a directory, one for each
+// object generation, so that reading them again doesn't fetch them from GCS.
+// When the cached ranges total more than a limit, the files least recently
+// used are removed.
+//
+// The cache doesn't survive restarts: the directory is emptied when the cache
+// is created.
+//
+// Safe for concurrent access.
+type RangeCache struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	dir      string
+	maxBytes int64
+
+	// Whether readers should treat every read as random, rather than waiting
+	// until reads look random.
+	allReads bool
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The files in the cache, keyed by file name. Values are of type
+	// *rangeCacheFile. The list is ordered from most to least recently used.
+	//
+	// INVARIANT: For each k, v in files, v.Value.(*rangeCacheFile).file == k
+	// INVARIANT: size is the sum of the sizes of the files
+	//
+	// GUARDED_BY(mu)
+	files map[string]*list.Element
+	lru   *list.List
+	size  int64
+}
+
+type rangeCacheFile struct {
+	file string
+
+	// The ranges of the object held in the file, sorted and neither
+	// overlapping nor adjacent, and the total of their lengths.
+	ranges []gcs.ByteRange
+	size   int64
+}
+
+// NewRangeCache creates a cache holding up to maxBytes of ranges in dir,
+// creating it if necessary and removing anything already in it. If allReads
+// is set, readers using the cache treat every read as random.
+func NewRangeCache(
+	dir string,
+	maxBytes int64,
+	allReads bool) (c *RangeCache, err error) {
+	if maxBytes <= 0 {
+		err = fmt.Errorf("Illegal cache size: %d", maxBytes)
+		return
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	// We don't know which ranges of files left by an earlier process hold
+	// data, so start afresh.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	for _, fi := range infos {
+		err = os.RemoveAll(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			err = fmt.Errorf("RemoveAll: %v", err)
+			return
+		}
+	}
+
+	c = &RangeCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		allReads: allReads,
+		files:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+
+	return
+}
+
+// The name of the file holding ranges of the given object generation.
+func rangeCacheFileName(o *gcs.Object) string {
+	sum := sha256.Sum256([]byte(o.Name))
+	return fmt.Sprintf("%x_%d", sum[:16], o.Generation)
+}
+
+// Read into p as much as the cache holds of the object starting at offset,
+// returning zero if it doesn't hold the byte at offset.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *RangeCache) read(o *gcs.Object, p []byte, offset int64) (n int) {
+	file := rangeCacheFileName(o)
+
+	c.mu.Lock()
+	e, ok := c.files[file]
+	if !ok {
+		c.mu.Unlock()
+		rangeCacheMisses.Add(1)
+		return
+	}
+
+	// Find the range containing offset, if any.
+	ranges := e.Value.(*rangeCacheFile).ranges
+	i := sort.Search(len(ranges), func(i int) bool {
+		return int64(ranges[i].Limit) > offset
+	})
+
+	if i == len(ranges) || int64(ranges[i].Start) > offset {
+		c.mu.Unlock()
+		rangeCacheMisses.Add(1)
+		return
+	}
+
+	if avail := int64(ranges[i].Limit) - offset; avail < int64(len(p)) {
+		p = p[:avail]
+	}
+
+	c.lru.MoveToFront(e)
+	c.mu.Unlock()
+
+	// Read outside of the lock. If the file has been removed since, treat it
+	// as a miss and forget it.
+	f, err := os.Open(filepath.Join(c.dir, file))
+	if err == nil {
+		n, err = f.ReadAt(p, offset)
+		f.Close()
+	}
+
+	if err != nil || n < len(p) {
+		logger.Warningf("Reading cached range: %v", err)
+
+		c.mu.Lock()
+		if e, ok := c.files[file]; ok {
+			c.remove(e)
+		}
+		c.mu.Unlock()
+
+		n = 0
+		rangeCacheMisses.Add(1)
+		return
+	}
+
+	rangeCacheHits.Add(1)
+	return
+}
+
+// Add the supplied contents of the object starting at offset to the cache.
+// Errors are logged, since the contents can always be fetched again.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *RangeCache) insert(o *gcs.Object, offset int64, data []byte) {
+	// A range bigger than the whole cache can't be kept.
+	if int64(len(data)) > c.maxBytes || len(data) == 0 {
+		return
+	}
+
+	file := rangeCacheFileName(o)
+
+	// Write outside of the lock. Writers of the same range of the same
+	// generation write the same bytes, so they needn't be serialized.
+	f, err := os.OpenFile(
+		filepath.Join(c.dir, file),
+		os.O_RDWR|os.O_CREATE,
+		0600)
+
+	if err == nil {
+		_, err = f.WriteAt(data, offset)
+		f.Close()
+	}
+
+	if err != nil {
+		logger.Warningf("Caching range: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.files[file]
+	if !ok {
+		e = c.lru.PushFront(&rangeCacheFile{file: file})
+		c.files[file] = e
+	}
+
+	c.lru.MoveToFront(e)
+
+	rcf := e.Value.(*rangeCacheFile)
+	c.size -= rcf.size
+	rcf.ranges, rcf.size = addRange(
+		rcf.ranges,
+		gcs.ByteRange{
+			Start: uint64(offset),
+			Limit: uint64(offset) + uint64(len(data)),
+		})
+
+	c.size += rcf.size
+
+	// Make room, removing the file we just added to only if it alone is too
+	// big.
+	for c.size > c.maxBytes && c.lru.Back() != e {
+		c.remove(c.lru.Back())
+	}
+
+	if c.size > c.maxBytes {
+		c.remove(e)
+	}
+}
+
+// Forget a file, removing it.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *RangeCache) remove(e *list.Element) {
+	rcf := e.Value.(*rangeCacheFile)
+	c.lru.Remove(e)
+	delete(c.files, rcf.file)
+	c.size -= rcf.size
+
+	// Readers that already have the file open can keep reading it.
+	err := os.Remove(filepath.Join(c.dir, rcf.file))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warningf("Removing cached ranges: %v", err)
+	}
+}
+
+// Merge r into the supplied sorted ranges, returning the result and the total
+// of its lengths.
+func addRange(
+	ranges []gcs.ByteRange,
+	r gcs.ByteRange) (merged []gcs.ByteRange, size int64) {
+	for _, existing := range ranges {
+		switch {
+		// Entirely before or after r, without touching it.
+		case existing.Limit < r.Start || existing.Start > r.Limit:
+			merged = append(merged, existing)
+
+		// Overlapping or adjacent, so absorb it into r.
+		default:
+			if existing.Start < r.Start {
+				r.Start = existing.Start
+			}
+
+			if existing.Limit > r.Limit {
+				r.Limit = existing.Limit
+			}
+		}
+	}
+
+	merged = append(merged, r)
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Start < merged[j].Start
+	})
+
+	for _, m := range merged {
+		size += int64(m.Limit - m.Start)
+	}
+
+	return
+}
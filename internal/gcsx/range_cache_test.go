@@ -0,0 +1,240 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestRangeCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The size of the ranges fetched for small random reads.
+const rangeCacheFetch = gcsx.MB
+
+type RangeCacheTest struct {
+	ctx context.Context
+
+	// The cache directory. Removed in TearDown.
+	dir string
+
+	bucket rangeRecordingBucket
+
+	// Two objects of three fetches each.
+	contents []byte
+	foo      *gcs.Object
+	bar      *gcs.Object
+}
+
+var _ SetUpInterface = &RangeCacheTest{}
+var _ TearDownInterface = &RangeCacheTest{}
+
+func init() { RegisterTestSuite(&RangeCacheTest{}) }
+
+func (t *RangeCacheTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.dir, err = ioutil.TempDir("", "range_cache_test")
+	AssertEq(nil, err)
+
+	t.bucket.Bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.contents = make([]byte, 3*rangeCacheFetch)
+	for i := range t.contents {
+		t.contents[i] = byte(i * 7)
+	}
+
+	t.foo, err = gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", t.contents)
+	AssertEq(nil, err)
+
+	t.bar, err = gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "bar", t.contents)
+	AssertEq(nil, err)
+}
+
+func (t *RangeCacheTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Create a cache holding up to the given number of fetches.
+func (t *RangeCacheTest) newCache(
+	fetches int64,
+	allReads bool) (c *gcsx.RangeCache) {
+	c, err := gcsx.NewRangeCache(t.dir, fetches*rangeCacheFetch, allReads)
+	AssertEq(nil, err)
+	return
+}
+
+func (t *RangeCacheTest) newReader(
+	o *gcs.Object,
+	c *gcsx.RangeCache) (rr gcsx.RandomReader) {
+	rr, err := gcsx.NewCachingRandomReader(o, &t.bucket, c)
+	AssertEq(nil, err)
+	return
+}
+
+// Read size bytes at offset, checking that they match the object's contents.
+func (t *RangeCacheTest) readAt(
+	rr gcsx.RandomReader,
+	offset int64,
+	size int) {
+	rr.CheckInvariants()
+	defer rr.CheckInvariants()
+
+	buf := make([]byte, size)
+	n, err := rr.ReadAt(t.ctx, buf, offset)
+	AssertEq(nil, err)
+	AssertEq(size, n)
+	AssertTrue(
+		string(t.contents[offset:offset+int64(size)]) == string(buf),
+		"Contents mismatch at offset %d", offset)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RangeCacheTest) IllegalSize() {
+	_, err := gcsx.NewRangeCache(t.dir, 0, false)
+	ExpectThat(err, Error(HasSubstr("size")))
+}
+
+func (t *RangeCacheTest) EmptiesDirectory() {
+	p := path.Join(t.dir, "taco")
+	AssertEq(nil, ioutil.WriteFile(p, []byte("burrito"), 0600))
+
+	t.newCache(1, false)
+
+	_, err := os.Stat(p)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *RangeCacheTest) RepeatedReadsServedFromCache() {
+	rr := t.newReader(t.foo, t.newCache(10, true))
+	defer rr.Destroy()
+
+	t.readAt(rr, 100, 10)
+	t.readAt(rr, 5000, 10)
+	t.readAt(rr, 100, 10)
+	ExpectThat(t.bucket.starts(1), ElementsAre(100))
+}
+
+func (t *RangeCacheTest) ReadSpanningCachedAndFetched() {
+	rr := t.newReader(t.foo, t.newCache(10, true))
+	defer rr.Destroy()
+
+	t.readAt(rr, 0, 10)
+	t.readAt(rr, rangeCacheFetch-5, 10)
+	ExpectThat(t.bucket.starts(2), ElementsAre(0, rangeCacheFetch))
+}
+
+func (t *RangeCacheTest) ReadersShareCache() {
+	c := t.newCache(10, true)
+
+	rr := t.newReader(t.foo, c)
+	t.readAt(rr, 0, 10)
+	rr.Destroy()
+
+	rr = t.newReader(t.foo, c)
+	defer rr.Destroy()
+	t.readAt(rr, 0, 10)
+
+	ExpectThat(t.bucket.starts(1), ElementsAre(0))
+}
+
+func (t *RangeCacheTest) NewGenerationFetchedAgain() {
+	c := t.newCache(10, true)
+
+	rr := t.newReader(t.foo, c)
+	t.readAt(rr, 0, 10)
+	rr.Destroy()
+
+	// Overwrite the object with the same contents.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", t.contents)
+	AssertEq(nil, err)
+	AssertNe(t.foo.Generation, o.Generation)
+
+	rr = t.newReader(o, c)
+	defer rr.Destroy()
+	t.readAt(rr, 0, 10)
+
+	ExpectThat(t.bucket.starts(2), ElementsAre(0, 0))
+}
+
+func (t *RangeCacheTest) LeastRecentlyUsedEvicted() {
+	c := t.newCache(2, true)
+
+	foo := t.newReader(t.foo, c)
+	defer foo.Destroy()
+
+	bar := t.newReader(t.bar, c)
+	defer bar.Destroy()
+
+	// Fill the cache with a range of each object, then use foo's again.
+	t.readAt(foo, 0, 10)
+	t.readAt(bar, 0, 10)
+	t.readAt(foo, 0, 10)
+	AssertThat(t.bucket.starts(2), ElementsAre(0, 0))
+
+	// Caching another range of foo makes room by evicting bar.
+	t.readAt(foo, 2*rangeCacheFetch, 10)
+	t.readAt(foo, 0, 10)
+	t.readAt(bar, 0, 10)
+
+	ExpectThat(
+		t.bucket.starts(4),
+		ElementsAre(0, 0, 0, 2*rangeCacheFetch))
+}
+
+func (t *RangeCacheTest) WaitsForRandomReads() {
+	rr := t.newReader(t.foo, t.newCache(10, false))
+	defer rr.Destroy()
+
+	// Sequential reads are served by a single stream.
+	t.readAt(rr, 0, 10)
+	t.readAt(rr, 10, 10)
+	AssertThat(t.bucket.starts(1), ElementsAre(0))
+
+	// Seeking back twice makes reads look random, but the streams started for
+	// the seeks aren't cached.
+	t.readAt(rr, 0, 10)
+	t.readAt(rr, 0, 10)
+	AssertThat(t.bucket.starts(3), ElementsAre(0, 0, 0))
+
+	// From then on, fetched ranges are cached.
+	t.readAt(rr, 2*rangeCacheFetch, 10)
+	t.readAt(rr, 100, 10)
+	t.readAt(rr, 2*rangeCacheFetch, 10)
+
+	ExpectThat(
+		t.bucket.starts(5),
+		ElementsAre(0, 0, 0, 100, 2*rangeCacheFetch))
+}
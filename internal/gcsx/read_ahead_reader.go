@@ -0,0 +1,173 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The number of chunks into which the read-ahead window is divided, so that
+// the end of the window is being fetched while the start is consumed.
+const readAheadChunks = 4
+
+// NewReadAheadReader creates a random reader that reads like one from
+// NewRandomReader until trigger reads in a row have each started close to
+// where the one before ended. From then on it keeps the window bytes starting
+// with each read in flight or in memory, fetching them with several
+// concurrent range requests as for NewParallelReader, until a read lands
+// elsewhere. If cache is non-nil, reads that aren't read ahead are served as by
+// NewCachingRandomReader. The window is reserved from budget as for
+// NewParallelReader.
+func NewReadAheadReader(
+	o *gcs.Object,
+	bucket gcs.Bucket,
+	window int64,
+	trigger int,
+	cache *RangeCache,
+	budget *MemoryBudget) (rr RandomReader, err error) {
+	if window <= 0 {
+		err = fmt.Errorf("Illegal window: %d", window)
+		return
+	}
+
+	if trigger < 0 {
+		err = fmt.Errorf("Illegal trigger: %d", trigger)
+		return
+	}
+
+	chunkSize := (window + readAheadChunks - 1) / readAheadChunks
+
+	rr = &readAheadReader{
+		object:    o,
+		bucket:    bucket,
+		chunkSize: chunkSize,
+		trigger:   trigger,
+		cache:     cache,
+		budget:    budget,
+		reader:    newRandomReader(o, bucket, cache),
+		lastEnd:   -1,
+	}
+
+	return
+}
+
+type readAheadReader struct {
+	object    *gcs.Object
+	bucket    gcs.Bucket
+	chunkSize int64
+	trigger   int
+	cache     *RangeCache
+	budget    *MemoryBudget
+
+	// The reader serving reads: one from NewParallelReader if readingAhead is
+	// set, and one from NewRandomReader or NewCachingRandomReader otherwise.
+	//
+	// INVARIANT: reader != nil
+	reader       RandomReader
+	readingAhead bool
+
+	// Where the previous read ended, or -1 if there hasn't been one, and the
+	// number of reads in a row that started close to where the one before
+	// ended.
+	lastEnd    int64
+	sequential int
+}
+
+func (rr *readAheadReader) CheckInvariants() {
+	// INVARIANT: reader != nil
+	if rr.reader == nil {
+		panic("Nil reader")
+	}
+
+	rr.reader.CheckInvariants()
+}
+
+func (rr *readAheadReader) ReadAt(
+	ctx context.Context,
+	p []byte,
+	offset int64) (n int, err error) {
+	// Does this read continue from the last one? Readers such as the kernel
+	// may skip a little or issue reads slightly out of order, so allow some
+	// slack.
+	distance := offset - rr.lastEnd
+	if distance < 0 {
+		distance = -distance
+	}
+
+	if rr.lastEnd >= 0 && distance <= rr.chunkSize {
+		rr.sequential++
+	} else {
+		rr.sequential = 0
+	}
+
+	// Switch readers if the pattern has changed.
+	switch {
+	case !rr.readingAhead && rr.sequential >= rr.trigger:
+		err = rr.switchReader(true)
+
+	case rr.readingAhead && rr.sequential == 0:
+		err = rr.switchReader(false)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("switchReader: %v", err)
+		return
+	}
+
+	// Call through, passing on errors unmangled since callers look for io.EOF
+	// and *gcs.NotFoundError.
+	n, err = rr.reader.ReadAt(ctx, p, offset)
+	rr.lastEnd = offset + int64(n)
+
+	return
+}
+
+func (rr *readAheadReader) Object() (o *gcs.Object) {
+	o = rr.object
+	return
+}
+
+func (rr *readAheadReader) Destroy() {
+	rr.reader.Destroy()
+}
+
+// Replace the current reader with one that reads ahead or one that doesn't.
+func (rr *readAheadReader) switchReader(readAhead bool) (err error) {
+	var reader RandomReader
+	if readAhead {
+		reader, err = NewParallelReader(
+			rr.object,
+			rr.bucket,
+			rr.chunkSize,
+			readAheadChunks,
+			rr.budget,
+			false)
+	} else {
+		reader = newRandomReader(rr.object, rr.bucket, rr.cache)
+	}
+
+	if err != nil {
+		return
+	}
+
+	rr.reader.Destroy()
+	rr.reader = reader
+	rr.readingAhead = readAhead
+
+	return
+}
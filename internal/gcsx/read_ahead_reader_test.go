@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestReadAheadReader(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const readAheadReaderContents = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+type ReadAheadReaderTest struct {
+	ctx    context.Context
+	bucket rangeRecordingBucket
+	object *gcs.Object
+	rr     gcsx.RandomReader
+}
+
+var _ SetUpInterface = &ReadAheadReaderTest{}
+var _ TearDownInterface = &ReadAheadReaderTest{}
+
+func init() { RegisterTestSuite(&ReadAheadReaderTest{}) }
+
+func (t *ReadAheadReaderTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.bucket.Bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.object, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"foo",
+		[]byte(readAheadReaderContents))
+
+	AssertEq(nil, err)
+
+	// An eight-byte window, fetched in two-byte chunks, once two reads in a row
+	// have continued from the last.
+	t.rr, err = gcsx.NewReadAheadReader(t.object, &t.bucket, 8, 2, nil, nil)
+	AssertEq(nil, err)
+}
+
+func (t *ReadAheadReaderTest) TearDown() {
+	t.rr.CheckInvariants()
+	t.rr.Destroy()
+}
+
+func (t *ReadAheadReaderTest) readAt(offset int64, size int) string {
+	t.rr.CheckInvariants()
+	defer t.rr.CheckInvariants()
+
+	buf := make([]byte, size)
+	n, err := t.rr.ReadAt(t.ctx, buf, offset)
+	if err != io.EOF {
+		AssertEq(nil, err)
+	}
+
+	return string(buf[:n])
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReadAheadReaderTest) IllegalArgs() {
+	var err error
+
+	_, err = gcsx.NewReadAheadReader(t.object, &t.bucket, 0, 2, nil, nil)
+	ExpectThat(err, Error(HasSubstr("window")))
+
+	_, err = gcsx.NewReadAheadReader(t.object, &t.bucket, 8, -1, nil, nil)
+	ExpectThat(err, Error(HasSubstr("trigger")))
+}
+
+func (t *ReadAheadReaderTest) ReadsAheadOnceTriggered() {
+	// The first two reads are served by a single stream.
+	ExpectEq("ab", t.readAt(0, 2))
+	ExpectEq("cd", t.readAt(2, 2))
+	ExpectThat(t.bucket.starts(1), ElementsAre(0))
+
+	// The third is the second in a row to continue from the last, so the
+	// window following it is fetched in chunks.
+	ExpectEq("ef", t.readAt(4, 2))
+	ExpectThat(t.bucket.starts(5), ElementsAre(0, 4, 6, 8, 10))
+}
+
+func (t *ReadAheadReaderTest) SeekStopsReadingAhead() {
+	t.readAt(0, 2)
+	t.readAt(2, 2)
+	t.readAt(4, 2)
+	AssertThat(t.bucket.starts(5), ElementsAre(0, 4, 6, 8, 10))
+
+	// Reading far away goes back to a single stream.
+	ExpectEq("uvw", t.readAt(20, 3))
+	ExpectThat(t.bucket.starts(6), ElementsAre(0, 4, 6, 8, 10, 20))
+}
+
+func (t *ReadAheadReaderTest) SmallSkipsCountAsSequential() {
+	t.readAt(0, 2)
+	t.readAt(3, 2)
+	ExpectEq("gh", t.readAt(6, 2))
+
+	ExpectThat(t.bucket.starts(5), ElementsAre(0, 6, 8, 10, 12))
+}
+
+func (t *ReadAheadReaderTest) ReadWholeObject() {
+	var contents string
+	for offset := 0; offset < len(readAheadReaderContents); offset += 5 {
+		contents += t.readAt(int64(offset), 5)
+	}
+
+	ExpectEq(readAheadReaderContents, contents)
+}
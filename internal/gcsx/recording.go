@@ -0,0 +1,343 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/jacobsa/gcloud/httputil"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// The most of each request and response body to record. Larger bodies, e.g.
+// of object contents, are truncated.
+const recordMaxBodyBytes = 1 << 20
+
+// What we replace secrets with when recording.
+const redacted = "REDACTED"
+
+// Headers that carry credentials, which are dropped when recording.
+var secretHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Goog-Api-Key",
+}
+
+// Query parameters that carry credentials, whose values are redacted when
+// recording. The ID of a resumable upload is enough to write to it.
+var secretParams = []string{
+	"access_token",
+	"key",
+	"upload_id",
+}
+
+// An Exchange is an HTTP request sent to GCS and the response to it, as
+// recorded by NewRecordingRoundTripper and served by NewReplayHandler.
+type Exchange struct {
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"request_header,omitempty"`
+	RequestBody    []byte      `json:"request_body,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   []byte      `json:"response_body,omitempty"`
+
+	// Set if either body was longer than we record.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Remove credentials from the supplied header in place.
+func sanitizeHeader(h http.Header) {
+	for _, k := range secretHeaders {
+		h.Del(k)
+	}
+
+	// Redirects to resumable upload sessions contain the upload ID.
+	if l := h.Get("Location"); l != "" {
+		h.Set("Location", sanitizeURL(l))
+	}
+}
+
+// Return the supplied URL with the values of secret query parameters
+// redacted, and the remaining parameters sorted so that equivalent URLs
+// compare equal.
+func sanitizeURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+
+	query := u.Query()
+	for _, k := range secretParams {
+		if _, ok := query[k]; ok {
+			query.Set(k, redacted)
+		}
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// ReadExchanges reads exchanges in the format written by
+// NewRecordingRoundTripper, one JSON object per line.
+func ReadExchanges(r io.Reader) (exchanges []Exchange, err error) {
+	d := json.NewDecoder(r)
+	for {
+		var e Exchange
+		err = d.Decode(&e)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Decode: %v", err)
+			return
+		}
+
+		exchanges = append(exchanges, e)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Recording
+////////////////////////////////////////////////////////////////////////
+
+// NewRecordingRoundTripper returns a round tripper that writes each exchange
+// with the wrapped round tripper to w as a line of JSON, for turning behavior
+// seen against GCS into a fixture for NewReplayHandler. Credentials are
+// removed, and bodies are truncated to a megabyte. An exchange is written
+// once the response body has been closed, or when the request fails.
+func NewRecordingRoundTripper(
+	w io.Writer,
+	wrapped httputil.CancellableRoundTripper) httputil.CancellableRoundTripper {
+	return &recordingRoundTripper{
+		rewritingRoundTripper: newRewritingRoundTripper(nil, wrapped),
+		w:                     w,
+	}
+}
+
+type recordingRoundTripper struct {
+	*rewritingRoundTripper
+
+	// Serializes writes, so that lines aren't interleaved.
+	wMu sync.Mutex
+	w   io.Writer // GUARDED_BY(wMu)
+}
+
+// A buffer that keeps only the first recordMaxBodyBytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if room := recordMaxBodyBytes - b.Len(); len(p) > room {
+		p = p[:room]
+		b.truncated = true
+	}
+
+	b.Buffer.Write(p)
+	return
+}
+
+// A body that copies what is read from it into a buffer, calling a function
+// once when closed.
+type teeBody struct {
+	io.Reader
+	rc      io.ReadCloser
+	once    sync.Once
+	onClose func()
+}
+
+func newTeeBody(
+	rc io.ReadCloser,
+	buf *limitedBuffer,
+	onClose func()) *teeBody {
+	return &teeBody{
+		Reader:  io.TeeReader(rc, buf),
+		rc:      rc,
+		onClose: onClose,
+	}
+}
+
+func (b *teeBody) Close() (err error) {
+	err = b.rc.Close()
+	b.once.Do(b.onClose)
+	return
+}
+
+func (rt *recordingRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	e := &Exchange{
+		Method:        req.Method,
+		URL:           sanitizeURL(req.URL.String()),
+		RequestHeader: make(http.Header),
+	}
+
+	for k, v := range req.Header {
+		e.RequestHeader[k] = v
+	}
+
+	sanitizeHeader(e.RequestHeader)
+
+	// Make a copy of the request whose body we can observe. RoundTrip must not
+	// modify the request it's given.
+	var reqBody limitedBuffer
+	recorded := new(http.Request)
+	*recorded = *req
+	if req.Body != nil {
+		recorded.Body = newTeeBody(req.Body, &reqBody, func() {})
+	}
+
+	resp, err = rt.send(req, recorded)
+	if err != nil {
+		e.RequestBody = reqBody.Bytes()
+		e.Truncated = reqBody.truncated
+		rt.write(e)
+		return
+	}
+
+	e.Status = resp.StatusCode
+	e.ResponseHeader = make(http.Header)
+	for k, v := range resp.Header {
+		e.ResponseHeader[k] = v
+	}
+
+	sanitizeHeader(e.ResponseHeader)
+
+	var respBody limitedBuffer
+	resp.Body = newTeeBody(resp.Body, &respBody, func() {
+		e.RequestBody = reqBody.Bytes()
+		e.ResponseBody = respBody.Bytes()
+		e.Truncated = reqBody.truncated || respBody.truncated
+		rt.write(e)
+	})
+
+	return
+}
+
+// LOCKS_EXCLUDED(rt.wMu)
+func (rt *recordingRoundTripper) write(e *Exchange) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("Recording %s %s: %v", e.Method, e.URL, err)
+		return
+	}
+
+	rt.wMu.Lock()
+	defer rt.wMu.Unlock()
+
+	_, err = rt.w.Write(append(b, '\n'))
+	if err != nil {
+		logger.Errorf("Recording %s %s: %v", e.Method, e.URL, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Replaying
+////////////////////////////////////////////////////////////////////////
+
+// NewReplayHandler returns a handler that answers requests with the responses
+// recorded in the supplied exchanges, so that it can stand in for GCS when
+// served with e.g. httptest.NewServer and used as the endpoint of a
+// connection. A request is matched to the earliest unused exchange with the
+// same method, path, and query, disregarding the host and redacted values.
+// Requests with no match are answered with 501 Not Implemented.
+func NewReplayHandler(exchanges []Exchange) http.Handler {
+	h := &replayHandler{
+		unused: make(map[string][]Exchange),
+	}
+
+	for _, e := range exchanges {
+		// Requests that failed without a response have nothing to replay.
+		if e.Status == 0 {
+			continue
+		}
+
+		key, err := replayKey(e.Method, e.URL)
+		if err != nil {
+			continue
+		}
+
+		h.unused[key] = append(h.unused[key], e)
+	}
+
+	return h
+}
+
+type replayHandler struct {
+	mu sync.Mutex
+
+	// Exchanges not yet replayed, in order, by replayKey.
+	//
+	// GUARDED_BY(mu)
+	unused map[string][]Exchange
+}
+
+// The key on which to match a request with the given method and URL.
+func replayKey(method string, rawURL string) (key string, err error) {
+	u, err := url.Parse(sanitizeURL(rawURL))
+	if err != nil {
+		return
+	}
+
+	key = fmt.Sprintf("%s %s?%s", method, u.EscapedPath(), u.Query().Encode())
+	return
+}
+
+// LOCKS_EXCLUDED(h.mu)
+func (h *replayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := replayKey(r.Method, r.URL.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	candidates := h.unused[key]
+	if len(candidates) == 0 {
+		h.mu.Unlock()
+		http.Error(
+			w,
+			fmt.Sprintf("No recorded exchange for %s", key),
+			http.StatusNotImplemented)
+
+		return
+	}
+
+	e := candidates[0]
+	h.unused[key] = candidates[1:]
+	h.mu.Unlock()
+
+	for k, v := range e.ResponseHeader {
+		w.Header()[k] = v
+	}
+
+	// The body may have been truncated.
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.ResponseBody)))
+	w.WriteHeader(e.Status)
+	w.Write(e.ResponseBody)
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func TestRecording(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RecordingTest struct {
+	ctx context.Context
+
+	// A server standing in for GCS, and what it received.
+	server   *httptest.Server
+	received []*http.Request
+
+	// Where exchanges are recorded, and a client that records them.
+	recording bytes.Buffer
+	client    *http.Client
+}
+
+var _ SetUpInterface = &RecordingTest{}
+var _ TearDownInterface = &RecordingTest{}
+
+func init() { RegisterTestSuite(&RecordingTest{}) }
+
+func (t *RecordingTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.received = append(t.received, r)
+			ioutil.ReadAll(r.Body)
+
+			w.Header().Set("Set-Cookie", "session=secret")
+			w.Header().Set(
+				"Location",
+				"https://www.googleapis.com/upload?upload_id=secret&name=foo")
+
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"name":"foo"}`))
+		}))
+
+	endpoint, err := url.Parse(t.server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+
+	t.client = &http.Client{
+		Transport: gcsx.NewRecordingRoundTripper(&t.recording, transport),
+	}
+}
+
+func (t *RecordingTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *RecordingTest) post(u string, body string) (err error) {
+	req, err := http.NewRequest("POST", u, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return
+	}
+
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return
+}
+
+func (t *RecordingTest) recorded() (exchanges []gcsx.Exchange) {
+	exchanges, err := gcsx.ReadExchanges(bytes.NewReader(t.recording.Bytes()))
+	AssertEq(nil, err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RecordingTest) RecordsExchange() {
+	err := t.post(
+		"https://www.googleapis.com/upload/storage/v1/b/some_bucket/o?name=foo",
+		"taco")
+
+	AssertEq(nil, err)
+
+	exchanges := t.recorded()
+	AssertEq(1, len(exchanges))
+
+	e := exchanges[0]
+	ExpectEq("POST", e.Method)
+	ExpectEq(
+		"https://www.googleapis.com/upload/storage/v1/b/some_bucket/o?name=foo",
+		e.URL)
+
+	ExpectEq("taco", string(e.RequestBody))
+	ExpectEq(http.StatusCreated, e.Status)
+	ExpectEq(`{"name":"foo"}`, string(e.ResponseBody))
+	ExpectFalse(e.Truncated)
+}
+
+func (t *RecordingTest) RemovesCredentials() {
+	err := t.post(
+		"https://www.googleapis.com/storage/v1/b?access_token=secret&upload_id=x",
+		"")
+
+	AssertEq(nil, err)
+
+	// The server should still have seen them.
+	AssertEq(1, len(t.received))
+	ExpectEq("Bearer secret", t.received[0].Header.Get("Authorization"))
+
+	ExpectThat(t.recording.String(), Not(HasSubstr("secret")))
+
+	exchanges := t.recorded()
+	AssertEq(1, len(exchanges))
+
+	e := exchanges[0]
+	ExpectThat(e.URL, HasSubstr("access_token=REDACTED"))
+	ExpectThat(e.URL, HasSubstr("upload_id=REDACTED"))
+	ExpectEq("", e.RequestHeader.Get("Authorization"))
+	ExpectEq("", e.ResponseHeader.Get("Set-Cookie"))
+	ExpectEq(
+		"https://www.googleapis.com/upload?name=foo&upload_id=REDACTED",
+		e.ResponseHeader.Get("Location"))
+}
+
+func (t *RecordingTest) ReplaysInOrder() {
+	u := "https://www.googleapis.com/storage/v1/b/some_bucket/o/foo?alt=json"
+	handler := gcsx.NewReplayHandler([]gcsx.Exchange{
+		{Method: "GET", URL: u, Status: http.StatusOK, ResponseBody: []byte("1")},
+		{Method: "GET", URL: u, Status: http.StatusOK, ResponseBody: []byte("2")},
+	})
+
+	for _, expected := range []string{"1", "2"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+		ExpectEq(http.StatusOK, w.Code)
+		ExpectEq(expected, w.Body.String())
+	}
+
+	// There's nothing left to replay.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+	ExpectEq(http.StatusNotImplemented, w.Code)
+}
+
+func (t *RecordingTest) ReplayMatchesRedactedValues() {
+	handler := gcsx.NewReplayHandler([]gcsx.Exchange{
+		{
+			Method: "PUT",
+			URL:    "https://www.googleapis.com/upload?upload_id=REDACTED",
+			Status: http.StatusOK,
+		},
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(
+		w,
+		httptest.NewRequest("PUT", "/upload?upload_id=abcd", nil))
+
+	ExpectEq(http.StatusOK, w.Code)
+}
+
+func (t *RecordingTest) ReplayToConnection() {
+	// A recorded stat of an object that GCS says doesn't exist.
+	fixture := `{"method":"GET",` +
+		`"url":"https://www.googleapis.com/storage/v1/b/some_bucket/o/foo` +
+		`?projection=full",` +
+		`"status":404,` +
+		`"response_header":{"Content-Type":["application/json"]},` +
+		`"response_body":"eyJlcnJvciI6eyJjb2RlIjo0MDR9fQ=="}` + "\n"
+
+	exchanges, err := gcsx.ReadExchanges(strings.NewReader(fixture))
+	AssertEq(nil, err)
+
+	server := httptest.NewServer(gcsx.NewReplayHandler(exchanges))
+	defer server.Close()
+
+	endpoint, err := url.Parse(server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+
+	conn, err := gcs.NewConn(&gcs.ConnConfig{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "none"}),
+		Transport:   transport,
+	})
+
+	AssertEq(nil, err)
+
+	bucket, err := conn.OpenBucket(
+		t.ctx,
+		&gcs.OpenBucketOptions{Name: "some_bucket"})
+
+	AssertEq(nil, err)
+
+	_, err = bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// A ReloadableBucket passes calls on to a wrapped bucket that may be replaced
+// while the bucket is in use, e.g. by one with different limits or a
+// differently sized cache. Calls already in progress finish using the bucket
+// with which they began.
+type ReloadableBucket struct {
+	name string
+
+	mu sync.RWMutex
+
+	// GUARDED_BY(mu)
+	wrapped gcs.Bucket
+}
+
+// NewReloadableBucket creates a bucket that initially passes calls on to the
+// supplied one.
+func NewReloadableBucket(wrapped gcs.Bucket) (b *ReloadableBucket) {
+	b = &ReloadableBucket{
+		name:    wrapped.Name(),
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+// Reload replaces the wrapped bucket, which should have the same name as the
+// original.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *ReloadableBucket) Reload(wrapped gcs.Bucket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.wrapped = wrapped
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *ReloadableBucket) current() gcs.Bucket {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.wrapped
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket methods
+////////////////////////////////////////////////////////////////////////
+
+func (b *ReloadableBucket) Name() string {
+	return b.name
+}
+
+func (b *ReloadableBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.current().NewReader(ctx, req)
+	return
+}
+
+func (b *ReloadableBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.current().CreateObject(ctx, req)
+	return
+}
+
+func (b *ReloadableBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.current().CopyObject(ctx, req)
+	return
+}
+
+func (b *ReloadableBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.current().ComposeObjects(ctx, req)
+	return
+}
+
+func (b *ReloadableBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.current().StatObject(ctx, req)
+	return
+}
+
+func (b *ReloadableBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.current().ListObjects(ctx, req)
+	return
+}
+
+func (b *ReloadableBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.current().UpdateObject(ctx, req)
+	return
+}
+
+func (b *ReloadableBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.current().DeleteObject(ctx, req)
+	return
+}
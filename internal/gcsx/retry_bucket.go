@@ -0,0 +1,458 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// The names of the bucket operations that may be given their own retry
+// policies.
+const (
+	RetryOpRead    = "read"
+	RetryOpCreate  = "create"
+	RetryOpCopy    = "copy"
+	RetryOpCompose = "compose"
+	RetryOpStat    = "stat"
+	RetryOpList    = "list"
+	RetryOpUpdate  = "update"
+	RetryOpDelete  = "delete"
+)
+
+var retryOps = []string{
+	RetryOpRead,
+	RetryOpCreate,
+	RetryOpCopy,
+	RetryOpCompose,
+	RetryOpStat,
+	RetryOpList,
+	RetryOpUpdate,
+	RetryOpDelete,
+}
+
+// RetryOps returns the names of the operations that may be given their own
+// retry policies.
+func RetryOps() []string {
+	return append([]string(nil), retryOps...)
+}
+
+// A RetryPolicy says when and how often a request that fails is retried.
+type RetryPolicy struct {
+	// How many times to retry a request after it first fails. Zero disables
+	// retries.
+	MaxAttempts int
+
+	// The longest to sleep between attempts. The sleep before each retry is
+	// chosen at random up to a limit that begins at the initial backoff given to
+	// NewRetryBucket and grows by Multiplier after each, up to MaxSleep.
+	MaxSleep   time.Duration
+	Multiplier float64
+
+	// The HTTP status codes of errors from GCS after which to retry. Network
+	// errors and connections closed part way through a response are always
+	// retried.
+	RetryableCodes []int
+}
+
+// A RetryOverride replaces some settings of a RetryPolicy for one operation.
+// Settings that aren't given are nil.
+type RetryOverride struct {
+	Op          string
+	MaxAttempts *int
+	MaxSleep    *time.Duration
+	Multiplier  *float64
+}
+
+// ParseRetryOverride parses an override of the form
+// "op:key=value[,key=value...]", where op is one of those returned by
+// RetryOps and each key is attempts, sleep, or multiplier.
+func ParseRetryOverride(s string) (o RetryOverride, err error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		err = fmt.Errorf("Expected op:key=value[,key=value...], got %q", s)
+		return
+	}
+
+	o.Op = strings.TrimSpace(s[:i])
+	if !isRetryOp(o.Op) {
+		err = fmt.Errorf(
+			"Unknown operation %q in %q; expected one of %s",
+			o.Op,
+			s,
+			strings.Join(retryOps, ", "))
+		return
+	}
+
+	for _, kv := range strings.Split(s[i+1:], ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			err = fmt.Errorf("Expected key=value, got %q in %q", kv, s)
+			return
+		}
+
+		switch key, value := parts[0], parts[1]; key {
+		case "attempts":
+			var n int
+			n, err = strconv.Atoi(value)
+			if err != nil || n < 0 {
+				err = fmt.Errorf("Illegal attempts %q in %q", value, s)
+				return
+			}
+
+			o.MaxAttempts = &n
+
+		case "sleep":
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				err = fmt.Errorf("Illegal sleep %q in %q", value, s)
+				return
+			}
+
+			o.MaxSleep = &d
+
+		case "multiplier":
+			var m float64
+			m, err = strconv.ParseFloat(value, 64)
+			if err != nil || m < 1 {
+				err = fmt.Errorf("Illegal multiplier %q in %q", value, s)
+				return
+			}
+
+			o.Multiplier = &m
+
+		default:
+			err = fmt.Errorf(
+				"Unknown key %q in %q; expected attempts, sleep, or multiplier",
+				key,
+				s)
+			return
+		}
+	}
+
+	return
+}
+
+func isRetryOp(op string) bool {
+	for _, o := range retryOps {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply returns the policy with the settings given by the override replacing
+// those of p.
+func (o RetryOverride) Apply(p RetryPolicy) RetryPolicy {
+	if o.MaxAttempts != nil {
+		p.MaxAttempts = *o.MaxAttempts
+	}
+
+	if o.MaxSleep != nil {
+		p.MaxSleep = *o.MaxSleep
+	}
+
+	if o.Multiplier != nil {
+		p.Multiplier = *o.Multiplier
+	}
+
+	return p
+}
+
+// String formats the override as ParseRetryOverride accepts it.
+func (o RetryOverride) String() string {
+	var kvs []string
+	if o.MaxAttempts != nil {
+		kvs = append(kvs, fmt.Sprintf("attempts=%d", *o.MaxAttempts))
+	}
+
+	if o.MaxSleep != nil {
+		kvs = append(kvs, fmt.Sprintf("sleep=%v", *o.MaxSleep))
+	}
+
+	if o.Multiplier != nil {
+		kvs = append(kvs, fmt.Sprintf("multiplier=%v", *o.Multiplier))
+	}
+
+	return o.Op + ":" + strings.Join(kvs, ",")
+}
+
+// NewRetryBucket returns a bucket that retries requests to the wrapped bucket
+// that fail with retryable errors, according to the policy for their
+// operation in perOp, or def if there is none. It returns the last error if
+// the policy's attempts run out or the context is cancelled while sleeping.
+//
+// Object creation is retried only when the contents can be rewound, i.e. are
+// an io.Seeker. For reads, only opening the object is retried; errors while
+// reading its contents are returned to the caller.
+func NewRetryBucket(
+	initialBackoff time.Duration,
+	def RetryPolicy,
+	perOp map[string]RetryPolicy,
+	wrapped gcs.Bucket) gcs.Bucket {
+	b := &retryBucket{
+		Bucket:         wrapped,
+		initialBackoff: initialBackoff,
+		policies:       make(map[string]RetryPolicy),
+	}
+
+	for _, op := range retryOps {
+		p, ok := perOp[op]
+		if !ok {
+			p = def
+		}
+
+		b.policies[op] = p
+	}
+
+	return b
+}
+
+type retryBucket struct {
+	gcs.Bucket
+	initialBackoff time.Duration
+
+	// The policy for each operation.
+	policies map[string]RetryPolicy
+}
+
+// Is the supplied error worth retrying under the given policy?
+func shouldRetry(p *RetryPolicy, err error) bool {
+	switch typed := err.(type) {
+	case *googleapi.Error:
+		for _, c := range p.RetryableCodes {
+			if typed.Code == c {
+				return true
+			}
+		}
+
+	case *net.OpError:
+		return true
+
+	case *url.Error:
+		return typed.Err == io.EOF || shouldRetry(p, typed.Err)
+	}
+
+	return err == io.ErrUnexpectedEOF
+}
+
+// Call f, retrying it under the policy for op if it fails. If rewind is
+// non-nil, it is called before each retry, and retrying stops if it fails.
+func (b *retryBucket) do(
+	ctx context.Context,
+	op string,
+	desc string,
+	rewind func() error,
+	f func() error) (err error) {
+	p := b.policies[op]
+	backoff := b.initialBackoff
+	for attempt := 0; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= p.MaxAttempts || !shouldRetry(&p, err) {
+			return
+		}
+
+		if backoff > p.MaxSleep {
+			backoff = p.MaxSleep
+		}
+
+		// Wait for a random time up to the backoff, so that requests that failed
+		// together don't come back together. If we're cancelled, return the
+		// last error.
+		delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+		logger.Infof(
+			"Retrying %s after error (%v) in %v.",
+			desc,
+			err,
+			delay)
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(delay):
+		}
+
+		if rewind != nil {
+			if rErr := rewind(); rErr != nil {
+				logger.Infof("Not retrying %s: rewinding: %v", desc, rErr)
+				return
+			}
+		}
+
+		backoff = time.Duration(float64(backoff) * p.Multiplier)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *retryBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	err = b.do(
+		ctx,
+		RetryOpRead,
+		fmt.Sprintf("NewReader(%q)", req.Name),
+		nil,
+		func() (err error) {
+			rc, err = b.Bucket.NewReader(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	f := func() (err error) {
+		o, err = b.Bucket.CreateObject(ctx, req)
+		return
+	}
+
+	desc := fmt.Sprintf("CreateObject(%q)", req.Name)
+
+	// Contents that can't be rewound can't be sent again.
+	s, ok := req.Contents.(io.Seeker)
+	if !ok {
+		err = f()
+		return
+	}
+
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		err = f()
+		return
+	}
+
+	rewind := func() (err error) {
+		_, err = s.Seek(start, io.SeekStart)
+		return
+	}
+
+	err = b.do(ctx, RetryOpCreate, desc, rewind, f)
+	return
+}
+
+func (b *retryBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	err = b.do(
+		ctx,
+		RetryOpCopy,
+		fmt.Sprintf("CopyObject(%q, %q)", req.SrcName, req.DstName),
+		nil,
+		func() (err error) {
+			o, err = b.Bucket.CopyObject(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	err = b.do(
+		ctx,
+		RetryOpCompose,
+		fmt.Sprintf("ComposeObjects(%q)", req.DstName),
+		nil,
+		func() (err error) {
+			o, err = b.Bucket.ComposeObjects(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = b.do(
+		ctx,
+		RetryOpStat,
+		fmt.Sprintf("StatObject(%q)", req.Name),
+		nil,
+		func() (err error) {
+			o, err = b.Bucket.StatObject(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	err = b.do(
+		ctx,
+		RetryOpList,
+		fmt.Sprintf("ListObjects(%q)", req.Prefix),
+		nil,
+		func() (err error) {
+			listing, err = b.Bucket.ListObjects(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	err = b.do(
+		ctx,
+		RetryOpUpdate,
+		fmt.Sprintf("UpdateObject(%q)", req.Name),
+		nil,
+		func() (err error) {
+			o, err = b.Bucket.UpdateObject(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.do(
+		ctx,
+		RetryOpDelete,
+		fmt.Sprintf("DeleteObject(%q)", req.Name),
+		nil,
+		func() error {
+			return b.Bucket.DeleteObject(ctx, req)
+		})
+
+	return
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+var errUnavailable = &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+type RetryBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped failingBucket
+	policy  RetryPolicy
+	perOp   map[string]RetryPolicy
+}
+
+func init() { RegisterTestSuite(&RetryBucketTest{}) }
+
+func (t *RetryBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.policy = RetryPolicy{
+		MaxAttempts:    3,
+		MaxSleep:       4 * time.Millisecond,
+		Multiplier:     2,
+		RetryableCodes: []int{http.StatusServiceUnavailable},
+	}
+
+	t.perOp = make(map[string]RetryPolicy)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *RetryBucketTest) bucket() gcs.Bucket {
+	return NewRetryBucket(time.Millisecond, t.policy, t.perOp, &t.wrapped)
+}
+
+func (t *RetryBucketTest) stat() (err error) {
+	_, err = t.bucket().StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	return
+}
+
+func (t *RetryBucketTest) create(contents io.Reader) (err error) {
+	_, err = t.bucket().CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:     "bar",
+		Contents: contents,
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RetryBucketTest) RetriesFailedRequests() {
+	t.wrapped.errs = []error{errUnavailable, io.ErrUnexpectedEOF}
+
+	ExpectEq(nil, t.stat())
+	ExpectEq(3, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) GivesUpAfterMaxAttempts() {
+	for i := 0; i < 10; i++ {
+		t.wrapped.errs = append(t.wrapped.errs, errUnavailable)
+	}
+
+	ExpectEq(errUnavailable, t.stat())
+	ExpectEq(4, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) DoesntRetryOtherCodes() {
+	t.wrapped.errs = []error{&googleapi.Error{Code: http.StatusBadGateway}}
+
+	ExpectThat(t.stat(), HasSameTypeAs(&googleapi.Error{}))
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) DoesntRetryOtherErrors() {
+	t.wrapped.errs = []error{errors.New("taco")}
+
+	ExpectThat(t.stat(), Error(Equals("taco")))
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) StopsWhenCancelled() {
+	t.policy.MaxSleep = time.Hour
+	t.wrapped.errs = []error{errUnavailable, errUnavailable}
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	_, err := t.bucket().StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(errUnavailable, err)
+	ExpectLe(t.wrapped.calls, 2)
+}
+
+func (t *RetryBucketTest) PerOpOverride() {
+	t.perOp[RetryOpStat] = RetryPolicy{
+		MaxAttempts:    1,
+		RetryableCodes: t.policy.RetryableCodes,
+	}
+
+	t.wrapped.errs = []error{errUnavailable, errUnavailable}
+
+	ExpectEq(errUnavailable, t.stat())
+	ExpectEq(2, t.wrapped.calls)
+
+	// Other operations still use the default policy.
+	t.wrapped.calls = 0
+	t.wrapped.errs = []error{errUnavailable, errUnavailable}
+
+	ExpectEq(nil, t.create(strings.NewReader("burrito")))
+	ExpectEq(3, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) CreateRewindsContents() {
+	t.wrapped.errs = []error{errUnavailable}
+
+	r := strings.NewReader("burrito")
+	r.Seek(1, io.SeekStart)
+
+	AssertEq(nil, t.create(r))
+	ExpectEq(2, t.wrapped.calls)
+
+	rc, err := t.wrapped.Bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{Name: "bar"})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	ExpectEq("urrito", string(b))
+}
+
+func (t *RetryBucketTest) CreateWithUnseekableContents() {
+	t.wrapped.errs = []error{errUnavailable}
+
+	err := t.create(io.MultiReader(strings.NewReader("burrito")))
+	ExpectEq(errUnavailable, err)
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *RetryBucketTest) ParseRetryOverride() {
+	o, err := ParseRetryOverride("read:attempts=10,sleep=1m,multiplier=1.5")
+	AssertEq(nil, err)
+	ExpectEq(RetryOpRead, o.Op)
+
+	p := o.Apply(t.policy)
+	ExpectEq(10, p.MaxAttempts)
+	ExpectEq(time.Minute, p.MaxSleep)
+	ExpectEq(1.5, p.Multiplier)
+	ExpectThat(p.RetryableCodes, ElementsAre(http.StatusServiceUnavailable))
+
+	// Settings that aren't given are kept.
+	o, err = ParseRetryOverride("delete:attempts=0")
+	AssertEq(nil, err)
+
+	p = o.Apply(t.policy)
+	ExpectEq(0, p.MaxAttempts)
+	ExpectEq(t.policy.MaxSleep, p.MaxSleep)
+	ExpectEq("delete:attempts=0", o.String())
+}
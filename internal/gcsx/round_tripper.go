@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// A round tripper that hands the wrapped one a rewritten copy of each request
+// it is given, since RoundTrip must not modify its request, while forwarding
+// cancellation of the original to the copy.
+//
+// Round trippers that do more than rewrite the request, e.g. looking at the
+// response or sending several requests for one, embed this with a nil rewrite
+// function and call send themselves.
+type rewritingRoundTripper struct {
+	wrapped httputil.CancellableRoundTripper
+
+	// Return the request to send in place of the supplied one, or the supplied
+	// one itself to pass it through.
+	rewrite func(req *http.Request) (modified *http.Request, err error)
+
+	mu sync.Mutex
+
+	// The requests we have handed to the wrapped round tripper in place of the
+	// ones we were given, so that we can cancel them.
+	//
+	// GUARDED_BY(mu)
+	modified map[*http.Request]*http.Request
+}
+
+func newRewritingRoundTripper(
+	rewrite func(req *http.Request) (modified *http.Request, err error),
+	wrapped httputil.CancellableRoundTripper) *rewritingRoundTripper {
+	return &rewritingRoundTripper{
+		wrapped:  wrapped,
+		rewrite:  rewrite,
+		modified: make(map[*http.Request]*http.Request),
+	}
+}
+
+// Return a copy of the supplied request with its own header, for a rewrite
+// function to modify.
+func copyRequest(req *http.Request) (modified *http.Request) {
+	modified = new(http.Request)
+	*modified = *req
+	modified.Header = make(http.Header)
+	for k, v := range req.Header {
+		modified.Header[k] = v
+	}
+
+	return
+}
+
+func (rt *rewritingRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	modified, err := rt.rewrite(req)
+	if err != nil {
+		return
+	}
+
+	resp, err = rt.send(req, modified)
+	return
+}
+
+// Send the modified request to the wrapped round tripper in place of req, so
+// that cancelling req cancels it.
+//
+// LOCKS_EXCLUDED(rt.mu)
+func (rt *rewritingRoundTripper) send(
+	req *http.Request,
+	modified *http.Request) (resp *http.Response, err error) {
+	if modified == req {
+		resp, err = rt.wrapped.RoundTrip(req)
+		return
+	}
+
+	rt.mu.Lock()
+	rt.modified[req] = modified
+	rt.mu.Unlock()
+
+	resp, err = rt.wrapped.RoundTrip(modified)
+
+	rt.mu.Lock()
+	delete(rt.modified, req)
+	rt.mu.Unlock()
+
+	return
+}
+
+// LOCKS_EXCLUDED(rt.mu)
+func (rt *rewritingRoundTripper) CancelRequest(req *http.Request) {
+	rt.mu.Lock()
+	modified, ok := rt.modified[req]
+	rt.mu.Unlock()
+
+	if ok {
+		req = modified
+	}
+
+	rt.wrapped.CancelRequest(req)
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestRewritingRoundTripper(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A round tripper that blocks each request until it is cancelled, recording
+// the requests it is given and those cancelled.
+type blockingRoundTripper struct {
+	mu        sync.Mutex
+	received  []*http.Request
+	cancelled []*http.Request
+	arrived   chan struct{}
+	cancel    chan struct{}
+}
+
+func (rt *blockingRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	rt.mu.Lock()
+	rt.received = append(rt.received, req)
+	rt.mu.Unlock()
+
+	rt.arrived <- struct{}{}
+	<-rt.cancel
+
+	err = errors.New("cancelled")
+	return
+}
+
+func (rt *blockingRoundTripper) CancelRequest(req *http.Request) {
+	rt.mu.Lock()
+	rt.cancelled = append(rt.cancelled, req)
+	rt.mu.Unlock()
+
+	close(rt.cancel)
+}
+
+type RewritingRoundTripperTest struct {
+	wrapped blockingRoundTripper
+}
+
+var _ SetUpInterface = &RewritingRoundTripperTest{}
+
+func init() { RegisterTestSuite(&RewritingRoundTripperTest{}) }
+
+func (t *RewritingRoundTripperTest) SetUp(ti *TestInfo) {
+	t.wrapped.arrived = make(chan struct{}, 1)
+	t.wrapped.cancel = make(chan struct{})
+}
+
+// Send a request through a rewriting round tripper using the supplied
+// function, cancel it once it reaches the wrapped round tripper, and return
+// the original request.
+func (t *RewritingRoundTripperTest) sendAndCancel(
+	rewrite func(*http.Request) (*http.Request, error)) (req *http.Request) {
+	rt := newRewritingRoundTripper(rewrite, &t.wrapped)
+
+	req, err := http.NewRequest("GET", "https://www.googleapis.com/", nil)
+	AssertEq(nil, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := rt.RoundTrip(req)
+		done <- err
+	}()
+
+	<-t.wrapped.arrived
+	rt.CancelRequest(req)
+	ExpectThat(<-done, Error(HasSubstr("cancelled")))
+
+	// Nothing is left behind.
+	ExpectEq(0, len(rt.modified))
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RewritingRoundTripperTest) CancelsRewrittenRequest() {
+	req := t.sendAndCancel(func(req *http.Request) (*http.Request, error) {
+		modified := copyRequest(req)
+		modified.Header.Set("X-Taco", "burrito")
+		return modified, nil
+	})
+
+	AssertEq(1, len(t.wrapped.received))
+	modified := t.wrapped.received[0]
+
+	ExpectNe(req, modified)
+	ExpectEq("burrito", modified.Header.Get("X-Taco"))
+	ExpectEq("", req.Header.Get("X-Taco"))
+	ExpectThat(t.wrapped.cancelled, ElementsAre(modified))
+}
+
+func (t *RewritingRoundTripperTest) CancelsUnmodifiedRequest() {
+	req := t.sendAndCancel(func(req *http.Request) (*http.Request, error) {
+		return req, nil
+	})
+
+	ExpectThat(t.wrapped.received, ElementsAre(req))
+	ExpectThat(t.wrapped.cancelled, ElementsAre(req))
+}
+
+func (t *RewritingRoundTripperTest) RewriteError() {
+	rt := newRewritingRoundTripper(
+		func(req *http.Request) (*http.Request, error) {
+			return nil, errors.New("taco")
+		},
+		&t.wrapped)
+
+	req, err := http.NewRequest("GET", "https://www.googleapis.com/", nil)
+	AssertEq(nil, err)
+
+	_, err = rt.RoundTrip(req)
+	ExpectThat(err, Error(Equals("taco")))
+	ExpectEq(0, len(t.wrapped.received))
+}
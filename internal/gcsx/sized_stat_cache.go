@@ -0,0 +1,212 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+)
+
+// The number of entries evicted to make room in stat caches returned by
+// NewSizedStatCache.
+var statCacheEvictions = expvar.NewInt("stat_cache_evictions")
+
+// StatCacheEvictions returns the number of entries evicted from sized stat
+// caches in this process to make room for others. The same value is published
+// by package expvar under the name "stat_cache_evictions".
+func StatCacheEvictions() int64 {
+	return statCacheEvictions.Value()
+}
+
+// The estimated memory used by a cache entry apart from its strings: the
+// object record, the list element, and the map bucket holding it.
+const statCacheEntryOverhead = 512
+
+// Estimate the memory used by a cache entry for the given name and object,
+// which is nil for negative entries.
+func statCacheEntrySize(name string, o *gcs.Object) (size int64) {
+	// The name is held both by the map and by the entry.
+	size = statCacheEntryOverhead + 2*int64(len(name))
+	if o == nil {
+		return
+	}
+
+	for _, s := range []string{
+		o.ContentType,
+		o.ContentLanguage,
+		o.CacheControl,
+		o.Owner,
+		o.ContentEncoding,
+		o.MediaLink,
+		o.StorageClass,
+	} {
+		size += int64(len(s))
+	}
+
+	for k, v := range o.Metadata {
+		size += int64(len(k) + len(v) + 32)
+	}
+
+	return
+}
+
+// NewSizedStatCache returns a stat cache that evicts the least recently used
+// entries when their estimated memory use would exceed maxBytes, rather than
+// when there are more than a fixed number of them. Objects with more metadata
+// therefore take up more room. Evictions are counted for StatCacheEvictions.
+//
+// Like the caches returned by gcscaching.NewStatCache, it needs external
+// synchronization.
+func NewSizedStatCache(maxBytes int64) gcscaching.StatCache {
+	return &sizedStatCache{
+		maxBytes: maxBytes,
+		entries:  list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+type sizedStatCache struct {
+	maxBytes int64
+
+	// The estimated size of the entries in the list.
+	//
+	// INVARIANT: size is the sum of the sizes of the entries
+	// INVARIANT: size <= maxBytes, unless there's a single entry
+	size int64
+
+	// Entries, from most to least recently used, of type *sizedStatEntry.
+	//
+	// INVARIANT: Each element is indexed by its entry's name
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+type sizedStatEntry struct {
+	name       string
+	o          *gcs.Object
+	expiration time.Time
+	size       int64
+}
+
+// Replace any entry for the given name, evicting others as necessary.
+func (sc *sizedStatCache) put(
+	name string,
+	o *gcs.Object,
+	expiration time.Time) {
+	sc.Erase(name)
+
+	e := &sizedStatEntry{
+		name:       name,
+		o:          o,
+		expiration: expiration,
+		size:       statCacheEntrySize(name, o),
+	}
+
+	sc.index[name] = sc.entries.PushFront(e)
+	sc.size += e.size
+
+	for sc.size > sc.maxBytes && sc.entries.Len() > 1 {
+		sc.remove(sc.entries.Back())
+		statCacheEvictions.Add(1)
+	}
+}
+
+func (sc *sizedStatCache) remove(elem *list.Element) {
+	e := sc.entries.Remove(elem).(*sizedStatEntry)
+	delete(sc.index, e.name)
+	sc.size -= e.size
+}
+
+func (sc *sizedStatCache) Insert(o *gcs.Object, expiration time.Time) {
+	// Keep an existing entry for a newer generation, as gcscaching does, but
+	// always replace negative entries.
+	if elem, ok := sc.index[o.Name]; ok {
+		existing := elem.Value.(*sizedStatEntry).o
+		if existing != nil {
+			if o.Generation != existing.Generation {
+				if o.Generation < existing.Generation {
+					return
+				}
+			} else if o.MetaGeneration < existing.MetaGeneration {
+				return
+			}
+		}
+	}
+
+	sc.put(o.Name, o, expiration)
+}
+
+func (sc *sizedStatCache) AddNegativeEntry(name string, expiration time.Time) {
+	sc.put(name, nil, expiration)
+}
+
+func (sc *sizedStatCache) Erase(name string) {
+	if elem, ok := sc.index[name]; ok {
+		sc.remove(elem)
+	}
+}
+
+func (sc *sizedStatCache) LookUp(
+	name string,
+	now time.Time) (hit bool, o *gcs.Object) {
+	elem, ok := sc.index[name]
+	if !ok {
+		return
+	}
+
+	e := elem.Value.(*sizedStatEntry)
+	if e.expiration.Before(now) {
+		sc.remove(elem)
+		return
+	}
+
+	sc.entries.MoveToFront(elem)
+	hit = true
+	o = e.o
+
+	return
+}
+
+func (sc *sizedStatCache) CheckInvariants() {
+	var size int64
+	for elem := sc.entries.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*sizedStatEntry)
+		if sc.index[e.name] != elem {
+			panic(fmt.Sprintf("Entry for %q not indexed", e.name))
+		}
+
+		size += e.size
+	}
+
+	if len(sc.index) != sc.entries.Len() {
+		panic(fmt.Sprintf(
+			"Index has %d entries; list has %d",
+			len(sc.index),
+			sc.entries.Len()))
+	}
+
+	if size != sc.size {
+		panic(fmt.Sprintf("Size is %d; expected %d", sc.size, size))
+	}
+
+	if sc.size > sc.maxBytes && sc.entries.Len() > 1 {
+		panic(fmt.Sprintf("Size %d exceeds %d", sc.size, sc.maxBytes))
+	}
+}
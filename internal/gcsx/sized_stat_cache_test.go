@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestSizedStatCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Room for three small entries, but not four.
+const sizedStatCacheBytes = 3 * 600
+
+type SizedStatCacheTest struct {
+	now   time.Time
+	cache gcscaching.StatCache
+}
+
+var _ SetUpInterface = &SizedStatCacheTest{}
+var _ TearDownInterface = &SizedStatCacheTest{}
+
+func init() { RegisterTestSuite(&SizedStatCacheTest{}) }
+
+func (t *SizedStatCacheTest) SetUp(ti *TestInfo) {
+	t.now = time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local)
+	t.cache = gcsx.NewSizedStatCache(sizedStatCacheBytes)
+}
+
+func (t *SizedStatCacheTest) TearDown() {
+	t.cache.CheckInvariants()
+}
+
+func (t *SizedStatCacheTest) insert(name string, generation int64) {
+	t.cache.Insert(
+		&gcs.Object{Name: name, Generation: generation},
+		t.now.Add(time.Hour))
+}
+
+func (t *SizedStatCacheTest) generation(name string) (g int64) {
+	hit, o := t.cache.LookUp(name, t.now)
+	if hit && o != nil {
+		g = o.Generation
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SizedStatCacheTest) EvictsLeastRecentlyUsed() {
+	evictions := gcsx.StatCacheEvictions()
+
+	t.insert("a", 1)
+	t.insert("b", 1)
+	t.insert("c", 1)
+
+	// Use "a", so that "b" is evicted.
+	ExpectEq(1, t.generation("a"))
+	t.insert("d", 1)
+
+	ExpectEq(1, t.generation("a"))
+	ExpectEq(0, t.generation("b"))
+	ExpectEq(1, t.generation("c"))
+	ExpectEq(1, t.generation("d"))
+	ExpectEq(evictions+1, gcsx.StatCacheEvictions())
+}
+
+func (t *SizedStatCacheTest) LargeObjectsTakeMoreRoom() {
+	t.insert("a", 1)
+	t.insert("b", 1)
+
+	t.cache.Insert(
+		&gcs.Object{
+			Name:     "c",
+			Metadata: map[string]string{"k": strings.Repeat("x", 600)},
+		},
+		t.now.Add(time.Hour))
+
+	// It takes the place of "a", where a small object would have fit.
+	ExpectEq(0, t.generation("a"))
+	ExpectEq(1, t.generation("b"))
+
+	hit, _ := t.cache.LookUp("c", t.now)
+	ExpectTrue(hit)
+}
+
+func (t *SizedStatCacheTest) KeepsNewerGenerations() {
+	t.insert("a", 2)
+	t.insert("a", 1)
+	ExpectEq(2, t.generation("a"))
+
+	t.insert("a", 3)
+	ExpectEq(3, t.generation("a"))
+
+	t.cache.AddNegativeEntry("a", t.now.Add(time.Hour))
+	hit, o := t.cache.LookUp("a", t.now)
+	ExpectTrue(hit)
+	ExpectEq(nil, o)
+
+	t.insert("a", 1)
+	ExpectEq(1, t.generation("a"))
+}
+
+func (t *SizedStatCacheTest) Expiration() {
+	t.insert("a", 1)
+
+	t.now = t.now.Add(time.Hour + time.Second)
+	hit, _ := t.cache.LookUp("a", t.now)
+	ExpectFalse(hit)
+}
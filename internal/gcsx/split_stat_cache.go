@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/jacobsa/timeutil"
+)
+
+// NewSplitStatCache returns a stat cache that keeps positive entries in one
+// cache and negative entries, recording that an object doesn't exist, in
+// another. Negative entries expire negativeTTL after they're added, whatever
+// expiration time is requested, so that they may be kept for a different time
+// than positive ones. Either cache may be nil to disable entries of that kind.
+//
+// Keeping them apart also means that looking up many names that don't exist,
+// as build systems and language runtimes do when searching paths, can't evict
+// the entries for the objects that do.
+func NewSplitStatCache(
+	positive gcscaching.StatCache,
+	negative gcscaching.StatCache,
+	negativeTTL time.Duration,
+	clock timeutil.Clock) gcscaching.StatCache {
+	return &splitStatCache{
+		positive:    positive,
+		negative:    negative,
+		negativeTTL: negativeTTL,
+		clock:       clock,
+	}
+}
+
+type splitStatCache struct {
+	positive    gcscaching.StatCache
+	negative    gcscaching.StatCache
+	negativeTTL time.Duration
+	clock       timeutil.Clock
+}
+
+func (sc *splitStatCache) Insert(o *gcs.Object, expiration time.Time) {
+	if sc.negative != nil {
+		sc.negative.Erase(o.Name)
+	}
+
+	if sc.positive != nil {
+		sc.positive.Insert(o, expiration)
+	}
+}
+
+func (sc *splitStatCache) AddNegativeEntry(name string, expiration time.Time) {
+	if sc.positive != nil {
+		sc.positive.Erase(name)
+	}
+
+	if sc.negative != nil {
+		sc.negative.AddNegativeEntry(name, sc.clock.Now().Add(sc.negativeTTL))
+	}
+}
+
+func (sc *splitStatCache) Erase(name string) {
+	if sc.positive != nil {
+		sc.positive.Erase(name)
+	}
+
+	if sc.negative != nil {
+		sc.negative.Erase(name)
+	}
+}
+
+func (sc *splitStatCache) LookUp(
+	name string,
+	now time.Time) (hit bool, o *gcs.Object) {
+	if sc.positive != nil {
+		hit, o = sc.positive.LookUp(name, now)
+		if hit {
+			return
+		}
+	}
+
+	if sc.negative != nil {
+		hit, o = sc.negative.LookUp(name, now)
+	}
+
+	return
+}
+
+func (sc *splitStatCache) CheckInvariants() {
+	if sc.positive != nil {
+		sc.positive.CheckInvariants()
+	}
+
+	if sc.negative != nil {
+		sc.negative.CheckInvariants()
+	}
+}
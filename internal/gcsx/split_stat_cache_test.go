@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestSplitStatCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const negativeTTL = time.Second
+
+type SplitStatCacheTest struct {
+	clock    timeutil.SimulatedClock
+	positive gcscaching.StatCache
+	negative gcscaching.StatCache
+	cache    gcscaching.StatCache
+}
+
+var _ SetUpInterface = &SplitStatCacheTest{}
+
+func init() { RegisterTestSuite(&SplitStatCacheTest{}) }
+
+func (t *SplitStatCacheTest) SetUp(ti *TestInfo) {
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.positive = gcscaching.NewStatCache(2)
+	t.negative = gcscaching.NewStatCache(2)
+	t.cache = gcsx.NewSplitStatCache(
+		t.positive,
+		t.negative,
+		negativeTTL,
+		&t.clock)
+}
+
+func (t *SplitStatCacheTest) expiration() time.Time {
+	return t.clock.Now().Add(time.Hour)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SplitStatCacheTest) NegativeEntriesUseTheirOwnTTL() {
+	t.cache.AddNegativeEntry("foo", t.expiration())
+
+	hit, o := t.cache.LookUp("foo", t.clock.Now())
+	ExpectTrue(hit)
+	ExpectEq(nil, o)
+
+	t.clock.AdvanceTime(negativeTTL + time.Millisecond)
+	hit, _ = t.cache.LookUp("foo", t.clock.Now())
+	ExpectFalse(hit)
+}
+
+func (t *SplitStatCacheTest) NegativeEntriesDontEvictPositiveOnes() {
+	t.cache.Insert(&gcs.Object{Name: "foo"}, t.expiration())
+	for i := 0; i < 10; i++ {
+		t.cache.AddNegativeEntry(fmt.Sprintf("missing%d", i), t.expiration())
+	}
+
+	hit, o := t.cache.LookUp("foo", t.clock.Now())
+	ExpectTrue(hit)
+	AssertNe(nil, o)
+	ExpectEq("foo", o.Name)
+}
+
+func (t *SplitStatCacheTest) EntriesReplaceEachOther() {
+	t.cache.AddNegativeEntry("foo", t.expiration())
+	t.cache.Insert(&gcs.Object{Name: "foo"}, t.expiration())
+
+	hit, o := t.cache.LookUp("foo", t.clock.Now())
+	ExpectTrue(hit)
+	ExpectNe(nil, o)
+
+	t.cache.AddNegativeEntry("foo", t.expiration())
+
+	hit, o = t.cache.LookUp("foo", t.clock.Now())
+	ExpectTrue(hit)
+	ExpectEq(nil, o)
+
+	t.cache.Erase("foo")
+
+	hit, _ = t.cache.LookUp("foo", t.clock.Now())
+	ExpectFalse(hit)
+}
+
+func (t *SplitStatCacheTest) NegativeEntriesDisabled() {
+	t.cache = gcsx.NewSplitStatCache(t.positive, nil, negativeTTL, &t.clock)
+	t.cache.AddNegativeEntry("foo", t.expiration())
+
+	hit, _ := t.cache.LookUp("foo", t.clock.Now())
+	ExpectFalse(hit)
+}
@@ -0,0 +1,327 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/httputil"
+	"golang.org/x/net/context"
+)
+
+// How many times to retry a read that stalls before giving up.
+const maxStallRetries = 3
+
+// How long to avoid an address on which a read has stalled, when asked to.
+const stalledAddrTTL = 10 * time.Minute
+
+// Matches the Range headers sent by package gcs, which give a first byte and
+// optionally a last byte.
+var rangeRegexp = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+var errStalled = errors.New("Read stalled")
+
+// NewStallRoundTripper returns a round tripper that sends requests with the
+// supplied HTTP transport, which it takes over, and watches the bodies of
+// responses to requests for object contents. If no data arrives for the given timeout, it cancels the
+// request, which closes its connection, and asks again for the rest of the
+// range on another. It gives up after a few attempts.
+//
+// If avoidStalledAddrs is set, it also avoids dialing the address of the
+// server from which a read stalled for a while, as long as the host name
+// resolves to others.
+func NewStallRoundTripper(
+	timeout time.Duration,
+	avoidStalledAddrs bool,
+	transport *http.Transport) (rt httputil.CancellableRoundTripper) {
+	s := &stallRoundTripper{
+		timeout:     timeout,
+		dialContext: transport.DialContext,
+		stalled:     make(map[string]time.Time),
+	}
+
+	if s.dialContext == nil {
+		var d net.Dialer
+		s.dialContext = d.DialContext
+	}
+
+	if avoidStalledAddrs {
+		transport.DialContext = s.dial
+	}
+
+	s.wrapped = transport
+	rt = s
+	return
+}
+
+type stallRoundTripper struct {
+	timeout time.Duration
+	wrapped *http.Transport
+
+	// The transport's original function for dialing addresses.
+	dialContext func(
+		ctx context.Context,
+		network string,
+		addr string) (net.Conn, error)
+
+	mu sync.Mutex
+
+	// The IP addresses on which reads have stalled, and when.
+	//
+	// GUARDED_BY(mu)
+	stalled map[string]time.Time
+}
+
+func (rt *stallRoundTripper) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	if req.Method != "GET" || req.URL.Query().Get("alt") != "media" {
+		resp, err = rt.wrapped.RoundTrip(req)
+		return
+	}
+
+	// Find the range requested, which we will need to ask for the rest of it.
+	var start int64
+	end := ""
+	if h := req.Header.Get("Range"); h != "" {
+		m := rangeRegexp.FindStringSubmatch(h)
+		if m == nil {
+			resp, err = rt.wrapped.RoundTrip(req)
+			return
+		}
+
+		start, _ = strconv.ParseInt(m[1], 10, 64)
+		end = m[2]
+	}
+
+	b := &stallBody{
+		rt:     rt,
+		req:    req,
+		offset: start,
+		end:    end,
+	}
+
+	resp, err = b.send(req)
+	if err != nil {
+		return
+	}
+
+	b.body = resp.Body
+	resp.Body = b
+	return
+}
+
+func (rt *stallRoundTripper) CancelRequest(req *http.Request) {
+	// Requests are cancelled through their contexts and Cancel channels.
+}
+
+// LOCKS_EXCLUDED(rt.mu)
+func (rt *stallRoundTripper) noteStalled(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	rt.mu.Lock()
+	rt.stalled[host] = time.Now()
+	rt.mu.Unlock()
+}
+
+// Dial the given address, trying the IP addresses to which its host resolves
+// in order, except for those on which reads have recently stalled, which are
+// tried last.
+//
+// LOCKS_EXCLUDED(rt.mu)
+func (rt *stallRoundTripper) dial(
+	ctx context.Context,
+	network string,
+	addr string) (conn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		conn, err = rt.dialContext(ctx, network, addr)
+		return
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return
+	}
+
+	var preferred, avoided []string
+	rt.mu.Lock()
+	for _, ip := range ips {
+		s := ip.String()
+		if t, ok := rt.stalled[s]; ok && time.Since(t) < stalledAddrTTL {
+			avoided = append(avoided, s)
+		} else {
+			delete(rt.stalled, s)
+			preferred = append(preferred, s)
+		}
+	}
+	rt.mu.Unlock()
+
+	for _, ip := range append(preferred, avoided...) {
+		conn, err = rt.dialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return
+		}
+	}
+
+	return
+}
+
+// The body of a response with object contents, which replaces a stalled
+// response with a request for the rest of the range.
+type stallBody struct {
+	rt  *stallRoundTripper
+	req *http.Request
+
+	// The response body currently being read, a function that cancels the
+	// request for it, and the address of the server sending it.
+	body   io.ReadCloser
+	cancel func()
+	addr   string
+
+	// The offset within the object of the next byte to be read, and the last
+	// byte requested, if any.
+	offset int64
+	end    string
+
+	retries int
+}
+
+// Send the given request, arranging to be able to cancel it and to learn the
+// address of the server that answers it.
+func (b *stallBody) send(req *http.Request) (resp *http.Response, err error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			b.addr = info.Conn.RemoteAddr().String()
+		},
+	})
+
+	resp, err = b.rt.wrapped.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return
+	}
+
+	b.cancel = cancel
+	return
+}
+
+// Ask again for the rest of the range, replacing b.body.
+func (b *stallBody) resend() (err error) {
+	b.body.Close()
+	b.cancel()
+
+	req := b.req.Clone(b.req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", b.offset, b.end))
+
+	resp, err := b.send(req)
+	if err != nil {
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		b.body = resp.Body
+
+	// The stall came after the last byte.
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		b.body = http.NoBody
+
+	default:
+		resp.Body.Close()
+		err = fmt.Errorf("Unexpected status %q for the rest of a range", resp.Status)
+	}
+
+	return
+}
+
+// Read from b.body, returning errStalled if nothing arrives in time.
+func (b *stallBody) readOnce(p []byte) (n int, err error) {
+	var mu sync.Mutex
+	stalled := false
+
+	timer := time.AfterFunc(b.rt.timeout, func() {
+		mu.Lock()
+		stalled = true
+		mu.Unlock()
+
+		b.cancel()
+	})
+
+	n, err = b.body.Read(p)
+	timer.Stop()
+
+	mu.Lock()
+	if stalled {
+		err = errStalled
+	}
+	mu.Unlock()
+
+	return
+}
+
+func (b *stallBody) Read(p []byte) (n int, err error) {
+	for {
+		n, err = b.readOnce(p)
+		b.offset += int64(n)
+		if err != errStalled {
+			return
+		}
+
+		if b.retries == maxStallRetries {
+			err = fmt.Errorf("Read stalled %d times; giving up", b.retries+1)
+			return
+		}
+
+		b.retries++
+		logger.Warningf(
+			"Read of %s from %s stalled at offset %d; retrying.",
+			b.req.URL,
+			b.addr,
+			b.offset)
+
+		b.rt.noteStalled(b.addr)
+
+		err = b.resend()
+		if err != nil {
+			err = fmt.Errorf("resend: %v", err)
+			return
+		}
+
+		if n > 0 {
+			return
+		}
+	}
+}
+
+func (b *stallBody) Close() (err error) {
+	err = b.body.Close()
+	b.cancel()
+	return
+}
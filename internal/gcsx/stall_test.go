@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestStall(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const stallTimeout = 50 * time.Millisecond
+
+// The contents of the object served by the test server.
+const stallContents = "taco burrito enchilada"
+
+type StallTest struct {
+	server *httptest.Server
+	client *http.Client
+
+	mu sync.Mutex
+
+	// The Range headers of the requests received so far.
+	//
+	// GUARDED_BY(mu)
+	ranges []string
+
+	// How many responses should stall after sending a few bytes.
+	//
+	// GUARDED_BY(mu)
+	stalls int
+}
+
+var _ SetUpInterface = &StallTest{}
+var _ TearDownInterface = &StallTest{}
+
+func init() { RegisterTestSuite(&StallTest{}) }
+
+func (t *StallTest) SetUp(ti *TestInfo) {
+	t.server = httptest.NewServer(http.HandlerFunc(t.serve))
+	t.client = &http.Client{
+		Transport: gcsx.NewStallRoundTripper(
+			stallTimeout,
+			true,
+			http.DefaultTransport.(*http.Transport).Clone()),
+	}
+}
+
+func (t *StallTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *StallTest) serve(w http.ResponseWriter, r *http.Request) {
+	var start, end int
+	t.mu.Lock()
+	t.ranges = append(t.ranges, r.Header.Get("Range"))
+	stall := t.stalls > 0
+	t.stalls--
+	t.mu.Unlock()
+
+	end = len(stallContents) - 1
+	fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+	if end >= len(stallContents) {
+		end = len(stallContents) - 1
+	}
+
+	w.WriteHeader(http.StatusPartialContent)
+
+	contents := stallContents[start : end+1]
+	if !stall {
+		w.Write([]byte(contents))
+		return
+	}
+
+	// Send a few bytes, then nothing until the client goes away.
+	w.Write([]byte(contents[:5]))
+	w.(http.Flusher).Flush()
+	<-r.Context().Done()
+}
+
+// Read the object through the round tripper with the given Range header.
+func (t *StallTest) read(query string, rangeHeader string) (s string, err error) {
+	req, err := http.NewRequest("GET", t.server.URL+"/o/foo?"+query, nil)
+	AssertEq(nil, err)
+
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	resp, err := t.client.Do(req)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	s = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StallTest) NoStall() {
+	s, err := t.read("alt=media", "bytes=5-11")
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+	ExpectThat(t.ranges, ElementsAre("bytes=5-11"))
+}
+
+func (t *StallTest) StallIsRetried() {
+	t.stalls = 1
+
+	s, err := t.read("alt=media", "bytes=5-")
+	AssertEq(nil, err)
+	ExpectEq("burrito enchilada", s)
+	ExpectThat(t.ranges, ElementsAre("bytes=5-", "bytes=10-"))
+}
+
+func (t *StallTest) StallWithoutRange() {
+	t.stalls = 2
+
+	s, err := t.read("alt=media", "")
+	AssertEq(nil, err)
+	ExpectEq(stallContents, s)
+	ExpectThat(t.ranges, ElementsAre("", "bytes=5-", "bytes=10-"))
+}
+
+func (t *StallTest) GivesUp() {
+	t.stalls = 100
+
+	_, err := t.read("alt=media", "bytes=0-21")
+	ExpectThat(err, Error(HasSubstr("giving up")))
+	ExpectEq(4, len(t.ranges))
+}
+
+func (t *StallTest) OtherRequestsNotWatched() {
+	t.stalls = 1
+
+	start := time.Now()
+	go func() {
+		time.Sleep(4 * stallTimeout)
+		t.server.CloseClientConnections()
+	}()
+
+	s, _ := t.read("alt=json", "")
+	ExpectEq("taco ", s)
+	ExpectThat(t.ranges, ElementsAre(""))
+	ExpectGe(time.Since(start), 4*stallTimeout)
+}
@@ -0,0 +1,237 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// The storage classes that may be chosen for new objects.
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+// StorageClasses returns the storage classes that may be chosen for new
+// objects.
+func StorageClasses() []string {
+	return append([]string(nil), storageClasses...)
+}
+
+// ParseStorageClass returns the storage class with the given name, which is
+// case-insensitive.
+func ParseStorageClass(s string) (class string, err error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for _, c := range storageClasses {
+		if c == upper {
+			class = c
+			return
+		}
+	}
+
+	err = fmt.Errorf(
+		"Unknown storage class %q; expected one of %s",
+		s,
+		strings.Join(storageClasses, ", "))
+
+	return
+}
+
+// A StorageClassRule chooses the storage class of new objects whose names
+// begin with a prefix.
+type StorageClassRule struct {
+	Prefix string
+	Class  string
+}
+
+// ParseStorageClassRule parses a rule of the form "prefix:class".
+func ParseStorageClassRule(s string) (r StorageClassRule, err error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		err = fmt.Errorf("Expected prefix:class, got %q", s)
+		return
+	}
+
+	r.Prefix = strings.TrimSpace(s[:i])
+	r.Class, err = ParseStorageClass(s[i+1:])
+	if err != nil {
+		err = fmt.Errorf("In %q: %v", s, err)
+		return
+	}
+
+	return
+}
+
+// String formats the rule as ParseStorageClassRule accepts it.
+func (r StorageClassRule) String() string {
+	return r.Prefix + ":" + r.Class
+}
+
+// NewStorageClassRoundTripper returns a round tripper that sets the storage
+// class of objects created by uploads and compositions to that of the rule
+// with the longest prefix of the object's name, or to defaultClass if none
+// matches. An empty defaultClass leaves the bucket's default. Requests that
+// already name a storage class, and those creating objects within temporary
+// directories named tmpPrefix, which are soon deleted, are passed through
+// unmodified, as are all others.
+func NewStorageClassRoundTripper(
+	defaultClass string,
+	rules []StorageClassRule,
+	tmpPrefix string,
+	wrapped httputil.CancellableRoundTripper) httputil.CancellableRoundTripper {
+	s := &storageClassRewriter{
+		defaultClass: defaultClass,
+		rules:        rules,
+		tmpPrefix:    tmpPrefix,
+	}
+
+	return newRewritingRoundTripper(s.rewrite, wrapped)
+}
+
+type storageClassRewriter struct {
+	defaultClass string
+	rules        []StorageClassRule
+	tmpPrefix    string
+}
+
+// Return the storage class for a new object with the given name, or the empty
+// string to leave the bucket's default.
+func (s *storageClassRewriter) classFor(name string) (class string) {
+	if s.tmpPrefix != "" &&
+		(strings.HasPrefix(name, s.tmpPrefix) ||
+			strings.Contains(name, "/"+s.tmpPrefix)) {
+		return
+	}
+
+	class = s.defaultClass
+	longest := -1
+	for _, r := range s.rules {
+		if strings.HasPrefix(name, r.Prefix) && len(r.Prefix) > longest {
+			class = r.Class
+			longest = len(r.Prefix)
+		}
+	}
+
+	return
+}
+
+// Set the storage class in the supplied JSON object resource, returning nil if
+// it should be left alone.
+func (s *storageClassRewriter) setClass(
+	resource json.RawMessage) (modified json.RawMessage, err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(resource, &fields); err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	if _, ok := fields["storageClass"]; ok {
+		return
+	}
+
+	var name string
+	if err = json.Unmarshal(fields["name"], &name); err != nil {
+		err = fmt.Errorf("Unmarshal name: %v", err)
+		return
+	}
+
+	class := s.classFor(name)
+	if class == "" {
+		return
+	}
+
+	fields["storageClass"], _ = json.Marshal(class)
+	modified, err = json.Marshal(fields)
+	return
+}
+
+// Return the body to send in place of the supplied one, or nil to send it
+// unmodified. Uploads begin with the object resource, while compositions give
+// it as their destination.
+func (s *storageClassRewriter) modifyBody(
+	body []byte,
+	compose bool) (modified []byte, err error) {
+	if !compose {
+		modified, err = s.setClass(body)
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(body, &fields); err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	if fields["destination"] == nil {
+		return
+	}
+
+	dst, err := s.setClass(fields["destination"])
+	if err != nil || dst == nil {
+		return
+	}
+
+	fields["destination"] = dst
+	modified, err = json.Marshal(fields)
+	return
+}
+
+func (s *storageClassRewriter) rewrite(
+	req *http.Request) (modified *http.Request, err error) {
+	// Resumable uploads are started by posting the object resource to the
+	// bucket's objects under /upload/. Object names are escaped in paths, so
+	// only compositions end in "/compose".
+	p := requestPath(req.URL)
+	upload := strings.HasPrefix(p, "/upload/") &&
+		strings.HasSuffix(p, "/o") &&
+		req.URL.Query().Get("uploadType") == "resumable"
+
+	compose := strings.HasSuffix(p, "/compose")
+
+	if req.Method != "POST" || req.Body == nil || !(upload || compose) {
+		modified = req
+		return
+	}
+
+	// We must close the body we were given, whatever happens.
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		err = fmt.Errorf("Reading request body: %v", err)
+		return
+	}
+
+	modifiedBody, err := s.modifyBody(body, compose)
+	if err != nil {
+		err = fmt.Errorf("Setting storage class: %v", err)
+		return
+	}
+
+	if modifiedBody == nil {
+		modifiedBody = body
+	}
+
+	// Make a copy of the request with the new body.
+	modified = new(http.Request)
+	*modified = *req
+	modified.Body = ioutil.NopCloser(bytes.NewReader(modifiedBody))
+	modified.ContentLength = int64(len(modifiedBody))
+
+	return
+}
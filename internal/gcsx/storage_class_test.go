@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestStorageClass(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StorageClassTest struct {
+	wrapped capturingRoundTripper
+	rt      http.RoundTripper
+}
+
+var _ SetUpInterface = &StorageClassTest{}
+
+func init() { RegisterTestSuite(&StorageClassTest{}) }
+
+func (t *StorageClassTest) SetUp(ti *TestInfo) {
+	t.rt = gcsx.NewStorageClassRoundTripper(
+		"NEARLINE",
+		[]gcsx.StorageClassRule{
+			{Prefix: "archive/", Class: "ARCHIVE"},
+			{Prefix: "archive/hot/", Class: "STANDARD"},
+		},
+		".gcsfuse_tmp/",
+		&t.wrapped)
+}
+
+// Send a POST with the given opaque URL, query, and JSON body, returning the
+// body received by the wrapped round tripper, decoded.
+func (t *StorageClassTest) send(
+	opaque string,
+	rawQuery string,
+	body string) (received map[string]interface{}) {
+	req := &http.Request{
+		Method: "POST",
+		URL: &url.URL{
+			Scheme:   "https",
+			Host:     "www.googleapis.com",
+			Opaque:   opaque,
+			RawQuery: rawQuery,
+		},
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+	}
+
+	_, err := t.rt.RoundTrip(req)
+	AssertEq(nil, err)
+	AssertEq(1, len(t.wrapped.requests))
+
+	r := t.wrapped.requests[0]
+	t.wrapped.requests = nil
+
+	b, err := ioutil.ReadAll(r.Body)
+	AssertEq(nil, err)
+	ExpectEq(len(b), r.ContentLength)
+
+	err = json.Unmarshal(b, &received)
+	AssertEq(nil, err)
+	return
+}
+
+const uploadOpaque = "//www.googleapis.com/upload/storage/v1/b/some_bucket/o"
+
+// Return the storage class given when uploading the named object.
+func (t *StorageClassTest) uploadClass(name string) interface{} {
+	received := t.send(
+		uploadOpaque,
+		"uploadType=resumable",
+		`{"name":"`+name+`"}`)
+
+	ExpectEq(name, received["name"])
+	return received["storageClass"]
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StorageClassTest) ParseRule() {
+	r, err := gcsx.ParseStorageClassRule("logs/2015:coldline")
+	AssertEq(nil, err)
+	ExpectEq("logs/2015", r.Prefix)
+	ExpectEq("COLDLINE", r.Class)
+	ExpectEq("logs/2015:COLDLINE", r.String())
+
+	_, err = gcsx.ParseStorageClassRule("logs/")
+	ExpectThat(err, Error(HasSubstr("prefix:class")))
+
+	_, err = gcsx.ParseStorageClassRule("logs/:CHILLY")
+	ExpectThat(err, Error(HasSubstr("Unknown storage class")))
+}
+
+func (t *StorageClassTest) DefaultClass() {
+	ExpectEq("NEARLINE", t.uploadClass("foo"))
+	ExpectEq("NEARLINE", t.uploadClass("archived"))
+}
+
+func (t *StorageClassTest) LongestPrefixWins() {
+	ExpectEq("ARCHIVE", t.uploadClass("archive/foo"))
+	ExpectEq("STANDARD", t.uploadClass("archive/hot/foo"))
+}
+
+func (t *StorageClassTest) TemporaryObjectsLeftAlone() {
+	ExpectEq(nil, t.uploadClass(".gcsfuse_tmp/foo"))
+	ExpectEq(nil, t.uploadClass("archive/.gcsfuse_tmp/foo"))
+}
+
+func (t *StorageClassTest) ExistingClassKept() {
+	received := t.send(
+		uploadOpaque,
+		"uploadType=resumable",
+		`{"name":"foo","storageClass":"COLDLINE"}`)
+
+	ExpectEq("COLDLINE", received["storageClass"])
+}
+
+func (t *StorageClassTest) Compose() {
+	received := t.send(
+		"//www.googleapis.com/storage/v1/b/some_bucket/o/archive%2Ffoo/compose",
+		"",
+		`{"destination":{"name":"archive/foo"},`+
+			`"sourceObjects":[{"name":"a","generation":"1234"}]}`)
+
+	dst := received["destination"].(map[string]interface{})
+	ExpectEq("archive/foo", dst["name"])
+	ExpectEq("ARCHIVE", dst["storageClass"])
+
+	// Other fields are left alone.
+	srcs := received["sourceObjects"].([]interface{})
+	AssertEq(1, len(srcs))
+	ExpectEq("1234", srcs[0].(map[string]interface{})["generation"])
+}
+
+func (t *StorageClassTest) OtherRequestsUnmodified() {
+	body := `{"name":"foo"}`
+	received := t.send(
+		"//www.googleapis.com/storage/v1/b/some_bucket/o/foo",
+		"",
+		body)
+
+	ExpectEq(nil, received["storageClass"])
+}
+
+func (t *StorageClassTest) NoDefault() {
+	t.rt = gcsx.NewStorageClassRoundTripper(
+		"",
+		[]gcsx.StorageClassRule{{Prefix: "archive/", Class: "ARCHIVE"}},
+		".gcsfuse_tmp/",
+		&t.wrapped)
+
+	ExpectEq(nil, t.uploadClass("foo"))
+	ExpectEq("ARCHIVE", t.uploadClass("archive/foo"))
+}
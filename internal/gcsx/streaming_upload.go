@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The error with which the contents of an aborted upload end, so that GCS
+// never sees them as complete.
+var errUploadAborted = errors.New("Upload aborted")
+
+// StreamingUpload creates an object from contents supplied in order by calls
+// to Write, handing each to GCS as it arrives rather than staging the whole
+// object locally first. The object doesn't exist until Finish returns.
+//
+// Writes block while GCS catches up, so the memory used is bounded regardless
+// of the size of the object. A StreamingUpload is not safe for concurrent use.
+type StreamingUpload struct {
+	name string
+	pw   *io.PipeWriter
+
+	// The number of bytes written so far.
+	size int64
+
+	// Cancels the context of the request.
+	cancel func()
+
+	// Closed when the request has finished, after which o and err may be read.
+	done chan struct{}
+	o    *gcs.Object
+	err  error
+}
+
+// NewStreamingUpload starts an upload that creates an object as described by
+// req, whose Contents field is ignored. The upload continues until Finish or
+// Abort is called.
+func NewStreamingUpload(
+	bucket gcs.Bucket,
+	req *gcs.CreateObjectRequest) (u *StreamingUpload) {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	u = &StreamingUpload{
+		name:   req.Name,
+		pw:     pw,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	reqCopy := *req
+	r, untrack := trackUpload(req.Name, -1, pr)
+	reqCopy.Contents = r
+
+	go func() {
+		defer close(u.done)
+		defer untrack()
+
+		u.o, u.err = bucket.CreateObject(ctx, &reqCopy)
+
+		// Unblock the writer if the request gave up before reading everything.
+		if u.err != nil {
+			pr.CloseWithError(u.err)
+		} else {
+			pr.Close()
+		}
+	}()
+
+	return
+}
+
+// Size returns the number of bytes written so far.
+func (u *StreamingUpload) Size() int64 {
+	return u.size
+}
+
+// Write appends to the contents of the object, blocking until GCS has
+// accepted p or the upload has failed.
+func (u *StreamingUpload) Write(p []byte) (n int, err error) {
+	n, err = u.pw.Write(p)
+	u.size += int64(n)
+
+	if err != nil {
+		err = fmt.Errorf("Uploading %q: %v", u.name, err)
+		return
+	}
+
+	return
+}
+
+// Finish marks the end of the contents and waits for GCS to create the
+// object, returning it. Precondition errors are returned unmangled. Neither
+// Write nor Finish may be called again afterward.
+func (u *StreamingUpload) Finish(ctx context.Context) (o *gcs.Object, err error) {
+	u.pw.Close()
+
+	select {
+	case <-u.done:
+
+	case <-ctx.Done():
+		u.Abort()
+		err = ctx.Err()
+		return
+	}
+
+	o, err = u.o, u.err
+	if err != nil {
+		if _, ok := err.(*gcs.PreconditionError); ok {
+			return
+		}
+
+		err = fmt.Errorf("CreateObject: %v", err)
+		return
+	}
+
+	return
+}
+
+// Abort abandons the upload without creating the object, and without
+// waiting for the request to finish. It may be called at any time, including
+// after Finish.
+func (u *StreamingUpload) Abort() {
+	u.pw.CloseWithError(errUploadAborted)
+	u.cancel()
+}
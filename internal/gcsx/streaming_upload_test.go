@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStreamingUpload(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that reads the contents of new objects before creating them. The
+// fake bucket holds its lock while reading contents, so without this nothing
+// else could use it while an upload is streaming.
+type bufferingBucket struct {
+	gcs.Bucket
+}
+
+func (b *bufferingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	contents, err := ioutil.ReadAll(req.Contents)
+	if err != nil {
+		return
+	}
+
+	reqCopy := *req
+	reqCopy.Contents = bytes.NewReader(contents)
+	o, err = b.Bucket.CreateObject(ctx, &reqCopy)
+	return
+}
+
+type StreamingUploadTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &StreamingUploadTest{}
+
+func init() { RegisterTestSuite(&StreamingUploadTest{}) }
+
+func (t *StreamingUploadTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.bucket = &bufferingBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+}
+
+func (t *StreamingUploadTest) write(u *gcsx.StreamingUpload, s string) {
+	n, err := u.Write([]byte(s))
+	AssertEq(nil, err)
+	AssertEq(len(s), n)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StreamingUploadTest) CreatesObject() {
+	u := gcsx.NewStreamingUpload(
+		t.bucket,
+		&gcs.CreateObjectRequest{Name: "foo"})
+
+	t.write(u, "taco")
+	t.write(u, "burrito")
+	ExpectEq(len("tacoburrito"), u.Size())
+
+	o, err := u.Finish(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq("foo", o.Name)
+	ExpectEq(len("tacoburrito"), o.Size)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *StreamingUploadTest) EmptyObject() {
+	u := gcsx.NewStreamingUpload(
+		t.bucket,
+		&gcs.CreateObjectRequest{Name: "foo"})
+
+	o, err := u.Finish(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, o.Size)
+}
+
+func (t *StreamingUploadTest) ObjectDoesntExistUntilFinished() {
+	u := gcsx.NewStreamingUpload(
+		t.bucket,
+		&gcs.CreateObjectRequest{Name: "foo"})
+
+	defer u.Abort()
+	t.write(u, "taco")
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *StreamingUploadTest) Abort() {
+	u := gcsx.NewStreamingUpload(
+		t.bucket,
+		&gcs.CreateObjectRequest{Name: "foo"})
+
+	t.write(u, "taco")
+	u.Abort()
+
+	// The object should never appear, and further writes should fail.
+	_, err := u.Finish(t.ctx)
+	ExpectNe(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = u.Write([]byte("burrito"))
+	ExpectNe(nil, err)
+}
+
+func (t *StreamingUploadTest) PreconditionFailed() {
+	// Create an object, then try to replace a generation that isn't current.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	var generation int64 = 17
+	u := gcsx.NewStreamingUpload(
+		t.bucket,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			GenerationPrecondition: &generation,
+		})
+
+	// The failure may show up as soon as the contents are written, or when
+	// finishing.
+	u.Write([]byte("burrito"))
+
+	_, err = u.Finish(t.ctx)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *StreamingUploadTest) ShowsUpInProgress() {
+	// Use a name of our own, since aborted uploads in other tests may not have
+	// finished yet.
+	u := gcsx.NewStreamingUpload(
+		t.bucket,
+		&gcs.CreateObjectRequest{Name: "bar"})
+
+	t.write(u, "taco")
+
+	var found bool
+	for _, p := range gcsx.UploadsInProgress() {
+		if p.Name == "bar" {
+			found = true
+			ExpectEq(-1, p.BytesTotal)
+		}
+	}
+
+	ExpectTrue(found)
+
+	_, err := u.Finish(t.ctx)
+	AssertEq(nil, err)
+
+	for _, p := range gcsx.UploadsInProgress() {
+		ExpectNe("bar", p.Name)
+	}
+}
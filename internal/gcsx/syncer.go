@@ -28,6 +28,75 @@ import (
 // by time.RFC3339Nano.
 const MtimeMetadataKey = "gcsfuse_mtime"
 
+// Metadata keys holding the permission bits, owner, and group that the file
+// system records for a file when asked to preserve them: the bits in octal,
+// and the IDs in decimal. Objects created by Syncer.SyncObject carry these
+// over from their source objects, so that writing to a file doesn't reset
+// them.
+const (
+	ModeMetadataKey = "gcsfuse_mode"
+	UIDMetadataKey  = "gcsfuse_uid"
+	GIDMetadataKey  = "gcsfuse_gid"
+)
+
+// PosixMetadata returns the subset of o's metadata recording its POSIX
+// attributes, or nil if there is none.
+func PosixMetadata(o *gcs.Object) (metadata map[string]string) {
+	for _, k := range []string{ModeMetadataKey, UIDMetadataKey, GIDMetadataKey} {
+		if v, ok := o.Metadata[k]; ok {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+
+			metadata[k] = v
+		}
+	}
+
+	return
+}
+
+// Return the metadata for an object replacing srcObject with new contents
+// last modified at the given time.
+func syncedMetadata(
+	srcObject *gcs.Object,
+	mtime time.Time) (metadata map[string]string) {
+	metadata = PosixMetadata(srcObject)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+
+	metadata[MtimeMetadataKey] = mtime.Format(time.RFC3339Nano)
+	return
+}
+
+// An UnchangedContentPolicy says what a Syncer does with modified content
+// that turns out to be identical to that of its source object, as when a tool
+// rewrites a file without changing it.
+type UnchangedContentPolicy string
+
+const (
+	// Write out a new generation as usual.
+	UnchangedContentUpload UnchangedContentPolicy = ""
+
+	// Leave the object alone, including its mtime.
+	UnchangedContentSkip UnchangedContentPolicy = "skip"
+
+	// Update only the object's mtime metadata.
+	UnchangedContentTouch UnchangedContentPolicy = "touch"
+)
+
+// Validate returns an error if the policy is unknown.
+func (p UnchangedContentPolicy) Validate() (err error) {
+	switch p {
+	case UnchangedContentUpload, UnchangedContentSkip, UnchangedContentTouch:
+	default:
+		err = fmt.Errorf("Unknown unchanged content policy %q", p)
+		return
+	}
+
+	return
+}
+
 // Syncer is safe for concurrent access.
 type Syncer interface {
 	// Given an object record and content that was originally derived from that
@@ -35,28 +104,60 @@ type Syncer interface {
 	//
 	// *   If the temp file has not been modified, return a nil new object.
 	//
+	// *   If the content is the same as the object's and the syncer's
+	//     UnchangedContentPolicy says not to upload it, return the object as it
+	//     now stands, which may have updated metadata.
+	//
 	// *   Otherwise, write out a new generation in the bucket (failing with
 	//     *gcs.PreconditionError if the source generation is no longer current).
 	//
-	// In the second case, the TempFile is destroyed. Otherwise, including when
+	// In the second and third cases, the TempFile is destroyed. Otherwise, including when
 	// this function fails, it is guaranteed to still be valid.
 	SyncObject(
 		ctx context.Context,
 		srcObject *gcs.Object,
 		content TempFile) (o *gcs.Object, err error)
+
+	// Report whether content may be appended to the given object with
+	// AppendObject, i.e. whether it is long enough for composing to be
+	// worthwhile and has room for another component.
+	CanAppend(srcObject *gcs.Object) bool
+
+	// Given an object record for which CanAppend returns true and content
+	// to be appended to that object's contents, write out a new generation
+	// consisting of both without reading the object (failing with
+	// *gcs.PreconditionError if the source generation is no longer current).
+	// The mtime recorded is that of the appended content.
+	//
+	// On success the TempFile is destroyed. Otherwise it is guaranteed to still
+	// be valid.
+	AppendObject(
+		ctx context.Context,
+		srcObject *gcs.Object,
+		appended TempFile) (o *gcs.Object, err error)
 }
 
 // NewSyncer creates a syncer that syncs into the supplied bucket.
 //
+// Content identical to that of the source object, judged by CRC32C, is
+// handled according to unchanged.
+//
 // When the source object has been changed only by appending, and the source
 // object's size is at least appendThreshold, we will "append" to it by writing
 // out a temporary blob and composing it with the source object.
 //
+// Otherwise, if parallelUploadThreshold is positive and the content is at
+// least that long, we will write it out as up to parallelUploadParts temporary
+// blobs uploaded concurrently, then compose them over the source object.
+//
 // Temporary blobs have names beginning with tmpObjectPrefix. We make an effort
 // to delete them, but if we are interrupted for some reason we may not be able
 // to do so. Therefore the user should arrange for garbage collection.
 func NewSyncer(
 	appendThreshold int64,
+	parallelUploadThreshold int64,
+	parallelUploadParts int,
+	unchanged UnchangedContentPolicy,
 	tmpObjectPrefix string,
 	bucket gcs.Bucket) (os Syncer) {
 	// Create the object creators.
@@ -68,8 +169,23 @@ func NewSyncer(
 		tmpObjectPrefix,
 		bucket)
 
+	var parallelCreator parallelObjectCreator
+	if parallelUploadThreshold > 0 && parallelUploadParts > 1 {
+		parallelCreator = newCompositeObjectCreator(
+			parallelUploadParts,
+			tmpObjectPrefix,
+			bucket)
+	}
+
 	// And the syncer.
-	os = newSyncer(appendThreshold, fullCreator, appendCreator)
+	os = newSyncer(
+		appendThreshold,
+		parallelUploadThreshold,
+		unchanged,
+		bucket,
+		fullCreator,
+		appendCreator,
+		parallelCreator)
 
 	return
 }
@@ -86,15 +202,18 @@ func (oc *fullObjectCreator) Create(
 	ctx context.Context,
 	srcObject *gcs.Object,
 	mtime time.Time,
+	checksums *Checksums,
 	r io.Reader) (o *gcs.Object, err error) {
 	req := &gcs.CreateObjectRequest{
 		Name: srcObject.Name,
 		GenerationPrecondition:     &srcObject.Generation,
 		MetaGenerationPrecondition: &srcObject.MetaGeneration,
 		Contents:                   r,
-		Metadata: map[string]string{
-			MtimeMetadataKey: mtime.Format(time.RFC3339Nano),
-		},
+		Metadata:                   syncedMetadata(srcObject, mtime),
+	}
+
+	if checksums != nil {
+		checksums.apply(req)
 	}
 
 	o, err = oc.bucket.CreateObject(ctx, req)
@@ -115,12 +234,15 @@ func (oc *fullObjectCreator) Create(
 // syncer
 ////////////////////////////////////////////////////////////////////////
 
-// An implementation detail of syncer. See notes on newSyncer.
+// An implementation detail of syncer. See notes on newSyncer. If checksums is
+// non-nil, it holds those of the contents read from r, which GCS is asked to
+// check.
 type objectCreator interface {
 	Create(
 		ctx context.Context,
 		srcObject *gcs.Object,
 		mtime time.Time,
+		checksums *Checksums,
 		r io.Reader) (o *gcs.Object, err error)
 }
 
@@ -137,23 +259,91 @@ type objectCreator interface {
 // worthwhile to make the append optimization. It should be set to a value on
 // the order of the bandwidth to GCS times three times the round trip latency
 // to GCS (for a small create, a compose, and a delete).
+//
+// If parallelCreator is non-nil, it is used in place of fullCreator for
+// contents at least parallelThreshold long.
+//
+// bucket is used only for updating the metadata of unchanged objects.
 func newSyncer(
 	appendThreshold int64,
+	parallelThreshold int64,
+	unchanged UnchangedContentPolicy,
+	bucket gcs.Bucket,
 	fullCreator objectCreator,
-	appendCreator objectCreator) (os Syncer) {
+	appendCreator objectCreator,
+	parallelCreator parallelObjectCreator) (os Syncer) {
 	os = &syncer{
-		appendThreshold: appendThreshold,
-		fullCreator:     fullCreator,
-		appendCreator:   appendCreator,
+		appendThreshold:   appendThreshold,
+		parallelThreshold: parallelThreshold,
+		unchanged:         unchanged,
+		bucket:            bucket,
+		fullCreator:       fullCreator,
+		appendCreator:     appendCreator,
+		parallelCreator:   parallelCreator,
 	}
 
 	return
 }
 
 type syncer struct {
-	appendThreshold int64
-	fullCreator     objectCreator
-	appendCreator   objectCreator
+	appendThreshold   int64
+	parallelThreshold int64
+	unchanged         UnchangedContentPolicy
+	bucket            gcs.Bucket
+	fullCreator       objectCreator
+	appendCreator     objectCreator
+	parallelCreator   parallelObjectCreator
+}
+
+// Return true if the content, which has the same size as the source object,
+// also has the same CRC32C.
+func sameContent(
+	srcObject *gcs.Object,
+	content TempFile) (same bool, err error) {
+	checksums, err := content.Checksums()
+	if err != nil {
+		err = fmt.Errorf("Checksums: %v", err)
+		return
+	}
+
+	same = checksums.CRC32C == srcObject.CRC32C
+	return
+}
+
+// Handle content that is the same as that of the source object, according to
+// the unchanged content policy.
+func (os *syncer) syncUnchanged(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	mtime time.Time) (o *gcs.Object, err error) {
+	if os.unchanged == UnchangedContentSkip {
+		o = new(gcs.Object)
+		*o = *srcObject
+		return
+	}
+
+	mtimeString := mtime.Format(time.RFC3339Nano)
+	o, err = os.bucket.UpdateObject(ctx, &gcs.UpdateObjectRequest{
+		Name:                       srcObject.Name,
+		Generation:                 srcObject.Generation,
+		MetaGenerationPrecondition: &srcObject.MetaGeneration,
+		Metadata: map[string]*string{
+			MtimeMetadataKey: &mtimeString,
+		},
+	})
+
+	switch err.(type) {
+	case nil, *gcs.PreconditionError:
+
+	// The source generation is no longer current.
+	case *gcs.NotFoundError:
+		err = &gcs.PreconditionError{Err: err}
+
+	default:
+		err = fmt.Errorf("UpdateObject: %v", err)
+	}
+
+	return
 }
 
 func (os *syncer) SyncObject(
@@ -195,27 +385,73 @@ func (os *syncer) SyncObject(
 	// Canonicalize to UTC.
 	mtime := sr.Mtime.UTC()
 
+	// If the content has merely been rewritten, there may be no need to upload
+	// it.
+	if os.unchanged != UnchangedContentUpload && sr.Size == srcSize {
+		var same bool
+		same, err = sameContent(srcObject, content)
+		if err != nil {
+			err = fmt.Errorf("sameContent: %v", err)
+			return
+		}
+
+		if same {
+			o, err = os.syncUnchanged(ctx, srcObject, mtime)
+			if err != nil {
+				return
+			}
+
+			content.Destroy()
+			return
+		}
+	}
+
 	// Otherwise, we need to create a new generation. If the source object is
 	// long enough, hasn't been dirtied, and has a low enough component count,
 	// then we can make the optimization of not rewriting its contents.
-	if srcSize >= os.appendThreshold &&
-		sr.DirtyThreshold == srcSize &&
-		srcObject.ComponentCount < gcs.MaxComponentCount {
+	//
+	// Either way, GCS is given checksums of what is uploaded, so that it rejects
+	// contents damaged on the way rather than storing them.
+	if os.CanAppend(srcObject) && sr.DirtyThreshold == srcSize {
+		var checksums Checksums
+		checksums, err = computeChecksums(
+			io.NewSectionReader(content, srcSize, sr.Size-srcSize))
+
+		if err != nil {
+			err = fmt.Errorf("computeChecksums: %v", err)
+			return
+		}
+
 		_, err = content.Seek(srcSize, 0)
 		if err != nil {
 			err = fmt.Errorf("Seek: %v", err)
 			return
 		}
 
-		o, err = os.appendCreator.Create(ctx, srcObject, mtime, content)
+		r, done := trackUpload(srcObject.Name, sr.Size-srcSize, content)
+		o, err = os.appendCreator.Create(ctx, srcObject, mtime, &checksums, r)
+		done()
+	} else if os.parallelCreator != nil && sr.Size >= os.parallelThreshold {
+		r, done := trackUploadAt(srcObject.Name, sr.Size, content)
+		o, err = os.parallelCreator.Create(ctx, srcObject, mtime, r, sr.Size)
+		done()
 	} else {
+		var checksums Checksums
+		checksums, err = content.Checksums()
+		if err != nil {
+			err = fmt.Errorf("Checksums: %v", err)
+			return
+		}
+
 		_, err = content.Seek(0, 0)
 		if err != nil {
 			err = fmt.Errorf("Seek: %v", err)
 			return
 		}
 
-		o, err = os.fullCreator.Create(ctx, srcObject, mtime, content)
+		r, done := trackUpload(srcObject.Name, sr.Size, content)
+		o, err = os.fullCreator.Create(ctx, srcObject, mtime, &checksums, r)
+		done()
 	}
 
 	// Deal with errors.
@@ -234,3 +470,58 @@ func (os *syncer) SyncObject(
 
 	return
 }
+
+func (os *syncer) CanAppend(srcObject *gcs.Object) bool {
+	return int64(srcObject.Size) >= os.appendThreshold &&
+		srcObject.ComponentCount < gcs.MaxComponentCount
+}
+
+func (os *syncer) AppendObject(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	appended TempFile) (o *gcs.Object, err error) {
+	sr, err := appended.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	mtime := srcObject.Updated
+	if sr.Mtime != nil {
+		mtime = *sr.Mtime
+	}
+
+	checksums, err := appended.Checksums()
+	if err != nil {
+		err = fmt.Errorf("Checksums: %v", err)
+		return
+	}
+
+	_, err = appended.Seek(0, 0)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	r, done := trackUpload(srcObject.Name, sr.Size, appended)
+	o, err = os.appendCreator.Create(
+		ctx,
+		srcObject,
+		mtime.UTC(),
+		&checksums,
+		r)
+	done()
+
+	if err != nil {
+		// Special case: don't mess with precondition errors.
+		if _, ok := err.(*gcs.PreconditionError); ok {
+			return
+		}
+
+		err = fmt.Errorf("Create: %v", err)
+		return
+	}
+
+	appended.Destroy()
+	return
+}
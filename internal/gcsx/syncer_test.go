@@ -15,6 +15,7 @@
 package gcsx
 
 import (
+	"crypto/md5"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -24,6 +25,7 @@ import (
 
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
@@ -44,8 +46,12 @@ type fakeObjectCreator struct {
 	// Supplied arguments
 	srcObject *gcs.Object
 	mtime     time.Time
+	checksums *Checksums
 	contents  []byte
 
+	// The uploads in progress at the time of the call
+	inProgress []UploadProgress
+
 	// Canned results
 	o   *gcs.Object
 	err error
@@ -55,6 +61,7 @@ func (oc *fakeObjectCreator) Create(
 	ctx context.Context,
 	srcObject *gcs.Object,
 	mtime time.Time,
+	checksums *Checksums,
 	r io.Reader) (o *gcs.Object, err error) {
 	// Have we been called more than once?
 	AssertFalse(oc.called)
@@ -63,9 +70,12 @@ func (oc *fakeObjectCreator) Create(
 	// Record args.
 	oc.srcObject = srcObject
 	oc.mtime = mtime
+	oc.checksums = checksums
 	oc.contents, err = ioutil.ReadAll(r)
 	AssertEq(nil, err)
 
+	oc.inProgress = UploadsInProgress()
+
 	// Return results.
 	o, err = oc.o, oc.err
 	return
@@ -104,8 +114,12 @@ func (t *SyncerTest) SetUp(ti *TestInfo) {
 	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
 	t.syncer = newSyncer(
 		appendThreshold,
+		0,
+		UnchangedContentUpload,
+		t.bucket,
 		&t.fullCreator,
-		&t.appendCreator)
+		&t.appendCreator,
+		nil)
 
 	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
 
@@ -132,6 +146,28 @@ func (t *SyncerTest) SetUp(ti *TestInfo) {
 	t.appendCreator.err = errors.New("Fake error")
 }
 
+// Replace the syncer with one using the supplied unchanged content policy.
+func (t *SyncerTest) setUnchangedContentPolicy(p UnchangedContentPolicy) {
+	t.syncer = newSyncer(
+		appendThreshold,
+		0,
+		p,
+		t.bucket,
+		&t.fullCreator,
+		&t.appendCreator,
+		nil)
+}
+
+// Overwrite the content with the source object's contents, and set a new
+// mtime as a tool rewriting the file would.
+func (t *SyncerTest) rewriteUnchanged() {
+	_, err := t.content.WriteAt([]byte(srcObjectContents), 0)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Hour)
+	t.content.SetMtime(t.clock.Now())
+}
+
 func (t *SyncerTest) call() (o *gcs.Object, err error) {
 	o, err = t.syncer.SyncObject(t.ctx, t.srcObject, t.content)
 	return
@@ -207,8 +243,12 @@ func (t *SyncerTest) SourceTooShortForAppend() {
 	// Recreate the syncer with a higher append threshold.
 	t.syncer = newSyncer(
 		int64(len(srcObjectContents)+1),
+		0,
+		UnchangedContentUpload,
+		t.bucket,
 		&t.fullCreator,
-		&t.appendCreator)
+		&t.appendCreator,
+		nil)
 
 	// Extend the length of the content.
 	err = t.content.Truncate(int64(len(srcObjectContents) + 1))
@@ -270,6 +310,89 @@ func (t *SyncerTest) CallsFullCreator() {
 	ExpectEq(t.srcObject, t.fullCreator.srcObject)
 	ExpectThat(t.fullCreator.mtime, timeutil.TimeEq(mtime.UTC()))
 	ExpectEq(srcObjectContents[:2], string(t.fullCreator.contents))
+
+	AssertNe(nil, t.fullCreator.checksums)
+	ExpectEq(
+		*gcsutil.CRC32C([]byte(srcObjectContents[:2])),
+		t.fullCreator.checksums.CRC32C)
+	ExpectEq(
+		md5.Sum([]byte(srcObjectContents[:2])),
+		t.fullCreator.checksums.MD5)
+}
+
+func (t *SyncerTest) LargeContentUploadedInParallel() {
+	var err error
+	t.syncer = newSyncer(
+		appendThreshold,
+		8,
+		UnchangedContentUpload,
+		t.bucket,
+		&t.fullCreator,
+		&t.appendCreator,
+		newCompositeObjectCreator(2, ".gcsfuse_tmp/", t.bucket))
+
+	// Overwrite the content with something long enough.
+	const contents = "burrito enchilada"
+	_, err = t.content.WriteAt([]byte(contents), 0)
+	AssertEq(nil, err)
+
+	// Call
+	o, err := t.call()
+	AssertEq(nil, err)
+
+	ExpectFalse(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+	ExpectEq(len(contents), o.Size)
+	ExpectEq(2, o.ComponentCount)
+
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket, t.srcObject.Name)
+	AssertEq(nil, err)
+	ExpectEq(contents, string(b))
+}
+
+func (t *SyncerTest) SmallContentNotUploadedInParallel() {
+	var err error
+	t.syncer = newSyncer(
+		appendThreshold,
+		8,
+		UnchangedContentUpload,
+		t.bucket,
+		&t.fullCreator,
+		&t.appendCreator,
+		newCompositeObjectCreator(2, ".gcsfuse_tmp/", t.bucket))
+
+	// Ready the content.
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	// Call
+	t.call()
+
+	ExpectTrue(t.fullCreator.called)
+}
+
+func (t *SyncerTest) FullCreatorProgressIsTracked() {
+	var err error
+	AssertLt(2, t.srcObject.Size)
+
+	// Ready the content.
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	// Call
+	t.call()
+
+	// While uploading, the progress should have been visible.
+	AssertTrue(t.fullCreator.called)
+	AssertEq(1, len(t.fullCreator.inProgress))
+
+	p := t.fullCreator.inProgress[0]
+	ExpectEq(t.srcObject.Name, p.Name)
+	ExpectEq(2, p.BytesUploaded)
+	ExpectEq(2, p.BytesTotal)
+
+	// Afterward it should be gone.
+	ExpectEq(0, len(UploadsInProgress()))
 }
 
 func (t *SyncerTest) FullCreatorFails() {
@@ -335,6 +458,36 @@ func (t *SyncerTest) CallsAppendCreator() {
 	ExpectEq(t.srcObject, t.appendCreator.srcObject)
 	ExpectThat(t.appendCreator.mtime, timeutil.TimeEq(mtime.UTC()))
 	ExpectEq("burrito", string(t.appendCreator.contents))
+
+	// The checksums are of what is appended.
+	AssertNe(nil, t.appendCreator.checksums)
+	ExpectEq(
+		*gcsutil.CRC32C([]byte("burrito")),
+		t.appendCreator.checksums.CRC32C)
+	ExpectEq(md5.Sum([]byte("burrito")), t.appendCreator.checksums.MD5)
+}
+
+func (t *SyncerTest) AppendCreatorProgressIsTracked() {
+	var err error
+
+	// Append some data.
+	_, err = t.content.WriteAt([]byte("burrito"), int64(t.srcObject.Size))
+	AssertEq(nil, err)
+
+	// Call
+	t.call()
+
+	// Only the appended data should count toward the upload.
+	AssertTrue(t.appendCreator.called)
+	AssertEq(1, len(t.appendCreator.inProgress))
+
+	p := t.appendCreator.inProgress[0]
+	ExpectEq(t.srcObject.Name, p.Name)
+	ExpectEq(len("burrito"), p.BytesUploaded)
+	ExpectEq(len("burrito"), p.BytesTotal)
+
+	// Afterward it should be gone.
+	ExpectEq(0, len(UploadsInProgress()))
 }
 
 func (t *SyncerTest) AppendCreatorFails() {
@@ -381,3 +534,88 @@ func (t *SyncerTest) AppendCreatorSucceeds() {
 	AssertEq(nil, err)
 	ExpectEq(t.appendCreator.o, o)
 }
+
+func (t *SyncerTest) Unchanged_UploadPolicy() {
+	t.rewriteUnchanged()
+
+	// The full creator should be called as usual.
+	t.call()
+
+	ExpectTrue(t.fullCreator.called)
+	ExpectEq(srcObjectContents, string(t.fullCreator.contents))
+}
+
+func (t *SyncerTest) Unchanged_SkipPolicy() {
+	t.setUnchangedContentPolicy(UnchangedContentSkip)
+	t.rewriteUnchanged()
+
+	// Call
+	o, err := t.call()
+	AssertEq(nil, err)
+
+	// The source object should be returned unmodified.
+	AssertNe(nil, o)
+	ExpectEq(t.srcObject.Generation, o.Generation)
+	ExpectEq(t.srcObject.MetaGeneration, o.MetaGeneration)
+	ExpectEq("", o.Metadata[MtimeMetadataKey])
+
+	ExpectFalse(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+}
+
+func (t *SyncerTest) Unchanged_TouchPolicy() {
+	t.setUnchangedContentPolicy(UnchangedContentTouch)
+	t.rewriteUnchanged()
+
+	// Call
+	o, err := t.call()
+	AssertEq(nil, err)
+
+	// Only the metadata should have been updated.
+	AssertNe(nil, o)
+	ExpectEq(t.srcObject.Generation, o.Generation)
+	ExpectEq(t.srcObject.MetaGeneration+1, o.MetaGeneration)
+	ExpectEq(
+		t.clock.Now().UTC().Format(time.RFC3339Nano),
+		o.Metadata[MtimeMetadataKey])
+
+	ExpectFalse(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+}
+
+func (t *SyncerTest) Unchanged_TouchPolicy_SourceClobbered() {
+	var err error
+	t.setUnchangedContentPolicy(UnchangedContentTouch)
+	t.rewriteUnchanged()
+
+	// Overwrite the source object.
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     t.srcObject.Name,
+			Contents: strings.NewReader(""),
+		})
+
+	AssertEq(nil, err)
+
+	// Call
+	_, err = t.call()
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *SyncerTest) Changed_SkipPolicy() {
+	t.setUnchangedContentPolicy(UnchangedContentSkip)
+
+	// Dirty a byte without changing the length.
+	_, err := t.content.WriteAt(
+		[]byte("a"),
+		int64(len(srcObjectContents)-1))
+
+	AssertEq(nil, err)
+
+	// The full creator should be called.
+	t.call()
+
+	ExpectTrue(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+}
@@ -15,12 +15,15 @@
 package gcsx
 
 import (
+	"crypto/md5"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
-	"os"
 	"time"
 
 	"github.com/jacobsa/fuse/fsutil"
+	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/timeutil"
 )
 
@@ -42,6 +45,12 @@ type TempFile interface {
 	// the seek position.
 	Stat() (sr StatResult, err error)
 
+	// Return the checksums of the current content. They are kept up to date
+	// while the content is written in order from the start, and otherwise
+	// found by reading back what was written out of order. May invalidate the
+	// seek position.
+	Checksums() (c Checksums, err error)
+
 	// Explicitly set the mtime that will return in stat results. This will stick
 	// until another method that modifies the file is called.
 	SetMtime(mtime time.Time)
@@ -70,6 +79,38 @@ type StatResult struct {
 	Mtime *time.Time
 }
 
+// Checksums of some content, as GCS records them for objects.
+type Checksums struct {
+	CRC32C uint32
+	MD5    [md5.Size]byte
+}
+
+// Compute the checksums of everything read from r.
+func computeChecksums(r io.Reader) (c Checksums, err error) {
+	crc32cHash := crc32.New(crc32cTable)
+	md5Hash := md5.New()
+
+	_, err = io.Copy(io.MultiWriter(crc32cHash, md5Hash), r)
+	if err != nil {
+		return
+	}
+
+	c.CRC32C = crc32cHash.Sum32()
+	copy(c.MD5[:], md5Hash.Sum(nil))
+
+	return
+}
+
+// Ask GCS to reject the contents of the supplied request unless they match
+// the checksums.
+func (c Checksums) apply(req *gcs.CreateObjectRequest) {
+	crc32c := c.CRC32C
+	md5Sum := c.MD5
+
+	req.CRC32C = &crc32c
+	req.MD5 = &md5Sum
+}
+
 // NewTempFile creates a temp file whose initial contents are given by the
 // supplied reader. dir is a directory on whose file system the inode will live,
 // or the system default temporary location if empty.
@@ -85,19 +126,47 @@ func NewTempFile(
 		return
 	}
 
-	// Copy into the file.
-	size, err := io.Copy(f, content)
+	tf, err = newTempFile(f, content, clock)
 	if err != nil {
-		err = fmt.Errorf("copy: %v", err)
+		f.Close()
 		return
 	}
 
+	return
+}
+
+// The storage behind a temp file, with semantics matching os.File.
+type tempFileStorage interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) (err error)
+}
+
+// Create a temp file backed by the supplied empty storage, with initial
+// contents given by the supplied reader.
+func newTempFile(
+	f tempFileStorage,
+	content io.Reader,
+	clock timeutil.Clock) (tf *tempFile, err error) {
 	tf = &tempFile{
-		clock:          clock,
-		f:              f,
-		dirtyThreshold: size,
+		clock:      clock,
+		f:          f,
+		crc32cHash: crc32.New(crc32cTable),
+		md5Hash:    md5.New(),
+	}
+
+	// Copy into the file, checksumming along the way.
+	size, err := io.Copy(io.MultiWriter(f, tf.crc32cHash, tf.md5Hash), content)
+	if err != nil {
+		err = fmt.Errorf("copy: %v", err)
+		return
 	}
 
+	tf.dirtyThreshold = size
+	tf.hashed = size
+
 	return
 }
 
@@ -115,7 +184,7 @@ type tempFile struct {
 	destroyed bool
 
 	// A file containing our current contents.
-	f *os.File
+	f tempFileStorage
 
 	// The lowest byte index that has been modified from the initial contents.
 	//
@@ -127,6 +196,13 @@ type tempFile struct {
 	//
 	// INVARIANT: mtime == nil => Stat().DirtyThreshold == Stat().Size
 	mtime *time.Time
+
+	// Running checksums of the first hashed bytes of our contents.
+	//
+	// INVARIANT: 0 <= hashed
+	crc32cHash hash.Hash32
+	md5Hash    hash.Hash
+	hashed     int64
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -165,6 +241,11 @@ func (tf *tempFile) CheckInvariants() {
 	if tf.mtime == nil && sr.DirtyThreshold != sr.Size {
 		panic(fmt.Sprintf("Mismatch: %d vs. %d", sr.DirtyThreshold, sr.Size))
 	}
+
+	// INVARIANT: 0 <= hashed
+	if tf.hashed < 0 {
+		panic(fmt.Sprintf("Unexpected hashed count: %d", tf.hashed))
+	}
 }
 
 func (tf *tempFile) Destroy() {
@@ -201,7 +282,35 @@ func (tf *tempFile) Stat() (sr StatResult, err error) {
 	return
 }
 
-func (tf *tempFile) WriteAt(p []byte, offset int64) (int, error) {
+func (tf *tempFile) Checksums() (c Checksums, err error) {
+	// Catch up with anything written since we were last in order.
+	size, err := tf.f.Seek(0, 2)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	if tf.hashed < size {
+		_, err = io.Copy(
+			io.MultiWriter(tf.crc32cHash, tf.md5Hash),
+			io.NewSectionReader(tf.f, tf.hashed, size-tf.hashed))
+
+		if err != nil {
+			tf.resetChecksums()
+			err = fmt.Errorf("Copy: %v", err)
+			return
+		}
+
+		tf.hashed = size
+	}
+
+	c.CRC32C = tf.crc32cHash.Sum32()
+	copy(c.MD5[:], tf.md5Hash.Sum(nil))
+
+	return
+}
+
+func (tf *tempFile) WriteAt(p []byte, offset int64) (n int, err error) {
 	// Update our state regarding being dirty.
 	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, offset)
 
@@ -209,7 +318,21 @@ func (tf *tempFile) WriteAt(p []byte, offset int64) (int, error) {
 	tf.mtime = &newMtime
 
 	// Call through.
-	return tf.f.WriteAt(p, offset)
+	n, err = tf.f.WriteAt(p, offset)
+
+	// Extend the checksums if the write continues from what they cover, and
+	// start over if it changes anything they cover.
+	switch {
+	case offset == tf.hashed:
+		tf.crc32cHash.Write(p[:n])
+		tf.md5Hash.Write(p[:n])
+		tf.hashed += int64(n)
+
+	case offset < tf.hashed:
+		tf.resetChecksums()
+	}
+
+	return
 }
 
 func (tf *tempFile) Truncate(n int64) error {
@@ -219,6 +342,10 @@ func (tf *tempFile) Truncate(n int64) error {
 	newMtime := tf.clock.Now()
 	tf.mtime = &newMtime
 
+	if n < tf.hashed {
+		tf.resetChecksums()
+	}
+
 	// Call through.
 	return tf.f.Truncate(n)
 }
@@ -231,6 +358,12 @@ func (tf *tempFile) SetMtime(mtime time.Time) {
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+func (tf *tempFile) resetChecksums() {
+	tf.crc32cHash.Reset()
+	tf.md5Hash.Reset()
+	tf.hashed = 0
+}
+
 func minInt64(a int64, b int64) int64 {
 	if a < b {
 		return a
@@ -15,6 +15,7 @@
 package gcsx_test
 
 import (
+	"crypto/md5"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,6 +24,7 @@ import (
 	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
@@ -67,6 +69,12 @@ func (tf *checkingTempFile) Stat() (gcsx.StatResult, error) {
 	return tf.wrapped.Stat()
 }
 
+func (tf *checkingTempFile) Checksums() (gcsx.Checksums, error) {
+	tf.wrapped.CheckInvariants()
+	defer tf.wrapped.CheckInvariants()
+	return tf.wrapped.Checksums()
+}
+
 func (tf *checkingTempFile) Read(b []byte) (int, error) {
 	tf.wrapped.CheckInvariants()
 	defer tf.wrapped.CheckInvariants()
@@ -143,6 +151,15 @@ func (t *TempFileTest) SetUp(ti *TestInfo) {
 	AssertEq(nil, err)
 }
 
+// Expect the temp file's checksums to be those of the supplied contents.
+func (t *TempFileTest) expectChecksums(contents string) {
+	c, err := t.tf.Checksums()
+	AssertEq(nil, err)
+
+	ExpectEq(*gcsutil.CRC32C([]byte(contents)), c.CRC32C)
+	ExpectEq(md5.Sum([]byte(contents)), c.MD5)
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Tests
 ////////////////////////////////////////////////////////////////////////
@@ -234,3 +251,48 @@ func (t *TempFileTest) SetMtime() {
 	AssertEq(nil, err)
 	ExpectThat(sr.Mtime, Pointee(timeutil.TimeEq(mtime)))
 }
+
+func (t *TempFileTest) Checksums_InitialContent() {
+	t.expectChecksums(initialContent)
+}
+
+func (t *TempFileTest) Checksums_WrittenInOrder() {
+	var err error
+
+	_, err = t.tf.WriteAt([]byte("enchilada"), int64(initialContentSize))
+	AssertEq(nil, err)
+
+	_, err = t.tf.WriteAt([]byte("queso"), int64(initialContentSize+9))
+	AssertEq(nil, err)
+
+	t.expectChecksums(initialContent + "enchiladaqueso")
+}
+
+func (t *TempFileTest) Checksums_WrittenOutOfOrder() {
+	var err error
+
+	// Leave a hole, then fill it in.
+	_, err = t.tf.WriteAt([]byte("queso"), int64(initialContentSize+9))
+	AssertEq(nil, err)
+
+	_, err = t.tf.WriteAt([]byte("enchilada"), int64(initialContentSize))
+	AssertEq(nil, err)
+
+	t.expectChecksums(initialContent + "enchiladaqueso")
+
+	// Overwrite the start.
+	_, err = t.tf.WriteAt([]byte("pizza"), 0)
+	AssertEq(nil, err)
+
+	t.expectChecksums("pizza" + initialContent[5:] + "enchiladaqueso")
+}
+
+func (t *TempFileTest) Checksums_Truncated() {
+	err := t.tf.Truncate(4)
+	AssertEq(nil, err)
+	t.expectChecksums(initialContent[:4])
+
+	err = t.tf.Truncate(6)
+	AssertEq(nil, err)
+	t.expectChecksums(initialContent[:4] + "\x00\x00")
+}
@@ -0,0 +1,637 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// A directory in a bucket created by NewTreeBucket.
+type TreeEntry struct {
+	// The path of the directory relative to the root of the tree, e.g.
+	// "datasets/imagenet". The directories leading to it are synthesized.
+	Path string
+
+	// The objects in Bucket whose names begin with Prefix appear within the
+	// directory, with the prefix stripped. Prefix must be empty or end in a
+	// slash.
+	Bucket gcs.Bucket
+	Prefix string
+
+	// If set, requests that would modify objects within the directory fail
+	// with *ReadOnlyError.
+	ReadOnly bool
+}
+
+// ReadOnlyError is returned by buckets created by NewTreeBucket and
+// NewVersionsBucket for requests that would modify an object within a
+// read-only directory.
+type ReadOnlyError struct {
+	Name string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("%q is within a read-only directory", e.Name)
+}
+
+// NewTreeBucket creates a bucket presenting a tree of directories, each of
+// which exposes a prefix of some bucket. For example, with entries
+//
+//     {Path: "datasets/imagenet", Bucket: b1, Prefix: "imagenet/", ReadOnly: true}
+//     {Path: "results", Bucket: b2, Prefix: ""}
+//
+// the object "imagenet/foo" in b1 appears as "datasets/imagenet/foo" and the
+// object "bar" in b2 appears as "results/bar". The directories named by the
+// entries and those leading to them always exist, cannot be modified, and
+// contain nothing else.
+//
+// Objects whose names begin with passthrough (which may be empty to disable
+// this) are exposed as-is from the home bucket, so that temporary objects used
+// by gcsfuse itself can be created there. The tree takes its name from home.
+//
+// Each path must be valid UTF-8 and consist of one or more non-empty
+// components separated by slashes, and no path may lie within another.
+// Copies and compositions between directories backed by different buckets
+// work by reading the sources and writing the destination, since GCS can't
+// perform them directly.
+func NewTreeBucket(
+	entries []TreeEntry,
+	passthrough string,
+	home gcs.Bucket) (b gcs.Bucket, err error) {
+	if len(entries) == 0 {
+		err = errors.New("No directories given")
+		return
+	}
+
+	tb := &treeBucket{
+		entries:     make(map[string]TreeEntry),
+		synthetic:   make(map[string]bool),
+		passthrough: passthrough,
+		home:        home,
+	}
+
+	for _, e := range entries {
+		p := e.Path
+		switch {
+		case p == "" ||
+			strings.HasPrefix(p, "/") ||
+			strings.HasSuffix(p, "/") ||
+			strings.Contains(p, "//") ||
+			!utf8.ValidString(p):
+			err = fmt.Errorf("Illegal directory path: %q", p)
+			return
+
+		case passthrough != "" && strings.HasPrefix(p+"/", passthrough):
+			err = fmt.Errorf("Directory path %q is reserved", p)
+			return
+
+		case e.Bucket == nil:
+			err = fmt.Errorf("No bucket for %q", p)
+			return
+
+		case !utf8.ValidString(e.Prefix):
+			err = fmt.Errorf("Prefix for %q is not valid UTF-8", p)
+			return
+
+		case e.Prefix != "" && !strings.HasSuffix(e.Prefix, "/"):
+			err = fmt.Errorf("Prefix for %q doesn't end in a slash: %q", p, e.Prefix)
+			return
+		}
+
+		tb.entries[p+"/"] = e
+	}
+
+	// Find the directories leading to each entry, making sure that no entry
+	// lies within another.
+	for dir := range tb.entries {
+		for i := 0; i < len(dir); i++ {
+			if dir[i] != '/' {
+				continue
+			}
+
+			ancestor := dir[:i+1]
+			if _, ok := tb.entries[ancestor]; ok && ancestor != dir {
+				err = fmt.Errorf(
+					"Directory %q lies within %q",
+					strings.TrimSuffix(dir, "/"),
+					strings.TrimSuffix(ancestor, "/"))
+				return
+			}
+
+			tb.synthetic[ancestor] = true
+		}
+	}
+
+	for dir := range tb.synthetic {
+		tb.dirObjects = append(tb.dirObjects, dir)
+	}
+
+	sort.Strings(tb.dirObjects)
+	b = tb
+
+	return
+}
+
+type treeBucket struct {
+	// A map from the local name of each entry's directory (including the
+	// trailing slash) to the entry.
+	entries map[string]TreeEntry
+
+	// The local names of the entries' directories and those leading to them,
+	// as a set and sorted.
+	synthetic  map[string]bool
+	dirObjects []string
+
+	passthrough string
+	home        gcs.Bucket
+}
+
+// The location of an object named by a local name.
+type treeLocation struct {
+	// The bucket holding the object and its name within that bucket.
+	bucket gcs.Bucket
+	name   string
+
+	// The directory within which the local name lies, and the corresponding
+	// entry. dir is empty for passthrough objects.
+	dir   string
+	entry TreeEntry
+}
+
+// Translate a name in l.bucket into a local name.
+func (l treeLocation) localName(n string) string {
+	if l.dir == "" {
+		return n
+	}
+
+	return l.dir + strings.TrimPrefix(n, l.entry.Prefix)
+}
+
+func (b *treeBucket) isPassthrough(n string) bool {
+	return b.passthrough != "" && strings.HasPrefix(n, b.passthrough)
+}
+
+// Find the entry whose directory contains the supplied local name, if any.
+func (b *treeBucket) entryFor(n string) (dir string, e TreeEntry, ok bool) {
+	for i := 0; i < len(n); i++ {
+		if n[i] != '/' {
+			continue
+		}
+
+		dir = n[:i+1]
+		if e, ok = b.entries[dir]; ok {
+			return
+		}
+	}
+
+	dir = ""
+	return
+}
+
+// Find the object with the supplied local name.
+func (b *treeBucket) locate(n string) (l treeLocation, err error) {
+	if b.isPassthrough(n) {
+		l = treeLocation{bucket: b.home, name: n}
+		return
+	}
+
+	dir, e, ok := b.entryFor(n)
+	if !ok || n == dir {
+		err = fmt.Errorf("%q is not within a mounted directory", n)
+		return
+	}
+
+	l = treeLocation{
+		bucket: e.Bucket,
+		name:   e.Prefix + strings.TrimPrefix(n, dir),
+		dir:    dir,
+		entry:  e,
+	}
+
+	return
+}
+
+// Like locate, but fail if the object may not be modified.
+func (b *treeBucket) locateForWrite(n string) (l treeLocation, err error) {
+	l, err = b.locate(n)
+	if err != nil {
+		return
+	}
+
+	if l.entry.ReadOnly {
+		err = &ReadOnlyError{Name: n}
+		return
+	}
+
+	return
+}
+
+// List the synthesized directories matching the supplied request.
+func (b *treeBucket) listDirs(req *gcs.ListObjectsRequest) (l *gcs.Listing) {
+	l = &gcs.Listing{}
+	seen := make(map[string]bool)
+
+	for _, n := range b.dirObjects {
+		if !strings.HasPrefix(n, req.Prefix) {
+			continue
+		}
+
+		// A directory placeholder shows up as a collapsed run when it contains
+		// the delimiter after the prefix, as it would in GCS.
+		rest := strings.TrimPrefix(n, req.Prefix)
+		if req.Delimiter != "" && strings.Contains(rest, req.Delimiter) {
+			i := len(req.Prefix) + strings.Index(rest, req.Delimiter)
+			run := n[:i+len(req.Delimiter)]
+			if !seen[run] {
+				seen[run] = true
+				l.CollapsedRuns = append(l.CollapsedRuns, run)
+			}
+
+			continue
+		}
+
+		l.Objects = append(l.Objects, syntheticDirObject(n))
+	}
+
+	return
+}
+
+// Synthesize the placeholder object for a directory.
+func syntheticDirObject(name string) *gcs.Object {
+	return &gcs.Object{
+		Name:           name,
+		Generation:     1,
+		MetaGeneration: 1,
+	}
+}
+
+func objectNotFound(n string) error {
+	return &gcs.NotFoundError{
+		Err: fmt.Errorf("Object %q not found", n),
+	}
+}
+
+// Copy an object between buckets by reading it and writing it anew.
+func copyAcrossBuckets(
+	ctx context.Context,
+	src treeLocation,
+	srcGeneration int64,
+	srcMetaGeneration *int64,
+	dst treeLocation) (o *gcs.Object, err error) {
+	// Find the source's attributes, checking that the requested generation is
+	// still current, as GCS would for a non-versioned bucket.
+	so, err := src.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: src.name})
+	if err != nil {
+		return
+	}
+
+	if srcGeneration != 0 && so.Generation != srcGeneration {
+		err = objectNotFound(src.name)
+		return
+	}
+
+	if srcMetaGeneration != nil && so.MetaGeneration != *srcMetaGeneration {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"Meta-generation of %q is %d, not %d",
+				src.name,
+				so.MetaGeneration,
+				*srcMetaGeneration),
+		}
+
+		return
+	}
+
+	// Copy the contents.
+	rc, err := src.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       src.name,
+			Generation: so.Generation,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	o, err = dst.bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:            dst.name,
+			ContentType:     so.ContentType,
+			ContentLanguage: so.ContentLanguage,
+			ContentEncoding: so.ContentEncoding,
+			CacheControl:    so.CacheControl,
+			Metadata:        so.Metadata,
+			Contents:        rc,
+		})
+
+	return
+}
+
+// Compose objects from various buckets by reading them and writing the
+// concatenation anew.
+func composeAcrossBuckets(
+	ctx context.Context,
+	srcs []treeLocation,
+	req *gcs.ComposeObjectsRequest,
+	dst treeLocation) (o *gcs.Object, err error) {
+	var readers []io.Reader
+	for i, src := range srcs {
+		var rc io.ReadCloser
+		rc, err = src.bucket.NewReader(
+			ctx,
+			&gcs.ReadObjectRequest{
+				Name:       src.name,
+				Generation: req.Sources[i].Generation,
+			})
+
+		if err != nil {
+			return
+		}
+
+		defer rc.Close()
+		readers = append(readers, rc)
+	}
+
+	o, err = dst.bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                       dst.name,
+			ContentType:                req.ContentType,
+			Metadata:                   req.Metadata,
+			Contents:                   io.MultiReader(readers...),
+			GenerationPrecondition:     req.DstGenerationPrecondition,
+			MetaGenerationPrecondition: req.DstMetaGenerationPrecondition,
+		})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket methods
+////////////////////////////////////////////////////////////////////////
+
+func (b *treeBucket) Name() string {
+	return b.home.Name()
+}
+
+func (b *treeBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	l, err := b.locate(req.Name)
+	if err != nil {
+		err = objectNotFound(req.Name)
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.ReadObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	rc, err = l.bucket.NewReader(ctx, mReq)
+	return
+}
+
+func (b *treeBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	l, err := b.locateForWrite(req.Name)
+	if err != nil {
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.CreateObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	o, err = l.bucket.CreateObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = l.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *treeBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	src, err := b.locate(req.SrcName)
+	if err != nil {
+		err = objectNotFound(req.SrcName)
+		return
+	}
+
+	dst, err := b.locateForWrite(req.DstName)
+	if err != nil {
+		return
+	}
+
+	if src.bucket == dst.bucket {
+		// Modify the request and call through.
+		mReq := new(gcs.CopyObjectRequest)
+		*mReq = *req
+		mReq.SrcName = src.name
+		mReq.DstName = dst.name
+
+		o, err = dst.bucket.CopyObject(ctx, mReq)
+	} else {
+		o, err = copyAcrossBuckets(
+			ctx,
+			src,
+			req.SrcGeneration,
+			req.SrcMetaGenerationPrecondition,
+			dst)
+	}
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = dst.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *treeBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	dst, err := b.locateForWrite(req.DstName)
+	if err != nil {
+		return
+	}
+
+	// Find the sources, noting whether they are all in the destination bucket.
+	var srcs []treeLocation
+	sameBucket := true
+	for _, s := range req.Sources {
+		var l treeLocation
+		l, err = b.locate(s.Name)
+		if err != nil {
+			err = objectNotFound(s.Name)
+			return
+		}
+
+		srcs = append(srcs, l)
+		sameBucket = sameBucket && l.bucket == dst.bucket
+	}
+
+	if sameBucket {
+		// Modify the request and call through.
+		mReq := new(gcs.ComposeObjectsRequest)
+		*mReq = *req
+		mReq.DstName = dst.name
+
+		mReq.Sources = nil
+		for i, s := range req.Sources {
+			s.Name = srcs[i].name
+			mReq.Sources = append(mReq.Sources, s)
+		}
+
+		o, err = dst.bucket.ComposeObjects(ctx, mReq)
+	} else {
+		o, err = composeAcrossBuckets(ctx, srcs, req, dst)
+	}
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = dst.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *treeBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	// Special case: the synthesized directories always exist.
+	if b.synthetic[req.Name] {
+		o = syntheticDirObject(req.Name)
+		return
+	}
+
+	l, err := b.locate(req.Name)
+	if err != nil {
+		err = objectNotFound(req.Name)
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.StatObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	o, err = l.bucket.StatObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = l.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *treeBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	// Requests for passthrough objects are sent straight through, and requests
+	// not within a single entry's directory are answered locally.
+	if b.isPassthrough(req.Prefix) {
+		l, err = b.home.ListObjects(ctx, req)
+		return
+	}
+
+	dir, e, ok := b.entryFor(req.Prefix)
+	if !ok {
+		l = b.listDirs(req)
+		return
+	}
+
+	loc := treeLocation{bucket: e.Bucket, dir: dir, entry: e}
+
+	// Modify the request and call through.
+	mReq := new(gcs.ListObjectsRequest)
+	*mReq = *req
+	mReq.Prefix = e.Prefix + strings.TrimPrefix(req.Prefix, dir)
+
+	l, err = e.Bucket.ListObjects(ctx, mReq)
+
+	// Modify the returned listing.
+	if l != nil {
+		for _, o := range l.Objects {
+			o.Name = loc.localName(o.Name)
+		}
+
+		for i, n := range l.CollapsedRuns {
+			l.CollapsedRuns[i] = loc.localName(n)
+		}
+	}
+
+	return
+}
+
+func (b *treeBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	l, err := b.locateForWrite(req.Name)
+	if err != nil {
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.UpdateObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	o, err = l.bucket.UpdateObject(ctx, mReq)
+
+	// Modify the returned object.
+	if o != nil {
+		o.Name = l.localName(o.Name)
+	}
+
+	return
+}
+
+func (b *treeBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	l, err := b.locateForWrite(req.Name)
+	if err != nil {
+		return
+	}
+
+	// Modify the request and call through.
+	mReq := new(gcs.DeleteObjectRequest)
+	*mReq = *req
+	mReq.Name = l.name
+
+	err = l.bucket.DeleteObject(ctx, mReq)
+	return
+}
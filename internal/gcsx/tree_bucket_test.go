@@ -0,0 +1,374 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestTreeBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type TreeBucketTest struct {
+	ctx context.Context
+
+	// Temporary objects go in home. The "datasets/imagenet" directory exposes
+	// a prefix of the read-only datasets bucket, and "results" the whole of
+	// the results bucket.
+	home     gcs.Bucket
+	datasets gcs.Bucket
+	results  gcs.Bucket
+
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &TreeBucketTest{}
+
+func init() { RegisterTestSuite(&TreeBucketTest{}) }
+
+func (t *TreeBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.home = gcsfake.NewFakeBucket(timeutil.RealClock(), "home")
+	t.datasets = gcsfake.NewFakeBucket(timeutil.RealClock(), "datasets")
+	t.results = gcsfake.NewFakeBucket(timeutil.RealClock(), "results")
+
+	t.bucket, err = gcsx.NewTreeBucket(
+		[]gcsx.TreeEntry{
+			{
+				Path:     "datasets/imagenet",
+				Bucket:   t.datasets,
+				Prefix:   "imagenet/",
+				ReadOnly: true,
+			},
+			{
+				Path:   "results",
+				Bucket: t.results,
+			},
+		},
+		"tmp/",
+		t.home)
+
+	AssertEq(nil, err)
+}
+
+func (t *TreeBucketTest) read(b gcs.Bucket, name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, b, name)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+func (t *TreeBucketTest) create(b gcs.Bucket, name string, contents string) {
+	_, err := gcsutil.CreateObject(t.ctx, b, name, []byte(contents))
+	AssertEq(nil, err)
+}
+
+func (t *TreeBucketTest) list(prefix string) (names []string) {
+	l, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:    prefix,
+			Delimiter: "/",
+		})
+
+	AssertEq(nil, err)
+	for _, o := range l.Objects {
+		names = append(names, o.Name)
+	}
+
+	names = append(names, l.CollapsedRuns...)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TreeBucketTest) IllegalConfigs() {
+	testCases := []gcsx.TreeEntry{
+		{Path: "", Bucket: t.home},
+		{Path: "/a", Bucket: t.home},
+		{Path: "a/", Bucket: t.home},
+		{Path: "a//b", Bucket: t.home},
+		{Path: "tmp", Bucket: t.home},
+		{Path: "a", Bucket: nil},
+		{Path: "a", Bucket: t.home, Prefix: "b"},
+		{Path: "a\xff", Bucket: t.home},
+	}
+
+	for _, tc := range testCases {
+		_, err := gcsx.NewTreeBucket([]gcsx.TreeEntry{tc}, "tmp/", t.home)
+		ExpectNe(nil, err, "entry: %v", tc)
+	}
+
+	// No entries.
+	_, err := gcsx.NewTreeBucket(nil, "tmp/", t.home)
+	ExpectNe(nil, err)
+
+	// One entry within another.
+	_, err = gcsx.NewTreeBucket(
+		[]gcsx.TreeEntry{
+			{Path: "a", Bucket: t.home},
+			{Path: "a/b/c", Bucket: t.home},
+		},
+		"tmp/",
+		t.home)
+
+	ExpectThat(err, Error(HasSubstr(`"a/b/c" lies within "a"`)))
+}
+
+func (t *TreeBucketTest) Name() {
+	ExpectEq("home", t.bucket.Name())
+}
+
+func (t *TreeBucketTest) SynthesizedDirectories() {
+	ExpectThat(t.list(""), ElementsAre("datasets/", "results/"))
+	ExpectThat(t.list("datasets/"), ElementsAre("datasets/", "datasets/imagenet/"))
+
+	for _, n := range []string{"datasets/", "datasets/imagenet/", "results/"} {
+		o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: n})
+		AssertEq(nil, err, "name: %s", n)
+		ExpectEq(n, o.Name)
+	}
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "datasets/foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *TreeBucketTest) ReadFromEachBucket() {
+	t.create(t.datasets, "imagenet/foo", "taco")
+	t.create(t.datasets, "other/foo", "enchilada")
+	t.create(t.results, "bar", "burrito")
+
+	ExpectEq("taco", t.read(t.bucket, "datasets/imagenet/foo"))
+	ExpectEq("burrito", t.read(t.bucket, "results/bar"))
+
+	ExpectThat(t.list("datasets/imagenet/"), ElementsAre("datasets/imagenet/foo"))
+	ExpectThat(t.list("results/"), ElementsAre("results/bar"))
+}
+
+func (t *TreeBucketTest) ReadOnlyDirectory() {
+	t.create(t.datasets, "imagenet/foo", "taco")
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "datasets/imagenet/bar",
+			Contents: strings.NewReader(""),
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "datasets/imagenet/foo"})
+
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+
+	// Nothing should have changed.
+	ExpectEq("taco", t.read(t.datasets, "imagenet/foo"))
+	_, err = t.datasets.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "imagenet/bar"})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *TreeBucketTest) WritableDirectory() {
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "results/bar",
+			Contents: strings.NewReader("burrito"),
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("results/bar", o.Name)
+	ExpectEq("burrito", t.read(t.results, "bar"))
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "results/bar"})
+	AssertEq(nil, err)
+
+	_, err = t.results.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *TreeBucketTest) CreateOutsideDirectories() {
+	names := []string{"foo", "datasets/foo", "datasets/imagenet/", "results/"}
+	for _, n := range names {
+		_, err := t.bucket.CreateObject(
+			t.ctx,
+			&gcs.CreateObjectRequest{
+				Name:     n,
+				Contents: strings.NewReader(""),
+			})
+
+		ExpectNe(nil, err, "name: %s", n)
+	}
+}
+
+func (t *TreeBucketTest) Passthrough() {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "tmp/foo",
+			Contents: strings.NewReader("taco"),
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("taco", t.read(t.home, "tmp/foo"))
+	ExpectEq("taco", t.read(t.bucket, "tmp/foo"))
+}
+
+func (t *TreeBucketTest) CopyAcrossBuckets() {
+	src, err := t.datasets.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:        "imagenet/foo",
+			ContentType: "image/jpeg",
+			Metadata:    map[string]string{"a": "b"},
+			Contents:    strings.NewReader("taco"),
+		})
+
+	AssertEq(nil, err)
+
+	o, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:                       "datasets/imagenet/foo",
+			DstName:                       "results/foo",
+			SrcGeneration:                 src.Generation,
+			SrcMetaGenerationPrecondition: &src.MetaGeneration,
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("results/foo", o.Name)
+	ExpectEq("image/jpeg", o.ContentType)
+	ExpectEq("b", o.Metadata["a"])
+	ExpectEq("taco", t.read(t.results, "foo"))
+}
+
+func (t *TreeBucketTest) CopyAcrossBuckets_Preconditions() {
+	src, err := t.datasets.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "imagenet/foo",
+			Contents: strings.NewReader("taco"),
+		})
+
+	AssertEq(nil, err)
+
+	// Wrong generation.
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:       "datasets/imagenet/foo",
+			DstName:       "results/foo",
+			SrcGeneration: src.Generation + 1,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Wrong meta-generation.
+	badMetaGen := src.MetaGeneration + 1
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:                       "datasets/imagenet/foo",
+			DstName:                       "results/foo",
+			SrcMetaGenerationPrecondition: &badMetaGen,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	// Nothing should have been written.
+	_, err = t.results.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *TreeBucketTest) ComposeAcrossBuckets() {
+	t.create(t.results, "bar", "taco")
+	t.create(t.home, "tmp/baz", "burrito")
+
+	dst, err := t.results.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	AssertEq(nil, err)
+
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                   "results/bar",
+			DstGenerationPrecondition: &dst.Generation,
+			Sources: []gcs.ComposeSource{
+				{Name: "results/bar", Generation: dst.Generation},
+				{Name: "tmp/baz"},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("results/bar", o.Name)
+	ExpectEq("tacoburrito", t.read(t.results, "bar"))
+
+	// The precondition should be honored.
+	_, err = t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                   "results/bar",
+			DstGenerationPrecondition: &dst.Generation,
+			Sources: []gcs.ComposeSource{
+				{Name: "tmp/baz"},
+			},
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+	ExpectEq("tacoburrito", t.read(t.results, "bar"))
+}
+
+func (t *TreeBucketTest) ComposeWithinBucket() {
+	t.create(t.results, "bar", "taco")
+	t.create(t.results, "baz", "burrito")
+
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "results/qux",
+			Sources: []gcs.ComposeSource{
+				{Name: "results/bar"},
+				{Name: "results/baz"},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("results/qux", o.Name)
+	ExpectEq(2, o.ComponentCount)
+	ExpectEq("tacoburrito", t.read(t.results, "qux"))
+}
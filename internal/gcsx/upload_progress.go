@@ -0,0 +1,235 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"expvar"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// How often to log the progress of an upload that is still running. Uploads
+// that finish sooner than this are never logged.
+const uploadProgressLogInterval = 30 * time.Second
+
+// UploadProgress describes an upload made by a Syncer that has not yet
+// finished.
+type UploadProgress struct {
+	// The name of the object being written.
+	Name string
+
+	// How many bytes of content have been handed to GCS so far, out of how many
+	// in total. The total is -1 for streaming uploads, whose size isn't known
+	// until they finish.
+	BytesUploaded int64
+	BytesTotal    int64
+
+	// When the upload started.
+	Started time.Time
+}
+
+// UploadsInProgress returns a snapshot of all uploads currently being made by
+// syncers in this process, oldest first. The same information is published by
+// package expvar under the name "uploads_in_progress".
+func UploadsInProgress() (uploads []UploadProgress) {
+	inProgress.mu.Lock()
+	defer inProgress.mu.Unlock()
+
+	for r := range inProgress.readers {
+		uploads = append(uploads, r.progress())
+	}
+
+	sort.Sort(byStartTime(uploads))
+	return
+}
+
+func init() {
+	expvar.Publish(
+		"uploads_in_progress",
+		expvar.Func(func() interface{} { return UploadsInProgress() }))
+}
+
+type byStartTime []UploadProgress
+
+func (s byStartTime) Len() int           { return len(s) }
+func (s byStartTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStartTime) Less(i, j int) bool { return s[i].Started.Before(s[j].Started) }
+
+////////////////////////////////////////////////////////////////////////
+// Tracking
+////////////////////////////////////////////////////////////////////////
+
+var inProgress struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	readers map[*progressReader]struct{}
+}
+
+// Wrap the supplied reader, which will supply total bytes of content for the
+// named object (or an unknown number if total is -1), so that reads from it
+// are reflected by UploadsInProgress and logged periodically. The caller must
+// call the returned function once the upload has finished, successfully or
+// not.
+func trackUpload(
+	name string,
+	total int64,
+	r io.Reader) (wrapped io.Reader, done func()) {
+	pr, done := startTracking(name, total)
+	pr.wrapped = r
+	wrapped = pr
+	return
+}
+
+// Like trackUpload, but for content read at arbitrary offsets, possibly
+// concurrently, as by parallel uploads.
+func trackUploadAt(
+	name string,
+	total int64,
+	r io.ReaderAt) (wrapped io.ReaderAt, done func()) {
+	pr, done := startTracking(name, total)
+	pr.wrappedAt = r
+	wrapped = pr
+	return
+}
+
+func startTracking(
+	name string,
+	total int64) (pr *progressReader, done func()) {
+	now := time.Now()
+	pr = &progressReader{
+		name:    name,
+		total:   total,
+		started: now,
+		lastLog: now,
+	}
+
+	inProgress.mu.Lock()
+	if inProgress.readers == nil {
+		inProgress.readers = make(map[*progressReader]struct{})
+	}
+
+	inProgress.readers[pr] = struct{}{}
+	inProgress.mu.Unlock()
+
+	done = func() {
+		inProgress.mu.Lock()
+		delete(inProgress.readers, pr)
+		inProgress.mu.Unlock()
+
+		// If we told the user about this upload, tell them how it ended.
+		pr.mu.Lock()
+		logged := pr.lastLog != pr.started
+		pr.mu.Unlock()
+
+		if logged {
+			logger.Infof(
+				"Finished uploading %q (%d of %d bytes) after %v",
+				pr.name,
+				atomic.LoadInt64(&pr.n),
+				pr.total,
+				time.Since(pr.started))
+		}
+	}
+
+	return
+}
+
+// An io.Reader or io.ReaderAt that counts the bytes read through it.
+type progressReader struct {
+	wrapped   io.Reader
+	wrappedAt io.ReaderAt
+	name      string
+	total     int64
+	started   time.Time
+
+	// The number of bytes read so far. Accessed atomically, since it is read
+	// concurrently by UploadsInProgress.
+	n int64
+
+	mu sync.Mutex
+
+	// The last time we logged progress, or started if never.
+	//
+	// GUARDED_BY(mu)
+	lastLog time.Time
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.wrapped.Read(p)
+	pr.count(n)
+	return
+}
+
+func (pr *progressReader) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = pr.wrappedAt.ReadAt(p, off)
+	pr.count(n)
+	return
+}
+
+// Record that n more bytes have been read, logging if it has been a while.
+func (pr *progressReader) count(n int) {
+	read := atomic.AddInt64(&pr.n, int64(n))
+
+	now := time.Now()
+	pr.mu.Lock()
+	if now.Sub(pr.lastLog) < uploadProgressLogInterval {
+		pr.mu.Unlock()
+		return
+	}
+
+	pr.lastLog = now
+	pr.mu.Unlock()
+
+	if pr.total < 0 {
+		logger.Infof(
+			"Uploading %q: %d bytes so far, after %v",
+			pr.name,
+			read,
+			now.Sub(pr.started))
+		return
+	}
+
+	logger.Infof(
+		"Uploading %q: %d of %d bytes (%.1f%%), %d remaining, after %v",
+		pr.name,
+		read,
+		pr.total,
+		percentOf(read, pr.total),
+		pr.total-read,
+		now.Sub(pr.started))
+}
+
+func (pr *progressReader) progress() UploadProgress {
+	return UploadProgress{
+		Name:          pr.name,
+		BytesUploaded: atomic.LoadInt64(&pr.n),
+		BytesTotal:    pr.total,
+		Started:       pr.started,
+	}
+}
+
+func percentOf(n int64, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+
+	return 100 * float64(n) / float64(total)
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	storagev1 "google.golang.org/api/storage/v1"
+)
+
+// Versions lists every generation of the objects in a bucket, including the
+// noncurrent ones kept by object versioning. The GCS client we use can only
+// list live objects.
+type Versions interface {
+	// List generations as ListObjects lists objects, with each name appearing
+	// once for each of its generations, in increasing order of generation.
+	ListVersions(
+		ctx context.Context,
+		req *gcs.ListObjectsRequest) (l *gcs.Listing, err error)
+}
+
+// NewVersions returns Versions for the named bucket that sends requests using
+// the supplied client, which must add credentials. Object names are relative
+// to prefix, which must be empty or end in a slash.
+func NewVersions(
+	client *http.Client,
+	bucketName string,
+	prefix string,
+	userAgent string) Versions {
+	return &httpVersions{
+		client:     client,
+		bucketName: bucketName,
+		prefix:     prefix,
+		userAgent:  userAgent,
+	}
+}
+
+type httpVersions struct {
+	client     *http.Client
+	bucketName string
+	prefix     string
+	userAgent  string
+}
+
+func (v *httpVersions) ListVersions(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	query := make(url.Values)
+	query.Set("versions", "true")
+	query.Set("projection", "full")
+	query.Set("prefix", v.prefix+req.Prefix)
+
+	if req.Delimiter != "" {
+		query.Set("delimiter", req.Delimiter)
+	}
+
+	if req.ContinuationToken != "" {
+		query.Set("pageToken", req.ContinuationToken)
+	}
+
+	if req.MaxResults != 0 {
+		query.Set("maxResults", strconv.Itoa(req.MaxResults))
+	}
+
+	var page struct {
+		Items         []*storagev1.Object `json:"items"`
+		Prefixes      []string            `json:"prefixes"`
+		NextPageToken string              `json:"nextPageToken"`
+	}
+
+	err = sendBucketRequest(
+		ctx,
+		v.client,
+		v.bucketName,
+		v.userAgent,
+		"GET",
+		"o",
+		query,
+		nil,
+		&page)
+
+	if err != nil {
+		return
+	}
+
+	l = &gcs.Listing{
+		ContinuationToken: page.NextPageToken,
+	}
+
+	for _, r := range page.Items {
+		var o *gcs.Object
+		o, err = toVersionObject(r)
+		if err != nil {
+			err = fmt.Errorf("Object %q: %v", r.Name, err)
+			return
+		}
+
+		o.Name = strings.TrimPrefix(o.Name, v.prefix)
+		l.Objects = append(l.Objects, o)
+	}
+
+	for _, p := range page.Prefixes {
+		l.CollapsedRuns = append(l.CollapsedRuns, strings.TrimPrefix(p, v.prefix))
+	}
+
+	return
+}
+
+// Convert an object resource from the JSON API, as package gcs would.
+func toVersionObject(r *storagev1.Object) (o *gcs.Object, err error) {
+	o = &gcs.Object{
+		Name:            r.Name,
+		ContentType:     r.ContentType,
+		ContentLanguage: r.ContentLanguage,
+		CacheControl:    r.CacheControl,
+		ContentEncoding: r.ContentEncoding,
+		ComponentCount:  r.ComponentCount,
+		Size:            r.Size,
+		MediaLink:       r.MediaLink,
+		Metadata:        r.Metadata,
+		Generation:      r.Generation,
+		MetaGeneration:  r.Metageneration,
+		StorageClass:    r.StorageClass,
+	}
+
+	if o.ComponentCount == 0 {
+		o.ComponentCount = 1
+	}
+
+	if r.Updated != "" {
+		o.Updated, err = time.Parse(time.RFC3339Nano, r.Updated)
+		if err != nil {
+			err = fmt.Errorf("Parsing updated %q: %v", r.Updated, err)
+			return
+		}
+	}
+
+	// Noncurrent generations record when they stopped being live.
+	if r.TimeDeleted != "" {
+		o.Deleted, err = time.Parse(time.RFC3339Nano, r.TimeDeleted)
+		if err != nil {
+			err = fmt.Errorf("Parsing timeDeleted %q: %v", r.TimeDeleted, err)
+			return
+		}
+	}
+
+	if r.Md5Hash != "" {
+		var md5Hash []byte
+		md5Hash, err = base64.StdEncoding.DecodeString(r.Md5Hash)
+		if err != nil || len(md5Hash) != md5.Size {
+			err = fmt.Errorf("Unexpected md5Hash %q", r.Md5Hash)
+			return
+		}
+
+		o.MD5 = new([md5.Size]byte)
+		copy(o.MD5[:], md5Hash)
+	}
+
+	crc32c, err := base64.StdEncoding.DecodeString(r.Crc32c)
+	if err != nil || len(crc32c) != 4 {
+		err = fmt.Errorf("Unexpected crc32c %q", r.Crc32c)
+		return
+	}
+
+	o.CRC32C = binary.BigEndian.Uint32(crc32c)
+	return
+}
@@ -0,0 +1,392 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewVersionsBucket wraps a bucket so that every generation of its objects,
+// including noncurrent ones, can be read beneath the directory with the given
+// name at the top of the bucket. Generation G of the object "foo/bar" appears
+// as the object "DIR/foo/bar/G", with the directory "DIR/foo/bar/" holding
+// every generation of it, and "DIR/foo/" holding one such directory for each
+// object whose name begins with "foo/", live or not.
+//
+// Nothing within the directory can be modified; requests that would do so
+// fail with *ReadOnlyError. Its directories are synthesized, and listings of
+// it are returned in a single page. It hides any objects in the wrapped
+// bucket with names beneath it.
+func NewVersionsBucket(
+	dir string,
+	versions Versions,
+	wrapped gcs.Bucket) (b gcs.Bucket, err error) {
+	if dir == "" || dir == "." || dir == ".." || strings.Contains(dir, "/") {
+		err = fmt.Errorf("Illegal versions directory name: %q", dir)
+		return
+	}
+
+	b = &versionsBucket{
+		Bucket:   wrapped,
+		prefix:   dir + "/",
+		versions: versions,
+	}
+
+	return
+}
+
+type versionsBucket struct {
+	gcs.Bucket
+
+	// The name of the directory, followed by a slash.
+	prefix   string
+	versions Versions
+}
+
+func (b *versionsBucket) inDir(name string) bool {
+	return strings.HasPrefix(name, b.prefix)
+}
+
+// Return the name under which the given generation appears.
+func (b *versionsBucket) versionName(o *gcs.Object) string {
+	return b.prefix + o.Name + "/" + strconv.FormatInt(o.Generation, 10)
+}
+
+// Present the given generation as an object within the directory.
+func (b *versionsBucket) versionObject(o *gcs.Object) *gcs.Object {
+	v := *o
+	v.Name = b.versionName(o)
+	return &v
+}
+
+// Parse a name within the directory as that of a generation of an object.
+func (b *versionsBucket) parseVersionName(
+	n string) (name string, generation int64, ok bool) {
+	rest := strings.TrimPrefix(n, b.prefix)
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		return
+	}
+
+	generation, err := strconv.ParseInt(rest[i+1:], 10, 64)
+	if err != nil || generation <= 0 {
+		return
+	}
+
+	name = rest[:i]
+	ok = true
+	return
+}
+
+// Call f with each page of the versions listing for the given request, until
+// there are no more or it returns false.
+func (b *versionsBucket) forEachPage(
+	ctx context.Context,
+	req gcs.ListObjectsRequest,
+	f func(l *gcs.Listing) bool) (err error) {
+	for {
+		var l *gcs.Listing
+		l, err = b.versions.ListVersions(ctx, &req)
+		if err != nil {
+			err = fmt.Errorf("ListVersions: %v", err)
+			return
+		}
+
+		if !f(l) || l.ContinuationToken == "" {
+			return
+		}
+
+		req.ContinuationToken = l.ContinuationToken
+	}
+}
+
+// Find the generations of the object with the given name, oldest first.
+func (b *versionsBucket) generationsOf(
+	ctx context.Context,
+	name string) (gens []*gcs.Object, err error) {
+	// Names are listed in order, so the object comes first.
+	err = b.forEachPage(
+		ctx,
+		gcs.ListObjectsRequest{Prefix: name, Delimiter: "/"},
+		func(l *gcs.Listing) bool {
+			for _, o := range l.Objects {
+				if o.Name != name {
+					return false
+				}
+
+				gens = append(gens, o)
+			}
+
+			return true
+		})
+
+	return
+}
+
+// List the directory given by req.Prefix, which must be within ours.
+func (b *versionsBucket) listDir(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	rest := strings.TrimPrefix(req.Prefix, b.prefix)
+	if rest != "" && !strings.HasSuffix(rest, "/") {
+		err = fmt.Errorf("Can't list prefix %q, which isn't a directory", req.Prefix)
+		return
+	}
+
+	l = &gcs.Listing{}
+	runs := make(map[string]struct{})
+	full := func() bool {
+		return req.MaxResults > 0 && len(l.Objects)+len(runs) >= req.MaxResults
+	}
+
+	// The generations of an object appear in the directory named after it.
+	if rest != "" {
+		var gens []*gcs.Object
+		gens, err = b.generationsOf(ctx, strings.TrimSuffix(rest, "/"))
+		if err != nil {
+			return
+		}
+
+		for _, o := range gens {
+			l.Objects = append(l.Objects, b.versionObject(o))
+		}
+	}
+
+	// Each object with a name beginning with the rest of the prefix has a
+	// directory of its own.
+	if !full() {
+		err = b.forEachPage(
+			ctx,
+			gcs.ListObjectsRequest{Prefix: rest, Delimiter: req.Delimiter},
+			func(page *gcs.Listing) bool {
+				for _, o := range page.Objects {
+					if req.Delimiter == "/" {
+						runs[b.prefix+o.Name+"/"] = struct{}{}
+					} else {
+						l.Objects = append(l.Objects, b.versionObject(o))
+					}
+				}
+
+				for _, r := range page.CollapsedRuns {
+					runs[b.prefix+r] = struct{}{}
+				}
+
+				return !full()
+			})
+
+		if err != nil {
+			return
+		}
+	}
+
+	sort.Slice(l.Objects, func(i, j int) bool {
+		return l.Objects[i].Name < l.Objects[j].Name
+	})
+
+	for r := range runs {
+		l.CollapsedRuns = append(l.CollapsedRuns, r)
+	}
+
+	sort.Strings(l.CollapsedRuns)
+	return
+}
+
+func (b *versionsBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if !b.inDir(req.Name) {
+		o, err = b.Bucket.StatObject(ctx, req)
+		return
+	}
+
+	// Directories exist if there is anything in them.
+	if strings.HasSuffix(req.Name, "/") {
+		if req.Name != b.prefix {
+			var l *gcs.Listing
+			l, err = b.listDir(
+				ctx,
+				&gcs.ListObjectsRequest{
+					Prefix:     req.Name,
+					Delimiter:  "/",
+					MaxResults: 1,
+				})
+
+			if err != nil {
+				return
+			}
+
+			if len(l.Objects) == 0 && len(l.CollapsedRuns) == 0 {
+				err = objectNotFound(req.Name)
+				return
+			}
+		}
+
+		o = syntheticDirObject(req.Name)
+		return
+	}
+
+	name, generation, ok := b.parseVersionName(req.Name)
+	if !ok {
+		err = objectNotFound(req.Name)
+		return
+	}
+
+	gens, err := b.generationsOf(ctx, name)
+	if err != nil {
+		return
+	}
+
+	for _, g := range gens {
+		if g.Generation == generation {
+			o = b.versionObject(g)
+			return
+		}
+	}
+
+	err = objectNotFound(req.Name)
+	return
+}
+
+func (b *versionsBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if !b.inDir(req.Name) {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	name, generation, ok := b.parseVersionName(req.Name)
+	if !ok || (req.Generation != 0 && req.Generation != generation) {
+		err = objectNotFound(req.Name)
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       name,
+			Generation: generation,
+			Range:      req.Range,
+		})
+
+	return
+}
+
+func (b *versionsBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	if b.inDir(req.Prefix) {
+		l, err = b.listDir(ctx, req)
+		return
+	}
+
+	l, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil || req.Prefix != "" || req.Delimiter != "/" {
+		return
+	}
+
+	// Add the directory to the first page of the top level, and make sure it
+	// doesn't show up again on later ones.
+	var runs []string
+	for _, r := range l.CollapsedRuns {
+		if r != b.prefix {
+			runs = append(runs, r)
+		}
+	}
+
+	if req.ContinuationToken == "" {
+		runs = append(runs, b.prefix)
+		sort.Strings(runs)
+	}
+
+	l.CollapsedRuns = runs
+	return
+}
+
+func (b *versionsBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if b.inDir(req.Name) {
+		err = &ReadOnlyError{Name: req.Name}
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *versionsBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	for _, n := range []string{req.SrcName, req.DstName} {
+		if b.inDir(n) {
+			err = &ReadOnlyError{Name: n}
+			return
+		}
+	}
+
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
+
+func (b *versionsBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	names := []string{req.DstName}
+	for _, s := range req.Sources {
+		names = append(names, s.Name)
+	}
+
+	for _, n := range names {
+		if b.inDir(n) {
+			err = &ReadOnlyError{Name: n}
+			return
+		}
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *versionsBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if b.inDir(req.Name) {
+		err = &ReadOnlyError{Name: req.Name}
+		return
+	}
+
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	return
+}
+
+func (b *versionsBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if b.inDir(req.Name) {
+		err = &ReadOnlyError{Name: req.Name}
+		return
+	}
+
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
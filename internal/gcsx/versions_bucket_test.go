@@ -0,0 +1,310 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestVersionsBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that keeps every generation of its objects, as with object
+// versioning, and lists them as Versions. Listings are a single page.
+type versionedBucket struct {
+	gcs.Bucket
+
+	generations []*gcs.Object
+	contents    map[int64][]byte
+}
+
+func (b *versionedBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	contents, err := ioutil.ReadAll(req.Contents)
+	if err != nil {
+		return
+	}
+
+	tmp := *req
+	tmp.Contents = ioutil.NopCloser(bytes.NewReader(contents))
+
+	o, err = b.Bucket.CreateObject(ctx, &tmp)
+	if err != nil {
+		return
+	}
+
+	b.generations = append(b.generations, o)
+	b.contents[o.Generation] = contents
+	return
+}
+
+func (b *versionedBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	contents, ok := b.contents[req.Generation]
+	if !ok {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	if req.Range != nil {
+		contents = contents[req.Range.Start:req.Range.Limit]
+	}
+
+	rc = ioutil.NopCloser(bytes.NewReader(contents))
+	return
+}
+
+func (b *versionedBucket) ListVersions(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l = &gcs.Listing{}
+	runs := make(map[string]struct{})
+
+	for _, o := range b.generations {
+		if !strings.HasPrefix(o.Name, req.Prefix) {
+			continue
+		}
+
+		rest := o.Name[len(req.Prefix):]
+		if i := strings.Index(rest, req.Delimiter); req.Delimiter != "" && i >= 0 {
+			runs[req.Prefix+rest[:i+1]] = struct{}{}
+			continue
+		}
+
+		l.Objects = append(l.Objects, o)
+	}
+
+	sort.SliceStable(l.Objects, func(i, j int) bool {
+		return l.Objects[i].Name < l.Objects[j].Name
+	})
+
+	for r := range runs {
+		l.CollapsedRuns = append(l.CollapsedRuns, r)
+	}
+
+	sort.Strings(l.CollapsedRuns)
+	return
+}
+
+type VersionsBucketTest struct {
+	ctx       context.Context
+	versioned *versionedBucket
+	bucket    gcs.Bucket
+}
+
+var _ SetUpInterface = &VersionsBucketTest{}
+
+func init() { RegisterTestSuite(&VersionsBucketTest{}) }
+
+func (t *VersionsBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.versioned = &versionedBucket{
+		Bucket:   gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		contents: make(map[int64][]byte),
+	}
+
+	t.bucket, err = gcsx.NewVersionsBucket(".versions", t.versioned, t.versioned)
+	AssertEq(nil, err)
+}
+
+func (t *VersionsBucketTest) create(name string, contents string) *gcs.Object {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(contents))
+	AssertEq(nil, err)
+	return o
+}
+
+func (t *VersionsBucketTest) list(prefix string) (l *gcs.Listing) {
+	l, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: prefix, Delimiter: "/"})
+
+	AssertEq(nil, err)
+	return
+}
+
+func versionName(name string, o *gcs.Object) string {
+	return fmt.Sprintf(".versions/%s/%d", name, o.Generation)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *VersionsBucketTest) IllegalDirectoryNames() {
+	for _, dir := range []string{"", ".", "..", "a/b"} {
+		_, err := gcsx.NewVersionsBucket(dir, t.versioned, t.versioned)
+		ExpectThat(err, Error(HasSubstr("Illegal")), "dir: %q", dir)
+	}
+}
+
+func (t *VersionsBucketTest) TopLevelListing() {
+	t.create("foo", "taco")
+	t.create("bar/baz", "taco")
+
+	l := t.list("")
+	ExpectThat(l.CollapsedRuns, ElementsAre(".versions/", "bar/"))
+	AssertEq(1, len(l.Objects))
+	ExpectEq("foo", l.Objects[0].Name)
+
+	// Other listings are untouched.
+	l = t.list("bar/")
+	ExpectThat(l.CollapsedRuns, ElementsAre())
+	AssertEq(1, len(l.Objects))
+	ExpectEq("bar/baz", l.Objects[0].Name)
+}
+
+func (t *VersionsBucketTest) ListDirectory() {
+	t.create("foo", "taco")
+	t.create("foo", "burrito")
+	t.create("bar/baz", "taco")
+	t.create("qux", "taco")
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "qux"})
+	AssertEq(nil, err)
+
+	// Deleted objects still have directories.
+	l := t.list(".versions/")
+	ExpectEq(0, len(l.Objects))
+	ExpectThat(
+		l.CollapsedRuns,
+		ElementsAre(".versions/bar/", ".versions/foo/", ".versions/qux/"))
+
+	l = t.list(".versions/bar/")
+	ExpectEq(0, len(l.Objects))
+	ExpectThat(l.CollapsedRuns, ElementsAre(".versions/bar/baz/"))
+}
+
+func (t *VersionsBucketTest) ListGenerations() {
+	o0 := t.create("foo", "taco")
+	o1 := t.create("foo", "burrito")
+	t.create("foo/bar", "enchilada")
+
+	l := t.list(".versions/foo/")
+	AssertEq(2, len(l.Objects))
+	ExpectEq(versionName("foo", o0), l.Objects[0].Name)
+	ExpectEq(o0.Generation, l.Objects[0].Generation)
+	ExpectEq(versionName("foo", o1), l.Objects[1].Name)
+	ExpectEq(len("burrito"), l.Objects[1].Size)
+
+	// Objects beneath the name get directories of their own.
+	ExpectThat(l.CollapsedRuns, ElementsAre(".versions/foo/bar/"))
+}
+
+func (t *VersionsBucketTest) ReadGenerations() {
+	o0 := t.create("foo", "taco")
+	o1 := t.create("foo", "burrito")
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, versionName("foo", o0))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, versionName("foo", o1))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// The live object is still readable under its own name.
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *VersionsBucketTest) StatGenerations() {
+	o := t.create("foo", "taco")
+
+	s, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: versionName("foo", o)})
+
+	AssertEq(nil, err)
+	ExpectEq(versionName("foo", o), s.Name)
+	ExpectEq(o.Generation, s.Generation)
+	ExpectEq(len("taco"), s.Size)
+
+	for _, name := range []string{
+		fmt.Sprintf(".versions/foo/%d", o.Generation+1),
+		".versions/foo/taco",
+		".versions/foo",
+		".versions/bar/1",
+	} {
+		_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+		ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}), "name: %q", name)
+	}
+}
+
+func (t *VersionsBucketTest) StatDirectories() {
+	t.create("foo/bar", "taco")
+
+	for _, name := range []string{
+		".versions/",
+		".versions/foo/",
+		".versions/foo/bar/",
+	} {
+		o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+		AssertEq(nil, err, "name: %q", name)
+		ExpectEq(name, o.Name)
+	}
+
+	_, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: ".versions/baz/"})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *VersionsBucketTest) ReadOnly() {
+	o := t.create("foo", "taco")
+	name := versionName("foo", o)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, ".versions/bar/1", nil)
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: name, DstName: "bar"})
+
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+
+	_, err = t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{Name: name})
+
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+}
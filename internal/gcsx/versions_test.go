@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestVersions(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type VersionsTest struct {
+	ctx    context.Context
+	server *httptest.Server
+
+	// The response to send, and the URLs of the requests received so far.
+	status   int
+	response string
+	requests []*url.URL
+
+	versions gcsx.Versions
+}
+
+var _ SetUpInterface = &VersionsTest{}
+var _ TearDownInterface = &VersionsTest{}
+
+func init() { RegisterTestSuite(&VersionsTest{}) }
+
+func (t *VersionsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.status = http.StatusOK
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.requests = append(t.requests, r.URL)
+			w.WriteHeader(t.status)
+			w.Write([]byte(t.response))
+		}))
+
+	endpoint, err := url.Parse(t.server.URL)
+	AssertEq(nil, err)
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		endpoint,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	AssertEq(nil, err)
+
+	t.versions = gcsx.NewVersions(
+		&http.Client{Transport: transport},
+		"some_bucket",
+		"pre/",
+		"gcsfuse/0.0")
+}
+
+func (t *VersionsTest) TearDown() {
+	t.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *VersionsTest) ListVersions() {
+	t.response = `{
+		"items": [
+			{
+				"name": "pre/foo/bar",
+				"generation": "17",
+				"metageneration": "2",
+				"size": "4",
+				"contentType": "text/plain",
+				"crc32c": "rmxLDw==",
+				"md5Hash": "BVbbOE0fQfTSSIwj0aEVhg==",
+				"updated": "2015-04-05T02:15:00.5Z",
+				"timeDeleted": "2015-04-06T02:15:00Z",
+				"metadata": {"color": "blue"}
+			},
+			{
+				"name": "pre/foo/bar",
+				"generation": "19",
+				"metageneration": "1",
+				"size": "7",
+				"crc32c": "AAAAAA=="
+			}
+		],
+		"prefixes": ["pre/foo/baz/"],
+		"nextPageToken": "taco"
+	}`
+
+	l, err := t.versions.ListVersions(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:            "foo/",
+			Delimiter:         "/",
+			ContinuationToken: "burrito",
+			MaxResults:        10,
+		})
+
+	AssertEq(nil, err)
+
+	// Request
+	AssertEq(1, len(t.requests))
+	ExpectEq("/storage/v1/b/some_bucket/o", t.requests[0].EscapedPath())
+
+	query := t.requests[0].Query()
+	ExpectEq("true", query.Get("versions"))
+	ExpectEq("pre/foo/", query.Get("prefix"))
+	ExpectEq("/", query.Get("delimiter"))
+	ExpectEq("burrito", query.Get("pageToken"))
+	ExpectEq("10", query.Get("maxResults"))
+
+	// Response
+	ExpectEq("taco", l.ContinuationToken)
+	ExpectThat(l.CollapsedRuns, ElementsAre("foo/baz/"))
+	AssertEq(2, len(l.Objects))
+
+	o := l.Objects[0]
+	ExpectEq("foo/bar", o.Name)
+	ExpectEq(17, o.Generation)
+	ExpectEq(2, o.MetaGeneration)
+	ExpectEq(4, o.Size)
+	ExpectEq("text/plain", o.ContentType)
+	ExpectEq(0xae6c4b0f, o.CRC32C)
+	AssertNe(nil, o.MD5)
+	ExpectEq(0x05, o.MD5[0])
+	ExpectEq("blue", o.Metadata["color"])
+	ExpectTrue(
+		time.Date(2015, 4, 5, 2, 15, 0, 5e8, time.UTC).Equal(o.Updated),
+		"%v", o.Updated)
+	ExpectTrue(
+		time.Date(2015, 4, 6, 2, 15, 0, 0, time.UTC).Equal(o.Deleted),
+		"%v", o.Deleted)
+
+	o = l.Objects[1]
+	ExpectEq("foo/bar", o.Name)
+	ExpectEq(19, o.Generation)
+	ExpectEq(nil, o.MD5)
+	ExpectTrue(o.Deleted.IsZero())
+}
+
+func (t *VersionsTest) NotFound() {
+	t.status = http.StatusNotFound
+	t.response = `{"error": {"code": 404, "message": "No such bucket"}}`
+
+	_, err := t.versions.ListVersions(t.ctx, &gcs.ListObjectsRequest{})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hookbucket contains a gcs.Bucket wrapper that lets tests run code
+// just before particular requests reach the wrapped bucket, e.g. to simulate
+// another writer modifying an object while gcsfuse is in the middle of
+// uploading it.
+package hookbucket
+
+import (
+	"io"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Op identifies a gcs.Bucket method.
+type Op string
+
+const (
+	NewReader      Op = "NewReader"
+	CreateObject   Op = "CreateObject"
+	CopyObject     Op = "CopyObject"
+	ComposeObjects Op = "ComposeObjects"
+	StatObject     Op = "StatObject"
+	UpdateObject   Op = "UpdateObject"
+	DeleteObject   Op = "DeleteObject"
+)
+
+// Bucket wraps another bucket, calling hooks registered with OnceBefore. It is
+// safe for concurrent access.
+type Bucket struct {
+	gcs.Bucket
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	hooks map[hookKey][]func()
+}
+
+type hookKey struct {
+	op   Op
+	name string
+}
+
+// New wraps the supplied bucket.
+func New(wrapped gcs.Bucket) (b *Bucket) {
+	b = &Bucket{
+		Bucket: wrapped,
+		hooks:  make(map[hookKey][]func()),
+	}
+
+	return
+}
+
+// OnceBefore arranges for f to be called the next time op is invoked for the
+// named object (the destination, for CopyObject and ComposeObjects), before
+// the request is passed on to the wrapped bucket. Hooks registered for the
+// same op and name run in the order registered, one per request.
+//
+// f is called without any locks held, and may use the wrapped bucket.
+func (b *Bucket) OnceBefore(op Op, name string, f func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	k := hookKey{op, name}
+	b.hooks[k] = append(b.hooks[k], f)
+}
+
+// Run the next hook for the given op and name, if any.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *Bucket) runHook(op Op, name string) {
+	k := hookKey{op, name}
+
+	b.mu.Lock()
+	hooks := b.hooks[k]
+	if len(hooks) == 0 {
+		b.mu.Unlock()
+		return
+	}
+
+	f := hooks[0]
+	if len(hooks) == 1 {
+		delete(b.hooks, k)
+	} else {
+		b.hooks[k] = hooks[1:]
+	}
+	b.mu.Unlock()
+
+	f()
+}
+
+////////////////////////////////////////////////////////////////////////
+// gcs.Bucket methods
+////////////////////////////////////////////////////////////////////////
+
+func (b *Bucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.runHook(NewReader, req.Name)
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *Bucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.runHook(CreateObject, req.Name)
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *Bucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	b.runHook(CopyObject, req.DstName)
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
+
+func (b *Bucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	b.runHook(ComposeObjects, req.DstName)
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *Bucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.runHook(StatObject, req.Name)
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *Bucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	b.runHook(UpdateObject, req.Name)
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	return
+}
+
+func (b *Bucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.runHook(DeleteObject, req.Name)
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,332 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logger writes gcsfuse's log messages, each with a severity and
+// optionally with named fields, either as lines of text or as JSON objects
+// that logging services like Cloud Logging can ingest.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// Severity is the importance of a log message. Messages less severe than a
+// logger's configured severity are dropped.
+type Severity int
+
+const (
+	Debug Severity = iota
+	Info
+	Warning
+	Error
+
+	// Off drops all messages when used as the configured severity.
+	Off
+)
+
+var severityNames = []string{"DEBUG", "INFO", "WARNING", "ERROR", "OFF"}
+
+func (s Severity) String() string {
+	if s < Debug || s > Off {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+
+	return severityNames[s]
+}
+
+// ParseSeverity parses the name of a severity, ignoring case.
+func ParseSeverity(s string) (sev Severity, err error) {
+	for i, name := range severityNames {
+		if strings.EqualFold(s, name) {
+			sev = Severity(i)
+			return
+		}
+	}
+
+	err = fmt.Errorf(
+		"Unknown severity %q; want debug, info, warning, error, or off",
+		s)
+
+	return
+}
+
+// Format is the format in which messages are written.
+type Format string
+
+const (
+	// One line of text per message, with fields written as name=value.
+	FormatText Format = "text"
+
+	// One JSON object per line, with "time", "severity", and "message" keys
+	// along with the fields.
+	FormatJSON Format = "json"
+)
+
+// A Logger writes messages at or above a severity to an io.Writer. It is safe
+// for concurrent use.
+type Logger struct {
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	w        io.Writer
+	format   Format
+	severity Severity
+}
+
+// New creates a logger that writes messages at or above the given severity to
+// w in the given format, timestamped using the clock.
+func New(
+	w io.Writer,
+	format Format,
+	severity Severity,
+	clock timeutil.Clock) (l *Logger) {
+	l = &Logger{
+		clock:    clock,
+		w:        w,
+		format:   format,
+		severity: severity,
+	}
+
+	return
+}
+
+// Configure changes where and how the logger writes messages, and which it
+// drops.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *Logger) Configure(w io.Writer, format Format, severity Severity) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.w = w
+	l.format = format
+	l.severity = severity
+}
+
+// Enabled reports whether messages of the given severity are written, so
+// that callers can skip work to prepare those that aren't.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *Logger) Enabled(sev Severity) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.severity != Off && sev >= l.severity
+}
+
+// Log writes a message with the given severity, along with fields given as
+// alternating names and values.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *Logger) Log(sev Severity, msg string, fields ...interface{}) {
+	if !l.Enabled(sev) {
+		return
+	}
+
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf bytes.Buffer
+	switch l.format {
+	case FormatJSON:
+		writeJSON(&buf, now, sev, msg, fields)
+
+	default:
+		writeText(&buf, now, sev, msg, fields)
+	}
+
+	l.w.Write(buf.Bytes())
+}
+
+// Return the value to write for a field.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+
+	case time.Duration:
+		return v.String()
+
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
+
+// Return the name of the ith field, given alternating names and values.
+func fieldName(fields []interface{}, i int) string {
+	if s, ok := fields[i].(string); ok {
+		return s
+	}
+
+	return fmt.Sprint(fields[i])
+}
+
+func writeText(
+	buf *bytes.Buffer,
+	now time.Time,
+	sev Severity,
+	msg string,
+	fields []interface{}) {
+	buf.WriteString(now.Format("2006/01/02 15:04:05.000000 "))
+	buf.WriteString(sev.String())
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		s := fmt.Sprint(fieldValue(fields[i+1]))
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+
+		fmt.Fprintf(buf, " %s=%s", fieldName(fields, i), s)
+	}
+
+	buf.WriteByte('\n')
+}
+
+func writeJSON(
+	buf *bytes.Buffer,
+	now time.Time,
+	sev Severity,
+	msg string,
+	fields []interface{}) {
+	// Write the keys in order, which a map wouldn't preserve.
+	buf.WriteByte('{')
+	writeKey := func(k string, v interface{}) {
+		if buf.Len() != 1 {
+			buf.WriteByte(',')
+		}
+
+		kj, _ := json.Marshal(k)
+		vj, err := json.Marshal(v)
+		if err != nil {
+			vj, _ = json.Marshal(fmt.Sprint(v))
+		}
+
+		buf.Write(kj)
+		buf.WriteByte(':')
+		buf.Write(vj)
+	}
+
+	writeKey("time", now.Format(time.RFC3339Nano))
+	writeKey("severity", sev.String())
+	writeKey("message", msg)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		writeKey(fieldName(fields, i), fieldValue(fields[i+1]))
+	}
+
+	buf.WriteString("}\n")
+}
+
+// A writer that logs each line written to it as a message.
+type lineWriter struct {
+	l      *Logger
+	sev    Severity
+	prefix string
+}
+
+func (w *lineWriter) Write(p []byte) (n int, err error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.l.Log(w.sev, w.prefix+line)
+	}
+
+	n = len(p)
+	return
+}
+
+// NewStdLogger returns a *log.Logger, for packages that want one, whose
+// output is written by l as messages of the given severity, each beginning
+// with prefix.
+func (l *Logger) NewStdLogger(sev Severity, prefix string) *log.Logger {
+	return log.New(&lineWriter{l: l, sev: sev, prefix: prefix}, "", 0)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Default logger
+////////////////////////////////////////////////////////////////////////
+
+// The logger used by the functions below, which writes text to stderr at
+// Info severity until Init is called.
+var std = New(os.Stderr, FormatText, Info, timeutil.RealClock())
+
+// Init configures the default logger, and directs the output of package log
+// to it at Info severity.
+func Init(w io.Writer, format Format, severity Severity) {
+	std.Configure(w, format, severity)
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(&lineWriter{l: std, sev: Info})
+}
+
+// Enabled reports whether the default logger writes messages of the given
+// severity.
+func Enabled(sev Severity) bool {
+	return std.Enabled(sev)
+}
+
+// Log writes a message using the default logger. See Logger.Log.
+func Log(sev Severity, msg string, fields ...interface{}) {
+	std.Log(sev, msg, fields...)
+}
+
+// NewStdLogger returns a *log.Logger whose output is written by the default
+// logger. See Logger.NewStdLogger.
+func NewStdLogger(sev Severity, prefix string) *log.Logger {
+	return std.NewStdLogger(sev, prefix)
+}
+
+// Debugf writes a formatted message with Debug severity using the default
+// logger.
+func Debugf(format string, v ...interface{}) {
+	if std.Enabled(Debug) {
+		std.Log(Debug, fmt.Sprintf(format, v...))
+	}
+}
+
+// Infof writes a formatted message with Info severity using the default
+// logger.
+func Infof(format string, v ...interface{}) {
+	std.Log(Info, fmt.Sprintf(format, v...))
+}
+
+// Warningf writes a formatted message with Warning severity using the default
+// logger.
+func Warningf(format string, v ...interface{}) {
+	std.Log(Warning, fmt.Sprintf(format, v...))
+}
+
+// Errorf writes a formatted message with Error severity using the default
+// logger.
+func Errorf(format string, v ...interface{}) {
+	std.Log(Error, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestLogger(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type LoggerTest struct {
+	clock timeutil.SimulatedClock
+	buf   bytes.Buffer
+}
+
+var _ SetUpInterface = &LoggerTest{}
+
+func init() { RegisterTestSuite(&LoggerTest{}) }
+
+func (t *LoggerTest) SetUp(ti *TestInfo) {
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 123456789, time.UTC))
+}
+
+func (t *LoggerTest) newLogger(
+	format logger.Format,
+	severity logger.Severity) *logger.Logger {
+	return logger.New(&t.buf, format, severity, &t.clock)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LoggerTest) ParseSeverity() {
+	sev, err := logger.ParseSeverity("warning")
+	AssertEq(nil, err)
+	ExpectEq(logger.Warning, sev)
+
+	sev, err = logger.ParseSeverity("DEBUG")
+	AssertEq(nil, err)
+	ExpectEq(logger.Debug, sev)
+
+	_, err = logger.ParseSeverity("loud")
+	ExpectThat(err, Error(HasSubstr("loud")))
+}
+
+func (t *LoggerTest) Text() {
+	l := t.newLogger(logger.FormatText, logger.Debug)
+	l.Log(
+		logger.Info,
+		"Served op",
+		"op", "LookUpInode",
+		"inode", 17,
+		"name", "foo bar",
+		"latency", 1500*time.Microsecond)
+
+	ExpectEq(
+		"2015/04/05 02:15:00.123456 INFO Served op op=LookUpInode inode=17 "+
+			"name=\"foo bar\" latency=1.5ms\n",
+		t.buf.String())
+}
+
+func (t *LoggerTest) JSON() {
+	l := t.newLogger(logger.FormatJSON, logger.Debug)
+	l.Log(
+		logger.Error,
+		"Writing out file",
+		"object", "foo",
+		"error", errors.New("taco"),
+		"bytes", 19)
+
+	var record map[string]interface{}
+	err := json.Unmarshal(t.buf.Bytes(), &record)
+	AssertEq(nil, err)
+
+	ExpectEq("2015-04-05T02:15:00.123456789Z", record["time"])
+	ExpectEq("ERROR", record["severity"])
+	ExpectEq("Writing out file", record["message"])
+	ExpectEq("foo", record["object"])
+	ExpectEq("taco", record["error"])
+	ExpectEq(19, record["bytes"])
+
+	// There is exactly one line.
+	ExpectEq(1, bytes.Count(t.buf.Bytes(), []byte("\n")))
+}
+
+func (t *LoggerTest) DropsLessSevere() {
+	l := t.newLogger(logger.FormatText, logger.Warning)
+	ExpectFalse(l.Enabled(logger.Info))
+	ExpectTrue(l.Enabled(logger.Error))
+
+	l.Log(logger.Info, "taco")
+	l.Log(logger.Warning, "burrito")
+
+	ExpectThat(t.buf.String(), Not(HasSubstr("taco")))
+	ExpectThat(t.buf.String(), HasSubstr("WARNING burrito"))
+}
+
+func (t *LoggerTest) Off() {
+	l := t.newLogger(logger.FormatText, logger.Off)
+	l.Log(logger.Error, "taco")
+	ExpectEq("", t.buf.String())
+}
+
+func (t *LoggerTest) StdLogger() {
+	l := t.newLogger(logger.FormatJSON, logger.Debug)
+	std := l.NewStdLogger(logger.Debug, "fuse: ")
+	std.Printf("taco\nburrito")
+
+	lines := bytes.Split(bytes.TrimSpace(t.buf.Bytes()), []byte("\n"))
+	AssertEq(2, len(lines))
+
+	var record map[string]interface{}
+	err := json.Unmarshal(lines[1], &record)
+	AssertEq(nil, err)
+	ExpectEq("DEBUG", record["severity"])
+	ExpectEq("fuse: burrito", record["message"])
+}
+
+func (t *LoggerTest) Configure() {
+	l := t.newLogger(logger.FormatText, logger.Error)
+	l.Log(logger.Info, "taco")
+
+	var other bytes.Buffer
+	l.Configure(&other, logger.FormatText, logger.Info)
+	l.Log(logger.Info, "burrito")
+
+	ExpectEq("", t.buf.String())
+	ExpectThat(other.String(), HasSubstr("INFO burrito"))
+}
@@ -15,44 +15,127 @@
 // Helper functions for dealing with mount(8)-style flags.
 package mount
 
-import "strings"
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A mount option, such as "uid=1000" or "ro", as given to mount(8).
+type Option struct {
+	Name  string
+	Value string
+}
 
 // Parse an option string in the format accepted by mount(8) and generated for
-// its external mount helpers.
+// its external mount helpers, appending the options to the supplied list in
+// the order given. An option given more than once appears each time.
 //
-// It is assumed that option name and values do not contain commas, and that
-// the first equals sign in an option is the name/value separator. There is no
-// support for escaping.
+// It is assumed that the first equals sign in an option is the name/value
+// separator. A value may be enclosed in double quotes, as mount(8) allows for
+// SELinux contexts, in which case it may contain commas and the quotes are
+// removed. There is no other support for escaping.
 //
 // For example, if the input is
 //
-//     user,foo=bar=baz,qux
+//     user,foo=bar=baz,qux,context="a:b:c:s0:c1,c2"
 //
-// then the following will be inserted into the map.
+// then the following will be appended to the list.
 //
-//     "user": "",
-//     "foo": "bar=baz",
-//     "qux": "",
+//     {"user", ""},
+//     {"foo", "bar=baz"},
+//     {"qux", ""},
+//     {"context", "a:b:c:s0:c1,c2"},
 //
-func ParseOptions(m map[string]string, s string) {
+func ParseOptionList(opts []Option, s string) []Option {
 	// NOTE(jacobsa): The man pages don't define how escaping works, and as far
-	// as I can tell there is no way to properly escape or quote a comma in the
-	// options list for an fstab entry. So put our fingers in our ears and hope
-	// that nobody needs a comma.
-	for _, p := range strings.Split(s, ",") {
-		var name string
-		var value string
+	// as I can tell there is no way to properly escape a comma in the options
+	// list for an fstab entry other than quoting it as above. So put our
+	// fingers in our ears and hope that nobody needs anything else.
+	for _, p := range splitOptions(s) {
+		var o Option
 
 		// Split on the first equals sign.
 		if equalsIndex := strings.IndexByte(p, '='); equalsIndex != -1 {
-			name = p[:equalsIndex]
-			value = p[equalsIndex+1:]
+			o.Name = p[:equalsIndex]
+			o.Value = p[equalsIndex+1:]
 		} else {
-			name = p
+			o.Name = p
 		}
 
-		m[name] = value
+		if len(o.Value) >= 2 &&
+			o.Value[0] == '"' &&
+			o.Value[len(o.Value)-1] == '"' {
+			o.Value = o.Value[1 : len(o.Value)-1]
+		}
+
+		opts = append(opts, o)
+	}
+
+	return opts
+}
+
+// Like ParseOptionList, but inserting the options into a map, so that the
+// last of those given more than once wins.
+func ParseOptions(m map[string]string, s string) {
+	for _, o := range ParseOptionList(nil, s) {
+		m[o.Name] = o.Value
+	}
+
+	return
+}
+
+// Expand references to environment variables, in the form $NAME or ${NAME},
+// in the values of the supplied options, looking them up with the supplied
+// function. "$$" stands for a dollar sign. It is an error to refer to a
+// variable that isn't set, rather than silently expanding it to nothing.
+func ExpandOptions(
+	opts []Option,
+	lookupEnv func(string) (string, bool)) (err error) {
+	for i := range opts {
+		o := &opts[i]
+
+		var missing []string
+		o.Value = os.Expand(o.Value, func(v string) string {
+			if v == "$" {
+				return "$"
+			}
+
+			s, ok := lookupEnv(v)
+			if !ok {
+				missing = append(missing, v)
+			}
+
+			return s
+		})
+
+		if len(missing) != 0 {
+			err = fmt.Errorf("%s: $%s is not set", o.Name, missing[0])
+			return
+		}
+	}
+
+	return
+}
+
+// Split the supplied option string on the commas that aren't within double
+// quotes.
+func splitOptions(s string) (parts []string) {
+	var quoted bool
+	var start int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+
+		case ',':
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
 	}
 
+	parts = append(parts, s[start:])
 	return
 }
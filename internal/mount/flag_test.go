@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount_test
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/mount"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFlag(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FlagTest struct {
+	env map[string]string
+}
+
+func init() { RegisterTestSuite(&FlagTest{}) }
+
+func (t *FlagTest) SetUp(ti *TestInfo) {
+	t.env = map[string]string{
+		"CREDS_DIR": "/etc/creds",
+		"EMPTY":     "",
+		"CONTEXT":   "system_u:object_r:tmp_t:s0:c1,c2",
+	}
+}
+
+func (t *FlagTest) lookupEnv(name string) (value string, ok bool) {
+	value, ok = t.env[name]
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FlagTest) ParseOptionList() {
+	testCases := []struct {
+		s        string
+		expected []mount.Option
+	}{
+		{"ro", []mount.Option{{Name: "ro"}}},
+		{
+			"user,foo=bar=baz,qux",
+			[]mount.Option{
+				{Name: "user"},
+				{Name: "foo", Value: "bar=baz"},
+				{Name: "qux"},
+			},
+		},
+
+		// Commas within double quotes don't split, and the quotes are removed.
+		{
+			`context="a:b:c:s0:c1,c2",ro`,
+			[]mount.Option{
+				{Name: "context", Value: "a:b:c:s0:c1,c2"},
+				{Name: "ro"},
+			},
+		},
+		{`context="a,b"`, []mount.Option{{Name: "context", Value: "a,b"}}},
+		{`a="",b`, []mount.Option{{Name: "a"}, {Name: "b"}}},
+
+		// Quotes are only removed when they enclose the whole value.
+		{
+			`a="b,c"d,e`,
+			[]mount.Option{{Name: "a", Value: `"b,c"d`}, {Name: "e"}},
+		},
+		{`a="`, []mount.Option{{Name: "a", Value: `"`}}},
+
+		// An unterminated quote runs to the end.
+		{`a="b,c`, []mount.Option{{Name: "a", Value: `"b,c`}}},
+
+		// Empty options are kept.
+		{"", []mount.Option{{}}},
+		{"a,,b", []mount.Option{{Name: "a"}, {}, {Name: "b"}}},
+	}
+
+	for _, tc := range testCases {
+		opts := mount.ParseOptionList(nil, tc.s)
+		ExpectThat(opts, DeepEquals(tc.expected), "s: %q", tc.s)
+	}
+}
+
+func (t *FlagTest) ParseOptionList_Appends() {
+	opts := mount.ParseOptionList(nil, "include=*.txt")
+	opts = mount.ParseOptionList(opts, `include="*.csv",ro`)
+
+	ExpectThat(
+		opts,
+		DeepEquals([]mount.Option{
+			{Name: "include", Value: "*.txt"},
+			{Name: "include", Value: "*.csv"},
+			{Name: "ro"},
+		}))
+}
+
+func (t *FlagTest) ParseOptions() {
+	m := map[string]string{"ro": ""}
+	mount.ParseOptions(m, `uid=1,context="a:b:c:s0:c1,c2",uid=2`)
+
+	ExpectThat(
+		m,
+		DeepEquals(map[string]string{
+			"ro":      "",
+			"uid":     "2",
+			"context": "a:b:c:s0:c1,c2",
+		}))
+}
+
+func (t *FlagTest) ExpandOptions() {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"/etc/key.json", "/etc/key.json"},
+		{"$CREDS_DIR/sa.json", "/etc/creds/sa.json"},
+		{"${CREDS_DIR}sa.json", "/etc/credssa.json"},
+		{"a$EMPTY", "a"},
+		{"a$$b", "a$b"},
+		{"$$CREDS_DIR", "$CREDS_DIR"},
+		{"$CREDS_DIR:$CREDS_DIR", "/etc/creds:/etc/creds"},
+	}
+
+	for _, tc := range testCases {
+		opts := []mount.Option{{Name: "key_file", Value: tc.value}}
+		err := mount.ExpandOptions(opts, t.lookupEnv)
+
+		AssertEq(nil, err, "value: %q", tc.value)
+		ExpectEq(tc.expected, opts[0].Value, "value: %q", tc.value)
+	}
+}
+
+func (t *FlagTest) ExpandOptions_Unset() {
+	opts := []mount.Option{
+		{Name: "uid", Value: "1000"},
+		{Name: "key_file", Value: "${NOPE}/sa.json"},
+	}
+
+	err := mount.ExpandOptions(opts, t.lookupEnv)
+	ExpectThat(err, Error(Equals("key_file: $NOPE is not set")))
+}
+
+func (t *FlagTest) ExpandOptions_Names() {
+	// Only values are expanded.
+	opts := mount.ParseOptionList(nil, "$CREDS_DIR,ro")
+
+	err := mount.ExpandOptions(opts, t.lookupEnv)
+	AssertEq(nil, err)
+	ExpectThat(
+		opts,
+		DeepEquals([]mount.Option{{Name: "$CREDS_DIR"}, {Name: "ro"}}))
+}
+
+func (t *FlagTest) ExpandOptions_Comma() {
+	// Options are split before expanding, so a comma in a variable's value
+	// stays within the option.
+	opts := mount.ParseOptionList(nil, "context=$CONTEXT,ro")
+
+	err := mount.ExpandOptions(opts, t.lookupEnv)
+	AssertEq(nil, err)
+	ExpectThat(
+		opts,
+		DeepEquals([]mount.Option{
+			{Name: "context", Value: "system_u:object_r:tmp_t:s0:c1,c2"},
+			{Name: "ro"},
+		}))
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import "strings"
+
+// Mount options that mount.gcsfuse translates into gcsfuse flags, named as the
+// flags are with underscores in place of dashes.
+var (
+	// Options for bool flags, such as implicit_dirs for --implicit-dirs, which
+	// may also be given values, such as implicit_dirs=false.
+	boolFlagOptions = []string{
+		"implicit_dirs",
+		"preserve_posix_metadata",
+		"reflect_iam_permissions",
+		"streaming_writes",
+		"async_close",
+		"lazy_fsync",
+		"skip_unmodified_fsync",
+		"range_cache_all_reads",
+		"read_stall_other_ip",
+		"verify_crc32c",
+		"force_unmount",
+		"debug_fuse",
+		"debug_gcs",
+		"debug_http",
+		"debug_invariants",
+	}
+
+	// Options for flags whose optional values must be attached to them, such as
+	// prefetch_metadata=foo/ for --prefetch-metadata=foo/. Among them,
+	// default_permissions=false turns off the kernel's checks, which gcsfuse
+	// otherwise always asks for.
+	optionalValueFlagOptions = []string{
+		"prefetch_metadata",
+		"default_permissions",
+	}
+
+	// Options for flags taking values, such as key_file=foo for
+	// --key-file foo.
+	valueFlagOptions = []string{
+		"dir_mode", "file_mode", "key_file", "temp_dir", "gid", "uid",
+		"uid_map", "gid_map", "only_dir", "prefix_dirs", "mapping_file",
+		"versions_dir", "include", "exclude", "file_rules", "normalize_names",
+		"unchanged_content", "content_types", "cache_control", "storage_class",
+		"storage_class_overrides", "rename_dir_limit", "profile", "config_file",
+		"limit_ops_per_sec", "max_concurrent_requests", "client_protocol",
+		"max_conns_per_host", "max_idle_conns_per_host", "idle_conn_timeout",
+		"tcp_keep_alive", "list_page_size", "list_projection", "gzip_objects",
+		"read_stall_timeout", "max_retry_attempts", "max_retry_sleep",
+		"retry_multiplier", "limit_bytes_per_sec", "bandwidth_schedule",
+		"custom_time_interval", "clock_skew_threshold", "failover_bucket",
+		"failover_after", "offline_queue_dir", "inventory_report",
+		"notification_subscription", "write_lease_ttl", "write_journal_dir",
+		"max_memory_mb", "max_cached_inodes", "max_open_readers",
+		"memory_staging_mb", "upload_chunk_size_mb", "write_back_delay",
+		"write_back_max_dirty_mb", "parallel_upload_threshold_mb",
+		"parallel_upload_parts", "file_cache_dir", "file_cache_max_size_mb",
+		"parallel_download_threshold_mb", "parallel_download_chunk_size_mb",
+		"parallel_download_streams", "read_ahead_mb", "read_ahead_trigger",
+		"range_cache_dir", "range_cache_max_size_mb", "metadata_cache_ttl",
+		"metadata_cache_capacity", "stat_cache_ttl", "stat_cache_max_size_mb",
+		"negative_stat_cache_ttl", "negative_stat_cache_capacity",
+		"type_cache_ttl", "kernel_list_cache_ttl", "log_format", "log_severity",
+		"billing_project", "project", "endpoint", "encryption_key_file",
+		"impersonate_service_account", "token_url", "nonempty_mount_point",
+		"mapping", "retryable_codes", "retry_overrides",
+		"stat_cache_capacity", "debug_addr", "debug_record_http",
+	}
+)
+
+// The prefix of options that set the gcsfuse flag named by the rest of the
+// option name, such as gcsfuse_flag.stat-cache-ttl=1h for --stat-cache-ttl=1h.
+// This allows setting flags without options of their own, such as those added
+// to gcsfuse after mount.gcsfuse was built.
+const FlagOptionPrefix = "gcsfuse_flag."
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the name of the gcsfuse flag corresponding to the mount option with
+// the given name.
+func flagName(option string) string {
+	// The debug flags are named with underscores.
+	if strings.HasPrefix(option, "debug_") {
+		return option
+	}
+
+	return strings.Replace(option, "_", "-", -1)
+}
+
+// FlagArgs returns the gcsfuse arguments that have the effect of the mount
+// option with the given name and value, or false if the option doesn't
+// correspond to a gcsfuse flag.
+func FlagArgs(name string, value string) (args []string, ok bool) {
+	var flag string
+	switch {
+	case strings.HasPrefix(name, FlagOptionPrefix):
+		flag = "--" + strings.TrimPrefix(name, FlagOptionPrefix)
+
+	case contains(boolFlagOptions, name),
+		contains(optionalValueFlagOptions, name),
+		contains(valueFlagOptions, name):
+		flag = "--" + flagName(name)
+
+	default:
+		return
+	}
+
+	switch {
+	case contains(valueFlagOptions, name):
+		args = []string{flag, value}
+
+	// Values of the others must be attached to the flag, as for
+	// implicit_dirs=false or prefetch_metadata=foo/.
+	case value != "":
+		args = []string{flag + "=" + value}
+
+	default:
+		args = []string{flag}
+	}
+
+	ok = true
+	return
+}
+
+// FlagOption returns the name of the mount option that sets the gcsfuse flag
+// with the given name, and whether there is one.
+func FlagOption(flag string) (name string, ok bool) {
+	name = strings.Replace(flag, "-", "_", -1)
+	ok = contains(boolFlagOptions, name) ||
+		contains(optionalValueFlagOptions, name) ||
+		contains(valueFlagOptions, name)
+
+	return
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount_test
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/mount"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestOptions(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type OptionsTest struct {
+}
+
+func init() { RegisterTestSuite(&OptionsTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OptionsTest) FlagArgs() {
+	testCases := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		// Bool flags
+		{"implicit_dirs", "", []string{"--implicit-dirs"}},
+		{"implicit_dirs", "false", []string{"--implicit-dirs=false"}},
+		{"debug_gcs", "", []string{"--debug_gcs"}},
+
+		// Flags with optional values
+		{"prefetch_metadata", "", []string{"--prefetch-metadata"}},
+		{"prefetch_metadata", "foo/", []string{"--prefetch-metadata=foo/"}},
+		{"default_permissions", "false", []string{"--default-permissions=false"}},
+
+		// Flags with values
+		{"uid", "1000", []string{"--uid", "1000"}},
+		{"stat_cache_ttl", "1h", []string{"--stat-cache-ttl", "1h"}},
+		{"retryable_codes", "429,503", []string{"--retryable-codes", "429,503"}},
+		{"debug_addr", "localhost:8000", []string{"--debug_addr", "localhost:8000"}},
+
+		// The generic option
+		{"gcsfuse_flag.stat-cache-ttl", "1h", []string{"--stat-cache-ttl=1h"}},
+		{"gcsfuse_flag.implicit-dirs", "", []string{"--implicit-dirs"}},
+		{"gcsfuse_flag.debug_gcs", "false", []string{"--debug_gcs=false"}},
+	}
+
+	for _, tc := range testCases {
+		args, ok := mount.FlagArgs(tc.name, tc.value)
+		AssertTrue(ok, "option: %s=%s", tc.name, tc.value)
+		ExpectThat(
+			args,
+			DeepEquals(tc.expected),
+			"option: %s=%s", tc.name, tc.value)
+	}
+}
+
+func (t *OptionsTest) FlagArgs_OtherOptions() {
+	names := []string{
+		"ro",
+		"allow_other",
+		"context",
+		"implicit-dirs",
+		"gcsfuse_flag",
+
+		// Keys don't belong in fstab, nor on gcsfuse's command line.
+		"encryption_key",
+	}
+
+	for _, name := range names {
+		_, ok := mount.FlagArgs(name, "")
+		ExpectFalse(ok, "option: %s", name)
+	}
+}
+
+func (t *OptionsTest) FlagOption() {
+	testCases := []struct {
+		flag     string
+		expected string
+	}{
+		{"implicit-dirs", "implicit_dirs"},
+		{"prefetch-metadata", "prefetch_metadata"},
+		{"stat-cache-ttl", "stat_cache_ttl"},
+		{"debug_gcs", "debug_gcs"},
+	}
+
+	for _, tc := range testCases {
+		name, ok := mount.FlagOption(tc.flag)
+		ExpectTrue(ok, "flag: %s", tc.flag)
+		ExpectEq(tc.expected, name, "flag: %s", tc.flag)
+	}
+
+	// Flags without options of their own.
+	for _, flag := range []string{"foreground", "allow-other", "encryption-key"} {
+		_, ok := mount.FlagOption(flag)
+		ExpectFalse(ok, "flag: %s", flag)
+	}
+}
+
+func (t *OptionsTest) RepeatedOptions() {
+	opts := mount.ParseOptionList(nil, "include=*.txt,ro")
+	opts = mount.ParseOptionList(opts, "include=*.csv")
+
+	ExpectThat(
+		opts,
+		DeepEquals([]mount.Option{
+			{Name: "include", Value: "*.txt"},
+			{Name: "ro"},
+			{Name: "include", Value: "*.csv"},
+		}))
+
+	var args []string
+	for _, o := range opts {
+		if a, ok := mount.FlagArgs(o.Name, o.Value); ok {
+			args = append(args, a...)
+		}
+	}
+
+	ExpectThat(
+		args,
+		DeepEquals([]string{"--include", "*.txt", "--include", "*.csv"}))
+}
@@ -16,14 +16,20 @@
 //
 // Usage:
 //
-//     gcsfuse [flags] bucket mount_point
+//     gcsfuse [flags] [bucket] mount_point
 //
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
@@ -35,14 +41,18 @@ import (
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 
 	"github.com/codegangsta/cli"
 	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
 	"github.com/jacobsa/daemonize"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
 	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
 	"github.com/kardianos/osext"
 )
 
@@ -50,7 +60,13 @@ import (
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
-func registerSIGINTHandler(mountPoint string) {
+// Unmount in response to SIGINT. Unless force is set, refuse to do so while
+// the server holds writes that have not yet made it to GCS, since they would
+// otherwise be lost.
+func registerSIGINTHandler(
+	mountPoint string,
+	server fs.Server,
+	force bool) {
 	// Register for SIGINT.
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt)
@@ -59,19 +75,81 @@ func registerSIGINTHandler(mountPoint string) {
 	go func() {
 		for {
 			<-signalChan
-			log.Println("Received SIGINT, attempting to unmount...")
+			logger.Infof("Received SIGINT, attempting to unmount...")
+
+			if dirty := server.DirtyFiles(); len(dirty) != 0 {
+				if !force {
+					logger.Warningf(
+						"Refusing to unmount: %d file(s) have not yet been written to "+
+							"GCS: %q. Close or sync them and try again, or mount with "+
+							"--force-unmount to unmount anyway.",
+						len(dirty),
+						dirty)
+
+					continue
+				}
+
+				logger.Errorf(
+					"Unmounting with %d file(s) not yet written to GCS: %q",
+					len(dirty),
+					dirty)
+			}
 
 			err := fuse.Unmount(mountPoint)
 			if err != nil {
-				log.Printf("Failed to unmount in response to SIGINT: %v", err)
+				logger.Errorf("Failed to unmount in response to SIGINT: %v", err)
 			} else {
-				log.Printf("Successfully unmounted in response to SIGINT.")
+				logger.Infof("Successfully unmounted in response to SIGINT.")
 				return
 			}
 		}
 	}()
 }
 
+// Set up the default logger according to the supplied flags. Debugging output
+// is pointless if it's dropped, so the debug flags lower the severity.
+func initLogging(flags *flagStorage) {
+	severity := flags.LogSeverity
+	if (flags.DebugFuse || flags.DebugGCS || flags.DebugHTTP) &&
+		severity > logger.Debug {
+		severity = logger.Debug
+	}
+
+	logger.Init(os.Stderr, flags.LogFormat, severity)
+}
+
+// Serve debugging information over HTTP on the supplied address, including the
+// variables published with package expvar at /debug/vars.
+func startDebugServer(addr string) (err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	go func() {
+		err := http.Serve(l, nil)
+		logger.Warningf("Debug server on %s exited: %v", addr, err)
+	}()
+
+	return
+}
+
+// Return a handler that reports the internal state of the inodes for the path
+// given by the "path" query parameter, relative to the mount point, as JSON.
+func inodeDebugHandler(server fs.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infos := server.Inspect(r.Context(), r.URL.Query().Get("path"))
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(infos); err != nil {
+			logger.Errorf("Encoding inode info: %v", err)
+		}
+	})
+}
+
 func handleCPUProfileSignals() {
 	profileOnce := func(duration time.Duration, path string) (err error) {
 		// Set up the file.
@@ -102,13 +180,13 @@ func handleCPUProfileSignals() {
 		const path = "/tmp/cpu.pprof"
 		const duration = 10 * time.Second
 
-		log.Printf("Writing %v CPU profile to %s...", duration, path)
+		logger.Infof("Writing %v CPU profile to %s...", duration, path)
 
 		err := profileOnce(duration, path)
 		if err == nil {
-			log.Printf("Done writing CPU profile to %s.", path)
+			logger.Infof("Done writing CPU profile to %s.", path)
 		} else {
-			log.Printf("Error writing CPU profile: %v", err)
+			logger.Errorf("Error writing CPU profile: %v", err)
 		}
 	}
 }
@@ -151,72 +229,211 @@ func handleMemoryProfileSignals() {
 
 		err := profileOnce(path)
 		if err == nil {
-			log.Printf("Wrote memory profile to %s.", path)
+			logger.Infof("Wrote memory profile to %s.", path)
 		} else {
-			log.Printf("Error writing memory profile: %v", err)
+			logger.Errorf("Error writing memory profile: %v", err)
 		}
 	}
 }
 
-// Create token source from the JSON file at the supplide path.
-func newTokenSourceFromPath(
-	path string,
-	scope string) (ts oauth2.TokenSource, err error) {
-	// Read the file.
-	contents, err := ioutil.ReadFile(path)
+// Return the customer-supplied encryption key given by --encryption-key or
+// --encryption-key-file, or nil if neither is set.
+func loadEncryptionKey(flags *flagStorage) (key []byte, err error) {
+	switch {
+	case flags.EncryptionKey != "" && flags.EncryptionKeyFile != "":
+		err = errors.New(
+			"--encryption-key and --encryption-key-file are incompatible")
+
+	case flags.EncryptionKey != "":
+		key, err = gcsx.ParseEncryptionKey(flags.EncryptionKey)
+		if err != nil {
+			err = fmt.Errorf("--encryption-key: %v", err)
+		}
+
+	case flags.EncryptionKeyFile != "":
+		var contents []byte
+		contents, err = ioutil.ReadFile(flags.EncryptionKeyFile)
+		if err != nil {
+			err = fmt.Errorf("ReadFile: %v", err)
+			return
+		}
+
+		key, err = gcsx.ParseEncryptionKey(string(contents))
+		if err != nil {
+			err = fmt.Errorf("--encryption-key-file: %v", err)
+		}
+	}
+
+	return
+}
+
+// Also return an HTTP client with the same credentials and transport, for
+// requests that the connection doesn't support.
+func getConn(
+	flags *flagStorage) (c gcs.Conn, client *http.Client, err error) {
+	// Parse the endpoint, if any, falling back to an emulator named in the
+	// environment.
+	var endpoint *url.URL
+	if flags.Endpoint != "" {
+		endpoint, err = url.Parse(flags.Endpoint)
+		if err != nil {
+			err = fmt.Errorf("Parsing endpoint: %v", err)
+			return
+		}
+	} else if h := os.Getenv(gcsx.EmulatorHostEnvVar); h != "" {
+		endpoint, err = gcsx.ParseEmulatorHost(h)
+		if err != nil {
+			err = fmt.Errorf("Parsing %s: %v", gcsx.EmulatorHostEnvVar, err)
+			return
+		}
+	}
+
+	// Create the oauth2 token source.
+	tokenSrc, err := newTokenSource(flags, endpoint)
 	if err != nil {
-		err = fmt.Errorf("ReadFile(%q): %v", path, err)
+		err = fmt.Errorf("newTokenSource: %v", err)
 		return
 	}
 
-	// Create a config struct based on its contents.
-	jwtConfig, err := google.JWTConfigFromJSON(contents, scope)
+	// Choose the HTTP transport, retrying reads that stall if requested.
+	base := newTransport(flags)
+	transport := httputil.CancellableRoundTripper(base)
+	if flags.ReadStallTimeout > 0 {
+		transport = gcsx.NewStallRoundTripper(
+			flags.ReadStallTimeout,
+			flags.ReadStallOtherIP,
+			base)
+	}
+
+	// Download the bytes stored for objects, whatever their Content-Encoding.
+	transport = gcsx.NewStoredBytesRoundTripper(transport)
+
+	// Attach a customer-supplied encryption key, if any. This comes first so
+	// that the debugging and recording below don't see the key.
+	key, err := loadEncryptionKey(flags)
 	if err != nil {
-		err = fmt.Errorf("JWTConfigFromJSON: %v", err)
+		err = fmt.Errorf("loadEncryptionKey: %v", err)
 		return
 	}
 
-	// Create the token source.
-	ts = jwtConfig.TokenSource(context.Background())
-
-	return
-}
+	if key != nil {
+		transport = gcsx.NewEncryptionRoundTripper(key, transport)
+	}
+	if endpoint != nil {
+		transport, err = gcsx.NewEndpointRoundTripper(endpoint, transport)
+		if err != nil {
+			err = fmt.Errorf("NewEndpointRoundTripper: %v", err)
+			return
+		}
+	}
 
-func getConn(flags *flagStorage) (c gcs.Conn, err error) {
-	// Create the oauth2 token source.
-	const scope = gcs.Scope_FullControl
+	// Ask for listings as configured.
+	if flags.ListPageSize != 0 || flags.ListProjection != gcsx.ListProjectionFull {
+		transport, err = gcsx.NewListingRoundTripper(
+			flags.ListPageSize,
+			flags.ListProjection,
+			transport)
 
-	var tokenSrc oauth2.TokenSource
-	if flags.KeyFile != "" {
-		tokenSrc, err = newTokenSourceFromPath(flags.KeyFile, scope)
 		if err != nil {
-			err = fmt.Errorf("newTokenSourceFromPath: %v", err)
+			err = fmt.Errorf("NewListingRoundTripper: %v", err)
 			return
 		}
-	} else {
-		tokenSrc, err = google.DefaultTokenSource(context.Background(), scope)
+	}
+
+	// Choose the storage class of new objects, if configured.
+	if flags.StorageClass != "" || len(flags.StorageClassOverrides) != 0 {
+		transport = gcsx.NewStorageClassRoundTripper(
+			flags.StorageClass,
+			flags.StorageClassOverrides,
+			tmpObjectPrefix,
+			transport)
+	}
+
+	// Warn about a skewed clock.
+	if flags.ClockSkewThreshold > 0 {
+		transport = gcsx.NewClockSkewRoundTripper(
+			flags.ClockSkewThreshold,
+			timeutil.RealClock(),
+			transport)
+	}
+
+	// Record exchanges with GCS, if requested.
+	if flags.DebugRecordHTTP != "" {
+		var f *os.File
+		f, err = os.OpenFile(
+			flags.DebugRecordHTTP,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+			0600)
+
 		if err != nil {
-			err = fmt.Errorf("DefaultTokenSource: %v", err)
+			err = fmt.Errorf("Opening --debug_record_http file: %v", err)
 			return
 		}
+
+		transport = gcsx.NewRecordingRoundTripper(f, transport)
+	}
+
+	// Enable HTTP debugging ourselves rather than setting HTTPDebugLogger
+	// below, since the latter would discard the transport chosen above.
+	if flags.DebugHTTP {
+		transport = httputil.DebuggingRoundTripper(
+			transport,
+			logger.NewStdLogger(logger.Debug, "http: "))
+	}
+
+	// Upload in chunks, if requested. This comes last so that the debugging
+	// and recording above see the requests actually sent.
+	if flags.UploadChunkSizeMB > 0 {
+		transport = gcsx.NewChunkedUploadRoundTripper(
+			flags.UploadChunkSizeMB<<20,
+			transport)
+	}
+
+	client = &http.Client{
+		Transport: &oauth2.Transport{Source: tokenSrc, Base: transport},
 	}
 
 	// Create the connection.
-	const userAgent = "gcsfuse/0.0"
 	cfg := &gcs.ConnConfig{
 		TokenSource: tokenSrc,
 		UserAgent:   userAgent,
+		Transport:   transport,
 	}
 
-	if flags.DebugHTTP {
-		cfg.HTTPDebugLogger = log.New(os.Stdout, "http: ", 0)
+	if flags.DebugGCS {
+		cfg.GCSDebugLogger = logger.NewStdLogger(logger.Debug, "gcs: ")
 	}
 
-	if flags.DebugGCS {
-		cfg.GCSDebugLogger = log.New(os.Stdout, "gcs: ", log.Flags())
+	c, err = gcs.NewConn(cfg)
+	return
+}
+
+// Create an HTTP transport with the protocol, connection pool, and keep-alive
+// settings given by the supplied flags, and otherwise like the default one.
+func newTransport(flags *flagStorage) (t *http.Transport) {
+	t = http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxConnsPerHost = flags.MaxConnsPerHost
+	t.MaxIdleConnsPerHost = flags.MaxIdleConnsPerHost
+	t.IdleConnTimeout = flags.IdleConnTimeout
+
+	// An empty map of protocols to upgrade to disables HTTP/2.
+	if flags.ClientProtocol == ClientProtocolHTTP1 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	// Don't let the limit on idle connections to all hosts get in the way.
+	if t.MaxIdleConns < flags.MaxIdleConnsPerHost {
+		t.MaxIdleConns = flags.MaxIdleConnsPerHost
+	}
+
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: flags.TCPKeepAlive,
 	}
 
-	return gcs.NewConn(cfg)
+	t.DialContext = d.DialContext
+	return
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -228,21 +445,35 @@ func mountWithArgs(
 	bucketName string,
 	mountPoint string,
 	flags *flagStorage,
-	mountStatus *log.Logger) (mfs *fuse.MountedFileSystem, err error) {
+	mountStatus *log.Logger) (
+	mfs *fuse.MountedFileSystem,
+	server fs.Server,
+	r *reloader,
+	err error) {
 	// Enable invariant checking if requested.
 	if flags.DebugInvariants {
 		syncutil.EnableInvariantChecking()
 	}
 
+	// Serve debugging information if requested.
+	if flags.DebugAddr != "" {
+		err = startDebugServer(flags.DebugAddr)
+		if err != nil {
+			err = fmt.Errorf("startDebugServer: %v", err)
+			return
+		}
+	}
+
 	// Grab the connection.
 	//
 	// Special case: if we're mounting the fake bucket, we don't need an actual
 	// connection.
 	var conn gcs.Conn
+	var client *http.Client
 	if bucketName != canned.FakeBucketName {
 		mountStatus.Println("Opening GCS connection...")
 
-		conn, err = getConn(flags)
+		conn, client, err = getConn(flags)
 		if err != nil {
 			err = fmt.Errorf("getConn: %v", err)
 			return
@@ -250,12 +481,13 @@ func mountWithArgs(
 	}
 
 	// Mount the file system.
-	mfs, err = mountWithConn(
+	mfs, server, r, err = mountWithConn(
 		context.Background(),
 		bucketName,
 		mountPoint,
 		flags,
 		conn,
+		client,
 		mountStatus)
 
 	if err != nil {
@@ -263,25 +495,44 @@ func mountWithArgs(
 		return
 	}
 
+	// Allow inspecting the state of individual files now that there's a server
+	// to ask.
+	if flags.DebugAddr != "" {
+		http.Handle("/debug/inode", inodeDebugHandler(server))
+	}
+
 	return
 }
 
 func runCLIApp(c *cli.Context) (err error) {
-	flags := populateFlags(c)
+	flags, err := populateFlags(c)
+	if err != nil {
+		err = fmt.Errorf("populateFlags: %v", err)
+		return
+	}
 
-	// Extract arguments.
-	if len(c.Args()) != 2 {
+	initLogging(flags)
+
+	// Extract arguments. Without a bucket name, mount all buckets.
+	var bucketName, mountPoint string
+	switch len(c.Args()) {
+	case 1:
+		bucketName = allBucketsName
+		mountPoint = c.Args()[0]
+
+	case 2:
+		bucketName = c.Args()[0]
+		mountPoint = c.Args()[1]
+
+	default:
 		err = fmt.Errorf(
-			"%s takes exactly two arguments. Run `%s --help` for more info.",
+			"%s takes one or two arguments. Run `%s --help` for more info.",
 			path.Base(os.Args[0]),
 			path.Base(os.Args[0]))
 
 		return
 	}
 
-	bucketName := c.Args()[0]
-	mountPoint := c.Args()[1]
-
 	// Canonicalize the mount point, making it absolute. This is important when
 	// daemonizing below, since the daemon will change its working directory
 	// before running this code again.
@@ -305,9 +556,43 @@ func runCLIApp(c *cli.Context) (err error) {
 		}
 
 		// Set up arguments. Be sure to use foreground mode, and to send along the
-		// potentially-modified mount point.
-		args := append([]string{"--foreground"}, os.Args[1:]...)
-		args[len(args)-1] = mountPoint
+		// bucket name and the potentially-modified mount point.
+		flagArgs := os.Args[1 : len(os.Args)-len(c.Args())]
+		args := append([]string{"--foreground"}, flagArgs...)
+
+		// The daemon runs in the root directory, so give it absolute paths to
+		// the files named by flags. A later flag overrides an earlier one, so add
+		// them just before the positional arguments.
+		var fileArgs []string
+		for _, f := range []struct {
+			name  string
+			value string
+		}{
+			{"config-file", flags.ConfigFile},
+			{"encryption-key-file", flags.EncryptionKeyFile},
+			{"mapping-file", flags.MappingFile},
+			{"offline-queue-dir", flags.OfflineQueueDir},
+			{"write-journal-dir", flags.WriteJournalDir},
+			{"file-cache-dir", flags.FileCacheDir},
+			{"range-cache-dir", flags.RangeCacheDir},
+			{"debug_record_http", flags.DebugRecordHTTP},
+		} {
+			if f.value == "" {
+				continue
+			}
+
+			var p string
+			p, err = filepath.Abs(f.value)
+			if err != nil {
+				err = fmt.Errorf("canonicalizing --%s: %v", f.name, err)
+				return
+			}
+
+			fileArgs = append(fileArgs, "--"+f.name, p)
+		}
+
+		args = append(args, fileArgs...)
+		args = append(args, bucketName, mountPoint)
 
 		// Pass along PATH so that the daemon can find fusermount on Linux.
 		env := []string{
@@ -319,6 +604,11 @@ func runCLIApp(c *cli.Context) (err error) {
 		if p, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); ok {
 			env = append(env, fmt.Sprintf("GOOGLE_APPLICATION_CREDENTIALS=%s", p))
 		}
+		// Pass along the emulator, if any, in place of --endpoint.
+		if p, ok := os.LookupEnv(gcsx.EmulatorHostEnvVar); ok {
+			env = append(env, fmt.Sprintf("%s=%s", gcsx.EmulatorHostEnvVar, p))
+		}
+
 		// Pass through the http_proxy environment variable, in case the host
 		// requires a HTTP proxy server to reach the GCS endpoint.
 		if p, ok := os.LookupEnv("http_proxy"); ok {
@@ -338,9 +628,15 @@ func runCLIApp(c *cli.Context) (err error) {
 	// Mount, writing information about our progress to the writer that package
 	// daemonize gives us and telling it about the outcome.
 	var mfs *fuse.MountedFileSystem
+	var server fs.Server
+	var r *reloader
 	{
 		mountStatus := log.New(daemonize.StatusWriter, "", 0)
-		mfs, err = mountWithArgs(bucketName, mountPoint, flags, mountStatus)
+		mfs, server, r, err = mountWithArgs(
+			bucketName,
+			mountPoint,
+			flags,
+			mountStatus)
 
 		if err == nil {
 			mountStatus.Println("File system has been successfully mounted.")
@@ -353,7 +649,20 @@ func runCLIApp(c *cli.Context) (err error) {
 	}
 
 	// Let the user unmount with Ctrl-C (SIGINT).
-	registerSIGINTHandler(mfs.Dir())
+	registerSIGINTHandler(mfs.Dir(), server, flags.ForceUnmount)
+
+	// And change some settings without unmounting by sending SIGHUP.
+	registerSIGHUPHandler(os.Args, r)
+
+	// Serve the control interface used by commands like `gcsfuse lsof`. The
+	// file system works without it, so failing to start it isn't fatal.
+	control, err := startControlServer(controlSocketPath(mountPoint), server)
+	if err != nil {
+		logger.Warningf("Not serving the control interface: %v", err)
+		err = nil
+	} else {
+		defer control.Close()
+	}
 
 	// Wait for the file system to be unmounted.
 	err = mfs.Join(context.Background())
@@ -362,6 +671,23 @@ func runCLIApp(c *cli.Context) (err error) {
 		return
 	}
 
+	// An unmount we didn't initiate (e.g. a lazy one) may have left behind
+	// files whose last flush failed, and files whose write-back failed are
+	// kept too. Make one final attempt to write them out, exiting with an
+	// error rather than silently dropping their contents.
+	if dirty := server.DirtyFiles(); len(dirty) != 0 {
+		logger.Warningf(
+			"Unmounted with %d file(s) not yet written to GCS; retrying: %q",
+			len(dirty),
+			dirty)
+
+		err = server.SyncDirtyFiles(context.Background())
+		if err != nil {
+			err = fmt.Errorf("SyncDirtyFiles: %v", err)
+			return
+		}
+	}
+
 	return
 }
 
@@ -385,9 +711,6 @@ func run() (err error) {
 }
 
 func main() {
-	// Make logging output better.
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-
 	// Set up profiling handlers.
 	go handleCPUProfileSignals()
 	go handleMemoryProfileSignals()
@@ -0,0 +1,212 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// A directory described by a line of a mapping file.
+type mappingEntry struct {
+	line int
+
+	// The directory's path relative to the mount point.
+	path string
+
+	// The bucket and prefix it exposes. The prefix is empty or ends in a slash.
+	bucket string
+	prefix string
+
+	readOnly bool
+}
+
+// Parse the contents of a mapping file, which consists of lines of the form
+//
+//     path  bucket[/prefix]  [ro|rw]
+//
+// each mounting the given prefix of the bucket (which may be written with a
+// leading gs://) at the given path relative to the mount point, read-only or
+// read-write. The default is read-write. Blank lines and text following a '#'
+// at the start of a line or after whitespace are ignored.
+//
+// Problems are returned each prefixed with its line number.
+func parseMappingFile(
+	contents string) (entries []mappingEntry, problems []string) {
+	lines := make(map[string]int)
+	for i, line := range strings.Split(contents, "\n") {
+		lineNum := i + 1
+		problem := func(format string, v ...interface{}) {
+			problems = append(
+				problems,
+				fmt.Sprintf("%d: %s", lineNum, fmt.Sprintf(format, v...)))
+		}
+
+		// Strip comments and whitespace.
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		if j := strings.Index(line, " #"); j >= 0 {
+			line = line[:j]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 3 {
+			problem("expected \"path bucket[/prefix] [ro|rw]\", got %q", line)
+			continue
+		}
+
+		e := mappingEntry{line: lineNum}
+
+		// Parse the path.
+		e.path = path.Clean(strings.Trim(fields[0], "/"))
+		if e.path == "." ||
+			e.path == ".." ||
+			strings.HasPrefix(e.path, "../") {
+			problem("illegal path %q", fields[0])
+			continue
+		}
+
+		if l, ok := lines[e.path]; ok {
+			problem("%q is already mapped on line %d", e.path, l)
+			continue
+		}
+
+		// Parse the bucket and prefix.
+		source := strings.TrimPrefix(fields[1], "gs://")
+		e.bucket = source
+		if j := strings.Index(source, "/"); j >= 0 {
+			e.bucket = source[:j]
+			e.prefix = strings.Trim(source[j+1:], "/")
+			if e.prefix != "" {
+				e.prefix = path.Clean(e.prefix) + "/"
+			}
+		}
+
+		if e.bucket == "" {
+			problem("no bucket in %q", fields[1])
+			continue
+		}
+
+		// Parse the mode.
+		if len(fields) == 3 {
+			switch fields[2] {
+			case "ro":
+				e.readOnly = true
+
+			case "rw":
+
+			default:
+				problem("unknown mode %q; want ro or rw", fields[2])
+				continue
+			}
+		}
+
+		lines[e.path] = lineNum
+		entries = append(entries, e)
+	}
+
+	return
+}
+
+// Do the flags describe a tree of directories, with --mapping-file or
+// --mapping?
+func hasMapping(flags *flagStorage) bool {
+	return flags.MappingFile != "" || len(flags.Mapping) != 0
+}
+
+// Assemble the tree of directories described by the mapping file named by
+// the flags, or the lines given by --mapping, opening each bucket it mentions.
+// Temporary objects are written to the home bucket, whose name is given so
+// that it isn't opened twice.
+func setUpTree(
+	ctx context.Context,
+	flags *flagStorage,
+	conn gcs.Conn,
+	homeName string,
+	home gcs.Bucket) (b gcs.Bucket, err error) {
+	// Read the mapping, naming its source in any errors. Each --mapping item
+	// is a line, so that problems are reported by item number.
+	source := "--mapping"
+	contents := strings.Join(flags.Mapping, "\n")
+
+	if flags.MappingFile != "" {
+		source = flags.MappingFile
+
+		var raw []byte
+		raw, err = ioutil.ReadFile(flags.MappingFile)
+		if err != nil {
+			err = fmt.Errorf("ReadFile: %v", err)
+			return
+		}
+
+		contents = string(raw)
+	}
+
+	mapping, problems := parseMappingFile(contents)
+	if len(problems) != 0 {
+		for i, p := range problems {
+			problems[i] = source + ":" + p
+		}
+
+		err = errors.New(strings.Join(problems, "\n"))
+		return
+	}
+
+	// Open each bucket once.
+	buckets := map[string]gcs.Bucket{homeName: home}
+
+	var entries []gcsx.TreeEntry
+	for _, m := range mapping {
+		bucket, ok := buckets[m.bucket]
+		if !ok {
+			bucket, err = openBucket(ctx, flags, conn, m.bucket)
+			if err != nil {
+				err = fmt.Errorf("%s:%d: %v", source, m.line, err)
+				return
+			}
+
+			buckets[m.bucket] = bucket
+		}
+
+		entries = append(entries, gcsx.TreeEntry{
+			Path:     m.path,
+			Bucket:   bucket,
+			Prefix:   m.prefix,
+			ReadOnly: m.readOnly,
+		})
+	}
+
+	b, err = gcsx.NewTreeBucket(entries, tmpObjectPrefix, home)
+	if err != nil {
+		err = fmt.Errorf("NewTreeBucket: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestMapping(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MappingFileTest struct {
+	ctx context.Context
+
+	// A temporary directory holding the mapping file. Removed in TearDown.
+	dir string
+}
+
+var _ SetUpInterface = &MappingFileTest{}
+var _ TearDownInterface = &MappingFileTest{}
+
+func init() { RegisterTestSuite(&MappingFileTest{}) }
+
+func (t *MappingFileTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.dir, err = ioutil.TempDir("", "mapping_test")
+	AssertEq(nil, err)
+}
+
+func (t *MappingFileTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MappingFileTest) ValidFile() {
+	const contents = `
+# Some comments.
+datasets/imagenet   gs://ml-data/imagenet/   ro
+/datasets/coco/     ml-data/sets//coco       ro   # A trailing comment.
+results             my-results               rw
+scratch             my-results/scratch
+`
+
+	entries, problems := parseMappingFile(contents)
+	AssertEq(0, len(problems), "problems: %v", problems)
+	AssertEq(4, len(entries))
+
+	ExpectEq(3, entries[0].line)
+	ExpectEq("datasets/imagenet", entries[0].path)
+	ExpectEq("ml-data", entries[0].bucket)
+	ExpectEq("imagenet/", entries[0].prefix)
+	ExpectTrue(entries[0].readOnly)
+
+	ExpectEq("datasets/coco", entries[1].path)
+	ExpectEq("ml-data", entries[1].bucket)
+	ExpectEq("sets/coco/", entries[1].prefix)
+	ExpectTrue(entries[1].readOnly)
+
+	ExpectEq("results", entries[2].path)
+	ExpectEq("my-results", entries[2].bucket)
+	ExpectEq("", entries[2].prefix)
+	ExpectFalse(entries[2].readOnly)
+
+	ExpectEq("scratch", entries[3].path)
+	ExpectEq("scratch/", entries[3].prefix)
+	ExpectFalse(entries[3].readOnly)
+}
+
+func (t *MappingFileTest) Problems() {
+	const contents = `
+datasets
+a  b  rw  extra
+/  bucket
+../up  bucket
+b  gs://
+c  bucket  rx
+d  bucket
+d  other
+`
+
+	_, problems := parseMappingFile(contents)
+	all := strings.Join(problems, "\n")
+
+	ExpectThat(all, HasSubstr(`2: expected "path bucket[/prefix] [ro|rw]"`))
+	ExpectThat(all, HasSubstr(`3: expected`))
+	ExpectThat(all, HasSubstr(`4: illegal path "/"`))
+	ExpectThat(all, HasSubstr(`5: illegal path "../up"`))
+	ExpectThat(all, HasSubstr(`6: no bucket in "gs://"`))
+	ExpectThat(all, HasSubstr(`7: unknown mode "rx"`))
+	ExpectThat(all, HasSubstr(`9: "d" is already mapped on line 8`))
+	ExpectEq(7, len(problems))
+}
+
+func (t *MappingFileTest) SetUpTree() {
+	const contents = `
+fake      fake@bucket/bar   ro
+home/dir  home
+`
+
+	p := path.Join(t.dir, "mapping")
+	err := ioutil.WriteFile(p, []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	home := gcsfake.NewFakeBucket(timeutil.RealClock(), "home")
+	_, err = gcsutil.CreateObject(t.ctx, home, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	// Both buckets are available without a connection.
+	flags := &flagStorage{MappingFile: p}
+	b, err := setUpTree(t.ctx, flags, nil, "home", home)
+	AssertEq(nil, err)
+
+	contents0, err := gcsutil.ReadObject(t.ctx, b, "fake/f")
+	AssertEq(nil, err)
+	ExpectEq(canned.ExplicitDirFile_Contents, string(contents0))
+
+	contents1, err := gcsutil.ReadObject(t.ctx, b, "home/dir/foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents1))
+
+	_, err = gcsutil.CreateObject(t.ctx, b, "fake/g", []byte(""))
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+
+	_, err = gcsutil.CreateObject(t.ctx, b, "home/dir/g", []byte(""))
+	ExpectEq(nil, err)
+
+	_, err = home.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "g"})
+	ExpectEq(nil, err)
+}
+
+func (t *MappingFileTest) SetUpTree_ReportsProblemsWithLocations() {
+	p := path.Join(t.dir, "mapping")
+	err := ioutil.WriteFile(p, []byte("a  b  rx\nc\n"), 0600)
+	AssertEq(nil, err)
+
+	home := gcsfake.NewFakeBucket(timeutil.RealClock(), "home")
+	flags := &flagStorage{MappingFile: p}
+	_, err = setUpTree(t.ctx, flags, nil, "home", home)
+
+	ExpectThat(err, Error(HasSubstr(p+`:1: unknown mode "rx"`)))
+	ExpectThat(err, Error(HasSubstr(p+`:2: expected`)))
+}
+
+func (t *MappingFileTest) SetUpTree_FromFlag() {
+	home := gcsfake.NewFakeBucket(timeutil.RealClock(), "home")
+	_, err := gcsutil.CreateObject(t.ctx, home, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	flags := &flagStorage{
+		Mapping: []string{"fake  gs://fake@bucket  ro", "home/dir  home"},
+	}
+
+	b, err := setUpTree(t.ctx, flags, nil, "home", home)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, b, "home/dir/foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	_, err = gcsutil.CreateObject(t.ctx, b, "fake/g", []byte(""))
+	ExpectThat(err, HasSameTypeAs(&gcsx.ReadOnlyError{}))
+
+	// Problems are reported by item.
+	flags = &flagStorage{Mapping: []string{"a  b", "c  d  rx"}}
+	_, err = setUpTree(t.ctx, flags, nil, "home", home)
+	ExpectThat(err, Error(HasSubstr(`--mapping:2: unknown mode "rx"`)))
+}
@@ -15,13 +15,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"golang.org/x/net/context"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
 	"github.com/googlecloudplatform/gcsfuse/internal/perms"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fsutil"
@@ -29,15 +42,37 @@ import (
 	"github.com/jacobsa/timeutil"
 )
 
+// The prefix of the names of temporary objects created in the bucket.
+const tmpObjectPrefix = ".gcsfuse_tmp/"
+
+// The prefix of the names of lease objects created in the bucket by
+// --write-lease-ttl.
+const leaseObjectPrefix = ".gcsfuse_leases/"
+
+// The bucket name that mounts every bucket in a project, each as a top-level
+// directory. It can't be the name of a real bucket.
+const allBucketsName = "_"
+
+// The user agent sent with requests to GCS.
+const userAgent = "gcsfuse/0.0"
+
 // Mount the file system based on the supplied arguments, returning a
-// fuse.MountedFileSystem that can be joined to wait for unmounting.
+// fuse.MountedFileSystem that can be joined to wait for unmounting, the
+// server that backs it, and a reloader for changing its settings. client is
+// used for requests that conn doesn't support, and is nil along with conn
+// when mounting the fake bucket.
 func mountWithConn(
 	ctx context.Context,
 	bucketName string,
 	mountPoint string,
 	flags *flagStorage,
 	conn gcs.Conn,
-	status *log.Logger) (mfs *fuse.MountedFileSystem, err error) {
+	client *http.Client,
+	status *log.Logger) (
+	mfs *fuse.MountedFileSystem,
+	server fs.Server,
+	r *reloader,
+	err error) {
 	// Sanity check: make sure the temporary directory exists and is writable
 	// currently. This gives a better user experience than harder to debug EIO
 	// errors when reading files in the future.
@@ -64,7 +99,7 @@ func mountWithConn(
 		return
 	}
 
-	if uid == 0 && flags.Uid < 0 {
+	if uid == 0 && flags.Uid < 0 && len(flags.UIDMap) == 0 {
 		fmt.Fprintln(os.Stdout, `
 WARNING: gcsfuse invoked as root. This will cause all files to be owned by
 root. If this is not what you intended, invoke gcsfuse as the user that will
@@ -73,21 +108,48 @@ be interacting with the file system.
 	}
 
 	// Choose UID and GID.
-	if flags.Uid >= 0 {
-		uid = uint32(flags.Uid)
+	myUID, myGID := uid, gid
+	uid, err = chooseOwnerID(uid, flags.Uid, flags.UIDMap)
+	if err != nil {
+		err = fmt.Errorf("--uid-map: %v", err)
+		return
 	}
 
-	if flags.Gid >= 0 {
-		gid = uint32(flags.Gid)
+	gid, err = chooseOwnerID(gid, flags.Gid, flags.GIDMap)
+	if err != nil {
+		err = fmt.Errorf("--gid-map: %v", err)
+		return
+	}
+
+	// Reject permission settings that contradict each other now, rather than
+	// leaving users to find out from EACCES once mounted.
+	groups, err := os.Getgroups()
+	if err != nil {
+		err = fmt.Errorf("Getgroups: %v", err)
+		return
+	}
+
+	err = checkPermissionFlags(flags, myUID, myGID, groups, uid, gid)
+	if err != nil {
+		return
+	}
+
+	if myUID == 0 && uid != 0 && !allowOther(flags) {
+		status.Printf(
+			"WARNING: Mounting as root without allow_other, so only root may "+
+				"use the file system, not its owner UID %d. Pass --allow-other "+
+				"to admit other users.",
+			uid)
 	}
 
 	// Set up the bucket.
 	status.Println("Opening bucket...")
 
-	bucket, err := setUpBucket(
+	bucket, folders, bucketReloader, err := setUpBucket(
 		ctx,
 		flags,
 		conn,
+		client,
 		bucketName)
 
 	if err != nil {
@@ -95,24 +157,180 @@ be interacting with the file system.
 		return
 	}
 
+	// Narrow the permission bits presented to what the bucket's IAM policy
+	// allows us to do, if requested, so that the kernel refuses what would fail
+	// later on. It checks them only with default_permissions.
+	filePerms := os.FileMode(flags.FileMode)
+	dirPerms := os.FileMode(flags.DirMode)
+
+	if flags.ReflectIAMPermissions {
+		if client == nil {
+			err = fmt.Errorf("--reflect-iam-permissions requires a real bucket")
+			return
+		}
+
+		var granted []string
+		granted, err = gcsx.TestBucketPermissions(
+			ctx,
+			client,
+			bucketName,
+			userAgent,
+			iamPermissions)
+
+		if err != nil {
+			err = fmt.Errorf("TestBucketPermissions: %v", err)
+			return
+		}
+
+		filePerms, dirPerms = restrictPerms(granted, filePerms, dirPerms)
+		status.Printf(
+			"Using file mode %#o and directory mode %#o given IAM permissions %v.",
+			filePerms,
+			dirPerms,
+			granted)
+	}
+
+	// Set up the write journal, if requested, first writing out any files left
+	// in it by an earlier process.
+	var journal *gcsx.Journal
+	if flags.WriteJournalDir != "" {
+		journal, err = gcsx.NewJournal(flags.WriteJournalDir)
+		if err != nil {
+			err = fmt.Errorf("NewJournal: %v", err)
+			return
+		}
+
+		var recovered int
+		recovered, err = journal.Recover(ctx, bucket)
+		if err != nil {
+			err = fmt.Errorf("Recover: %v", err)
+			return
+		}
+
+		if recovered != 0 {
+			status.Printf("Wrote out %d files from the write journal.", recovered)
+		}
+	}
+
+	// Share what's left of the memory budget after the stat cache's share
+	// between read buffers and files staged in memory, if requested.
+	var memoryBudget *gcsx.MemoryBudget
+	if flags.MaxMemoryMB > 0 {
+		budgetMB := flags.MaxMemoryMB
+		if flags.StatCacheTTL != 0 {
+			budgetMB -= flags.StatCacheMaxSizeMB
+		}
+
+		memoryBudget = gcsx.NewMemoryBudget(int64(budgetMB) << 20)
+	}
+
+	// Keep the local contents of files in memory, if requested.
+	var memoryStaging *gcsx.MemoryStaging
+	if flags.MemoryStagingMB > 0 {
+		memoryStaging = gcsx.NewMemoryStaging(
+			int64(flags.MemoryStagingMB)<<20,
+			flags.TempDir,
+			memoryBudget)
+	}
+
+	// Keep ranges fetched by random reads on local disk, if requested.
+	var rangeCache *gcsx.RangeCache
+	if flags.RangeCacheDir != "" {
+		rangeCache, err = gcsx.NewRangeCache(
+			flags.RangeCacheDir,
+			int64(flags.RangeCacheMaxMB)<<20,
+			flags.RangeCacheAllReads)
+
+		if err != nil {
+			err = fmt.Errorf("NewRangeCache: %v", err)
+			return
+		}
+	}
+
 	// Create a file system server.
+	// Coordinate writes with other mounts, if requested, renewing leases well
+	// before they expire.
+	var leases *gcsx.LeaseManager
+	if flags.WriteLeaseTTL > 0 {
+		leases = gcsx.NewLeaseManager(
+			bucket,
+			leaseObjectPrefix,
+			flags.WriteLeaseTTL,
+			timeutil.RealClock())
+
+		go leases.RenewPeriodically(context.Background(), flags.WriteLeaseTTL/3)
+	}
+
+	// Appending to a large file composes a temporary object with it, as do
+	// parallel uploads, but when mounting all buckets there's no bucket in which
+	// to put temporary objects, so rewrite such files in full instead.
+	appendThreshold := int64(1 << 21) // 2 MiB, a total guess.
+	parallelUploadThreshold := int64(flags.ParallelUploadThresholdMB) << 20
+	if bucketName == allBucketsName {
+		appendThreshold = math.MaxInt64
+		parallelUploadThreshold = 0
+	}
+
+	volumeIcon, err := readVolumeIcon(flags.MountOptions)
+	if err != nil {
+		return
+	}
+
 	serverCfg := &fs.ServerConfig{
 		CacheClock:             timeutil.RealClock(),
 		Bucket:                 bucket,
 		TempDir:                flags.TempDir,
+		Journal:                journal,
+		MemoryStaging:          memoryStaging,
+		StreamingWrites:        flags.StreamingWrites,
 		ImplicitDirectories:    flags.ImplicitDirs,
 		InodeAttributeCacheTTL: flags.StatCacheTTL,
 		DirTypeCacheTTL:        flags.TypeCacheTTL,
+		DirTypeCacheCapacity:   flags.StatCacheCapacity,
+		KernelListCacheTTL:     flags.KernelListCacheTTL,
 		Uid:                    uid,
 		Gid:                    gid,
-		FilePerms:              os.FileMode(flags.FileMode),
-		DirPerms:               os.FileMode(flags.DirMode),
+		FilePerms:              filePerms,
+		DirPerms:               dirPerms,
+		PreservePosixMetadata:  flags.PreservePosixMetadata,
+
+		AppendThreshold: appendThreshold,
+		TmpObjectPrefix: tmpObjectPrefix,
+
+		ParallelUploadThreshold: parallelUploadThreshold,
+		ParallelUploadParts:     flags.ParallelUploadParts,
+
+		WriteBackDelay:         flags.WriteBackDelay,
+		WriteBackMaxDirtyBytes: int64(flags.WriteBackMaxDirtyMB) << 20,
+		AsyncClose:             flags.AsyncClose,
+		LazySync:               flags.LazyFsync,
+		SkipUnmodifiedSync:     flags.SkipUnmodifiedFsync,
+
+		UnchangedContent: flags.UnchangedContent,
+
+		FileRules:    flags.FileRules,
+		ContentTypes: flags.ContentTypes,
+		CacheControl: flags.CacheControl,
+		NameForm:     flags.NameForm,
+		Leases:       leases,
+		Folders:      folders,
 
-		AppendThreshold: 1 << 21, // 2 MiB, a total guess.
-		TmpObjectPrefix: ".gcsfuse_tmp/",
+		RenameDirLimit: flags.RenameDirLimit,
+
+		ParallelDownloadThreshold:   uint64(flags.ParallelDownloadThresholdMB) << 20,
+		ParallelDownloadChunkSize:   int64(flags.ParallelDownloadChunkSizeMB) << 20,
+		ParallelDownloadParallelism: flags.ParallelDownloadStreams,
+		VerifyCRC32C:                flags.VerifyCRC32C,
+		ReadAheadWindow:             int64(flags.ReadAheadMB) << 20,
+		ReadAheadTrigger:            flags.ReadAheadTrigger,
+		RangeCache:                  rangeCache,
+		MemoryBudget:                memoryBudget,
+		MaxCachedInodes:             flags.MaxCachedInodes,
+		MaxOpenReaders:              flags.MaxOpenReaders,
+		VolumeIcon:                  volumeIcon,
 	}
 
-	server, err := fs.NewServer(serverCfg)
+	server, err = fs.NewServer(serverCfg)
 	if err != nil {
 		err = fmt.Errorf("fs.NewServer: %v", err)
 		return
@@ -121,22 +339,651 @@ be interacting with the file system.
 	// Mount the file system.
 	status.Println("Mounting file system...")
 
+	mountOptions, err := chooseMountOptions(
+		mountPoint,
+		flags.NonEmpty,
+		flags.MountOptions,
+		status)
+
+	if err != nil {
+		err = fmt.Errorf("chooseMountOptions: %v", explainMountError(err))
+		return
+	}
+
+	// Have fusermount unmount if we exit without doing so, e.g. by crashing,
+	// rather than leaving behind a mount point that fails every access with
+	// "Transport endpoint is not connected". fusermount before 2.9 doesn't
+	// know the option, so mount without it there.
+	if runtime.GOOS == "linux" {
+		if fusermountSupportsAutoUnmount(os.Getenv("PATH")) {
+			mountOptions["auto_unmount"] = ""
+		} else {
+			logger.Infof(
+				"fusermount doesn't support auto_unmount; if gcsfuse exits " +
+					"without unmounting, unmount with \"fusermount -u\".")
+		}
+	}
+
+	// Package fuse sets default_permissions itself, unless told not to.
+	if allowOther(flags) {
+		mountOptions["allow_other"] = ""
+	}
+
+	delete(mountOptions, "default_permissions")
+
+	// The file system serves the volume icon itself; see readVolumeIcon.
+	delete(mountOptions, "volicon")
+
+	err = checkAllowOther(mountOptions, os.Getuid(), fuseConfPath)
+	if err != nil {
+		return
+	}
+
+	err = checkSELinuxOptions(mountOptions, selinuxFSPath)
+	if err != nil {
+		return
+	}
+
 	mountCfg := &fuse.MountConfig{
 		FSName:      bucket.Name(),
 		VolumeName:  bucket.Name(),
-		Options:     flags.MountOptions,
-		ErrorLogger: log.New(os.Stderr, "fuse: ", log.Flags()),
+		Options:     mountOptions,
+		ErrorLogger: logger.NewStdLogger(logger.Error, "fuse: "),
+
+		DisableDefaultPermissions: !flags.DefaultPermissions,
 	}
 
 	if flags.DebugFuse {
-		mountCfg.DebugLogger = log.New(os.Stdout, "fuse_debug: ", log.Flags())
+		mountCfg.DebugLogger = logger.NewStdLogger(logger.Debug, "fuse_debug: ")
+	}
+
+	// Check the notification subscription before mounting, if any.
+	var listener *gcsx.NotificationListener
+	if flags.NotificationSubscription != "" {
+		if client == nil || bucketName == allBucketsName {
+			err = errors.New(
+				"--notification-subscription requires a single real bucket")
+			return
+		}
+
+		listener, err = gcsx.NewNotificationListener(
+			client,
+			"",
+			flags.NotificationSubscription)
+
+		if err != nil {
+			err = fmt.Errorf("NewNotificationListener: %v", err)
+			return
+		}
 	}
 
 	mfs, err = fuse.Mount(mountPoint, server, mountCfg)
 	if err != nil {
-		err = fmt.Errorf("Mount: %v", err)
+		err = fmt.Errorf("Mount: %v", explainMountError(err))
+		return
+	}
+
+	if listener != nil {
+		go listener.Listen(
+			context.Background(),
+			notificationHandler(flags, bucketName, bucketReloader, server))
+	}
+
+	r = &reloader{
+		flags:  flags,
+		bucket: bucketReloader,
+		server: server,
+	}
+
+	return
+}
+
+// Return a function that makes the stat cache and the file system forget what
+// they know about objects in the named bucket that a notification reports
+// changed, translating their names as --only-dir does. Changes to gcsfuse's
+// own temporary and lease objects are ignored.
+func notificationHandler(
+	flags *flagStorage,
+	bucketName string,
+	br *bucketReloader,
+	server fs.Server) func(gcsx.ObjectChange) {
+	var prefix string
+	if flags.OnlyDir != "" {
+		prefix = path.Clean(flags.OnlyDir) + "/"
+	}
+
+	return func(c gcsx.ObjectChange) {
+		if c.Bucket != bucketName || !strings.HasPrefix(c.Name, prefix) {
+			return
+		}
+
+		name := strings.TrimPrefix(c.Name, prefix)
+		if name == "" ||
+			strings.HasPrefix(name, tmpObjectPrefix) ||
+			strings.HasPrefix(name, leaseObjectPrefix) {
+			return
+		}
+
+		logger.Debugf("%s of %q generation %d", c.EventType, name, c.Generation)
+
+		// Records of the directories containing the object, or of their absence,
+		// may be out of date too.
+		br.eraseStat(name)
+		for i, r := range strings.TrimSuffix(name, "/") {
+			if r == '/' {
+				br.eraseStat(name[:i+1])
+			}
+		}
+
+		server.Invalidate(name)
+	}
+}
+
+// The IAM permissions consulted by restrictPerms.
+var iamPermissions = []string{
+	gcsx.PermissionObjectsGet,
+	gcsx.PermissionObjectsList,
+	gcsx.PermissionObjectsCreate,
+	gcsx.PermissionObjectsDelete,
+}
+
+// Clear the permission bits for files and directories that grant access the
+// given IAM permissions on the bucket don't allow. Reading files requires
+// storage.objects.get, and reading directories storage.objects.list. Creating
+// files in directories requires storage.objects.create, and writing files,
+// which replaces their objects, storage.objects.delete as well.
+//
+// Unlinking requires storage.objects.delete too, but a directory's write bits
+// cover both creating and unlinking, so it isn't reflected there.
+func restrictPerms(
+	granted []string,
+	filePerms os.FileMode,
+	dirPerms os.FileMode) (fileOut os.FileMode, dirOut os.FileMode) {
+	has := make(map[string]bool)
+	for _, p := range granted {
+		has[p] = true
+	}
+
+	fileOut = filePerms
+	dirOut = dirPerms
+
+	if !has[gcsx.PermissionObjectsGet] {
+		fileOut &^= 0444
+	}
+
+	if !has[gcsx.PermissionObjectsList] {
+		dirOut &^= 0444
+	}
+
+	if !has[gcsx.PermissionObjectsCreate] {
+		dirOut &^= 0222
+	}
+
+	if !has[gcsx.PermissionObjectsCreate] || !has[gcsx.PermissionObjectsDelete] {
+		fileOut &^= 0222
+	}
+
+	return
+}
+
+// Choose the owner ID to present for inodes, given the ID of the invoking
+// process, the value of --uid or --gid (negative if unset), and the
+// corresponding ID map. With a map, the flag's value is an ID inside the
+// mapped namespace, defaulting to its root.
+func chooseOwnerID(
+	mine uint32,
+	flag int64,
+	m IDMap) (id uint32, err error) {
+	if len(m) == 0 {
+		id = mine
+		if flag >= 0 {
+			id = uint32(flag)
+		}
+
+		return
+	}
+
+	var inside uint32
+	if flag >= 0 {
+		inside = uint32(flag)
+	}
+
+	id, err = m.Translate(inside)
+	return
+}
+
+// Return the mount options to use for the supplied mount point, dealing with
+// the case where it is not empty according to the policy. Mounting over a
+// non-empty directory hides its contents, which tends to surprise users, so by
+// default we refuse.
+//
+// Explicitly passing the "nonempty" option is taken to mean the user knows
+// what they are doing.
+func chooseMountOptions(
+	mountPoint string,
+	policy NonEmptyPolicy,
+	opts map[string]string,
+	status *log.Logger) (result map[string]string, err error) {
+	result = make(map[string]string)
+	for k, v := range opts {
+		result[k] = v
+	}
+
+	if _, ok := opts["nonempty"]; ok {
+		return
+	}
+
+	// Is the mount point empty?
+	d, err := os.Open(mountPoint)
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	_, err = d.Readdirnames(1)
+	d.Close()
+
+	switch {
+	case err == io.EOF:
+		err = nil
+		return
+
+	case err != nil:
+		err = fmt.Errorf("Readdirnames: %v", err)
+		return
+	}
+
+	switch policy {
+	case NonEmptyWarn:
+		status.Printf(
+			"WARNING: Mount point %s is not empty. Its contents will be hidden "+
+				"until the file system is unmounted.",
+			mountPoint)
+
+	case NonEmptyAllow:
+
+	default:
+		err = fmt.Errorf(
+			"Mount point %s is not empty, and mounting would hide its contents. "+
+				"Use --nonempty-mount-point=warn or =allow to mount anyway.",
+			mountPoint)
+		return
+	}
+
+	// fusermount on Linux refuses to mount over a non-empty directory unless
+	// asked to. osxfuse doesn't mind.
+	if runtime.GOOS == "linux" {
+		result["nonempty"] = ""
+	}
+
+	return
+}
+
+// Should the mount admit users other than the one mounting it? A mount
+// presenting files as owned by IDs in another user namespace is useless unless
+// the users of that namespace may access it, so ID maps imply this.
+func allowOther(flags *flagStorage) bool {
+	_, ok := flags.MountOptions["allow_other"]
+	return ok ||
+		flags.AllowOther ||
+		len(flags.UIDMap) != 0 ||
+		len(flags.GIDMap) != 0
+}
+
+// Return an error if the flags governing access to the file system contradict
+// each other. myUID, myGID, and groups describe the mounting user, and uid and
+// gid are the owners chosen for inodes.
+func checkPermissionFlags(
+	flags *flagStorage,
+	myUID uint32,
+	myGID uint32,
+	groups []int,
+	uid uint32,
+	gid uint32) (err error) {
+	// Without the kernel's checks, modes and owners mean nothing, so flags that
+	// set them for the sake of controlling access are in vain.
+	if !flags.DefaultPermissions {
+		var reason string
+		_, explicit := flags.MountOptions["default_permissions"]
+		switch {
+		case explicit:
+			reason = "-o default_permissions"
+		case allowOther(flags):
+			reason = "allow_other (from --allow-other, -o allow_other, " +
+				"--uid-map, or --gid-map), which would let every user do " +
+				"anything to every file"
+		case flags.ReflectIAMPermissions:
+			reason = "--reflect-iam-permissions"
+		case flags.PreservePosixMetadata:
+			reason = "--preserve-posix-metadata"
+		}
+
+		if reason != "" {
+			err = fmt.Errorf(
+				"--default-permissions=false contradicts %s. Keep the kernel's "+
+					"permission checks, or drop the latter.",
+				reason)
+		}
+
+		return
+	}
+
+	// Otherwise, without allow_other the mounting user is the only one
+	// admitted, so make sure the owners and modes let them in. Root may
+	// always enter.
+	if allowOther(flags) || myUID == 0 {
+		return
+	}
+
+	inGroup := gid == myGID
+	for _, g := range groups {
+		if uint32(g) == gid {
+			inGroup = true
+		}
+	}
+
+	var search os.FileMode
+	switch {
+	case uid == myUID:
+		search = flags.DirMode & 0100
+	case inGroup:
+		search = flags.DirMode & 0010
+	default:
+		search = flags.DirMode & 0001
+	}
+
+	if search == 0 {
+		err = fmt.Errorf(
+			"With --uid %d, --gid %d, and --dir-mode %o, you couldn't enter "+
+				"directories of the file system, and without allow_other nobody "+
+				"else may. Change the owners or mode, or pass --allow-other.",
+			uid,
+			gid,
+			flags.DirMode)
+
+		return
+	}
+
+	return
+}
+
+// The configuration file of fusermount on Linux.
+const fuseConfPath = "/etc/fuse.conf"
+
+// The names of the fusermount program for fuse 3 and fuse 2, in the order in
+// which package fuse looks for them.
+var fusermountNames = []string{"fusermount3", "fusermount"}
+
+// Return whether the fusermount that package fuse would find in the
+// directories of the supplied $PATH value supports the auto_unmount option,
+// which fuse 2 gained in 2.9.0. Older versions pass the option on to the
+// kernel, which rejects it and fails the mount.
+func fusermountSupportsAutoUnmount(pathList string) bool {
+	for _, name := range fusermountNames {
+		for _, dir := range filepath.SplitList(pathList) {
+			p := path.Join(dir, name)
+			fi, err := os.Stat(p)
+			if err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+				continue
+			}
+
+			output, err := exec.Command(p, "-V").CombinedOutput()
+			if err != nil {
+				return false
+			}
+
+			major, minor, ok := parseFusermountVersion(string(output))
+			return ok && (major > 2 || major == 2 && minor >= 9)
+		}
+	}
+
+	return false
+}
+
+// Parse the major and minor version from the output of "fusermount -V", which
+// looks like "fusermount3 version: 3.10.3".
+func parseFusermountVersion(output string) (major, minor int, ok bool) {
+	i := strings.Index(output, "version:")
+	if i < 0 {
+		return
+	}
+
+	fields := strings.Fields(output[i+len("version:"):])
+	if len(fields) == 0 {
+		return
+	}
+
+	parts := strings.Split(fields[0], ".")
+	if len(parts) < 2 {
+		return
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
 		return
 	}
 
+	ok = true
 	return
 }
+
+// Return an error if the supplied mount options include allow_other but
+// fusermount won't allow it, because the user with the given ID isn't root
+// and the fuse configuration file at the given path doesn't set
+// user_allow_other. Checking beforehand lets us say why the option is there.
+func checkAllowOther(
+	opts map[string]string,
+	uid int,
+	confPath string) (err error) {
+	if _, ok := opts["allow_other"]; !ok || uid == 0 {
+		return
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	contents, err := ioutil.ReadFile(confPath)
+	if err != nil && !os.IsNotExist(err) {
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+	}
+
+	err = nil
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.TrimSpace(line) == "user_allow_other" {
+			return
+		}
+	}
+
+	err = fmt.Errorf(
+		"Mounting with allow_other (from --allow-other or -o allow_other, or "+
+			"implied by --uid-map and --gid-map) "+
+			"requires root or user_allow_other in %s. Add that line, or mount "+
+			"without allow_other so that only you can access the file system.",
+		confPath)
+
+	return
+}
+
+// Where the SELinux file system is mounted on hosts that enable it.
+const selinuxFSPath = "/sys/fs/selinux"
+
+// The mount options that label a file system for SELinux, for confined
+// services that may access only files with particular types.
+var selinuxContextOptions = []string{"context", "fscontext", "rootcontext"}
+
+// Check the SELinux context options among the supplied mount options, if any,
+// which the kernel accepts only if SELinux is enabled, as shown by the
+// presence of the given path. Values containing commas, as MCS categories may,
+// are quoted as the kernel requires.
+func checkSELinuxOptions(
+	opts map[string]string,
+	selinuxfs string) (err error) {
+	var given []string
+	for _, name := range selinuxContextOptions {
+		if _, ok := opts[name]; ok {
+			given = append(given, name)
+		}
+	}
+
+	if len(given) == 0 {
+		return
+	}
+
+	if runtime.GOOS != "linux" {
+		err = fmt.Errorf("-o %s is supported only on Linux", given[0])
+		return
+	}
+
+	if _, statErr := os.Stat(selinuxfs); statErr != nil {
+		err = fmt.Errorf(
+			"-o %s requires SELinux, which isn't enabled on this host",
+			given[0])
+		return
+	}
+
+	// context applies one label to everything, so can't be combined with one
+	// for the file system as a whole.
+	_, context := opts["context"]
+	_, fscontext := opts["fscontext"]
+	if context && fscontext {
+		err = errors.New("-o context and -o fscontext are incompatible")
+		return
+	}
+
+	for _, name := range given {
+		v := strings.Trim(opts[name], `"`)
+
+		// A context is user:role:type, optionally followed by an MLS/MCS level
+		// that may itself contain colons.
+		parts := strings.SplitN(v, ":", 4)
+		if len(parts) < 3 ||
+			parts[0] == "" ||
+			parts[1] == "" ||
+			parts[2] == "" ||
+			(len(parts) == 4 && parts[3] == "") {
+			err = fmt.Errorf(
+				"-o %s: expected user:role:type[:level], got %q",
+				name,
+				v)
+			return
+		}
+
+		if strings.Contains(v, ",") {
+			v = `"` + v + `"`
+		}
+
+		opts[name] = v
+	}
+
+	return
+}
+
+// The mount options that only macFUSE understands, naming the volume and
+// giving it an icon in the Finder.
+var darwinOnlyOptions = []string{"volname", "volicon"}
+
+// Check the macOS-only options among the supplied mount options, if any, and
+// return the contents of the .icns file named by volicon. macFUSE implements
+// that option in its libfuse rather than its kernel extension, so the file
+// system serves the icon itself instead of passing the option along.
+func readVolumeIcon(opts map[string]string) (icon []byte, err error) {
+	for _, name := range darwinOnlyOptions {
+		if _, ok := opts[name]; ok && runtime.GOOS != "darwin" {
+			err = fmt.Errorf("-o %s is supported only on macOS", name)
+			return
+		}
+	}
+
+	p, ok := opts["volicon"]
+	if !ok {
+		return
+	}
+
+	// The daemon runs in the root directory.
+	if !path.IsAbs(p) {
+		err = fmt.Errorf("-o volicon: expected an absolute path, got %q", p)
+		return
+	}
+
+	icon, err = ioutil.ReadFile(p)
+	if err != nil {
+		err = fmt.Errorf("-o volicon: %v", err)
+		return
+	}
+
+	if len(icon) == 0 {
+		err = fmt.Errorf("-o volicon: %s is empty", p)
+		return
+	}
+
+	return
+}
+
+// Hints for failures to mount, keyed by part of the message of the error from
+// package fuse, which includes what fusermount says on stderr.
+var mountErrorHints = []struct {
+	substr string
+	hint   string
+}{
+	{
+		"nor fusermount found",
+		"Mounting requires fusermount3 (or fusermount) in $PATH. Install fuse3, " +
+			"or fuse on older systems.",
+	},
+	{
+		"user_allow_other",
+		"allow_other requires root or user_allow_other in " + fuseConfPath + ".",
+	},
+	{
+		"failed to open /dev/fuse",
+		"You need read and write access to /dev/fuse. On some systems this " +
+			"means joining the fuse group; in a container, pass the device in.",
+	},
+	{
+		"fuse device not found",
+		"The fuse kernel module isn't loaded. Try \"modprobe fuse\" as root.",
+	},
+	{
+		"no write access to mountpoint",
+		"The mount point must be writable by you unless you are root.",
+	},
+	{
+		"too many FUSE filesystems mounted",
+		"Raise mount_max in " + fuseConfPath + ", or unmount some file systems.",
+	},
+	{
+		"transport endpoint is not connected",
+		"The mount point belongs to a file system whose process has exited. " +
+			"Unmount it with \"fusermount3 -u\" (or \"fusermount -u\") first.",
+	},
+	{
+		"loadOSXFUSE",
+		"macFUSE's kernel extension couldn't be loaded. Allow it in System " +
+			"Settings under Privacy & Security, restart, and try again.",
+	},
+	{
+		"operation not permitted",
+		"The kernel refused to mount. In a container, mounting fuse file " +
+			"systems needs the SYS_ADMIN capability.",
+	},
+}
+
+// Add a hint to the supplied error from mounting saying what to do about it,
+// if we recognize it.
+func explainMountError(err error) error {
+	msg := strings.ToLower(err.Error())
+	for _, h := range mountErrorHints {
+		if strings.Contains(msg, strings.ToLower(h.substr)) {
+			return fmt.Errorf("%v\n\n%s", err, h.hint)
+		}
+	}
+
+	return err
+}
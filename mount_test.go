@@ -0,0 +1,427 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMount(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MountOptionsTest struct {
+	// A temporary directory to use as a mount point. Removed in TearDown.
+	dir string
+
+	opts map[string]string
+
+	statusBuf bytes.Buffer
+	status    *log.Logger
+}
+
+var _ SetUpInterface = &MountOptionsTest{}
+var _ TearDownInterface = &MountOptionsTest{}
+
+func init() { RegisterTestSuite(&MountOptionsTest{}) }
+
+func (t *MountOptionsTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.dir, err = ioutil.TempDir("", "mount_test")
+	AssertEq(nil, err)
+
+	t.opts = map[string]string{"ro": ""}
+	t.status = log.New(&t.statusBuf, "", 0)
+}
+
+func (t *MountOptionsTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+func (t *MountOptionsTest) makeNonEmpty() {
+	err := ioutil.WriteFile(path.Join(t.dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+}
+
+func (t *MountOptionsTest) choose(
+	policy NonEmptyPolicy) (result map[string]string, err error) {
+	result, err = chooseMountOptions(t.dir, policy, t.opts, t.status)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MountOptionsTest) Empty() {
+	policies := []NonEmptyPolicy{NonEmptyRefuse, NonEmptyWarn, NonEmptyAllow}
+	for _, p := range policies {
+		result, err := t.choose(p)
+		AssertEq(nil, err)
+		ExpectThat(result, DeepEquals(t.opts), "policy: %s", p)
+	}
+
+	ExpectEq("", t.statusBuf.String())
+}
+
+func (t *MountOptionsTest) NonEmpty_Refuse() {
+	t.makeNonEmpty()
+
+	_, err := t.choose(NonEmptyRefuse)
+	ExpectThat(err, Error(HasSubstr("not empty")))
+	ExpectThat(err, Error(HasSubstr(t.dir)))
+}
+
+func (t *MountOptionsTest) NonEmpty_Warn() {
+	t.makeNonEmpty()
+
+	result, err := t.choose(NonEmptyWarn)
+	AssertEq(nil, err)
+
+	ExpectEq("", result["ro"])
+	if runtime.GOOS == "linux" {
+		_, ok := result["nonempty"]
+		ExpectTrue(ok)
+	}
+
+	ExpectThat(t.statusBuf.String(), HasSubstr("WARNING"))
+	ExpectThat(t.statusBuf.String(), HasSubstr(t.dir))
+
+	// The caller's options should not have been modified.
+	ExpectThat(t.opts, DeepEquals(map[string]string{"ro": ""}))
+}
+
+func (t *MountOptionsTest) NonEmpty_Allow() {
+	t.makeNonEmpty()
+
+	result, err := t.choose(NonEmptyAllow)
+	AssertEq(nil, err)
+
+	ExpectEq("", result["ro"])
+	if runtime.GOOS == "linux" {
+		_, ok := result["nonempty"]
+		ExpectTrue(ok)
+	}
+
+	ExpectEq("", t.statusBuf.String())
+}
+
+func (t *MountOptionsTest) NonEmpty_ExplicitOption() {
+	t.makeNonEmpty()
+	t.opts["nonempty"] = ""
+
+	result, err := t.choose(NonEmptyRefuse)
+	AssertEq(nil, err)
+	ExpectThat(result, DeepEquals(t.opts))
+}
+
+func (t *MountOptionsTest) MountPointDoesntExist() {
+	_, err := chooseMountOptions(
+		path.Join(t.dir, "foo"),
+		NonEmptyAllow,
+		t.opts,
+		t.status)
+
+	ExpectThat(err, Error(HasSubstr("no such file")))
+}
+
+func (t *MountOptionsTest) AllowOther() {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	conf := path.Join(t.dir, "fuse.conf")
+	t.opts["allow_other"] = ""
+
+	// Root may always use it, and without the option there's nothing to check.
+	ExpectEq(nil, checkAllowOther(t.opts, 0, conf))
+	ExpectEq(nil, checkAllowOther(map[string]string{"ro": ""}, 1000, conf))
+
+	// Others need the configuration file to allow it.
+	ExpectThat(
+		checkAllowOther(t.opts, 1000, conf),
+		Error(HasSubstr("user_allow_other in "+conf)))
+
+	err := ioutil.WriteFile(conf, []byte("# user_allow_other\n"), 0644)
+	AssertEq(nil, err)
+	ExpectThat(
+		checkAllowOther(t.opts, 1000, conf),
+		Error(HasSubstr("user_allow_other")))
+
+	err = ioutil.WriteFile(
+		conf,
+		[]byte("mount_max = 10\nuser_allow_other\n"),
+		0644)
+
+	AssertEq(nil, err)
+	ExpectEq(nil, checkAllowOther(t.opts, 1000, conf))
+}
+
+func (t *MountOptionsTest) ParseFusermountVersion() {
+	testCases := []struct {
+		output string
+		major  int
+		minor  int
+		ok     bool
+	}{
+		{"fusermount version: 2.9.7\n", 2, 9, true},
+		{"fusermount3 version: 3.10.3\n", 3, 10, true},
+		{"fusermount version: 2.8\n", 2, 8, true},
+		{"fusermount version: 2\n", 0, 0, false},
+		{"fusermount: unknown option -V\n", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, tc := range testCases {
+		major, minor, ok := parseFusermountVersion(tc.output)
+		ExpectEq(tc.ok, ok, "output: %q", tc.output)
+		if tc.ok {
+			ExpectEq(tc.major, major, "output: %q", tc.output)
+			ExpectEq(tc.minor, minor, "output: %q", tc.output)
+		}
+	}
+}
+
+func (t *MountOptionsTest) FusermountSupportsAutoUnmount() {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	// Create a fake fusermount in a directory of its own, reporting the given
+	// version.
+	fake := func(dir string, name string, version string) string {
+		dir = path.Join(t.dir, dir)
+		err := os.MkdirAll(dir, 0700)
+		AssertEq(nil, err)
+
+		script := "#!/bin/sh\necho '" + name + " version: " + version + "'\n"
+		err = ioutil.WriteFile(path.Join(dir, name), []byte(script), 0700)
+		AssertEq(nil, err)
+		return dir
+	}
+
+	old := fake("old", "fusermount", "2.8.6")
+	current := fake("current", "fusermount", "2.9.9")
+	fuse3 := fake("fuse3", "fusermount3", "3.10.3")
+
+	ExpectFalse(fusermountSupportsAutoUnmount(""))
+	ExpectFalse(fusermountSupportsAutoUnmount(t.dir))
+	ExpectFalse(fusermountSupportsAutoUnmount(old))
+	ExpectTrue(fusermountSupportsAutoUnmount(current))
+
+	// The first in $PATH wins.
+	ExpectFalse(fusermountSupportsAutoUnmount(old + ":" + current))
+
+	// fusermount3 is preferred wherever it is.
+	ExpectTrue(fusermountSupportsAutoUnmount(old + ":" + fuse3))
+}
+
+func (t *MountOptionsTest) PermissionFlags() {
+	f := &flagStorage{
+		MountOptions:       make(map[string]string),
+		DirMode:            0750,
+		DefaultPermissions: true,
+	}
+
+	check := func() error {
+		return checkPermissionFlags(f, 1000, 1000, []int{1000, 27}, 1001, 27)
+	}
+
+	// Without allow_other, the mounting user must be able to enter
+	// directories, here by way of a supplementary group.
+	ExpectEq(nil, check())
+
+	f.DirMode = 0700
+	ExpectThat(check(), Error(HasSubstr("couldn't enter")))
+
+	ExpectEq(nil, checkPermissionFlags(f, 0, 0, nil, 1001, 27))
+	ExpectEq(nil, checkPermissionFlags(f, 1001, 1000, nil, 1001, 27))
+
+	f.AllowOther = true
+	ExpectEq(nil, check())
+
+	// Without the kernel's checks, allow_other admits anyone to do anything.
+	f.DefaultPermissions = false
+	ExpectThat(check(), Error(HasSubstr("contradicts allow_other")))
+
+	f.AllowOther = false
+	f.UIDMap = IDMap{{Inside: 0, Outside: 100000, Count: 65536}}
+	ExpectThat(check(), Error(HasSubstr("contradicts allow_other")))
+
+	f.UIDMap = nil
+	ExpectEq(nil, check())
+
+	f.MountOptions["default_permissions"] = ""
+	ExpectThat(check(), Error(HasSubstr("contradicts -o default_permissions")))
+
+	delete(f.MountOptions, "default_permissions")
+	f.ReflectIAMPermissions = true
+	ExpectThat(check(), Error(HasSubstr("--reflect-iam-permissions")))
+}
+
+func (t *MountOptionsTest) SELinuxOptions() {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	missing := path.Join(t.dir, "selinux")
+
+	// Without any context options, there's nothing to check.
+	ExpectEq(nil, checkSELinuxOptions(t.opts, missing))
+
+	// The kernel accepts them only with SELinux enabled.
+	t.opts["context"] = "system_u:object_r:httpd_sys_content_t:s0"
+	ExpectThat(
+		checkSELinuxOptions(t.opts, missing),
+		Error(HasSubstr("isn't enabled")))
+
+	AssertEq(nil, checkSELinuxOptions(t.opts, t.dir))
+	ExpectEq("system_u:object_r:httpd_sys_content_t:s0", t.opts["context"])
+
+	// Levels with several categories are quoted.
+	t.opts["context"] = "system_u:object_r:container_file_t:s0:c1,c2"
+	AssertEq(nil, checkSELinuxOptions(t.opts, t.dir))
+	ExpectEq(
+		`"system_u:object_r:container_file_t:s0:c1,c2"`,
+		t.opts["context"])
+
+	// Malformed contexts and incompatible combinations are rejected.
+	t.opts["rootcontext"] = "httpd_sys_content_t"
+	ExpectThat(
+		checkSELinuxOptions(t.opts, t.dir),
+		Error(HasSubstr("expected user:role:type")))
+
+	delete(t.opts, "rootcontext")
+	t.opts["fscontext"] = "system_u:object_r:fusefs_t:s0"
+	ExpectThat(
+		checkSELinuxOptions(t.opts, t.dir),
+		Error(HasSubstr("incompatible")))
+}
+
+func (t *MountOptionsTest) VolumeIcon() {
+	p := path.Join(t.dir, "bucket.icns")
+	err := ioutil.WriteFile(p, []byte("taco"), 0644)
+	AssertEq(nil, err)
+
+	// Without the option there's no icon.
+	icon, err := readVolumeIcon(t.opts)
+	AssertEq(nil, err)
+	ExpectEq(nil, icon)
+
+	// Elsewhere than macOS the options are rejected.
+	t.opts["volicon"] = p
+	icon, err = readVolumeIcon(t.opts)
+	if runtime.GOOS != "darwin" {
+		ExpectThat(err, Error(HasSubstr("only on macOS")))
+
+		delete(t.opts, "volicon")
+		t.opts["volname"] = "taco"
+		_, err = readVolumeIcon(t.opts)
+		ExpectThat(err, Error(HasSubstr("only on macOS")))
+		return
+	}
+
+	AssertEq(nil, err)
+	ExpectEq("taco", string(icon))
+
+	// The path must be absolute, and the file must exist.
+	t.opts["volicon"] = "bucket.icns"
+	_, err = readVolumeIcon(t.opts)
+	ExpectThat(err, Error(HasSubstr("absolute")))
+
+	t.opts["volicon"] = path.Join(t.dir, "missing.icns")
+	_, err = readVolumeIcon(t.opts)
+	ExpectThat(err, Error(HasSubstr("no such file")))
+}
+
+func (t *MountOptionsTest) ExplainMountError() {
+	err := explainMountError(errors.New(
+		"mount: running /bin/fusermount3: exit status 1\n\nstderr:\n" +
+			"fusermount3: failed to open /dev/fuse: Permission denied\n"))
+
+	ExpectThat(err, Error(HasSubstr("Permission denied")))
+	ExpectThat(err, Error(HasSubstr("access to /dev/fuse")))
+
+	err = explainMountError(errors.New(
+		"Open: open /mnt/foo: transport endpoint is not connected"))
+
+	ExpectThat(err, Error(HasSubstr("fusermount3 -u")))
+
+	err = explainMountError(errors.New(
+		"Mount: mount: loadOSXFUSE: exit status 1"))
+
+	ExpectThat(err, Error(HasSubstr("Privacy & Security")))
+
+	err = explainMountError(errors.New("taco"))
+	ExpectThat(err, Error(Equals("taco")))
+}
+
+////////////////////////////////////////////////////////////////////////
+// restrictPerms
+////////////////////////////////////////////////////////////////////////
+
+type RestrictPermsTest struct {
+}
+
+func init() { RegisterTestSuite(&RestrictPermsTest{}) }
+
+func (t *RestrictPermsTest) AllGranted() {
+	file, dir := restrictPerms(iamPermissions, 0644, 0755)
+	ExpectEq(os.FileMode(0644), file)
+	ExpectEq(os.FileMode(0755), dir)
+}
+
+func (t *RestrictPermsTest) ReadOnly() {
+	file, dir := restrictPerms(
+		[]string{"storage.objects.get", "storage.objects.list"},
+		0664,
+		0775)
+
+	ExpectEq(os.FileMode(0444), file)
+	ExpectEq(os.FileMode(0555), dir)
+}
+
+func (t *RestrictPermsTest) CreateWithoutDelete() {
+	file, dir := restrictPerms(
+		[]string{
+			"storage.objects.get",
+			"storage.objects.list",
+			"storage.objects.create",
+		},
+		0644,
+		0755)
+
+	ExpectEq(os.FileMode(0444), file)
+	ExpectEq(os.FileMode(0755), dir)
+}
+
+func (t *RestrictPermsTest) NoneGranted() {
+	file, dir := restrictPerms(nil, 0644, 0755)
+	ExpectEq(os.FileMode(0), file)
+	ExpectEq(os.FileMode(0111), dir)
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// The fields of flagStorage that take effect when reloaded, without
+// remounting.
+var reloadableFields = map[string]bool{
+	"LogFormat":                          true,
+	"LogSeverity":                        true,
+	"StatCacheTTL":                       true,
+	"StatCacheCapacity":                  true,
+	"StatCacheMaxSizeMB":                 true,
+	"NegativeStatCacheTTL":               true,
+	"NegativeStatCacheCapacity":          true,
+	"TypeCacheTTL":                       true,
+	"KernelListCacheTTL":                 true,
+	"OpRateLimitHz":                      true,
+	"EgressBandwidthLimitBytesPerSecond": true,
+}
+
+// Parse the supplied command line again, re-reading any config file it names.
+func reparseFlags(args []string) (flags *flagStorage, err error) {
+	app := newApp()
+	app.Action = func(c *cli.Context) {
+		flags, err = populateFlags(c)
+	}
+
+	if runErr := app.Run(args); runErr != nil {
+		err = runErr
+		return
+	}
+
+	if err == nil && flags == nil {
+		err = errors.New("The command line no longer mounts a file system.")
+		return
+	}
+
+	return
+}
+
+// Return the names of the fields that differ between a and b, excluding those
+// that can be reloaded.
+func fixedFieldsChanged(a *flagStorage, b *flagStorage) (names []string) {
+	va := reflect.ValueOf(a).Elem()
+	vb := reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Name
+		if reloadableFields[name] {
+			continue
+		}
+
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			names = append(names, name)
+		}
+	}
+
+	return
+}
+
+// A reloader applies changes to the settings of a mounted file system that
+// don't require remounting: logging, cache TTLs and capacity, and rate limits.
+type reloader struct {
+	// The flags with which the file system was mounted.
+	flags *flagStorage
+
+	bucket *bucketReloader
+	server fs.Server
+}
+
+// Apply the reloadable settings in the supplied flags. Others are ignored,
+// returning the names of their fields if they differ from those with which the
+// file system was mounted.
+//
+// Not safe for concurrent calls.
+func (r *reloader) reload(flags *flagStorage) (ignored []string, err error) {
+	err = r.bucket.reload(flags)
+	if err != nil {
+		err = fmt.Errorf("reloading bucket: %v", err)
+		return
+	}
+
+	r.server.SetCacheTTLs(fs.CacheTTLs{
+		InodeAttributeCacheTTL: flags.StatCacheTTL,
+		DirTypeCacheTTL:        flags.TypeCacheTTL,
+		KernelListCacheTTL:     flags.KernelListCacheTTL,
+	})
+
+	initLogging(flags)
+
+	ignored = fixedFieldsChanged(r.flags, flags)
+
+	return
+}
+
+// Re-read the supplied command line, along with any config file it names, in
+// response to SIGHUP, applying the settings that can be changed while mounted.
+// A command line or config file that no longer parses is reported and
+// otherwise ignored.
+func registerSIGHUPHandler(args []string, r *reloader) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+
+	go func() {
+		for range signalChan {
+			logger.Infof("Received SIGHUP, reloading settings...")
+
+			flags, err := reparseFlags(args)
+			if err != nil {
+				logger.Errorf("Not reloading settings: %v", err)
+				continue
+			}
+
+			ignored, err := r.reload(flags)
+			if err != nil {
+				logger.Errorf("Reloading settings: %v", err)
+				continue
+			}
+
+			if len(ignored) != 0 {
+				logger.Warningf(
+					"Changes to %v take effect only when remounted.",
+					ignored)
+			}
+
+			logger.Infof("Reloaded settings.")
+		}
+	}()
+}
@@ -0,0 +1,228 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestReload(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A fs.Server that records the cache TTLs it's given.
+type ttlServer struct {
+	fs.Server
+	ttls fs.CacheTTLs
+}
+
+func (s *ttlServer) SetCacheTTLs(ttls fs.CacheTTLs) {
+	s.ttls = ttls
+}
+
+type ReloadTest struct {
+	ctx context.Context
+
+	// A temporary directory holding the config file. Removed in TearDown.
+	dir        string
+	configFile string
+
+	// The bucket beneath the reloadable layers.
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+
+	flags  *flagStorage
+	server ttlServer
+	r      *reloader
+}
+
+var _ SetUpInterface = &ReloadTest{}
+var _ TearDownInterface = &ReloadTest{}
+
+func init() { RegisterTestSuite(&ReloadTest{}) }
+
+func (t *ReloadTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.dir, err = ioutil.TempDir("", "reload_test")
+	AssertEq(nil, err)
+
+	t.configFile = path.Join(t.dir, "gcsfuse.yaml")
+	t.writeConfig("stat-cache-ttl: 1h\n")
+
+	t.flags, err = reparseFlags(t.args())
+	AssertEq(nil, err)
+
+	// Set up reloadable layers as setUpBucket does.
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	br := &bucketReloader{
+		unlimited: t.wrapped,
+		limited:   gcsx.NewReloadableBucket(t.wrapped),
+		uncached:  t.wrapped,
+	}
+
+	cached, cache := setUpStatCache(t.wrapped, t.flags)
+	br.cached = gcsx.NewReloadableBucket(cached)
+	br.noteStatCache(t.flags, cache)
+
+	t.bucket = br.cached
+	t.r = &reloader{
+		flags:  t.flags,
+		bucket: br,
+		server: &t.server,
+	}
+}
+
+func (t *ReloadTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+func (t *ReloadTest) args() []string {
+	return []string{"some_app", "--config-file", t.configFile}
+}
+
+func (t *ReloadTest) writeConfig(contents string) {
+	err := ioutil.WriteFile(t.configFile, []byte(contents), 0600)
+	AssertEq(nil, err)
+}
+
+// Reload the settings from the config file, returning the ignored changes.
+func (t *ReloadTest) reload() (ignored []string) {
+	flags, err := reparseFlags(t.args())
+	AssertEq(nil, err)
+
+	ignored, err = t.r.reload(flags)
+	AssertEq(nil, err)
+
+	return
+}
+
+// Create an object, then delete it beneath the stat cache after statting it
+// through the cache.
+func (t *ReloadTest) createAndDeleteBehindCache(name string) {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+
+	err = t.wrapped.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	AssertEq(nil, err)
+}
+
+// Is the named object still in the stat cache?
+func (t *ReloadTest) cached(name string) bool {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	return err == nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReloadTest) ReparseRereadsConfigFile() {
+	ExpectEq(time.Hour, t.flags.StatCacheTTL)
+
+	t.writeConfig("stat-cache-ttl: 10s\n")
+	flags, err := reparseFlags(t.args())
+	AssertEq(nil, err)
+	ExpectEq(10*time.Second, flags.StatCacheTTL)
+
+	t.writeConfig("stat-cache-ttl: soon\n")
+	_, err = reparseFlags(t.args())
+	ExpectThat(err, Error(HasSubstr("stat-cache-ttl")))
+}
+
+func (t *ReloadTest) CacheTTLs() {
+	t.writeConfig(
+		"stat-cache-ttl: 1h\ntype-cache-ttl: 2m\nkernel-list-cache-ttl: 3s\n")
+
+	ignored := t.reload()
+	ExpectEq(0, len(ignored))
+
+	ExpectEq(time.Hour, t.server.ttls.InodeAttributeCacheTTL)
+	ExpectEq(2*time.Minute, t.server.ttls.DirTypeCacheTTL)
+	ExpectEq(3*time.Second, t.server.ttls.KernelListCacheTTL)
+}
+
+func (t *ReloadTest) StatCacheKeptWhenUnchanged() {
+	t.createAndDeleteBehindCache("foo")
+	AssertTrue(t.cached("foo"))
+
+	t.writeConfig("stat-cache-ttl: 1h\nlimit-ops-per-sec: 100\n")
+	t.reload()
+	ExpectTrue(t.cached("foo"))
+}
+
+func (t *ReloadTest) StatCacheReplacedWhenChanged() {
+	t.createAndDeleteBehindCache("foo")
+	AssertTrue(t.cached("foo"))
+
+	t.writeConfig("stat-cache-ttl: 1h\nstat-cache-capacity: 17\n")
+	t.reload()
+	ExpectFalse(t.cached("foo"))
+
+	// Disabling the cache works too.
+	t.createAndDeleteBehindCache("bar")
+	t.writeConfig("stat-cache-ttl: 0s\n")
+	t.reload()
+	ExpectFalse(t.cached("bar"))
+}
+
+func (t *ReloadTest) NegativeStatCacheReplacedWhenChanged() {
+	// Remember that "foo" doesn't exist, then create it behind the cache.
+	AssertFalse(t.cached("foo"))
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+	AssertFalse(t.cached("foo"))
+
+	t.writeConfig("stat-cache-ttl: 1h\nnegative-stat-cache-ttl: 5s\n")
+	t.reload()
+	ExpectTrue(t.cached("foo"))
+}
+
+func (t *ReloadTest) OtherChangesAreIgnored() {
+	t.writeConfig("stat-cache-ttl: 1h\nimplicit-dirs: true\nonly-dir: foo\n")
+
+	ignored := t.reload()
+	ExpectThat(ignored, ElementsAre("ImplicitDirs", "OnlyDir"))
+
+	// They are reported until undone, since they never take effect.
+	ignored = t.reload()
+	ExpectThat(ignored, ElementsAre("ImplicitDirs", "OnlyDir"))
+
+	t.writeConfig("stat-cache-ttl: 1h\n")
+	ignored = t.reload()
+	ExpectEq(0, len(ignored))
+}
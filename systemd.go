@@ -0,0 +1,421 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/mount"
+)
+
+// `gcsfuse systemd-unit` writes a systemd mount unit, and optionally an
+// automount unit, that mounts a bucket through mount.gcsfuse with the gcsfuse
+// flags given to it, translated into mount options.
+
+const mountingDocURL = "https://github.com/GoogleCloudPlatform/gcsfuse/" +
+	"blob/master/docs/mounting.md"
+
+// Flags naming files or directories, whose values are made absolute and whose
+// mounts the unit requires.
+var unitPathFlags = map[string]bool{
+	"key-file":            true,
+	"config-file":         true,
+	"encryption-key-file": true,
+	"mapping-file":        true,
+	"temp-dir":            true,
+	"offline-queue-dir":   true,
+	"write-journal-dir":   true,
+	"file-cache-dir":      true,
+	"range-cache-dir":     true,
+	"debug_record_http":   true,
+}
+
+// A description of the units to write.
+type systemdUnit struct {
+	Bucket     string
+	MountPoint string
+
+	// Mount options, including those standing for gcsfuse flags.
+	Options []string
+
+	// Paths on which the mount depends, such as that of a key file.
+	RequiredPaths []string
+
+	// Whether to write an automount unit, and if so how long the file system
+	// may go unused before it's unmounted. Zero means never.
+	Automount   bool
+	IdleTimeout time.Duration
+}
+
+// Escape the supplied absolute path as `systemd-escape --path` does, giving
+// the name of the units that mount there without their suffixes.
+func systemdEscapePath(p string) string {
+	p = strings.Trim(path.Clean(p), "/")
+	if p == "" {
+		return "-"
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+
+		case c == '.' && i == 0,
+			!(c >= 'a' && c <= 'z' ||
+				c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' ||
+				c == ':' || c == '_' || c == '.'):
+			fmt.Fprintf(&b, `\x%02x`, c)
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Escape the percent signs that systemd would otherwise take to begin
+// specifiers in the values of unit settings.
+func escapeSpecifiers(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
+}
+
+// Quote a path for a setting taking a space-separated list, if necessary.
+func quoteUnitPath(p string) string {
+	if strings.ContainsAny(p, " \t\"\\") {
+		return fmt.Sprintf("%q", p)
+	}
+
+	return p
+}
+
+// The [Unit] section shared by the mount and automount units: both need the
+// network, so they are started after it's up and, since systemd stops units
+// in the reverse order, stopped before it goes down.
+func writeUnitSection(w io.Writer, description string) {
+	fmt.Fprintf(w, "[Unit]\n")
+	fmt.Fprintf(w, "Description=%s\n", escapeSpecifiers(description))
+	fmt.Fprintf(w, "Documentation=%s\n", mountingDocURL)
+	fmt.Fprintf(w, "Wants=network-online.target\n")
+	fmt.Fprintf(w, "After=network-online.target\n")
+	fmt.Fprintf(w, "Before=remote-fs.target\n")
+}
+
+// Write the mount unit for the supplied description.
+func (u *systemdUnit) writeMount(w io.Writer) {
+	writeUnitSection(
+		w,
+		fmt.Sprintf("gcsfuse mount of %s at %s", u.Bucket, u.MountPoint))
+
+	if len(u.RequiredPaths) != 0 {
+		var quoted []string
+		for _, p := range u.RequiredPaths {
+			quoted = append(quoted, quoteUnitPath(escapeSpecifiers(p)))
+		}
+
+		fmt.Fprintf(w, "RequiresMountsFor=%s\n", strings.Join(quoted, " "))
+	}
+
+	// _netdev tells systemd that this is a network file system, which it
+	// would otherwise guess only from the type.
+	options := append([]string{"_netdev"}, u.Options...)
+
+	fmt.Fprintf(w, "\n[Mount]\n")
+	fmt.Fprintf(w, "What=%s\n", escapeSpecifiers(u.Bucket))
+	fmt.Fprintf(w, "Where=%s\n", escapeSpecifiers(u.MountPoint))
+	fmt.Fprintf(w, "Type=gcsfuse\n")
+	fmt.Fprintf(w, "Options=%s\n", escapeSpecifiers(strings.Join(options, ",")))
+
+	// An automounted file system is started by its automount unit instead.
+	if !u.Automount {
+		fmt.Fprintf(w, "\n[Install]\n")
+		fmt.Fprintf(w, "WantedBy=remote-fs.target\n")
+	}
+}
+
+// Write the automount unit for the supplied description.
+func (u *systemdUnit) writeAutomount(w io.Writer) {
+	writeUnitSection(
+		w,
+		fmt.Sprintf("gcsfuse automount of %s at %s", u.Bucket, u.MountPoint))
+
+	fmt.Fprintf(w, "\n[Automount]\n")
+	fmt.Fprintf(w, "Where=%s\n", escapeSpecifiers(u.MountPoint))
+	if u.IdleTimeout > 0 {
+		fmt.Fprintf(
+			w,
+			"TimeoutIdleSec=%d\n",
+			int64(math.Ceil(u.IdleTimeout.Seconds())))
+	}
+
+	fmt.Fprintf(w, "\n[Install]\n")
+	fmt.Fprintf(w, "WantedBy=remote-fs.target\n")
+}
+
+// Translate the gcsfuse flags set in the supplied context into mount options
+// for mount.gcsfuse, and find the paths they depend on.
+func unitOptions(
+	c *cli.Context,
+	gcsfuseFlags []cli.Flag) (options []string, paths []string, err error) {
+	for _, f := range gcsfuseFlags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if !c.IsSet(name) {
+			continue
+		}
+
+		switch name {
+		// mount(8) waits for gcsfuse to mount and then go into the background.
+		case "foreground":
+			err = errors.New(
+				"--foreground can't be used, since mount.gcsfuse runs gcsfuse in " +
+					"the background")
+			return
+
+		// Units can be read by any user.
+		case "encryption-key":
+			err = errors.New(
+				"--encryption-key can't be used, since the unit would show the key " +
+					"to all users; use --encryption-key-file")
+			return
+
+		// Mount options are passed through as they are.
+		case "o":
+			options = append(options, c.StringSlice("o")...)
+			continue
+
+		// gcsfuse treats the kernel's option as the flag.
+		case "allow-other":
+			if c.Bool(name) {
+				options = append(options, "allow_other")
+			}
+
+			continue
+		}
+
+		// Flags without options of their own are set through the generic one.
+		option, ok := mount.FlagOption(name)
+		if !ok {
+			option = mount.FlagOptionPrefix + name
+		}
+
+		// The values to give the option. A bool flag's option has none.
+		var values []string
+		switch f.(type) {
+		case cli.BoolFlag:
+			if c.Bool(name) {
+				values = []string{""}
+			}
+
+		case cli.BoolTFlag:
+			if !c.BoolT(name) {
+				values = []string{"false"}
+			}
+
+		// Repeated flags become repeated options. A config file may set the flag
+		// to an empty list, giving none.
+		case cli.StringSliceFlag:
+			values = c.StringSlice(name)
+
+		default:
+			// An empty value, such as that of --prefetch-metadata=false, is the
+			// same as not giving the flag.
+			if v := c.Generic(name).(flag.Value).String(); v != "" {
+				values = []string{v}
+			}
+		}
+
+		for _, value := range values {
+			if unitPathFlags[name] {
+				value, err = filepath.Abs(value)
+				if err != nil {
+					err = fmt.Errorf("canonicalizing --%s: %v", name, err)
+					return
+				}
+
+				paths = append(paths, value)
+			}
+
+			// mount.gcsfuse would otherwise expand environment variables.
+			value = strings.Replace(value, "$", "$$", -1)
+
+			switch {
+			case value == "":
+				options = append(options, option)
+
+			// mount(8) would otherwise split the value at commas.
+			case strings.Contains(value, ","):
+				options = append(options, fmt.Sprintf("%s=\"%s\"", option, value))
+
+			default:
+				options = append(options, option+"="+value)
+			}
+		}
+	}
+
+	return
+}
+
+// Write the units for the supplied description to files in the given
+// directory, or to stdout if it's empty, returning the names of the units.
+func writeSystemdUnits(
+	u *systemdUnit,
+	dir string,
+	stdout io.Writer) (names []string, err error) {
+	base := systemdEscapePath(u.MountPoint)
+
+	var mountUnit bytes.Buffer
+	u.writeMount(&mountUnit)
+
+	if dir == "" {
+		if u.Automount {
+			err = errors.New(
+				"--automount writes two units, so requires --output-dir")
+			return
+		}
+
+		_, err = stdout.Write(mountUnit.Bytes())
+		names = []string{base + ".mount"}
+		return
+	}
+
+	files := map[string][]byte{base + ".mount": mountUnit.Bytes()}
+	names = []string{base + ".mount"}
+
+	if u.Automount {
+		var automountUnit bytes.Buffer
+		u.writeAutomount(&automountUnit)
+		files[base+".automount"] = automountUnit.Bytes()
+		names = append(names, base+".automount")
+	}
+
+	for _, name := range names {
+		err = ioutil.WriteFile(filepath.Join(dir, name), files[name], 0644)
+		if err != nil {
+			err = fmt.Errorf("WriteFile: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// A command that writes systemd units mounting a bucket with the gcsfuse
+// flags given to it.
+func newSystemdUnitCommand(appFlags []cli.Flag) cli.Command {
+	// The command adds its own help flag.
+	var gcsfuseFlags []cli.Flag
+	for _, f := range appFlags {
+		if f.GetName() != cli.HelpFlag.GetName() {
+			gcsfuseFlags = append(gcsfuseFlags, f)
+		}
+	}
+
+	flags := append([]cli.Flag{
+		cli.BoolFlag{
+			Name: "automount",
+			Usage: "Also write an automount unit, mounting the bucket when the " +
+				"mount point is first used rather than at boot. Requires " +
+				"--output-dir.",
+		},
+
+		cli.DurationFlag{
+			Name: "idle-timeout",
+			Usage: "With --automount, unmount after the file system has gone " +
+				"unused this long. Zero means never.",
+		},
+
+		cli.StringFlag{
+			Name: "output-dir",
+			Usage: "Write the units to files in this directory, such as " +
+				"/etc/systemd/system, rather than to stdout.",
+		},
+	}, gcsfuseFlags...)
+
+	return cli.Command{
+		Name:      "systemd-unit",
+		Usage:     "Write a systemd mount unit for a bucket, given gcsfuse flags",
+		ArgsUsage: "bucket mount_point [flags]",
+		Flags:     flags,
+		Action: func(c *cli.Context) (err error) {
+			if len(c.Args()) != 2 {
+				err = errors.New(
+					"systemd-unit takes exactly two arguments, the bucket and the " +
+						"mount point.")
+				return
+			}
+
+			u := &systemdUnit{
+				Bucket:      c.Args()[0],
+				Automount:   c.Bool("automount"),
+				IdleTimeout: c.Duration("idle-timeout"),
+			}
+
+			u.MountPoint, err = filepath.Abs(c.Args()[1])
+			if err != nil {
+				err = fmt.Errorf("canonicalizing mount point: %v", err)
+				return
+			}
+
+			if u.IdleTimeout != 0 && !u.Automount {
+				err = errors.New("--idle-timeout requires --automount")
+				return
+			}
+
+			u.Options, u.RequiredPaths, err = unitOptions(c, gcsfuseFlags)
+			if err != nil {
+				return
+			}
+
+			// Check the flags as gcsfuse would when mounting.
+			_, err = populateFlags(c)
+			if err != nil {
+				err = fmt.Errorf("populateFlags: %v", err)
+				return
+			}
+
+			dir := c.String("output-dir")
+			names, err := writeSystemdUnits(u, dir, os.Stdout)
+			if err != nil {
+				return
+			}
+
+			if dir != "" {
+				fmt.Fprintf(
+					os.Stderr,
+					"Wrote %s. Run `systemctl daemon-reload` and then "+
+						"`systemctl enable --now %s`.\n",
+					strings.Join(names, " and "),
+					names[len(names)-1])
+			}
+
+			return
+		},
+	}
+}
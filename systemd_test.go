@@ -0,0 +1,338 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SystemdUnitTest struct {
+	dir string
+}
+
+func init() { RegisterTestSuite(&SystemdUnitTest{}) }
+
+func (t *SystemdUnitTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "systemd_unit_test")
+	AssertEq(nil, err)
+}
+
+func (t *SystemdUnitTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Run `gcsfuse systemd-unit` with the supplied arguments, writing units to
+// t.dir.
+func (t *SystemdUnitTest) run(args ...string) (err error) {
+	app := newApp()
+	fullArgs := append(
+		[]string{"some_app", "systemd-unit", "--output-dir", t.dir},
+		args...)
+
+	err = app.Run(fullArgs)
+	return
+}
+
+// Return the contents of the unit with the given name in t.dir.
+func (t *SystemdUnitTest) readUnit(name string) string {
+	contents, err := ioutil.ReadFile(path.Join(t.dir, name))
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+// Return the lines of the supplied unit that set the given setting.
+func unitSettings(unit string, key string) (values []string) {
+	for _, line := range strings.Split(unit, "\n") {
+		if strings.HasPrefix(line, key+"=") {
+			values = append(values, strings.TrimPrefix(line, key+"="))
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SystemdUnitTest) EscapePath() {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/", "-"},
+		{"/mnt/gcs", "mnt-gcs"},
+		{"/mnt/gcs/", "mnt-gcs"},
+		{"/mnt//my-bucket", `mnt-my\x2dbucket`},
+		{"/mnt/my bucket", `mnt-my\x20bucket`},
+		{"/.hidden/a.b", `\x2ehidden-a.b`},
+		{"/mnt/a_b:c", "mnt-a_b:c"},
+	}
+
+	for _, tc := range testCases {
+		ExpectEq(tc.expected, systemdEscapePath(tc.path), "path: %q", tc.path)
+	}
+}
+
+func (t *SystemdUnitTest) MountUnit() {
+	u := &systemdUnit{
+		Bucket:        "some-bucket",
+		MountPoint:    "/mnt/100% gcs",
+		Options:       []string{"implicit_dirs", "uid=1000"},
+		RequiredPaths: []string{"/etc/gcs/key.json", "/var/tmp/a b"},
+	}
+
+	var buf bytes.Buffer
+	u.writeMount(&buf)
+	unit := buf.String()
+
+	ExpectThat(
+		unitSettings(unit, "After"),
+		ElementsAre("network-online.target"))
+
+	ExpectThat(
+		unitSettings(unit, "Wants"),
+		ElementsAre("network-online.target"))
+
+	ExpectThat(
+		unitSettings(unit, "RequiresMountsFor"),
+		ElementsAre(`/etc/gcs/key.json "/var/tmp/a b"`))
+
+	ExpectThat(unitSettings(unit, "What"), ElementsAre("some-bucket"))
+	ExpectThat(unitSettings(unit, "Where"), ElementsAre("/mnt/100%% gcs"))
+	ExpectThat(unitSettings(unit, "Type"), ElementsAre("gcsfuse"))
+	ExpectThat(
+		unitSettings(unit, "Options"),
+		ElementsAre("_netdev,implicit_dirs,uid=1000"))
+
+	ExpectThat(
+		unitSettings(unit, "WantedBy"),
+		ElementsAre("remote-fs.target"))
+}
+
+func (t *SystemdUnitTest) AutomountUnit() {
+	u := &systemdUnit{
+		Bucket:      "some-bucket",
+		MountPoint:  "/mnt/gcs",
+		Automount:   true,
+		IdleTimeout: 90500 * time.Millisecond,
+	}
+
+	var buf bytes.Buffer
+	u.writeMount(&buf)
+	ExpectThat(unitSettings(buf.String(), "WantedBy"), ElementsAre())
+
+	buf.Reset()
+	u.writeAutomount(&buf)
+	unit := buf.String()
+
+	ExpectThat(
+		unitSettings(unit, "After"),
+		ElementsAre("network-online.target"))
+
+	ExpectThat(unitSettings(unit, "Where"), ElementsAre("/mnt/gcs"))
+	ExpectThat(unitSettings(unit, "TimeoutIdleSec"), ElementsAre("91"))
+	ExpectThat(
+		unitSettings(unit, "WantedBy"),
+		ElementsAre("remote-fs.target"))
+}
+
+func (t *SystemdUnitTest) Stdout() {
+	u := &systemdUnit{
+		Bucket:     "some-bucket",
+		MountPoint: "/mnt/gcs",
+	}
+
+	var buf bytes.Buffer
+	names, err := writeSystemdUnits(u, "", &buf)
+
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("mnt-gcs.mount"))
+	ExpectThat(unitSettings(buf.String(), "Where"), ElementsAre("/mnt/gcs"))
+
+	// An automount needs two units, which don't fit on stdout.
+	u.Automount = true
+	_, err = writeSystemdUnits(u, "", &buf)
+	ExpectThat(err, Error(HasSubstr("--output-dir")))
+}
+
+func (t *SystemdUnitTest) FlagsToOptions() {
+	err := t.run(
+		"--implicit-dirs",
+		"--default-permissions=false",
+		"--uid", "1000",
+		"--stat-cache-ttl", "1h",
+		"--file-rules", "*.bin:no-cache",
+		"--exclude", "a,b",
+		"--billing-project", "$taco",
+		"--prefetch-metadata=false",
+		"-o", "ro",
+		"some-bucket",
+		"/mnt/gcs")
+
+	AssertEq(nil, err)
+
+	unit := t.readUnit("mnt-gcs.mount")
+	ExpectThat(unitSettings(unit, "What"), ElementsAre("some-bucket"))
+	ExpectThat(
+		unitSettings(unit, "Options"),
+		ElementsAre(
+			"_netdev,ro,uid=1000,default_permissions=false,implicit_dirs,"+
+				`exclude="a,b",file_rules=*.bin:no-cache,billing_project=$$taco,`+
+				"stat_cache_ttl=1h0m0s"))
+
+	ExpectThat(unitSettings(unit, "RequiresMountsFor"), ElementsAre())
+
+	_, err = os.Stat(path.Join(t.dir, "mnt-gcs.automount"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *SystemdUnitTest) PathFlags() {
+	wd, err := os.Getwd()
+	AssertEq(nil, err)
+
+	err = t.run(
+		"--key-file", "key.json",
+		"--temp-dir", "/var/tmp/gcsfuse",
+		"some-bucket",
+		"mnt")
+
+	AssertEq(nil, err)
+
+	mountPoint := path.Join(wd, "mnt")
+	unit := t.readUnit(systemdEscapePath(mountPoint) + ".mount")
+
+	ExpectThat(unitSettings(unit, "Where"), ElementsAre(mountPoint))
+	ExpectThat(
+		unitSettings(unit, "Options"),
+		ElementsAre(
+			"_netdev,key_file="+path.Join(wd, "key.json")+
+				",temp_dir=/var/tmp/gcsfuse"))
+
+	ExpectThat(
+		unitSettings(unit, "RequiresMountsFor"),
+		ElementsAre(path.Join(wd, "key.json")+" /var/tmp/gcsfuse"))
+}
+
+func (t *SystemdUnitTest) Automount() {
+	err := t.run(
+		"--automount",
+		"--idle-timeout", "10m",
+		"some-bucket",
+		"/mnt/gcs")
+
+	AssertEq(nil, err)
+
+	unit := t.readUnit("mnt-gcs.mount")
+	ExpectThat(unitSettings(unit, "WantedBy"), ElementsAre())
+
+	unit = t.readUnit("mnt-gcs.automount")
+	ExpectThat(unitSettings(unit, "Where"), ElementsAre("/mnt/gcs"))
+	ExpectThat(unitSettings(unit, "TimeoutIdleSec"), ElementsAre("600"))
+}
+
+func (t *SystemdUnitTest) IdleTimeoutWithoutAutomount() {
+	err := t.run("--idle-timeout", "10m", "some-bucket", "/mnt/gcs")
+	ExpectThat(err, Error(HasSubstr("requires --automount")))
+}
+
+func (t *SystemdUnitTest) Foreground() {
+	err := t.run("--foreground", "some-bucket", "/mnt/gcs")
+	ExpectThat(err, Error(HasSubstr("--foreground")))
+}
+
+func (t *SystemdUnitTest) OtherFlags() {
+	err := t.run(
+		"--allow-other",
+		"--force-unmount",
+		"--retryable-codes", "429,503",
+		"--debug_addr", "localhost:8000",
+		"some-bucket",
+		"/mnt/gcs")
+
+	AssertEq(nil, err)
+
+	unit := t.readUnit("mnt-gcs.mount")
+	ExpectThat(
+		unitSettings(unit, "Options"),
+		ElementsAre(
+			"_netdev,force_unmount,allow_other,"+
+				`retryable_codes="429,503",debug_addr=localhost:8000`))
+}
+
+func (t *SystemdUnitTest) EncryptionKey() {
+	err := t.run("--encryption-key", "taco", "some-bucket", "/mnt/gcs")
+	ExpectThat(err, Error(HasSubstr("--encryption-key-file")))
+}
+
+func (t *SystemdUnitTest) InvalidFlags() {
+	err := t.run(
+		"--write-back-delay", "1s",
+		"--write-lease-ttl", "1m",
+		"some-bucket",
+		"/mnt/gcs")
+
+	ExpectThat(err, Error(HasSubstr("can't be used with --write-lease-ttl")))
+}
+
+func (t *SystemdUnitTest) RepeatedFlags() {
+	err := t.run(
+		"--include", "*.txt",
+		"--include", "*.csv",
+		"--exclude", "tmp/**",
+		"some-bucket",
+		"/mnt/gcs")
+
+	AssertEq(nil, err)
+
+	unit := t.readUnit("mnt-gcs.mount")
+	ExpectThat(
+		unitSettings(unit, "Options"),
+		ElementsAre("_netdev,include=*.txt,include=*.csv,exclude=tmp/**"))
+}
+
+func (t *SystemdUnitTest) EmptyListInConfigFile() {
+	// The config file is named in the unit and read when mounting, so an empty
+	// list there gives no options of its own.
+	configFile := path.Join(t.dir, "gcsfuse.yaml")
+	err := ioutil.WriteFile(configFile, []byte("include: []\n"), 0644)
+	AssertEq(nil, err)
+
+	err = t.run("--config-file", configFile, "some-bucket", "/mnt/gcs")
+	AssertEq(nil, err)
+
+	unit := t.readUnit("mnt-gcs.mount")
+	ExpectThat(
+		unitSettings(unit, "Options"),
+		ElementsAre("_netdev,config_file="+configFile))
+}
+
+func (t *SystemdUnitTest) WrongNumberOfArgs() {
+	err := t.run("some-bucket")
+	ExpectThat(err, Error(HasSubstr("two arguments")))
+}
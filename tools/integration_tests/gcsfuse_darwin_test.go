@@ -19,10 +19,16 @@
 package integration_test
 
 import (
+	"io/ioutil"
 	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
 	"syscall"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 )
 
@@ -53,7 +59,7 @@ func (t *GcsfuseTest) Statfs() {
 	var stat syscall.Statfs_t
 
 	// Mount.
-	args := []string{canned.FakeBucketName, t.dir}
+	args := []string{gBucketName, t.dir}
 
 	err = t.runGcsfuse(args)
 	AssertEq(nil, err)
@@ -78,5 +84,88 @@ func (t *GcsfuseTest) Statfs() {
 	ExpectEq(1<<20, stat.Iosize)
 
 	// The file system name should be the bucket's name.
-	ExpectEq(canned.FakeBucketName, convertStatfsString(stat.Mntfromname[:]))
+	ExpectEq(gBucketName, convertStatfsString(stat.Mntfromname[:]))
+}
+
+func (t *GcsfuseTest) VolumeName() {
+	var err error
+
+	// Mount with a name for the Finder other than the bucket's.
+	args := []string{"-o", "volname=taco", gBucketName, t.dir}
+
+	err = t.runGcsfuse(args)
+	AssertEq(nil, err)
+	defer unmount(t.dir)
+
+	// The file system should work as usual.
+	contents, err := ioutil.ReadFile(path.Join(t.dir, canned.TopLevelFile))
+	AssertEq(nil, err)
+	ExpectEq(canned.TopLevelFile_Contents, string(contents))
+}
+
+func (t *GcsfuseTest) VolumeIcon() {
+	var err error
+
+	// Write an icon somewhere other than the mount point.
+	iconDir, err := ioutil.TempDir("", "gcsfuse_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(iconDir)
+
+	icon := path.Join(iconDir, "bucket.icns")
+	err = ioutil.WriteFile(icon, []byte("taco"), 0644)
+	AssertEq(nil, err)
+
+	// Mount.
+	args := []string{"-o", "volicon=" + icon, gBucketName, t.dir}
+
+	err = t.runGcsfuse(args)
+	AssertEq(nil, err)
+	defer unmount(t.dir)
+
+	// The Finder should find the icon at the root...
+	contents, err := ioutil.ReadFile(path.Join(t.dir, ".VolumeIcon.icns"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// ...and be told to look for it.
+	output, err := exec.Command(
+		"xattr", "-px", "com.apple.FinderInfo", t.dir).CombinedOutput()
+
+	AssertEq(nil, err, "%s", output)
+	ExpectThat(
+		strings.Fields(string(output)),
+		ElementsAre(
+			"00", "00", "00", "00", "00", "00", "00", "00",
+			"04", "00", "00", "00", "00", "00", "00", "00",
+			"00", "00", "00", "00", "00", "00", "00", "00",
+			"00", "00", "00", "00", "00", "00", "00", "00"))
+}
+
+func (t *GcsfuseTest) VolumeIcon_RelativePath() {
+	var err error
+
+	// The daemon runs in the root directory, so a relative path is refused.
+	args := []string{"-o", "volicon=bucket.icns", gBucketName, t.dir}
+
+	err = t.runGcsfuse(args)
+	ExpectThat(err, Error(HasSubstr("absolute path")))
+}
+
+func (t *GcsfuseTest) UnmountWithUmount() {
+	var err error
+
+	// Mount.
+	args := []string{gBucketName, t.dir}
+
+	err = t.runGcsfuse(args)
+	AssertEq(nil, err)
+
+	// Unmount the way users do, without any help from us.
+	output, err := exec.Command("umount", t.dir).CombinedOutput()
+	AssertEq(nil, err, "%s", output)
+
+	// The mount point should be empty again.
+	entries, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+	ExpectThat(entries, ElementsAre())
 }
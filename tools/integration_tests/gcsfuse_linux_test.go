@@ -22,7 +22,6 @@ import (
 	"math"
 	"syscall"
 
-	"github.com/googlecloudplatform/gcsfuse/internal/canned"
 	. "github.com/jacobsa/ogletest"
 )
 
@@ -35,7 +34,7 @@ func (t *GcsfuseTest) Statfs() {
 	var stat syscall.Statfs_t
 
 	// Mount.
-	args := []string{canned.FakeBucketName, t.dir}
+	args := []string{gBucketName, t.dir}
 
 	err = t.runGcsfuse(args)
 	AssertEq(nil, err)
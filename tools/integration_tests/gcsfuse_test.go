@@ -22,7 +22,6 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"runtime"
 	"strings"
 	"syscall"
 	"testing"
@@ -59,6 +58,10 @@ func (t *GcsfuseTest) SetUp(_ *TestInfo) {
 	var err error
 	t.gcsfusePath = path.Join(gBuildDir, "bin/gcsfuse")
 
+	// Make sure the bucket has its canned contents.
+	err = resetBucket()
+	AssertEq(nil, err)
+
 	// Set up the temporary directory.
 	t.dir, err = ioutil.TempDir("", "gcsfuse_test")
 	AssertEq(nil, err)
@@ -72,7 +75,7 @@ func (t *GcsfuseTest) TearDown() {
 // Create an appropriate exec.Cmd for running gcsfuse, setting the required
 // environment.
 func (t *GcsfuseTest) gcsfuseCommand(args []string, env []string) (cmd *exec.Cmd) {
-	cmd = exec.Command(t.gcsfusePath, args...)
+	cmd = exec.Command(t.gcsfusePath, append(endpointArgs(), args...)...)
 	cmd.Env = make([]string, len(env))
 	copy(cmd.Env, env)
 
@@ -131,19 +134,19 @@ func (t *GcsfuseTest) BadUsage() {
 	}{
 		// Too few args
 		0: {
-			[]string{canned.FakeBucketName},
+			[]string{gBucketName},
 			"exactly two arguments",
 		},
 
 		// Too many args
 		1: {
-			[]string{canned.FakeBucketName, "a", "b"},
+			[]string{gBucketName, "a", "b"},
 			"exactly two arguments",
 		},
 
 		// Unknown flag
 		2: {
-			[]string{"--tweak_frobnicator", canned.FakeBucketName, "a"},
+			[]string{"--tweak_frobnicator", gBucketName, "a"},
 			"not defined.*tweak_frobnicator",
 		},
 	}
@@ -162,7 +165,7 @@ func (t *GcsfuseTest) NonExistentMountPoint() {
 	var err error
 
 	// Mount.
-	args := []string{canned.FakeBucketName, path.Join(t.dir, "blahblah")}
+	args := []string{gBucketName, path.Join(t.dir, "blahblah")}
 
 	err = t.runGcsfuse(args)
 	ExpectThat(err, Error(HasSubstr("no such")))
@@ -172,11 +175,6 @@ func (t *GcsfuseTest) NonExistentMountPoint() {
 func (t *GcsfuseTest) NonEmptyMountPoint() {
 	var err error
 
-	// osxfuse apparently doesn't care about this.
-	if runtime.GOOS == "darwin" {
-		return
-	}
-
 	// Write a file into the mount point.
 	p := path.Join(t.dir, "foo")
 	err = ioutil.WriteFile(p, nil, 0600)
@@ -185,7 +183,7 @@ func (t *GcsfuseTest) NonEmptyMountPoint() {
 	defer os.Remove(p)
 
 	// Mount.
-	args := []string{canned.FakeBucketName, t.dir}
+	args := []string{gBucketName, t.dir}
 
 	err = t.runGcsfuse(args)
 	ExpectThat(err, Error(HasSubstr("is not empty")))
@@ -202,7 +200,7 @@ func (t *GcsfuseTest) MountPointIsAFile() {
 	defer os.Remove(p)
 
 	// Mount.
-	args := []string{canned.FakeBucketName, p}
+	args := []string{gBucketName, p}
 
 	err = t.runGcsfuse(args)
 	ExpectThat(err, Error(HasSubstr(p)))
@@ -212,6 +210,12 @@ func (t *GcsfuseTest) MountPointIsAFile() {
 func (t *GcsfuseTest) KeyFile() {
 	const nonexistent = "/tmp/foobarbazdoesntexist"
 
+	// gcsfuse doesn't look for credentials when talking to an emulator.
+	if *fEndpoint != "" {
+		log.Println("Skipping KeyFile test when running against an emulator.")
+		return
+	}
+
 	// Specify a non-existent key file in two different ways.
 	testCases := []struct {
 		extraArgs []string
@@ -249,7 +253,7 @@ func (t *GcsfuseTest) CannedContents() {
 	var fi os.FileInfo
 
 	// Mount.
-	args := []string{canned.FakeBucketName, t.dir}
+	args := []string{gBucketName, t.dir}
 
 	err = t.runGcsfuse(args)
 	AssertEq(nil, err)
@@ -278,7 +282,7 @@ func (t *GcsfuseTest) ReadOnlyMode() {
 	var err error
 
 	// Mount.
-	args := []string{"-o", "ro", canned.FakeBucketName, t.dir}
+	args := []string{"-o", "ro", gBucketName, t.dir}
 
 	err = t.runGcsfuse(args)
 	AssertEq(nil, err)
@@ -293,7 +297,7 @@ func (t *GcsfuseTest) ReadWriteMode() {
 	var err error
 
 	// Mount.
-	args := []string{canned.FakeBucketName, t.dir}
+	args := []string{gBucketName, t.dir}
 
 	err = t.runGcsfuse(args)
 	AssertEq(nil, err)
@@ -318,7 +322,7 @@ func (t *GcsfuseTest) FileAndDirModeFlags() {
 	args := []string{
 		"--file-mode", "461",
 		"--dir-mode", "511",
-		canned.FakeBucketName,
+		gBucketName,
 		t.dir,
 	}
 
@@ -346,7 +350,7 @@ func (t *GcsfuseTest) UidAndGidFlags() {
 		"--uid", "1719",
 		"--gid", "2329",
 		"--dir-mode", "555",
-		canned.FakeBucketName,
+		gBucketName,
 		t.dir,
 	}
 
@@ -373,7 +377,7 @@ func (t *GcsfuseTest) ImplicitDirs() {
 	// Mount with implicit directories enabled.
 	args := []string{
 		"--implicit-dirs",
-		canned.FakeBucketName,
+		gBucketName,
 		t.dir,
 	}
 
@@ -399,7 +403,7 @@ func (t *GcsfuseTest) OnlyDir() {
 	args := []string{
 		"--only-dir",
 		path.Dir(canned.ExplicitDirFile),
-		canned.FakeBucketName,
+		gBucketName,
 		t.dir,
 	}
 
@@ -425,7 +429,7 @@ func (t *GcsfuseTest) OnlyDir_TrailingSlash() {
 	args := []string{
 		"--only-dir",
 		path.Dir(canned.ExplicitDirFile) + "/",
-		canned.FakeBucketName,
+		gBucketName,
 		t.dir,
 	}
 
@@ -451,7 +455,7 @@ func (t *GcsfuseTest) OnlyDir_WithImplicitDir() {
 	args := []string{
 		"--only-dir",
 		path.Dir(canned.ImplicitDirFile),
-		canned.FakeBucketName,
+		gBucketName,
 		t.dir,
 	}
 
@@ -472,7 +476,7 @@ func (t *GcsfuseTest) OnlyDir_WithImplicitDir() {
 func (t *GcsfuseTest) RelativeMountPoint() {
 	// Start gcsfuse with a relative mount point.
 	cmd := t.gcsfuseCommand([]string{
-		canned.FakeBucketName,
+		gBucketName,
 		path.Base(t.dir),
 	},
 		nil)
@@ -495,7 +499,7 @@ func (t *GcsfuseTest) ForegroundMode() {
 	// Start gcsfuse, writing stderr to a pipe.
 	cmd := t.gcsfuseCommand([]string{
 		"--foreground",
-		canned.FakeBucketName,
+		gBucketName,
 		t.dir,
 	},
 		nil)
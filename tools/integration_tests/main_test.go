@@ -20,13 +20,36 @@ import (
 	"go/build"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"runtime"
 	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/gcloud/httputil"
 )
 
+var fEndpoint = flag.String(
+	"endpoint",
+	"",
+	"If set, the URL of a GCS emulator (e.g. fake-gcs-server) against which to "+
+		"run the tests, in place of gcsfuse's built-in fake bucket.")
+
+var fBucket = flag.String(
+	"bucket",
+	"gcsfuse-integration-tests",
+	"The name of an existing bucket on the emulator given by --endpoint. Its "+
+		"contents are deleted and replaced before each test.")
+
 // A directory containing outputs created by build_gcsfuse, set up and deleted
 // in TestMain.
 var gBuildDir string
@@ -35,6 +58,14 @@ var gBuildDir string
 // variable in order to successfully mount. Set by TestMain.
 var gFusermountPath string
 
+// The name of the bucket that tests should mount, whose initial contents are
+// described in package canned. Set by TestMain.
+var gBucketName string
+
+// When running against an emulator, the bucket named by gBucketName. Set by
+// TestMain.
+var gEmulatorBucket gcs.Bucket
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	var err error
@@ -47,6 +78,16 @@ func TestMain(m *testing.M) {
 		}
 	}
 
+	// Choose the bucket to mount.
+	gBucketName = canned.FakeBucketName
+	if *fEndpoint != "" {
+		gBucketName = *fBucket
+		gEmulatorBucket, err = openEmulatorBucket(*fEndpoint, gBucketName)
+		if err != nil {
+			log.Fatalf("openEmulatorBucket: %v", err)
+		}
+	}
+
 	// Set up a directory into which we will build.
 	gBuildDir, err = ioutil.TempDir("", "gcsfuse_integration_tests")
 	if err != nil {
@@ -174,3 +215,79 @@ func buildBuildGcsfuse(dst string) (err error) {
 
 	return
 }
+
+// Open the named bucket on the emulator at the supplied endpoint, in the same
+// way that gcsfuse does when given --endpoint.
+func openEmulatorBucket(
+	endpoint string,
+	name string) (b gcs.Bucket, err error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		err = fmt.Errorf("url.Parse: %v", err)
+		return
+	}
+
+	transport, err := gcsx.NewEndpointRoundTripper(
+		u,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	if err != nil {
+		err = fmt.Errorf("NewEndpointRoundTripper: %v", err)
+		return
+	}
+
+	conn, err := gcs.NewConn(&gcs.ConnConfig{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "none"}),
+		Transport:   transport,
+	})
+
+	if err != nil {
+		err = fmt.Errorf("NewConn: %v", err)
+		return
+	}
+
+	b, err = conn.OpenBucket(
+		context.Background(),
+		&gcs.OpenBucketOptions{Name: name})
+
+	if err != nil {
+		err = fmt.Errorf("OpenBucket: %v", err)
+		return
+	}
+
+	return
+}
+
+// When running against an emulator, restore the bucket to its canned contents,
+// undoing any changes made by earlier tests. Otherwise do nothing, since each
+// mount of the fake bucket starts afresh.
+func resetBucket() (err error) {
+	if gEmulatorBucket == nil {
+		return
+	}
+
+	ctx := context.Background()
+	err = gcsutil.DeleteAllObjects(ctx, gEmulatorBucket)
+	if err != nil {
+		err = fmt.Errorf("DeleteAllObjects: %v", err)
+		return
+	}
+
+	err = canned.PopulateBucket(ctx, gEmulatorBucket)
+	if err != nil {
+		err = fmt.Errorf("PopulateBucket: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return any arguments that must be passed to gcsfuse so that it can mount
+// gBucketName.
+func endpointArgs() (args []string) {
+	if *fEndpoint != "" {
+		args = []string{fmt.Sprintf("--endpoint=%s", *fEndpoint)}
+	}
+
+	return
+}
@@ -64,6 +64,10 @@ func (t *MountHelperTest) SetUp(_ *TestInfo) {
 		AbortTest()
 	}
 
+	// Make sure the bucket has its canned contents.
+	err = resetBucket()
+	AssertEq(nil, err)
+
 	// Set up the temporary directory.
 	t.dir, err = ioutil.TempDir("", "mount_helper_test")
 	AssertEq(nil, err)
@@ -76,6 +80,12 @@ func (t *MountHelperTest) TearDown() {
 
 func (t *MountHelperTest) mountHelperCommand(args []string) (cmd *exec.Cmd) {
 	cmd = exec.Command(t.helperPath)
+
+	// Point gcsfuse at the emulator, if any, via the helper's options.
+	if *fEndpoint != "" {
+		cmd.Args = append(cmd.Args, "-o", fmt.Sprintf("endpoint=%s", *fEndpoint))
+	}
+
 	cmd.Args = append(cmd.Args, args...)
 	cmd.Env = []string{
 		fmt.Sprintf("PATH=%s", path.Join(gBuildDir, "bin")),
@@ -107,19 +117,19 @@ func (t *MountHelperTest) BadUsage() {
 	}{
 		// Too few args
 		0: {
-			[]string{canned.FakeBucketName},
+			[]string{gBucketName},
 			"two positional arguments",
 		},
 
 		// Too many args
 		1: {
-			[]string{canned.FakeBucketName, "a", "b"},
+			[]string{gBucketName, "a", "b"},
 			"Unexpected arg 3",
 		},
 
 		// Trailing -o
 		2: {
-			[]string{canned.FakeBucketName, "a", "-o"},
+			[]string{gBucketName, "a", "-o"},
 			"Unexpected -o",
 		},
 	}
@@ -138,7 +148,7 @@ func (t *MountHelperTest) NoMtabFlag() {
 	var err error
 
 	// Mount. The "-n" argument should be ignored.
-	args := []string{canned.FakeBucketName, t.dir, "-n"}
+	args := []string{gBucketName, t.dir, "-n"}
 
 	err = t.mount(args)
 	AssertEq(nil, err)
@@ -150,7 +160,7 @@ func (t *MountHelperTest) SuccessfulMount() {
 	var fi os.FileInfo
 
 	// Mount.
-	args := []string{canned.FakeBucketName, t.dir}
+	args := []string{gBucketName, t.dir}
 
 	err = t.mount(args)
 	AssertEq(nil, err)
@@ -169,7 +179,7 @@ func (t *MountHelperTest) RelativeMountPoint() {
 
 	// Mount with a relative mount point.
 	cmd := t.mountHelperCommand([]string{
-		canned.FakeBucketName,
+		gBucketName,
 		path.Base(t.dir),
 	})
 
@@ -191,7 +201,7 @@ func (t *MountHelperTest) ReadOnlyMode() {
 	var err error
 
 	// Mount.
-	args := []string{"-o", "ro", canned.FakeBucketName, t.dir}
+	args := []string{"-o", "ro", gBucketName, t.dir}
 
 	err = t.mount(args)
 	AssertEq(nil, err)
@@ -209,7 +219,7 @@ func (t *MountHelperTest) ExtraneousOptions() {
 	// Mount with extra junk that shouldn't be passed on.
 	args := []string{
 		"-o", "noauto,nouser,no_netdev,auto,user,_netdev",
-		canned.FakeBucketName,
+		gBucketName,
 		t.dir,
 	}
 
@@ -228,7 +238,7 @@ func (t *MountHelperTest) LinuxArgumentOrder() {
 	var err error
 
 	// Linux places the options at the end.
-	args := []string{canned.FakeBucketName, t.dir, "-o", "ro"}
+	args := []string{gBucketName, t.dir, "-o", "ro"}
 
 	err = t.mount(args)
 	AssertEq(nil, err)
@@ -250,7 +260,7 @@ func (t *MountHelperTest) FuseSubtype() {
 
 	// Mount using the tool that would be invoked by ~mount -t fuse.gcsfuse`.
 	t.helperPath = path.Join(gBuildDir, "sbin/mount.fuse.gcsfuse")
-	args := []string{canned.FakeBucketName, t.dir}
+	args := []string{gBucketName, t.dir}
 
 	err = t.mount(args)
 	AssertEq(nil, err)
@@ -271,7 +281,7 @@ func (t *MountHelperTest) ModeOptions() {
 	args := []string{
 		"-o", "dir_mode=754",
 		"-o", "file_mode=612",
-		canned.FakeBucketName, t.dir,
+		gBucketName, t.dir,
 	}
 
 	err = t.mount(args)
@@ -293,7 +303,7 @@ func (t *MountHelperTest) ImplicitDirs() {
 	var err error
 
 	// Mount.
-	args := []string{"-o", "implicit_dirs", canned.FakeBucketName, t.dir}
+	args := []string{"-o", "implicit_dirs", gBucketName, t.dir}
 
 	err = t.mount(args)
 	AssertEq(nil, err)
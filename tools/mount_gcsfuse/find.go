@@ -16,12 +16,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 )
 
-// Find the path to the fusermount command for this system, returning "" if
-// we're not running on Linux.
+// Find the path to the fusermount command for this system, preferring that of
+// fuse 3, returning "" if we're not running on Linux.
 func findFusermount() (p string, err error) {
 	if runtime.GOOS != "linux" {
 		return
@@ -32,6 +35,8 @@ func findFusermount() (p string, err error) {
 	// list of candidates. These are directories where I've seen it live on
 	// various distributions.
 	candidates := []string{
+		"/bin/fusermount3",
+		"/usr/bin/fusermount3",
 		"/bin/fusermount",
 		"/usr/bin/fusermount",
 	}
@@ -72,3 +77,64 @@ func findGcsfuse() (p string, err error) {
 	err = errors.New("Can't find a usable executable.")
 	return
 }
+
+// A FUSE implementation for OS X, identified by a file that its installer
+// leaves behind.
+type osxFUSEImplementation struct {
+	name   string
+	marker string
+
+	// Does the fuse package that gcsfuse is built with know how to talk to it?
+	supported bool
+}
+
+// Implementations in order of preference. The supported entries must match
+// the installations that package fuse searches for. fuse-t is listed only to
+// explain why mounting fails: package fuse can't talk to it.
+var osxFUSEImplementations = []osxFUSEImplementation{
+	{"macFUSE", "/Library/Filesystems/macfuse.fs/Contents/Resources/mount_macfuse", true},
+	{"osxfuse", "/Library/Filesystems/osxfuse.fs/Contents/Resources/mount_osxfuse", true},
+	{"osxfuse", "/Library/Filesystems/osxfusefs.fs/Support/mount_osxfusefs", true},
+	{"fuse-t", "/usr/local/lib/libfuse-t.dylib", false},
+}
+
+// Make sure that a FUSE implementation usable by gcsfuse is installed, so that
+// we can give a clear error rather than an opaque one from gcsfuse. Does
+// nothing if goos isn't "darwin". exists reports whether a marker file is
+// present.
+func checkOSXFUSE(
+	goos string,
+	exists func(path string) bool) (err error) {
+	if goos != "darwin" {
+		return
+	}
+
+	var unsupported []string
+	for _, impl := range osxFUSEImplementations {
+		if !exists(impl.marker) {
+			continue
+		}
+
+		if impl.supported {
+			return
+		}
+
+		unsupported = append(unsupported, impl.name)
+	}
+
+	if len(unsupported) != 0 {
+		err = fmt.Errorf(
+			"Found %s, which gcsfuse can't use. Please install macFUSE.",
+			strings.Join(unsupported, " and "))
+		return
+	}
+
+	err = errors.New("Can't find macFUSE. Please install it.")
+	return
+}
+
+// Does a file exist at the supplied path?
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFind(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	macFUSEMarker = "/Library/Filesystems/macfuse.fs/Contents/Resources/mount_macfuse"
+	osxfuseMarker = "/Library/Filesystems/osxfuse.fs/Contents/Resources/mount_osxfuse"
+	fuseTMarker   = "/usr/local/lib/libfuse-t.dylib"
+)
+
+type CheckOSXFUSETest struct {
+}
+
+func init() { RegisterTestSuite(&CheckOSXFUSETest{}) }
+
+// Run checkOSXFUSE on OS X with only the supplied marker files present.
+func checkWith(markers ...string) (err error) {
+	present := make(map[string]bool)
+	for _, m := range markers {
+		present[m] = true
+	}
+
+	err = checkOSXFUSE("darwin", func(path string) bool { return present[path] })
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CheckOSXFUSETest) NotOSX() {
+	err := checkOSXFUSE("linux", func(path string) bool {
+		AddFailure("Unexpected stat of %q", path)
+		return false
+	})
+
+	ExpectEq(nil, err)
+}
+
+func (t *CheckOSXFUSETest) MacFUSE() {
+	ExpectEq(nil, checkWith(macFUSEMarker))
+}
+
+func (t *CheckOSXFUSETest) OSXFUSEOnly() {
+	ExpectEq(nil, checkWith(osxfuseMarker))
+}
+
+func (t *CheckOSXFUSETest) FuseTOnly() {
+	err := checkWith(fuseTMarker)
+	ExpectThat(err, Error(HasSubstr("fuse-t")))
+	ExpectThat(err, Error(HasSubstr("install macFUSE")))
+}
+
+func (t *CheckOSXFUSETest) FuseTAndMacFUSE() {
+	ExpectEq(nil, checkWith(fuseTMarker, macFUSEMarker))
+}
+
+func (t *CheckOSXFUSETest) NothingInstalled() {
+	err := checkWith()
+	ExpectThat(err, Error(HasSubstr("Can't find macFUSE")))
+}
@@ -59,6 +59,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
 	"strings"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/mount"
@@ -71,42 +72,55 @@ import (
 func makeGcsfuseArgs(
 	device string,
 	mountPoint string,
-	opts map[string]string) (args []string, err error) {
-	// Deal with options.
-	for name, value := range opts {
+	opts []mount.Option) (args []string, err error) {
+	// Deal with options, in order, so that those for flags that may be
+	// repeated, such as include, each become a flag.
+	for _, o := range opts {
+		name, value := o.Name, o.Value
+
+		switch name {
+		// We wait for gcsfuse to mount and go into the background.
+		case mount.FlagOptionPrefix + "foreground":
+			err = fmt.Errorf("%s can't be used with mount(8)", name)
+			return
+
+		// The key would be on gcsfuse's command line, which we log and which other
+		// users can see.
+		case mount.FlagOptionPrefix + "encryption-key":
+			err = fmt.Errorf("%s can't be used; use encryption_key_file", name)
+			return
+		}
+
+		// Translate options corresponding to gcsfuse flags.
+		if flagArgs, ok := mount.FlagArgs(name, value); ok {
+			args = append(args, flagArgs...)
+			continue
+		}
+
+		// Don't pass through options meant for other userspace programs, such as
+		// x-systemd.automount and x-systemd.idle-timeout, which systemd's fstab
+		// generator acts on and mount(8) passes along to us.
+		if strings.HasPrefix(name, "x-") {
+			continue
+		}
+
 		switch name {
-		// Don't pass through options that are relevant to mount(8) but not to
-		// gcsfuse, and that fusermount chokes on with "Invalid argument" on Linux.
-		case "user", "nouser", "auto", "noauto", "_netdev", "no_netdev":
-
-		// Special case: support mount-like formatting for gcsfuse bool flags.
-		case "implicit_dirs":
-			args = append(
-				args,
-				"--"+strings.Replace(name, "_", "-", -1),
-			)
-
-			// Special case: support mount-like formatting for gcsfuse string flags.
-		case "dir_mode", "file_mode", "key_file", "temp_dir", "gid", "uid", "only_dir", "limit_ops_per_sec", "limit_bytes_per_sec", "stat_cache_ttl", "type_cache_ttl", "billing_project":
-			args = append(
-				args,
-				"--"+strings.Replace(name, "_", "-", -1),
-				value,
-			)
-
-			// Special case: support mount-like formatting for gcsfuse debug flags.
-		case "debug_fuse", "debug_gcs", "debug_http", "debug_invariants":
-			args = append(
-				args,
-				"--"+name,
-			)
-
-		// Pass through everything else.
+		// Don't pass through options that are relevant to mount(8) or systemd but
+		// not to gcsfuse, and that fusermount chokes on with "Invalid argument"
+		// on Linux.
+		case "user", "nouser", "users", "auto", "noauto", "_netdev", "no_netdev",
+			"nofail", "defaults", "comment":
+
+		// Pass through everything else, quoting values that contain commas
+		// (such as SELinux contexts) as mount(8) does.
 		default:
 			var formatted string
-			if value == "" {
+			switch {
+			case value == "":
 				formatted = name
-			} else {
+			case strings.Contains(value, ","):
+				formatted = fmt.Sprintf("%s=\"%s\"", name, value)
+			default:
 				formatted = fmt.Sprintf("%s=%s", name, value)
 			}
 
@@ -126,10 +140,8 @@ func parseArgs(
 	args []string) (
 	device string,
 	mountPoint string,
-	opts map[string]string,
+	opts []mount.Option,
 	err error) {
-	opts = make(map[string]string)
-
 	// Process each argument in turn.
 	positionalCount := 0
 	for i, s := range args {
@@ -156,9 +168,15 @@ func parseArgs(
 		case s == "-n":
 			continue
 
+		// mount(8) passes on -s (sloppy), which asks us to ignore options we
+		// don't understand, and -v (verbose). We pass unknown options on to
+		// gcsfuse regardless, and always say how we call it.
+		case s == "-s" || s == "-v":
+			continue
+
 		// Is this an options string following a "-o"?
 		case i > 0 && args[i-1] == "-o":
-			mount.ParseOptions(opts, s)
+			opts = mount.ParseOptionList(opts, s)
 
 		// Is this the device?
 		case positionalCount == 0:
@@ -210,6 +228,13 @@ func run(args []string) (err error) {
 		return
 	}
 
+	// On OS X, make sure there's a FUSE implementation gcsfuse can use.
+	err = checkOSXFUSE(runtime.GOOS, fileExists)
+	if err != nil {
+		err = fmt.Errorf("checkOSXFUSE: %v", err)
+		return
+	}
+
 	// Attempt to parse arguments.
 	device, mountPoint, opts, err := parseArgs(args)
 	if err != nil {
@@ -217,6 +242,14 @@ func run(args []string) (err error) {
 		return
 	}
 
+	// Expand environment variables in option values, so that one fstab entry
+	// can name files in different places on different hosts.
+	err = mount.ExpandOptions(opts, os.LookupEnv)
+	if err != nil {
+		err = fmt.Errorf("ExpandOptions: %v", err)
+		return
+	}
+
 	// Choose gcsfuse args.
 	gcsfuseArgs, err := makeGcsfuseArgs(device, mountPoint, opts)
 	if err != nil {
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/mount"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMountHelper(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MountHelperTest struct {
+}
+
+func init() { RegisterTestSuite(&MountHelperTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MountHelperTest) ParseArgs() {
+	testCases := []struct {
+		args     []string
+		expected []mount.Option
+	}{
+		// OS X style
+		{
+			[]string{"mount_gcsfuse", "-o", "ro", "-o", "uid=1", "b", "/mp"},
+			[]mount.Option{{Name: "ro"}, {Name: "uid", Value: "1"}},
+		},
+
+		// Linux style
+		{
+			[]string{"mount.gcsfuse", "b", "/mp", "-o", "rw,noexec,uid=1"},
+			[]mount.Option{
+				{Name: "rw"},
+				{Name: "noexec"},
+				{Name: "uid", Value: "1"},
+			},
+		},
+
+		// Flags passed by mount(8) and systemd, which are ignored
+		{
+			[]string{"mount.gcsfuse", "b", "/mp", "-n", "-s", "-v", "-o", "rw"},
+			[]mount.Option{{Name: "rw"}},
+		},
+
+		{
+			[]string{"mount.gcsfuse", "-s", "b", "-v", "/mp"},
+			nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		device, mountPoint, opts, err := parseArgs(tc.args)
+		AssertEq(nil, err, "args: %q", tc.args)
+		ExpectEq("b", device, "args: %q", tc.args)
+		ExpectEq("/mp", mountPoint, "args: %q", tc.args)
+		ExpectThat(opts, DeepEquals(tc.expected), "args: %q", tc.args)
+	}
+}
+
+func (t *MountHelperTest) ParseArgs_Errors() {
+	testCases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"mount.gcsfuse", "b", "/mp", "-o"}, "-o at end"},
+		{[]string{"mount.gcsfuse", "b"}, "got 1"},
+		{[]string{"mount.gcsfuse", "b", "/mp", "c"}, "Unexpected arg 3"},
+	}
+
+	for _, tc := range testCases {
+		_, _, _, err := parseArgs(tc.args)
+		ExpectThat(err, Error(HasSubstr(tc.expected)), "args: %q", tc.args)
+	}
+}
+
+func (t *MountHelperTest) MakeGcsfuseArgs() {
+	testCases := []struct {
+		opts     string
+		expected []string
+	}{
+		// Options meant for mount(8), systemd, and other programs are dropped.
+		{
+			"rw,user,noauto,_netdev,nofail,defaults,comment=systemd.foo",
+			[]string{"-o", "rw", "b", "/mp"},
+		},
+
+		{
+			"x-systemd.automount,x-systemd.idle-timeout=10min,x-gvfs-show,ro",
+			[]string{"-o", "ro", "b", "/mp"},
+		},
+
+		// Options for flags become flags, in order.
+		{
+			"implicit_dirs,uid=1000,include=*.txt,include=*.csv",
+			[]string{
+				"--implicit-dirs",
+				"--uid", "1000",
+				"--include", "*.txt",
+				"--include", "*.csv",
+				"b", "/mp",
+			},
+		},
+
+		// Other options are passed through, quoted if they contain commas.
+		{
+			`noatime,context="system_u:object_r:tmp_t:s0:c1,c2"`,
+			[]string{
+				"-o", "noatime",
+				"-o", `context="system_u:object_r:tmp_t:s0:c1,c2"`,
+				"b", "/mp",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		opts := mount.ParseOptionList(nil, tc.opts)
+		args, err := makeGcsfuseArgs("b", "/mp", opts)
+
+		AssertEq(nil, err, "opts: %s", tc.opts)
+		ExpectThat(args, DeepEquals(tc.expected), "opts: %s", tc.opts)
+	}
+}
+
+func (t *MountHelperTest) MakeGcsfuseArgs_Refused() {
+	testCases := []string{
+		"gcsfuse_flag.foreground",
+		"gcsfuse_flag.encryption-key=taco",
+	}
+
+	for _, tc := range testCases {
+		opts := mount.ParseOptionList(nil, tc)
+		_, err := makeGcsfuseArgs("b", "/mp", opts)
+		ExpectNe(nil, err, "opts: %s", tc)
+	}
+}
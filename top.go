@@ -0,0 +1,295 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// The most in-flight ops and uploads to show.
+const topMaxRows = 10
+
+// Clears a terminal and moves the cursor to the top left.
+const clearScreen = "\033[H\033[2J"
+
+// Present the supplied number of bytes in a human-readable format.
+func formatBytes(v float64) string {
+	switch {
+	case v >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", v/(1<<30))
+
+	case v >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", v/(1<<20))
+
+	case v >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", v/(1<<10))
+
+	default:
+		return fmt.Sprintf("%.0f B", v)
+	}
+}
+
+// The rate of ops of one type between two snapshots.
+type opRate struct {
+	name       string
+	opsPerSec  float64
+	errsPerSec float64
+	avgLatency time.Duration
+}
+
+// Write a screenful describing the activity of a mount between the supplied
+// snapshots. If prev is nil, rates are averaged over the life of the mount.
+func writeTop(
+	w io.Writer,
+	mountPoint string,
+	prev *mountStats,
+	cur *mountStats) (err error) {
+	// Work out what to subtract.
+	var base mountStats
+	base.Time = cur.FS.Since
+	if prev != nil {
+		base = *prev
+	}
+
+	seconds := cur.Time.Sub(base.Time).Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	// Compute the rate for each type of op.
+	var rates []opRate
+	var totalOps, totalErrs float64
+	for name, s := range cur.FS.Ops {
+		b := base.FS.Ops[name]
+		count := s.Count - b.Count
+		if count == 0 {
+			continue
+		}
+
+		r := opRate{
+			name:       name,
+			opsPerSec:  float64(count) / seconds,
+			errsPerSec: float64(s.Errors-b.Errors) / seconds,
+			avgLatency: (s.Duration - b.Duration) / time.Duration(count),
+		}
+
+		totalOps += r.opsPerSec
+		totalErrs += r.errsPerSec
+		rates = append(rates, r)
+	}
+
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].opsPerSec != rates[j].opsPerSec {
+			return rates[i].opsPerSec > rates[j].opsPerSec
+		}
+
+		return rates[i].name < rates[j].name
+	})
+
+	// The stat cache hit rate.
+	hitRate := "-"
+	hits := cur.StatCacheHits - base.StatCacheHits
+	misses := cur.StatCacheMisses - base.StatCacheMisses
+	if hits+misses > 0 {
+		hitRate = fmt.Sprintf("%.1f%%", 100*float64(hits)/float64(hits+misses))
+	}
+
+	// Summary.
+	fmt.Fprintf(
+		w,
+		"gcsfuse top - %s - %s\n\n",
+		mountPoint,
+		cur.Time.Format("15:04:05"))
+
+	fmt.Fprintf(
+		w,
+		"Ops: %.1f/s  Errors: %.1f/s  Read: %s/s  Written: %s/s\n",
+		totalOps,
+		totalErrs,
+		formatBytes(float64(cur.FS.BytesRead-base.FS.BytesRead)/seconds),
+		formatBytes(float64(cur.FS.BytesWritten-base.FS.BytesWritten)/seconds))
+
+	fmt.Fprintf(
+		w,
+		"Stat cache hits: %s  Evictions: %.1f/s  Dirty files: %d  Uploads: %d\n",
+		hitRate,
+		float64(cur.StatCacheEvictions-base.StatCacheEvictions)/seconds,
+		cur.FS.DirtyFiles,
+		len(cur.Uploads))
+
+	fmt.Fprintf(
+		w,
+		"Inodes: %d  Open handles: %d\n",
+		cur.FS.Inodes,
+		cur.FS.Handles)
+
+	// Ops by type.
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nOP\tOPS/S\tERRORS/S\tAVG LATENCY")
+	for _, r := range rates {
+		fmt.Fprintf(
+			tw,
+			"%s\t%.1f\t%.1f\t%v\n",
+			r.name,
+			r.opsPerSec,
+			r.errsPerSec,
+			r.avgLatency.Truncate(time.Microsecond))
+	}
+
+	// The slowest in-flight ops, which are the oldest.
+	if len(cur.FS.InFlight) != 0 {
+		fmt.Fprintln(tw, "\nIN FLIGHT\tOP\tNAME")
+		for i, op := range cur.FS.InFlight {
+			if i == topMaxRows {
+				fmt.Fprintf(tw, "...\t%d more\t\n", len(cur.FS.InFlight)-i)
+				break
+			}
+
+			fmt.Fprintf(
+				tw,
+				"%v\t%s\t%s\n",
+				cur.Time.Sub(op.Start).Truncate(time.Millisecond),
+				op.Op,
+				op.Name)
+		}
+	}
+
+	// Pending uploads.
+	if len(cur.Uploads) != 0 {
+		fmt.Fprintln(tw, "\nUPLOADING\tPROGRESS\tNAME")
+		for i, u := range cur.Uploads {
+			if i == topMaxRows {
+				fmt.Fprintf(tw, "...\t%d more\t\n", len(cur.Uploads)-i)
+				break
+			}
+
+			progress := formatBytes(float64(u.BytesUploaded))
+			if u.BytesTotal > 0 {
+				progress = fmt.Sprintf(
+					"%s of %s",
+					progress,
+					formatBytes(float64(u.BytesTotal)))
+			}
+
+			fmt.Fprintf(
+				tw,
+				"%v\t%s\t%s\n",
+				cur.Time.Sub(u.Started).Truncate(time.Second),
+				progress,
+				u.Name)
+		}
+	}
+
+	err = tw.Flush()
+	return
+}
+
+// A command that shows the activity of a mounted file system, refreshing
+// periodically.
+func newTopCommand() cli.Command {
+	return cli.Command{
+		Name:      "top",
+		Usage:     "Show the activity of the file system mounted at a path",
+		ArgsUsage: "mount_point",
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "interval",
+				Value: 2 * time.Second,
+				Usage: "How often to refresh.",
+			},
+
+			cli.IntFlag{
+				Name:  "n",
+				Value: 0,
+				Usage: "Exit after this many refreshes. Zero means never.",
+			},
+		},
+		Action: func(c *cli.Context) (err error) {
+			if len(c.Args()) != 1 {
+				err = errors.New("top takes exactly one argument, the mount point.")
+				return
+			}
+
+			interval := c.Duration("interval")
+			if interval <= 0 {
+				err = errors.New("--interval must be positive.")
+				return
+			}
+
+			mountPoint, err := filepath.Abs(c.Args()[0])
+			if err != nil {
+				err = fmt.Errorf("canonicalizing mount point: %v", err)
+				return
+			}
+
+			err = runTop(mountPoint, interval, c.Int("n"), os.Stdout)
+			return
+		},
+	}
+}
+
+// Repeatedly fetch stats for the given mount and redraw the screen, the first
+// time with rates over the life of the mount.
+func runTop(
+	mountPoint string,
+	interval time.Duration,
+	n int,
+	w io.Writer) (err error) {
+	socket := controlSocketPath(mountPoint)
+
+	var prev *mountStats
+	for i := 0; n == 0 || i < n; i++ {
+		if i != 0 {
+			time.Sleep(interval)
+		}
+
+		var cur *mountStats
+		cur, err = getStats(socket)
+		if err != nil {
+			err = fmt.Errorf(
+				"Contacting gcsfuse for %s (is it mounted by this user?): %v",
+				mountPoint,
+				err)
+			return
+		}
+
+		// Draw off screen, so the terminal doesn't flicker.
+		var buf bytes.Buffer
+		buf.WriteString(clearScreen)
+		err = writeTop(&buf, mountPoint, prev, cur)
+		if err != nil {
+			return
+		}
+
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			return
+		}
+
+		prev = cur
+	}
+
+	return
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestTop(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type TopTest struct {
+	now  time.Time
+	prev mountStats
+	cur  mountStats
+}
+
+func init() { RegisterTestSuite(&TopTest{}) }
+
+func (t *TopTest) SetUp(ti *TestInfo) {
+	t.now = time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)
+
+	// Ten seconds apart.
+	t.prev = mountStats{
+		Time: t.now.Add(-10 * time.Second),
+		FS: fs.Stats{
+			Since: t.now.Add(-time.Hour),
+			Ops: map[string]fs.OpStats{
+				"ReadFile":    {Count: 100, Duration: time.Second},
+				"LookUpInode": {Count: 50, Errors: 5, Duration: time.Second},
+			},
+			BytesRead: 1 << 30,
+		},
+		StatCacheHits:   10,
+		StatCacheMisses: 10,
+	}
+
+	t.cur = mountStats{
+		Time: t.now,
+		FS: fs.Stats{
+			Since: t.now.Add(-time.Hour),
+			Ops: map[string]fs.OpStats{
+				"ReadFile":    {Count: 300, Duration: 3 * time.Second},
+				"LookUpInode": {Count: 60, Errors: 15, Duration: 2 * time.Second},
+				"StatFS":      {Count: 1},
+			},
+			BytesRead:    1<<30 + 100<<20,
+			BytesWritten: 20 << 10,
+			InFlight: []fs.InFlightOp{
+				{
+					Op:    "FlushFile",
+					Name:  "foo/bar",
+					Start: t.now.Add(-1500 * time.Millisecond),
+				},
+			},
+			DirtyFiles: 2,
+			Inodes:     1000,
+			Handles:    3,
+		},
+		StatCacheHits:      40,
+		StatCacheMisses:    20,
+		StatCacheEvictions: 20,
+		Uploads: []gcsx.UploadProgress{
+			{
+				Name:          "foo/bar",
+				BytesUploaded: 1 << 20,
+				BytesTotal:    4 << 20,
+				Started:       t.now.Add(-time.Minute),
+			},
+		},
+	}
+}
+
+func (t *TopTest) render(prev *mountStats) string {
+	var buf bytes.Buffer
+	err := writeTop(&buf, "/mnt/gcs", prev, &t.cur)
+	AssertEq(nil, err)
+	return buf.String()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TopTest) RatesBetweenSnapshots() {
+	out := t.render(&t.prev)
+
+	ExpectThat(out, HasSubstr("gcsfuse top - /mnt/gcs - 02:15:00"))
+	ExpectThat(
+		out,
+		HasSubstr(
+			"Ops: 21.1/s  Errors: 1.0/s  Read: 10.0 MiB/s  Written: 2.0 KiB/s"))
+
+	ExpectThat(
+		out,
+		HasSubstr(
+			"Stat cache hits: 75.0%  Evictions: 2.0/s  Dirty files: 2  Uploads: 1"))
+
+	ExpectThat(out, HasSubstr("Inodes: 1000  Open handles: 3\n"))
+
+	ExpectThat(
+		out,
+		HasSubstr(
+			"OP           OPS/S  ERRORS/S  AVG LATENCY\n"+
+				"ReadFile     20.0   0.0       10ms\n"+
+				"LookUpInode  1.0    1.0       100ms\n"+
+				"StatFS       0.1    0.0       0s\n"))
+}
+
+func (t *TopTest) InFlightAndUploads() {
+	out := t.render(&t.prev)
+
+	ExpectThat(
+		out,
+		HasSubstr(
+			"IN FLIGHT  OP         NAME\n"+
+				"1.5s       FlushFile  foo/bar\n"))
+
+	ExpectThat(
+		out,
+		HasSubstr(
+			"UPLOADING  PROGRESS            NAME\n"+
+				"1m0s       1.0 MiB of 4.0 MiB  foo/bar\n"))
+}
+
+func (t *TopTest) FirstScreenAveragesSinceMount() {
+	out := t.render(nil)
+
+	// 361 ops over an hour.
+	ExpectThat(out, HasSubstr("Ops: 0.1/s"))
+	ExpectThat(out, HasSubstr("Stat cache hits: 66.7%"))
+}
+
+func (t *TopTest) NothingInFlight() {
+	t.cur.FS.InFlight = nil
+	t.cur.Uploads = nil
+
+	out := t.render(&t.prev)
+	ExpectThat(out, Not(HasSubstr("IN FLIGHT")))
+	ExpectThat(out, Not(HasSubstr("UPLOADING")))
+}